@@ -15,6 +15,7 @@ const (
 func main() {
 	internal.CreateMasterHandler()
 	go internal.GlobalMasterHandler.Server()
+	go internal.GlobalMasterHandler.ShutdownOnSignal()
 	http.Handle("/metrics", promhttp.HandlerFor(
 		prometheus.DefaultGatherer,
 		promhttp.HandlerOpts{
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"tinydfs-master/internal"
+)
+
+// snapshotdiff prints how the namespace in a snapshot of master differs from
+// the one in an older snapshot, one FileNode per line. It only reads the two
+// snapshot files, so it can be run offline.
+func main() {
+	oldPath := flag.String("old", "", "path of the older snapshot")
+	newPath := flag.String("new", "", "path of the newer snapshot")
+	flag.Parse()
+	if *oldPath == "" || *newPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	oldFile, err := os.Open(*oldPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fail to open old snapshot, error detail: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer oldFile.Close()
+	newFile, err := os.Open(*newPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fail to open new snapshot, error detail: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer newFile.Close()
+	diffs, err := internal.DiffSnapshots(bufio.NewScanner(oldFile), bufio.NewScanner(newFile))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fail to diff snapshots, error detail: %s\n", err.Error())
+		os.Exit(1)
+	}
+	for _, diff := range diffs {
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", diff.Kind, diff.FileNodeId, diff.Namespace, diff.OldPath, diff.NewPath)
+	}
+}
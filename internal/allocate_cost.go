@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"github.com/spf13/viper"
+	"tinydfs-base/common"
+)
+
+// maxWeightedExploredNodes limits the nodes explored by a search with weighted
+// cost. The best cost of such search is unknown, so it can hardly exit early.
+const maxWeightedExploredNodes = 1 << 16
+
+// AllocateCostWeights are the weights of terms of the cost of a plan which
+// allocates receivers for a batch of Chunk. Each term is normalized to about
+// [0, 1] so that the weights can be compared with each other:
+//  1. Balance: the variance of the number of Chunk received by each DataNode.
+//  2. Capacity: the variance of the usage of each DataNode after receiving.
+//  3. Load: the IOLoad of the receiver of each Chunk relative to the busiest
+//     DataNode.
+//  4. Rack: the variance of the number of Chunk received by each rack, which is
+//     decided by the Tags of master.topologyKeys.
+//  5. Diversity: the ratio of Chunk whose receiver is in a rack which already
+//     has a replica of the Chunk. It is a soft preference for spreading
+//     replicas, which still works when there are too few racks to block.
+//  6. Distance: how near the receiver of each Chunk is to the nearest replica
+//     of the Chunk in topology, which is 1 in the same rack and 0 in another
+//     widest failure domain. It is only used with master.topologyKeys.
+type AllocateCostWeights struct {
+	Balance   float64
+	Capacity  float64
+	Load      float64
+	Rack      float64
+	Diversity float64
+	Distance  float64
+}
+
+// isVarianceOnly returns true if only the balance term is weighted, in which
+// case the cost is the same as the pure variance.
+func (w AllocateCostWeights) isVarianceOnly() bool {
+	return w.Capacity <= 0 && w.Load <= 0 && w.Rack <= 0 && w.Diversity <= 0 && w.Distance <= 0
+}
+
+// getAllocateCostWeights gets the configured AllocateCostWeights. The distance
+// term is weighted by default, so that replicas are spread across failure
+// domains once master.topologyKeys is set.
+func getAllocateCostWeights() AllocateCostWeights {
+	distance := defaultAllocateDistanceWeight
+	if viper.IsSet(MasterAllocateDistanceWeight) {
+		distance = viper.GetFloat64(MasterAllocateDistanceWeight)
+	}
+	return AllocateCostWeights{
+		Balance:   viper.GetFloat64(MasterAllocateBalanceWeight),
+		Capacity:  viper.GetFloat64(MasterAllocateCapacityWeight),
+		Load:      viper.GetFloat64(MasterAllocateLoadWeight),
+		Rack:      viper.GetFloat64(MasterAllocateRackWeight),
+		Diversity: viper.GetFloat64(MasterAllocateDiversityWeight),
+		Distance:  distance,
+	}
+}
+
+// allocateCost calculates the weighted cost of plans of a batch. A nil
+// *allocateCost means the cost is the pure variance.
+type allocateCost struct {
+	weights      AllocateCostWeights
+	chunkNum     int
+	usedCapacity []int
+	fullCapacity []int
+	// loads is the IOLoad of each DataNode relative to the busiest one.
+	loads []float64
+	// racks is the index of the rack of each DataNode.
+	racks   []int
+	rackNum int
+	// holderRacks is the index of racks which already have a replica of each
+	// Chunk. It is only set if the diversity term is weighted.
+	holderRacks []map[int]bool
+	// nearness is how near each DataNode is to the nearest replica of each
+	// Chunk in [0, 1]. It is only set if the distance term is weighted.
+	nearness [][]float64
+}
+
+// newAllocateCost creates an allocateCost for a batch of chunkNum Chunk and the
+// given DataNode. isStore tells which DataNode already stores which Chunk, it
+// can be nil if neither the diversity nor the distance term is weighted. The
+// distance term is dropped if there is no topology. It returns nil if the
+// weights only have the balance term.
+func newAllocateCost(chunkNum int, dataNodeIds []string, isStore [][]bool, weights AllocateCostWeights) *allocateCost {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	if len(topologyKeys) == 0 {
+		weights.Distance = 0
+	}
+	if weights.isVarianceOnly() {
+		return nil
+	}
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	cost := &allocateCost{
+		weights:      weights,
+		chunkNum:     chunkNum,
+		usedCapacity: make([]int, len(dataNodeIds)),
+		fullCapacity: make([]int, len(dataNodeIds)),
+		loads:        make([]float64, len(dataNodeIds)),
+		racks:        make([]int, len(dataNodeIds)),
+	}
+	rackIndexes := make(map[string]int)
+	maxLoad := 0
+	for j, id := range dataNodeIds {
+		dataNode, ok := dataNodeMap[id]
+		if !ok {
+			cost.racks[j] = cost.rackNum
+			cost.rackNum++
+			continue
+		}
+		cost.usedCapacity[j] = dataNode.UsedCapacity
+		cost.fullCapacity[j] = dataNode.FullCapacity
+		cost.loads[j] = float64(dataNode.IOLoad)
+		if dataNode.IOLoad > maxLoad {
+			maxLoad = dataNode.IOLoad
+		}
+		rack := getRack(dataNode.Tags, topologyKeys)
+		if rack == "" {
+			// DataNode without topology is a rack itself.
+			cost.racks[j] = cost.rackNum
+			cost.rackNum++
+			continue
+		}
+		if index, ok := rackIndexes[rack]; ok {
+			cost.racks[j] = index
+			continue
+		}
+		rackIndexes[rack] = cost.rackNum
+		cost.racks[j] = cost.rackNum
+		cost.rackNum++
+	}
+	if maxLoad > 0 {
+		for j := range cost.loads {
+			cost.loads[j] /= float64(maxLoad)
+		}
+	}
+	if weights.Diversity > 0 {
+		cost.holderRacks = make([]map[int]bool, chunkNum)
+		for i := range cost.holderRacks {
+			cost.holderRacks[i] = make(map[int]bool)
+			if i >= len(isStore) {
+				continue
+			}
+			for j, isStored := range isStore[i] {
+				if isStored {
+					cost.holderRacks[i][cost.racks[j]] = true
+				}
+			}
+		}
+	}
+	if weights.Distance > 0 {
+		cost.nearness = calNearness(chunkNum, dataNodeIds, isStore, topologyKeys)
+	}
+	return cost
+}
+
+// calNearness calculates how near each DataNode is to the nearest DataNode
+// storing each Chunk in topology. It is 1 minus the distance divided by the
+// number of topologyKeys, and 0 for Chunk without any replica. The caller must
+// hold updateMapLock.
+func calNearness(chunkNum int, dataNodeIds []string, isStore [][]bool, topologyKeys []string) [][]float64 {
+	nearness := make([][]float64, chunkNum)
+	for i := range nearness {
+		nearness[i] = make([]float64, len(dataNodeIds))
+		if i >= len(isStore) {
+			continue
+		}
+		holders := make([]*DataNode, 0)
+		for k, isStored := range isStore[i] {
+			if holder, ok := dataNodeMap[dataNodeIds[k]]; isStored && ok {
+				holders = append(holders, holder)
+			}
+		}
+		if len(holders) == 0 {
+			continue
+		}
+		for j, id := range dataNodeIds {
+			dataNode, ok := dataNodeMap[id]
+			if !ok {
+				continue
+			}
+			distance := len(topologyKeys)
+			for _, holder := range holders {
+				if d := getTopologyDistance(dataNode.Tags, holder.Tags, topologyKeys); d < distance {
+					distance = d
+				}
+			}
+			nearness[i][j] = 1 - float64(distance)/float64(len(topologyKeys))
+		}
+	}
+	return nearness
+}
+
+// getRack gets the rack of a DataNode, which is its failure domain of all
+// topologyKeys. It returns "" if the DataNode has none of them.
+func getRack(tags map[string]string, topologyKeys []string) string {
+	for _, key := range topologyKeys {
+		if _, ok := tags[key]; ok {
+			return getFailureDomain(tags, topologyKeys)
+		}
+	}
+	return ""
+}
+
+// normalize divides the variance of counts of Chunk by the square of chunkNum,
+// which is larger than any possible variance.
+func (c *allocateCost) normalize(variance float64) float64 {
+	if c.chunkNum == 0 {
+		return 0
+	}
+	return variance / float64(c.chunkNum*c.chunkNum)
+}
+
+// calculate calculates the cost of a plan. currentResult includes index of
+// Chunk received by each DataNode, and variance is the variance of the number
+// of Chunk received by each DataNode.
+func (c *allocateCost) calculate(currentResult [][]int, variance int) float64 {
+	cost := c.weights.Balance * c.normalize(float64(variance))
+	if c.weights.Capacity > 0 {
+		usages := make([]float64, 0, len(currentResult))
+		for j, chunks := range currentResult {
+			if c.fullCapacity[j] <= 0 {
+				continue
+			}
+			// Capacity is in bytes, so each received Chunk takes ChunkSize.
+			used := c.usedCapacity[j] + len(chunks)*common.ChunkSize
+			usages = append(usages, float64(used)/float64(c.fullCapacity[j]))
+		}
+		cost += c.weights.Capacity * calFloatVariance(usages)
+	}
+	if c.weights.Load > 0 && c.chunkNum > 0 {
+		load := 0.0
+		for j, chunks := range currentResult {
+			load += float64(len(chunks)) * c.loads[j]
+		}
+		cost += c.weights.Load * load / float64(c.chunkNum)
+	}
+	if c.weights.Rack > 0 && c.rackNum > 0 {
+		counts := make([]float64, c.rackNum)
+		for j, chunks := range currentResult {
+			counts[c.racks[j]] += float64(len(chunks))
+		}
+		cost += c.weights.Rack * c.normalize(calFloatVariance(counts)*float64(c.rackNum))
+	}
+	if c.weights.Diversity > 0 && c.chunkNum > 0 {
+		repeated := 0
+		for j, chunks := range currentResult {
+			for _, i := range chunks {
+				if c.holderRacks[i][c.racks[j]] {
+					repeated++
+				}
+			}
+		}
+		cost += c.weights.Diversity * float64(repeated) / float64(c.chunkNum)
+	}
+	if c.weights.Distance > 0 && c.chunkNum > 0 {
+		near := 0.0
+		for j, chunks := range currentResult {
+			for _, i := range chunks {
+				near += c.nearness[i][j]
+			}
+		}
+		cost += c.weights.Distance * near / float64(c.chunkNum)
+	}
+	return cost
+}
+
+// bestCost returns the lower bound of the cost of all plans. The other terms
+// are not less than 0, so it is the weighted best variance.
+func (c *allocateCost) bestCost(bestVariance int) float64 {
+	return c.weights.Balance * c.normalize(float64(bestVariance))
+}
+
+// calFloatVariance calculates the population variance of the values.
+func calFloatVariance(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	avg := 0.0
+	for _, value := range values {
+		avg += value
+	}
+	avg /= float64(len(values))
+	variance := 0.0
+	for _, value := range values {
+		variance += (value - avg) * (value - avg)
+	}
+	return variance / float64(len(values))
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"tinydfs-base/common"
+)
+
+func TestAllocateChunksDFSWithCost(t *testing.T) {
+	t.Cleanup(func() {
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive, IOLoad: 100}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Status: common.Alive, IOLoad: 0}
+	dataNodeIds := []string{"dataNode1", "dataNode2"}
+	newIsStore := func() [][]bool {
+		return [][]bool{{false, false}, {false, false}}
+	}
+
+	// Only the balance term means the pure variance.
+	assert.Nil(t, newAllocateCost(2, dataNodeIds, nil, AllocateCostWeights{Balance: 1}))
+
+	// Balance-heavy weights spread Chunk over both DataNode.
+	cost := newAllocateCost(2, dataNodeIds, nil, AllocateCostWeights{Balance: 1, Load: 0.01})
+	plan := allocateChunksDFSWithCost(2, 2, newIsStore(), cost)
+	assert.ElementsMatch(t, []int{0, 1}, plan, "Chunk should be balanced.")
+
+	// Load-heavy weights put all Chunk to the idle DataNode.
+	cost = newAllocateCost(2, dataNodeIds, nil, AllocateCostWeights{Balance: 0.01, Load: 1})
+	plan = allocateChunksDFSWithCost(2, 2, newIsStore(), cost)
+	assert.Equal(t, []int{1, 1}, plan, "Chunk should avoid the busy datanode.")
+}
+
+func TestAllocateCost_Capacity(t *testing.T) {
+	t.Cleanup(func() {
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	// dataNode1 is half full and dataNode2 is empty.
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", UsedCapacity: 4 * common.ChunkSize,
+		FullCapacity: 8 * common.ChunkSize}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", FullCapacity: 8 * common.ChunkSize}
+	cost := newAllocateCost(4, []string{"dataNode1", "dataNode2"}, nil, AllocateCostWeights{Capacity: 1})
+
+	// Received Chunk count in bytes, so filling the empty DataNode evens the
+	// usage.
+	assert.Equal(t, 0.0, cost.calculate([][]int{{}, {0, 1, 2, 3}}, 0), "Usage should be even.")
+	assert.Greater(t, cost.calculate([][]int{{0, 1}, {2, 3}}, 0), 0.0, "Usage should not be even.")
+}
+
+func TestAllocateCost_Rack(t *testing.T) {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	t.Cleanup(func() {
+		dataNodeMap = make(map[string]*DataNode)
+		viper.Set(MasterTopologyKeys, topologyKeys)
+	})
+	viper.Set(MasterTopologyKeys, []string{"rack"})
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Tags: map[string]string{"rack": "r1"}}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Tags: map[string]string{"rack": "r1"}}
+	dataNodeMap["dataNode3"] = &DataNode{Id: "dataNode3", Tags: map[string]string{"rack": "r2"}}
+	cost := newAllocateCost(2, []string{"dataNode1", "dataNode2", "dataNode3"}, nil, AllocateCostWeights{Rack: 1})
+	assert.Equal(t, 2, cost.rackNum)
+
+	// Two Chunk in the same rack cost more than in different racks.
+	sameRack := cost.calculate([][]int{{0}, {1}, {}}, 0)
+	differentRacks := cost.calculate([][]int{{0}, {}, {1}}, 0)
+	assert.Greater(t, sameRack, differentRacks)
+	assert.Equal(t, 0.0, differentRacks)
+}
+
+func TestAllocateCost_Diversity(t *testing.T) {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	t.Cleanup(func() {
+		dataNodeMap = make(map[string]*DataNode)
+		viper.Set(MasterTopologyKeys, topologyKeys)
+	})
+	viper.Set(MasterTopologyKeys, []string{"rack"})
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Tags: map[string]string{"rack": "r1"}}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Tags: map[string]string{"rack": "r1"}}
+	dataNodeMap["dataNode3"] = &DataNode{Id: "dataNode3", Tags: map[string]string{"rack": "r2"}}
+	dataNodeIds := []string{"dataNode1", "dataNode2", "dataNode3"}
+	// dataNode1 stores the Chunk, so both dataNode2 and dataNode3 can receive it.
+	isStore := [][]bool{{true, false, false}}
+	cost := newAllocateCost(1, dataNodeIds, isStore, AllocateCostWeights{Balance: 1, Diversity: 1})
+
+	// A replica in a new rack costs less than one in the rack of the holder.
+	sameRack := cost.calculate([][]int{{}, {0}, {}}, 0)
+	newRack := cost.calculate([][]int{{}, {}, {0}}, 0)
+	assert.Less(t, newRack, sameRack, "More diverse plan should cost less.")
+	assert.Equal(t, []int{2}, allocateChunksDFSWithCost(1, 3, isStore, cost), "Chunk should go to a new rack.")
+}
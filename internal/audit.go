@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"tinydfs-base/common"
+	"tinydfs-base/protocol/pb"
+)
+
+const (
+	// AuditIdentityKey is the key of gRPC metadata which carries the identity
+	// of the requester.
+	AuditIdentityKey = "identity"
+	unknownIdentity  = "unknown"
+)
+
+var (
+	// globalAuditLogger records all mutating namespace operations. It is nil if
+	// audit is disabled.
+	globalAuditLogger *AuditLogger
+)
+
+// AuditRecord is a human-readable record of a mutating namespace operation.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Identity  string    `json:"identity"`
+	Operation string    `json:"operation"`
+	Path      string    `json:"path"`
+	// Target is the new path of move or the new name of rename.
+	Target  string `json:"target,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// AuditSink is where AuditRecord will be written to.
+type AuditSink interface {
+	Write(record AuditRecord) error
+}
+
+// FileAuditSink appends AuditRecord to a file, one JSON object per line.
+type FileAuditSink struct {
+	file *os.File
+}
+
+// NewFileAuditSink opens the file in append-only mode.
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{file: file}, nil
+}
+
+func (s *FileAuditSink) Close() error {
+	return s.file.Close()
+}
+
+func (s *FileAuditSink) Write(record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+// AuditLogger writes AuditRecord to its AuditSink asynchronously, so that the
+// operation path will never be blocked by auditing.
+type AuditLogger struct {
+	sink    AuditSink
+	records chan AuditRecord
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewAuditLogger creates an AuditLogger which buffers at most bufferSize
+// AuditRecord and starts a goroutine to write them to the sink.
+func NewAuditLogger(sink AuditSink, bufferSize int) *AuditLogger {
+	logger := &AuditLogger{
+		sink:    sink,
+		records: make(chan AuditRecord, bufferSize),
+		done:    make(chan struct{}),
+	}
+	go logger.run()
+	return logger
+}
+
+func (l *AuditLogger) run() {
+	defer close(l.done)
+	for record := range l.records {
+		if err := l.sink.Write(record); err != nil {
+			Logger.Errorf("Fail to write audit record, error detail: %s", err.Error())
+		}
+	}
+}
+
+// Record puts an AuditRecord into the buffer. The record will be dropped if the
+// buffer is full.
+func (l *AuditLogger) Record(record AuditRecord) {
+	select {
+	case l.records <- record:
+	default:
+		Logger.Warnf("Audit buffer is full, drop audit record: %+v", record)
+	}
+}
+
+// Close stops receiving AuditRecord and waits for all buffered AuditRecord to
+// be written.
+func (l *AuditLogger) Close() {
+	l.once.Do(func() {
+		close(l.records)
+	})
+	<-l.done
+	if closer, ok := l.sink.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// initAuditLogger creates globalAuditLogger if the audit log path is configured.
+func initAuditLogger(path string, bufferSize int) {
+	if path == "" {
+		return
+	}
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		Logger.Errorf("Fail to open audit log, audit is disabled, error detail: %s", err.Error())
+		return
+	}
+	if bufferSize <= 0 {
+		bufferSize = defaultAuditBufferSize
+	}
+	globalAuditLogger = NewAuditLogger(sink, bufferSize)
+}
+
+// auditInterceptor records every mutating namespace operation requested by
+// client with the identity of the requester and the result.
+var auditInterceptor grpc.UnaryServerInterceptor = func(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	rep, err := handler(ctx, req)
+	if globalAuditLogger == nil {
+		return rep, err
+	}
+	record, ok := newAuditRecord(req)
+	if !ok {
+		return rep, err
+	}
+	record.Time = time.Now()
+	record.Identity = getIdentity(ctx)
+	record.Success = err == nil
+	if err != nil {
+		record.Error = err.Error()
+	}
+	globalAuditLogger.Record(record)
+	return rep, err
+}
+
+// newAuditRecord creates an AuditRecord from the request. It returns false if
+// the request is not a mutating namespace operation.
+func newAuditRecord(req interface{}) (AuditRecord, bool) {
+	switch args := req.(type) {
+	case *pb.CheckArgs4AddArgs:
+		return AuditRecord{Operation: common.OperationAdd, Path: joinPath(args.Path, args.FileName)}, true
+	case *pb.CheckAndMkDirArgs:
+		return AuditRecord{Operation: common.OperationMkdir, Path: joinPath(args.Path, args.DirName)}, true
+	case *pb.CheckAndMoveArgs:
+		return AuditRecord{Operation: common.OperationMove, Path: args.SourcePath, Target: args.TargetPath}, true
+	case *pb.CheckAndRemoveArgs:
+		return AuditRecord{Operation: common.OperationRemove, Path: args.Path}, true
+	case *pb.CheckAndRenameArgs:
+		return AuditRecord{Operation: common.OperationRename, Path: args.Path, Target: args.NewName}, true
+	default:
+		return AuditRecord{}, false
+	}
+}
+
+// getIdentity gets the identity of the requester from gRPC metadata. The
+// address of the requester is used if the identity is not given.
+func getIdentity(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if identities := md.Get(AuditIdentityKey); len(identities) != 0 {
+			return identities[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return unknownIdentity
+}
+
+// joinPath joins the path of the parent directory and the file name.
+func joinPath(path string, fileName string) string {
+	if strings.HasSuffix(path, pathSplitString) {
+		return path + fileName
+	}
+	return path + pathSplitString + fileName
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"os"
+	"path/filepath"
+	"testing"
+	"tinydfs-base/common"
+	"tinydfs-base/protocol/pb"
+)
+
+func TestAuditInterceptor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	initAuditLogger(path, 16)
+	t.Cleanup(func() {
+		globalAuditLogger = nil
+	})
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(AuditIdentityKey, "alice"))
+	info := &grpc.UnaryServerInfo{}
+	success := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	fail := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, fmt.Errorf("path not exist")
+	}
+
+	_, _ = auditInterceptor(ctx, &pb.CheckArgs4AddArgs{Path: "/a", FileName: "b.txt"}, info, success)
+	_, _ = auditInterceptor(ctx, &pb.CheckAndRemoveArgs{Path: "/a/c.txt"}, info, fail)
+	// Read only operation should not be audited.
+	_, _ = auditInterceptor(ctx, &pb.CheckAndListArgs{Path: "/a"}, info, success)
+	globalAuditLogger.Close()
+
+	file, err := os.Open(path)
+	assert.NoError(t, err, "Unexpected error.")
+	defer file.Close()
+	records := make([]AuditRecord, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := AuditRecord{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record), "Unexpected error.")
+		records = append(records, record)
+	}
+	assert.Equal(t, 2, len(records), "Unexpected number of audit records.")
+
+	assert.Equal(t, "alice", records[0].Identity, "Unexpected identity.")
+	assert.Equal(t, common.OperationAdd, records[0].Operation, "Unexpected operation.")
+	assert.Equal(t, "/a/b.txt", records[0].Path, "Unexpected path.")
+	assert.True(t, records[0].Success, "Create should succeed.")
+	assert.False(t, records[0].Time.IsZero(), "Time should be recorded.")
+
+	assert.Equal(t, "alice", records[1].Identity, "Unexpected identity.")
+	assert.Equal(t, common.OperationRemove, records[1].Operation, "Unexpected operation.")
+	assert.Equal(t, "/a/c.txt", records[1].Path, "Unexpected path.")
+	assert.False(t, records[1].Success, "Delete should fail.")
+	assert.Equal(t, "path not exist", records[1].Error, "Unexpected error.")
+}
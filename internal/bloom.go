@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+	// bloomBlockBits is the number of bits in a block, which is the size of a
+	// cache line.
+	bloomBlockBits = 512
+)
+
+// BloomFilter is a concurrency-safe Bloom filter of string. It can tell that a
+// string is definitely absent without any lock, but a string it considers
+// present may be a false positive. All bits of a string are put in one block of
+// a cache line size, so that checking a string only needs one memory access.
+type BloomFilter struct {
+	// bits is the bit array of the filter, every bit is set atomically.
+	bits []uint64
+	// blockMask is used to select a block, the number of block is a power of 2.
+	blockMask uint64
+	// hashNum is the number of hash function used for each string.
+	hashNum uint64
+	// capacity is the number of string the filter is sized for. The false
+	// positive rate will increase when more string are added.
+	capacity int
+}
+
+// NewBloomFilter creates a BloomFilter which can hold capacity strings with
+// about the given false positive rate.
+func NewBloomFilter(capacity int, falsePositiveRate float64) *BloomFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = defaultChunkBloomFalsePositiveRate
+	}
+	bitNum := math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	blockNum := uint64(1)
+	for float64(blockNum*bloomBlockBits) < bitNum {
+		blockNum <<= 1
+	}
+	hashNum := uint64(math.Round(float64(blockNum*bloomBlockBits) / float64(capacity) * math.Ln2))
+	if hashNum < 1 {
+		hashNum = 1
+	}
+	return &BloomFilter{
+		bits:      make([]uint64, blockNum*bloomBlockBits/64),
+		blockMask: blockNum - 1,
+		hashNum:   hashNum,
+		capacity:  capacity,
+	}
+}
+
+// Add puts the string into the filter.
+func (f *BloomFilter) Add(s string) {
+	block, h1, h2 := f.locate(s)
+	for i := uint64(0); i < f.hashNum; i++ {
+		pos := (h1 + i*h2) % bloomBlockBits
+		word, mask := &block[pos/64], uint64(1)<<(pos%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+				break
+			}
+		}
+	}
+}
+
+// MayContain returns false if the string is definitely not in the filter.
+func (f *BloomFilter) MayContain(s string) bool {
+	block, h1, h2 := f.locate(s)
+	for i := uint64(0); i < f.hashNum; i++ {
+		pos := (h1 + i*h2) % bloomBlockBits
+		if atomic.LoadUint64(&block[pos/64])&(uint64(1)<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// locate finds the block of the string and the hash values used to select bits
+// in the block.
+func (f *BloomFilter) locate(s string) ([]uint64, uint64, uint64) {
+	h1, h2 := bloomHash(s)
+	start := (h1 >> 32 & f.blockMask) * bloomBlockBits / 64
+	return f.bits[start : start+bloomBlockBits/64], h1, h2
+}
+
+// bloomHash calculates two hash values of the string, which are combined to
+// simulate all hash functions of the filter.
+func bloomHash(s string) (uint64, uint64) {
+	// Use FNV-1a and FNV-1 inline to avoid allocation in hot path.
+	h1, h2 := uint64(fnvOffset64), uint64(fnvOffset64)
+	for i := 0; i < len(s); i++ {
+		h1 ^= uint64(s[i])
+		h1 *= fnvPrime64
+		h2 *= fnvPrime64
+		h2 ^= uint64(s[i])
+	}
+	// The second hash value should be odd, so that it will never be zero.
+	return bloomMix(h1), bloomMix(h2) | 1
+}
+
+// bloomMix is the finalizer of MurmurHash3, which makes every bit of the hash
+// value depend on all bits of the input.
+func bloomMix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
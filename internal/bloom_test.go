@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		rate     float64
+	}{
+		{
+			name:     "Strict",
+			capacity: 10000,
+			rate:     0.001,
+		},
+		{
+			name:     "Loose",
+			capacity: 10000,
+			rate:     0.1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := NewBloomFilter(tt.capacity, tt.rate)
+			for i := 0; i < tt.capacity; i++ {
+				filter.Add(fmt.Sprintf("chunk%d", i))
+			}
+			for i := 0; i < tt.capacity; i++ {
+				assert.True(t, filter.MayContain(fmt.Sprintf("chunk%d", i)), "Unexpected false negative.")
+			}
+			falsePositive := 0
+			for i := 0; i < tt.capacity; i++ {
+				if filter.MayContain(fmt.Sprintf("absent%d", i)) {
+					falsePositive++
+				}
+			}
+			assert.Less(t, float64(falsePositive)/float64(tt.capacity), 2*tt.rate, "Unexpected false positive rate.")
+		})
+	}
+}
@@ -2,12 +2,15 @@ package internal
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	set "github.com/deckarep/golang-set"
 	"github.com/hashicorp/raft"
 	"github.com/spf13/viper"
 	"go.uber.org/atomic"
 	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,8 +22,21 @@ const (
 	chunkIdIdx = iota
 	dataNodesIdx
 	pendingDataNodesIdx
+	pinnedDataNodesIdx
+	minAckNumIdx
+	lastAccessTimeIdx
+	codingSchemeIdx
+	fragmentsIdx
+	chunkSizeIdx
+	primaryIdx
+	primaryEpochIdx
+	quarantinedDataNodesIdx
 )
 
+// pendingChunkLenDelimiter separates the length and the id of a pending Chunk
+// in snapshot.
+const pendingChunkLenDelimiter = ":"
+
 var (
 	// chunksMap stores all Chunk in the file system, using id as the key.
 	chunksMap        = make(map[string]*Chunk)
@@ -28,8 +44,39 @@ var (
 	// pendingChunkQueue stores all Chunk that are missing a replica and waiting
 	// to be allocated to a DataNode.
 	pendingChunkQueue = util.NewQueue[String]()
+	// chunkBloom stores a *BloomFilter of all Chunk's id in chunksMap, so that
+	// a Chunk which definitely does not exist can be found without lock.
+	chunkBloom = &atomic.Value{}
+	// chunkStoredCh is closed and replaced whenever some Chunk gets new stored
+	// replicas, so that all goroutines waiting for a Chunk to be committed can
+	// be woken up. It is protected by updateChunksLock.
+	chunkStoredCh = make(chan struct{})
+	// lostChunkIds includes id of all Chunk which have no alive DataNode to copy
+	// from. They are not allocated until a DataNode storing them comes back. It
+	// is protected by updateChunksLock.
+	lostChunkIds = set.NewSet()
+	// stagedChunks includes Chunk of dead DataNode which wait to be put to
+	// pendingChunkQueue. It is protected by updateChunksLock.
+	stagedChunks = make([]stagedChunk, 0)
+	// runningAllocateNum is the number of allocations being computed now. It
+	// is protected by allocateWorkerLock.
+	runningAllocateNum = 0
+	allocateWorkerLock = &sync.Mutex{}
 )
 
+// stagedChunk is a Chunk stored by a dead DataNode. It will be put to
+// pendingChunkQueue at releaseTime unless a DataNode with the same address
+// comes back with it before that.
+type stagedChunk struct {
+	chunkId     string
+	address     string
+	releaseTime time.Time
+}
+
+func init() {
+	chunkBloom.Store(NewBloomFilter(defaultChunkBloomCapacity, defaultChunkBloomFalsePositiveRate))
+}
+
 type Chunk struct {
 	// Id is FileNodeId+_+ChunkNum
 	Id string
@@ -39,6 +86,46 @@ type Chunk struct {
 	// It means these DataNode is already allocated to store this Chunk, but they
 	// have not truly store this Chunk in their hard drive.
 	pendingDataNodes set.Set
+	// pendingSince is the heartbeats of each DataNode in pendingDataNodes when
+	// it was first found pending by ExpireStalePendingDataNodes. It can be nil,
+	// and it is not persisted.
+	pendingSince map[string]int64
+	// pinnedDataNodes includes all id of DataNode which must always store this
+	// Chunk. It can be nil if this Chunk is not pinned to any DataNode.
+	pinnedDataNodes set.Set
+	// minAckNum is the number of DataNode which must store this Chunk before it
+	// is committed. It is 0 once this Chunk is committed, and the rest replicas
+	// will be filled by the background allocator.
+	minAckNum int
+	// lastAccessTime is the last time(unix seconds) this Chunk was read from
+	// any DataNode. It is 0 if no read has been reported.
+	lastAccessTime int64
+	// codingScheme is how this Chunk is made durable. dataNodes and
+	// pendingDataNodes of an erasure coded Chunk include DataNode storing any
+	// of its fragments.
+	codingScheme CodingScheme
+	// fragments includes id of the DataNode of each fragment of an erasure coded
+	// Chunk. The id of a lost fragment is empty. It is nil if this Chunk is
+	// replicated.
+	fragments []string
+	// Size is the number of bytes truly stored in this Chunk as reported by
+	// DataNode. The last Chunk of a file can be smaller than common.ChunkSize. It
+	// is 0 if no DataNode has reported it.
+	Size int64
+	// replicaSizes is the size reported by each DataNode storing this Chunk. It
+	// is not persisted and will be rebuilt by heartbeats.
+	replicaSizes map[string]int64
+	// primary is id of the DataNode holding the lease to order writes of this
+	// Chunk. It is empty if no lease has been granted.
+	primary string
+	// primaryEpoch is increased every time primary changes, so that a lease
+	// granted with an older epoch is revoked.
+	primaryEpoch int64
+	// quarantinedDataNodes includes all id of DataNode whose replica of this
+	// Chunk failed the checksum and is kept for inspection, see
+	// master.checksumMismatchMode. They are neither in dataNodes nor chosen to
+	// store this Chunk again. It can be nil.
+	quarantinedDataNodes set.Set
 }
 
 func (c *Chunk) String() string {
@@ -59,15 +146,520 @@ func (c *Chunk) String() string {
 		index++
 	}
 
-	res.WriteString(fmt.Sprintf("%s$%v$%v\n",
-		c.Id, dataNodes, pendingDataNodes))
+	res.WriteString(fmt.Sprintf("%s$%v$%v", c.Id, dataNodes, pendingDataNodes))
+	// Pinned DataNode, minimum-ack replica count, last access time, coding
+	// scheme, fragments, size, primary and its epoch and quarantined DataNode
+	// are optional, so they are only written when they or fields after them
+	// exist. Last access time is rounded down to limit
+	// the change of snapshot.
+	pinnedDataNodes := make([]string, 0)
+	if c.isPinned() {
+		pinnedDataNodes = set2SortedStrings(c.pinnedDataNodes)
+	}
+	quarantinedDataNodes := make([]string, 0)
+	if c.hasQuarantinedReplica() {
+		quarantinedDataNodes = set2SortedStrings(c.quarantinedDataNodes)
+	}
+	lastAccessTime := roundAccessTime(c.lastAccessTime)
+	optionalFields := []string{fmt.Sprintf("%v", pinnedDataNodes), strconv.Itoa(c.minAckNum),
+		strconv.FormatInt(lastAccessTime, 10), c.codingScheme.String(), fragments2String(c.fragments),
+		strconv.FormatInt(c.Size, 10), c.primary, strconv.FormatInt(c.primaryEpoch, 10),
+		fmt.Sprintf("%v", quarantinedDataNodes)}
+	optionalNum := 0
+	switch {
+	case c.hasQuarantinedReplica():
+		optionalNum = 9
+	case c.primaryEpoch != 0:
+		optionalNum = 8
+	case c.Size != 0:
+		optionalNum = 6
+	case c.codingScheme.IsErasureCoded():
+		optionalNum = 5
+	case lastAccessTime != 0:
+		optionalNum = 3
+	case !c.isCommitted():
+		optionalNum = 2
+	case c.isPinned():
+		optionalNum = 1
+	}
+	for _, field := range optionalFields[:optionalNum] {
+		res.WriteString("$" + field)
+	}
+	res.WriteString("\n")
 	return res.String()
 }
 
+// isPinned checks whether this Chunk is pinned to any DataNode.
+func (c *Chunk) isPinned() bool {
+	return c.pinnedDataNodes != nil && c.pinnedDataNodes.Cardinality() != 0
+}
+
+// isPinnedOn checks whether this Chunk is pinned to the given DataNode.
+func (c *Chunk) isPinnedOn(dataNodeId string) bool {
+	return c.pinnedDataNodes != nil && c.pinnedDataNodes.Contains(dataNodeId)
+}
+
+// isQuarantinedOn checks whether the replica of this Chunk on the given DataNode
+// is quarantined.
+func (c *Chunk) isQuarantinedOn(dataNodeId string) bool {
+	return c.quarantinedDataNodes != nil && c.quarantinedDataNodes.Contains(dataNodeId)
+}
+
+// hasQuarantinedReplica checks whether any replica of this Chunk is quarantined.
+func (c *Chunk) hasQuarantinedReplica() bool {
+	return c.quarantinedDataNodes != nil && c.quarantinedDataNodes.Cardinality() != 0
+}
+
+// isCommitted checks whether enough DataNode have stored this Chunk.
+func (c *Chunk) isCommitted() bool {
+	return c.minAckNum == 0
+}
+
+// addStoredDataNode records that the DataNode has stored this Chunk and marks
+// this Chunk committed once enough DataNode have stored it.
+func (c *Chunk) addStoredDataNode(dataNodeId string) {
+	c.dataNodes.Add(dataNodeId)
+	if !c.isCommitted() && c.dataNodes.Cardinality() >= c.minAckNum {
+		c.minAckNum = 0
+	}
+}
+
+// roundAccessTime rounds the last access time down to the configured
+// granularity.
+func roundAccessTime(accessTime int64) int64 {
+	granularity := int64(viper.GetInt(MasterAccessTimeGranularity))
+	if granularity <= 0 {
+		granularity = defaultAccessTimeGranularity
+	}
+	return accessTime - accessTime%granularity
+}
+
+// ChunkAccessInfo is the read access of a Chunk reported by a DataNode.
+type ChunkAccessInfo struct {
+	ChunkId string `json:"chunk_id"`
+	// LastAccessTime is the last time(unix seconds) the Chunk was read.
+	LastAccessTime int64 `json:"last_access_time"`
+}
+
+// UpdateChunkAccess advances the last access time of each Chunk according to
+// the read access reported by a DataNode. A report older than the current last
+// access time is ignored.
+func UpdateChunkAccess(infos []ChunkAccessInfo) {
+	if len(infos) == 0 {
+		return
+	}
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	for _, info := range infos {
+		if chunk, ok := chunksMap[info.ChunkId]; ok && info.LastAccessTime > chunk.lastAccessTime {
+			chunk.lastAccessTime = info.LastAccessTime
+		}
+	}
+}
+
+// ChunkSizeInfo is the size of a Chunk stored on a DataNode reported by the
+// DataNode.
+type ChunkSizeInfo struct {
+	ChunkId string `json:"chunk_id"`
+	Size    int64  `json:"size"`
+}
+
+// UpdateChunkSize records the size of each Chunk reported by a DataNode. If
+// replicas of a Chunk report different sizes, the largest one is regarded as
+// the size of the Chunk because a smaller replica is likely truncated, and the
+// Chunk can be found by GetChunkSizeConflicts.
+func UpdateChunkSize(dataNodeId string, infos []ChunkSizeInfo) {
+	if len(infos) == 0 {
+		return
+	}
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	for _, info := range infos {
+		chunk, ok := chunksMap[info.ChunkId]
+		if !ok || info.Size <= 0 {
+			continue
+		}
+		if chunk.replicaSizes == nil {
+			chunk.replicaSizes = make(map[string]int64)
+		}
+		chunk.replicaSizes[dataNodeId] = info.Size
+		size := int64(0)
+		for id, replicaSize := range chunk.replicaSizes {
+			// Forget the size reported by DataNode which no longer stores the Chunk.
+			if !chunk.dataNodes.Contains(id) && id != dataNodeId {
+				delete(chunk.replicaSizes, id)
+				continue
+			}
+			if replicaSize > size {
+				size = replicaSize
+			}
+		}
+		if chunk.Size != 0 && info.Size != chunk.Size {
+			Logger.Warnf("Replicas of chunk report different sizes, chunk id: %s, datanode id: %s, size: %d, expect: %d",
+				chunk.Id, dataNodeId, info.Size, chunk.Size)
+		}
+		chunk.Size = size
+	}
+}
+
+// ChunkSizeConflict is a Chunk whose replicas report different sizes.
+type ChunkSizeConflict struct {
+	ChunkId string
+	// Sizes is the size reported by each DataNode, using DataNode id as the key.
+	Sizes map[string]int64
+}
+
+// GetChunkSizeConflicts returns all Chunk whose replicas report different sizes,
+// sorted by Chunk id.
+func GetChunkSizeConflicts() []ChunkSizeConflict {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	res := make([]ChunkSizeConflict, 0)
+	for _, chunk := range chunksMap {
+		sizes := make(map[string]int64)
+		conflict := false
+		for id, size := range chunk.replicaSizes {
+			if !chunk.dataNodes.Contains(id) {
+				continue
+			}
+			sizes[id] = size
+			conflict = conflict || size != chunk.Size
+		}
+		if conflict {
+			res = append(res, ChunkSizeConflict{ChunkId: chunk.Id, Sizes: sizes})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ChunkId < res[j].ChunkId
+	})
+	return res
+}
+
+// storedSize returns the number of bytes stored in this Chunk. A Chunk whose
+// size has not been reported is regarded as a full Chunk.
+func (c *Chunk) storedSize() int64 {
+	if c.Size == 0 {
+		return common.ChunkSize
+	}
+	return c.Size
+}
+
+// GetStoredBytes returns the number of bytes stored in all replicas of all
+// Chunk.
+func GetStoredBytes() int64 {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	res := int64(0)
+	for _, chunk := range chunksMap {
+		res += chunk.storedSize() * int64(chunk.dataNodes.Cardinality())
+	}
+	return res
+}
+
+// GetChunkLastAccess returns the last time the Chunk was read. The returned bool
+// is false if the Chunk does not exist or no read has been reported.
+func GetChunkLastAccess(chunkId string) (time.Time, bool) {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	chunk, ok := chunksMap[chunkId]
+	if !ok || chunk.lastAccessTime == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(chunk.lastAccessTime, 0), true
+}
+
+// GetColdChunks returns id of all Chunk which have not been read since the given
+// time, sorted by id. Chunk which has never been read is also regarded as cold.
+// It is used by tiering tools to find candidates for fewer replicas or moving to
+// a cheaper tier.
+func GetColdChunks(before time.Time) []string {
+	updateChunksLock.RLock()
+	res := make([]string, 0)
+	for id, chunk := range chunksMap {
+		if chunk.lastAccessTime < before.Unix() {
+			res = append(res, id)
+		}
+	}
+	updateChunksLock.RUnlock()
+	sort.Strings(res)
+	return res
+}
+
+// notifyChunkStored wakes up all goroutines waiting in WaitForCommit. The
+// caller must hold the write lock of updateChunksLock.
+func notifyChunkStored() {
+	close(chunkStoredCh)
+	chunkStoredCh = make(chan struct{})
+}
+
+// IsChunkCommitted checks whether the Chunk has been stored by at least its
+// minimum-ack number of DataNode.
+func IsChunkCommitted(chunkId string) bool {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	chunk, ok := chunksMap[chunkId]
+	return ok && chunk.isCommitted()
+}
+
+// WaitForCommit blocks until the Chunk has been stored by at least minReplicas
+// DataNode. If minReplicas is not positive, it waits until the Chunk is
+// committed according to its own minimum-ack number.
+func WaitForCommit(ctx context.Context, chunkId string, minReplicas int) error {
+	for {
+		updateChunksLock.RLock()
+		chunk, ok := chunksMap[chunkId]
+		if !ok {
+			updateChunksLock.RUnlock()
+			return fmt.Errorf("chunk %s not exist", chunkId)
+		}
+		isDone := chunk.isCommitted()
+		if minReplicas > 0 {
+			isDone = chunk.dataNodes.Cardinality() >= minReplicas
+		}
+		storedCh := chunkStoredCh
+		updateChunksLock.RUnlock()
+		if isDone {
+			return nil
+		}
+		select {
+		case <-storedCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ChunkReplicationStatus is the replication progress of a Chunk.
+type ChunkReplicationStatus struct {
+	ChunkId string
+	// Replicas is the number of DataNode which have stored the Chunk.
+	Replicas int
+	// PendingReplicas is the number of DataNode which are storing the Chunk.
+	PendingReplicas int
+	// TargetReplicas is the number of replicas the Chunk should have.
+	TargetReplicas int
+	// Progress is Replicas / TargetReplicas, and it is at most 1.
+	Progress float64
+}
+
+// IsDurable returns true if the Chunk has been stored by enough DataNode.
+func (s ChunkReplicationStatus) IsDurable() bool {
+	return s.Replicas >= s.TargetReplicas
+}
+
+// GetChunkReplicationStatus gets the replication progress of a Chunk against
+// the ReplicaFactor of its file, so that client can poll whether a Chunk is
+// fully stored.
+func GetChunkReplicationStatus(chunkId string) (ChunkReplicationStatus, error) {
+	targetReplicas := getChunkReplicaFactor(chunkId)
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	chunk, ok := chunksMap[chunkId]
+	if !ok {
+		return ChunkReplicationStatus{}, fmt.Errorf("chunk %s not exist", chunkId)
+	}
+	status := ChunkReplicationStatus{
+		ChunkId:         chunkId,
+		Replicas:        chunk.dataNodes.Cardinality(),
+		PendingReplicas: chunk.pendingDataNodes.Cardinality(),
+		TargetReplicas:  targetReplicas,
+		Progress:        1,
+	}
+	if status.Replicas < targetReplicas {
+		status.Progress = float64(status.Replicas) / float64(targetReplicas)
+	}
+	return status, nil
+}
+
+// GetFileChunkIds gets id of all Chunk of the file in order.
+func GetFileChunkIds(path string) ([]string, error) {
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNode(path)
+	if !isExist || !fileNode.IsFile {
+		return nil, fmt.Errorf("file not exist, path : %s", path)
+	}
+	chunkIds := make([]string, len(fileNode.Chunks))
+	copy(chunkIds, fileNode.Chunks)
+	return chunkIds, nil
+}
+
+// FileChunk is a Chunk of a file.
+type FileChunk struct {
+	ChunkId string
+	// Index is the index of the Chunk in the file.
+	Index int
+	// Size is the size of the Chunk reported by DataNode, it is 0 if it has not
+	// been reported or the Chunk does not exist.
+	Size int64
+}
+
+// GetFileChunks gets all Chunk of the file in order together with their index
+// and size.
+func GetFileChunks(path string) ([]FileChunk, error) {
+	chunkIds, err := GetFileChunkIds(path)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]FileChunk, len(chunkIds))
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	for i, id := range chunkIds {
+		res[i] = FileChunk{ChunkId: id, Index: i}
+		if chunk, ok := chunksMap[id]; ok {
+			res[i].Size = chunk.Size
+		}
+	}
+	return res, nil
+}
+
+// ChunkRange is a part of a byte range of a file which is stored in one Chunk.
+type ChunkRange struct {
+	// ChunkId is empty if the part is a hole, which should be read as zeros.
+	ChunkId string
+	// ChunkOffset is the offset of the part in the Chunk.
+	ChunkOffset int64
+	Length      int64
+}
+
+// MapRangeToChunks maps the byte range [offset, offset+length) of the file to
+// ordered ChunkRange covering it. The range is cut at the end of the file. Each
+// Chunk covers common.ChunkSize bytes of the file, and bytes beyond the size of
+// a Chunk reported by DataNode, or of a Chunk which has never been allocated,
+// are holes. Chunk whose size has not been reported are regarded as full.
+// Adjacent holes are merged.
+func MapRangeToChunks(path string, offset int64, length int64) ([]ChunkRange, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range, offset: %d, length: %d", offset, length)
+	}
+	createFileNodeLock.Lock()
+	fileNode, isExist := getFileNode(path)
+	if !isExist || !fileNode.IsFile {
+		createFileNodeLock.Unlock()
+		return nil, fmt.Errorf("file not exist, path : %s", path)
+	}
+	chunkIds := make([]string, len(fileNode.Chunks))
+	copy(chunkIds, fileNode.Chunks)
+	end := fileNode.Size
+	createFileNodeLock.Unlock()
+	if offset < end && length < end-offset {
+		end = offset + length
+	}
+
+	ranges := make([]ChunkRange, 0)
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	for pos := offset; pos < end; {
+		index := pos / common.ChunkSize
+		chunkOffset := pos % common.ChunkSize
+		num := common.ChunkSize - chunkOffset
+		if num > end-pos {
+			num = end - pos
+		}
+		var stored int64
+		if index < int64(len(chunkIds)) {
+			stored = common.ChunkSize
+			if chunk, ok := chunksMap[chunkIds[index]]; ok && chunk.Size != 0 {
+				stored = chunk.Size
+			}
+		}
+		if chunkOffset < stored {
+			dataNum := stored - chunkOffset
+			if dataNum > num {
+				dataNum = num
+			}
+			ranges = append(ranges, ChunkRange{ChunkId: chunkIds[index], ChunkOffset: chunkOffset, Length: dataNum})
+			pos, chunkOffset, num = pos+dataNum, chunkOffset+dataNum, num-dataNum
+		}
+		if num == 0 {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last].ChunkId == "" {
+			ranges[last].Length += num
+		} else {
+			ranges = append(ranges, ChunkRange{ChunkOffset: chunkOffset, Length: num})
+		}
+		pos += num
+	}
+	return ranges, nil
+}
+
+// FileDataNode is an alive DataNode which stores some Chunk of a file.
+type FileDataNode struct {
+	DataNodeId string
+	Address    string
+	// ChunkNum is the number of Chunk of the file stored by the DataNode.
+	ChunkNum int
+}
+
+// GetFileDataNodes gets all alive DataNode storing any Chunk of the file, so that
+// a scheduler can place tasks where the data lives. The result is sorted by
+// ChunkNum in descending order.
+func GetFileDataNodes(path string) ([]FileDataNode, error) {
+	createFileNodeLock.Lock()
+	fileNode, isExist := getFileNode(path)
+	if !isExist || !fileNode.IsFile {
+		createFileNodeLock.Unlock()
+		return nil, fmt.Errorf("file not exist, path : %s", path)
+	}
+	chunkIds := make([]string, len(fileNode.Chunks))
+	copy(chunkIds, fileNode.Chunks)
+	createFileNodeLock.Unlock()
+
+	chunkNums := make(map[string]int)
+	updateChunksLock.RLock()
+	for _, chunkId := range chunkIds {
+		chunk, ok := chunksMap[chunkId]
+		if !ok {
+			continue
+		}
+		for _, id := range chunk.dataNodes.ToSlice() {
+			chunkNums[id.(string)]++
+		}
+	}
+	updateChunksLock.RUnlock()
+
+	dataNodes := make([]FileDataNode, 0, len(chunkNums))
+	updateMapLock.RLock()
+	for id, num := range chunkNums {
+		dataNode, ok := dataNodeMap[id]
+		if !ok || dataNode.Status != common.Alive {
+			continue
+		}
+		dataNodes = append(dataNodes, FileDataNode{
+			DataNodeId: id,
+			Address:    dataNode.Address,
+			ChunkNum:   num,
+		})
+	}
+	updateMapLock.RUnlock()
+	sort.Slice(dataNodes, func(i, j int) bool {
+		if dataNodes[i].ChunkNum != dataNodes[j].ChunkNum {
+			return dataNodes[i].ChunkNum > dataNodes[j].ChunkNum
+		}
+		return dataNodes[i].DataNodeId < dataNodes[j].DataNodeId
+	})
+	return dataNodes, nil
+}
+
+// getMinAckNum checks the minimum-ack number given by client. 0 means all
+// replicas must be stored before the Chunk is committed.
+func getMinAckNum(minAckNum int, replicaNum int) (int, error) {
+	if minAckNum < 0 || minAckNum > replicaNum {
+		return 0, fmt.Errorf("minimum-ack number should be in [1, %d], minimum-ack number: %d",
+			replicaNum, minAckNum)
+	}
+	if minAckNum == 0 {
+		return replicaNum, nil
+	}
+	return minAckNum, nil
+}
+
 func AddChunk(chunk *Chunk) {
 	updateChunksLock.Lock()
 	defer updateChunksLock.Unlock()
 	chunksMap[chunk.Id] = chunk
+	addChunkId2Bloom(chunk.Id)
 }
 
 func BatchAddChunk(chunks []*Chunk) {
@@ -75,126 +667,734 @@ func BatchAddChunk(chunks []*Chunk) {
 	defer updateChunksLock.Unlock()
 	for _, chunk := range chunks {
 		chunksMap[chunk.Id] = chunk
+		addChunkId2Bloom(chunk.Id)
+	}
+}
+
+// addChunkId2Bloom puts the Chunk's id into chunkBloom. chunkBloom will be
+// rebuilt with a larger capacity when chunksMap outgrows it. The caller must
+// hold updateChunksLock.
+func addChunkId2Bloom(id string) {
+	filter := chunkBloom.Load().(*BloomFilter)
+	if len(chunksMap) > filter.capacity {
+		rebuildChunkBloom()
+		return
+	}
+	filter.Add(id)
+}
+
+// rebuildChunkBloom creates a new chunkBloom from all Chunk in chunksMap. The
+// caller must hold updateChunksLock.
+func rebuildChunkBloom() {
+	capacity := 2 * len(chunksMap)
+	if capacity < defaultChunkBloomCapacity {
+		capacity = defaultChunkBloomCapacity
+	}
+	rate := defaultChunkBloomFalsePositiveRate
+	if viper.IsSet(MasterChunkBloomFPRate) {
+		rate = viper.GetFloat64(MasterChunkBloomFPRate)
+	}
+	filter := NewBloomFilter(capacity, rate)
+	for id := range chunksMap {
+		filter.Add(id)
+	}
+	chunkBloom.Store(filter)
+}
+
+// ReconcileChunkReport splits Chunk's id reported by a DataNode into ids of
+// Chunk which exist in master and ids of Chunk which do not exist. Ids which
+// are definitely absent are filtered by chunkBloom without taking the lock.
+func ReconcileChunkReport(ids []string) ([]string, []string) {
+	return reconcileChunkReport(ids, chunkBloom.Load().(*BloomFilter))
+}
+
+// reconcileChunkReport does the work of ReconcileChunkReport. The lock will be
+// taken for every id if filter is nil.
+func reconcileChunkReport(ids []string, filter *BloomFilter) ([]string, []string) {
+	known := make([]string, 0, len(ids))
+	unknown := make([]string, 0)
+	for _, id := range ids {
+		if filter != nil && !filter.MayContain(id) {
+			unknown = append(unknown, id)
+			continue
+		}
+		updateChunksLock.RLock()
+		_, ok := chunksMap[id]
+		updateChunksLock.RUnlock()
+		if ok {
+			known = append(known, id)
+		} else {
+			unknown = append(unknown, id)
+		}
+	}
+	return known, unknown
+}
+
+func GetChunk(id string) *Chunk {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	return chunksMap[id]
+}
+
+func BatchClearDataNode(chunkIds []interface{}, dataNodeId string) {
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	for _, id := range chunkIds {
+		if chunk, ok := chunksMap[id.(string)]; ok {
+			chunk.dataNodes.Remove(dataNodeId)
+		}
+	}
+}
+
+// ReclaimChunks removes the given Chunk from chunksMap and tells all DataNode
+// storing, receiving or quarantining them to delete them, which is what the
+// chunk check does for Chunk of permanently deleted files.
+func ReclaimChunks(chunkIds []string) {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	for _, id := range chunkIds {
+		chunk, ok := chunksMap[id]
+		if !ok {
+			continue
+		}
+		holders := chunk.dataNodes.Union(chunk.pendingDataNodes)
+		if chunk.hasQuarantinedReplica() {
+			holders = holders.Union(chunk.quarantinedDataNodes)
+		}
+		for _, dataNodeId := range set2SortedStrings(holders) {
+			dataNode, ok := dataNodeMap[dataNodeId]
+			if !ok {
+				continue
+			}
+			dataNode.scheduleChunkDelete(id)
+		}
+		delete(chunksMap, id)
+		lostChunkIds.Remove(id)
+	}
+	lostChunkCountMonitor.Set(float64(lostChunkIds.Cardinality()))
+	Logger.Infof("Reclaim chunks of removed files, chunk num: %d", len(chunkIds))
+}
+
+// BatchClearPendingDataNodes clear all pendingDataNodes of Chunk's id in the
+// given slice.
+func BatchClearPendingDataNodes(chunkIds []string) {
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	for _, id := range chunkIds {
+		if chunk, ok := chunksMap[id]; ok {
+			chunk.pendingDataNodes.Clear()
+			enqueuePendingChunk(id, "")
+		}
+	}
+}
+
+// BatchUpdatePendingDataNodes move all DataNode which have store the corresponding
+// Chunk successfully from that Chunk's pendingDataNodes to its dataNodes.
+func BatchUpdatePendingDataNodes(infos []util.ChunkTaskResult) {
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	for _, info := range infos {
+		if chunk, ok := chunksMap[info.ChunkId]; ok {
+			for _, id := range info.SuccessDataNodes {
+				chunk.addStoredDataNode(id)
+			}
+			missing := len(info.FailDataNodes)
+			// Replicas which were not allocated because there were not enough
+			// DataNode are made up later like failed ones.
+			if !chunk.codingScheme.IsErasureCoded() {
+				if shortfall := getChunkReplicaFactor(info.ChunkId) - chunk.dataNodes.Cardinality() -
+					len(info.FailDataNodes); shortfall > 0 {
+					Logger.Warnf("Chunk is stored with fewer replicas than needed, chunk id: %s, shortfall: %d",
+						info.ChunkId, shortfall)
+					missing += shortfall
+				}
+			}
+			for i := 0; i < missing; i++ {
+				enqueuePendingChunk(info.ChunkId, PendingReasonSendFailed)
+			}
+			chunk.pendingDataNodes.Clear()
+		}
+	}
+	notifyChunkStored()
+}
+
+// BatchFilterChunk filter Chunk that still exists, and it's DataNode is not full
+// from given Chunk's id slice. A Chunk missing several replicas may be in the
+// slice several times, but never more than the number of missing replicas.
+// Stale ids, such as those left in a restored snapshot, are dropped here by the
+// leader and removed from pendingChunkQueue with their batch by
+// AllocateChunksOperation, so Restore keeps the queue as it is persisted.
+func BatchFilterChunk(ids []string) []string {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	chunkIds := make([]string, 0, len(ids))
+	planned := make(map[string]int)
+	for i := 0; i < len(ids); i++ {
+		// Chunk should still exist, and it's DataNode is not full.
+		if chunk, ok := chunksMap[ids[i]]; ok {
+			replicaNum := chunk.dataNodes.Cardinality() + chunk.pendingDataNodes.Cardinality() + planned[ids[i]]
+			if replicaNum < getChunkReplicaFactor(ids[i]) {
+				chunkIds = append(chunkIds, ids[i])
+				planned[ids[i]]++
+			}
+		}
+	}
+	return chunkIds
+}
+
+// FindStalePendingDataNodes finds DataNode in pendingDataNodes of each Chunk
+// which has sent more heartbeats than the send timeout since it was found
+// pending and no DataNode is sending the Chunk to it. Such phantom pending
+// replicas come from allocations whose writer never reports, and they would
+// keep the Chunk below its replicaFactor forever because BatchFilterChunk
+// counts them. Sending ones are left to abandonStaleSends, and Chunk whose
+// client write is still in progress are skipped. It relies on heartbeats which
+// are not persisted, so it should only be called by the leader, and the result
+// is applied by ExpirePendingOperation. It returns the id of stale DataNode of
+// each Chunk.
+func FindStalePendingDataNodes() map[string][]string {
+	maxHeartbeats := int64(defaultSendTimeoutHeartbeats)
+	if viper.IsSet(MasterSendTimeoutHeartbeats) {
+		maxHeartbeats = viper.GetInt64(MasterSendTimeoutHeartbeats)
+	}
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	sending := make(map[ChunkSendInfo]bool)
+	for _, dataNode := range dataNodeMap {
+		for info := range dataNode.FutureSendChunks {
+			sending[ChunkSendInfo{ChunkId: info.ChunkId, DataNodeId: info.DataNodeId}] = true
+		}
+	}
+	stale := make(map[string][]string)
+	for _, chunk := range chunksMap {
+		for id := range chunk.pendingSince {
+			if !chunk.pendingDataNodes.Contains(id) {
+				delete(chunk.pendingSince, id)
+			}
+		}
+		if !chunk.isCommitted() {
+			chunk.pendingSince = nil
+			continue
+		}
+		for _, id := range set2SortedStrings(chunk.pendingDataNodes) {
+			dataNode, ok := dataNodeMap[id]
+			if !ok || sending[ChunkSendInfo{ChunkId: chunk.Id, DataNodeId: id}] {
+				delete(chunk.pendingSince, id)
+				continue
+			}
+			since, ok := chunk.pendingSince[id]
+			if !ok {
+				if chunk.pendingSince == nil {
+					chunk.pendingSince = make(map[string]int64)
+				}
+				chunk.pendingSince[id] = dataNode.heartbeats
+				continue
+			}
+			if dataNode.heartbeats-since > maxHeartbeats {
+				stale[chunk.Id] = append(stale[chunk.Id], id)
+			}
+		}
+	}
+	return stale
+}
+
+// ExpirePendingDataNodes removes the given DataNode from pendingDataNodes of
+// each Chunk if they are still pending there and the Chunk is committed.
+// Expired Chunk are put to pendingChunkQueue again. It returns the number of
+// expired replicas.
+func ExpirePendingDataNodes(stale map[string][]string) int {
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	chunkIds := make([]string, 0, len(stale))
+	for chunkId := range stale {
+		chunkIds = append(chunkIds, chunkId)
+	}
+	sort.Strings(chunkIds)
+	expired := 0
+	for _, chunkId := range chunkIds {
+		chunk, ok := chunksMap[chunkId]
+		if !ok || !chunk.isCommitted() {
+			continue
+		}
+		for _, id := range stale[chunkId] {
+			if !chunk.pendingDataNodes.Contains(id) {
+				continue
+			}
+			Logger.Warnf("Expire a stale pending replica, chunk id: %s, datanode id: %s", chunkId, id)
+			chunk.pendingDataNodes.Remove(id)
+			delete(chunk.pendingSince, id)
+			enqueuePendingChunk(chunkId, PendingReasonSendTimeout)
+			expired++
+		}
+	}
+	return expired
+}
+
+// ReconcileReplicaFactor makes existing replicas of the given Chunk match the
+// replicaFactor. Chunk missing replicas are put to pendingChunkQueue once for
+// each missing replica, and they are deferred if the queue is saturated. Excess
+// replicas are deleted from the DataNode storing the most Chunk, except pinned
+// ones. Erasure coded Chunk are skipped. now must be the time of the leader
+// carried by the operation, so that all masters defer the Chunk to the same
+// release time. It returns the number of queued and deleted replicas.
+func ReconcileReplicaFactor(chunkIds []string, replicaFactor int, now time.Time) (int, int) {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	missingIds := make([]string, 0)
+	removed := 0
+	for _, id := range chunkIds {
+		chunk, ok := chunksMap[id]
+		if !ok || chunk.codingScheme.IsErasureCoded() {
+			continue
+		}
+		replicaNum := chunk.dataNodes.Cardinality() + chunk.pendingDataNodes.Cardinality()
+		for ; replicaNum < replicaFactor; replicaNum++ {
+			missingIds = append(missingIds, id)
+		}
+		if replicaNum <= replicaFactor {
+			continue
+		}
+		candidates := make([]*DataNode, 0, chunk.dataNodes.Cardinality())
+		for _, dataNodeId := range set2SortedStrings(chunk.dataNodes) {
+			if dataNode, ok := dataNodeMap[dataNodeId]; ok && !chunk.isPinnedOn(dataNodeId) {
+				candidates = append(candidates, dataNode)
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].Chunks.Cardinality() > candidates[j].Chunks.Cardinality()
+		})
+		for _, dataNode := range candidates {
+			// Keep at least one stored replica, pending ones may fail.
+			if replicaNum <= replicaFactor || chunk.dataNodes.Cardinality() <= 1 {
+				break
+			}
+			dataNode.scheduleChunkDelete(id)
+			chunk.dataNodes.Remove(dataNode.Id)
+			replicaNum--
+			removed++
+			Logger.Infof("Delete excess replica, chunk id: %s, datanode id: %s", id, dataNode.Id)
+		}
+	}
+	pushPendingChunks(missingIds, now)
+	return len(missingIds), removed
+}
+
+// BatchApplyPlan2Chunk use the given plan to allocate DataNode for each Chunk.
+// The plan is made before it goes through Raft, so the target DataNode may have
+// stored or been allocated to the Chunk when the plan is applied. Such
+// assignment is skipped, otherwise it would stay pending forever. It returns
+// whether each assignment is applied.
+func BatchApplyPlan2Chunk(plan []int, chunkIds []string, dataNodeIds []string) []bool {
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	applied := make([]bool, len(plan))
+	for i, dnIndex := range plan {
+		chunk, ok := chunksMap[chunkIds[i]]
+		if !ok {
+			continue
+		}
+		dataNodeId := dataNodeIds[dnIndex]
+		if chunk.dataNodes.Contains(dataNodeId) || chunk.pendingDataNodes.Contains(dataNodeId) {
+			Logger.Warnf("Skip allocating chunk to a datanode which already has it, chunk id: %s, datanode id: %s",
+				chunk.Id, dataNodeId)
+			skippedPlacementCountMonitor.Inc()
+			continue
+		}
+		chunk.pendingDataNodes.Add(dataNodeId)
+		applied[i] = true
+	}
+	return applied
+}
+
+// ChunkState is a copy of the replication state of a Chunk. It is used to export
+// chunk state to external tools, so it must not share any set with the Chunk.
+type ChunkState struct {
+	ChunkId          string
+	DataNodes        []string
+	PendingDataNodes []string
+	ReplicaFactor    int
+	Committed        bool
+	// LastAccessTime is the last time(unix seconds) the Chunk was read.
+	LastAccessTime int64
+}
+
+// ChunkStateExporter holds the replication state of all Chunk copied at the
+// moment it is created. All pages exported by the same ChunkStateExporter come
+// from this single copy, so they never mix states even if chunksMap changes
+// during a long scan.
+type ChunkStateExporter struct {
+	// states is sorted by ChunkId.
+	states []ChunkState
+}
+
+// NewChunkStateExporter copies the state of all Chunk in chunksMap under the
+// read lock and release the lock immediately, so exporting will not block
+// other operations on chunksMap.
+func NewChunkStateExporter() *ChunkStateExporter {
+	updateChunksLock.RLock()
+	states := make([]ChunkState, 0, len(chunksMap))
+	for id, chunk := range chunksMap {
+		states = append(states, ChunkState{
+			ChunkId:          id,
+			DataNodes:        set2SortedStrings(chunk.dataNodes),
+			PendingDataNodes: set2SortedStrings(chunk.pendingDataNodes),
+			ReplicaFactor:    getChunkReplicaFactor(id),
+			Committed:        chunk.isCommitted(),
+			LastAccessTime:   chunk.lastAccessTime,
+		})
+	}
+	updateChunksLock.RUnlock()
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].ChunkId < states[j].ChunkId
+	})
+	return &ChunkStateExporter{states: states}
+}
+
+// Export returns at most limit ChunkState whose id is after the given token and
+// the token of next page. An empty token means starting from the first Chunk and
+// an empty returned token means there is no more Chunk.
+func (e *ChunkStateExporter) Export(token string, limit int) ([]ChunkState, string) {
+	start := 0
+	if token != "" {
+		start = sort.Search(len(e.states), func(i int) bool {
+			return e.states[i].ChunkId > token
+		})
+	}
+	end := start + limit
+	if limit <= 0 || end > len(e.states) {
+		end = len(e.states)
+	}
+	page := e.states[start:end]
+	if end == len(e.states) || len(page) == 0 {
+		return page, ""
+	}
+	return page, page[len(page)-1].ChunkId
+}
+
+// ExportChunkState exports the state of all Chunk in id-sorted order page by
+// page with the given send function. All pages come from one consistent copy
+// of chunksMap. It is used by the streaming RPC which dumps chunk state.
+func ExportChunkState(send func(states []ChunkState, token string) error) error {
+	pageSize := viper.GetInt(MasterExportPageSize)
+	if pageSize <= 0 {
+		pageSize = defaultExportPageSize
+	}
+	exporter := NewChunkStateExporter()
+	token := ""
+	for {
+		states, nextToken := exporter.Export(token, pageSize)
+		if err := send(states, nextToken); err != nil {
+			return err
+		}
+		if nextToken == "" {
+			return nil
+		}
+		token = nextToken
+	}
+}
+
+// set2SortedStrings converts a set of string to a sorted string slice.
+func set2SortedStrings(s set.Set) []string {
+	res := util.Interfaces2TypeArr[string](s.ToSlice())
+	sort.Strings(res)
+	return res
+}
+
+// PersistChunks writes all Chunk in chunksMap to the sink for persistence. The
+// caller must hold updateChunksLock.
+func PersistChunks(sink raft.SnapshotSink) error {
+	if err := writeSectionHeader(sink); err != nil {
+		return err
+	}
+	for _, chunk := range chunksMap {
+		_, err := sink.Write([]byte(chunk.String()))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := sink.Write([]byte(common.SnapshotDelimiter))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RestoreChunks reads all Chunk from the buf and puts them into chunksMap.
+func RestoreChunks(buf *bufio.Scanner) error {
+	chunksMap = map[string]*Chunk{}
+	err := scanSection(buf, sectionChunks, func(line string) error {
+		chunk, err := parseChunk(line)
+		if err != nil {
+			return err
+		}
+		chunksMap[chunk.Id] = chunk
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rebuildChunkBloom()
+	restoreLostFragments()
+	return nil
+}
+
+// ValidateChunks parses the chunks section of a snapshot like RestoreChunks,
+// but only reports what it finds without changing chunksMap.
+func ValidateChunks(buf *bufio.Scanner) *SectionReport {
+	return validateSection(buf, sectionChunks, func(line string) error {
+		_, err := parseChunk(line)
+		return err
+	})
+}
+
+// parseChunk parses a Chunk from the string created by Chunk.String.
+func parseChunk(line string) (*Chunk, error) {
+	data := strings.Split(line, common.DollarDelimiter)
+	if len(data) <= pendingDataNodesIdx || len(data) > quarantinedDataNodesIdx+1 ||
+		len(data) == codingSchemeIdx+1 || len(data) == primaryIdx+1 {
+		return nil, fmt.Errorf("illegal number of fields, expect %d to %d, got %d",
+			pendingDataNodesIdx+1, quarantinedDataNodesIdx+1, len(data))
+	}
+	if data[chunkIdIdx] == "" {
+		return nil, fmt.Errorf("chunk id is empty")
+	}
+	dataNodes, err := parseStringSetField(data[dataNodesIdx])
+	if err != nil {
+		return nil, err
+	}
+	pendingDataNodes, err := parseStringSetField(data[pendingDataNodesIdx])
+	if err != nil {
+		return nil, err
+	}
+	chunk := &Chunk{
+		Id:               data[chunkIdIdx],
+		dataNodes:        dataNodes,
+		pendingDataNodes: pendingDataNodes,
+	}
+	if len(data) > pinnedDataNodesIdx {
+		chunk.pinnedDataNodes, err = parseStringSetField(data[pinnedDataNodesIdx])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > minAckNumIdx {
+		chunk.minAckNum, err = strconv.Atoi(data[minAckNumIdx])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > lastAccessTimeIdx {
+		chunk.lastAccessTime, err = strconv.ParseInt(data[lastAccessTimeIdx], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// A replicated Chunk only writes its coding scheme and fragments when its
+	// size is written.
+	if len(data) > fragmentsIdx && data[codingSchemeIdx] != replicatedScheme {
+		chunk.codingScheme, err = ParseCodingScheme(data[codingSchemeIdx])
+		if err != nil {
+			return nil, err
+		}
+		chunk.fragments, err = parseFragments(data[fragmentsIdx], chunk.codingScheme)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > chunkSizeIdx {
+		chunk.Size, err = strconv.ParseInt(data[chunkSizeIdx], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > primaryEpochIdx {
+		chunk.primary = data[primaryIdx]
+		chunk.primaryEpoch, err = strconv.ParseInt(data[primaryEpochIdx], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > quarantinedDataNodesIdx {
+		chunk.quarantinedDataNodes, err = parseStringSetField(data[quarantinedDataNodesIdx])
+		if err != nil {
+			return nil, err
+		}
 	}
+	return chunk, nil
 }
 
-func GetChunk(id string) *Chunk {
-	updateChunksLock.RLock()
-	defer updateChunksLock.RUnlock()
-	return chunksMap[id]
+// parseStringSetField parses a string set like parseStringSet, but returns an
+// error if the field is not in the string format of a string slice.
+func parseStringSetField(field string) (set.Set, error) {
+	if !strings.HasPrefix(field, "[") || !strings.HasSuffix(field, "]") {
+		return nil, fmt.Errorf("malformed set field: %q", field)
+	}
+	return parseStringSet(field), nil
 }
 
-func BatchClearDataNode(chunkIds []interface{}, dataNodeId string) {
+// parseStringSet parses a string set from the string format of a string slice
+// like "[a b c]".
+func parseStringSet(field string) set.Set {
+	res := set.NewSet()
+	field = strings.TrimSuffix(strings.TrimPrefix(field, "["), "]")
+	if field == "" {
+		return res
+	}
+	for _, s := range strings.Split(field, " ") {
+		res.Add(s)
+	}
+	return res
+}
+
+// PinChunk pins a Chunk to a DataNode so that the DataNode will always store
+// the Chunk. If the DataNode has not stored the Chunk, a copy from one of the
+// DataNode storing the Chunk will be scheduled.
+func PinChunk(chunkId string, dataNodeId string) error {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
 	updateChunksLock.Lock()
 	defer updateChunksLock.Unlock()
-	for _, id := range chunkIds {
-		if chunk, ok := chunksMap[id.(string)]; ok {
-			chunk.dataNodes.Remove(dataNodeId)
-		}
+	chunk, ok := chunksMap[chunkId]
+	if !ok {
+		return fmt.Errorf("chunk not exist, chunk id: %s", chunkId)
+	}
+	if dataNode, ok := dataNodeMap[dataNodeId]; !ok || dataNode.Status != common.Alive {
+		return fmt.Errorf("datanode not exist or not alive, datanode id: %s", dataNodeId)
 	}
+	if chunk.pinnedDataNodes == nil {
+		chunk.pinnedDataNodes = set.NewSet()
+	}
+	chunk.pinnedDataNodes.Add(dataNodeId)
+	return schedulePinnedCopy(chunk, dataNodeId)
 }
 
-// BatchClearPendingDataNodes clear all pendingDataNodes of Chunk's id in the
-// given slice.
-func BatchClearPendingDataNodes(chunkIds []string) {
+// UnpinChunk removes the pin of a Chunk on a DataNode. The replica stored in
+// that DataNode will not be removed.
+func UnpinChunk(chunkId string, dataNodeId string) error {
 	updateChunksLock.Lock()
 	defer updateChunksLock.Unlock()
-	for _, id := range chunkIds {
-		if chunk, ok := chunksMap[id]; ok {
-			chunk.pendingDataNodes.Clear()
-			pendingChunkQueue.Push(String(id))
-		}
+	chunk, ok := chunksMap[chunkId]
+	if !ok {
+		return fmt.Errorf("chunk not exist, chunk id: %s", chunkId)
 	}
+	if !chunk.isPinnedOn(dataNodeId) {
+		return fmt.Errorf("chunk is not pinned on datanode, chunk id: %s, datanode id: %s", chunkId, dataNodeId)
+	}
+	chunk.pinnedDataNodes.Remove(dataNodeId)
+	return nil
 }
 
-// BatchUpdatePendingDataNodes move all DataNode which have store the corresponding
-// Chunk successfully from that Chunk's pendingDataNodes to its dataNodes.
-func BatchUpdatePendingDataNodes(infos []util.ChunkTaskResult) {
+// RestorePinnedReplicas schedules copies of Chunk which are pinned on the given
+// DataNode but have been lost by it.
+func RestorePinnedReplicas(dataNodeId string, lostChunkIds []string) {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
 	updateChunksLock.Lock()
 	defer updateChunksLock.Unlock()
-	for _, info := range infos {
-		if chunk, ok := chunksMap[info.ChunkId]; ok {
-			for _, id := range info.SuccessDataNodes {
-				chunk.dataNodes.Add(id)
+	for _, chunkId := range lostChunkIds {
+		if chunk, ok := chunksMap[chunkId]; ok && chunk.isPinnedOn(dataNodeId) {
+			if err := schedulePinnedCopy(chunk, dataNodeId); err != nil {
+				Logger.Warnf("Fail to restore pinned replica, error detail: %s", err.Error())
 			}
-			for i := 0; i < len(info.FailDataNodes); i++ {
-				pendingChunkQueue.Push(String(info.ChunkId))
-			}
-			chunk.pendingDataNodes.Clear()
 		}
 	}
 }
 
-// BatchFilterChunk filter Chunk that still exists, and it's DataNode is not full
-// from given Chunk's id slice.
-func BatchFilterChunk(ids []string) []string {
-	updateChunksLock.RLock()
-	defer updateChunksLock.RUnlock()
-	chunkIds := make([]string, 0, len(ids))
-	for i := 0; i < len(ids); i++ {
-		// Chunk should still exist, and it's DataNode is not full.
-		if chunk, ok := chunksMap[ids[i]]; ok {
-			if chunk.dataNodes.Cardinality()+chunk.pendingDataNodes.Cardinality() < viper.GetInt(common.ReplicaNum) {
-				chunkIds = append(chunkIds, ids[i])
-			}
+// schedulePinnedCopy schedules a copy of the Chunk to the pinned DataNode if the
+// DataNode has neither stored nor been allocated to store the Chunk. The caller
+// must hold both updateMapLock and updateChunksLock.
+func schedulePinnedCopy(chunk *Chunk, dataNodeId string) error {
+	if chunk.dataNodes.Contains(dataNodeId) || chunk.pendingDataNodes.Contains(dataNodeId) ||
+		chunk.isQuarantinedOn(dataNodeId) {
+		return nil
+	}
+	for _, id := range set2SortedStrings(chunk.dataNodes) {
+		if source, ok := dataNodeMap[id]; ok && source.Status == common.Alive {
+			source.FutureSendChunks[ChunkSendInfo{
+				ChunkId:    chunk.Id,
+				DataNodeId: dataNodeId,
+				SendType:   common.CopySendType,
+			}] = common.WaitToInform
+			chunk.pendingDataNodes.Add(dataNodeId)
+			return nil
 		}
 	}
-	return chunkIds
+	return fmt.Errorf("no alive datanode stores the chunk, chunk id: %s", chunk.Id)
 }
 
-// BatchApplyPlan2Chunk use the given plan to allocate DataNode for each Chunk.
-func BatchApplyPlan2Chunk(plan []int, chunkIds []string, dataNodeIds []string) {
+// EvictChunkFromNode moves the replica of a Chunk off the given DataNode without
+// decommissioning the DataNode. The replica is moved to a newly allocated
+// DataNode, and the DataNode is removed from dataNodes of the Chunk once the
+// move is reported by heartbeat. It fails if the DataNode does not store the
+// Chunk, or if there is no DataNode to receive the replica, because evicting it
+// without a target would drop the Chunk below the replica floor.
+func EvictChunkFromNode(chunkId string, dataNodeId string) (string, error) {
+	constraint := getPlacementConstraint(chunkId)
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
 	updateChunksLock.Lock()
 	defer updateChunksLock.Unlock()
-	for i, dnIndex := range plan {
-		chunksMap[chunkIds[i]].pendingDataNodes.Add(dataNodeIds[dnIndex])
+	chunk, ok := chunksMap[chunkId]
+	if !ok {
+		return "", fmt.Errorf("chunk not exist, chunk id: %s", chunkId)
 	}
-}
-
-// PersistChunks writes all Chunk in chunksMap to the sink for persistence.
-func PersistChunks(sink raft.SnapshotSink) error {
-	for _, chunk := range chunksMap {
-		_, err := sink.Write([]byte(chunk.String()))
-		if err != nil {
-			return err
-		}
+	if chunk.codingScheme.IsErasureCoded() {
+		return "", fmt.Errorf("fragment of erasure coded chunk can not be evicted, chunk id: %s", chunkId)
 	}
-	_, err := sink.Write([]byte(common.SnapshotDelimiter))
-	if err != nil {
-		return err
+	if !chunk.dataNodes.Contains(dataNodeId) {
+		return "", fmt.Errorf("datanode does not store the chunk, chunk id: %s, datanode id: %s", chunkId,
+			dataNodeId)
 	}
-	return nil
-}
-
-// RestoreChunks reads all Chunk from the buf and puts them into chunksMap.
-func RestoreChunks(buf *bufio.Scanner) error {
-	dataNodes := set.NewSet()
-	pendingDataNodes := set.NewSet()
-	chunksMap = map[string]*Chunk{}
-	for buf.Scan() {
-		line := buf.Text()
-		if line == common.SnapshotDelimiter {
-			return nil
-		}
-		data := strings.Split(line, "$")
-
-		dataNodesLen := len(data[dataNodesIdx])
-		dataNodesData := data[dataNodesIdx][1 : dataNodesLen-1]
-		for _, dnId := range strings.Split(dataNodesData, " ") {
-			dataNodes.Add(dnId)
+	if chunk.isPinnedOn(dataNodeId) {
+		return "", fmt.Errorf("chunk is pinned on datanode, chunk id: %s, datanode id: %s", chunkId, dataNodeId)
+	}
+	source, ok := dataNodeMap[dataNodeId]
+	if !ok || source.Status != common.Alive {
+		return "", fmt.Errorf("datanode not exist or not alive, datanode id: %s", dataNodeId)
+	}
+	for info := range source.FutureSendChunks {
+		if info.ChunkId == chunkId && info.SendType == common.MoveSendType {
+			return "", fmt.Errorf("chunk is already being moved, chunk id: %s, datanode id: %s", chunkId,
+				dataNodeId)
 		}
-		pendingDataNodesLen := len(data[pendingDataNodesIdx])
-		pendingDataNodesData := data[pendingDataNodesIdx][1 : pendingDataNodesLen-1]
-		for _, dnId := range strings.Split(pendingDataNodesData, " ") {
-			pendingDataNodes.Add(dnId)
+	}
+	var target *DataNode
+	for _, node := range dataNodeMap {
+		if node.Status != common.Alive || chunk.dataNodes.Contains(node.Id) ||
+			chunk.pendingDataNodes.Contains(node.Id) || !constraint.Match(node.Tags) {
+			continue
 		}
-		chunksMap[data[chunkIdIdx]] = &Chunk{
-			Id:               data[chunkIdIdx],
-			dataNodes:        dataNodes,
-			pendingDataNodes: pendingDataNodes,
+		if target == nil || node.Chunks.Cardinality() < target.Chunks.Cardinality() ||
+			(node.Chunks.Cardinality() == target.Chunks.Cardinality() && node.Id < target.Id) {
+			target = node
 		}
 	}
-	return nil
+	if target == nil {
+		return "", fmt.Errorf("no datanode can receive the chunk, evicting it would drop below the replica floor, "+
+			"chunk id: %s", chunkId)
+	}
+	source.FutureSendChunks[ChunkSendInfo{
+		ChunkId:    chunkId,
+		DataNodeId: target.Id,
+		SendType:   common.MoveSendType,
+	}] = common.WaitToInform
+	chunk.pendingDataNodes.Add(target.Id)
+	Logger.Infof("Evict chunk from datanode, chunk id: %s, source: %s, target: %s", chunkId, dataNodeId, target.Id)
+	return target.Id, nil
+}
+
+// isChunkPinnedOn checks whether the Chunk is pinned on the given DataNode.
+func isChunkPinnedOn(chunkId string, dataNodeId string) bool {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	chunk, ok := chunksMap[chunkId]
+	return ok && chunk.isPinnedOn(dataNodeId)
 }
 
 type String string
@@ -212,86 +1412,473 @@ func (q *PendingChunkQueue) String() string {
 	return q.queue.String()
 }
 
+// PersistPendingChunkQueue writes all Chunk's id in pendingChunkQueue to the
+// sink without changing the queue. Each id is written in its own line with its
+// length as prefix, like "7:chunk_1", so that the format does not depend on
+// what characters an id contains.
 func PersistPendingChunkQueue(sink raft.SnapshotSink) error {
-	_, err := sink.Write([]byte(pendingChunkQueue.String()))
-	if err != nil {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	return persistPendingChunkQueue(sink)
+}
+
+// persistPendingChunkQueue is the lock-free version of PersistPendingChunkQueue.
+// The caller must hold updateChunksLock.
+func persistPendingChunkQueue(sink raft.SnapshotSink) error {
+	if err := writeSectionHeader(sink); err != nil {
 		return err
 	}
-
-	_, err = sink.Write([]byte(common.SnapshotDelimiter))
+	ids := make([]string, 0, pendingChunkQueue.Len())
+	for _, id := range pendingChunkQueue.BatchTop(pendingChunkQueue.Len()) {
+		ids = append(ids, id.String())
+	}
+	// Lost Chunk are persisted as pending Chunk, they will be found lost again
+	// in the next allocation if no DataNode storing them comes back.
+	// So are staged Chunk, which are released at once after restoring.
+	ids = append(ids, set2SortedStrings(lostChunkIds)...)
+	for _, chunk := range stagedChunks {
+		ids = append(ids, chunk.chunkId)
+	}
+	for _, id := range ids {
+		line, err := encodePendingChunk(id)
+		if err != nil {
+			return err
+		}
+		if _, err = sink.Write([]byte(line)); err != nil {
+			return err
+		}
+	}
+	_, err := sink.Write([]byte(common.SnapshotDelimiter))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// RestorePendingChunkQueue reads all Chunk's id written by
+// PersistPendingChunkQueue and pushes them into pendingChunkQueue. Nothing will
+// be pushed if any line is malformed.
 func RestorePendingChunkQueue(buf *bufio.Scanner) error {
-	for buf.Scan() {
-		line := buf.Text()
-		if line == common.SnapshotDelimiter {
+	lostChunkIds.Clear()
+	lostChunkCountMonitor.Set(0)
+	stagedChunks = stagedChunks[:0]
+	ids := make([]string, 0)
+	err := scanSection(buf, sectionPendingChunkQueue, func(line string) error {
+		// An empty queue is written as an empty line by the old format.
+		if line == "" {
 			return nil
 		}
-		line = strings.Trim(line, common.DollarDelimiter)
-		data := strings.Split(line, "$")
-		for _, datum := range data {
-			pendingChunkQueue.Push(String(datum))
+		id, err := decodePendingChunk(line)
+		if err != nil {
+			return err
 		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		enqueuePendingChunk(id, "")
 	}
 	return nil
 }
 
+// encodePendingChunk encodes a Chunk's id into a line like "7:chunk_1".
+func encodePendingChunk(id string) (string, error) {
+	if id == "" || strings.Contains(id, "\n") {
+		return "", fmt.Errorf("illegal pending chunk id, id: %q", id)
+	}
+	return fmt.Sprintf("%d%s%s\n", len(id), pendingChunkLenDelimiter, id), nil
+}
+
+// decodePendingChunk decodes a Chunk's id from a line created by
+// encodePendingChunk.
+func decodePendingChunk(line string) (string, error) {
+	lenStr, id, ok := strings.Cut(line, pendingChunkLenDelimiter)
+	if !ok {
+		return "", fmt.Errorf("malformed pending chunk, line: %q", line)
+	}
+	idLen, err := strconv.Atoi(lenStr)
+	if err != nil || idLen <= 0 || idLen != len(id) {
+		return "", fmt.Errorf("malformed pending chunk, line: %q", line)
+	}
+	return id, nil
+}
+
 // BatchAllocateChunks runs in a goroutine. It will get a batch of Chunk from
 // pendingChunkQueue and the best plan which allocate a target DataNode to
 // store for each Chunk.
 // 1. Get batch of Chunk from pendingChunkQueue.
-// 2. Filter legal Chunk and alive DataNode.
+// 2. Filter legal Chunk and alive DataNode. Chunk which can not be received by
+//    any DataNode under its PlacementConstraint stays in pendingChunkQueue.
+//    Chunk which is not stored by any alive DataNode is marked as lost.
 // 3. Get current store state(which Chunk is stored by which DataNode).
 // 4. Use DFS algorithm to get the best plan which decide the receiver and sender
 //    of every Chunk to make the number of Chunk received and send by each DataNode
 //    as balanced as possible(use variance to measure).
+// At most master.allocateWorkerNum allocations are computed at the same time,
+// a trigger is skipped if all of them are busy.
 func BatchAllocateChunks() {
-	Logger.Infof("Start to allocate a batch of chunks.")
+	ok := runAllocateWorker(func() {
+		Logger.Infof("Start to allocate a batch of chunks.")
+		batchAllocateChunks()
+		Logger.Infof("Suceess to allocate a batch of chunks.")
+	})
+	if !ok {
+		Logger.Debugf("Skip allocating chunks because all allocate workers are busy.")
+	}
+}
+
+// runAllocateWorker runs f if the number of running allocations is less than
+// the configured worker number, otherwise it returns false immediately. Chunk
+// stay in pendingChunkQueue when an allocation is skipped, so they will be
+// allocated by the next trigger.
+func runAllocateWorker(f func()) bool {
+	workerNum := viper.GetInt(MasterAllocateWorkerNum)
+	if workerNum <= 0 {
+		workerNum = defaultAllocateWorkerNum
+	}
+	allocateWorkerLock.Lock()
+	if runningAllocateNum >= workerNum {
+		allocateWorkerLock.Unlock()
+		return false
+	}
+	runningAllocateNum++
+	allocateWorkerLock.Unlock()
+	defer func() {
+		allocateWorkerLock.Lock()
+		runningAllocateNum--
+		allocateWorkerLock.Unlock()
+	}()
+	f()
+	return true
+}
+
+// batchAllocateChunks computes and applies the plan of a batch of Chunk. It
+// must be called by runAllocateWorker.
+func batchAllocateChunks() {
 	if pendingChunkQueue.Len() != 0 {
-		batchChunkIds := getPendingChunks()
-		chunkIds := BatchFilterChunk(batchChunkIds)
-		dataNodeIds := GetAliveDataNodeIds()
-		isStore := getStoreState(chunkIds, dataNodeIds)
-		// Todo DataNode num is less than replicate num or other similar situation so that a Chunk can not find a DataNode to store.
-		receiverPlan := allocateChunksDFS(len(chunkIds), len(dataNodeIds), isStore)
-		for i := 0; i < len(isStore); i++ {
-			for j := 0; j < len(isStore[0]); j++ {
-				isStore[i][j] = !isStore[i][j]
-			}
-		}
-		senderPlan := allocateChunksDFS(len(chunkIds), len(dataNodeIds), isStore)
-		Logger.Debugf("Receiver plan is %v", receiverPlan)
-		Logger.Debugf("Sender plan is %v", senderPlan)
-		operation := &AllocateChunksOperation{
-			Id:           util.GenerateUUIDString(),
-			SenderPlan:   senderPlan,
-			ReceiverPlan: receiverPlan,
-			ChunkIds:     chunkIds,
-			DataNodeIds:  dataNodeIds,
-			BatchLen:     len(batchChunkIds),
-		}
+		operation := planAllocateChunks()
 		data := getData4Apply(operation, common.OperationAllocateChunks)
 		applyFuture := GlobalMasterHandler.Raft.Apply(data, 5*time.Second)
 		if err := applyFuture.Error(); err != nil {
 			Logger.Errorf("Fail to allocate a batch of chunks, error detail: %s,", err.Error())
 		}
 	}
-	Logger.Infof("Suceess to allocate a batch of chunks.")
+}
+
+// planAllocateChunks computes the plan of a batch of Chunk taken from
+// pendingChunkQueue without applying it.
+func planAllocateChunks() *AllocateChunksOperation {
+	batchChunkIds := getPendingChunks()
+	chunkIds := BatchFilterChunk(batchChunkIds)
+	dataNodeIds := GetAliveDataNodeIds()
+	chunkIds, lostIds := filterLostChunks(chunkIds, dataNodeIds)
+	isStore := getStoreState(chunkIds, dataNodeIds)
+	isBlocked := getBlockedState(chunkIds, dataNodeIds, isStore)
+	chunkIds, isStore, isBlocked, unsatisfiedChunkIds := filterUnsatisfiedChunks(chunkIds, isStore, isBlocked)
+	cost := newAllocateCost(len(chunkIds), dataNodeIds, isStore, getAllocateCostWeights())
+	receiverPlan := allocateChunksDFSWithCost(len(chunkIds), len(dataNodeIds), isBlocked, cost)
+	for i := 0; i < len(isStore); i++ {
+		for j := 0; j < len(isStore[0]); j++ {
+			isStore[i][j] = !isStore[i][j]
+		}
+	}
+	senderPlan := allocateChunksDFS(len(chunkIds), len(dataNodeIds), isStore)
+	Logger.Debugf("Receiver plan is %v", receiverPlan)
+	Logger.Debugf("Sender plan is %v", senderPlan)
+	return &AllocateChunksOperation{
+		Id:                  util.GenerateUUIDString(),
+		SenderPlan:          senderPlan,
+		ReceiverPlan:        receiverPlan,
+		ChunkIds:            chunkIds,
+		DataNodeIds:         dataNodeIds,
+		BatchChunkIds:       batchChunkIds,
+		BatchLen:            len(batchChunkIds),
+		UnsatisfiedChunkIds: unsatisfiedChunkIds,
+		LostChunkIds:        lostIds,
+	}
 }
 
 // ApplyAllocatePlan will apply the given allocating plan. It will:
 // 1. Apply the best plan to all target Chunk.
 // 2. Apply the best plan to all target DataNode.
 // 3. Remove the batch of Chunk from pendingChunkQueue.
+// 4. Put Chunk which can not be placed back to pendingChunkQueue.
+// 5. Mark Chunk which have no alive source as lost.
 func ApplyAllocatePlan(senderPlan []int, receiverPlan []int, chunkIds []string, dataNodeIds []string,
-	batchLen int) {
-	BatchApplyPlan2Chunk(receiverPlan, chunkIds, dataNodeIds)
-	BatchApplyPlan2DataNode(receiverPlan, senderPlan, chunkIds, dataNodeIds)
-	pendingChunkQueue.BatchPop(batchLen)
+	batchChunkIds []string, batchLen int, unsatisfiedChunkIds []string, lostIds []string) {
+	applied := BatchApplyPlan2Chunk(receiverPlan, chunkIds, dataNodeIds)
+	// Only Chunk which gets a new pending DataNode needs to be sent.
+	appliedReceiverPlan := make([]int, 0, len(receiverPlan))
+	appliedSenderPlan := make([]int, 0, len(senderPlan))
+	appliedChunkIds := make([]string, 0, len(chunkIds))
+	for i := range receiverPlan {
+		if applied[i] {
+			appliedReceiverPlan = append(appliedReceiverPlan, receiverPlan[i])
+			appliedSenderPlan = append(appliedSenderPlan, senderPlan[i])
+			appliedChunkIds = append(appliedChunkIds, chunkIds[i])
+		}
+	}
+	BatchApplyPlan2DataNode(appliedReceiverPlan, appliedSenderPlan, appliedChunkIds, dataNodeIds)
+	// Chunk which can not be placed are tracked before the batch is removed,
+	// so that they keep the time they were put to pendingChunkQueue.
+	trackPendingChunks(unsatisfiedChunkIds, PendingReasonNoTarget, time.Now())
+	popPendingChunks(batchChunkIds, batchLen)
+	for _, id := range unsatisfiedChunkIds {
+		pendingChunkQueue.Push(String(id))
+	}
+	markChunksLost(lostIds)
+}
+
+// popPendingChunks removes the planned batch of Chunk from the head of
+// pendingChunkQueue. The queue may have been changed since the batch was taken
+// by getPendingChunks, so only the longest prefix of the queue which is the
+// same as the batch is removed. Operation created before the batch is recorded
+// only has batchLen, in which case at most batchLen Chunk are removed. It
+// returns the number of removed Chunk.
+func popPendingChunks(batchChunkIds []string, batchLen int) int {
+	if batchChunkIds == nil {
+		if batchLen > pendingChunkQueue.Len() {
+			batchLen = pendingChunkQueue.Len()
+		}
+		untrackPendingChunks(pendingChunkQueue.BatchPop(batchLen))
+		return batchLen
+	}
+	topLen := len(batchChunkIds)
+	if topLen > pendingChunkQueue.Len() {
+		topLen = pendingChunkQueue.Len()
+	}
+	popLen := 0
+	for i, id := range pendingChunkQueue.BatchTop(topLen) {
+		if id.String() != batchChunkIds[i] {
+			break
+		}
+		popLen++
+	}
+	if popLen != len(batchChunkIds) {
+		Logger.Warnf("Pending chunk queue has changed since planning, planned: %d, removed: %d",
+			len(batchChunkIds), popLen)
+	}
+	untrackPendingChunks(pendingChunkQueue.BatchPop(popLen))
+	return popLen
+}
+
+// filterLostChunks removes Chunk which is not stored by any alive DataNode from
+// the batch, because there is no DataNode to copy them from.
+func filterLostChunks(chunkIds []string, dataNodeIds []string) ([]string, []string) {
+	aliveDataNodes := set.NewSet()
+	for _, id := range dataNodeIds {
+		aliveDataNodes.Add(id)
+	}
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	resIds := make([]string, 0, len(chunkIds))
+	lostIds := make([]string, 0)
+	for _, id := range chunkIds {
+		chunk, ok := chunksMap[id]
+		// Chunk which has been removed needs no replica, and erasure coded Chunk
+		// is reconstructed rather than replicated.
+		if !ok || chunk.codingScheme.IsErasureCoded() {
+			continue
+		}
+		if chunk.dataNodes.Intersect(aliveDataNodes).Cardinality() == 0 {
+			lostIds = append(lostIds, id)
+			continue
+		}
+		resIds = append(resIds, id)
+	}
+	return resIds, lostIds
+}
+
+// markChunksLost puts Chunk into lostChunkIds so that they will not be allocated
+// again until a DataNode storing them comes back.
+func markChunksLost(chunkIds []string) {
+	if len(chunkIds) == 0 {
+		return
+	}
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	for _, id := range chunkIds {
+		Logger.Errorf("Chunk is lost because no alive datanode stores it, chunk id: %s", id)
+		lostChunkIds.Add(id)
+	}
+	lostChunkCountMonitor.Set(float64(lostChunkIds.Cardinality()))
+}
+
+// RecoverLostChunks is called when a DataNode reports the Chunk it stores. Lost
+// Chunk stored by the DataNode will be put back to pendingChunkQueue to fill
+// their missing replicas from this DataNode.
+func RecoverLostChunks(dataNodeId string, chunkIds []string) {
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	if lostChunkIds.Cardinality() == 0 {
+		return
+	}
+	for _, id := range chunkIds {
+		if !lostChunkIds.Contains(id) {
+			continue
+		}
+		lostChunkIds.Remove(id)
+		if chunk, ok := chunksMap[id]; ok && !chunk.isQuarantinedOn(dataNodeId) {
+			Logger.Infof("Lost chunk is found, chunk id: %s, datanode id: %s", id, dataNodeId)
+			chunk.dataNodes.Add(dataNodeId)
+			enqueuePendingChunk(id, "")
+		}
+	}
+	lostChunkCountMonitor.Set(float64(lostChunkIds.Cardinality()))
+}
+
+// StageChunks spreads the release time of Chunk stored by a dead DataNode evenly
+// over the window, so that they are put to pendingChunkQueue gradually rather
+// than all at once. All Chunk are put to pendingChunkQueue immediately if the
+// window is not positive, unless the queue is saturated. The release time is
+// counted from now, which must be the time of the leader carried by the
+// operation, so that all masters release the Chunk at the same time.
+func StageChunks(address string, chunkIds []string, window time.Duration, now time.Time) {
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	if window <= 0 {
+		pushPendingChunks(chunkIds, now)
+		return
+	}
+	for i, id := range chunkIds {
+		stagedChunks = append(stagedChunks, stagedChunk{
+			chunkId:     id,
+			address:     address,
+			releaseTime: now.Add(window * time.Duration(i+1) / time.Duration(len(chunkIds))),
+		})
+	}
+}
+
+// ReleaseStagedChunks puts all staged Chunk whose release time is not after now
+// to pendingChunkQueue. Once the queue is saturated, Chunk which are not
+// endangered stay staged until the queue drains. It returns the number of
+// released Chunk.
+func ReleaseStagedChunks(now time.Time) int {
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	watermark := getPendingQueueWatermark()
+	remains := stagedChunks[:0]
+	released := 0
+	for _, chunk := range stagedChunks {
+		if chunk.releaseTime.After(now) ||
+			(pendingChunkQueue.Len() >= watermark && !isEndangered(chunk.chunkId)) {
+			remains = append(remains, chunk)
+			continue
+		}
+		enqueuePendingChunk(chunk.chunkId, "")
+		released++
+	}
+	stagedChunks = remains
+	updatePendingQueueSaturation(watermark)
+	return released
+}
+
+// pushPendingChunks puts Chunk to pendingChunkQueue with backpressure. Once the
+// length of the queue reaches the high watermark, Chunk which are not
+// endangered are deferred to stagedChunks and released when the queue drains,
+// so that the queue can not grow unboundedly when the allocator can not keep
+// up. Endangered Chunk are always pushed so that they are never delayed. It
+// returns the number of deferred Chunk. The caller must hold updateChunksLock.
+func pushPendingChunks(chunkIds []string, now time.Time) int {
+	watermark := getPendingQueueWatermark()
+	deferred := 0
+	for _, id := range chunkIds {
+		if pendingChunkQueue.Len() < watermark || isEndangered(id) {
+			enqueuePendingChunk(id, "")
+			continue
+		}
+		// A deferred Chunk has no address, so it is never cancelled by a
+		// rejoined DataNode.
+		stagedChunks = append(stagedChunks, stagedChunk{
+			chunkId:     id,
+			releaseTime: now,
+		})
+		deferred++
+	}
+	if deferred != 0 {
+		Logger.Warnf("Pending chunk queue is saturated, deferred chunk num: %d, queue len: %d", deferred,
+			pendingChunkQueue.Len())
+		deferredChunkCountMonitor.Add(float64(deferred))
+	}
+	updatePendingQueueSaturation(watermark)
+	return deferred
+}
+
+// isEndangered returns true if the Chunk has at most one stored or pending
+// replica, which means it will be lost if one more DataNode dies. The caller
+// must hold updateChunksLock.
+func isEndangered(chunkId string) bool {
+	chunk, ok := chunksMap[chunkId]
+	if !ok {
+		return false
+	}
+	return chunk.dataNodes.Cardinality()+chunk.pendingDataNodes.Cardinality() <= 1
+}
+
+// getPendingQueueWatermark gets the configured high watermark of the length of
+// pendingChunkQueue.
+func getPendingQueueWatermark() int {
+	watermark := viper.GetInt(MasterPendingQueueWatermark)
+	if watermark <= 0 {
+		return defaultPendingQueueWatermark
+	}
+	return watermark
+}
+
+// updatePendingQueueSaturation flags whether pendingChunkQueue is saturated.
+func updatePendingQueueSaturation(watermark int) {
+	if pendingChunkQueue.Len() >= watermark {
+		pendingQueueSaturatedMonitor.Set(1)
+	} else {
+		pendingQueueSaturatedMonitor.Set(0)
+	}
+}
+
+// CancelStagedChunks is called when a DataNode registers. Staged Chunk which
+// were stored by a dead DataNode with the same address and are still stored by
+// the new DataNode will never be put to pendingChunkQueue. Instead, the replica
+// on the new DataNode is put back to dataNodes of the Chunk, otherwise the
+// Chunk would miss the replica while the DataNode still lists it.
+func CancelStagedChunks(address string, dataNodeId string, chunkIds []string) {
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	if len(stagedChunks) == 0 {
+		return
+	}
+	stored := set.NewSet()
+	for _, id := range chunkIds {
+		stored.Add(id)
+	}
+	remains := stagedChunks[:0]
+	for _, chunk := range stagedChunks {
+		if chunk.address == address && stored.Contains(chunk.chunkId) {
+			if c, ok := chunksMap[chunk.chunkId]; ok && !c.isQuarantinedOn(dataNodeId) {
+				c.dataNodes.Add(dataNodeId)
+			}
+			continue
+		}
+		remains = append(remains, chunk)
+	}
+	Logger.Infof("Cancel staged chunks of a rejoined datanode, address: %s, count: %d", address,
+		len(stagedChunks)-len(remains))
+	stagedChunks = remains
+}
+
+// getStagedChunkNum returns the number of Chunk waiting to be released.
+func getStagedChunkNum() int {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	return len(stagedChunks)
+}
+
+// GetLostChunks returns id of all lost Chunk, sorted by id.
+func GetLostChunks() []string {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	return set2SortedStrings(lostChunkIds)
 }
 
 // getPendingChunks get a batch of Chunk's id from the pendingChunkQueue. The
@@ -317,6 +1904,9 @@ func getPendingChunks() []string {
 
 // getStoreState gets the state of all DataNode which store target Chunk for all
 // given Chunk. We need to check both pendingDataNodes and dataNodes of a Chunk.
+// A Chunk which has been removed is regarded as stored by all DataNode, so that
+// no DataNode will receive it and it stays in pendingChunkQueue until it is
+// filtered out by BatchFilterChunk.
 func getStoreState(chunkIds []string, dataNodeIds []string) [][]bool {
 	updateChunksLock.RLock()
 	defer updateChunksLock.RUnlock()
@@ -329,37 +1919,169 @@ func getStoreState(chunkIds []string, dataNodeIds []string) [][]bool {
 		dnIndexMap[id] = i
 	}
 	for i, id := range chunkIds {
-		chunk := chunksMap[id]
-		dataNodes := chunk.dataNodes.ToSlice()
-		pendingDataNodes := chunk.pendingDataNodes.ToSlice()
-		for _, dnId := range dataNodes {
-			isStore[i][dnIndexMap[dnId.(string)]] = true
+		chunk, ok := chunksMap[id]
+		if !ok {
+			Logger.Warnf("Chunk is removed during allocation, chunk id: %s", id)
+			for j := range isStore[i] {
+				isStore[i][j] = true
+			}
+			continue
 		}
-		for _, pdnId := range pendingDataNodes {
-			isStore[i][dnIndexMap[pdnId.(string)]] = true
+		// DataNode with a quarantined replica is handled as storing the Chunk,
+		// so that the replica is not overwritten by a new one.
+		dataNodes := chunk.dataNodes.Union(chunk.pendingDataNodes).ToSlice()
+		if chunk.hasQuarantinedReplica() {
+			dataNodes = append(dataNodes, chunk.quarantinedDataNodes.ToSlice()...)
+		}
+		for _, dnId := range dataNodes {
+			// DataNode which is not alive is not in the matrix.
+			if j, ok := dnIndexMap[dnId.(string)]; ok {
+				isStore[i][j] = true
+			}
 		}
 	}
 	return isStore
 }
 
+// getBlockedState gets which DataNode can not receive which Chunk. A DataNode
+// can not receive a Chunk if it has stored the Chunk, its Tags do not match
+// the PlacementConstraint of the file which the Chunk belongs to or its failure
+// domain already has MaxReplicasPerDomain replicas of the Chunk. The distance
+// from DataNode storing the Chunk in topology is a term of allocateCost rather
+// than a block, so it can be traded off against the other terms.
+func getBlockedState(chunkIds []string, dataNodeIds []string, isStore [][]bool) [][]bool {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	dataNodes := make([]*DataNode, len(dataNodeIds))
+	for j, dnId := range dataNodeIds {
+		dataNodes[j] = dataNodeMap[dnId]
+	}
+	isBlocked := make([][]bool, len(chunkIds))
+	for i, id := range chunkIds {
+		constraint := getPlacementConstraint(id)
+		isBlocked[i] = make([]bool, len(dataNodeIds))
+		for j, dataNode := range dataNodes {
+			isBlocked[i][j] = isStore[i][j] || dataNode == nil || !constraint.Match(dataNode.Tags)
+		}
+		if len(topologyKeys) != 0 {
+			if maxPerDomain := getChunkMaxReplicasPerDomain(id); maxPerDomain != 0 {
+				blockFullDomains(isBlocked[i], isStore[i], dataNodes, topologyKeys, maxPerDomain)
+			}
+		}
+	}
+	return isBlocked
+}
+
+// getTopologyDistance gets the distance between two DataNode in topology. The
+// topologyKeys are the keys of Tags from the widest failure domain to the
+// narrowest one, e.g. ["zone", "rack"]. The distance is the number of failure
+// domains from the first one the two DataNode are not in together, so it is
+// len(topologyKeys) for DataNode in different zones and 0 for DataNode in the
+// same rack.
+func getTopologyDistance(tags1 map[string]string, tags2 map[string]string, topologyKeys []string) int {
+	for i, key := range topologyKeys {
+		if tags1[key] != tags2[key] {
+			return len(topologyKeys) - i
+		}
+	}
+	return 0
+}
+
+// filterUnsatisfiedChunks removes Chunk which can not be received by any DataNode
+// from the batch, so that they will stay in pendingChunkQueue.
+func filterUnsatisfiedChunks(chunkIds []string, isStore [][]bool, isBlocked [][]bool) ([]string,
+	[][]bool, [][]bool, []string) {
+	var (
+		resIds       = make([]string, 0, len(chunkIds))
+		resIsStore   = make([][]bool, 0, len(chunkIds))
+		resIsBlocked = make([][]bool, 0, len(chunkIds))
+		unsatisfied  = make([]string, 0)
+	)
+	for i, id := range chunkIds {
+		isSatisfied := false
+		for _, blocked := range isBlocked[i] {
+			if !blocked {
+				isSatisfied = true
+				break
+			}
+		}
+		if !isSatisfied {
+			Logger.Warnf("Chunk stays pending because no alive datanode can receive it, chunk id: %s, constraint: %s",
+				id, getPlacementConstraint(id))
+			unsatisfied = append(unsatisfied, id)
+			continue
+		}
+		resIds = append(resIds, id)
+		resIsStore = append(resIsStore, isStore[i])
+		resIsBlocked = append(resIsBlocked, isBlocked[i])
+	}
+	return resIds, resIsStore, resIsBlocked, unsatisfied
+}
+
 // allocateChunksDFS calculate the best allocating plan base on the given information.
+// The cost and the result of the search are exported as metrics.
 func allocateChunksDFS(chunkNum int, dataNodeNum int, isStore [][]bool) []int {
+	return allocateChunksDFSWithCost(chunkNum, dataNodeNum, isStore, nil)
+}
+
+// allocateChunksDFSWithCost calculate the plan with the least cost. The cost is
+// the variance of the number of Chunk allocated to each DataNode if cost is nil.
+func allocateChunksDFSWithCost(chunkNum int, dataNodeNum int, isStore [][]bool, cost *allocateCost) []int {
+	start := time.Now()
 	currentResult := make([][]int, dataNodeNum)
 	for i := range currentResult {
 		currentResult[i] = make([]int, 0)
 	}
 	result := make([]int, chunkNum)
-	minValue := math.MaxInt
+	minValue := math.Inf(1)
 	avg := int(math.Ceil(float64(chunkNum / dataNodeNum)))
 	bestVariance := calBestVariance(chunkNum, dataNodeNum, avg)
+	targetVariance := calTargetVariance(bestVariance, viper.GetInt(MasterVarianceTolerance))
+	bestValue, targetValue := float64(bestVariance), float64(targetVariance)
+	maxExploredNodes := 0
+	if cost != nil {
+		bestValue = cost.bestCost(bestVariance)
+		targetValue = -1
+		if tolerance := viper.GetInt(MasterVarianceTolerance); tolerance > 0 {
+			targetValue = bestValue * float64(100+tolerance) / 100
+		}
+		maxExploredNodes = maxWeightedExploredNodes
+	}
+	exploredNodes := 0
+	dfsResult := dfsExhausted
 	for i := 0; i < dataNodeNum; i++ {
-		if dfs(chunkNum, dataNodeNum, 0, i, &currentResult, isStore, &result, &minValue, avg, bestVariance) {
+		if dfs(chunkNum, dataNodeNum, 0, i, &currentResult, isStore, &result, &minValue, avg, bestValue,
+			targetValue, &exploredNodes, cost, maxExploredNodes) {
+			dfsResult = dfsEarlyExit
 			break
 		}
 	}
+	if maxExploredNodes > 0 && exploredNodes >= maxExploredNodes {
+		dfsResult = dfsNodeLimit
+	}
+	allocateDFSDurationMonitor.Observe(time.Since(start).Seconds())
+	allocateDFSExploredNodesMonitor.Add(float64(exploredNodes))
+	allocateDFSResultMonitor.WithLabelValues(dfsResult).Inc()
+	if !math.IsInf(minValue, 1) {
+		allocateDFSVarianceMonitor.Set(minValue)
+	}
+	Logger.Debugf("Allocation dfs done, explored nodes: %d, result: %s, cost: %v, duration: %v",
+		exploredNodes, dfsResult, minValue, time.Since(start))
 	return result
 }
 
+// calTargetVariance calculate the variance which is good enough to stop dfs
+// according to the tolerance, which is the percentage of variance allowed to
+// exceed the best variance. It returns -1 if the tolerance is not positive, so
+// that dfs only stops when the best variance is reached.
+func calTargetVariance(bestVariance int, tolerance int) int {
+	if tolerance <= 0 {
+		return -1
+	}
+	return bestVariance * (100 + tolerance) / 100
+}
+
 // calBestVariance calculate the minimum variance of current situation.
 func calBestVariance(chunkNum int, dataNodeNum int, avg int) int {
 	if avg*dataNodeNum == chunkNum {
@@ -369,13 +2091,24 @@ func calBestVariance(chunkNum int, dataNodeNum int, avg int) int {
 }
 
 // dfs recursively find the best plan to make the allocation plan as uniform as
-// possible(use variance to measure).
+// possible(use variance to measure), or the plan with the least weighted cost
+// if cost is not nil. The search stops when maxExploredNodes is positive and
+// reached.
 func dfs(chunkNum int, dataNodeNum int, chunkIndex int, dnIndex int, currentResult *[][]int,
-	isStore [][]bool, result *[]int, minValue *int, avg int, bestVariance int) bool {
+	isStore [][]bool, result *[]int, minValue *float64, avg int, bestValue float64, targetValue float64,
+	exploredNodes *int, cost *allocateCost, maxExploredNodes int) bool {
+	if maxExploredNodes > 0 && *exploredNodes >= maxExploredNodes {
+		return true
+	}
+	*exploredNodes++
 	if chunkIndex == chunkNum {
-		currentValue := 0
+		variance := 0
 		for i := 0; i < dataNodeNum; i++ {
-			currentValue += int(math.Pow(float64(len((*currentResult)[i])-avg), 2))
+			variance += int(math.Pow(float64(len((*currentResult)[i])-avg), 2))
+		}
+		currentValue := float64(variance)
+		if cost != nil {
+			currentValue = cost.calculate(*currentResult, variance)
 		}
 		if currentValue < *minValue {
 			*minValue = currentValue
@@ -386,8 +2119,9 @@ func dfs(chunkNum int, dataNodeNum int, chunkIndex int, dnIndex int, currentResu
 			}
 
 		}
-		// If the best plan has been found， just stop dfs and return the result.
-		if currentValue == bestVariance {
+		// If the best plan or a good enough plan has been found， just stop dfs
+		// and return the result.
+		if currentValue == bestValue || currentValue <= targetValue {
 			return true
 		}
 		return false
@@ -398,7 +2132,8 @@ func dfs(chunkNum int, dataNodeNum int, chunkIndex int, dnIndex int, currentResu
 			continue
 		}
 		isStore[chunkIndex][dnIndex] = true
-		isBest := dfs(chunkNum, dataNodeNum, chunkIndex+1, i, currentResult, isStore, result, minValue, avg, bestVariance)
+		isBest := dfs(chunkNum, dataNodeNum, chunkIndex+1, i, currentResult, isStore, result, minValue, avg,
+			bestValue, targetValue, exploredNodes, cost, maxExploredNodes)
 		isStore[chunkIndex][dnIndex] = false
 		if isBest {
 			return isBest
@@ -414,23 +2149,34 @@ func UpdateChunk4Heartbeat(o HeartbeatOperation) {
 	updateChunksLock.Lock()
 	defer updateChunksLock.Unlock()
 	for _, info := range o.SuccessInfos {
+		// Replica to be deleted has been removed from dataNodes when scheduled.
+		if info.SendType == common.DeleteSendType {
+			continue
+		}
 		if chunk, ok := chunksMap[info.ChunkId]; ok {
 			chunk.pendingDataNodes.Remove(info.DataNodeId)
-			chunk.dataNodes.Add(info.DataNodeId)
+			chunk.addStoredDataNode(info.DataNodeId)
 			if info.SendType == common.MoveSendType {
 				chunk.dataNodes.Remove(o.DataNodeId)
 			}
 		}
 	}
+	if len(o.SuccessInfos) != 0 {
+		notifyChunkStored()
+	}
 	for _, info := range o.FailInfos {
 		if chunk, ok := chunksMap[info.ChunkId]; ok {
 			chunk.pendingDataNodes.Remove(info.DataNodeId)
 		}
 	}
+	isQuarantine := getChecksumMismatchMode() == MismatchModeQuarantine
 	for _, chunkId := range o.InvalidChunks {
 		if chunk, ok := chunksMap[chunkId]; ok {
 			chunk.dataNodes.Remove(o.DataNodeId)
-			pendingChunkQueue.Push(String(chunkId))
+			if isQuarantine {
+				chunk.quarantineReplica(o.DataNodeId)
+			}
+			enqueuePendingChunk(chunkId, "")
 		}
 	}
 }
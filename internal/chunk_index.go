@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"strings"
+
+	"tinydfs-base/common"
+)
+
+// rebuildChunkIndexBatchSize is the number of directories visited under one
+// hold of createFileNodeLock when rebuilding the chunk index.
+const rebuildChunkIndexBatchSize = 64
+
+// ChunkIndexReport is the result of RebuildChunkIndex.
+type ChunkIndexReport struct {
+	// Indexed is the number of FileNode found in the directory trees.
+	Indexed int
+	// Added is the number of FileNode which were missing from the index.
+	Added int
+	// Removed is the number of stale ids removed from the index.
+	Removed int
+}
+
+// getChunkFileNodeId gets id of the file which the Chunk belongs to, and
+// whether the file is in fileNodeIdSet, which is the reverse index from Chunk to
+// file because id of a Chunk starts with id of its file.
+func getChunkFileNodeId(chunkId string) (string, bool) {
+	fileNodeId := chunkId
+	if i := strings.LastIndex(chunkId, common.ChunkIdDelimiter); i != -1 {
+		fileNodeId = chunkId[:i]
+	}
+	return fileNodeId, fileNodeIdSet.Contains(fileNodeId)
+}
+
+// indexFileNode adds the FileNode to fileNodeIdSet and fileNodeIndex. The caller
+// must hold createFileNodeLock.
+func indexFileNode(fileNode *FileNode) {
+	fileNodeIdSet.Add(fileNode.Id)
+	fileNodeIndex[fileNode.Id] = fileNode
+}
+
+// unindexFileNode removes the FileNode with the given id from fileNodeIdSet,
+// fileNodeIndex and the indexes of FileNode with a PlacementConstraint,
+// ReplicaFactor or MaxReplicasPerDomain, because it is erased. The caller must
+// hold createFileNodeLock.
+func unindexFileNode(id string) {
+	fileNodeIdSet.Remove(id)
+	delete(fileNodeIndex, id)
+	updateConstraintLock.Lock()
+	defer updateConstraintLock.Unlock()
+	delete(constrainedFileNodes, id)
+	delete(replicaFactorFileNodes, id)
+	delete(spreadFileNodes, id)
+}
+
+// getIndexedFileNode gets the FileNode with the given id from fileNodeIndex.
+// The caller must hold createFileNodeLock.
+func getIndexedFileNode(id string) (*FileNode, bool) {
+	fileNode, ok := fileNodeIndex[id]
+	return fileNode, ok
+}
+
+// RebuildChunkIndex rebuilds fileNodeIdSet from the directory trees of all
+// namespaces, including deleted FileNode whose Chunk have not been reclaimed.
+// It changes the index, so it must only be called by applying
+// RebuildChunkIndexOperation. The trees are walked in batches of directories,
+// so callers outside the FSM are never blocked for the whole walk. The index is
+// repaired in place rather than cleared first, because the chunk check would
+// reclaim Chunk of files missing from the index. Missing ids are added as soon
+// as they are found. A stale id is removed only if it was indexed before the
+// walk and its FileNode can not be found in any tree at the end, so FileNode
+// created or moved during the walk are kept.
+func RebuildChunkIndex() ChunkIndexReport {
+	createFileNodeLock.Lock()
+	indexedBefore := fileNodeIdSet.Clone()
+	dirs := allNamespaceRoots()
+	createFileNodeLock.Unlock()
+
+	report := ChunkIndexReport{}
+	reached := make(map[string]bool)
+	for len(dirs) != 0 {
+		batchSize := rebuildChunkIndexBatchSize
+		if batchSize > len(dirs) {
+			batchSize = len(dirs)
+		}
+		batch := dirs[:batchSize]
+		dirs = dirs[batchSize:]
+		createFileNodeLock.Lock()
+		for _, dir := range batch {
+			for _, child := range dir.ChildNodes {
+				reached[child.Id] = true
+				if !fileNodeIdSet.Contains(child.Id) {
+					report.Added++
+				}
+				indexFileNode(child)
+				if !child.IsFile {
+					dirs = append(dirs, child)
+				}
+			}
+		}
+		createFileNodeLock.Unlock()
+	}
+	report.Indexed = len(reached)
+
+	for _, id := range set2SortedStrings(indexedBefore) {
+		if reached[id] {
+			continue
+		}
+		createFileNodeLock.Lock()
+		fileNode, ok := getIndexedFileNode(id)
+		isExist := ok && isInDirTree(fileNode)
+		if !isExist && fileNodeIdSet.Contains(id) {
+			unindexFileNode(id)
+			report.Removed++
+		}
+		createFileNodeLock.Unlock()
+	}
+	if report.Added != 0 || report.Removed != 0 {
+		Logger.Warnf("Repair chunk index, indexed: %d, added: %d, removed: %d", report.Indexed, report.Added,
+			report.Removed)
+	}
+	return report
+}
+
+// isInDirTree checks whether the FileNode can be reached from the root of a
+// namespace, by walking up ParentNode and checking that each FileNode is still
+// a child of its parent. A root itself is not in any tree. The caller must hold
+// createFileNodeLock.
+func isInDirTree(fileNode *FileNode) bool {
+	roots := make(map[*FileNode]bool)
+	for _, nsRoot := range allNamespaceRoots() {
+		roots[nsRoot] = true
+	}
+	for cur := fileNode; cur.ParentNode != nil; cur = cur.ParentNode {
+		if cur.ParentNode.ChildNodes[cur.FileName] != cur {
+			return false
+		}
+		if roots[cur.ParentNode] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"testing"
+
+	mapset "github.com/deckarep/golang-set"
+	"github.com/stretchr/testify/assert"
+	"tinydfs-base/common"
+)
+
+// indexTestFile indexes a file with the given id and number of Chunk which is not
+// in any directory tree, so that Chunk can be allocated for it.
+func indexTestFile(t *testing.T, id string, chunkNum int) *FileNode {
+	fileNode := &FileNode{Id: id, IsFile: true, Size: int64(chunkNum) * common.ChunkSize,
+		Chunks: initChunks(int64(chunkNum)*common.ChunkSize, id)}
+	createFileNodeLock.Lock()
+	indexFileNode(fileNode)
+	createFileNodeLock.Unlock()
+	t.Cleanup(func() {
+		createFileNodeLock.Lock()
+		unindexFileNode(id)
+		createFileNodeLock.Unlock()
+	})
+	return fileNode
+}
+
+func TestRebuildChunkIndex(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		namespaceRoots = make(map[string]*FileNode)
+		fileNodeIdSet = mapset.NewSet()
+	})
+	dir, err := AddFileNode("/", "dir", common.DirSize, false)
+	assert.NoError(t, err, "Unexpected error.")
+	file, err := AddFileNode("/dir", "a.txt", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = CreateNamespace("ns")
+	assert.NoError(t, err, "Unexpected error.")
+	nsFile, err := AddFileNodeIn("ns", "/", "b.txt", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	removed, err := AddFileNode("/", "c.txt", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = RemoveFileNode("/c.txt")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, ChunkIndexReport{Indexed: 4}, RebuildChunkIndex(), "Consistent index should not change.")
+
+	// Corrupt the index: two files are missing and a stale id is left.
+	fileNodeIdSet.Remove(file.Id)
+	fileNodeIdSet.Remove(nsFile.Id)
+	fileNodeIdSet.Add("stale")
+	_, ok := getChunkFileNodeId(file.Chunks[0])
+	assert.False(t, ok, "Index should be corrupted.")
+
+	report, err := newLeaderHandler(t).RebuildChunkIndex()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, &ChunkIndexReport{Indexed: 4, Added: 2, Removed: 1}, report, "Unexpected report.")
+	for _, fileNode := range []*FileNode{dir, file, nsFile, removed} {
+		assert.True(t, fileNodeIdSet.Contains(fileNode.Id), "FileNode should be indexed.")
+	}
+	for _, fileNode := range []*FileNode{file, nsFile, removed} {
+		fileNodeId, ok := getChunkFileNodeId(fileNode.Chunks[0])
+		assert.True(t, ok, "Chunk should be found.")
+		assert.Equal(t, fileNode.Id, fileNodeId, "Unexpected file of chunk.")
+	}
+	assert.False(t, fileNodeIdSet.Contains("stale"), "Stale id should be removed.")
+	assert.Equal(t, 4, fileNodeIdSet.Cardinality(), "Unexpected index size.")
+}
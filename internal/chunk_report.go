@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"time"
+	"tinydfs-base/common"
+	"tinydfs-base/protocol/pb"
+	"tinydfs-base/util"
+)
+
+// ChunkReportServiceServer is the server of the client-streaming RPC through
+// which a DataNode reports its full chunk inventory in batches. Each batch is a
+// pb.HeartbeatArgs with only Id and ChunkId set, and the reply is a
+// pb.HeartbeatReply whose ChunkInfos tell the DataNode to delete Chunk which do
+// not exist in master.
+type ChunkReportServiceServer interface {
+	ReportChunks(ChunkReportService_ReportChunksServer) error
+}
+
+// ChunkReportService_ReportChunksServer is the server side stream of
+// ReportChunks.
+type ChunkReportService_ReportChunksServer interface {
+	SendAndClose(*pb.HeartbeatReply) error
+	Recv() (*pb.HeartbeatArgs, error)
+	grpc.ServerStream
+}
+
+// ChunkReportService_ServiceDesc is the grpc.ServiceDesc of
+// ChunkReportServiceServer.
+var ChunkReportService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pb.ChunkReportService",
+	HandlerType: (*ChunkReportServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ReportChunks",
+			Handler:       _ChunkReportService_ReportChunks_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "ChunkReport.proto",
+}
+
+func _ChunkReportService_ReportChunks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ChunkReportServiceServer).ReportChunks(&chunkReportServiceReportChunksServer{stream})
+}
+
+type chunkReportServiceReportChunksServer struct {
+	grpc.ServerStream
+}
+
+func (x *chunkReportServiceReportChunksServer) SendAndClose(m *pb.HeartbeatReply) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *chunkReportServiceReportChunksServer) Recv() (*pb.HeartbeatArgs, error) {
+	m := new(pb.HeartbeatArgs)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReportChunks is called by chunkserver. It receives the full chunk report of a
+// DataNode in batches and reconciles it with the view of master once the
+// stream completes. Heartbeats of the DataNode during the stream are tracked
+// since the first batch, so the reconciliation does not undo them. Received
+// Chunk are applied by partial operations of at most master.chunkReportBatchSize
+// ids, and the report is aborted if the stream fails.
+func (handler *MasterHandler) ReportChunks(stream ChunkReportService_ReportChunksServer) error {
+	ctx := stream.Context()
+	batchSize := viper.GetInt(MasterChunkReportBatchSize)
+	if batchSize <= 0 {
+		batchSize = defaultChunkReportBatchSize
+	}
+	dataNodeId := ""
+	chunkIds := make([]string, 0, batchSize)
+	chunkNum := 0
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Logger.Errorf("Fail to receive chunk report, datanode id: %s, error detail: %s", dataNodeId, err.Error())
+			handler.abortChunkReport(dataNodeId)
+			return err
+		}
+		if dataNodeId == "" {
+			dataNodeId = batch.Id
+			Logger.WithContext(ctx).Infof("Get full chunk report, datanode id: %s", dataNodeId)
+			operation := &BeginChunkReportOperation{
+				Id:         util.GenerateUUIDString(),
+				DataNodeId: dataNodeId,
+			}
+			if _, err = handler.applyChunkReport(operation, OperationBeginChunkReport); err != nil {
+				return err
+			}
+		} else if batch.Id != dataNodeId {
+			handler.abortChunkReport(dataNodeId)
+			return chunkReportError(codes.InvalidArgument, "chunk report contains batches of different datanode")
+		}
+		chunkNum += len(batch.ChunkId)
+		chunkIds = append(chunkIds, batch.ChunkId...)
+		for len(chunkIds) >= batchSize {
+			operation := &ChunkReportOperation{
+				Id:         util.GenerateUUIDString(),
+				DataNodeId: dataNodeId,
+				ChunkIds:   chunkIds[:batchSize],
+				IsPartial:  true,
+			}
+			if _, err = handler.applyChunkReport(operation, OperationChunkReport); err != nil {
+				handler.abortChunkReport(dataNodeId)
+				return err
+			}
+			chunkIds = chunkIds[batchSize:]
+		}
+	}
+	if dataNodeId == "" {
+		return chunkReportError(codes.InvalidArgument, "chunk report is empty")
+	}
+	operation := &ChunkReportOperation{
+		Id:         util.GenerateUUIDString(),
+		DataNodeId: dataNodeId,
+		ChunkIds:   chunkIds,
+		Time:       time.Now().UnixMilli(),
+	}
+	response, err := handler.applyChunkReport(operation, OperationChunkReport)
+	if err != nil {
+		return err
+	}
+	unknown := response.([]string)
+	deleteInfos := make([]ChunkSendInfo, len(unknown))
+	for i, id := range unknown {
+		deleteInfos[i] = ChunkSendInfo{ChunkId: id, SendType: common.DeleteSendType}
+	}
+	Logger.WithContext(ctx).Infof("Success to reconcile full chunk report, datanode id: %s, chunk num: %d",
+		dataNodeId, chunkNum)
+	return stream.SendAndClose(&pb.HeartbeatReply{ChunkInfos: DeConvChunkInfo(deleteInfos)})
+}
+
+// applyChunkReport applies an Operation of chunk report and returns its
+// response.
+func (handler *MasterHandler) applyChunkReport(operation Operation, opType string) (interface{}, error) {
+	applyFuture := handler.Raft.Apply(getData4Apply(operation, opType), 5*time.Second)
+	if err := applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to apply chunk report, error code: %v, error detail: %s", common.MasterHeartbeatFailed,
+			err.Error())
+		return nil, chunkReportError(codes.Internal, err.Error())
+	}
+	response := applyFuture.Response().(*ApplyResponse)
+	if err := response.Error; err != nil {
+		Logger.Errorf("Fail to apply chunk report, error code: %v, error detail: %s", common.MasterHeartbeatFailed,
+			err.Error())
+		return nil, chunkReportError(codes.Internal, err.Error())
+	}
+	return response.Response, nil
+}
+
+// abortChunkReport drops the chunk report of the DataNode in progress. It is
+// best-effort, since a later report restarts the tracking anyway.
+func (handler *MasterHandler) abortChunkReport(dataNodeId string) {
+	if dataNodeId == "" {
+		return
+	}
+	operation := &AbortChunkReportOperation{
+		Id:         util.GenerateUUIDString(),
+		DataNodeId: dataNodeId,
+	}
+	if _, err := handler.applyChunkReport(operation, OperationAbortChunkReport); err != nil {
+		Logger.Warnf("Fail to abort chunk report, datanode id: %s, error detail: %s", dataNodeId, err.Error())
+	}
+}
+
+func chunkReportError(code codes.Code, msg string) error {
+	details, _ := status.New(code, msg).WithDetails(&pb.RPCError{
+		Code: common.MasterHeartbeatFailed,
+		Msg:  msg,
+	})
+	return details.Err()
+}
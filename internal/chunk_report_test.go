@@ -0,0 +1,308 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	set "github.com/deckarep/golang-set"
+	"github.com/hashicorp/raft"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"tinydfs-base/common"
+	"tinydfs-base/protocol/pb"
+	"tinydfs-base/util"
+)
+
+// fakeReportStream sends the batches in order and calls beforeRecv before
+// each batch is received. It fails with err after all batches if err is set.
+type fakeReportStream struct {
+	grpc.ServerStream
+	batches    []*pb.HeartbeatArgs
+	beforeRecv func(i int)
+	sent       int
+	reply      *pb.HeartbeatReply
+	err        error
+}
+
+func (s *fakeReportStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *fakeReportStream) Recv() (*pb.HeartbeatArgs, error) {
+	if s.sent == len(s.batches) {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	s.beforeRecv(s.sent)
+	s.sent++
+	return s.batches[s.sent-1], nil
+}
+
+func (s *fakeReportStream) SendAndClose(reply *pb.HeartbeatReply) error {
+	s.reply = reply
+	return nil
+}
+
+func TestMasterHandler_ReportChunks(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	leaderRaft, leaderTransport := newInmemRaft(t, "master1")
+	err := leaderRaft.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{{ID: "master1", Address: leaderTransport.LocalAddr()}},
+	}).Error()
+	assert.NoError(t, err, "Unexpected error.")
+	select {
+	case <-leaderRaft.LeaderCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fail to elect leader.")
+	}
+	handler := &MasterHandler{Raft: leaderRaft}
+
+	const chunkNum, batchSize = 10000, 1000
+	reported := make([]string, 0, chunkNum)
+	for i := 0; i < chunkNum; i++ {
+		id := fmt.Sprintf("chunk%d", i)
+		reported = append(reported, id)
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet(), pendingDataNodes: set.NewSet()}
+	}
+	// Master thinks dataNode1 stores the first half and a Chunk it has lost.
+	dataNode1 := &DataNode{Id: "dataNode1", Status: common.Alive, Chunks: set.NewSet(),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+	for _, id := range reported[:chunkNum/2] {
+		dataNode1.Chunks.Add(id)
+	}
+	dataNode1.Chunks.Add("lostReplica")
+	chunksMap["lostReplica"] = &Chunk{Id: "lostReplica", dataNodes: set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet()}
+	chunksMap["moved"] = &Chunk{Id: "moved", dataNodes: set.NewSet("dataNode2"), pendingDataNodes: set.NewSet()}
+	rebuildChunkBloom()
+	dataNodeMap["dataNode1"] = dataNode1
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Status: common.Alive, Chunks: set.NewSet("moved"),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+	// dataNode1 also reports a Chunk which master does not know.
+	reported = append(reported, "unknown")
+
+	batches := make([]*pb.HeartbeatArgs, 0)
+	for i := 0; i < len(reported); i += batchSize {
+		end := i + batchSize
+		if end > len(reported) {
+			end = len(reported)
+		}
+		batches = append(batches, &pb.HeartbeatArgs{Id: "dataNode1", ChunkId: reported[i:end]})
+	}
+	stream := &fakeReportStream{
+		batches: batches,
+		beforeRecv: func(i int) {
+			if i != 2 {
+				return
+			}
+			// During the stream, "moved" is moved to dataNode1 and chunk1 which
+			// has been reported is found invalid.
+			for _, op := range []HeartbeatOperation{
+				{DataNodeId: "dataNode2", SuccessInfos: []ChunkSendInfo{
+					{ChunkId: "moved", DataNodeId: "dataNode1", SendType: common.MoveSendType}}},
+				{DataNodeId: "dataNode1", InvalidChunks: []string{"chunk1"}},
+			} {
+				f := leaderRaft.Apply(getData4Apply(op, common.OperationHeartbeat), time.Second)
+				assert.NoError(t, f.Error(), "Unexpected error.")
+			}
+		},
+	}
+	assert.NoError(t, handler.ReportChunks(stream), "Unexpected error.")
+
+	dataNode1 = dataNodeMap["dataNode1"]
+	assert.Equal(t, chunkNum, dataNode1.Chunks.Cardinality(), "Unexpected chunk num.")
+	assert.True(t, dataNode1.Chunks.Contains("moved"), "Chunk moved during the stream should be kept.")
+	assert.False(t, dataNode1.Chunks.Contains("chunk1"), "Chunk invalid during the stream should be removed.")
+	assert.False(t, dataNode1.Chunks.Contains("lostReplica"), "Unreported chunk should be removed.")
+	assert.True(t, chunksMap[reported[chunkNum-1]].dataNodes.Contains("dataNode1"), "Unexpected data nodes.")
+	assert.False(t, chunksMap["lostReplica"].dataNodes.Contains("dataNode1"), "Unexpected data nodes.")
+	assert.Equal(t, []String{"chunk1", "lostReplica"}, pendingChunkQueue.BatchTop(pendingChunkQueue.Len()),
+		"Lost replicas should be replicated again.")
+	assert.Equal(t, []*pb.ChunkInfo{{ChunkId: "unknown", SendType: common.DeleteSendType}}, stream.reply.ChunkInfos,
+		"Unknown chunk should be deleted.")
+	assert.Nil(t, dataNode1.reportAdded, "Report should be finished.")
+
+	// A report can not be finished without beginning.
+	_, _, _, err = FinishChunkReport("dataNode1", nil, time.Now())
+	assert.Error(t, err, "Expected an error.")
+}
+
+func TestChunkReportOperation_LeaderTime(t *testing.T) {
+	watermark := viper.GetInt(MasterPendingQueueWatermark)
+	viper.Set(MasterPendingQueueWatermark, 1)
+	t.Cleanup(func() {
+		viper.Set(MasterPendingQueueWatermark, watermark)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+		stagedChunks = make([]stagedChunk, 0)
+	})
+	chunksMap["lostReplica"] = &Chunk{Id: "lostReplica", dataNodes: set.NewSet("dataNode1", "dataNode2", "dataNode3"),
+		pendingDataNodes: set.NewSet()}
+	rebuildChunkBloom()
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive, Chunks: set.NewSet("lostReplica"),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+	pendingChunkQueue.Push("chunk0")
+
+	// The queue is saturated, so the lost replica is deferred with the time of
+	// the leader rather than the time when it is applied.
+	assert.NoError(t, BeginChunkReport("dataNode1"), "Unexpected error.")
+	leaderTime := time.Now().Add(-time.Hour)
+	_, err := ChunkReportOperation{DataNodeId: "dataNode1", Time: leaderTime.UnixMilli()}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []stagedChunk{{chunkId: "lostReplica", releaseTime: time.UnixMilli(leaderTime.UnixMilli())}},
+		stagedChunks, "Unexpected staged chunks.")
+}
+
+func TestMasterHandler_ReportChunksInBatches(t *testing.T) {
+	batchSize := viper.GetInt(MasterChunkReportBatchSize)
+	viper.Set(MasterChunkReportBatchSize, 2)
+	t.Cleanup(func() {
+		viper.Set(MasterChunkReportBatchSize, batchSize)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	handler := newLeaderHandler(t)
+	for _, id := range []string{"chunk1", "chunk2", "chunk3", "chunk4", "chunk5"} {
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet(), pendingDataNodes: set.NewSet()}
+	}
+	rebuildChunkBloom()
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive, Chunks: set.NewSet(),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+
+	// The stream fails after parts of the report are applied, so the report
+	// is aborted.
+	stream := &fakeReportStream{
+		batches: []*pb.HeartbeatArgs{
+			{Id: "dataNode1", ChunkId: []string{"chunk1", "chunk2", "chunk3"}},
+			{Id: "dataNode1", ChunkId: []string{"chunk4"}},
+		},
+		beforeRecv: func(i int) {
+			if i != 1 {
+				return
+			}
+			dataNode := dataNodeMap["dataNode1"]
+			assert.Equal(t, []string{"chunk1", "chunk2"}, set2SortedStrings(dataNode.reportChunks),
+				"Full batch should be applied.")
+
+			// The report in progress survives snapshots.
+			sink := &bufferSink{}
+			assert.NoError(t, PersistDataNodes(sink), "Unexpected error.")
+			dataNodeMap = make(map[string]*DataNode)
+			assert.NoError(t, RestoreDataNodes(bufio.NewScanner(sink)), "Unexpected error.")
+			dataNode = dataNodeMap["dataNode1"]
+			assert.Equal(t, []string{"chunk1", "chunk2"}, set2SortedStrings(dataNode.reportChunks),
+				"Unexpected reported chunks.")
+			assert.Equal(t, 0, dataNode.reportAdded.Cardinality(), "Unexpected added chunks.")
+		},
+		err: errors.New("connection reset"),
+	}
+	assert.Error(t, handler.ReportChunks(stream), "Expected an error.")
+	dataNode := dataNodeMap["dataNode1"]
+	assert.Nil(t, dataNode.reportAdded, "Report should be aborted.")
+	assert.Nil(t, dataNode.reportChunks, "Report should be aborted.")
+	assert.Equal(t, 0, dataNode.Chunks.Cardinality(), "Aborted report should not change chunks.")
+
+	// A complete report reconciles all parts.
+	stream = &fakeReportStream{
+		batches: []*pb.HeartbeatArgs{
+			{Id: "dataNode1", ChunkId: []string{"chunk1", "chunk2", "chunk3"}},
+			{Id: "dataNode1", ChunkId: []string{"chunk4", "chunk5"}},
+		},
+		beforeRecv: func(int) {},
+	}
+	assert.NoError(t, handler.ReportChunks(stream), "Unexpected error.")
+	assert.Equal(t, []string{"chunk1", "chunk2", "chunk3", "chunk4", "chunk5"},
+		set2SortedStrings(dataNodeMap["dataNode1"].Chunks), "Unexpected chunks.")
+	assert.Nil(t, dataNodeMap["dataNode1"].reportChunks, "Report should be finished.")
+}
+
+// headerRecorder records headers set by the handler.
+type headerRecorder struct {
+	header metadata.MD
+}
+
+func (r *headerRecorder) Method() string {
+	return "Heartbeat"
+}
+
+func (r *headerRecorder) SetHeader(md metadata.MD) error {
+	r.header = metadata.Join(r.header, md)
+	return nil
+}
+
+func (r *headerRecorder) SendHeader(md metadata.MD) error {
+	return r.SetHeader(md)
+}
+
+func (r *headerRecorder) SetTrailer(metadata.MD) error {
+	return nil
+}
+
+func TestMasterHandler_HeartbeatRejoin(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	leaderRaft, leaderTransport := newInmemRaft(t, "master1")
+	err := leaderRaft.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{{ID: "master1", Address: leaderTransport.LocalAddr()}},
+	}).Error()
+	assert.NoError(t, err, "Unexpected error.")
+	select {
+	case <-leaderRaft.LeaderCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fail to elect leader.")
+	}
+	handler := &MasterHandler{Raft: leaderRaft}
+	for _, id := range []string{"chunk1", "chunk2", "chunk3"} {
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	}
+	rebuildChunkBloom()
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive,
+		Chunks: set.NewSet("chunk1", "chunk2", "chunk3"), FutureSendChunks: make(map[ChunkSendInfo]int)}
+	heartbeat := func() metadata.MD {
+		recorder := &headerRecorder{}
+		ctx := grpc.NewContextWithServerTransportStream(context.Background(), recorder)
+		_, err := handler.Heartbeat(ctx, &pb.HeartbeatArgs{Id: "dataNode1"})
+		assert.NoError(t, err, "Unexpected error.")
+		return recorder.header
+	}
+
+	// No report is requested for an Alive DataNode.
+	assert.Empty(t, heartbeat().Get(chunkReportMetadataKey), "Unexpected report request.")
+
+	// The DataNode goes Waiting and rejoins, so a report is requested until it
+	// is done.
+	DegradeDataNode("dataNode1", common.Degrade2Waiting, time.Now())
+	assert.Equal(t, []string{"true"}, heartbeat().Get(chunkReportMetadataKey), "Report should be requested.")
+	assert.Equal(t, common.Alive, dataNodeMap["dataNode1"].Status, "DataNode should be Alive again.")
+	assert.Equal(t, []string{"true"}, heartbeat().Get(chunkReportMetadataKey), "Report should be requested again.")
+
+	// The DataNode has lost chunk2 and chunk3 while away, so they are re-queued.
+	stream := &fakeReportStream{
+		batches:    []*pb.HeartbeatArgs{{Id: "dataNode1", ChunkId: []string{"chunk1"}}},
+		beforeRecv: func(int) {},
+	}
+	assert.NoError(t, handler.ReportChunks(stream), "Unexpected error.")
+	assert.Equal(t, []String{"chunk2", "chunk3"}, pendingChunkQueue.BatchTop(pendingChunkQueue.Len()),
+		"Missing chunks should be replicated again.")
+	assert.Equal(t, []string{"dataNode1"}, set2SortedStrings(chunksMap["chunk1"].dataNodes), "Unexpected data nodes.")
+	assert.Empty(t, chunksMap["chunk2"].dataNodes.ToSlice(), "Missing replica should be removed.")
+	assert.Empty(t, heartbeat().Get(chunkReportMetadataKey), "Report should not be requested after it is done.")
+}
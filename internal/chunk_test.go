@@ -1,9 +1,26 @@
 package internal
 
 import (
+	"bufio"
+	"context"
+	"fmt"
 	set "github.com/deckarep/golang-set"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"tinydfs-base/common"
+	"tinydfs-base/protocol/pb"
+	"tinydfs-base/util"
 )
 
 func TestChunk_String(t *testing.T) {
@@ -42,3 +59,1108 @@ func TestChunk_String(t *testing.T) {
 		})
 	}
 }
+
+func TestExportChunkState(t *testing.T) {
+	chunksMap = map[string]*Chunk{
+		"chunk3": {
+			Id:               "chunk3",
+			dataNodes:        set.NewSet("dataNode2"),
+			pendingDataNodes: set.NewSet("dataNode1"),
+		},
+		"chunk1": {
+			Id:               "chunk1",
+			dataNodes:        set.NewSet("dataNode2", "dataNode1"),
+			pendingDataNodes: set.NewSet(),
+		},
+		"chunk2": {
+			Id:               "chunk2",
+			dataNodes:        set.NewSet("dataNode3"),
+			pendingDataNodes: set.NewSet(),
+		},
+		"file1_0": {
+			Id:               "file1_0",
+			dataNodes:        set.NewSet("dataNode1"),
+			pendingDataNodes: set.NewSet(),
+		},
+	}
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		replicaFactorFileNodes = make(map[string]*FileNode)
+	})
+	applyFileNodeReplicaFactor(&FileNode{Id: "file1"}, 5)
+	exporter := NewChunkStateExporter()
+	// Chunk added after the exporter is created should not be seen.
+	AddChunk(&Chunk{Id: "chunk0", dataNodes: set.NewSet(), pendingDataNodes: set.NewSet()})
+
+	var (
+		token  string
+		states []ChunkState
+		pages  int
+	)
+	for {
+		var page []ChunkState
+		page, token = exporter.Export(token, 2)
+		states = append(states, page...)
+		pages++
+		if token == "" {
+			break
+		}
+	}
+	assert.Equal(t, 2, pages, "Unexpected page number.")
+	assert.Equal(t, []string{"chunk1", "chunk2", "chunk3", "file1_0"},
+		[]string{states[0].ChunkId, states[1].ChunkId, states[2].ChunkId, states[3].ChunkId},
+		"Unexpected chunk order.")
+	assert.Equal(t, viper.GetInt(common.ReplicaNum), states[0].ReplicaFactor, "Unexpected replica factor.")
+	assert.Equal(t, 5, states[3].ReplicaFactor, "ReplicaFactor of the file should be used.")
+	assert.Equal(t, []string{"dataNode1", "dataNode2"}, states[0].DataNodes, "Unexpected data nodes.")
+	assert.Equal(t, []string{"dataNode3"}, states[1].DataNodes, "Unexpected data nodes.")
+	assert.Equal(t, []string{"dataNode2"}, states[2].DataNodes, "Unexpected data nodes.")
+	assert.Equal(t, []string{"dataNode1"}, states[2].PendingDataNodes, "Unexpected pending data nodes.")
+}
+
+func TestRestoreChunks(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantLen int
+		wantErr bool
+	}{
+		{
+			name:    "Success",
+			data:    "chunk1$[dataNode1 dataNode2]$[]\nchunk2$[dataNode1]$[dataNode3]\n" + common.SnapshotDelimiter,
+			wantLen: 2,
+		},
+		{
+			name:    "Pinned",
+			data:    "chunk1$[dataNode1 dataNode2]$[]$[dataNode1]\n" + common.SnapshotDelimiter,
+			wantLen: 1,
+		},
+		{
+			name:    "Uncommitted",
+			data:    "chunk1$[dataNode1]$[dataNode2 dataNode3]$[]$2\n" + common.SnapshotDelimiter,
+			wantLen: 1,
+		},
+		{
+			name:    "LastAccess",
+			data:    "chunk1$[dataNode1]$[]$[]$0$1660000000\n" + common.SnapshotDelimiter,
+			wantLen: 1,
+		},
+		{
+			name:    "Truncated",
+			data:    "chunk1$[dataNode1 dataNode2]$[]\nchunk2$[dataNode1]$[dataNode3]\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() {
+				chunksMap = make(map[string]*Chunk)
+			})
+			err := RestoreChunks(bufio.NewScanner(strings.NewReader(tt.data)))
+			if tt.wantErr {
+				assert.Error(t, err, "Expected an error.")
+				return
+			}
+			assert.NoError(t, err, "Unexpected error.")
+			assert.Equal(t, tt.wantLen, len(chunksMap), "Unexpected len.")
+		})
+	}
+}
+
+func TestRestorePendingChunkQueue(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantLen int
+		wantErr bool
+	}{
+		{
+			name:    "Success",
+			data:    "6:chunk1\n6:chunk2\n" + common.SnapshotDelimiter,
+			wantLen: 2,
+		},
+		{
+			name:    "Empty",
+			data:    "\n" + common.SnapshotDelimiter,
+			wantLen: 0,
+		},
+		{
+			name:    "Truncated",
+			data:    "6:chunk1\n6:chunk2\n",
+			wantErr: true,
+		},
+		{
+			name:    "LegacyFormat",
+			data:    "chunk1$chunk2$\n" + common.SnapshotDelimiter,
+			wantErr: true,
+		},
+		{
+			name:    "LengthMismatch",
+			data:    "6:chunk1\n7:chunk2\n" + common.SnapshotDelimiter,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() {
+				pendingChunkQueue = util.NewQueue[String]()
+			})
+			err := RestorePendingChunkQueue(bufio.NewScanner(strings.NewReader(tt.data)))
+			if tt.wantErr {
+				assert.Error(t, err, "Expected an error.")
+				return
+			}
+			assert.NoError(t, err, "Unexpected error.")
+			assert.Equal(t, tt.wantLen, pendingChunkQueue.Len(), "Unexpected len.")
+		})
+	}
+}
+
+func TestBatchFilterChunk_RestoredPendingChunkQueue(t *testing.T) {
+	replicaNum := viper.GetInt(common.ReplicaNum)
+	viper.Set(common.ReplicaNum, 2)
+	t.Cleanup(func() {
+		viper.Set(common.ReplicaNum, replicaNum)
+		chunksMap = make(map[string]*Chunk)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	chunks := "chunk1$[dataNode1 dataNode2]$[]\nchunk2$[dataNode1]$[]\n" + common.SnapshotDelimiter
+	assert.NoError(t, RestoreChunks(bufio.NewScanner(strings.NewReader(chunks))), "Unexpected error.")
+	// chunk1 is fully replicated and chunk3 has been deleted.
+	queue := "6:chunk1\n6:chunk2\n6:chunk3\n6:chunk2\n" + common.SnapshotDelimiter
+	assert.NoError(t, RestorePendingChunkQueue(bufio.NewScanner(strings.NewReader(queue))), "Unexpected error.")
+	assert.Equal(t, 4, pendingChunkQueue.Len(), "Restored queue should be kept as it is persisted.")
+
+	// The leader only plans chunk2, and the whole batch is removed.
+	batchChunkIds := getPendingChunks()
+	assert.Equal(t, []string{"chunk2"}, BatchFilterChunk(batchChunkIds),
+		"Only the missing replica should be planned.")
+	assert.Equal(t, 4, popPendingChunks(batchChunkIds, len(batchChunkIds)), "Unexpected removed num.")
+	assert.Equal(t, 0, pendingChunkQueue.Len(), "Stale ids should be removed.")
+}
+
+func TestPersistPendingChunkQueue_RoundTrip(t *testing.T) {
+	t.Cleanup(func() {
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	ids := []string{
+		"3f2b8c1e-5d4a-4b6f-9e1c-7a8d9b0c1d2e_0",
+		"3f2b8c1e-5d4a-4b6f-9e1c-7a8d9b0c1d2e_1",
+		"chunk$with$dollar_0",
+		"$leading_0",
+		"trailing$",
+		"$$$$$$",
+		"colon:inside_2",
+		"chunk with space_3",
+	}
+	for _, id := range ids {
+		pendingChunkQueue.Push(String(id))
+	}
+	sink := &memorySink{}
+	err := PersistPendingChunkQueue(sink)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, len(ids), pendingChunkQueue.Len(), "Persist should not change the queue.")
+
+	pendingChunkQueue = util.NewQueue[String]()
+	err = RestorePendingChunkQueue(bufio.NewScanner(strings.NewReader(sink.String())))
+	assert.NoError(t, err, "Unexpected error.")
+	restored := make([]string, 0, len(ids))
+	for _, id := range pendingChunkQueue.BatchTop(pendingChunkQueue.Len()) {
+		restored = append(restored, id.String())
+	}
+	assert.Equal(t, ids, restored, "Unexpected restored ids.")
+}
+
+func TestPinChunk(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	for _, id := range []string{"dataNode1", "dataNode2"} {
+		dataNodeMap[id] = &DataNode{
+			Id:               id,
+			Status:           common.Alive,
+			FutureSendChunks: map[ChunkSendInfo]int{},
+		}
+	}
+	chunksMap["chunk1"] = &Chunk{
+		Id:               "chunk1",
+		dataNodes:        set.NewSet("dataNode1"),
+		pendingDataNodes: set.NewSet(),
+	}
+
+	handler := newLeaderHandler(t)
+	assert.Error(t, handler.PinChunk("chunk2", "dataNode2"), "Expected an error for unknown chunk.")
+	assert.Error(t, PinChunk("chunk1", "dataNode3"), "Expected an error for unknown datanode.")
+	assert.NoError(t, handler.PinChunk("chunk1", "dataNode2"), "Unexpected error.")
+	assert.True(t, chunksMap["chunk1"].pendingDataNodes.Contains("dataNode2"), "Pinned datanode should be pending.")
+	assert.Equal(t, common.WaitToInform, dataNodeMap["dataNode1"].FutureSendChunks[ChunkSendInfo{
+		ChunkId:    "chunk1",
+		DataNodeId: "dataNode2",
+		SendType:   common.CopySendType,
+	}], "Copy should be scheduled on the source datanode.")
+	assert.Equal(t, "chunk1$[dataNode1]$[dataNode2]$[dataNode2]\n", chunksMap["chunk1"].String(), "Unexpected string.")
+
+	// A pinned replica lost by the datanode should be copied back.
+	chunksMap["chunk1"].pendingDataNodes.Clear()
+	dataNodeMap["dataNode1"].FutureSendChunks = map[ChunkSendInfo]int{}
+	RestorePinnedReplicas("dataNode2", []string{"chunk1"})
+	assert.Equal(t, 1, len(dataNodeMap["dataNode1"].FutureSendChunks), "Lost pinned replica should be copied.")
+
+	assert.NoError(t, handler.UnpinChunk("chunk1", "dataNode2"), "Unexpected error.")
+	assert.Error(t, handler.UnpinChunk("chunk1", "dataNode2"), "Expected an error for chunk not pinned.")
+	assert.False(t, chunksMap["chunk1"].isPinned(), "Chunk should not be pinned.")
+}
+
+func TestEvictChunkFromNode(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	for _, id := range []string{"dataNode1", "dataNode2", "dataNode3", "dataNode4"} {
+		dataNodeMap[id] = &DataNode{
+			Id:               id,
+			Status:           common.Alive,
+			Chunks:           set.NewSet(),
+			FutureSendChunks: map[ChunkSendInfo]int{},
+			SendAttempts:     map[ChunkSendInfo]int{},
+		}
+	}
+	dataNodeMap["dataNode1"].Chunks.Add("chunk1")
+	dataNodeMap["dataNode2"].Chunks.Add("chunk1")
+	// dataNode4 stores more Chunk, so dataNode3 is the target.
+	dataNodeMap["dataNode4"].Chunks.Add("chunk2")
+	chunksMap["chunk1"] = &Chunk{
+		Id:               "chunk1",
+		dataNodes:        set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet(),
+	}
+
+	handler := newLeaderHandler(t)
+	_, err := handler.EvictChunk("chunk1", "dataNode3")
+	assert.Error(t, err, "Datanode does not store the chunk.")
+	target, err := handler.EvictChunk("chunk1", "dataNode1")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, "dataNode3", target, "Unexpected target.")
+	_, err = EvictChunkFromNode("chunk1", "dataNode1")
+	assert.Error(t, err, "Chunk is already being moved.")
+
+	// The move is reported by the heartbeat of the source.
+	nextInfos, err := HeartbeatOperation{DataNodeId: "dataNode1"}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	moveInfo := ChunkSendInfo{ChunkId: "chunk1", DataNodeId: "dataNode3", SendType: common.MoveSendType}
+	assert.Equal(t, []ChunkSendInfo{moveInfo}, nextInfos, "Move should be sent to the source.")
+	_, err = HeartbeatOperation{DataNodeId: "dataNode1", SuccessInfos: []ChunkSendInfo{moveInfo}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []string{"dataNode2", "dataNode3"}, set2SortedStrings(chunksMap["chunk1"].dataNodes),
+		"Chunk should be moved off the source.")
+	assert.False(t, dataNodeMap["dataNode1"].Chunks.Contains("chunk1"), "Source should not store the chunk.")
+	assert.True(t, dataNodeMap["dataNode3"].Chunks.Contains("chunk1"), "Target should store the chunk.")
+
+	// No alive datanode can receive the chunk.
+	dataNodeMap["dataNode1"].Status = common.Waiting
+	dataNodeMap["dataNode4"].Status = common.Waiting
+	_, err = EvictChunkFromNode("chunk1", "dataNode2")
+	assert.Error(t, err, "Evicting without a target should be rejected.")
+	assert.Equal(t, 0, len(dataNodeMap["dataNode2"].FutureSendChunks), "Nothing should be scheduled.")
+}
+
+func TestReconcileChunkReport(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		rebuildChunkBloom()
+	})
+	BatchAddChunk([]*Chunk{
+		{Id: "chunk1", dataNodes: set.NewSet(), pendingDataNodes: set.NewSet()},
+		{Id: "chunk2", dataNodes: set.NewSet(), pendingDataNodes: set.NewSet()},
+	})
+	known, unknown := ReconcileChunkReport([]string{"chunk1", "chunk3", "chunk2"})
+	assert.Equal(t, []string{"chunk1", "chunk2"}, known, "Unexpected known chunks.")
+	assert.Equal(t, []string{"chunk3"}, unknown, "Unexpected unknown chunks.")
+
+	// chunkBloom should be rebuilt after restoring.
+	err := RestoreChunks(bufio.NewScanner(strings.NewReader("chunk4$[dataNode1]$[]\n" + common.SnapshotDelimiter)))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.True(t, chunkBloom.Load().(*BloomFilter).MayContain("chunk4"), "Restored chunk should be in bloom filter.")
+	known, _ = ReconcileChunkReport([]string{"chunk1", "chunk4"})
+	assert.Equal(t, []string{"chunk4"}, known, "Unexpected known chunks after restoring.")
+}
+
+func BenchmarkReconcileChunkReport(b *testing.B) {
+	const chunkNum = 1 << 16
+	chunks := make([]*Chunk, chunkNum)
+	for i := 0; i < chunkNum; i++ {
+		chunks[i] = &Chunk{Id: fmt.Sprintf("chunk%d", i)}
+	}
+	BatchAddChunk(chunks)
+	b.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		rebuildChunkBloom()
+	})
+	// The Bloom pre-check only pays off for Chunk which do not exist in master,
+	// so compare reports with different percent of absent Chunk.
+	for _, absentPercent := range []int{0, 50, 90} {
+		report := make([]string, chunkNum)
+		for i := 0; i < chunkNum; i++ {
+			if i%100 < absentPercent {
+				report[i] = fmt.Sprintf("absent%d", i)
+			} else {
+				report[i] = fmt.Sprintf("chunk%d", i)
+			}
+		}
+		b.Run(fmt.Sprintf("Absent%d/WithoutBloom", absentPercent), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				reconcileChunkReport(report, nil)
+			}
+		})
+		b.Run(fmt.Sprintf("Absent%d/WithBloom", absentPercent), func(b *testing.B) {
+			filter := chunkBloom.Load().(*BloomFilter)
+			for i := 0; i < b.N; i++ {
+				reconcileChunkReport(report, filter)
+			}
+		})
+	}
+}
+
+func TestAllocateChunksDFS_VarianceTolerance(t *testing.T) {
+	const (
+		chunkNum    = 10
+		dataNodeNum = 3
+	)
+	t.Cleanup(func() {
+		viper.Set(MasterVarianceTolerance, 0)
+	})
+	calVariance := func(plan []int) int {
+		counts := make([]int, dataNodeNum)
+		for _, dnIndex := range plan {
+			counts[dnIndex]++
+		}
+		avg, variance := chunkNum/dataNodeNum, 0
+		for _, count := range counts {
+			variance += (count - avg) * (count - avg)
+		}
+		return variance
+	}
+	// The cost of a search is measured by the nodes it explores rather than the
+	// time it takes, which depends on the machine.
+	allocate := func(tolerance int) (int, float64) {
+		viper.Set(MasterVarianceTolerance, tolerance)
+		isStore := make([][]bool, chunkNum)
+		for i := range isStore {
+			isStore[i] = make([]bool, dataNodeNum)
+		}
+		exploredNodes := testutil.ToFloat64(allocateDFSExploredNodesMonitor)
+		plan := allocateChunksDFS(chunkNum, dataNodeNum, isStore)
+		return calVariance(plan), testutil.ToFloat64(allocateDFSExploredNodesMonitor) - exploredNodes
+	}
+
+	strictVariance, strictNodes := allocate(0)
+	looseVariance, looseNodes := allocate(50)
+	bestVariance := calBestVariance(chunkNum, dataNodeNum, chunkNum/dataNodeNum)
+	assert.LessOrEqual(t, strictVariance, looseVariance, "Strict tolerance should not get a worse plan.")
+	assert.LessOrEqual(t, looseVariance, calTargetVariance(bestVariance, 50), "Loose plan should be good enough.")
+	assert.Less(t, looseNodes, strictNodes, "Loose tolerance should stop earlier.")
+}
+
+func TestWaitForCommit(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+	})
+	chunksMap = map[string]*Chunk{
+		"chunk1": {
+			Id:               "chunk1",
+			dataNodes:        set.NewSet(),
+			pendingDataNodes: set.NewSet("dataNode1", "dataNode2", "dataNode3"),
+			minAckNum:        2,
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- WaitForCommit(ctx, "chunk1", 0)
+	}()
+
+	report := func(dataNodeId string) {
+		UpdateChunk4Heartbeat(HeartbeatOperation{
+			DataNodeId:   "dataNode1",
+			SuccessInfos: []ChunkSendInfo{{ChunkId: "chunk1", DataNodeId: dataNodeId, SendType: common.CopySendType}},
+		})
+	}
+	report("dataNode1")
+	assert.False(t, IsChunkCommitted("chunk1"), "Chunk should not be committed after one replica.")
+	select {
+	case <-errCh:
+		t.Fatal("WaitForCommit should not return before the chunk is committed.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	report("dataNode2")
+	assert.True(t, IsChunkCommitted("chunk1"), "Chunk should be committed after two replicas.")
+	assert.NoError(t, <-errCh, "Unexpected error.")
+	assert.Equal(t, 2, strings.Count(chunksMap["chunk1"].String(), "$"),
+		"Committed chunk should not persist its minimum-ack number.")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, WaitForCommit(ctx, "chunk1", 3), context.DeadlineExceeded, "Expected timeout.")
+}
+
+func TestMasterHandler_MinAckNum(t *testing.T) {
+	replicaNum := viper.GetInt(common.ReplicaNum)
+	viper.Set(common.ReplicaNum, 3)
+	t.Cleanup(func() {
+		viper.Set(common.ReplicaNum, replicaNum)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	handler := newLeaderHandler(t)
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("dataNode%d", i)
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet(),
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	indexTestFile(t, "file1", 1)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(minAckNumMetadataKey, "2"))
+	_, err := handler.GetDataNodes4Add(ctx, &pb.GetDataNodes4AddArgs{FileNodeId: "file1", ChunkNum: 1})
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 2, chunksMap["file1_0"].minAckNum, "Unexpected minimum-ack number.")
+
+	for _, value := range []string{"x", "4"} {
+		ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(minAckNumMetadataKey, value))
+		_, err = handler.GetDataNodes4Add(ctx, &pb.GetDataNodes4AddArgs{FileNodeId: "file1", ChunkNum: 1})
+		assert.Error(t, err, "Illegal minimum-ack number %q should be rejected.", value)
+	}
+}
+
+func TestUpdateChunkAccess(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+	})
+	viper.Set(MasterAccessTimeGranularity, 3600)
+	chunksMap = map[string]*Chunk{
+		"chunk1": {Id: "chunk1", dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()},
+		"chunk2": {Id: "chunk2", dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()},
+	}
+	_, ok := GetChunkLastAccess("chunk1")
+	assert.False(t, ok, "Chunk should not have been accessed.")
+
+	base := time.Date(2022, 8, 1, 10, 30, 0, 0, time.UTC)
+	UpdateChunkAccess([]ChunkAccessInfo{{ChunkId: "chunk1", LastAccessTime: base.Unix()}})
+	lastAccess, ok := GetChunkLastAccess("chunk1")
+	assert.True(t, ok, "Chunk should have been accessed.")
+	assert.Equal(t, base.Unix(), lastAccess.Unix(), "Unexpected last access time.")
+
+	// A newer report advances the last access time and an older one is ignored.
+	UpdateChunkAccess([]ChunkAccessInfo{
+		{ChunkId: "chunk1", LastAccessTime: base.Add(time.Hour).Unix()},
+		{ChunkId: "chunk1", LastAccessTime: base.Add(-time.Hour).Unix()},
+		{ChunkId: "notExist", LastAccessTime: base.Unix()},
+	})
+	lastAccess, _ = GetChunkLastAccess("chunk1")
+	assert.Equal(t, base.Add(time.Hour).Unix(), lastAccess.Unix(), "Last access time should advance.")
+	assert.Equal(t, []string{"chunk2"}, GetColdChunks(base), "Unexpected cold chunks.")
+
+	// Snapshot only keeps the last access time rounded down to an hour.
+	wantRounded := base.Add(time.Hour).Truncate(time.Hour).Unix()
+	assert.Equal(t, fmt.Sprintf("chunk1$[dataNode1]$[]$[]$0$%d\n", wantRounded), chunksMap["chunk1"].String(),
+		"Unexpected string.")
+}
+
+func TestLostChunks(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+		lostChunkIds.Clear()
+	})
+	dataNodeMap["dataNode2"] = &DataNode{
+		Id:               "dataNode2",
+		Status:           common.Alive,
+		Chunks:           set.NewSet("chunk2"),
+		FutureSendChunks: make(map[ChunkSendInfo]int),
+	}
+	// The only DataNode storing chunk1 has died.
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	chunksMap["chunk2"] = &Chunk{Id: "chunk2", dataNodes: set.NewSet("dataNode2"), pendingDataNodes: set.NewSet()}
+	pendingChunkQueue.Push("chunk1")
+	pendingChunkQueue.Push("chunk2")
+
+	batchChunkIds := getPendingChunks()
+	dataNodeIds := GetAliveDataNodeIds()
+	chunkIds, lostIds := filterLostChunks(BatchFilterChunk(batchChunkIds), dataNodeIds)
+	assert.Equal(t, []string{"chunk2"}, chunkIds, "Unexpected chunks to allocate.")
+	assert.Equal(t, []string{"chunk1"}, lostIds, "Unexpected lost chunks.")
+	ApplyAllocatePlan(nil, nil, nil, dataNodeIds, batchChunkIds, len(batchChunkIds), chunkIds, lostIds)
+	assert.Equal(t, []string{"chunk1"}, GetLostChunks(), "Chunk should be classified lost.")
+	assert.Equal(t, []String{"chunk2"}, pendingChunkQueue.BatchTop(pendingChunkQueue.Len()),
+		"Lost chunk should not be retried.")
+
+	// The DataNode storing chunk1 comes back.
+	RecoverLostChunks("dataNode1", []string{"chunk1"})
+	assert.Equal(t, 0, len(GetLostChunks()), "Chunk should not be lost any more.")
+	assert.True(t, chunksMap["chunk1"].dataNodes.Contains("dataNode1"), "Unexpected data nodes.")
+	assert.Equal(t, []String{"chunk2", "chunk1"}, pendingChunkQueue.BatchTop(pendingChunkQueue.Len()),
+		"Recovered chunk should be allocated again.")
+
+	// Lost chunk whose file is removed is forgotten by the chunk check.
+	markChunksLost([]string{"chunk1"})
+	lost, err := newLeaderHandler(t).GetLostChunks()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []string{"chunk1"}, lost, "Unexpected lost chunks.")
+	_, err = CheckChunksOperation{}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 0, len(GetLostChunks()), "Erased chunk should not be lost.")
+	assert.Equal(t, float64(0), testutil.ToFloat64(lostChunkCountMonitor), "Unexpected lost chunk gauge.")
+}
+
+func TestAllocateCost_AntiAffinity(t *testing.T) {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	viper.Set(MasterTopologyKeys, []string{"zone", "rack"})
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		viper.Set(MasterTopologyKeys, topologyKeys)
+	})
+	tests := []struct {
+		name         string
+		dataNodeTags map[string]map[string]string
+		wantReceiver string
+	}{
+		{
+			name: "OtherRack",
+			dataNodeTags: map[string]map[string]string{
+				"dataNode1": {"zone": "eu", "rack": "A"},
+				"dataNode2": {"zone": "eu", "rack": "A"},
+				"dataNode3": {"zone": "eu", "rack": "A"},
+				"dataNode4": {"zone": "eu", "rack": "B"},
+			},
+			wantReceiver: "dataNode4",
+		},
+		{
+			name: "OtherZone",
+			dataNodeTags: map[string]map[string]string{
+				"dataNode1": {"zone": "eu", "rack": "A"},
+				"dataNode2": {"zone": "eu", "rack": "A"},
+				"dataNode3": {"zone": "eu", "rack": "B"},
+				"dataNode4": {"zone": "us", "rack": "A"},
+			},
+			wantReceiver: "dataNode4",
+		},
+		{
+			name: "SameRackOnly",
+			dataNodeTags: map[string]map[string]string{
+				"dataNode1": {"zone": "eu", "rack": "A"},
+				"dataNode2": {"zone": "eu", "rack": "A"},
+				"dataNode3": {"zone": "eu", "rack": "A"},
+			},
+			wantReceiver: "dataNode3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataNodeMap = make(map[string]*DataNode)
+			dataNodeIds := make([]string, 0, len(tt.dataNodeTags))
+			for id, tags := range tt.dataNodeTags {
+				dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Tags: tags}
+				dataNodeIds = append(dataNodeIds, id)
+			}
+			sort.Strings(dataNodeIds)
+			chunksMap = map[string]*Chunk{
+				"file1_0": {
+					Id:               "file1_0",
+					dataNodes:        set.NewSet("dataNode1", "dataNode2"),
+					pendingDataNodes: set.NewSet(),
+				},
+			}
+			chunkIds := []string{"file1_0"}
+			isStore := getStoreState(chunkIds, dataNodeIds)
+			isBlocked := getBlockedState(chunkIds, dataNodeIds, isStore)
+			for j := range dataNodeIds {
+				assert.Equal(t, isStore[0][j], isBlocked[0][j], "Near datanode should not be blocked.")
+			}
+			cost := newAllocateCost(len(chunkIds), dataNodeIds, isStore, AllocateCostWeights{Balance: 1, Distance: 1})
+			receiverPlan := allocateChunksDFSWithCost(len(chunkIds), len(dataNodeIds), isBlocked, cost)
+			assert.Equal(t, tt.wantReceiver, dataNodeIds[receiverPlan[0]], "Unexpected receiver.")
+		})
+	}
+}
+
+func TestValidateChunks(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           string
+		wantRecords    int
+		wantErrLines   []int
+		wantTerminated bool
+	}{
+		{
+			name:           "Valid",
+			data:           "chunk1$[dataNode1 dataNode2]$[]\nchunk2$[]$[dataNode1]$[]$2$1700000000\n" + common.SnapshotDelimiter,
+			wantRecords:    2,
+			wantErrLines:   []int{},
+			wantTerminated: true,
+		},
+		{
+			name: "Corrupt",
+			data: "chunk1$[dataNode1]$[]\nchunk2$[dataNode1]\nchunk3$dataNode1$[]\nchunk4$[]$[]$[]$x\n" +
+				common.SnapshotDelimiter,
+			wantRecords:    1,
+			wantErrLines:   []int{2, 3, 4},
+			wantTerminated: true,
+		},
+		{
+			name:         "Truncated",
+			data:         "chunk1$[dataNode1]$[]\n",
+			wantRecords:  1,
+			wantErrLines: []int{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunksMap = map[string]*Chunk{}
+			report := ValidateChunks(bufio.NewScanner(strings.NewReader(tt.data)))
+			assert.Equal(t, tt.wantRecords, report.Records, "Unexpected records.")
+			errLines := make([]int, len(report.Errors))
+			for i, lineErr := range report.Errors {
+				errLines[i] = lineErr.Line
+			}
+			assert.Equal(t, tt.wantErrLines, errLines, "Unexpected malformed lines.")
+			assert.Equal(t, tt.wantTerminated, report.Terminated, "Unexpected terminated.")
+			assert.Equal(t, tt.wantTerminated && len(tt.wantErrLines) == 0, report.IsValid(), "Unexpected valid.")
+			assert.Empty(t, chunksMap, "Validation should not change chunksMap.")
+		})
+	}
+}
+
+func TestGetChunkReplicationStatus(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+	})
+	chunksMap["chunk1"] = &Chunk{
+		Id:               "chunk1",
+		dataNodes:        set.NewSet("dataNode1"),
+		pendingDataNodes: set.NewSet("dataNode2", "dataNode3"),
+	}
+	status, err := GetChunkReplicationStatus("chunk1")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, ChunkReplicationStatus{
+		ChunkId:         "chunk1",
+		Replicas:        1,
+		PendingReplicas: 2,
+		TargetReplicas:  3,
+		Progress:        1.0 / 3,
+	}, status, "Unexpected status.")
+	assert.False(t, status.IsDurable(), "Chunk should not be durable.")
+
+	chunksMap["chunk1"].dataNodes = set.NewSet("dataNode1", "dataNode2", "dataNode3", "dataNode4")
+	chunksMap["chunk1"].pendingDataNodes = set.NewSet()
+	status, err = GetChunkReplicationStatus("chunk1")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 1.0, status.Progress, "Progress should be at most 1.")
+	assert.True(t, status.IsDurable(), "Chunk should be durable.")
+
+	_, err = GetChunkReplicationStatus("chunk2")
+	assert.Error(t, err, "Expected an error.")
+
+	// The target is the ReplicaFactor of the file.
+	t.Cleanup(func() {
+		replicaFactorFileNodes = make(map[string]*FileNode)
+	})
+	applyFileNodeReplicaFactor(&FileNode{Id: "file1"}, 5)
+	chunksMap["file1_0"] = &Chunk{Id: "file1_0", dataNodes: set.NewSet("dataNode1", "dataNode2", "dataNode3",
+		"dataNode4"), pendingDataNodes: set.NewSet()}
+	status, err = GetChunkReplicationStatus("file1_0")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 5, status.TargetReplicas, "Unexpected target replicas.")
+	assert.False(t, status.IsDurable(), "Chunk should not be durable.")
+}
+
+func TestGetFileDataNodes(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	fileNode, err := AddFileNode("/", "a.txt", 3*common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Address: "address1", Status: common.Alive}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Address: "address2", Status: common.Alive}
+	dataNodeMap["dataNode3"] = &DataNode{Id: "dataNode3", Address: "address3", Status: common.Alive}
+	dataNodeMap["dataNode4"] = &DataNode{Id: "dataNode4", Address: "address4", Status: common.Waiting}
+	replicas := [][]interface{}{
+		{"dataNode1", "dataNode2", "dataNode4"},
+		{"dataNode1", "dataNode3", "dataNode4"},
+		{"dataNode1", "dataNode2", "dataNode4"},
+	}
+	for i, dataNodes := range replicas {
+		chunkId := fileNode.Id + common.ChunkIdDelimiter + strconv.Itoa(i)
+		chunksMap[chunkId] = &Chunk{Id: chunkId, dataNodes: set.NewSet(dataNodes...), pendingDataNodes: set.NewSet()}
+	}
+
+	dataNodes, err := GetFileDataNodes("/a.txt")
+	assert.NoError(t, err, "Unexpected error.")
+	// dataNode4 is not alive, so it is skipped.
+	assert.Equal(t, []FileDataNode{
+		{DataNodeId: "dataNode1", Address: "address1", ChunkNum: 3},
+		{DataNodeId: "dataNode2", Address: "address2", ChunkNum: 2},
+		{DataNodeId: "dataNode3", Address: "address3", ChunkNum: 1},
+	}, dataNodes, "Unexpected datanodes.")
+
+	_, err = GetFileDataNodes("/")
+	assert.Error(t, err, "Expected an error.")
+	_, err = GetFileDataNodes("/b.txt")
+	assert.Error(t, err, "Expected an error.")
+}
+
+func TestGetStoreState_RemovedChunk(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	for _, id := range []string{"dataNode1", "dataNode2", "dataNode3"} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive}
+	}
+	// dataNode4 is dead, so it is not in dataNodeIds.
+	chunksMap["chunk1"] = &Chunk{
+		Id:               "chunk1",
+		dataNodes:        set.NewSet("dataNode2", "dataNode4"),
+		pendingDataNodes: set.NewSet(),
+	}
+	chunksMap["chunk3"] = &Chunk{
+		Id:               "chunk3",
+		dataNodes:        set.NewSet("dataNode1"),
+		pendingDataNodes: set.NewSet("dataNode3"),
+	}
+	dataNodeIds := []string{"dataNode1", "dataNode2", "dataNode3"}
+	// chunk2 has been removed after the batch is filtered.
+	chunkIds := []string{"chunk1", "chunk2", "chunk3"}
+
+	var isStore [][]bool
+	assert.NotPanics(t, func() {
+		isStore = getStoreState(chunkIds, dataNodeIds)
+	}, "Removed chunk should not panic.")
+	assert.Equal(t, [][]bool{
+		{false, true, false},
+		{true, true, true},
+		{true, false, true},
+	}, isStore, "Unexpected store state.")
+
+	isBlocked := getBlockedState(chunkIds, dataNodeIds, isStore)
+	resIds, _, _, unsatisfied := filterUnsatisfiedChunks(chunkIds, isStore, isBlocked)
+	assert.Equal(t, []string{"chunk1", "chunk3"}, resIds, "Unexpected chunks to allocate.")
+	assert.Equal(t, []string{"chunk2"}, unsatisfied, "Removed chunk should not be allocated.")
+
+	resIds, lostIds := filterLostChunks(chunkIds, dataNodeIds)
+	assert.Equal(t, []string{"chunk1", "chunk3"}, resIds, "Unexpected chunks to allocate.")
+	assert.Empty(t, lostIds, "Removed chunk should not be lost.")
+}
+
+func TestAllocateChunksDFS_Metrics(t *testing.T) {
+	exploredNodes := testutil.ToFloat64(allocateDFSExploredNodesMonitor)
+	earlyExits := testutil.ToFloat64(allocateDFSResultMonitor.WithLabelValues(dfsEarlyExit))
+	exhausted := testutil.ToFloat64(allocateDFSResultMonitor.WithLabelValues(dfsExhausted))
+	getDurationCount := func() uint64 {
+		metric := &dto.Metric{}
+		assert.NoError(t, allocateDFSDurationMonitor.(prometheus.Metric).Write(metric), "Unexpected error.")
+		return metric.GetHistogram().GetSampleCount()
+	}
+	durations := getDurationCount()
+
+	// The best plan which stores a Chunk in each DataNode can be found.
+	allocateChunksDFS(3, 3, [][]bool{{false, false, false}, {false, false, false}, {false, false, false}})
+	assert.Equal(t, earlyExits+1, testutil.ToFloat64(allocateDFSResultMonitor.WithLabelValues(dfsEarlyExit)),
+		"Search should exit early.")
+	assert.Equal(t, 0.0, testutil.ToFloat64(allocateDFSVarianceMonitor), "Unexpected variance.")
+	assert.Greater(t, testutil.ToFloat64(allocateDFSExploredNodesMonitor), exploredNodes,
+		"Explored nodes should be counted.")
+
+	// Both Chunk can only be stored in the second DataNode, so the best plan can
+	// never be found.
+	allocateChunksDFS(2, 2, [][]bool{{true, false}, {true, false}})
+	assert.Equal(t, exhausted+1, testutil.ToFloat64(allocateDFSResultMonitor.WithLabelValues(dfsExhausted)),
+		"Search should be exhausted.")
+	assert.Equal(t, 2.0, testutil.ToFloat64(allocateDFSVarianceMonitor), "Unexpected variance.")
+	assert.Equal(t, durations+2, getDurationCount(), "Duration of each search should be observed.")
+}
+
+func TestUpdateChunkSize(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+	})
+	// A file of 1.5 Chunk, so its last Chunk is partial.
+	lastSize := int64(common.ChunkSize / 2)
+	chunksMap["file_0"] = &Chunk{Id: "file_0", dataNodes: set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet()}
+	chunksMap["file_1"] = &Chunk{Id: "file_1", dataNodes: set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet()}
+	// Chunk whose size has not been reported is counted as a full Chunk.
+	assert.Equal(t, int64(4*common.ChunkSize), GetStoredBytes(), "Unexpected stored bytes.")
+
+	UpdateChunkSize("dataNode1", []ChunkSizeInfo{{ChunkId: "file_0", Size: common.ChunkSize},
+		{ChunkId: "file_1", Size: lastSize}, {ChunkId: "file_2", Size: lastSize}})
+	UpdateChunkSize("dataNode2", []ChunkSizeInfo{{ChunkId: "file_0", Size: common.ChunkSize},
+		{ChunkId: "file_1", Size: lastSize}})
+	assert.Equal(t, lastSize, chunksMap["file_1"].Size, "Unexpected chunk size.")
+	assert.Equal(t, 2*common.ChunkSize+2*lastSize, GetStoredBytes(), "Unexpected stored bytes.")
+	assert.Empty(t, GetChunkSizeConflicts(), "Unexpected conflicts.")
+
+	// Size is persisted in snapshot.
+	chunk, err := parseChunk(strings.TrimSuffix(chunksMap["file_1"].String(), "\n"))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, lastSize, chunk.Size, "Unexpected restored chunk size.")
+	assert.False(t, chunk.codingScheme.IsErasureCoded(), "Unexpected coding scheme.")
+
+	// A truncated replica is flagged and the largest size is kept.
+	UpdateChunkSize("dataNode2", []ChunkSizeInfo{{ChunkId: "file_1", Size: lastSize - 1}})
+	assert.Equal(t, lastSize, chunksMap["file_1"].Size, "Unexpected chunk size.")
+	assert.Equal(t, []ChunkSizeConflict{{ChunkId: "file_1",
+		Sizes: map[string]int64{"dataNode1": lastSize, "dataNode2": lastSize - 1}}},
+		GetChunkSizeConflicts(), "Unexpected conflicts.")
+}
+
+func TestApplyAllocatePlan_QueueChanged(t *testing.T) {
+	t.Cleanup(func() {
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	pendingChunkQueue.Push("chunk1")
+	pendingChunkQueue.Push("chunk2")
+	batchChunkIds := getPendingChunks()
+	assert.Equal(t, []string{"chunk1", "chunk2"}, batchChunkIds, "Unexpected batch.")
+
+	// Chunk are pushed between planning and applying.
+	pendingChunkQueue.Push("chunk3")
+	pendingChunkQueue.Push("chunk4")
+	ApplyAllocatePlan(nil, nil, nil, nil, batchChunkIds, len(batchChunkIds), nil, nil)
+	assert.Equal(t, []String{"chunk3", "chunk4"}, pendingChunkQueue.BatchTop(pendingChunkQueue.Len()),
+		"Only planned chunks should be removed.")
+
+	// The same plan is applied again, nothing planned is at the head any more.
+	ApplyAllocatePlan(nil, nil, nil, nil, batchChunkIds, len(batchChunkIds), nil, nil)
+	assert.Equal(t, []String{"chunk3", "chunk4"}, pendingChunkQueue.BatchTop(pendingChunkQueue.Len()),
+		"Unplanned chunks should not be removed.")
+
+	// The batch length of an old operation exceeds the queue length.
+	assert.Equal(t, 2, popPendingChunks(nil, 5), "Unexpected removed num.")
+	assert.Equal(t, 0, pendingChunkQueue.Len(), "Queue should be empty.")
+}
+
+func TestApplyAllocatePlan_SkipPresentReplica(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	for _, id := range []string{"dataNode1", "dataNode2", "dataNode3"} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet(),
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	// dataNode2 has stored chunk1 since the plan was made.
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet()}
+	chunksMap["chunk2"] = &Chunk{Id: "chunk2", dataNodes: set.NewSet("dataNode1"),
+		pendingDataNodes: set.NewSet()}
+	dataNodeIds := []string{"dataNode1", "dataNode2", "dataNode3"}
+	chunkIds := []string{"chunk1", "chunk2"}
+	skipped := testutil.ToFloat64(skippedPlacementCountMonitor)
+
+	ApplyAllocatePlan([]int{0, 0}, []int{1, 2}, chunkIds, dataNodeIds, nil, 0, nil, nil)
+	assert.Equal(t, 0, chunksMap["chunk1"].pendingDataNodes.Cardinality(), "Present replica should be skipped.")
+	assert.True(t, chunksMap["chunk2"].pendingDataNodes.Contains("dataNode3"), "Unexpected pending data nodes.")
+	assert.Equal(t, map[ChunkSendInfo]int{
+		{ChunkId: "chunk2", DataNodeId: "dataNode3", SendType: common.CopySendType}: common.WaitToInform,
+	}, dataNodeMap["dataNode1"].FutureSendChunks, "Skipped chunk should not be sent.")
+	assert.Equal(t, skipped+1, testutil.ToFloat64(skippedPlacementCountMonitor))
+
+	// The same plan is applied again, the pending replica is not added twice.
+	applied := BatchApplyPlan2Chunk([]int{2}, []string{"chunk2"}, dataNodeIds)
+	assert.Equal(t, []bool{false}, applied)
+	assert.Equal(t, 1, chunksMap["chunk2"].pendingDataNodes.Cardinality(), "Unexpected pending data nodes.")
+}
+
+func TestGetFileChunkIds(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		chunksMap = make(map[string]*Chunk)
+	})
+	fileNode, err := AddFileNode("/", "a.txt", 2*common.ChunkSize+1, true)
+	assert.NoError(t, err, "Unexpected error.")
+	expect := initChunks(2*common.ChunkSize+1, fileNode.Id)
+	chunkIds, err := GetFileChunkIds("/a.txt")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, expect, chunkIds, "Unexpected chunk ids.")
+	assert.Equal(t, fileNode.Id+common.ChunkIdDelimiter+"2", chunkIds[2], "Unexpected last chunk id.")
+	// The returned ids are a copy.
+	chunkIds[0] = "modified"
+	assert.Equal(t, expect[0], fileNode.Chunks[0], "Chunks of FileNode should not be changed.")
+
+	chunksMap[expect[2]] = &Chunk{Id: expect[2], dataNodes: set.NewSet(), pendingDataNodes: set.NewSet(), Size: 1}
+	chunks, err := GetFileChunks("/a.txt")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []FileChunk{
+		{ChunkId: expect[0], Index: 0},
+		{ChunkId: expect[1], Index: 1},
+		{ChunkId: expect[2], Index: 2, Size: 1},
+	}, chunks, "Unexpected chunks.")
+
+	_, err = RemoveFileNode("/a.txt")
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = GetFileChunkIds("/a.txt")
+	assert.Error(t, err, "Expected an error for a deleted file.")
+	_, err = GetFileChunkIds("/")
+	assert.Error(t, err, "Expected an error for a directory.")
+}
+
+func TestMapRangeToChunks(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		chunksMap = make(map[string]*Chunk)
+	})
+	fileNode, err := AddFileNode("/", "a.txt", 3*common.ChunkSize+10, true)
+	assert.NoError(t, err, "Unexpected error.")
+	chunkIds := fileNode.Chunks
+	// The second Chunk is short, so the rest of it is a hole.
+	chunksMap[chunkIds[1]] = &Chunk{Id: chunkIds[1], dataNodes: set.NewSet(), pendingDataNodes: set.NewSet(),
+		Size: 100}
+	chunksMap[chunkIds[3]] = &Chunk{Id: chunkIds[3], dataNodes: set.NewSet(), pendingDataNodes: set.NewSet(),
+		Size: 10}
+
+	ranges, err := MapRangeToChunks("/a.txt", common.ChunkSize-5, 10)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []ChunkRange{
+		{ChunkId: chunkIds[0], ChunkOffset: common.ChunkSize - 5, Length: 5},
+		{ChunkId: chunkIds[1], ChunkOffset: 0, Length: 5},
+	}, ranges, "Range spanning chunk boundary should be split.")
+
+	ranges, err = MapRangeToChunks("/a.txt", 3*common.ChunkSize, common.ChunkSize)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []ChunkRange{{ChunkId: chunkIds[3], ChunkOffset: 0, Length: 10}}, ranges,
+		"Range should be cut at the end of the partial last chunk.")
+
+	ranges, err = MapRangeToChunks("/a.txt", common.ChunkSize+50, common.ChunkSize)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []ChunkRange{
+		{ChunkId: chunkIds[1], ChunkOffset: 50, Length: 50},
+		{ChunkOffset: 100, Length: common.ChunkSize - 100},
+		{ChunkId: chunkIds[2], ChunkOffset: 0, Length: 50},
+	}, ranges, "Bytes beyond a short chunk should be a hole.")
+
+	// Chunk which has never been allocated is a hole as well.
+	fileNode.Chunks = chunkIds[:2]
+	ranges, err = MapRangeToChunks("/a.txt", common.ChunkSize+90, 2*common.ChunkSize)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []ChunkRange{
+		{ChunkId: chunkIds[1], ChunkOffset: 90, Length: 10},
+		{ChunkOffset: 100, Length: 2*common.ChunkSize - 90},
+	}, ranges, "Adjacent holes should be merged.")
+
+	ranges, err = MapRangeToChunks("/a.txt", 4*common.ChunkSize, 10)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Empty(t, ranges, "Range beyond the end of file should be empty.")
+	_, err = MapRangeToChunks("/a.txt", -1, 10)
+	assert.Error(t, err, "Expected an error for a negative offset.")
+	_, err = MapRangeToChunks("/", 0, 10)
+	assert.Error(t, err, "Expected an error for a directory.")
+}
+
+func TestRunAllocateWorker(t *testing.T) {
+	workerNum := viper.GetInt(MasterAllocateWorkerNum)
+	t.Cleanup(func() {
+		viper.Set(MasterAllocateWorkerNum, workerNum)
+	})
+	viper.Set(MasterAllocateWorkerNum, 2)
+
+	var (
+		running, maxRunning, ran, skipped int32
+		wg                                sync.WaitGroup
+	)
+	release := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok := runAllocateWorker(func() {
+				cur := atomic.AddInt32(&running, 1)
+				for {
+					old := atomic.LoadInt32(&maxRunning)
+					if cur <= old || atomic.CompareAndSwapInt32(&maxRunning, old, cur) {
+						break
+					}
+				}
+				<-release
+				atomic.AddInt32(&running, -1)
+			})
+			if ok {
+				atomic.AddInt32(&ran, 1)
+			} else {
+				atomic.AddInt32(&skipped, 1)
+			}
+		}()
+	}
+	// Wait until all triggers which can not get a worker are skipped.
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&skipped) == 18
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(2), maxRunning)
+	assert.Equal(t, int32(2), ran)
+	assert.Equal(t, 0, runningAllocateNum)
+
+	// Workers are released after the allocation finishes.
+	assert.True(t, runAllocateWorker(func() {}))
+}
+
+func TestExpirePendingDataNodes(t *testing.T) {
+	replicaNum := viper.GetInt(common.ReplicaNum)
+	timeout := viper.GetInt(MasterSendTimeoutHeartbeats)
+	viper.Set(common.ReplicaNum, 2)
+	viper.Set(MasterSendTimeoutHeartbeats, 2)
+	t.Cleanup(func() {
+		viper.Set(common.ReplicaNum, replicaNum)
+		viper.Set(MasterSendTimeoutHeartbeats, timeout)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	for _, id := range []string{"dataNode1", "dataNode2", "dataNode3"} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet(),
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	dataNodeMap["dataNode1"].Chunks.Add("chunk1")
+	// dataNode2 is a phantom pending replica, while dataNode3 is being sent.
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1"),
+		pendingDataNodes: set.NewSet("dataNode2")}
+	chunksMap["chunk2"] = &Chunk{Id: "chunk2", dataNodes: set.NewSet("dataNode1"),
+		pendingDataNodes: set.NewSet("dataNode3")}
+	// The client is still writing chunk3 to dataNode2.
+	chunksMap["chunk3"] = &Chunk{Id: "chunk3", dataNodes: set.NewSet(),
+		pendingDataNodes: set.NewSet("dataNode2"), minAckNum: 1}
+	dataNodeMap["dataNode1"].FutureSendChunks[ChunkSendInfo{ChunkId: "chunk2", DataNodeId: "dataNode3",
+		SendType: common.CopySendType}] = common.WaitToSend
+	assert.Equal(t, []string{}, BatchFilterChunk([]string{"chunk1", "chunk2"}), "Chunk should not be allocatable.")
+
+	heartbeat := func() {
+		for _, id := range []string{"dataNode2", "dataNode3"} {
+			_, _, ok := UpdateDataNode4Heartbeat(HeartbeatOperation{DataNodeId: id})
+			assert.True(t, ok, "Unexpected heartbeat result.")
+		}
+	}
+	assert.Empty(t, FindStalePendingDataNodes(), "Pending replica should be only recorded first.")
+	heartbeat()
+	heartbeat()
+	assert.Empty(t, FindStalePendingDataNodes(), "Pending replica within timeout should be kept.")
+	heartbeat()
+	stale := FindStalePendingDataNodes()
+	assert.Equal(t, map[string][]string{"chunk1": {"dataNode2"}}, stale, "Unexpected stale replicas.")
+	expired, err := ExpirePendingOperation{Replicas: stale}.Apply()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expired, "Unexpected expired num.")
+	assert.Equal(t, 0, chunksMap["chunk1"].pendingDataNodes.Cardinality(), "Stale pending replica should be cleared.")
+	assert.True(t, chunksMap["chunk3"].pendingDataNodes.Contains("dataNode2"), "Writing replica should be kept.")
+	_, ok := chunksMap["chunk1"].pendingSince["dataNode2"]
+	assert.False(t, ok, "Expired pending replica should not be tracked.")
+	assert.True(t, chunksMap["chunk2"].pendingDataNodes.Contains("dataNode3"), "Sending replica should be kept.")
+	assert.Equal(t, 1, pendingChunkQueue.Len(), "Expired chunk should be queued again.")
+	assert.Equal(t, []string{"chunk1"}, BatchFilterChunk([]string{"chunk1", "chunk2"}),
+		"Chunk should be allocatable again.")
+}
@@ -0,0 +1,200 @@
+package internal
+
+// Config key string. These keys are only used by master, so they are not put
+// into tinydfs-base/common.
+const (
+	MasterExportPageSize        = "master.exportPageSize"
+	MasterExpandFreeSpaceFloor  = "master.expandFreeSpaceFloor"
+	MasterChunkBloomFPRate      = "master.chunkBloomFPRate"
+	MasterShutdownTimeout       = "master.shutdownTimeout"
+	MasterVarianceTolerance     = "master.varianceTolerance"
+	MasterSendTimeoutHeartbeats = "master.sendTimeoutHeartbeats"
+	MasterAuditLogPath          = "master.auditLogPath"
+	MasterAuditBufferSize       = "master.auditBufferSize"
+	MasterAccessTimeGranularity = "master.accessTimeGranularity"
+	MasterDegradeBatchSize      = "master.degradeBatchSize"
+	MasterClockSkewThreshold    = "master.clockSkewThreshold"
+	MasterTopologyKeys          = "master.topologyKeys"
+	MasterMaxChunksPerFile      = "master.maxChunksPerFile"
+	MasterLazyChunkThreshold    = "master.lazyChunkThreshold"
+	MasterDegradeRequeueWindow  = "master.degradeRequeueWindow"
+	MasterMaxChildrenPerDir     = "master.maxChildrenPerDir"
+	MasterReadIndexTimeout      = "master.readIndexTimeout"
+	MasterWalkTimeout           = "master.walkTimeout"
+	MasterAllocateWorkerNum     = "master.allocateWorkerNum"
+	MasterPermissionEnabled     = "master.permissionEnabled"
+	MasterSuperuser             = "master.superuser"
+	MasterPendingQueueWatermark = "master.pendingQueueHighWatermark"
+	MasterPendingAgeThreshold   = "master.pendingAgeThreshold"
+	MasterSnapshotDurability    = "master.snapshotDurability"
+	MasterSnapshotSyncInterval  = "master.snapshotSyncInterval"
+	MasterSnapshotRetainNum     = "master.snapshotRetainNum"
+	MasterSnapshotRetainAge     = "master.snapshotRetainAge"
+	MasterSendRetryLimit        = "master.sendRetryLimit"
+	MasterDeleteMode            = "master.deleteMode"
+	MasterMaxBatchStatSize      = "master.maxBatchStatSize"
+	MasterMaxBatchAddSize       = "master.maxBatchAddSize"
+	MasterRenameHistoryLength   = "master.renameHistoryLength"
+	MasterFlapThreshold         = "master.flapThreshold"
+	MasterFlapWindow            = "master.flapWindow"
+	MasterChecksumMismatchMode  = "master.checksumMismatchMode"
+	MasterWriteQuorumDomains    = "master.writeQuorumDomains"
+	MasterFileNameInternSize    = "master.fileNameInternSize"
+	MasterChunkReportBatchSize  = "master.chunkReportBatchSize"
+	// Weights of terms of the cost of chunk allocating plan, see AllocateCostWeights.
+	MasterAllocateBalanceWeight   = "master.allocateWeights.balance"
+	MasterAllocateCapacityWeight  = "master.allocateWeights.capacity"
+	MasterAllocateLoadWeight      = "master.allocateWeights.load"
+	MasterAllocateRackWeight      = "master.allocateWeights.rack"
+	MasterAllocateDiversityWeight = "master.allocateWeights.diversity"
+	MasterAllocateDistanceWeight  = "master.allocateWeights.distance"
+)
+
+// Default value of config which is used when the config is not set.
+const (
+	defaultExportPageSize       = 1024
+	defaultExpandFreeSpaceFloor = 15
+	// defaultChunkBloomFalsePositiveRate is also used when the configured rate
+	// is out of (0, 1).
+	defaultChunkBloomFalsePositiveRate = 0.01
+	defaultChunkBloomCapacity          = 1 << 16
+	defaultShutdownTimeout             = 30
+	defaultSendTimeoutHeartbeats       = 10
+	defaultAuditBufferSize             = 1024
+	defaultAccessTimeGranularity       = 3600
+	defaultDegradeBatchSize            = 8
+	defaultClockSkewThreshold          = 1000
+	defaultMaxChunksPerFile            = 1 << 20
+	defaultMaxChildrenPerDir           = 1 << 20
+	defaultReadIndexTimeout            = 1000
+	defaultWalkTimeout                 = 5000
+	defaultAllocateWorkerNum           = 1
+	defaultPendingQueueWatermark       = 1 << 20
+	defaultPendingAgeThreshold         = 600
+	defaultSnapshotSyncInterval        = 300
+	defaultSnapshotRetainNum           = 2
+	defaultSendRetryLimit              = 2
+	defaultMaxBatchStatSize            = 1000
+	defaultMaxBatchAddSize             = 10000
+	defaultRenameHistoryLength         = 8
+	defaultFlapThreshold               = 5
+	defaultFlapWindow                  = 600
+	defaultChunkReportBatchSize        = 1024
+	defaultAllocateDistanceWeight      = 1.0
+)
+
+// Status of DataNode. These status are only used by master, so they are not put
+// into tinydfs-base/common.
+const (
+	// Quarantined means the DataNode flaps between Alive and Waiting too often,
+	// so it is excluded from allocation until an operator clears it.
+	Quarantined = 3
+)
+
+// Metadata key of gRPC calls between client and master.
+const (
+	// appliedIndexMetadataKey is the header of the response of a mutation. Its
+	// value is the index of the Raft log of the mutation.
+	appliedIndexMetadataKey = "applied-index"
+	// minIndexMetadataKey is the metadata of a read request. Its value is the
+	// index of the Raft log the serving master must have applied.
+	minIndexMetadataKey = "min-applied-index"
+	// workDirMetadataKey is the metadata of a request. Relative paths in the
+	// request are resolved against its value.
+	workDirMetadataKey = "working-directory"
+	// deleteModeMetadataKey is the metadata of a remove request. Its value is
+	// the delete mode of the request, which overrides master.deleteMode.
+	deleteModeMetadataKey = "delete-mode"
+	// chunkIndexMetadataKey is the metadata of a GetDataNodes4Add request. Its
+	// value is the index of the first Chunk to get DataNode for, which is 0 if
+	// it is not given.
+	chunkIndexMetadataKey = "chunk-index"
+	// chunkReportMetadataKey is the header of the response of a heartbeat. It
+	// is set to "true" if the DataNode should stream a full chunk report by
+	// ReportChunks, and it is set until the report finishes.
+	chunkReportMetadataKey = "chunk-report-requested"
+	// clientAddressMetadataKey and clientTagsMetadataKey are the metadata of a
+	// read request. They are the ClientLocality hint, and the value of the tags
+	// is in the same format as Tags of DataNode in snapshot, e.g. "rack=r1,zone=z1".
+	clientAddressMetadataKey = "client-address"
+	clientTagsMetadataKey    = "client-tags"
+	// chunkSizesMetadataKey is the metadata of a heartbeat. Its value is the
+	// size of Chunk stored on the DataNode in the same format as Tags of
+	// DataNode in snapshot, e.g. "chunk1=1024,chunk2=2048".
+	chunkSizesMetadataKey = "chunk-sizes"
+	// codingSchemeMetadataKey is the metadata of a GetDataNodes4Add request.
+	// Its value is the CodingScheme of the Chunk like "6+3", and the Chunk are
+	// fully replicated if it is not given.
+	codingSchemeMetadataKey = "coding-scheme"
+	// reconstructTasksMetadataKey is the header of the response of a heartbeat.
+	// Each value is a ReconstructTask of the DataNode in json.
+	reconstructTasksMetadataKey = "reconstruct-tasks"
+	// dataNodeIdMetadataKey and dataNodeFreshMetadataKey are the metadata of a
+	// register request. The id is the one the DataNode got when it registered
+	// before, and a new id is generated if it is not given. Fresh is set to
+	// "true" if the DataNode has been formatted since then.
+	dataNodeIdMetadataKey    = "datanode-id"
+	dataNodeFreshMetadataKey = "datanode-fresh"
+	// minAckNumMetadataKey is the metadata of a GetDataNodes4Add request. Its
+	// value is the number of replicas which must be stored before a Chunk is
+	// committed, and all replicas must be stored if it is not given.
+	minAckNumMetadataKey = "min-ack-num"
+	// chunkAccessMetadataKey is the metadata of a heartbeat. Its value is the
+	// last read time(unix seconds) of Chunk on the DataNode since the last
+	// heartbeat in the same format as chunkSizesMetadataKey, e.g.
+	// "chunk1=1700000000".
+	chunkAccessMetadataKey = "chunk-access"
+	// chunkPlacementMetadataKey is the metadata of a GetDataNodes4Add request.
+	// Each value is the ordered DataNode id given by client for a Chunk,
+	// separated by ",", and the values are in the order of Chunk. Chunk without
+	// a value are allocated by master.
+	chunkPlacementMetadataKey = "chunk-placement"
+	// reportTimeMetadataKey is the metadata of a heartbeat. Its value is the
+	// time(unix milliseconds) of the DataNode when it sends the heartbeat, which
+	// is used to find the clock skew of the DataNode.
+	reportTimeMetadataKey = "report-time"
+	// overwriteMetadataKey is the metadata of a CheckArgs4Add request. It is
+	// set to "true" if an existing file with the same name should be replaced.
+	overwriteMetadataKey = "overwrite"
+	// includeDeletedMetadataKey is the metadata of a CheckAndList request. It
+	// is set to "true" if deleted FileNode which are still in the trash should
+	// also be listed.
+	includeDeletedMetadataKey = "include-deleted"
+)
+
+// Operation type. These operations are only used by master, so they are not put
+// into tinydfs-base/common.
+const (
+	OperationCreateNamespace = "CreateNamespace"
+	OperationPinChunk        = "PinChunk"
+	OperationUnpinChunk      = "UnpinChunk"
+	OperationSetDataNodeTags = "SetDataNodeTags"
+	OperationSetConstraint   = "SetConstraint"
+	OperationBatchDegrade    = "BatchDegrade"
+	OperationSetDirPolicy    = "SetDirPolicy"
+	OperationSetReadFloor    = "SetReadFloor"
+	OperationReleaseStaged   = "ReleaseStaged"
+	OperationReconstruct     = "Reconstruct"
+	OperationEvictChunk      = "EvictChunk"
+	OperationSetQuiescent    = "SetQuiescent"
+	OperationSetQuota        = "SetQuota"
+	OperationSetMaxChildren  = "SetMaxChildren"
+	// OperationForceRemoveDataNode is also used by admin through MasterHandler.
+	OperationForceRemoveDataNode = "ForceRemoveDataNode"
+	OperationSetReplicaFactor    = "SetReplicaFactor"
+	OperationChmod               = "Chmod"
+	OperationChown               = "Chown"
+	OperationBeginChunkReport    = "BeginChunkReport"
+	OperationChunkReport         = "ChunkReport"
+	OperationAbortChunkReport    = "AbortChunkReport"
+	OperationGrantPrimary        = "GrantPrimary"
+	OperationSetMaxPerDomain     = "SetMaxPerDomain"
+	OperationRestoreDeleted      = "RestoreDeleted"
+	OperationClearQuarantine     = "ClearQuarantine"
+	OperationReleaseReplica      = "ReleaseReplica"
+	OperationBatchAdd            = "BatchAdd"
+	OperationAllocateChunk       = "AllocateChunk"
+	OperationSwap                = "Swap"
+	OperationExpirePending       = "ExpirePending"
+	OperationRebuildChunkIndex   = "RebuildChunkIndex"
+)
@@ -9,6 +9,7 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/atomic"
 	"math"
+	"net"
 	"sort"
 	"strconv"
 	"strings"
@@ -29,8 +30,21 @@ const (
 	usedCapacityIdx
 	fsChunksIdx
 	heartbeatIdx
+	tagsIdx
+	quiescentIdx
+	flapTimesIdx
 )
 
+// reportRecordPrefix starts the line of the chunk report in progress of a
+// DataNode in the datanodes section of the snapshot, like
+// "#report:dataNode1$[added]$[removed]$[reported]".
+const reportRecordPrefix = "#report:"
+
+// sizeRecordPrefix starts the line of the size of Chunk reported by a DataNode
+// in the datanodes section of the snapshot, like
+// "#sizes:dataNode1$chunk1=1024,chunk2=2048".
+const sizeRecordPrefix = "#sizes:"
+
 var (
 	// dataNodeMap stores all DataNode in this system, using id as the key.
 	dataNodeMap   = make(map[string]*DataNode)
@@ -68,9 +82,161 @@ type DataNode struct {
 	// FutureSendChunks include ChunkSendInfo that means this DataNode should send
 	// which Chunk to Which DataNode, and the value represent the state of sending.
 	FutureSendChunks map[ChunkSendInfo]int
+	// SendAttempts includes how many heartbeats each ChunkSendInfo in
+	// FutureSendChunks has been waiting for its result since it was sent to
+	// this DataNode. It can be nil if no Chunk is being sent.
+	SendAttempts map[ChunkSendInfo]int
+	// SendRetries includes how many times each ChunkSendInfo in
+	// FutureSendChunks has been re-issued through the same source and target
+	// after failures. It can be nil if no sending has failed.
+	SendRetries map[ChunkSendInfo]int
 	// HeartbeatTime is the time when the most recent heartbeat was received for
 	// this node.
 	HeartbeatTime time.Time
+	// Tags are arbitrary key/value labels of this DataNode such as "zone=eu".
+	// They are used to evaluate the PlacementConstraint of files.
+	Tags map[string]string
+	// ClockSkew is the time reported by this DataNode in the most recent
+	// heartbeat minus the time master received it. It is only used to find
+	// clocks out of sync, liveness is always decided by HeartbeatTime.
+	ClockSkew time.Duration
+	// Quiescent means this DataNode is under maintenance such as formatting or
+	// replacing its disk, so the Chunk reported by its heartbeat are ignored
+	// until it is re-activated.
+	Quiescent bool
+	// reportAdded and reportRemoved include Chunk added to or removed from
+	// Chunks by heartbeats since a full chunk report of this DataNode began,
+	// and reportChunks includes Chunk received by partial report operations.
+	// They are nil if no report is in progress, and they are persisted as a
+	// line of reportRecordPrefix.
+	reportAdded   set.Set
+	reportRemoved set.Set
+	reportChunks  set.Set
+	// reportRequested means this DataNode rejoins after being Waiting, so a
+	// full chunk report is requested to re-validate its Chunks. It is cleared
+	// when the report finishes.
+	reportRequested bool
+	// heartbeats is the number of heartbeats received from this DataNode since
+	// master started. It is not persisted.
+	heartbeats int64
+	// FlapTimes includes unix seconds when this DataNode rejoined after being
+	// Waiting within the flap window, see recordFlap.
+	FlapTimes []int64
+	// chunkNum and chunkBytes are the number of Chunk in Chunks and the sum of
+	// their sizes reported by this DataNode. They are changed with Chunks by
+	// addChunk, removeChunk and recountChunks rather than computed on demand,
+	// and they are recounted when the snapshot is restored.
+	chunkNum   int
+	chunkBytes int64
+	// chunkSizes is the size of each Chunk in Chunks reported by this DataNode.
+	// It can be nil, and it is persisted as a line of sizeRecordPrefix.
+	chunkSizes map[string]int64
+}
+
+// addChunk adds a Chunk to Chunks and tracks it if a full chunk report is in
+// progress. The caller must hold updateMapLock.
+func (d *DataNode) addChunk(chunkId string) {
+	if !d.Chunks.Contains(chunkId) {
+		d.Chunks.Add(chunkId)
+		d.chunkNum++
+		d.updateChunkMonitor()
+	}
+	if d.reportAdded != nil {
+		d.reportAdded.Add(chunkId)
+		d.reportRemoved.Remove(chunkId)
+	}
+}
+
+// removeChunk removes a Chunk from Chunks and tracks it if a full chunk report
+// is in progress. The caller must hold updateMapLock.
+func (d *DataNode) removeChunk(chunkId string) {
+	if d.Chunks.Contains(chunkId) {
+		d.Chunks.Remove(chunkId)
+		d.chunkNum--
+		d.chunkBytes -= d.chunkSizes[chunkId]
+		delete(d.chunkSizes, chunkId)
+		d.updateChunkMonitor()
+	}
+	if d.reportAdded != nil {
+		d.reportRemoved.Add(chunkId)
+		d.reportAdded.Remove(chunkId)
+	}
+}
+
+// setChunkSize records the size of a Chunk in Chunks reported by this DataNode.
+// The caller must hold updateMapLock.
+func (d *DataNode) setChunkSize(chunkId string, size int64) {
+	if size <= 0 || !d.Chunks.Contains(chunkId) {
+		return
+	}
+	if d.chunkSizes == nil {
+		d.chunkSizes = make(map[string]int64)
+	}
+	d.chunkBytes += size - d.chunkSizes[chunkId]
+	d.chunkSizes[chunkId] = size
+	d.updateChunkMonitor()
+}
+
+// recountChunks computes chunkNum and chunkBytes from Chunks again. It must be
+// called after Chunks is replaced, and it repairs the counters if they drift.
+// The caller must hold updateMapLock.
+func (d *DataNode) recountChunks() {
+	d.chunkNum = d.Chunks.Cardinality()
+	d.chunkBytes = 0
+	for chunkId, size := range d.chunkSizes {
+		if !d.Chunks.Contains(chunkId) {
+			delete(d.chunkSizes, chunkId)
+			continue
+		}
+		d.chunkBytes += size
+	}
+	d.updateChunkMonitor()
+}
+
+// isChunkCountConsistent checks whether chunkNum and chunkBytes agree with
+// Chunks. The caller must hold updateMapLock.
+func (d *DataNode) isChunkCountConsistent() bool {
+	if d.chunkNum != d.Chunks.Cardinality() {
+		return false
+	}
+	chunkBytes := int64(0)
+	for chunkId, size := range d.chunkSizes {
+		if !d.Chunks.Contains(chunkId) {
+			return false
+		}
+		chunkBytes += size
+	}
+	return chunkBytes == d.chunkBytes
+}
+
+// updateChunkMonitor exposes chunkNum and chunkBytes of this DataNode.
+func (d *DataNode) updateChunkMonitor() {
+	dataNodeChunkCountMonitor.WithLabelValues(d.Id).Set(float64(d.chunkNum))
+	dataNodeChunkBytesMonitor.WithLabelValues(d.Id).Set(float64(d.chunkBytes))
+}
+
+// scheduleChunkDelete tells the DataNode to delete the Chunk. The Chunk stays in
+// Chunks as delete-pending until the DataNode confirms the deleting by a
+// heartbeat, or by a full chunk report without it. The caller must hold
+// updateMapLock.
+func (d *DataNode) scheduleChunkDelete(chunkId string) {
+	info := ChunkSendInfo{ChunkId: chunkId, DataNodeId: "", SendType: common.DeleteSendType}
+	if _, ok := d.FutureSendChunks[info]; !ok {
+		d.FutureSendChunks[info] = common.WaitToInform
+	}
+}
+
+// IsChunkDeletePending checks whether the DataNode has been told to delete the
+// Chunk but has not confirmed it.
+func IsChunkDeletePending(dataNodeId string, chunkId string) bool {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	dataNode, ok := dataNodeMap[dataNodeId]
+	if !ok {
+		return false
+	}
+	_, ok = dataNode.FutureSendChunks[ChunkSendInfo{ChunkId: chunkId, SendType: common.DeleteSendType}]
+	return ok
 }
 
 func (d *DataNode) String() string {
@@ -85,12 +251,29 @@ func (d *DataNode) String() string {
 	fsChunks := make([]string, len(d.FutureSendChunks))
 	index = 0
 	for info, s := range d.FutureSendChunks {
-		fsChunks[index] = fmt.Sprintf("%s@%s@%v@%v", info.ChunkId, info.DataNodeId, info.SendType, s)
+		fsChunks[index] = fmt.Sprintf("%s@%s@%v@%v@%v", info.ChunkId, info.DataNodeId, info.SendType, s,
+			d.SendAttempts[info])
+		if retries := d.SendRetries[info]; retries != 0 {
+			fsChunks[index] += fmt.Sprintf("@%v", retries)
+		}
+		index++
 	}
 
-	res.WriteString(fmt.Sprintf("%s$%v$%s$%v$%v$%v$%v$%v$%s\n",
+	res.WriteString(fmt.Sprintf("%s$%v$%s$%v$%v$%v$%v$%v$%s",
 		d.Id, d.Status, d.Address, chunks, d.IOLoad, d.FullCapacity, d.UsedCapacity, fsChunks,
 		d.HeartbeatTime.Format(common.LogFileTimeFormat)))
+	// Tags, quiescent flag and flap times are optional, so they are only
+	// written when they or fields after them exist.
+	if len(d.Tags) != 0 || d.Quiescent || len(d.FlapTimes) != 0 {
+		res.WriteString(fmt.Sprintf("$%s", tags2String(d.Tags)))
+	}
+	if d.Quiescent || len(d.FlapTimes) != 0 {
+		res.WriteString(fmt.Sprintf("$%v", d.Quiescent))
+	}
+	if len(d.FlapTimes) != 0 {
+		res.WriteString(fmt.Sprintf("$%s", flapTimes2String(d.FlapTimes)))
+	}
+	res.WriteString("\n")
 	return res.String()
 }
 
@@ -134,10 +317,49 @@ func (h *DataNodeHeap) Pop() interface{} {
 	return v
 }
 
-func AddDataNode(datanode *DataNode) {
+// AddDataNode adds a DataNode to dataNodeMap. If a DataNode with the same id
+// exists, the DataNode re-registers after a transient disconnect, so its Chunk
+// are merged into the existing Chunks, and the existing Status, Tags and
+// FutureSendChunks are kept except that a Waiting DataNode is back to the new
+// Status. The existing one is only replaced if isFresh is true, which means the
+// DataNode has been formatted and stores nothing it stored before, so Chunk of
+// the existing one are evacuated like those of a dead DataNode. A new
+// DataNode at the address of a removed one takes over its flaps, and a
+// quarantined DataNode stays quarantined without its Chunk being trusted. now is
+// the time it registers. It returns true if the DataNode is merged into the
+// existing one.
+func AddDataNode(datanode *DataNode, isFresh bool, now time.Time) bool {
 	updateMapLock.Lock()
 	defer updateMapLock.Unlock()
-	dataNodeMap[datanode.Id] = datanode
+	existing, ok := dataNodeMap[datanode.Id]
+	if !ok || isFresh {
+		if ok {
+			evacuateDataNode(existing, now)
+			datanode.FlapTimes = existing.FlapTimes
+			if existing.Status == Quarantined {
+				datanode.Status = Quarantined
+				datanode.Chunks = set.NewSet()
+			}
+		} else {
+			restoreFlapRecord(datanode)
+		}
+		dataNodeMap[datanode.Id] = datanode
+		datanode.recountChunks()
+		return false
+	}
+	if existing.Status != Quarantined {
+		existing.Chunks = existing.Chunks.Union(datanode.Chunks)
+		existing.recountChunks()
+	}
+	if existing.Status == common.Waiting {
+		existing.Status = datanode.Status
+		recordFlap(existing, now)
+	}
+	existing.Address = datanode.Address
+	existing.FullCapacity = datanode.FullCapacity
+	existing.UsedCapacity = datanode.UsedCapacity
+	existing.HeartbeatTime = datanode.HeartbeatTime
+	return true
 }
 
 func GetDataNode(id string) *DataNode {
@@ -146,43 +368,148 @@ func GetDataNode(id string) *DataNode {
 	return dataNodeMap[id]
 }
 
+// SetDataNodeTags replaces all Tags of the DataNode with the given tags.
+func SetDataNodeTags(id string, tags map[string]string) error {
+	for k, v := range tags {
+		if k == "" || !isLegalTag(k) || !isLegalTag(v) {
+			return fmt.Errorf("illegal datanode tag, tag: %s%s%s", k, tagDelimiter, v)
+		}
+	}
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	dataNode, ok := dataNodeMap[id]
+	if !ok {
+		return fmt.Errorf("datanode not exist, datanode id: %s", id)
+	}
+	dataNode.Tags = make(map[string]string, len(tags))
+	for k, v := range tags {
+		dataNode.Tags[k] = v
+	}
+	return nil
+}
+
+// SetDataNodeQuiescent sets or clears the quiescent flag of the DataNode.
+func SetDataNodeQuiescent(id string, quiescent bool) error {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	dataNode, ok := dataNodeMap[id]
+	if !ok {
+		return fmt.Errorf("datanode not exist, datanode id: %s", id)
+	}
+	dataNode.Quiescent = quiescent
+	Logger.Infof("Set quiescent flag of datanode, datanode id: %s, quiescent: %v", id, quiescent)
+	return nil
+}
+
+// IsDataNodeQuiescent checks whether the DataNode exists and is quiescent.
+func IsDataNodeQuiescent(id string) bool {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	dataNode, ok := dataNodeMap[id]
+	return ok && dataNode.Quiescent
+}
+
+// RetryFailedSends re-issues failed ChunkSendInfo of the DataNode through the
+// same source and target, so that a transient failure between two DataNode does
+// not churn the allocator. A ChunkSendInfo is retried at most the configured
+// number of times and only if its target is still alive, after that it is
+// returned to fall back to a full re-allocation like before. Move and delete
+// sending are never retried.
+func RetryFailedSends(dataNodeId string, failInfos []ChunkSendInfo) []ChunkSendInfo {
+	retryLimit := defaultSendRetryLimit
+	if viper.IsSet(MasterSendRetryLimit) {
+		retryLimit = viper.GetInt(MasterSendRetryLimit)
+	}
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	dataNode, ok := dataNodeMap[dataNodeId]
+	if !ok || retryLimit <= 0 {
+		return failInfos
+	}
+	remainInfos := make([]ChunkSendInfo, 0, len(failInfos))
+	for _, info := range failInfos {
+		target, ok := dataNodeMap[info.DataNodeId]
+		if info.SendType == common.MoveSendType || info.SendType == common.DeleteSendType || !ok ||
+			target.Status != common.Alive || dataNode.SendRetries[info] >= retryLimit {
+			remainInfos = append(remainInfos, info)
+			continue
+		}
+		if dataNode.SendRetries == nil {
+			dataNode.SendRetries = make(map[ChunkSendInfo]int)
+		}
+		dataNode.SendRetries[info]++
+		dataNode.FutureSendChunks[info] = common.WaitToInform
+		delete(dataNode.SendAttempts, info)
+		Logger.Infof("Retry a failed chunk sending, datanode id: %s, chunk id: %s, target: %s, retry: %d",
+			dataNodeId, info.ChunkId, info.DataNodeId, dataNode.SendRetries[info])
+	}
+	return remainInfos
+}
+
 // UpdateDataNode4Heartbeat updates DataNode according to the Chunk sending
-// information given by the heartbeat.
-func UpdateDataNode4Heartbeat(o HeartbeatOperation) ([]ChunkSendInfo, bool) {
+// information given by the heartbeat. It returns ChunkSendInfo which should be
+// sent by the DataNode next, and ChunkSendInfo which is abandoned because its
+// result has not been reported for too many heartbeats.
+func UpdateDataNode4Heartbeat(o HeartbeatOperation) ([]ChunkSendInfo, []ChunkSendInfo, bool) {
 	updateMapLock.Lock()
 	defer updateMapLock.Unlock()
 	dataNode, ok := dataNodeMap[o.DataNodeId]
 	if !ok {
-		return nil, false
+		return nil, nil, false
 	}
 	dataNode.FullCapacity = int(o.FullCapacity)
 	dataNode.UsedCapacity = int(o.UsedCapacity)
 	dataNode.HeartbeatTime = time.Now()
-	if o.IsReady {
+	dataNode.heartbeats++
+	updateClockSkew(dataNode, o.ReportTime, o.ReceiveTime)
+	// A Waiting DataNode sending heartbeat again rejoins, but it may have lost
+	// Chunk while away, so Chunks are not trusted until its full chunk report.
+	if dataNode.Status == common.Waiting {
+		dataNode.Status = common.Alive
+		dataNode.reportRequested = true
+		Logger.Infof("Waiting datanode rejoins, request a full chunk report, datanode id: %s", dataNode.Id)
+		recordFlap(dataNode, time.UnixMilli(o.ReceiveTime))
+	}
+	if o.IsReady && dataNode.Status != Quarantined {
 		dataNode.Status = common.Alive
 	}
 	dataNode.IOLoad = int(o.IOLoad)
 	for _, info := range o.SuccessInfos {
 		delete(dataNode.FutureSendChunks, info)
+		delete(dataNode.SendAttempts, info)
+		delete(dataNode.SendRetries, info)
 		if info.SendType == common.MoveSendType || info.SendType == common.DeleteSendType {
-			dataNode.Chunks.Remove(info.ChunkId)
+			dataNode.removeChunk(info.ChunkId)
 		}
 		// If SendType is delete, ok is false.
 		if dataNodeS, ok := dataNodeMap[info.DataNodeId]; ok {
-			dataNodeS.Chunks.Add(info.ChunkId)
+			dataNodeS.addChunk(info.ChunkId)
 		}
 	}
 	for _, info := range o.FailInfos {
+		delete(dataNode.SendAttempts, info)
+		delete(dataNode.SendRetries, info)
+		// Deleting is pending until it is confirmed, so it is sent again.
+		if info.SendType == common.DeleteSendType {
+			if _, ok := dataNode.FutureSendChunks[info]; ok {
+				dataNode.FutureSendChunks[info] = common.WaitToInform
+			}
+			continue
+		}
 		delete(dataNode.FutureSendChunks, info)
-		// No need to handle move or delete chunk failure.
-		if info.SendType == common.MoveSendType || info.SendType == common.DeleteSendType {
+		// No need to handle move chunk failure.
+		if info.SendType == common.MoveSendType {
 			continue
 		}
-		pendingChunkQueue.Push(String(info.ChunkId))
+		enqueuePendingChunk(info.ChunkId, PendingReasonSendFailed)
 	}
 	for _, chunkId := range o.InvalidChunks {
-		dataNode.Chunks.Remove(chunkId)
+		dataNode.removeChunk(chunkId)
+	}
+	for _, info := range o.SizeInfos {
+		dataNode.setChunkSize(info.ChunkId, info.Size)
 	}
+	abandonedInfos := abandonStaleSends(dataNode)
 	nextChunkInfos := make([]ChunkSendInfo, 0, len(dataNode.FutureSendChunks))
 	Logger.Debugf("[DataNode = %s] FutureSendChunks: %v", dataNode.Id, dataNode.FutureSendChunks)
 	for info, i := range dataNode.FutureSendChunks {
@@ -191,23 +518,153 @@ func UpdateDataNode4Heartbeat(o HeartbeatOperation) ([]ChunkSendInfo, bool) {
 			dataNode.FutureSendChunks[info] = common.WaitToSend
 		}
 	}
-	return nextChunkInfos, true
+	return nextChunkInfos, abandonedInfos, true
+}
+
+// abandonStaleSends increases the attempt counter of every ChunkSendInfo which
+// has been sent to the DataNode. ChunkSendInfo whose result has not been reported
+// within the configured number of heartbeats will be removed from
+// FutureSendChunks and its Chunk will be put to pendingChunkQueue again. The
+// caller must hold updateMapLock.
+func abandonStaleSends(dataNode *DataNode) []ChunkSendInfo {
+	maxAttempts := defaultSendTimeoutHeartbeats
+	if viper.IsSet(MasterSendTimeoutHeartbeats) {
+		maxAttempts = viper.GetInt(MasterSendTimeoutHeartbeats)
+	}
+	abandonedInfos := make([]ChunkSendInfo, 0)
+	for info, state := range dataNode.FutureSendChunks {
+		if state != common.WaitToSend {
+			continue
+		}
+		if dataNode.SendAttempts == nil {
+			dataNode.SendAttempts = make(map[ChunkSendInfo]int)
+		}
+		dataNode.SendAttempts[info]++
+		if dataNode.SendAttempts[info] <= maxAttempts {
+			continue
+		}
+		// Deleting is never abandoned, otherwise the Chunk would leak on the
+		// DataNode, so it is sent again.
+		if info.SendType == common.DeleteSendType {
+			Logger.Warnf("Resend an unconfirmed chunk deleting, datanode id: %s, chunk id: %s", dataNode.Id,
+				info.ChunkId)
+			dataNode.FutureSendChunks[info] = common.WaitToInform
+			delete(dataNode.SendAttempts, info)
+			continue
+		}
+		Logger.Warnf("Abandon a chunk sending without result, datanode id: %s, chunk id: %s, target: %s",
+			dataNode.Id, info.ChunkId, info.DataNodeId)
+		delete(dataNode.FutureSendChunks, info)
+		delete(dataNode.SendAttempts, info)
+		delete(dataNode.SendRetries, info)
+		abandonedInfos = append(abandonedInfos, info)
+		// Same as failure, no need to handle move chunk.
+		if info.SendType != common.MoveSendType {
+			enqueuePendingChunk(info.ChunkId, PendingReasonSendTimeout)
+		}
+	}
+	return abandonedInfos
+}
+
+// updateClockSkew records the clock skew between the DataNode and master and
+// logs a warning if it exceeds the threshold. Both times are unix milliseconds,
+// and a zero reportTime means the DataNode does not report its time.
+func updateClockSkew(dataNode *DataNode, reportTime int64, receiveTime int64) {
+	if reportTime == 0 {
+		return
+	}
+	receive := dataNode.HeartbeatTime
+	if receiveTime != 0 {
+		receive = time.UnixMilli(receiveTime)
+	}
+	dataNode.ClockSkew = time.UnixMilli(reportTime).Sub(receive)
+	threshold := viper.GetInt(MasterClockSkewThreshold)
+	if threshold <= 0 {
+		threshold = defaultClockSkewThreshold
+	}
+	if dataNode.ClockSkew > time.Duration(threshold)*time.Millisecond ||
+		dataNode.ClockSkew < -time.Duration(threshold)*time.Millisecond {
+		Logger.Warnf("Clock of datanode is out of sync with master, datanode id: %s, skew: %s",
+			dataNode.Id, dataNode.ClockSkew)
+	}
+}
+
+// DataNodeDescription is the state of a DataNode copied for administration.
+type DataNodeDescription struct {
+	Id            string
+	Status        int
+	Address       string
+	ChunkNum      int
+	IOLoad        int
+	FullCapacity  int
+	UsedCapacity  int
+	HeartbeatTime time.Time
+	ClockSkew     time.Duration
+	Tags          map[string]string
+}
+
+// DescribeDataNode returns the state of the DataNode with the given id.
+func DescribeDataNode(id string) (*DataNodeDescription, error) {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	dataNode, ok := dataNodeMap[id]
+	if !ok {
+		return nil, fmt.Errorf("datanode not exist, datanode id: %s", id)
+	}
+	tags := make(map[string]string, len(dataNode.Tags))
+	for k, v := range dataNode.Tags {
+		tags[k] = v
+	}
+	return &DataNodeDescription{
+		Id:            dataNode.Id,
+		Status:        dataNode.Status,
+		Address:       dataNode.Address,
+		ChunkNum:      dataNode.Chunks.Cardinality(),
+		IOLoad:        dataNode.IOLoad,
+		FullCapacity:  dataNode.FullCapacity,
+		UsedCapacity:  dataNode.UsedCapacity,
+		HeartbeatTime: dataNode.HeartbeatTime,
+		ClockSkew:     dataNode.ClockSkew,
+		Tags:          tags,
+	}, nil
 }
 
 func GetSortedDataNodeIds(set set.Set) ([]string, []string) {
+	return GetReadReplicas(set, ClientLocality{})
+}
+
+// ClientLocality is where a client reading Chunk is. It is a hint given by the
+// client, and all fields can be empty.
+type ClientLocality struct {
+	// Address is the address of the client, only its host is used.
+	Address string
+	// Tags are labels of the client like Tags of DataNode, e.g. "rack=r1".
+	Tags map[string]string
+}
+
+// GetReadReplicas returns id and address of all alive DataNode in the set,
+// sorted by the locality distance to the client first and IOLoad then, so that
+// the client reads the nearest and least loaded replica first.
+func GetReadReplicas(set set.Set, locality ClientLocality) ([]string, []string) {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
 	updateMapLock.RLock()
 	defer updateMapLock.RUnlock()
 	setChan := set.Iter()
 
 	dns := make([]*DataNode, 0)
+	distances := make(map[string]int)
 	for id := range setChan {
 		if node, ok := dataNodeMap[id.(string)]; ok {
 			if node.Status == common.Alive {
 				dns = append(dns, dataNodeMap[id.(string)])
+				distances[node.Id] = getLocalityDistance(locality, node, topologyKeys)
 			}
 		}
 	}
 	sort.SliceStable(dns, func(i, j int) bool {
+		if distances[dns[i].Id] != distances[dns[j].Id] {
+			return distances[dns[i].Id] < distances[dns[j].Id]
+		}
 		if dns[i].IOLoad < dns[j].IOLoad {
 			return true
 		}
@@ -222,6 +679,31 @@ func GetSortedDataNodeIds(set set.Set) ([]string, []string) {
 	return ids, adds
 }
 
+// getLocalityDistance gets the distance between the client and the DataNode. It
+// is 0 if they are on the same host, otherwise it is 1 plus their distance in
+// topology, where a failure domain missing in the hint is regarded as
+// different. So the order is same node, same rack, same zone and then remote.
+func getLocalityDistance(locality ClientLocality, dataNode *DataNode, topologyKeys []string) int {
+	if locality.Address != "" && getHost(locality.Address) == getHost(dataNode.Address) {
+		return 0
+	}
+	for i, key := range topologyKeys {
+		if value, ok := locality.Tags[key]; !ok || value != dataNode.Tags[key] {
+			return len(topologyKeys) - i + 1
+		}
+	}
+	return 1
+}
+
+// getHost gets the host of the address. The address is returned as it is if it
+// has no port.
+func getHost(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
 func GetAliveDataNodeIds() []string {
 	updateMapLock.RLock()
 	defer updateMapLock.RUnlock()
@@ -267,7 +749,7 @@ func BatchAddChunks(infos []util.ChunkTaskResult) {
 	for _, info := range infos {
 		for _, id := range info.SuccessDataNodes {
 			if dataNode, ok := dataNodeMap[id]; ok {
-				dataNode.Chunks.Add(info.ChunkId)
+				dataNode.addChunk(info.ChunkId)
 			}
 		}
 	}
@@ -303,40 +785,352 @@ func DeConvChunkInfo(chunkSendInfos []ChunkSendInfo) []*pb.ChunkInfo {
 	return chunkInfos
 }
 
+// BeginChunkReport starts to track Chunk changed by heartbeats of a DataNode
+// which begins to stream its full chunk report, so that the report can be
+// reconciled correctly when the stream completes. A report in progress is
+// restarted. A quiescent DataNode can not report, because its Chunk may be
+// truncated or empty.
+func BeginChunkReport(dataNodeId string) error {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	dataNode, ok := dataNodeMap[dataNodeId]
+	if !ok {
+		return fmt.Errorf("datanode not exist, datanode id: %s", dataNodeId)
+	}
+	if dataNode.Quiescent {
+		return fmt.Errorf("datanode is quiescent, datanode id: %s", dataNodeId)
+	}
+	dataNode.reportAdded = set.NewSet()
+	dataNode.reportRemoved = set.NewSet()
+	dataNode.reportChunks = set.NewSet()
+	return nil
+}
+
+// AddChunkReport adds a part of the full chunk report of a DataNode to the
+// report in progress. The part is reconciled with the others by
+// FinishChunkReport. The report is dropped if the DataNode has become quiescent.
+func AddChunkReport(dataNodeId string, chunkIds []string) error {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	dataNode, ok := dataNodeMap[dataNodeId]
+	if !ok {
+		return fmt.Errorf("datanode not exist, datanode id: %s", dataNodeId)
+	}
+	if dataNode.reportAdded == nil {
+		return fmt.Errorf("chunk report has not begun, datanode id: %s", dataNodeId)
+	}
+	if dataNode.Quiescent {
+		dataNode.resetChunkReport()
+		return fmt.Errorf("datanode is quiescent, datanode id: %s", dataNodeId)
+	}
+	for _, id := range chunkIds {
+		dataNode.reportChunks.Add(id)
+	}
+	return nil
+}
+
+// AbortChunkReport drops the chunk report of a DataNode in progress. It does
+// nothing if no report is in progress or the DataNode has been removed.
+func AbortChunkReport(dataNodeId string) error {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	if dataNode, ok := dataNodeMap[dataNodeId]; ok {
+		dataNode.resetChunkReport()
+		Logger.Infof("Abort chunk report, datanode id: %s", dataNodeId)
+	}
+	return nil
+}
+
+// resetChunkReport clears the tracking of the chunk report in progress. The
+// caller must hold updateMapLock.
+func (d *DataNode) resetChunkReport() {
+	d.reportAdded = nil
+	d.reportRemoved = nil
+	d.reportChunks = nil
+}
+
+// IsChunkReportRequested checks whether a full chunk report of the DataNode is
+// requested because it rejoins after being Waiting. The report of a quiescent
+// DataNode is not requested until it is re-activated.
+func IsChunkReportRequested(dataNodeId string) bool {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	dataNode, ok := dataNodeMap[dataNodeId]
+	return ok && dataNode.reportRequested && !dataNode.Quiescent
+}
+
+// FinishChunkReport reconciles the full chunk report of a DataNode with the
+// view of master. Chunk changed by heartbeats after the report began override
+// the report. Delete-pending Chunk missing from the report are confirmed to be
+// deleted, and the others stay delete-pending. Then added Chunk get the DataNode as a replica, and removed Chunk lose
+// the replica and are put to pendingChunkQueue. Chunk which do not exist in
+// master are returned to be deleted by the DataNode, and ids which are
+// definitely absent are filtered by chunkBloom first. The given chunkIds are
+// reconciled together with the parts added by AddChunkReport. The report is
+// dropped if the DataNode has become quiescent, and it is requested again
+// after the DataNode is re-activated. now must be the time of the leader
+// carried by the operation, which is used if removed Chunk are deferred. It
+// returns id of added, removed and unknown Chunk.
+func FinishChunkReport(dataNodeId string, chunkIds []string, now time.Time) ([]string, []string, []string,
+	error) {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	dataNode, ok := dataNodeMap[dataNodeId]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("datanode not exist, datanode id: %s", dataNodeId)
+	}
+	if dataNode.reportAdded == nil {
+		return nil, nil, nil, fmt.Errorf("chunk report has not begun, datanode id: %s", dataNodeId)
+	}
+	if dataNode.Quiescent {
+		dataNode.resetChunkReport()
+		return nil, nil, nil, fmt.Errorf("datanode is quiescent, datanode id: %s", dataNodeId)
+	}
+	deleting := set.NewSet()
+	for info := range dataNode.FutureSendChunks {
+		if info.SendType == common.DeleteSendType {
+			deleting.Add(info.ChunkId)
+		}
+	}
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	reported := set.NewSet()
+	stillDeleting := set.NewSet()
+	unknown := make([]string, 0)
+	filter := chunkBloom.Load().(*BloomFilter)
+	if dataNode.reportChunks != nil {
+		chunkIds = append(set2SortedStrings(dataNode.reportChunks), chunkIds...)
+	}
+	for _, id := range chunkIds {
+		if deleting.Contains(id) {
+			stillDeleting.Add(id)
+			continue
+		}
+		if dataNode.reportRemoved.Contains(id) {
+			continue
+		}
+		if !filter.MayContain(id) {
+			unknown = append(unknown, id)
+			continue
+		}
+		chunk, ok := chunksMap[id]
+		if !ok {
+			unknown = append(unknown, id)
+			continue
+		}
+		if chunk.isQuarantinedOn(dataNodeId) {
+			continue
+		}
+		reported.Add(id)
+	}
+	for _, id := range set2SortedStrings(deleting.Difference(stillDeleting)) {
+		delete(dataNode.FutureSendChunks, ChunkSendInfo{ChunkId: id, SendType: common.DeleteSendType})
+		dataNode.removeChunk(id)
+		Logger.Infof("Chunk report confirms a chunk deleting, datanode id: %s, chunk id: %s", dataNodeId, id)
+	}
+	reported = reported.Union(dataNode.reportAdded)
+	added := set2SortedStrings(reported.Difference(dataNode.Chunks))
+	removed := set2SortedStrings(dataNode.Chunks.Difference(reported).Difference(stillDeleting))
+	for _, id := range added {
+		if chunk, ok := chunksMap[id]; ok {
+			chunk.dataNodes.Add(dataNodeId)
+			chunk.pendingDataNodes.Remove(dataNodeId)
+		}
+	}
+	lostReplicas := make([]string, 0, len(removed))
+	for _, id := range removed {
+		if chunk, ok := chunksMap[id]; ok {
+			chunk.dataNodes.Remove(dataNodeId)
+			lostReplicas = append(lostReplicas, id)
+		}
+	}
+	reassignPrimaries(dataNodeId, lostReplicas)
+	pushPendingChunks(lostReplicas, now)
+	dataNode.Chunks = reported
+	dataNode.recountChunks()
+	dataNode.resetChunkReport()
+	dataNode.reportRequested = false
+	Logger.Infof("Reconcile chunk report, datanode id: %s, added: %d, removed: %d, unknown: %d", dataNodeId,
+		len(added), len(removed), len(unknown))
+	return added, removed, unknown, nil
+}
+
 // DegradeDataNode degrade a DataNode based on given stage. If DataNode is dead,
 // it will remove DataNode from dataNodeMap and put all Chunk's id in Chunks and
 // FutureSendChunks of the DataNode to pendingChunkQueue so that system can make
-// up the missing copies later.
-func DegradeDataNode(dataNodeId string, stage int) {
+// up the missing copies later. Chunk in Chunks are staged and put to
+// pendingChunkQueue gradually over the configured window, except that lost
+// fragments of erasure coded Chunk are put to lostFragmentQueue. The window is
+// counted from now. It returns false if the DataNode does not exist.
+func DegradeDataNode(dataNodeId string, stage int, now time.Time) bool {
 	Logger.Infof("Start to degrade, datanode id: %s, stage: %v", dataNodeId, stage)
 	updateMapLock.Lock()
 	defer updateMapLock.Unlock()
 	dataNode, ok := dataNodeMap[dataNodeId]
 	if !ok {
-		return
+		return false
 	}
 	if stage == common.Degrade2Waiting {
 		dataNode.Status = common.Waiting
-		return
+		return true
 	}
-	delete(dataNodeMap, dataNodeId)
+	removeDeadDataNode(dataNode, now)
+	Logger.Infof("Success to degrade, datanode id: %s, stage: %v", dataNodeId, stage)
+	return true
+}
+
+// ForceRemoveDataNode removes a DataNode as dead immediately whatever its
+// heartbeat state is. It is used when the DataNode will never come back, so
+// there is no need to wait for the dead timeout.
+func ForceRemoveDataNode(dataNodeId string, now time.Time) error {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	dataNode, ok := dataNodeMap[dataNodeId]
+	if !ok {
+		return fmt.Errorf("datanode not exist, datanode id: %s", dataNodeId)
+	}
+	Logger.Infof("Force to remove datanode, datanode id: %s, status: %v", dataNodeId, dataNode.Status)
+	removeDeadDataNode(dataNode, now)
+	return nil
+}
+
+// ReconcileChunkLocations cross-checks Chunks of each DataNode with dataNodes of
+// each Chunk and repairs the drift between them, taking dataNodes of Chunk as
+// the authority. A Chunk listed by a DataNode but not by the Chunk is removed
+// from the DataNode, unless the DataNode has been told to delete it. A DataNode
+// listed by a Chunk but not listing the Chunk gets it back, or is removed from
+// the Chunk if the DataNode does not exist, and then the Chunk is put to be
+// replicated again. Chunk which do not exist are left to the chunk check, and
+// locations on a quiescent DataNode are left until it is re-activated. At
+// last, the chunk counters of each DataNode are checked against its Chunks. now
+// must be the time of the leader carried by the operation, which is used if
+// the Chunk to be replicated again are deferred. It returns the number of
+// repairs of locations.
+func ReconcileChunkLocations(now time.Time) int {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	repaired := 0
+	dataNodeIds := make([]string, 0, len(dataNodeMap))
+	for id := range dataNodeMap {
+		dataNodeIds = append(dataNodeIds, id)
+	}
+	sort.Strings(dataNodeIds)
+	for _, dataNodeId := range dataNodeIds {
+		dataNode := dataNodeMap[dataNodeId]
+		if dataNode.Quiescent {
+			continue
+		}
+		deleting := set.NewSet()
+		for info := range dataNode.FutureSendChunks {
+			if info.SendType == common.DeleteSendType {
+				deleting.Add(info.ChunkId)
+			}
+		}
+		for _, chunkId := range set2SortedStrings(dataNode.Chunks) {
+			chunk, ok := chunksMap[chunkId]
+			if !ok || chunk.dataNodes.Contains(dataNodeId) || deleting.Contains(chunkId) {
+				continue
+			}
+			Logger.Warnf("Repair chunk location, datanode lists a chunk which does not list it, datanode id: %s, "+
+				"chunk id: %s", dataNodeId, chunkId)
+			dataNode.removeChunk(chunkId)
+			chunkLocationRepairCountMonitor.WithLabelValues(repairRemoveFromDataNode).Inc()
+			repaired++
+		}
+	}
+	chunkIds := make([]string, 0, len(chunksMap))
+	for id := range chunksMap {
+		chunkIds = append(chunkIds, id)
+	}
+	sort.Strings(chunkIds)
+	danglingIds := make([]string, 0)
+	for _, chunkId := range chunkIds {
+		chunk := chunksMap[chunkId]
+		for _, dataNodeId := range set2SortedStrings(chunk.dataNodes) {
+			dataNode, ok := dataNodeMap[dataNodeId]
+			if ok && (dataNode.Chunks.Contains(chunkId) || dataNode.Quiescent) {
+				continue
+			}
+			if ok {
+				Logger.Warnf("Repair chunk location, chunk lists a datanode which does not list it, datanode id: %s, "+
+					"chunk id: %s", dataNodeId, chunkId)
+				dataNode.addChunk(chunkId)
+				chunkLocationRepairCountMonitor.WithLabelValues(repairAddToDataNode).Inc()
+			} else {
+				Logger.Warnf("Repair chunk location, chunk lists a datanode which does not exist, datanode id: %s, "+
+					"chunk id: %s", dataNodeId, chunkId)
+				chunk.dataNodes.Remove(dataNodeId)
+				danglingIds = append(danglingIds, chunkId)
+				chunkLocationRepairCountMonitor.WithLabelValues(repairRemoveDanglingDataNode).Inc()
+			}
+			repaired++
+		}
+	}
+	for _, dataNodeId := range dataNodeIds {
+		dataNode, ok := dataNodeMap[dataNodeId]
+		if !ok || dataNode.isChunkCountConsistent() {
+			continue
+		}
+		Logger.Warnf("Repair chunk counters of datanode, datanode id: %s, chunk num: %d, expect: %d",
+			dataNodeId, dataNode.chunkNum, dataNode.Chunks.Cardinality())
+		dataNode.recountChunks()
+		chunkLocationRepairCountMonitor.WithLabelValues(repairRecountDataNode).Inc()
+	}
+	pushPendingChunks(danglingIds, now)
+	if repaired != 0 {
+		Logger.Warnf("Reconcile chunk locations, repaired: %d", repaired)
+	}
+	return repaired
+}
+
+// removeDeadDataNode removes a dead DataNode from dataNodeMap and puts its Chunk
+// to be replicated again. The caller must hold updateMapLock.
+func removeDeadDataNode(dataNode *DataNode, now time.Time) {
+	delete(dataNodeMap, dataNode.Id)
+	keepFlapRecord(dataNode)
+	forgetQuarantinedReplicas(dataNode.Id)
+	dataNodeChunkCountMonitor.DeleteLabelValues(dataNode.Id)
+	dataNodeChunkBytesMonitor.DeleteLabelValues(dataNode.Id)
+	evacuateDataNode(dataNode, now)
+}
+
+// evacuateDataNode puts all Chunk stored or being sent by the DataNode to be
+// replicated again without using the DataNode. Chunk are staged from now. The
+// caller must hold updateMapLock.
+func evacuateDataNode(dataNode *DataNode, now time.Time) {
 	Logger.Debugf("Degrade datanode chunks is: %s, len is: %v", dataNode.Chunks.String(),
 		dataNode.Chunks.Cardinality())
+	chunkIds := make([]string, 0, dataNode.Chunks.Cardinality())
 	for _, chunkId := range dataNode.Chunks.ToSlice() {
-		pendingChunkQueue.Push(String(chunkId.(string)))
+		chunkIds = append(chunkIds, chunkId.(string))
 	}
-	BatchClearDataNode(dataNode.Chunks.ToSlice(), dataNodeId)
+	sort.Strings(chunkIds)
+	// Replicas on the DataNode are cleared first, so that endangered
+	// Chunk can be found when they are staged and the primary can be moved to
+	// a surviving replica.
+	BatchClearDataNode(dataNode.Chunks.ToSlice(), dataNode.Id)
+	updateChunksLock.Lock()
+	reassignPrimaries(dataNode.Id, chunkIds)
+	updateChunksLock.Unlock()
+	chunkIds = markFragmentsLost(dataNode.Id, chunkIds)
+	window := time.Duration(viper.GetInt(MasterDegradeRequeueWindow)) * time.Second
+	StageChunks(dataNode.Address, chunkIds, window, now)
 	for info := range dataNode.FutureSendChunks {
-		pendingChunkQueue.Push(String(info.ChunkId))
+		enqueuePendingChunk(info.ChunkId, PendingReasonSendFailed)
 	}
-	Logger.Infof("Success to degrade, datanode id: %s, stage: %v", dataNodeId, stage)
 }
 
 // AllocateDataNodes Select several DataNode to store a Chunk. DataNode allocation
 // strategy is:
 // 1. Reload dataNodeHeap with all DataNode.
 // 2. Select the first "ReplicaNum" dataNodes with the least number of memory Chunk.
-func AllocateDataNodes() []*DataNode {
+// Fewer than "ReplicaNum" DataNode are selected if there are not enough alive
+// DataNode, so it returns the number of selected DataNode with them and callers
+// should never assume the length. It acquires updateMapLock and then
+// updateHeapLock, so the caller must hold neither of them.
+func AllocateDataNodes() ([]*DataNode, int) {
 	updateMapLock.RLock()
 	updateHeapLock.Lock()
 	dataNodeHeap.dns = dataNodeHeap.dns[0:0]
@@ -350,28 +1144,31 @@ func AllocateDataNodes() []*DataNode {
 	copy(allDataNodes, dataNodeHeap.dns)
 	updateHeapLock.Unlock()
 	updateMapLock.RUnlock()
-	return allDataNodes
+	if replicaNum := viper.GetInt(common.ReplicaNum); len(allDataNodes) < replicaNum {
+		Logger.Warnf("Replica target can not be met, alive datanode num: %d, replica num: %d",
+			len(allDataNodes), replicaNum)
+	}
+	return allDataNodes, len(allDataNodes)
 }
 
 // BatchAllocateDataNodes allocate DataNode for a batch of Chunk. Each Chunk will
-// get ReplicaNum DataNode to store it.
-func BatchAllocateDataNodes(chunkNum int) [][]*DataNode {
+// get replicaNum DataNode to store it. Only DataNode whose Tags match the given
+// constraint will be candidates.
+func BatchAllocateDataNodes(chunkNum int, replicaNum int, constraint PlacementConstraint) [][]*DataNode {
 	updateMapLock.RLock()
 	updateHeapLock.Lock()
 	processMap := make(map[*DataNode]int)
 	allDataNodes := make([][]*DataNode, chunkNum)
 	for _, node := range dataNodeMap {
-		if node.Status == common.Alive {
+		if node.Status == common.Alive && constraint.Match(node.Tags) {
 			processMap[node] = 0
 		}
 	}
 	for i := 0; i < chunkNum; i++ {
 		// Todo if Chunk num is same, choose the DataNode with less IOLoad.
 		dataNodeHeap.dns = dataNodeHeap.dns[0:0]
-		for _, node := range dataNodeMap {
-			if node.Status == common.Alive {
-				adjust4batch(node, processMap)
-			}
+		for node := range processMap {
+			adjust4batch(node, processMap, replicaNum)
 		}
 		currentDataNodes := make([]*DataNode, dataNodeHeap.Len())
 		copy(currentDataNodes, dataNodeHeap.dns)
@@ -385,8 +1182,56 @@ func BatchAllocateDataNodes(chunkNum int) [][]*DataNode {
 	return allDataNodes
 }
 
+// MergeClientPlacement uses the DataNode given by client for each Chunk instead
+// of the allocated ones. A given DataNode is ignored if it is not alive, does
+// not match the constraint, is given twice for the same Chunk or will not be
+// storable after storing the Chunk. Replicas which are not filled by the given
+// DataNode are filled by the allocated DataNode in order, up to replicaNum.
+func MergeClientPlacement(placement [][]string, allocated [][]*DataNode,
+	constraint PlacementConstraint, replicaNum int) [][]*DataNode {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	// processMap contains how many bytes have been directed to each DataNode by
+	// client in this request.
+	processMap := make(map[*DataNode]int)
+	res := make([][]*DataNode, len(allocated))
+	for i := range allocated {
+		chosen := make([]*DataNode, 0, replicaNum)
+		chosenIds := set.NewSet()
+		if i < len(placement) {
+			for _, id := range placement[i] {
+				if len(chosen) == replicaNum {
+					break
+				}
+				dataNode, ok := dataNodeMap[id]
+				if !ok || dataNode.Status != common.Alive || !constraint.Match(dataNode.Tags) ||
+					chosenIds.Contains(id) ||
+					dataNode.CalUsage(processMap[dataNode]+common.ChunkSize) >= viper.GetInt(common.StorableThreshold) {
+					Logger.Warnf("Ignore illegal datanode given by client, chunk index: %d, datanode id: %s", i, id)
+					continue
+				}
+				processMap[dataNode] += common.ChunkSize
+				chosen = append(chosen, dataNode)
+				chosenIds.Add(id)
+			}
+		}
+		for _, dataNode := range allocated[i] {
+			if len(chosen) == replicaNum {
+				break
+			}
+			if !chosenIds.Contains(dataNode.Id) {
+				chosen = append(chosen, dataNode)
+				chosenIds.Add(dataNode.Id)
+			}
+		}
+		res[i] = chosen
+	}
+	return res
+}
+
 // adjust tries to put a DataNode into dataNodeHeap. If this DataNode meets the
 // requirements of dataNodeHeap, put it into dataNodeHeap, otherwise do nothing.
+// The caller must hold updateMapLock and updateHeapLock.
 func adjust(node *DataNode) {
 	if dataNodeHeap.Len() < viper.GetInt(common.ReplicaNum) {
 		heap.Push(&dataNodeHeap, node)
@@ -404,9 +1249,11 @@ func adjust(node *DataNode) {
 // DataNode) need to be considered. It tries to put a DataNode into dataNodeHeap
 // considering the processMap given. The processMap contains how many Chunk have
 // been allocated to those alive DataNode until now. If this DataNode meets the
-// requirements of dataNodeHeap, put it into dataNodeHeap, otherwise do nothing.
-func adjust4batch(node *DataNode, processMap map[*DataNode]int) {
-	if dataNodeHeap.Len() < viper.GetInt(common.ReplicaNum) {
+// requirements of dataNodeHeap with capacity replicaNum, put it into
+// dataNodeHeap, otherwise do nothing. The caller must hold updateMapLock and
+// updateHeapLock.
+func adjust4batch(node *DataNode, processMap map[*DataNode]int, replicaNum int) {
+	if dataNodeHeap.Len() < replicaNum {
 		heap.Push(&dataNodeHeap, node)
 	} else {
 		topNode := heap.Pop(&dataNodeHeap).(*DataNode)
@@ -422,18 +1269,26 @@ func (d *DataNode) CalUsage(temp int) int {
 	return CalUsage(d.UsedCapacity, d.FullCapacity, temp)
 }
 
+// CalAvgUsage calculates the average usage of all DataNode. It acquires
+// updateMapLock itself, so the caller must not hold it.
 func CalAvgUsage() int {
 	updateMapLock.RLock()
 	defer updateMapLock.RUnlock()
+	return calAvgUsage()
+}
+
+// calAvgUsage is the lock-free version of CalAvgUsage. The caller must hold
+// updateMapLock.
+func calAvgUsage() int {
 	usedSum := 0
 	fullSum := 0
-	if len(dataNodeMap) == 0 {
-		return 0
-	}
 	for _, node := range dataNodeMap {
 		usedSum += node.UsedCapacity
 		fullSum += node.FullCapacity
 	}
+	if fullSum == 0 {
+		return 0
+	}
 	return usedSum * 100 / fullSum
 }
 
@@ -442,13 +1297,46 @@ func CalUsage(usedCapacity int, fullCapacity int, temp int) int {
 }
 
 // PersistDataNodes writes all DataNode in dataNodeMap to the sink for persistence.
+// The caller must hold updateMapLock.
 func PersistDataNodes(sink raft.SnapshotSink) error {
+	if err := writeSectionHeader(sink); err != nil {
+		return err
+	}
 	for _, dataNode := range dataNodeMap {
 		_, err := sink.Write([]byte(dataNode.String()))
 		if err != nil {
 			return err
 		}
 	}
+	for _, dataNode := range dataNodeMap {
+		if dataNode.reportAdded == nil {
+			continue
+		}
+		_, err := sink.Write([]byte(reportRecord2String(dataNode)))
+		if err != nil {
+			return err
+		}
+	}
+	for _, dataNode := range dataNodeMap {
+		if len(dataNode.chunkSizes) == 0 {
+			continue
+		}
+		_, err := sink.Write([]byte(sizeRecord2String(dataNode)))
+		if err != nil {
+			return err
+		}
+	}
+	addresses := make([]string, 0, len(removedFlapRecords))
+	for address := range removedFlapRecords {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		_, err := sink.Write([]byte(flapRecord2String(address, removedFlapRecords[address])))
+		if err != nil {
+			return err
+		}
+	}
 	_, err := sink.Write([]byte(common.SnapshotDelimiter))
 	if err != nil {
 		return err
@@ -456,67 +1344,305 @@ func PersistDataNodes(sink raft.SnapshotSink) error {
 	return nil
 }
 
-// RestoreDataNodes reads all DataNode from the buf and puts them into dataNodeMap.
+// RestoreDataNodes reads all DataNode from the buf and puts them into
+// dataNodeMap, and the flapRecord of removed DataNode into removedFlapRecords.
+// The chunk report in progress and the size of Chunk are restored to their
+// DataNode, which is written before them.
 func RestoreDataNodes(buf *bufio.Scanner) error {
-	var (
-		chunks = set.NewSet()
-	)
-
-	for buf.Scan() {
-		line := buf.Text()
-		if line == common.SnapshotDelimiter {
+	removedFlapRecords = make(map[string]*flapRecord)
+	return scanSection(buf, sectionDataNodes, func(line string) error {
+		if strings.HasPrefix(line, reportRecordPrefix) {
+			record, err := parseReportRecord(line)
+			if err != nil {
+				return err
+			}
+			dataNode, ok := dataNodeMap[record.Id]
+			if !ok {
+				return fmt.Errorf("chunk report of unknown datanode, datanode id: %s", record.Id)
+			}
+			dataNode.reportAdded = record.reportAdded
+			dataNode.reportRemoved = record.reportRemoved
+			dataNode.reportChunks = record.reportChunks
 			return nil
 		}
-		data := strings.Split(line, "$")
-
-		chunksLen := len(data[dnChunksIdx])
-		chunksData := data[dnChunksIdx][1 : chunksLen-1]
-		for _, chunkId := range strings.Split(chunksData, " ") {
-			chunks.Add(chunkId)
-		}
-		heartbeatTime, _ := time.Parse(common.LogFileTimeFormat, data[heartbeatIdx])
-		status, _ := strconv.Atoi(data[statusIdx])
-		ioLoad, _ := strconv.Atoi(data[ioLoadIdx])
-		fullCapacity, _ := strconv.Atoi(data[fullCapacityIdx])
-		usedCapacity, _ := strconv.Atoi(data[usedCapacityIdx])
-		fsChunksLen := len(data[fsChunksIdx])
-		futureSendChunks := make(map[ChunkSendInfo]int, fsChunksLen)
-		fsChunksData := data[dnChunksIdx][1 : chunksLen-1]
-		for _, s := range strings.Split(fsChunksData, " ") {
-			fsChunk := strings.Split(s, "@")
-			sendType, _ := strconv.Atoi(fsChunk[2])
-			state, _ := strconv.Atoi(fsChunk[3])
-			futureSendChunks[ChunkSendInfo{
-				ChunkId:    fsChunk[0],
-				DataNodeId: fsChunk[1],
-				SendType:   sendType,
-			}] = state
-		}
-		dataNodeMap[data[dataNodeIdIdx]] = &DataNode{
-			Id:               data[dataNodeIdIdx],
-			Status:           status,
-			Address:          data[addressIdx],
-			Chunks:           chunks,
-			IOLoad:           ioLoad,
-			FullCapacity:     fullCapacity,
-			UsedCapacity:     usedCapacity,
-			FutureSendChunks: futureSendChunks,
-			HeartbeatTime:    heartbeatTime,
+		if strings.HasPrefix(line, sizeRecordPrefix) {
+			record, err := parseSizeRecord(line)
+			if err != nil {
+				return err
+			}
+			dataNode, ok := dataNodeMap[record.Id]
+			if !ok {
+				return fmt.Errorf("chunk sizes of unknown datanode, datanode id: %s", record.Id)
+			}
+			dataNode.chunkSizes = record.chunkSizes
+			dataNode.recountChunks()
+			return nil
 		}
+		if strings.HasPrefix(line, flapRecordPrefix) {
+			address, record, err := parseFlapRecord(line)
+			if err != nil {
+				return err
+			}
+			removedFlapRecords[address] = record
+			return nil
+		}
+		dataNode, err := parseDataNode(line)
+		if err != nil {
+			return err
+		}
+		dataNodeMap[dataNode.Id] = dataNode
+		return nil
+	})
+}
+
+// ValidateDataNodes parses the datanodes section of a snapshot like
+// RestoreDataNodes, but only reports what it finds without changing
+// dataNodeMap.
+func ValidateDataNodes(buf *bufio.Scanner) *SectionReport {
+	return validateSection(buf, sectionDataNodes, func(line string) error {
+		if strings.HasPrefix(line, reportRecordPrefix) {
+			_, err := parseReportRecord(line)
+			return err
+		}
+		if strings.HasPrefix(line, sizeRecordPrefix) {
+			_, err := parseSizeRecord(line)
+			return err
+		}
+		if strings.HasPrefix(line, flapRecordPrefix) {
+			_, _, err := parseFlapRecord(line)
+			return err
+		}
+		_, err := parseDataNode(line)
+		return err
+	})
+}
+
+// reportRecord2String converts the chunk report in progress of a DataNode to a
+// line in the datanodes section of the snapshot.
+func reportRecord2String(d *DataNode) string {
+	return fmt.Sprintf("%s%s$%v$%v$%v\n", reportRecordPrefix, d.Id, set2SortedStrings(d.reportAdded),
+		set2SortedStrings(d.reportRemoved), set2SortedStrings(d.reportChunks))
+}
+
+// parseReportRecord parses the chunk report in progress from the line created
+// by reportRecord2String. Only Id and the report tracking of the returned
+// DataNode are set.
+func parseReportRecord(line string) (*DataNode, error) {
+	data := strings.Split(strings.TrimPrefix(line, reportRecordPrefix), common.DollarDelimiter)
+	if len(data) != 4 || data[0] == "" {
+		return nil, fmt.Errorf("illegal chunk report record: %q", line)
 	}
-	return nil
+	sets := make([]set.Set, 3)
+	for i := range sets {
+		s, err := parseStringSetField(data[i+1])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = s
+	}
+	return &DataNode{Id: data[0], reportAdded: sets[0], reportRemoved: sets[1], reportChunks: sets[2]}, nil
+}
+
+// sizeRecord2String converts the size of Chunk reported by a DataNode to a line
+// in the datanodes section of the snapshot.
+func sizeRecord2String(d *DataNode) string {
+	sizes := make(map[string]string, len(d.chunkSizes))
+	for chunkId, size := range d.chunkSizes {
+		sizes[chunkId] = strconv.FormatInt(size, 10)
+	}
+	return fmt.Sprintf("%s%s$%s\n", sizeRecordPrefix, d.Id, tags2String(sizes))
+}
+
+// parseSizeRecord parses the size of Chunk from the line created by
+// sizeRecord2String. Only Id and chunkSizes of the returned DataNode are set.
+func parseSizeRecord(line string) (*DataNode, error) {
+	data := strings.Split(strings.TrimPrefix(line, sizeRecordPrefix), common.DollarDelimiter)
+	if len(data) != 2 || data[0] == "" {
+		return nil, fmt.Errorf("illegal chunk size record: %q", line)
+	}
+	chunkSizes := make(map[string]int64)
+	for chunkId, s := range string2Tags(data[1]) {
+		size, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("illegal chunk size, chunk id: %s, size: %q", chunkId, s)
+		}
+		chunkSizes[chunkId] = size
+	}
+	return &DataNode{Id: data[0], chunkSizes: chunkSizes}, nil
 }
 
-// IsNeed2Expand finds out whether to expand.
+// parseDataNode parses a DataNode from the string created by DataNode.String.
+func parseDataNode(line string) (*DataNode, error) {
+	data := strings.Split(line, common.DollarDelimiter)
+	if len(data) <= heartbeatIdx || len(data) > flapTimesIdx+1 {
+		return nil, fmt.Errorf("illegal number of fields, expect %d to %d, got %d",
+			heartbeatIdx+1, flapTimesIdx+1, len(data))
+	}
+	if data[dataNodeIdIdx] == "" {
+		return nil, fmt.Errorf("datanode id is empty")
+	}
+	chunks, err := parseStringSetField(data[dnChunksIdx])
+	if err != nil {
+		return nil, err
+	}
+	fsChunks, err := parseStringSetField(data[fsChunksIdx])
+	if err != nil {
+		return nil, err
+	}
+	heartbeatTime, err := time.Parse(common.LogFileTimeFormat, data[heartbeatIdx])
+	if err != nil {
+		return nil, err
+	}
+	status, err := strconv.Atoi(data[statusIdx])
+	if err != nil {
+		return nil, err
+	}
+	ioLoad, err := strconv.Atoi(data[ioLoadIdx])
+	if err != nil {
+		return nil, err
+	}
+	fullCapacity, err := strconv.Atoi(data[fullCapacityIdx])
+	if err != nil {
+		return nil, err
+	}
+	usedCapacity, err := strconv.Atoi(data[usedCapacityIdx])
+	if err != nil {
+		return nil, err
+	}
+	futureSendChunks := make(map[ChunkSendInfo]int)
+	sendAttempts := make(map[ChunkSendInfo]int)
+	sendRetries := make(map[ChunkSendInfo]int)
+	for fsChunkData := range fsChunks.Iter() {
+		fsChunk := strings.Split(fsChunkData.(string), "@")
+		if len(fsChunk) < 4 {
+			continue
+		}
+		sendType, _ := strconv.Atoi(fsChunk[2])
+		state, _ := strconv.Atoi(fsChunk[3])
+		info := ChunkSendInfo{
+			ChunkId:    fsChunk[0],
+			DataNodeId: fsChunk[1],
+			SendType:   sendType,
+		}
+		futureSendChunks[info] = state
+		// The attempt counter is absent in snapshot of old version.
+		if len(fsChunk) > 4 {
+			if attempts, _ := strconv.Atoi(fsChunk[4]); attempts != 0 {
+				sendAttempts[info] = attempts
+			}
+		}
+		if len(fsChunk) > 5 {
+			if retries, _ := strconv.Atoi(fsChunk[5]); retries != 0 {
+				sendRetries[info] = retries
+			}
+		}
+	}
+	dataNode := &DataNode{
+		Id:               data[dataNodeIdIdx],
+		Status:           status,
+		Address:          data[addressIdx],
+		Chunks:           chunks,
+		IOLoad:           ioLoad,
+		FullCapacity:     fullCapacity,
+		UsedCapacity:     usedCapacity,
+		FutureSendChunks: futureSendChunks,
+		SendAttempts:     sendAttempts,
+		SendRetries:      sendRetries,
+		HeartbeatTime:    heartbeatTime,
+	}
+	dataNode.recountChunks()
+	if len(data) > tagsIdx {
+		dataNode.Tags = string2Tags(data[tagsIdx])
+	}
+	if len(data) > quiescentIdx {
+		dataNode.Quiescent, err = strconv.ParseBool(data[quiescentIdx])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > flapTimesIdx {
+		dataNode.FlapTimes, err = parseFlapTimes(data[flapTimesIdx])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dataNode, nil
+}
+
+// ClusterCapacity is the aggregate capacity of all alive DataNode. Use bytes
+// as the unit of measurement.
+type ClusterCapacity struct {
+	FullCapacity int
+	UsedCapacity int
+	FreeCapacity int
+}
+
+// GetClusterCapacity aggregates the capacity reported by heartbeat of all alive
+// DataNode.
+func GetClusterCapacity() ClusterCapacity {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	return calClusterCapacity()
+}
+
+// calClusterCapacity aggregates the capacity of all alive DataNode. The caller
+// must hold updateMapLock.
+func calClusterCapacity() ClusterCapacity {
+	capacity := ClusterCapacity{}
+	for _, node := range dataNodeMap {
+		if node.Status == common.Alive {
+			capacity.FullCapacity += node.FullCapacity
+			capacity.UsedCapacity += node.UsedCapacity
+		}
+	}
+	capacity.FreeCapacity = capacity.FullCapacity - capacity.UsedCapacity
+	return capacity
+}
+
+// IsNeed2ExpandByBytes finds out whether the cluster should add more DataNode
+// because the percentage of free space of the cluster is below the floor.
+func IsNeed2ExpandByBytes() bool {
+	return isNeed2ExpandByBytes(GetClusterCapacity())
+}
+
+func isNeed2ExpandByBytes(capacity ClusterCapacity) bool {
+	floor := viper.GetInt(MasterExpandFreeSpaceFloor)
+	if floor <= 0 {
+		floor = defaultExpandFreeSpaceFloor
+	}
+	if capacity.FullCapacity == 0 {
+		return false
+	}
+	return capacity.FreeCapacity*100/capacity.FullCapacity < floor
+}
+
+// IsNeed2Expand finds out whether to expand. It acquires updateMapLock itself,
+// so the caller must not hold it.
 func IsNeed2Expand(usedCapacity int, fullCapacity int) bool {
-	avgUsage := CalAvgUsage()
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	return isNeed2Expand(usedCapacity, fullCapacity)
+}
+
+// isNeed2Expand is the lock-free version of IsNeed2Expand. The caller must hold
+// updateMapLock.
+func isNeed2Expand(usedCapacity int, fullCapacity int) bool {
+	avgUsage := calAvgUsage()
 	currentUsage := CalUsage(usedCapacity, fullCapacity, 0)
 	return avgUsage-currentUsage > viper.GetInt(common.ExpandThreshold)
 }
 
+// GetAvgChunkNum calculates the average number of Chunk stored in each DataNode.
+// It acquires updateMapLock itself, so the caller must not hold it.
 func GetAvgChunkNum() int {
 	updateMapLock.RLock()
 	defer updateMapLock.RUnlock()
+	return calAvgChunkNum()
+}
+
+// calAvgChunkNum is the lock-free version of GetAvgChunkNum. The caller must
+// hold updateMapLock.
+func calAvgChunkNum() int {
 	if len(dataNodeMap) == 0 {
 		return 0
 	}
@@ -524,16 +1650,190 @@ func GetAvgChunkNum() int {
 	for _, node := range dataNodeMap {
 		count += node.Chunks.Cardinality()
 	}
-	avgChunkNum := count / len(dataNodeMap)
-	return avgChunkNum
+	return count / len(dataNodeMap)
 }
 
 // DoExpand gets the chunk copied according to this new dataNode.
 func DoExpand(dataNode *DataNode) int {
 	Logger.Infof("Start to expand with dataNode %s", dataNode.Id)
+	expandOperation := newExpandOperation(dataNode)
+	data := getData4Apply(expandOperation, common.OperationExpand)
+	GlobalMasterHandler.Raft.Apply(data, 5*time.Second)
+	Logger.Infof("Success to expand with dataNode %s", dataNode.Id)
+	return len(expandOperation.ChunkIds)
+}
+
+// newExpandOperation plans the expansion with the given DataNode without
+// applying it.
+func newExpandOperation(dataNode *DataNode) *ExpandOperation {
+	pendingMap, pendingChunks := getExpandPlan(dataNode)
+	return &ExpandOperation{
+		Id:           util.GenerateUUIDString(),
+		SenderPlan:   pendingMap,
+		ReceiverPlan: dataNode.Id,
+		ChunkIds:     pendingChunks,
+	}
+}
+
+// RebalanceEstimate is the cost of a rebalance which has not been started.
+type RebalanceEstimate struct {
+	// ChunkMoves is the number of Chunk which will be moved to each DataNode,
+	// using DataNode id as the key.
+	ChunkMoves map[string]int
+	// TotalMoves is the number of Chunk which will be moved in total.
+	TotalMoves int
+	// Bytes is the estimated number of bytes which will be transferred.
+	Bytes int64
+}
+
+// EstimateRebalance plans the expansion with every alive DataNode which needs
+// to expand in dry-run mode and returns the cost of it. Nothing is scheduled.
+func EstimateRebalance() RebalanceEstimate {
+	updateMapLock.RLock()
+	receivers := make([]*DataNode, 0)
+	for _, node := range dataNodeMap {
+		if node.Status == common.Alive && isNeed2Expand(node.UsedCapacity, node.FullCapacity) {
+			receivers = append(receivers, node)
+		}
+	}
+	updateMapLock.RUnlock()
+	estimate := RebalanceEstimate{ChunkMoves: make(map[string]int)}
+	movedChunks := make([]string, 0)
+	for _, node := range receivers {
+		chunkIds := newExpandOperation(node).ChunkIds
+		moves := len(chunkIds)
+		if moves == 0 {
+			continue
+		}
+		movedChunks = append(movedChunks, chunkIds...)
+		estimate.ChunkMoves[node.Id] = moves
+		estimate.TotalMoves += moves
+	}
+	updateChunksLock.RLock()
+	for _, id := range movedChunks {
+		// Chunk removed after planning is still counted as a full Chunk.
+		if chunk, ok := chunksMap[id]; ok {
+			estimate.Bytes += chunk.storedSize()
+		} else {
+			estimate.Bytes += common.ChunkSize
+		}
+	}
+	updateChunksLock.RUnlock()
+	return estimate
+}
+
+// ChunksOnDataNode returns id of all Chunk stored on the DataNode, sorted by id.
+func ChunksOnDataNode(dataNodeId string) ([]string, error) {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	dataNode, ok := dataNodeMap[dataNodeId]
+	if !ok {
+		return nil, fmt.Errorf("datanode not exist, datanode id: %s", dataNodeId)
+	}
+	res := util.Interfaces2TypeArr[string](dataNode.Chunks.ToSlice())
+	sort.Strings(res)
+	return res, nil
+}
+
+// ChunkDecommissionImpact is what will happen to a Chunk if the DataNode
+// storing it is decommissioned.
+type ChunkDecommissionImpact struct {
+	ChunkId string
+	// Target is the DataNode which can receive the replica, it is empty if no
+	// DataNode can receive it.
+	Target string
+	// OtherReplicas is the number of other alive DataNode storing the Chunk.
+	OtherReplicas int
+}
+
+// DecommissionReport is the impact of decommissioning a DataNode.
+type DecommissionReport struct {
+	DataNodeId string
+	Chunks     []ChunkDecommissionImpact
+	// UnsafeChunks includes id of all Chunk which will be under-replicated
+	// forever, because no DataNode can receive their replica.
+	UnsafeChunks []string
+}
+
+// IsSafe checks whether the DataNode can be decommissioned without
+// under-replicating any Chunk.
+func (r *DecommissionReport) IsSafe() bool {
+	return len(r.UnsafeChunks) == 0
+}
+
+// DecommissionImpact finds out whether each Chunk stored on the DataNode can be
+// re-replicated to another DataNode if the DataNode is decommissioned. A target
+// must be alive, match the PlacementConstraint of the Chunk, not store the Chunk
+// yet and stay storable after receiving all replicas directed to it. Nothing is
+// scheduled, so decommission can be refused up front if it is unsafe.
+func DecommissionImpact(dataNodeId string) (*DecommissionReport, error) {
+	chunkIds, err := ChunksOnDataNode(dataNodeId)
+	if err != nil {
+		return nil, err
+	}
+	constraints := make(map[string]PlacementConstraint, len(chunkIds))
+	for _, chunkId := range chunkIds {
+		constraints[chunkId] = getPlacementConstraint(chunkId)
+	}
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	report := &DecommissionReport{
+		DataNodeId:   dataNodeId,
+		Chunks:       make([]ChunkDecommissionImpact, 0, len(chunkIds)),
+		UnsafeChunks: make([]string, 0),
+	}
+	// processMap contains how many bytes have been directed to each DataNode by
+	// this plan.
+	processMap := make(map[*DataNode]int)
+	threshold := viper.GetInt(common.StorableThreshold)
+	for _, chunkId := range chunkIds {
+		impact := ChunkDecommissionImpact{ChunkId: chunkId}
+		chunk, ok := chunksMap[chunkId]
+		if !ok {
+			// The Chunk has been removed, so it needs nothing.
+			continue
+		}
+		size := int(chunk.storedSize())
+		var target *DataNode
+		for _, node := range dataNodeMap {
+			if node.Id == dataNodeId || node.Status != common.Alive {
+				continue
+			}
+			if chunk.dataNodes.Contains(node.Id) {
+				impact.OtherReplicas++
+				continue
+			}
+			if chunk.pendingDataNodes.Contains(node.Id) || !constraints[chunkId].Match(node.Tags) ||
+				node.CalUsage(processMap[node]+size) >= threshold {
+				continue
+			}
+			if target == nil || node.CalUsage(processMap[node]) < target.CalUsage(processMap[target]) ||
+				(node.CalUsage(processMap[node]) == target.CalUsage(processMap[target]) && node.Id < target.Id) {
+				target = node
+			}
+		}
+		if target == nil {
+			report.UnsafeChunks = append(report.UnsafeChunks, chunkId)
+		} else {
+			impact.Target = target.Id
+			processMap[target] += size
+		}
+		report.Chunks = append(report.Chunks, impact)
+	}
+	return report, nil
+}
+
+// getExpandPlan selects Chunk which will be moved to the new DataNode. It returns
+// the Chunk will be sent by each DataNode and all selected Chunk. A replica of
+// Chunk pinned on its DataNode will never be moved.
+func getExpandPlan(dataNode *DataNode) (map[string][]string, []string) {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
 	currentUsage := dataNode.CalUsage(0)
 	var (
-		pendingCount  = (CalAvgUsage()-currentUsage)*dataNode.FullCapacity/(100*common.ChunkSize) + 1
+		pendingCount  = (calAvgUsage()-currentUsage)*dataNode.FullCapacity/(100*common.ChunkSize) + 1
 		selfChunks    = dataNode.Chunks
 		pendingChunks = set.NewSet()
 		pendingMap    = map[string][]string{}
@@ -543,15 +1843,14 @@ For:
 		notFound := true
 		for _, node := range dataNodeMap {
 			if node.Status == common.Alive {
-				for chunk := range node.Chunks.Iter() {
-					if !pendingChunks.Contains(chunk) && !selfChunks.Contains(chunk) {
+				// Iterate over a copy, breaking out of Iter() would leave the
+				// set's read lock held.
+				for _, chunk := range node.Chunks.ToSlice() {
+					if !pendingChunks.Contains(chunk) && !selfChunks.Contains(chunk) &&
+						!isChunkPinnedOn(chunk.(string), node.Id) {
 						notFound = false
 						pendingChunks.Add(chunk)
-						if pendingDataNodeChunks, ok := pendingMap[node.Id]; ok {
-							pendingDataNodeChunks = append(pendingDataNodeChunks, chunk.(string))
-						} else {
-							pendingMap[node.Id] = []string{chunk.(string)}
-						}
+						pendingMap[node.Id] = append(pendingMap[node.Id], chunk.(string))
 						if pendingChunks.Cardinality() == pendingCount {
 							break For
 						}
@@ -564,14 +1863,5 @@ For:
 			break
 		}
 	}
-	expandOperation := &ExpandOperation{
-		Id:           util.GenerateUUIDString(),
-		SenderPlan:   pendingMap,
-		ReceiverPlan: dataNode.Id,
-		ChunkIds:     util.Interfaces2TypeArr[string](pendingChunks.ToSlice()),
-	}
-	data := getData4Apply(expandOperation, common.OperationExpand)
-	GlobalMasterHandler.Raft.Apply(data, 5*time.Second)
-	Logger.Infof("Success to expand with dataNode %s", dataNode.Id)
-	return pendingChunks.Cardinality()
+	return pendingMap, util.Interfaces2TypeArr[string](pendingChunks.ToSlice())
 }
@@ -1,12 +1,19 @@
 package internal
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/agiledragon/gomonkey/v2"
 	set "github.com/deckarep/golang-set"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 	"tinydfs-base/common"
+	"tinydfs-base/protocol/pb"
 	"tinydfs-base/util"
 )
 
@@ -61,8 +68,12 @@ func TestDegradeDataNode(t *testing.T) {
 						ChunkSendInfo{ChunkId: "chunk2", DataNodeId: "dataNode3"}: common.WaitToSend,
 					},
 				}
+				// Put all Chunk to pendingChunkQueue at once.
+				window := viper.GetInt(MasterDegradeRequeueWindow)
+				viper.Set(MasterDegradeRequeueWindow, 0)
 				batchClearDataNode := gomonkey.ApplyFunc(BatchClearDataNode, func(_ []interface{}, _ string) {})
 				t.Cleanup(func() {
+					viper.Set(MasterDegradeRequeueWindow, window)
 					batchClearDataNode.Reset()
 					dataNodeMap = make(map[string]*DataNode)
 					pendingChunkQueue = util.NewQueue[String]()
@@ -100,7 +111,7 @@ func TestDegradeDataNode(t *testing.T) {
 			if tt.Setup != nil {
 				tt.Setup(t)
 			}
-			DegradeDataNode(tt.args.dataNodeId, tt.args.stage)
+			DegradeDataNode(tt.args.dataNodeId, tt.args.stage, time.Now())
 			if tt.name == "Degrade2Waiting" {
 				assert.Equal(t, tt.wantStatus, dataNodeMap[tt.args.dataNodeId].Status, "Unexpected Status.")
 			}
@@ -108,3 +119,1008 @@ func TestDegradeDataNode(t *testing.T) {
 		})
 	}
 }
+
+func TestDegradeDataNode_Staggered(t *testing.T) {
+	window := viper.GetInt(MasterDegradeRequeueWindow)
+	viper.Set(MasterDegradeRequeueWindow, 100)
+	t.Cleanup(func() {
+		viper.Set(MasterDegradeRequeueWindow, window)
+		dataNodeMap = make(map[string]*DataNode)
+		chunksMap = make(map[string]*Chunk)
+		pendingChunkQueue = util.NewQueue[String]()
+		stagedChunks = make([]stagedChunk, 0)
+	})
+	for _, id := range []string{"chunk1", "chunk2", "chunk3", "chunk4"} {
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	}
+	dataNodeMap["dataNode1"] = &DataNode{
+		Id:      "dataNode1",
+		Address: "127.0.0.1",
+		Status:  common.Waiting,
+		Chunks:  set.NewSet("chunk1", "chunk2", "chunk3", "chunk4"),
+		FutureSendChunks: map[ChunkSendInfo]int{
+			ChunkSendInfo{ChunkId: "chunk5", DataNodeId: "dataNode2"}: common.WaitToSend,
+		},
+	}
+	start := time.Now()
+	DegradeDataNode("dataNode1", common.Degrade2Dead, start)
+	// Only Chunk in FutureSendChunks is put to pendingChunkQueue at once.
+	assert.Equal(t, 1, pendingChunkQueue.Len(), "Unexpected len.")
+	assert.Equal(t, 4, getStagedChunkNum(), "Unexpected staged num.")
+
+	// Chunk are released at 25s, 50s, 75s and 100s after degrading.
+	assert.Equal(t, 0, ReleaseStagedChunks(start), "Unexpected released num.")
+	// The release time is decided by the time of the leader in the operation.
+	released, err := ReleaseStagedOperation{Time: start.Add(60 * time.Second).UnixMilli()}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 2, released, "Unexpected released num.")
+	assert.Equal(t, 3, pendingChunkQueue.Len(), "Unexpected len.")
+
+	// The DataNode comes back with chunk3 and chunk4, so they are canceled.
+	_, err = RegisterOperation{
+		Address:    "127.0.0.1",
+		DataNodeId: "dataNode3",
+		ChunkIds:   []string{"chunk3", "chunk4"},
+	}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 0, getStagedChunkNum(), "Unexpected staged num.")
+	for _, id := range []string{"chunk3", "chunk4"} {
+		assert.Equal(t, []string{"dataNode3"}, set2SortedStrings(chunksMap[id].dataNodes),
+			"Replica of canceled chunk should be restored.")
+	}
+	assert.Equal(t, 0, ReconcileChunkLocations(time.Now()), "Restored replicas should not drift.")
+	assert.Equal(t, 0, ReleaseStagedChunks(start.Add(200*time.Second)), "Unexpected released num.")
+	assert.Equal(t, 3, pendingChunkQueue.Len(), "Unexpected len.")
+}
+
+func TestAddDataNode_Reregister(t *testing.T) {
+	window := viper.GetInt(MasterDegradeRequeueWindow)
+	viper.Set(MasterDegradeRequeueWindow, 0)
+	t.Cleanup(func() {
+		viper.Set(MasterDegradeRequeueWindow, window)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+		stagedChunks = make([]stagedChunk, 0)
+	})
+	for _, id := range []string{"chunk1", "chunk2", "chunk4"} {
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	}
+	AddDataNode(&DataNode{
+		Id:               "dataNode1",
+		Status:           common.Alive,
+		Address:          "127.0.0.1",
+		Chunks:           set.NewSet("chunk1", "chunk2"),
+		Tags:             map[string]string{"rack": "r1"},
+		FutureSendChunks: map[ChunkSendInfo]int{{ChunkId: "chunk3", DataNodeId: "dataNode2"}: common.WaitToSend},
+	}, false, time.Now())
+
+	// The DataNode reconnects with the same id and reports part of its Chunk.
+	merged := AddDataNode(&DataNode{
+		Id:               "dataNode1",
+		Status:           common.Cold,
+		Address:          "127.0.0.2",
+		Chunks:           set.NewSet("chunk2", "chunk4"),
+		FullCapacity:     100,
+		FutureSendChunks: make(map[ChunkSendInfo]int),
+	}, false, time.Now())
+	assert.True(t, merged, "DataNode should be merged.")
+	dataNode := dataNodeMap["dataNode1"]
+	assert.Equal(t, []string{"chunk1", "chunk2", "chunk4"}, set2SortedStrings(dataNode.Chunks), "Chunks should be merged.")
+	assert.Equal(t, common.Alive, dataNode.Status, "Status should be kept.")
+	assert.Equal(t, "127.0.0.2", dataNode.Address, "Unexpected address.")
+	assert.Equal(t, 100, dataNode.FullCapacity, "Unexpected full capacity.")
+	assert.Equal(t, "r1", dataNode.Tags["rack"], "Tags should be kept.")
+	assert.Equal(t, 1, len(dataNode.FutureSendChunks), "Future send chunks should be kept.")
+
+	// A formatted DataNode replaces the existing one.
+	merged = AddDataNode(&DataNode{
+		Id:               "dataNode1",
+		Status:           common.Alive,
+		Chunks:           set.NewSet(),
+		FutureSendChunks: make(map[ChunkSendInfo]int),
+	}, true, time.Now())
+	assert.False(t, merged, "DataNode should be replaced.")
+	assert.Equal(t, 0, dataNodeMap["dataNode1"].Chunks.Cardinality(), "Chunks should be replaced.")
+	for _, id := range []string{"chunk1", "chunk2", "chunk4"} {
+		assert.False(t, chunksMap[id].dataNodes.Contains("dataNode1"), "Replica should be purged, chunk id: %s", id)
+	}
+	assert.Equal(t, 4, pendingChunkQueue.Len(), "Chunk of the replaced DataNode should be replicated again.")
+}
+
+func TestDegradeDataNode_Backpressure(t *testing.T) {
+	window := viper.GetInt(MasterDegradeRequeueWindow)
+	watermark := viper.GetInt(MasterPendingQueueWatermark)
+	viper.Set(MasterDegradeRequeueWindow, 0)
+	viper.Set(MasterPendingQueueWatermark, 2)
+	t.Cleanup(func() {
+		viper.Set(MasterDegradeRequeueWindow, window)
+		viper.Set(MasterPendingQueueWatermark, watermark)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+		stagedChunks = make([]stagedChunk, 0)
+		pendingQueueSaturatedMonitor.Set(0)
+	})
+	dataNodeMap["dataNode1"] = &DataNode{
+		Id:               "dataNode1",
+		Status:           common.Waiting,
+		Chunks:           set.NewSet("chunk1", "chunk2", "chunk3", "chunk4"),
+		FutureSendChunks: make(map[ChunkSendInfo]int),
+	}
+	for _, id := range []string{"chunk1", "chunk2", "chunk3"} {
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet("dataNode1", "dataNode2", "dataNode3"),
+			pendingDataNodes: set.NewSet()}
+	}
+	// chunk4 only has one replica left after dataNode1 dies.
+	chunksMap["chunk4"] = &Chunk{Id: "chunk4", dataNodes: set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet()}
+	pendingChunkQueue.Push("chunk0")
+	pendingChunkQueue.Push("chunk0")
+	deferred := testutil.ToFloat64(deferredChunkCountMonitor)
+
+	// The queue is saturated, so only the endangered Chunk is pushed.
+	DegradeDataNode("dataNode1", common.Degrade2Dead, time.Now())
+	assert.Equal(t, []String{"chunk0", "chunk0", "chunk4"}, pendingChunkQueue.BatchTop(pendingChunkQueue.Len()),
+		"Endangered chunk should not be deferred.")
+	assert.Equal(t, 3, getStagedChunkNum(), "Unexpected staged num.")
+	assert.Equal(t, float64(1), testutil.ToFloat64(pendingQueueSaturatedMonitor), "Queue should be saturated.")
+	assert.Equal(t, float64(3), testutil.ToFloat64(deferredChunkCountMonitor)-deferred, "Unexpected deferred num.")
+	assert.Equal(t, 0, ReleaseStagedChunks(time.Now()), "Deferred chunk should wait for the queue.")
+
+	// Deferred Chunk are released as the queue drains.
+	pendingChunkQueue.BatchPop(pendingChunkQueue.Len())
+	assert.Equal(t, 2, ReleaseStagedChunks(time.Now()), "Unexpected released num.")
+	assert.Equal(t, []String{"chunk1", "chunk2"}, pendingChunkQueue.BatchTop(pendingChunkQueue.Len()),
+		"Unexpected pending chunks.")
+	assert.Equal(t, 1, getStagedChunkNum(), "Unexpected staged num.")
+	pendingChunkQueue.BatchPop(pendingChunkQueue.Len())
+	assert.Equal(t, 1, ReleaseStagedChunks(time.Now()), "Unexpected released num.")
+	assert.Equal(t, float64(0), testutil.ToFloat64(pendingQueueSaturatedMonitor), "Queue should not be saturated.")
+}
+
+func TestForceRemoveDataNode(t *testing.T) {
+	window := viper.GetInt(MasterDegradeRequeueWindow)
+	viper.Set(MasterDegradeRequeueWindow, 0)
+	t.Cleanup(func() {
+		viper.Set(MasterDegradeRequeueWindow, window)
+		dataNodeMap = make(map[string]*DataNode)
+		chunksMap = make(map[string]*Chunk)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	dataNodeMap["dataNode1"] = &DataNode{
+		Id:               "dataNode1",
+		Status:           common.Alive,
+		HeartbeatTime:    time.Now(),
+		Chunks:           set.NewSet("chunk1", "chunk2"),
+		FutureSendChunks: make(map[ChunkSendInfo]int),
+	}
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	chunksMap["chunk2"] = &Chunk{Id: "chunk2", dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+
+	// An alive DataNode is removed without waiting for the dead timeout.
+	_, err := ForceRemoveDataNodeOperation{DataNodeId: "dataNode1"}.Apply()
+	assert.NoError(t, err)
+	assert.Nil(t, GetDataNode("dataNode1"), "DataNode should be removed.")
+	assert.Equal(t, []String{"chunk1", "chunk2"}, pendingChunkQueue.BatchTop(pendingChunkQueue.Len()),
+		"Chunk of the datanode should be enqueued.")
+	assert.False(t, chunksMap["chunk1"].dataNodes.Contains("dataNode1"), "Unexpected data nodes.")
+
+	// A removed DataNode can not be removed again, nor degraded by heartbeat check.
+	_, err = ForceRemoveDataNodeOperation{DataNodeId: "dataNode1"}.Apply()
+	assert.Error(t, err)
+	degraded, err := BatchDegradeOperation{DataNodeIds: []string{"dataNode1"}, Stage: common.Degrade2Dead}.Apply()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, degraded)
+}
+
+func TestIsNeed2ExpandByBytes(t *testing.T) {
+	t.Cleanup(func() {
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	for _, id := range []string{"dataNode1", "dataNode2"} {
+		dataNodeMap[id] = &DataNode{
+			Id:               id,
+			Status:           common.Alive,
+			Chunks:           set.NewSet(),
+			FutureSendChunks: map[ChunkSendInfo]int{},
+		}
+	}
+	tests := []struct {
+		name         string
+		usedCapacity int64
+		wantFree     int
+		wantExpand   bool
+	}{
+		{
+			name:         "EnoughSpace",
+			usedCapacity: 80 * common.GB,
+			wantFree:     40 * common.GB,
+			wantExpand:   false,
+		},
+		{
+			name:         "AtFloor",
+			usedCapacity: 85 * common.GB,
+			wantFree:     30 * common.GB,
+			wantExpand:   false,
+		},
+		{
+			name:         "BelowFloor",
+			usedCapacity: 86 * common.GB,
+			wantFree:     28 * common.GB,
+			wantExpand:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, id := range []string{"dataNode1", "dataNode2"} {
+				UpdateDataNode4Heartbeat(HeartbeatOperation{
+					DataNodeId:   id,
+					FullCapacity: 100 * common.GB,
+					UsedCapacity: tt.usedCapacity,
+				})
+			}
+			assert.Equal(t, tt.wantFree, GetClusterCapacity().FreeCapacity, "Unexpected free capacity.")
+			assert.Equal(t, tt.wantExpand, IsNeed2ExpandByBytes(), "Unexpected expand recommendation.")
+		})
+	}
+}
+
+func TestGetExpandPlan(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	dataNodeMap["dataNode1"] = &DataNode{
+		Id:           "dataNode1",
+		Status:       common.Alive,
+		Chunks:       set.NewSet("chunk1", "chunk2"),
+		FullCapacity: 100 * common.ChunkSize,
+		UsedCapacity: 2 * common.ChunkSize,
+	}
+	newDataNode := &DataNode{
+		Id:           "dataNode2",
+		Status:       common.Alive,
+		Chunks:       set.NewSet(),
+		FullCapacity: 100 * common.ChunkSize,
+	}
+	dataNodeMap["dataNode2"] = newDataNode
+	chunksMap["chunk1"] = &Chunk{
+		Id:               "chunk1",
+		dataNodes:        set.NewSet("dataNode1"),
+		pendingDataNodes: set.NewSet(),
+		pinnedDataNodes:  set.NewSet("dataNode1"),
+	}
+	chunksMap["chunk2"] = &Chunk{
+		Id:               "chunk2",
+		dataNodes:        set.NewSet("dataNode1"),
+		pendingDataNodes: set.NewSet(),
+	}
+	pendingMap, pendingChunks := getExpandPlan(newDataNode)
+	assert.Equal(t, map[string][]string{"dataNode1": {"chunk2"}}, pendingMap, "Pinned chunk should not be moved.")
+	assert.Equal(t, []string{"chunk2"}, pendingChunks, "Unexpected pending chunks.")
+
+	done := make(chan struct{})
+	go func() {
+		dataNodeMap["dataNode1"].Chunks.Add("chunk3")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Chunk set of dataNode1 is still locked after planning.")
+	}
+}
+
+func TestBatchAllocateDataNodes(t *testing.T) {
+	t.Cleanup(func() {
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	tags := map[string]map[string]string{
+		"dataNode1": {"zone": "eu"},
+		"dataNode2": {"zone": "eu", "gpu": "true"},
+		"dataNode3": {"zone": "us"},
+		"dataNode4": nil,
+	}
+	for id, tag := range tags {
+		dataNodeMap[id] = &DataNode{
+			Id:           id,
+			Status:       common.Alive,
+			Chunks:       set.NewSet(),
+			FullCapacity: 100 * common.ChunkSize,
+			Tags:         tag,
+		}
+	}
+	tests := []struct {
+		name    string
+		expr    string
+		wantIds []string
+	}{
+		{
+			name:    "Zone",
+			expr:    "zone=eu",
+			wantIds: []string{"dataNode1", "dataNode2"},
+		},
+		{
+			name:    "ZoneWithoutGpu",
+			expr:    "zone=eu,gpu!=true",
+			wantIds: []string{"dataNode1"},
+		},
+		{
+			name:    "Unsatisfiable",
+			expr:    "zone=asia",
+			wantIds: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			constraint, err := ParsePlacementConstraint(tt.expr)
+			assert.NoError(t, err, "Unexpected error.")
+			dataNodes := BatchAllocateDataNodes(2, viper.GetInt(common.ReplicaNum), constraint)
+			for _, nodes := range dataNodes {
+				ids := make([]string, len(nodes))
+				for i, node := range nodes {
+					ids[i] = node.Id
+				}
+				assert.ElementsMatch(t, tt.wantIds, ids, "Unexpected allocated datanodes.")
+			}
+		})
+	}
+}
+
+func TestAllocateDataNodes_Short(t *testing.T) {
+	replicaNum := viper.GetInt(common.ReplicaNum)
+	viper.Set(common.ReplicaNum, 3)
+	t.Cleanup(func() {
+		viper.Set(common.ReplicaNum, replicaNum)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	for _, id := range []string{"dataNode1", "dataNode2"} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet(),
+			FullCapacity: 100 * common.ChunkSize, FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	dataNodes, num := AllocateDataNodes()
+	assert.Equal(t, 2, num, "Unexpected datanode num.")
+	assert.Equal(t, num, len(dataNodes), "Unexpected datanode num.")
+
+	// Both alive DataNode are used for the Chunk without panic.
+	indexTestFile(t, "file1", 1)
+	reply, err := AddOperation{FileNodeId: "file1", ChunkNum: 1, Stage: common.GetDataNodes}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.ElementsMatch(t, []string{"dataNode1", "dataNode2"},
+		reply.(*pb.GetDataNodes4AddReply).DataNodeIds[0].Items, "Unexpected allocated datanodes.")
+
+	// The missing replica stays pending after the Chunk is stored.
+	_, err = AddOperation{Stage: common.UnlockDic, Infos: []util.ChunkTaskResult{
+		{ChunkId: "file1_0", SuccessDataNodes: []string{"dataNode1", "dataNode2"}},
+	}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 2, chunksMap["file1_0"].dataNodes.Cardinality(), "Unexpected stored replicas.")
+	assert.Equal(t, []String{"file1_0"}, pendingChunkQueue.BatchTop(pendingChunkQueue.Len()),
+		"Shortfall replica should be pending.")
+}
+
+func TestRestoreDataNodes(t *testing.T) {
+	t.Cleanup(func() {
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	dataNode := &DataNode{
+		Id:     "dataNode1",
+		Status: common.Alive,
+		Chunks: set.NewSet("chunk1", "chunk2"),
+		FutureSendChunks: map[ChunkSendInfo]int{
+			ChunkSendInfo{ChunkId: "chunk1", DataNodeId: "dataNode2", SendType: common.CopySendType}: common.WaitToInform,
+		},
+		Tags: map[string]string{"zone": "eu", "gpu": "true"},
+	}
+	data := dataNode.String() + common.SnapshotDelimiter
+	err := RestoreDataNodes(bufio.NewScanner(strings.NewReader(data)))
+	assert.NoError(t, err, "Unexpected error.")
+	restored := dataNodeMap["dataNode1"]
+	assert.True(t, dataNode.Chunks.Equal(restored.Chunks), "Unexpected chunks.")
+	assert.Equal(t, dataNode.FutureSendChunks, restored.FutureSendChunks, "Unexpected future send chunks.")
+	assert.Equal(t, dataNode.Tags, restored.Tags, "Unexpected tags.")
+}
+
+func TestAbandonStaleSends(t *testing.T) {
+	viper.Set(MasterSendTimeoutHeartbeats, 2)
+	t.Cleanup(func() {
+		viper.Set(MasterSendTimeoutHeartbeats, defaultSendTimeoutHeartbeats)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	info := ChunkSendInfo{ChunkId: "chunk1", DataNodeId: "dataNode2", SendType: common.CopySendType}
+	dataNodeMap["dataNode1"] = &DataNode{
+		Id:               "dataNode1",
+		Status:           common.Alive,
+		Chunks:           set.NewSet("chunk1"),
+		FutureSendChunks: map[ChunkSendInfo]int{info: common.WaitToInform},
+	}
+	chunksMap["chunk1"] = &Chunk{
+		Id:               "chunk1",
+		dataNodes:        set.NewSet("dataNode1"),
+		pendingDataNodes: set.NewSet("dataNode2"),
+	}
+	heartbeat := HeartbeatOperation{DataNodeId: "dataNode1", IsReady: true}
+
+	// The first heartbeat informs the DataNode to send the Chunk.
+	next, err := heartbeat.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []ChunkSendInfo{info}, next, "Chunk should be sent.")
+	// The DataNode never reports the result.
+	for i := 0; i < 2; i++ {
+		_, _ = heartbeat.Apply()
+		assert.Equal(t, common.WaitToSend, dataNodeMap["dataNode1"].FutureSendChunks[info], "Sending should be waiting.")
+	}
+	assert.Equal(t, 2, dataNodeMap["dataNode1"].SendAttempts[info], "Unexpected attempts.")
+	assert.Contains(t, dataNodeMap["dataNode1"].String(), "chunk1@dataNode2@0@1@2", "Attempts should be persisted.")
+
+	_, _ = heartbeat.Apply()
+	assert.Empty(t, dataNodeMap["dataNode1"].FutureSendChunks, "Stale sending should be abandoned.")
+	assert.Empty(t, dataNodeMap["dataNode1"].SendAttempts, "Attempts should be removed.")
+	assert.Equal(t, 1, pendingChunkQueue.Len(), "Chunk should be re-queued.")
+	assert.False(t, chunksMap["chunk1"].pendingDataNodes.Contains("dataNode2"), "Pending datanode should be removed.")
+}
+
+func TestRetryFailedSends(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	info := ChunkSendInfo{ChunkId: "chunk1", DataNodeId: "dataNode2", SendType: common.CopySendType}
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive, Chunks: set.NewSet("chunk1"),
+		FutureSendChunks: map[ChunkSendInfo]int{info: common.WaitToInform}}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Status: common.Alive, Chunks: set.NewSet(),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1"),
+		pendingDataNodes: set.NewSet("dataNode2")}
+	next, err := HeartbeatOperation{DataNodeId: "dataNode1"}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []ChunkSendInfo{info}, next, "Chunk should be sent.")
+
+	// The sending fails twice, and the same path is retried each time.
+	failed := HeartbeatOperation{DataNodeId: "dataNode1", FailInfos: []ChunkSendInfo{info}}
+	for i := 1; i <= 2; i++ {
+		next, err = failed.Apply()
+		assert.NoError(t, err, "Unexpected error.")
+		assert.Equal(t, []ChunkSendInfo{info}, next, "Same path should be retried.")
+		assert.Equal(t, i, dataNodeMap["dataNode1"].SendRetries[info], "Unexpected retries.")
+		assert.Equal(t, 0, pendingChunkQueue.Len(), "Chunk should not be allocated again.")
+		assert.True(t, chunksMap["chunk1"].pendingDataNodes.Contains("dataNode2"), "Target should be pending.")
+	}
+	assert.Contains(t, dataNodeMap["dataNode1"].String(), "chunk1@dataNode2@0@1@0@2", "Retries should be persisted.")
+
+	// Then it succeeds.
+	_, err = HeartbeatOperation{DataNodeId: "dataNode1", SuccessInfos: []ChunkSendInfo{info}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Empty(t, dataNodeMap["dataNode1"].SendRetries, "Retries should be removed.")
+	assert.True(t, chunksMap["chunk1"].dataNodes.Contains("dataNode2"), "Chunk should be stored.")
+	assert.Equal(t, 0, pendingChunkQueue.Len(), "Chunk should not be allocated again.")
+
+	// A sending which fails after all retries is allocated again.
+	dataNodeMap["dataNode1"].FutureSendChunks[info] = common.WaitToSend
+	dataNodeMap["dataNode1"].SendRetries = map[ChunkSendInfo]int{info: 2}
+	_, err = failed.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Empty(t, dataNodeMap["dataNode1"].FutureSendChunks, "Sending should be removed.")
+	assert.Equal(t, 1, pendingChunkQueue.Len(), "Chunk should be allocated again.")
+}
+
+func TestReconcileChunkLocations(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	deleting := ChunkSendInfo{ChunkId: "chunk3", SendType: common.DeleteSendType}
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive,
+		Chunks: set.NewSet("chunk1", "chunk2", "chunk3"), FutureSendChunks: map[ChunkSendInfo]int{deleting: 0}}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Status: common.Alive, Chunks: set.NewSet(),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+	// dataNode1 lists chunk2 which does not list it, dataNode2 does not list
+	// chunk1 which lists it, and chunk2 lists dataNode3 which does not exist.
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet()}
+	chunksMap["chunk2"] = &Chunk{Id: "chunk2", dataNodes: set.NewSet("dataNode3"), pendingDataNodes: set.NewSet()}
+	chunksMap["chunk3"] = &Chunk{Id: "chunk3", dataNodes: set.NewSet(), pendingDataNodes: set.NewSet()}
+	removed := testutil.ToFloat64(chunkLocationRepairCountMonitor.WithLabelValues(repairRemoveFromDataNode))
+
+	assert.Equal(t, 3, ReconcileChunkLocations(time.Now()), "Unexpected repaired num.")
+	assert.False(t, dataNodeMap["dataNode1"].Chunks.Contains("chunk2"), "Chunk side should be the authority.")
+	assert.True(t, dataNodeMap["dataNode1"].Chunks.Contains("chunk3"), "Chunk being deleted should be kept.")
+	assert.True(t, dataNodeMap["dataNode2"].Chunks.Contains("chunk1"), "Chunk side should be the authority.")
+	assert.Equal(t, 0, chunksMap["chunk2"].dataNodes.Cardinality(), "Dangling datanode should be removed.")
+	assert.Equal(t, []String{"chunk2"}, pendingChunkQueue.BatchTop(pendingChunkQueue.Len()),
+		"Chunk should be replicated again.")
+	assert.Equal(t, float64(1),
+		testutil.ToFloat64(chunkLocationRepairCountMonitor.WithLabelValues(repairRemoveFromDataNode))-removed)
+
+	// Nothing is repaired once the two sides agree.
+	assert.Equal(t, 0, ReconcileChunkLocations(time.Now()), "Unexpected repaired num.")
+}
+
+func TestCheckChunksOperation_LeaderTime(t *testing.T) {
+	watermark := viper.GetInt(MasterPendingQueueWatermark)
+	viper.Set(MasterPendingQueueWatermark, 1)
+	t.Cleanup(func() {
+		viper.Set(MasterPendingQueueWatermark, watermark)
+		root.ChildNodes = map[string]*FileNode{}
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+		stagedChunks = make([]stagedChunk, 0)
+	})
+	fileNode, err := AddFileNode("/", "a.txt", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	chunkId := fileNode.Chunks[0]
+	for _, id := range []string{"dataNode1", "dataNode2"} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet(chunkId),
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	// The Chunk lists dataNode3 which does not exist.
+	chunksMap[chunkId] = &Chunk{Id: chunkId, dataNodes: set.NewSet("dataNode1", "dataNode2", "dataNode3"),
+		pendingDataNodes: set.NewSet()}
+	pendingChunkQueue.Push("chunk0")
+
+	// The queue is saturated, so the Chunk is deferred with the time of the
+	// leader rather than the time when it is applied.
+	leaderTime := time.Now().Add(-time.Hour)
+	_, err = CheckChunksOperation{Time: leaderTime.UnixMilli()}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []stagedChunk{{chunkId: chunkId, releaseTime: time.UnixMilli(leaderTime.UnixMilli())}},
+		stagedChunks, "Unexpected staged chunks.")
+}
+
+func TestUpdateDataNode4Heartbeat_ClockSkew(t *testing.T) {
+	t.Cleanup(func() {
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	lastHeartbeat := time.Now().Add(-time.Hour)
+	dataNodeMap["dataNode1"] = &DataNode{
+		Id:               "dataNode1",
+		Status:           common.Alive,
+		Chunks:           set.NewSet(),
+		FutureSendChunks: make(map[ChunkSendInfo]int),
+		HeartbeatTime:    lastHeartbeat,
+	}
+	receiveTime := time.Now()
+	// The clock of the DataNode is 10 minutes behind.
+	reportTime := receiveTime.Add(-10 * time.Minute)
+	_, _, ok := UpdateDataNode4Heartbeat(HeartbeatOperation{
+		DataNodeId:  "dataNode1",
+		ReportTime:  reportTime.UnixMilli(),
+		ReceiveTime: receiveTime.UnixMilli(),
+	})
+	assert.True(t, ok, "DataNode should exist.")
+
+	description, err := DescribeDataNode("dataNode1")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, -10*time.Minute, description.ClockSkew, "Unexpected clock skew.")
+	// Liveness is decided by the time of master, not the skewed time.
+	assert.False(t, description.HeartbeatTime.Before(receiveTime), "HeartbeatTime should use master time.")
+	assert.WithinDuration(t, time.Now(), description.HeartbeatTime, time.Second, "HeartbeatTime should use master time.")
+
+	_, err = DescribeDataNode("notExist")
+	assert.Error(t, err, "Expected an error.")
+}
+
+func TestIsNeed2Expand_ConcurrentHeartbeat(t *testing.T) {
+	t.Cleanup(func() {
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	for _, id := range []string{"dataNode1", "dataNode2", "dataNode3"} {
+		dataNodeMap[id] = &DataNode{
+			Id:               id,
+			Status:           common.Alive,
+			Chunks:           set.NewSet(),
+			FutureSendChunks: make(map[ChunkSendInfo]int),
+			SendAttempts:     make(map[ChunkSendInfo]int),
+			FullCapacity:     100,
+			UsedCapacity:     10,
+		}
+	}
+	const rounds = 200
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			UpdateDataNode4Heartbeat(HeartbeatOperation{
+				DataNodeId:   "dataNode1",
+				FullCapacity: 100,
+				UsedCapacity: int64(i % 100),
+				IsReady:      true,
+			})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			IsNeed2Expand(i%100, 100)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			GetAvgChunkNum()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			_, _ = AllocateDataNodes()
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("IsNeed2Expand deadlocks with heartbeat.")
+	}
+}
+
+func TestEstimateRebalance(t *testing.T) {
+	viper.Set(common.ExpandThreshold, 10)
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		viper.Set(common.ExpandThreshold, 0)
+	})
+	// dataNode1 and dataNode2 store the same 40 Chunk while dataNode3 is empty.
+	chunkIds := make([]interface{}, 40)
+	for i := range chunkIds {
+		id := fmt.Sprintf("chunk%d", i)
+		chunkIds[i] = id
+		chunksMap[id] = &Chunk{
+			Id:               id,
+			dataNodes:        set.NewSet("dataNode1", "dataNode2"),
+			pendingDataNodes: set.NewSet(),
+		}
+	}
+	for _, id := range []string{"dataNode1", "dataNode2"} {
+		dataNodeMap[id] = &DataNode{
+			Id:               id,
+			Status:           common.Alive,
+			Chunks:           set.NewSet(chunkIds...),
+			FullCapacity:     100 * common.ChunkSize,
+			UsedCapacity:     40 * common.ChunkSize,
+			FutureSendChunks: make(map[ChunkSendInfo]int),
+		}
+	}
+	dataNodeMap["dataNode3"] = &DataNode{
+		Id:               "dataNode3",
+		Status:           common.Alive,
+		Chunks:           set.NewSet(),
+		FullCapacity:     100 * common.ChunkSize,
+		FutureSendChunks: make(map[ChunkSendInfo]int),
+	}
+
+	estimate := EstimateRebalance()
+	// Average usage is 26%, so dataNode3 should receive 26 + 1 Chunk.
+	assert.Equal(t, map[string]int{"dataNode3": 27}, estimate.ChunkMoves, "Unexpected chunk moves.")
+	assert.Equal(t, 27, estimate.TotalMoves, "Unexpected total moves.")
+	assert.Equal(t, int64(27*common.ChunkSize), estimate.Bytes, "Unexpected bytes.")
+	for _, node := range dataNodeMap {
+		assert.Empty(t, node.FutureSendChunks, "Estimation should not schedule anything.")
+	}
+
+	_, err := newExpandOperation(dataNodeMap["dataNode3"]).Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	scheduled := 0
+	for _, node := range dataNodeMap {
+		scheduled += len(node.FutureSendChunks)
+	}
+	assert.Equal(t, estimate.TotalMoves, scheduled, "Estimate should match the actual rebalance.")
+}
+
+func TestValidateDataNodes(t *testing.T) {
+	dataNode := &DataNode{
+		Id:     "dataNode1",
+		Status: common.Alive,
+		Chunks: set.NewSet("chunk1"),
+		Tags:   map[string]string{"zone": "eu"},
+	}
+	data := dataNode.String() +
+		"dataNode2$0$address2$[]$0$abc$0$[]$2006-01-02.15.04.05\n" +
+		"dataNode3$0$address3\n" +
+		common.SnapshotDelimiter
+	report := ValidateDataNodes(bufio.NewScanner(strings.NewReader(data)))
+	assert.Equal(t, "datanodes", report.Section, "Unexpected section.")
+	assert.Equal(t, 1, report.Records, "Unexpected records.")
+	assert.Equal(t, 2, len(report.Errors), "Unexpected number of malformed lines.")
+	assert.Equal(t, 2, report.Errors[0].Line, "Unexpected malformed line.")
+	assert.Equal(t, 3, report.Errors[1].Line, "Unexpected malformed line.")
+	assert.True(t, report.Terminated, "Section should be terminated.")
+	assert.False(t, report.IsValid(), "Section should not be valid.")
+	assert.Empty(t, dataNodeMap, "Validation should not change dataNodeMap.")
+}
+
+func TestDecommissionImpact(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive,
+		Chunks: set.NewSet("chunk1", "chunk2"), FullCapacity: 10 * common.ChunkSize}
+	// dataNode2 is not storable and dataNode3 is not alive.
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Status: common.Alive, Chunks: set.NewSet("chunk2"),
+		FullCapacity: 10 * common.ChunkSize, UsedCapacity: 8 * common.ChunkSize}
+	dataNodeMap["dataNode3"] = &DataNode{Id: "dataNode3", Status: common.Waiting, Chunks: set.NewSet(),
+		FullCapacity: 2 * common.ChunkSize}
+	// dataNode1 stores the only copy of chunk1.
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	chunksMap["chunk2"] = &Chunk{Id: "chunk2", dataNodes: set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet()}
+
+	chunkIds, err := ChunksOnDataNode("dataNode1")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []string{"chunk1", "chunk2"}, chunkIds, "Unexpected chunks.")
+	_, err = ChunksOnDataNode("dataNode4")
+	assert.Error(t, err, "Expected an error for a datanode which does not exist.")
+
+	report, err := DecommissionImpact("dataNode1")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.False(t, report.IsSafe(), "Decommission should be unsafe.")
+	assert.Equal(t, []string{"chunk1", "chunk2"}, report.UnsafeChunks, "Unexpected unsafe chunks.")
+	assert.Equal(t, []ChunkDecommissionImpact{
+		{ChunkId: "chunk1", OtherReplicas: 0},
+		{ChunkId: "chunk2", OtherReplicas: 1},
+	}, report.Chunks, "Unexpected impact.")
+
+	// dataNode3 only has room for one of the Chunk.
+	dataNodeMap["dataNode3"].Status = common.Alive
+	report, err = DecommissionImpact("dataNode1")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.False(t, report.IsSafe(), "Decommission should be unsafe.")
+	assert.Equal(t, []string{"chunk2"}, report.UnsafeChunks, "Unexpected unsafe chunks.")
+	assert.Equal(t, "dataNode3", report.Chunks[0].Target, "Unexpected target.")
+
+	dataNodeMap["dataNode3"].FullCapacity = 10 * common.ChunkSize
+	report, err = DecommissionImpact("dataNode1")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.True(t, report.IsSafe(), "Decommission should be safe.")
+	for _, impact := range report.Chunks {
+		assert.Equal(t, "dataNode3", impact.Target, "Unexpected target.")
+	}
+}
+
+func TestHeartbeatOperation_Quiescent(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	dataNodeMap["dataNode1"] = &DataNode{
+		Id:               "dataNode1",
+		Status:           common.Alive,
+		Chunks:           set.NewSet("chunk1", "chunk2"),
+		FutureSendChunks: make(map[ChunkSendInfo]int),
+	}
+	for _, id := range []string{"chunk1", "chunk2"} {
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	}
+	assert.Error(t, SetDataNodeQuiescent("dataNode2", true), "Expected an error for a datanode which does not exist.")
+	_, err := SetQuiescentOperation{DataNodeId: "dataNode1", Quiescent: true}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+
+	// The quiescent flag is persisted.
+	dataNode, err := parseDataNode(strings.TrimSuffix(dataNodeMap["dataNode1"].String(), "\n"))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.True(t, dataNode.Quiescent, "Quiescent flag should be restored.")
+
+	// The DataNode is being formatted and reports an empty chunk list.
+	heartbeat := HeartbeatOperation{DataNodeId: "dataNode1", IOLoad: 5, IsReady: true,
+		InvalidChunks: []string{"chunk1", "chunk2"}}
+	_, err = heartbeat.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 5, dataNodeMap["dataNode1"].IOLoad, "IOLoad should be accepted.")
+	assert.Equal(t, 2, dataNodeMap["dataNode1"].Chunks.Cardinality(), "Chunks should be kept.")
+	assert.True(t, chunksMap["chunk1"].dataNodes.Contains("dataNode1"), "Replica should be kept.")
+	assert.Equal(t, 0, pendingChunkQueue.Len(), "Chunk should not be re-queued.")
+
+	// Neither a chunk report nor the reconciliation changes its locations.
+	dataNodeMap["dataNode1"].reportRequested = true
+	assert.False(t, IsChunkReportRequested("dataNode1"), "Report should not be requested.")
+	assert.Error(t, BeginChunkReport("dataNode1"), "Expected an error.")
+	chunksMap["chunk2"].dataNodes.Remove("dataNode1")
+	assert.Equal(t, 0, ReconcileChunkLocations(time.Now()), "Unexpected repairs.")
+	assert.True(t, dataNodeMap["dataNode1"].Chunks.Contains("chunk2"), "Chunks should be kept.")
+	chunksMap["chunk2"].dataNodes.Add("dataNode1")
+
+	assert.NoError(t, newLeaderHandler(t).SetQuiescent("dataNode1", false), "Unexpected error.")
+	assert.True(t, IsChunkReportRequested("dataNode1"), "Report should be requested after re-activation.")
+	_, err = heartbeat.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 0, dataNodeMap["dataNode1"].Chunks.Cardinality(), "Chunks should be removed.")
+	assert.Equal(t, 2, pendingChunkQueue.Len(), "Chunk should be re-queued.")
+}
+
+func TestGetReadReplicas_ClientLocality(t *testing.T) {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	viper.Set(MasterTopologyKeys, []string{"zone", "rack"})
+	t.Cleanup(func() {
+		viper.Set(MasterTopologyKeys, topologyKeys)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	for id, node := range map[string]struct {
+		address string
+		zone    string
+		rack    string
+		ioLoad  int
+	}{
+		"dataNode1": {"10.0.0.1:9000", "zone1", "rack1", 9},
+		"dataNode2": {"10.0.0.2:9000", "zone1", "rack2", 1},
+		"dataNode3": {"10.0.0.3:9000", "zone2", "rack3", 0},
+		"dataNode4": {"10.0.0.4:9000", "zone1", "rack1", 5},
+	} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Address: node.address, IOLoad: node.ioLoad,
+			Tags: map[string]string{"zone": node.zone, "rack": node.rack}, Chunks: set.NewSet()}
+	}
+	replicas := set.NewSet("dataNode1", "dataNode2", "dataNode3", "dataNode4")
+
+	// Without a hint, replicas are sorted by IOLoad only.
+	ids, _ := GetReadReplicas(replicas, ClientLocality{})
+	assert.Equal(t, []string{"dataNode3", "dataNode2", "dataNode4", "dataNode1"}, ids, "Unexpected order.")
+
+	// Same rack goes first, and the less loaded one goes first in the same rack.
+	ids, addrs := GetReadReplicas(replicas, ClientLocality{Tags: map[string]string{"zone": "zone1", "rack": "rack1"}})
+	assert.Equal(t, []string{"dataNode4", "dataNode1", "dataNode2", "dataNode3"}, ids, "Unexpected order.")
+	assert.Equal(t, "10.0.0.4:9000", addrs[0], "Unexpected address.")
+
+	// The client on the same host reads locally.
+	ids, _ = GetReadReplicas(replicas, ClientLocality{Address: "10.0.0.1",
+		Tags: map[string]string{"zone": "zone1", "rack": "rack1"}})
+	assert.Equal(t, []string{"dataNode1", "dataNode4", "dataNode2", "dataNode3"}, ids, "Unexpected order.")
+
+	// Only the zone is known.
+	ids, _ = GetReadReplicas(replicas, ClientLocality{Tags: string2Tags("zone=zone2")})
+	assert.Equal(t, []string{"dataNode3", "dataNode2", "dataNode4", "dataNode1"}, ids, "Unexpected order.")
+}
+
+func TestChunkDelete_Acknowledgement(t *testing.T) {
+	timeout := viper.GetInt(MasterSendTimeoutHeartbeats)
+	viper.Set(MasterSendTimeoutHeartbeats, 1)
+	t.Cleanup(func() {
+		viper.Set(MasterSendTimeoutHeartbeats, timeout)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive,
+		Chunks: set.NewSet("chunk1", "chunk2", "chunk3"), FutureSendChunks: make(map[ChunkSendInfo]int)}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Status: common.Alive, Chunks: set.NewSet("chunk1"),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet()}
+	for _, id := range []string{"chunk2", "chunk3"} {
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	}
+	rebuildChunkBloom()
+	deleteInfo := ChunkSendInfo{ChunkId: "chunk1", SendType: common.DeleteSendType}
+
+	// The excess replica on the fuller DataNode is deleted, but it stays on the
+	// DataNode until the deleting is confirmed.
+	_, removed := ReconcileReplicaFactor([]string{"chunk1"}, 1, time.Now())
+	assert.Equal(t, 1, removed, "Unexpected removed num.")
+	assert.Equal(t, []string{"dataNode2"}, set2SortedStrings(chunksMap["chunk1"].dataNodes), "Unexpected replicas.")
+	assert.True(t, IsChunkDeletePending("dataNode1", "chunk1"), "Deleting should be pending.")
+	assert.True(t, dataNodeMap["dataNode1"].Chunks.Contains("chunk1"), "Chunk should stay on the datanode.")
+
+	// The ack is withheld, so the deleting is sent again rather than abandoned.
+	heartbeat := HeartbeatOperation{DataNodeId: "dataNode1"}
+	nextInfos, _, _ := UpdateDataNode4Heartbeat(heartbeat)
+	assert.Equal(t, []ChunkSendInfo{deleteInfo}, nextInfos, "Deleting should be sent.")
+	UpdateDataNode4Heartbeat(heartbeat)
+	nextInfos, abandonedInfos, _ := UpdateDataNode4Heartbeat(heartbeat)
+	assert.Empty(t, abandonedInfos, "Deleting should never be abandoned.")
+	assert.Equal(t, []ChunkSendInfo{deleteInfo}, nextInfos, "Unconfirmed deleting should be sent again.")
+	_, err := HeartbeatOperation{DataNodeId: "dataNode1", FailInfos: []ChunkSendInfo{deleteInfo}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.True(t, IsChunkDeletePending("dataNode1", "chunk1"), "Failed deleting should stay pending.")
+
+	// A chunk report still containing the Chunk does not confirm the deleting.
+	assert.NoError(t, BeginChunkReport("dataNode1"), "Unexpected error.")
+	_, lost, _, err := FinishChunkReport("dataNode1", []string{"chunk1", "chunk2", "chunk3"}, time.Now())
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Empty(t, lost, "Delete-pending chunk should not be lost.")
+	assert.True(t, IsChunkDeletePending("dataNode1", "chunk1"), "Reported chunk should stay delete-pending.")
+
+	// The ack confirms the deleting.
+	_, err = HeartbeatOperation{DataNodeId: "dataNode1", SuccessInfos: []ChunkSendInfo{deleteInfo}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.False(t, IsChunkDeletePending("dataNode1", "chunk1"), "Deleting should be confirmed.")
+	assert.False(t, dataNodeMap["dataNode1"].Chunks.Contains("chunk1"), "Chunk should be removed.")
+
+	// A chunk report without the Chunk confirms the deleting as well.
+	ReclaimChunks([]string{"chunk2"})
+	assert.True(t, IsChunkDeletePending("dataNode1", "chunk2"), "Deleting should be pending.")
+	assert.NoError(t, BeginChunkReport("dataNode1"), "Unexpected error.")
+	_, lost, _, err = FinishChunkReport("dataNode1", []string{"chunk3"}, time.Now())
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Empty(t, lost, "Confirmed deleting should not be lost.")
+	assert.False(t, IsChunkDeletePending("dataNode1", "chunk2"), "Deleting should be confirmed by the report.")
+	assert.Equal(t, []string{"chunk3"}, set2SortedStrings(dataNodeMap["dataNode1"].Chunks), "Unexpected chunks.")
+}
+
+func TestDataNode_ChunkCounters(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	getGauges := func(id string) (float64, float64) {
+		return testutil.ToFloat64(dataNodeChunkCountMonitor.WithLabelValues(id)),
+			testutil.ToFloat64(dataNodeChunkBytesMonitor.WithLabelValues(id))
+	}
+	assertCounters := func(chunkNum int, chunkBytes int64) {
+		dataNode := dataNodeMap["dataNode1"]
+		assert.Equal(t, dataNode.Chunks.Cardinality(), dataNode.chunkNum, "Counter should match chunks.")
+		assert.Equal(t, chunkNum, dataNode.chunkNum, "Unexpected chunk num.")
+		assert.Equal(t, chunkBytes, dataNode.chunkBytes, "Unexpected chunk bytes.")
+		count, bytes := getGauges("dataNode1")
+		assert.Equal(t, float64(chunkNum), count, "Unexpected chunk count gauge.")
+		assert.Equal(t, float64(chunkBytes), bytes, "Unexpected chunk bytes gauge.")
+	}
+	for _, id := range []string{"chunk1", "chunk2", "chunk3", "chunk4"} {
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	}
+	rebuildChunkBloom()
+	AddDataNode(&DataNode{Id: "dataNode1", Status: common.Alive, Chunks: set.NewSet("chunk1", "chunk2"),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}, false, time.Now())
+	assertCounters(2, 0)
+
+	// Sizes reported again only count the difference.
+	_, err := HeartbeatOperation{DataNodeId: "dataNode1", SizeInfos: []ChunkSizeInfo{{ChunkId: "chunk1", Size: 100},
+		{ChunkId: "chunk2", Size: 50}, {ChunkId: "chunk5", Size: 10}}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assertCounters(2, 150)
+	_, err = HeartbeatOperation{DataNodeId: "dataNode1",
+		SizeInfos: []ChunkSizeInfo{{ChunkId: "chunk1", Size: 120}}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assertCounters(2, 170)
+
+	// Sizes survive snapshots.
+	sink := &bufferSink{}
+	assert.NoError(t, PersistDataNodes(sink), "Unexpected error.")
+	dataNodeMap = make(map[string]*DataNode)
+	assert.NoError(t, RestoreDataNodes(bufio.NewScanner(sink)), "Unexpected error.")
+	assertCounters(2, 170)
+
+	// Chunk added twice are counted once.
+	BatchAddChunks([]util.ChunkTaskResult{{ChunkId: "chunk3", SuccessDataNodes: []string{"dataNode1"}},
+		{ChunkId: "chunk1", SuccessDataNodes: []string{"dataNode1"}}})
+	assertCounters(3, 170)
+
+	// Removing a Chunk also removes its size.
+	_, err = HeartbeatOperation{DataNodeId: "dataNode1", InvalidChunks: []string{"chunk1", "chunk9"}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assertCounters(2, 50)
+
+	// A full chunk report replaces Chunks.
+	assert.NoError(t, BeginChunkReport("dataNode1"), "Unexpected error.")
+	_, _, _, err = FinishChunkReport("dataNode1", []string{"chunk3", "chunk4"}, time.Now())
+	assert.NoError(t, err, "Unexpected error.")
+	assertCounters(2, 0)
+
+	// Drift is repaired by the reconciliation.
+	updateMapLock.Lock()
+	dataNodeMap["dataNode1"].Chunks.Remove("chunk4")
+	assert.False(t, dataNodeMap["dataNode1"].isChunkCountConsistent(), "Drift should be found.")
+	updateMapLock.Unlock()
+	chunksMap["chunk4"].dataNodes.Remove("dataNode1")
+	ReconcileChunkLocations(time.Now())
+	assertCounters(1, 0)
+
+	// Gauges of a dead DataNode are removed.
+	DegradeDataNode("dataNode1", common.Degrade2Dead, time.Now())
+	assert.False(t, dataNodeChunkCountMonitor.DeleteLabelValues("dataNode1"), "Gauge should be removed.")
+	assert.False(t, dataNodeChunkBytesMonitor.DeleteLabelValues("dataNode1"), "Gauge should be removed.")
+}
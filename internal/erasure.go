@@ -0,0 +1,422 @@
+package internal
+
+import (
+	"fmt"
+	set "github.com/deckarep/golang-set"
+	"github.com/spf13/viper"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"tinydfs-base/common"
+	"tinydfs-base/protocol/pb"
+	"tinydfs-base/util"
+)
+
+const (
+	codingSchemeDelimiter = "+"
+	// replicatedScheme is the string format of the CodingScheme of a fully
+	// replicated Chunk.
+	replicatedScheme = "replicated"
+	// lostFragment takes the place of the DataNode id of a lost fragment in
+	// snapshot.
+	lostFragment      = "-"
+	fragmentDelimiter = "#"
+)
+
+var (
+	// lostFragmentQueue stores all fragments of erasure coded Chunk which are
+	// lost and waiting to be reconstructed. Erasure coded Chunk never enter
+	// pendingChunkQueue, because copying a whole replica does not make up a
+	// lost fragment.
+	lostFragmentQueue = util.NewQueue[Fragment]()
+)
+
+// CodingScheme is how a Chunk is made durable. The zero value means the Chunk is
+// fully replicated, otherwise it is erasure coded into DataShards data fragments
+// and ParityShards parity fragments, and can be decoded from any DataShards of
+// them.
+type CodingScheme struct {
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+}
+
+// ParseCodingScheme parses a CodingScheme from its string format like "6+3".
+func ParseCodingScheme(str string) (CodingScheme, error) {
+	dataStr, parityStr, ok := strings.Cut(str, codingSchemeDelimiter)
+	if !ok {
+		return CodingScheme{}, fmt.Errorf("illegal coding scheme, scheme: %q", str)
+	}
+	dataShards, err := strconv.Atoi(dataStr)
+	if err != nil {
+		return CodingScheme{}, fmt.Errorf("illegal coding scheme, scheme: %q", str)
+	}
+	parityShards, err := strconv.Atoi(parityStr)
+	if err != nil {
+		return CodingScheme{}, fmt.Errorf("illegal coding scheme, scheme: %q", str)
+	}
+	scheme := CodingScheme{DataShards: dataShards, ParityShards: parityShards}
+	if err = scheme.check(); err != nil {
+		return CodingScheme{}, err
+	}
+	return scheme, nil
+}
+
+func (s CodingScheme) String() string {
+	if !s.IsErasureCoded() {
+		return replicatedScheme
+	}
+	return fmt.Sprintf("%d%s%d", s.DataShards, codingSchemeDelimiter, s.ParityShards)
+}
+
+// IsErasureCoded checks whether the Chunk is erasure coded.
+func (s CodingScheme) IsErasureCoded() bool {
+	return s.DataShards != 0 || s.ParityShards != 0
+}
+
+// FragmentNum is the number of fragments of an erasure coded Chunk.
+func (s CodingScheme) FragmentNum() int {
+	return s.DataShards + s.ParityShards
+}
+
+// check checks whether an erasure coding scheme is legal.
+func (s CodingScheme) check() error {
+	if s.DataShards <= 0 || s.ParityShards <= 0 {
+		return fmt.Errorf("both data and parity shards must be positive, scheme: %s", s)
+	}
+	return nil
+}
+
+// Fragment is a data or parity fragment of an erasure coded Chunk.
+type Fragment struct {
+	ChunkId string
+	// Index is the index of the fragment. Data fragments come first.
+	Index int
+}
+
+func (f Fragment) String() string {
+	return util.CombineString(f.ChunkId, fragmentDelimiter, strconv.Itoa(f.Index))
+}
+
+// ReconstructTask re-creates a lost fragment on Target by decoding it from the
+// surviving fragments on Sources.
+type ReconstructTask struct {
+	ChunkId string `json:"chunk_id"`
+	Index   int    `json:"index"`
+	// Sources are DataNode storing DataShards surviving fragments.
+	Sources []string `json:"sources"`
+	Target  string   `json:"target"`
+}
+
+// fragments2String converts the DataNode of all fragments to the string format
+// of a string slice like "[a b - d]".
+func fragments2String(fragments []string) string {
+	res := make([]string, len(fragments))
+	for i, dataNodeId := range fragments {
+		res[i] = dataNodeId
+		if dataNodeId == "" {
+			res[i] = lostFragment
+		}
+	}
+	return fmt.Sprintf("%v", res)
+}
+
+// parseFragments parses the DataNode of all fragments from the string created
+// by fragments2String.
+func parseFragments(field string, scheme CodingScheme) ([]string, error) {
+	if !strings.HasPrefix(field, "[") || !strings.HasSuffix(field, "]") {
+		return nil, fmt.Errorf("malformed fragments field: %q", field)
+	}
+	fragments := strings.Split(strings.TrimSuffix(strings.TrimPrefix(field, "["), "]"), " ")
+	if len(fragments) != scheme.FragmentNum() {
+		return nil, fmt.Errorf("illegal number of fragments, expect %d, got %d", scheme.FragmentNum(),
+			len(fragments))
+	}
+	for i, dataNodeId := range fragments {
+		if dataNodeId == lostFragment {
+			fragments[i] = ""
+		}
+	}
+	return fragments, nil
+}
+
+// allocateECChunks creates erasure coded Chunk for a file. Fragments of each
+// Chunk are spread over distinct DataNode and as many failure domains as
+// possible. Chunk are indexed from firstIndex. It returns the DataNode of each
+// fragment in order.
+func allocateECChunks(fileNodeId string, firstIndex int, chunkNum int,
+	scheme CodingScheme) (*pb.GetDataNodes4AddReply, error) {
+	if err := scheme.check(); err != nil {
+		return nil, err
+	}
+	chunks := make([]*Chunk, chunkNum)
+	rep := &pb.GetDataNodes4AddReply{
+		DataNodeIds:  make([]*pb.GetDataNodes4AddReply_Array, chunkNum),
+		DataNodeAdds: make([]*pb.GetDataNodes4AddReply_Array, chunkNum),
+	}
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	for i := 0; i < chunkNum; i++ {
+		dataNodes, err := allocateFragments(scheme.FragmentNum(), nil)
+		if err != nil {
+			return nil, err
+		}
+		chunk := &Chunk{
+			Id:               util.CombineString(fileNodeId, common.ChunkIdDelimiter, strconv.Itoa(firstIndex+i)),
+			dataNodes:        set.NewSet(),
+			pendingDataNodes: set.NewSet(),
+			codingScheme:     scheme,
+			fragments:        make([]string, len(dataNodes)),
+		}
+		dnIds := make([]string, len(dataNodes))
+		dnAdds := make([]string, len(dataNodes))
+		for j, node := range dataNodes {
+			chunk.fragments[j] = node.Id
+			chunk.pendingDataNodes.Add(node.Id)
+			dnIds[j] = node.Id
+			dnAdds[j] = node.Address
+		}
+		chunks[i] = chunk
+		rep.DataNodeIds[i] = &pb.GetDataNodes4AddReply_Array{Items: dnIds}
+		rep.DataNodeAdds[i] = &pb.GetDataNodes4AddReply_Array{Items: dnAdds}
+	}
+	BatchAddChunk(chunks)
+	return rep, nil
+}
+
+// allocateFragments selects n distinct alive DataNode which are not in holders
+// to store fragments of a Chunk. Each time it selects a DataNode from the
+// failure domain with the fewest fragments, counting the ones on holders, and
+// then the DataNode with the fewest Chunk. The caller must hold updateMapLock.
+func allocateFragments(n int, holders []string) ([]*DataNode, error) {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	domainCount := make(map[string]int)
+	excluded := set.NewSet()
+	for _, id := range holders {
+		excluded.Add(id)
+		if node, ok := dataNodeMap[id]; ok {
+			domainCount[getFailureDomain(node.Tags, topologyKeys)]++
+		}
+	}
+	candidates := make([]*DataNode, 0)
+	for _, node := range dataNodeMap {
+		if node.Status == common.Alive && !excluded.Contains(node.Id) {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(candidates) < n {
+		return nil, fmt.Errorf("not enough datanodes for fragments, need %d, got %d", n, len(candidates))
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Chunks.Cardinality() != candidates[j].Chunks.Cardinality() {
+			return candidates[i].Chunks.Cardinality() < candidates[j].Chunks.Cardinality()
+		}
+		return candidates[i].Id < candidates[j].Id
+	})
+	selected := make([]*DataNode, 0, n)
+	for len(selected) < n {
+		best := -1
+		for i, node := range candidates {
+			if node == nil {
+				continue
+			}
+			if best == -1 || domainCount[getFailureDomain(node.Tags, topologyKeys)] <
+				domainCount[getFailureDomain(candidates[best].Tags, topologyKeys)] {
+				best = i
+			}
+		}
+		selected = append(selected, candidates[best])
+		domainCount[getFailureDomain(candidates[best].Tags, topologyKeys)]++
+		candidates[best] = nil
+	}
+	return selected, nil
+}
+
+// getFailureDomain gets the narrowest failure domain of a DataNode according to
+// its Tags.
+func getFailureDomain(tags map[string]string, topologyKeys []string) string {
+	values := make([]string, len(topologyKeys))
+	for i, key := range topologyKeys {
+		values[i] = tags[key]
+	}
+	return strings.Join(values, tagDelimiter)
+}
+
+// markFragmentsLost marks fragments stored by the dead DataNode as lost and puts
+// them to lostFragmentQueue. It returns id of the given Chunk which are not
+// erasure coded, so that they can be replicated as usual.
+func markFragmentsLost(dataNodeId string, chunkIds []string) []string {
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	replicatedIds := make([]string, 0, len(chunkIds))
+	for _, id := range chunkIds {
+		chunk, ok := chunksMap[id]
+		if !ok || !chunk.codingScheme.IsErasureCoded() {
+			replicatedIds = append(replicatedIds, id)
+			continue
+		}
+		for i, fragmentDataNodeId := range chunk.fragments {
+			if fragmentDataNodeId == dataNodeId {
+				chunk.fragments[i] = ""
+				lostFragmentQueue.Push(Fragment{ChunkId: id, Index: i})
+			}
+		}
+	}
+	return replicatedIds
+}
+
+// BatchReconstructFragments plans the reconstruction of a batch of lost fragments
+// and applies the plan through Raft.
+func BatchReconstructFragments() {
+	if lostFragmentQueue.Len() == 0 {
+		return
+	}
+	batchLen := lostFragmentQueue.Len()
+	if maxCount := viper.GetInt(common.ChunkDeadChunkCopyThreshold); batchLen > maxCount {
+		batchLen = maxCount
+	}
+	tasks, unsatisfied := getReconstructPlan(lostFragmentQueue.BatchTop(batchLen))
+	operation := &ReconstructOperation{
+		Id:          util.GenerateUUIDString(),
+		Tasks:       tasks,
+		BatchLen:    batchLen,
+		Unsatisfied: unsatisfied,
+	}
+	data := getData4Apply(operation, OperationReconstruct)
+	applyFuture := GlobalMasterHandler.Raft.Apply(data, 5*time.Second)
+	if err := applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to reconstruct a batch of fragments, error detail: %s,", err.Error())
+	}
+}
+
+// getReconstructPlan creates a ReconstructTask for each lost fragment. Fragment
+// whose Chunk has fewer than DataShards surviving fragments or which has no
+// DataNode to be placed on is returned as unsatisfied. Fragment whose Chunk has
+// been removed is dropped.
+func getReconstructPlan(fragments []Fragment) ([]ReconstructTask, []Fragment) {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	tasks := make([]ReconstructTask, 0, len(fragments))
+	unsatisfied := make([]Fragment, 0)
+	// Fragments of the same Chunk in a batch must be placed on different DataNode.
+	planned := make(map[string][]string)
+	for _, fragment := range fragments {
+		chunk, ok := chunksMap[fragment.ChunkId]
+		if !ok || !chunk.codingScheme.IsErasureCoded() {
+			continue
+		}
+		sources := make([]string, 0, chunk.codingScheme.DataShards)
+		holders := append([]string{}, planned[chunk.Id]...)
+		for _, dataNodeId := range chunk.fragments {
+			if dataNodeId == "" {
+				continue
+			}
+			holders = append(holders, dataNodeId)
+			node, ok := dataNodeMap[dataNodeId]
+			if ok && node.Status == common.Alive && chunk.dataNodes.Contains(dataNodeId) &&
+				len(sources) < chunk.codingScheme.DataShards {
+				sources = append(sources, dataNodeId)
+			}
+		}
+		if len(sources) < chunk.codingScheme.DataShards {
+			Logger.Errorf("Fragment can not be reconstructed now, fragment: %s, surviving: %d",
+				fragment, len(sources))
+			unsatisfied = append(unsatisfied, fragment)
+			continue
+		}
+		targets, err := allocateFragments(1, holders)
+		if err != nil {
+			Logger.Errorf("Fail to allocate a datanode for fragment %s, error detail: %s", fragment, err.Error())
+			unsatisfied = append(unsatisfied, fragment)
+			continue
+		}
+		planned[chunk.Id] = append(planned[chunk.Id], targets[0].Id)
+		tasks = append(tasks, ReconstructTask{
+			ChunkId: chunk.Id,
+			Index:   fragment.Index,
+			Sources: sources,
+			Target:  targets[0].Id,
+		})
+	}
+	return tasks, unsatisfied
+}
+
+// ApplyReconstructPlan places each lost fragment on the target of its
+// ReconstructTask, removes the batch from lostFragmentQueue and puts unsatisfied
+// fragments back.
+func ApplyReconstructPlan(tasks []ReconstructTask, batchLen int, unsatisfied []Fragment) {
+	updateChunksLock.Lock()
+	for _, task := range tasks {
+		chunk, ok := chunksMap[task.ChunkId]
+		if !ok || task.Index >= len(chunk.fragments) || chunk.fragments[task.Index] != "" {
+			continue
+		}
+		chunk.fragments[task.Index] = task.Target
+		chunk.pendingDataNodes.Add(task.Target)
+	}
+	updateChunksLock.Unlock()
+	lostFragmentQueue.BatchPop(batchLen)
+	for _, fragment := range unsatisfied {
+		lostFragmentQueue.Push(fragment)
+	}
+}
+
+// GetReconstructTasks gets all fragments which are placed on the DataNode but
+// have not been stored by it, together with the DataNode to decode them from.
+func GetReconstructTasks(dataNodeId string) []ReconstructTask {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	tasks := make([]ReconstructTask, 0)
+	for _, chunk := range chunksMap {
+		if !chunk.codingScheme.IsErasureCoded() || chunk.dataNodes.Contains(dataNodeId) {
+			continue
+		}
+		for i, fragmentDataNodeId := range chunk.fragments {
+			if fragmentDataNodeId != dataNodeId {
+				continue
+			}
+			sources := make([]string, 0, chunk.codingScheme.DataShards)
+			for _, id := range chunk.fragments {
+				if id != "" && id != dataNodeId && chunk.dataNodes.Contains(id) &&
+					len(sources) < chunk.codingScheme.DataShards {
+					sources = append(sources, id)
+				}
+			}
+			// Fragment which can not be decoded yet, like the ones being written
+			// by client, is skipped.
+			if len(sources) < chunk.codingScheme.DataShards {
+				continue
+			}
+			tasks = append(tasks, ReconstructTask{ChunkId: chunk.Id, Index: i, Sources: sources, Target: dataNodeId})
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].ChunkId != tasks[j].ChunkId {
+			return tasks[i].ChunkId < tasks[j].ChunkId
+		}
+		return tasks[i].Index < tasks[j].Index
+	})
+	return tasks
+}
+
+// restoreLostFragments rebuilds lostFragmentQueue from fragments of all Chunk
+// which are lost. The caller must hold updateChunksLock or be restoring.
+func restoreLostFragments() {
+	lostFragmentQueue = util.NewQueue[Fragment]()
+	ids := make([]string, 0)
+	for id, chunk := range chunksMap {
+		if chunk.codingScheme.IsErasureCoded() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for i, dataNodeId := range chunksMap[id].fragments {
+			if dataNodeId == "" {
+				lostFragmentQueue.Push(Fragment{ChunkId: id, Index: i})
+			}
+		}
+	}
+}
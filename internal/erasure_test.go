@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	set "github.com/deckarep/golang-set"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"strings"
+	"testing"
+	"time"
+	"tinydfs-base/common"
+	"tinydfs-base/protocol/pb"
+	"tinydfs-base/util"
+)
+
+func TestParseCodingScheme(t *testing.T) {
+	scheme, err := ParseCodingScheme("6+3")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, CodingScheme{DataShards: 6, ParityShards: 3}, scheme, "Unexpected scheme.")
+	assert.Equal(t, 9, scheme.FragmentNum(), "Unexpected fragment num.")
+	for _, str := range []string{"", "6", "6+", "a+3", "0+3", "6+0", "-1+3"} {
+		_, err = ParseCodingScheme(str)
+		assert.Error(t, err, "Expected an error, scheme: %s", str)
+	}
+}
+
+func TestErasureCoding_Reconstruct(t *testing.T) {
+	window := viper.GetInt(MasterDegradeRequeueWindow)
+	viper.Set(MasterDegradeRequeueWindow, 0)
+	t.Cleanup(func() {
+		viper.Set(MasterDegradeRequeueWindow, window)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+		lostFragmentQueue = util.NewQueue[Fragment]()
+	})
+	// 10 DataNode in 5 racks.
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("dataNode%d", i)
+		dataNodeMap[id] = &DataNode{
+			Id:               id,
+			Status:           common.Alive,
+			Chunks:           set.NewSet(),
+			FutureSendChunks: make(map[ChunkSendInfo]int),
+			Tags:             map[string]string{"rack": fmt.Sprintf("rack%d", i/2)},
+		}
+	}
+	scheme := CodingScheme{DataShards: 6, ParityShards: 3}
+	indexTestFile(t, "file1", 1)
+	rep, err := AddOperation{
+		FileNodeId:   "file1",
+		ChunkNum:     1,
+		Stage:        common.GetDataNodes,
+		CodingScheme: scheme,
+	}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	fragments := rep.(*pb.GetDataNodes4AddReply).DataNodeIds[0].Items
+	distinct := set.NewSet()
+	rackCount := make(map[string]int)
+	for _, id := range fragments {
+		distinct.Add(id)
+		rackCount[dataNodeMap[id].Tags["rack"]]++
+	}
+	assert.Equal(t, 9, distinct.Cardinality(), "Fragments should be on distinct datanodes.")
+	for rack, count := range rackCount {
+		assert.LessOrEqual(t, count, 2, "Fragments should be spread across racks, rack: %s", rack)
+	}
+
+	// All fragments are stored.
+	chunkId := "file1" + common.ChunkIdDelimiter + "0"
+	chunk := chunksMap[chunkId]
+	for _, id := range fragments {
+		chunk.dataNodes.Add(id)
+		dataNodeMap[id].Chunks.Add(chunkId)
+	}
+	chunk.pendingDataNodes.Clear()
+
+	// The snapshot keeps the scheme and placement.
+	restored, err := parseChunk(strings.TrimSuffix(chunk.String(), "\n"))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, scheme, restored.codingScheme, "Unexpected scheme.")
+	assert.Equal(t, fragments, restored.fragments, "Unexpected fragments.")
+
+	// Lose the third fragment.
+	DegradeDataNode(fragments[2], common.Degrade2Dead, time.Now())
+	assert.Equal(t, 0, pendingChunkQueue.Len(), "Erasure coded chunk should not be replicated.")
+	assert.Equal(t, []Fragment{{ChunkId: chunkId, Index: 2}}, lostFragmentQueue.BatchTop(lostFragmentQueue.Len()),
+		"Lost fragment should be reconstructed.")
+	assert.True(t, strings.HasSuffix(chunk.String(), fragments2String(chunk.fragments)+"\n"),
+		"Fragments should be persisted.")
+	assert.Contains(t, fragments2String(chunk.fragments), " - ", "Lost fragment should be persisted as lost.")
+
+	tasks, unsatisfied := getReconstructPlan(lostFragmentQueue.BatchTop(1))
+	assert.Empty(t, unsatisfied, "Unexpected unsatisfied fragments.")
+	assert.Equal(t, 1, len(tasks), "Unexpected task num.")
+	assert.Equal(t, 6, len(tasks[0].Sources), "Unexpected source num.")
+	assert.NotContains(t, tasks[0].Sources, fragments[2], "Dead datanode can not be a source.")
+	assert.NotContains(t, fragments, tasks[0].Target, "Target should not hold another fragment.")
+
+	ApplyReconstructPlan(tasks, 1, unsatisfied)
+	assert.Equal(t, 0, lostFragmentQueue.Len(), "Unexpected lost fragment num.")
+	assert.Equal(t, tasks[0].Target, chunk.fragments[2], "Fragment should be placed on the target.")
+	assert.Equal(t, tasks, GetReconstructTasks(tasks[0].Target), "Unexpected reconstruct tasks.")
+}
+
+func TestMasterHandler_ErasureCoding(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	handler := newLeaderHandler(t)
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("dataNode%d", i)
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet(),
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	indexTestFile(t, "file1", 1)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(codingSchemeMetadataKey, "2+1"))
+	rep, err := handler.GetDataNodes4Add(ctx, &pb.GetDataNodes4AddArgs{FileNodeId: "file1", ChunkNum: 1})
+	assert.NoError(t, err, "Unexpected error.")
+	fragments := rep.DataNodeIds[0].Items
+	assert.Equal(t, 3, len(fragments), "Each fragment should get a datanode.")
+	chunkId := "file1" + common.ChunkIdDelimiter + "0"
+	assert.Equal(t, CodingScheme{DataShards: 2, ParityShards: 1}, chunksMap[chunkId].codingScheme,
+		"Unexpected scheme.")
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(codingSchemeMetadataKey, "2+"))
+	_, err = handler.GetDataNodes4Add(ctx, &pb.GetDataNodes4AddArgs{FileNodeId: "file1", ChunkNum: 1})
+	assert.Error(t, err, "Expected an error.")
+
+	// The DataNode of the first fragment is told to decode it from the others.
+	for _, id := range fragments[1:] {
+		chunksMap[chunkId].dataNodes.Add(id)
+	}
+	recorder := &headerRecorder{}
+	ctx = grpc.NewContextWithServerTransportStream(context.Background(), recorder)
+	_, err = handler.Heartbeat(ctx, &pb.HeartbeatArgs{Id: fragments[0]})
+	assert.NoError(t, err, "Unexpected error.")
+	values := recorder.header.Get(reconstructTasksMetadataKey)
+	assert.Equal(t, 1, len(values), "Unexpected task num.")
+	task := ReconstructTask{}
+	assert.NoError(t, json.Unmarshal([]byte(values[0]), &task), "Unexpected error.")
+	assert.Equal(t, ReconstructTask{ChunkId: chunkId, Index: 0, Sources: fragments[1:], Target: fragments[0]}, task,
+		"Unexpected reconstruct task.")
+}
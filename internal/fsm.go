@@ -2,16 +2,85 @@ package internal
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/hashicorp/raft"
+	"github.com/spf13/viper"
 	"io"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tinydfs-base/common"
+)
+
+// snapshotDelimiterLine is the SnapshotDelimiter read by bufio.Scanner, which
+// does not contain the line break.
+var snapshotDelimiterLine = strings.TrimSuffix(common.SnapshotDelimiter, "\n")
+
+// Name of each section of snapshot.
+const (
+	sectionDirTree           = "directory tree"
+	sectionDataNodes         = "datanodes"
+	sectionChunks            = "chunks"
+	sectionPendingChunkQueue = "pending chunk queue"
+)
+
+const (
+	// snapshotVersionPrefix starts the header line of a snapshot section, like
+	// "#version:3".
+	snapshotVersionPrefix = "#version:"
+	// appliedIndexPrefix starts the last line of a snapshot, which records the
+	// index of the last log applied before it was taken, like
+	// "#applied-index:42". Snapshots taken by an old master do not have it.
+	appliedIndexPrefix = "#applied-index:"
+	// legacySnapshotVersion is the version of section without a header.
+	legacySnapshotVersion = 1
+	// currentSnapshotVersion is the version of section written by this master.
+	// Increase it and register a migration in snapshotMigrations whenever the
+	// format of any record changes. Version 3 adds optional fields to records
+	// of all sections, the flap, chunk report and chunk size lines of the datanodes section
+	// and the applied index line, so a master which only reads version 2 must
+	// refuse it rather than fail on a record.
+	currentSnapshotVersion = 3
+)
+
+// recordMigration upgrades a record of a snapshot section by one version.
+type recordMigration func(line string) (string, error)
+
+// snapshotMigrations stores migrations of each section, using the version they
+// upgrade from as the key. A missing migration means a record of that version
+// is also a valid record of the next version. Version 2 only adds the header,
+// and records of version 2 are version 3 records without the new optional
+// fields, except that Chunk ids of a file miss the ChunkIdDelimiter.
+var snapshotMigrations = map[string]map[int]recordMigration{
+	sectionDirTree: {2: migrateChunkIds},
+}
+
+var (
+	// applyLock is held by MasterFSM when applying a log or restoring, so that
+	// a snapshot can capture metadata between two logs.
+	applyLock = &sync.RWMutex{}
+	// lastAppliedIndex is the index of the last log applied by MasterFSM. It
+	// is written under applyLock and read atomically, so that reading it does
+	// not wait for the log being applied.
+	lastAppliedIndex uint64
+	// appliedNotify is closed and replaced after each log is applied to wake up
+	// WaitForAppliedIndex. It is protected by appliedNotifyLock.
+	appliedNotify     = make(chan struct{})
+	appliedNotifyLock = &sync.Mutex{}
 )
 
 // ApplyResponse is the reply of MasterFSM's Apply function.
 type ApplyResponse struct {
 	Response interface{}
 	Error    error
+	// Index is the index of the applied log.
+	Index uint64
 }
 
 // MasterFSM implements FSM and make use of the replicated log.
@@ -21,37 +90,98 @@ type MasterFSM struct {
 // Apply calls Apply function of operation, changes to metadata will be made
 // in that function.
 func (ms MasterFSM) Apply(l *raft.Log) interface{} {
-	operation := ConvBytes2Operation(l.Data)
+	applyLock.Lock()
+	defer applyLock.Unlock()
+	defer notifyApplied()
+	// The index is published after the log is applied, so that anyone seeing
+	// it also sees the mutations of the log.
+	defer atomic.StoreUint64(&lastAppliedIndex, l.Index)
+	operation, err := ConvBytes2Operation(l.Data)
+	if err != nil {
+		Logger.Errorf("Fail to decode operation, index: %d, error detail: %s", l.Index, err.Error())
+		return &ApplyResponse{
+			Error: err,
+			Index: l.Index,
+		}
+	}
 	response, err := operation.Apply()
 	return &ApplyResponse{
 		Response: response,
 		Error:    err,
+		Index:    l.Index,
+	}
+}
+
+// notifyApplied wakes up all WaitForAppliedIndex.
+func notifyApplied() {
+	appliedNotifyLock.Lock()
+	defer appliedNotifyLock.Unlock()
+	close(appliedNotify)
+	appliedNotify = make(chan struct{})
+}
+
+// getLastAppliedIndex gets the index of the last log which has been applied
+// completely.
+func getLastAppliedIndex() uint64 {
+	return atomic.LoadUint64(&lastAppliedIndex)
+}
+
+// WaitForAppliedIndex blocks until the log of the given index has been applied
+// by this master, so that a read after it sees all mutations up to the index.
+// It returns an error if ctx is done before that.
+func WaitForAppliedIndex(ctx context.Context, index uint64) error {
+	for {
+		// Get the channel before checking the index, so that a log applied in
+		// between is not missed.
+		appliedNotifyLock.Lock()
+		notify := appliedNotify
+		appliedNotifyLock.Unlock()
+		applied := getLastAppliedIndex()
+		if applied >= index {
+			return nil
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return fmt.Errorf("master is behind the required index, applied: %d, required: %d", applied, index)
+		}
 	}
 }
 
-// ConvBytes2Operation uses reflect to restore operation from data.
-func ConvBytes2Operation(data []byte) Operation {
+// ConvBytes2Operation uses reflect to restore operation from data. It fails if
+// the operation type has not been registered by RegisterOperationType.
+func ConvBytes2Operation(data []byte) (Operation, error) {
 	opContainer := OpContainer{}
-	var operation Operation
 	err := json.Unmarshal(data, &opContainer)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("fail to decode operation container, error detail: %s", err.Error())
 	}
-	operation = reflect.New(OpTypeMap[opContainer.OpType]).Interface().(Operation)
+	opType, ok := OpTypeMap[opContainer.OpType]
+	if !ok {
+		return nil, fmt.Errorf("unknown operation type: %q", opContainer.OpType)
+	}
+	operation := reflect.New(opType).Interface().(Operation)
 	err = json.Unmarshal(opContainer.OpData, operation)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("fail to decode operation, operation type: %s, error detail: %s",
+			opContainer.OpType, err.Error())
 	}
-	return operation
+	return operation, nil
 }
 
 func (ms MasterFSM) Snapshot() (raft.FSMSnapshot, error) {
-	return &snapshot{}, nil
+	data, err := captureMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{data: data}, nil
 }
 
 // Restore read snapshot and restore metadata from it. There are three part of metadata
 // need to be restored: directory tree, DataNode information and Chunk information
 func (ms MasterFSM) Restore(r io.ReadCloser) error {
+	applyLock.Lock()
+	defer applyLock.Unlock()
 	buf := bufio.NewScanner(r)
 	err := RestoreDirTree(buf)
 	if err != nil {
@@ -69,37 +199,331 @@ func (ms MasterFSM) Restore(r io.ReadCloser) error {
 	if err != nil {
 		return err
 	}
+	err = restoreAppliedIndex(buf)
+	if err != nil {
+		return err
+	}
 	return r.Close()
 }
 
+// restoreAppliedIndex reads the applied index at the end of the snapshot and
+// wakes up WaitForAppliedIndex, so that reads waiting for a log covered by the
+// snapshot do not wait for the next log. The applied index is kept if the
+// snapshot does not have it.
+func restoreAppliedIndex(buf *bufio.Scanner) error {
+	defer notifyApplied()
+	if !buf.Scan() {
+		return buf.Err()
+	}
+	line := buf.Text()
+	if !strings.HasPrefix(line, appliedIndexPrefix) {
+		return fmt.Errorf("unexpected line at the end of snapshot: %q", line)
+	}
+	index, err := strconv.ParseUint(strings.TrimPrefix(line, appliedIndexPrefix), 10, 64)
+	if err != nil {
+		return fmt.Errorf("illegal applied index in snapshot: %q", line)
+	}
+	atomic.StoreUint64(&lastAppliedIndex, index)
+	return nil
+}
+
+// isSnapshotDelimiter checks whether the given line is the end of a snapshot
+// section.
+func isSnapshotDelimiter(line string) bool {
+	return line == snapshotDelimiterLine
+}
+
+// checkSectionEnd is called when the scan of a snapshot section stops before
+// meeting the SnapshotDelimiter. It means the snapshot is corrupt, so it always
+// returns an error to stop restoring partial metadata.
+func checkSectionEnd(buf *bufio.Scanner, section string) error {
+	if err := buf.Err(); err != nil {
+		return fmt.Errorf("fail to read snapshot section %s, error detail: %s", section, err.Error())
+	}
+	return fmt.Errorf("snapshot section %s is truncated, delimiter not found", section)
+}
+
+// SectionReport is the result of validating a section of snapshot.
+type SectionReport struct {
+	Section string
+	// Records is the number of well-formed records in the section.
+	Records int
+	// Errors are all malformed records in the section.
+	Errors []*LineError
+	// Terminated is true if the section ends with the SnapshotDelimiter.
+	Terminated bool
+}
+
+// IsValid returns true if the section can be restored.
+func (r *SectionReport) IsValid() bool {
+	return r.Terminated && len(r.Errors) == 0
+}
+
+// LineError is a malformed record in a section of snapshot.
+type LineError struct {
+	// Line is the line number of the record in the section, starting from 1.
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+// writeSectionHeader writes the header with the current version at the start of
+// a snapshot section.
+func writeSectionHeader(sink io.Writer) error {
+	_, err := fmt.Fprintf(sink, "%s%d\n", snapshotVersionPrefix, currentSnapshotVersion)
+	return err
+}
+
+// parseSectionHeader checks whether the line is a section header and gets the
+// version in it. A version newer than currentSnapshotVersion can not be read.
+func parseSectionHeader(line string) (int, bool, error) {
+	if !strings.HasPrefix(line, snapshotVersionPrefix) {
+		return 0, false, nil
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(line, snapshotVersionPrefix))
+	if err != nil || version < legacySnapshotVersion {
+		return 0, true, fmt.Errorf("illegal snapshot section header: %q", line)
+	}
+	if version > currentSnapshotVersion {
+		return 0, true, fmt.Errorf("snapshot version %d is newer than the supported version %d", version,
+			currentSnapshotVersion)
+	}
+	return version, true, nil
+}
+
+// migrateRecord upgrades a record of the section from the given version to
+// currentSnapshotVersion.
+func migrateRecord(section string, line string, version int) (string, error) {
+	var err error
+	for v := version; v < currentSnapshotVersion; v++ {
+		migration, ok := snapshotMigrations[section][v]
+		if !ok {
+			continue
+		}
+		if line, err = migration(line); err != nil {
+			return "", fmt.Errorf("fail to migrate record from version %d, error detail: %s", v, err.Error())
+		}
+	}
+	return line, nil
+}
+
+// scanSection reads all records of a snapshot section until the
+// SnapshotDelimiter is met. Each record is upgraded to the current version
+// before being passed to handle, so that handle only needs to know the current
+// format.
+func scanSection(buf *bufio.Scanner, section string, handle func(line string) error) error {
+	version := legacySnapshotVersion
+	isFirst := true
+	for buf.Scan() {
+		line := buf.Text()
+		if isFirst {
+			isFirst = false
+			v, isHeader, err := parseSectionHeader(line)
+			if err != nil {
+				return fmt.Errorf("fail to read snapshot section %s, error detail: %s", section, err.Error())
+			}
+			if isHeader {
+				version = v
+				continue
+			}
+		}
+		if isSnapshotDelimiter(line) {
+			return nil
+		}
+		line, err := migrateRecord(section, line, version)
+		if err != nil {
+			return err
+		}
+		if err = handle(line); err != nil {
+			return err
+		}
+	}
+	return checkSectionEnd(buf, section)
+}
+
+// validateSection parses all records of a section by the given parse function
+// until the SnapshotDelimiter is met. Unlike restoring, it goes on after a
+// malformed record so that all of them are reported.
+func validateSection(buf *bufio.Scanner, section string, parse func(line string) error) *SectionReport {
+	report := &SectionReport{
+		Section: section,
+		Errors:  make([]*LineError, 0),
+	}
+	version := legacySnapshotVersion
+	line := 0
+	for buf.Scan() {
+		line++
+		if line == 1 {
+			v, isHeader, err := parseSectionHeader(buf.Text())
+			if err != nil {
+				report.Errors = append(report.Errors, &LineError{Line: line, Err: err})
+				continue
+			}
+			if isHeader {
+				version = v
+				continue
+			}
+		}
+		if isSnapshotDelimiter(buf.Text()) {
+			report.Terminated = true
+			return report
+		}
+		record, err := migrateRecord(section, buf.Text(), version)
+		if err == nil {
+			err = parse(record)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, &LineError{Line: line, Err: err})
+			continue
+		}
+		report.Records++
+	}
+	return report
+}
+
+// Durability mode of snapshots, see master.snapshotDurability.
+const (
+	// SnapshotSyncAlways syncs every snapshot before it is marked complete.
+	SnapshotSyncAlways = "sync"
+	// SnapshotSyncPeriodic only syncs a snapshot if the last sync is older than
+	// master.snapshotSyncInterval.
+	SnapshotSyncPeriodic = "periodic"
+	// SnapshotSyncNone never syncs snapshots explicitly and leaves flushing to
+	// the OS.
+	SnapshotSyncNone = "none"
+)
+
+// lastSnapshotSync is the unix nano time of the last sync of a snapshot.
+var lastSnapshotSync int64
+
+// syncer is a raft.SnapshotSink which can flush written data to stable storage.
+type syncer interface {
+	Sync() error
+}
+
+// syncSnapshotSink syncs the sink according to the durability mode. A sink
+// which can not be synced is left to make the snapshot durable by itself when
+// it is closed, as raft.FileSnapshotSink does.
+func syncSnapshotSink(sink raft.SnapshotSink, now time.Time) error {
+	s, ok := sink.(syncer)
+	if !ok {
+		return nil
+	}
+	switch mode := viper.GetString(MasterSnapshotDurability); mode {
+	case SnapshotSyncNone:
+		return nil
+	case SnapshotSyncPeriodic:
+		interval := time.Duration(viper.GetInt(MasterSnapshotSyncInterval)) * time.Second
+		if interval <= 0 {
+			interval = defaultSnapshotSyncInterval * time.Second
+		}
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&lastSnapshotSync))) < interval {
+			return nil
+		}
+	case SnapshotSyncAlways, "":
+	default:
+		Logger.Warnf("Unknown snapshot durability mode %q, sync is used.", mode)
+	}
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&lastSnapshotSync, now.UnixNano())
+	return nil
+}
+
 type snapshot struct {
+	// data is all metadata serialized at the moment the snapshot is taken.
+	data []byte
 }
 
 // Persist Take a snapshot of current metadata and save it as a file.
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
 	Logger.Infof("Start to persist a snapshot of metadata.")
+	if s.data == nil {
+		data, err := captureMetadata()
+		if err != nil {
+			_ = sink.Cancel()
+			return err
+		}
+		s.data = data
+	}
+	if _, err := sink.Write(s.data); err != nil {
+		Logger.Errorf("Fail to persist metadata, error detail: %s", err.Error())
+		_ = sink.Cancel()
+		return err
+	}
+	// The snapshot is marked complete once the sink is closed, so it must be
+	// synced before that to survive a crash.
+	if err := syncSnapshotSink(sink, time.Now()); err != nil {
+		Logger.Errorf("Fail to sync snapshot, error detail: %s", err.Error())
+		_ = sink.Cancel()
+		return err
+	}
+	Logger.Infof("Success to persist a snapshot of metadata.")
+	return sink.Close()
+}
+
+// captureMetadata serializes the directory tree, DataNode, Chunk and
+// pendingChunkQueue in a single critical section, so that all sections of a
+// snapshot describe the same moment, e.g. a DataNode never lists a Chunk which
+// does not list the DataNode. Metadata is copied into memory, so the slow
+// writing of the snapshot does not block applying logs.
+func captureMetadata() ([]byte, error) {
+	applyLock.RLock()
+	defer applyLock.RUnlock()
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	sink := &bufferSink{}
 	err := PersistDirTree(sink)
 	if err != nil {
 		Logger.Errorf("Fail to persist directory tree, error detail: %s", err.Error())
-		return err
+		return nil, err
 	}
 	err = PersistDataNodes(sink)
 	if err != nil {
 		Logger.Errorf("Fail to persist datanodes, error detail: %s", err.Error())
-		return err
+		return nil, err
 	}
 	err = PersistChunks(sink)
 	if err != nil {
 		Logger.Errorf("Fail to persist chunks, error detail: %s", err.Error())
-		return err
+		return nil, err
 	}
-	err = PersistPendingChunkQueue(sink)
+	err = persistPendingChunkQueue(sink)
 	if err != nil {
 		Logger.Errorf("Fail to persist pending chunk queue, error detail: %s", err.Error())
-		return err
+		return nil, err
 	}
-	Logger.Infof("Success to persist a snapshot of metadata.")
-	return sink.Close()
+	_, err = fmt.Fprintf(sink, "%s%d\n", appliedIndexPrefix, lastAppliedIndex)
+	if err != nil {
+		Logger.Errorf("Fail to persist applied index, error detail: %s", err.Error())
+		return nil, err
+	}
+	return sink.Bytes(), nil
+}
+
+// bufferSink is a raft.SnapshotSink which keeps all data in memory.
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string {
+	return "buffer"
+}
+
+func (s *bufferSink) Cancel() error {
+	return nil
+}
+
+func (s *bufferSink) Close() error {
+	return nil
 }
 
 func (s *snapshot) Release() {
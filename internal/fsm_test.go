@@ -0,0 +1,417 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	set "github.com/deckarep/golang-set"
+	"github.com/hashicorp/raft"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+	"tinydfs-base/common"
+	"tinydfs-base/util"
+)
+
+// legacySnapshot returns a snapshot written before section headers and any
+// optional field were introduced.
+func legacySnapshot() string {
+	return strings.Join([]string{
+		fmt.Sprintf("legacyRoot$$%s$[legacyFile]$[]$0$false$<nil>$false", common.MinusOneString),
+		"legacyFile$a.txt$legacyRoot$[]$[legacyFile_0]$10$true$<nil>$false",
+	}, "\n") + "\n" + common.SnapshotDelimiter +
+		fmt.Sprintf("legacyDataNode$%d$127.0.0.1$[legacyFile_0]$0$100$10$[]$2022-01-01.00.00.00\n", common.Alive) +
+		common.SnapshotDelimiter +
+		"legacyFile_0$[legacyDataNode]$[]\n" + common.SnapshotDelimiter +
+		"\n" + common.SnapshotDelimiter
+}
+
+func TestMasterFSM_RestoreLegacySnapshot(t *testing.T) {
+	oldRoot := root
+	t.Cleanup(func() {
+		root = oldRoot
+		chunksMap = map[string]*Chunk{}
+		dataNodeMap = map[string]*DataNode{}
+		namespaceRoots = make(map[string]*FileNode)
+		fileNodeIdSet.Clear()
+	})
+
+	err := MasterFSM{}.Restore(io.NopCloser(strings.NewReader(legacySnapshot())))
+	assert.NoError(t, err)
+	fileNode, err := CheckAndGetFileNode("/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "legacyFile", fileNode.Id)
+	assert.Equal(t, 0, fileNode.ReplicaFactor)
+	assert.Equal(t, "", fileNode.Constraint.String())
+	assert.Equal(t, 0, fileNode.MinReadReplicas)
+	chunk := chunksMap["legacyFile_0"]
+	assert.NotNil(t, chunk)
+	assert.True(t, chunk.dataNodes.Contains("legacyDataNode"))
+	assert.Nil(t, chunk.pinnedDataNodes)
+	assert.Equal(t, 0, chunk.minAckNum)
+	assert.False(t, chunk.codingScheme.IsErasureCoded())
+	dataNode := dataNodeMap["legacyDataNode"]
+	assert.NotNil(t, dataNode)
+	assert.Equal(t, 0, len(dataNode.Tags))
+
+	// A snapshot taken now carries the current version in every section and
+	// can be restored again.
+	sink := &memorySink{}
+	assert.NoError(t, (&snapshot{}).Persist(sink))
+	data := sink.String()
+	sections := strings.Split(data, common.SnapshotDelimiter)
+	assert.Equal(t, 5, len(sections))
+	for _, section := range sections[:4] {
+		assert.True(t, strings.HasPrefix(section, fmt.Sprintf("%s%d\n", snapshotVersionPrefix, currentSnapshotVersion)))
+	}
+	err = MasterFSM{}.Restore(io.NopCloser(strings.NewReader(data)))
+	assert.NoError(t, err)
+	_, err = CheckAndGetFileNode("/a.txt")
+	assert.NoError(t, err)
+	assert.True(t, chunksMap["legacyFile_0"].dataNodes.Contains("legacyDataNode"))
+
+	// Records of version 2 are restored with Chunk ids of files rebuilt.
+	v2Sections := strings.Split(strings.Replace(legacySnapshot(), "[legacyFile_0]$10$true", "[legacyFile0]$10$true", 1),
+		common.SnapshotDelimiter)
+	for i := range v2Sections[:4] {
+		v2Sections[i] = fmt.Sprintf("%s2\n", snapshotVersionPrefix) + v2Sections[i]
+	}
+	err = MasterFSM{}.Restore(io.NopCloser(strings.NewReader(strings.Join(v2Sections, common.SnapshotDelimiter))))
+	assert.NoError(t, err)
+	fileNode, err = CheckAndGetFileNode("/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"legacyFile_0"}, fileNode.Chunks)
+	assert.True(t, dataNodeMap["legacyDataNode"].Chunks.Contains("legacyFile_0"))
+
+	// A snapshot of a newer version must not be restored partially.
+	newer := fmt.Sprintf("%s%d\n", snapshotVersionPrefix, currentSnapshotVersion+1) + legacySnapshot()
+	err = MasterFSM{}.Restore(io.NopCloser(bytes.NewBufferString(newer)))
+	assert.Error(t, err)
+}
+
+func TestMasterFSM_RestoreLegacyChunkIds(t *testing.T) {
+	oldRoot := root
+	t.Cleanup(func() {
+		root = oldRoot
+		chunksMap = map[string]*Chunk{}
+		dataNodeMap = map[string]*DataNode{}
+		namespaceRoots = make(map[string]*FileNode)
+		fileNodeIdSet.Clear()
+	})
+	// Old versions stored Chunk ids of a file without the ChunkIdDelimiter,
+	// while chunks and DataNode already used it.
+	size := 2*common.ChunkSize + 1
+	legacy := strings.Join([]string{
+		fmt.Sprintf("legacyRoot$$%s$[legacyFile]$[]$0$false$<nil>$false", common.MinusOneString),
+		fmt.Sprintf("legacyFile$a.txt$legacyRoot$[]$[legacyFile0 legacyFile1 legacyFile2]$%d$true$<nil>$false", size),
+	}, "\n") + "\n" + common.SnapshotDelimiter +
+		fmt.Sprintf("legacyDataNode$%d$127.0.0.1$[legacyFile_2]$0$100$10$[]$2022-01-01.00.00.00\n", common.Alive) +
+		common.SnapshotDelimiter +
+		"legacyFile_2$[legacyDataNode]$[]\n" + common.SnapshotDelimiter +
+		"\n" + common.SnapshotDelimiter
+
+	err := MasterFSM{}.Restore(io.NopCloser(strings.NewReader(legacy)))
+	assert.NoError(t, err)
+	fileNode, err := CheckAndGetFileNode("/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"legacyFile_0", "legacyFile_1", "legacyFile_2"}, fileNode.Chunks,
+		"Chunk ids of a legacy file should be rebuilt in order.")
+	chunkIds, err := GetFileChunkIds("/a.txt")
+	assert.NoError(t, err)
+	assert.Contains(t, chunksMap, chunkIds[2], "Rebuilt id should address the restored chunk.")
+	assert.True(t, dataNodeMap["legacyDataNode"].Chunks.Contains(chunkIds[2]))
+}
+
+func TestWaitForAppliedIndex(t *testing.T) {
+	index := lastAppliedIndex
+	timeout := viper.GetInt(MasterReadIndexTimeout)
+	t.Cleanup(func() {
+		lastAppliedIndex = index
+		viper.Set(MasterReadIndexTimeout, timeout)
+	})
+	lastAppliedIndex = 10
+	data := getData4Apply(&ReleaseStagedOperation{}, OperationReleaseStaged)
+
+	// The index of the applied log is returned for read-your-writes.
+	response := MasterFSM{}.Apply(&raft.Log{Index: 11, Data: data}).(*ApplyResponse)
+	assert.NoError(t, response.Error)
+	assert.Equal(t, uint64(11), response.Index)
+	assert.NoError(t, WaitForAppliedIndex(context.Background(), 11))
+
+	// A read with a future index waits until the log is applied.
+	done := make(chan error)
+	go func() {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(minIndexMetadataKey, "13"))
+		done <- waitForMinIndex(ctx)
+	}()
+	MasterFSM{}.Apply(&raft.Log{Index: 12, Data: data})
+	select {
+	case <-done:
+		t.Fatal("Read should wait until the index is applied.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	MasterFSM{}.Apply(&raft.Log{Index: 13, Data: data})
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Read should be woken up after the index is applied.")
+	}
+
+	// A read fails if the master can not catch up in time.
+	viper.Set(MasterReadIndexTimeout, 10)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(minIndexMetadataKey, "14"))
+	assert.Error(t, waitForMinIndex(ctx))
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(minIndexMetadataKey, "abc"))
+	assert.Error(t, waitForMinIndex(ctx))
+	assert.NoError(t, waitForMinIndex(context.Background()))
+}
+
+func TestMasterFSM_RestoreAppliedIndex(t *testing.T) {
+	index := lastAppliedIndex
+	oldRoot := root
+	t.Cleanup(func() {
+		lastAppliedIndex = index
+		root = oldRoot
+		chunksMap = map[string]*Chunk{}
+		dataNodeMap = map[string]*DataNode{}
+		namespaceRoots = make(map[string]*FileNode)
+		fileNodeIdSet.Clear()
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	lastAppliedIndex = 20
+	data, err := captureMetadata()
+	assert.NoError(t, err)
+	lastAppliedIndex = 5
+
+	// A read waiting for a log covered by the snapshot is woken up by Restore.
+	done := make(chan error)
+	go func() {
+		done <- WaitForAppliedIndex(context.Background(), 20)
+	}()
+	assert.NoError(t, MasterFSM{}.Restore(io.NopCloser(bytes.NewReader(data))))
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Read should be woken up after the snapshot is restored.")
+	}
+	assert.Equal(t, uint64(20), getLastAppliedIndex())
+}
+
+func TestMasterFSM_RestoreDuplicateName(t *testing.T) {
+	oldRoot := root
+	t.Cleanup(func() {
+		root = oldRoot
+		chunksMap = map[string]*Chunk{}
+		dataNodeMap = map[string]*DataNode{}
+		namespaceRoots = make(map[string]*FileNode)
+		fileNodeIdSet.Clear()
+	})
+	snapshot := strings.Join([]string{
+		fmt.Sprintf("dupRoot$$%s$[dupFile2 dupFile1]$[]$0$false$<nil>$false", common.MinusOneString),
+		"dupFile1$a.txt$dupRoot$[]$[]$10$true$<nil>$false",
+		"dupFile2$a.txt$dupRoot$[]$[]$20$true$<nil>$false",
+	}, "\n") + "\n" + common.SnapshotDelimiter + common.SnapshotDelimiter +
+		common.SnapshotDelimiter + common.SnapshotDelimiter
+
+	err := MasterFSM{}.Restore(io.NopCloser(strings.NewReader(snapshot)))
+	assert.NoError(t, err)
+	// Both nodes survive and the one with the smaller id keeps its name.
+	assert.Equal(t, 2, len(root.ChildNodes))
+	fileNode, err := CheckAndGetFileNode("/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "dupFile1", fileNode.Id)
+	fileNode, err = CheckAndGetFileNode("/a.txt" + deleteDelimiter + "dupFile2")
+	assert.NoError(t, err)
+	assert.Equal(t, "dupFile2", fileNode.Id)
+	assert.Equal(t, int64(30), root.subtreeSize)
+}
+
+func TestMasterFSM_SnapshotConsistent(t *testing.T) {
+	index := lastAppliedIndex
+	oldRoot := root
+	t.Cleanup(func() {
+		lastAppliedIndex = index
+		root = oldRoot
+		chunksMap = map[string]*Chunk{}
+		dataNodeMap = map[string]*DataNode{}
+		namespaceRoots = make(map[string]*FileNode)
+		fileNodeIdSet.Clear()
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	for _, id := range []string{"dataNode1", "dataNode2"} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet(),
+			FutureSendChunks: make(map[ChunkSendInfo]int), HeartbeatTime: time.Now()}
+	}
+	dataNodeMap["dataNode1"].Chunks.Add("chunk1")
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+
+	// Heartbeats keep moving chunk1 between the two DataNode.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		from, to := "dataNode1", "dataNode2"
+		for i := uint64(1); ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			data := getData4Apply(&HeartbeatOperation{
+				DataNodeId: from,
+				SuccessInfos: []ChunkSendInfo{
+					{ChunkId: "chunk1", DataNodeId: to, SendType: common.MoveSendType},
+				},
+			}, common.OperationHeartbeat)
+			MasterFSM{}.Apply(&raft.Log{Index: index + i, Data: data})
+			from, to = to, from
+		}
+	}()
+	snapshots := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		fsmSnapshot, err := MasterFSM{}.Snapshot()
+		assert.NoError(t, err)
+		sink := &memorySink{}
+		assert.NoError(t, fsmSnapshot.Persist(sink))
+		snapshots = append(snapshots, sink.String())
+	}
+	close(done)
+	<-stopped
+
+	for _, data := range snapshots {
+		dataNodeMap = map[string]*DataNode{}
+		assert.NoError(t, MasterFSM{}.Restore(io.NopCloser(strings.NewReader(data))))
+		report := VerifyNamespace()
+		assert.True(t, report.IsValid(), "%v", report.Issues)
+		// The chunk section and the datanode section agree on where chunk1 is.
+		holders := make([]string, 0)
+		for id, dataNode := range dataNodeMap {
+			if dataNode.Chunks.Contains("chunk1") {
+				holders = append(holders, id)
+			}
+		}
+		assert.Equal(t, set2SortedStrings(chunksMap["chunk1"].dataNodes), holders)
+	}
+}
+
+// syncRecordingSink records the order of Sync, Close and Cancel.
+type syncRecordingSink struct {
+	memorySink
+	calls []string
+}
+
+func (s *syncRecordingSink) Sync() error {
+	s.calls = append(s.calls, "sync")
+	return nil
+}
+
+func (s *syncRecordingSink) Close() error {
+	s.calls = append(s.calls, "close")
+	return nil
+}
+
+func (s *syncRecordingSink) Cancel() error {
+	s.calls = append(s.calls, "cancel")
+	return nil
+}
+
+func TestSnapshot_PersistDurability(t *testing.T) {
+	mode := viper.GetString(MasterSnapshotDurability)
+	interval := viper.GetInt(MasterSnapshotSyncInterval)
+	t.Cleanup(func() {
+		viper.Set(MasterSnapshotDurability, mode)
+		viper.Set(MasterSnapshotSyncInterval, interval)
+		atomic.StoreInt64(&lastSnapshotSync, 0)
+	})
+	persist := func() []string {
+		sink := &syncRecordingSink{}
+		assert.NoError(t, (&snapshot{data: []byte("data")}).Persist(sink))
+		assert.Equal(t, "data", sink.String())
+		return sink.calls
+	}
+
+	// The snapshot is synced before it is marked complete.
+	viper.Set(MasterSnapshotDurability, SnapshotSyncAlways)
+	assert.Equal(t, []string{"sync", "close"}, persist())
+	assert.Equal(t, []string{"sync", "close"}, persist())
+
+	// Only the first snapshot in an interval is synced.
+	viper.Set(MasterSnapshotDurability, SnapshotSyncPeriodic)
+	viper.Set(MasterSnapshotSyncInterval, 3600)
+	atomic.StoreInt64(&lastSnapshotSync, 0)
+	assert.Equal(t, []string{"sync", "close"}, persist())
+	assert.Equal(t, []string{"close"}, persist())
+
+	viper.Set(MasterSnapshotDurability, SnapshotSyncNone)
+	assert.Equal(t, []string{"close"}, persist())
+}
+
+// doubleOperation is an Operation registered by the test.
+type doubleOperation struct {
+	Id    string `json:"id"`
+	Value int    `json:"value"`
+}
+
+func (o doubleOperation) Apply() (interface{}, error) {
+	return o.Value * 2, nil
+}
+
+func TestMasterFSM_ApplyRegisteredOperation(t *testing.T) {
+	const opType = "TestDouble"
+	appliedIndex := getLastAppliedIndex()
+	t.Cleanup(func() {
+		delete(OpTypeMap, opType)
+		lastAppliedIndex = appliedIndex
+	})
+	RegisterOperationType(opType, &doubleOperation{})
+	assert.Panics(t, func() {
+		RegisterOperationType(opType, doubleOperation{})
+	}, "Operation type can not be registered twice.")
+	assert.Panics(t, func() {
+		RegisterOperationType(common.OperationHeartbeat, doubleOperation{})
+	}, "Built-in operation type can not be registered again.")
+
+	fsm := MasterFSM{}
+	data := getData4Apply(doubleOperation{Value: 21}, opType)
+	response := fsm.Apply(&raft.Log{Index: 1, Data: data}).(*ApplyResponse)
+	assert.NoError(t, response.Error, "Unexpected error.")
+	assert.Equal(t, 42, response.Response, "Operation should be dispatched to its type.")
+
+	// An unknown operation type or a malformed payload is an error instead of
+	// a panic.
+	data = getData4Apply(doubleOperation{}, "TestUnknown")
+	response = fsm.Apply(&raft.Log{Index: 2, Data: data}).(*ApplyResponse)
+	assert.EqualError(t, response.Error, `unknown operation type: "TestUnknown"`)
+	assert.Equal(t, uint64(2), response.Index, "Unexpected index.")
+	data = []byte(`{"op_type":"TestDouble","op_data":{"value":"x"}}`)
+	response = fsm.Apply(&raft.Log{Index: 3, Data: data}).(*ApplyResponse)
+	assert.Error(t, response.Error, "Expected an error.")
+	assert.Equal(t, uint64(3), getLastAppliedIndex(), "Failed log should still be applied.")
+}
+
+func TestMigrateChunkIds(t *testing.T) {
+	file := fmt.Sprintf("file$a.txt$root$[]$[file0 file1]$%d$true$<nil>$false", common.ChunkSize+1)
+	line, err := migrateRecord(sectionDirTree, file, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("file$a.txt$root$[]$[file_0 file_1]$%d$true$<nil>$false", common.ChunkSize+1), line)
+	line, err = migrateRecord(sectionDirTree, file, legacySnapshotVersion)
+	assert.NoError(t, err)
+	assert.Contains(t, line, "[file_0 file_1]")
+
+	// Records of the current version and directories are kept.
+	line, err = migrateRecord(sectionDirTree, file, currentSnapshotVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, file, line)
+	dir := "dir$d$root$[file]$[]$0$false$<nil>$false"
+	line, err = migrateRecord(sectionDirTree, dir, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, dir, line)
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	// fileNameInterns includes the shared copy of each interned FileName, using
+	// the name as the key. Names are never evicted, so its size is limited by
+	// master.fileNameInternSize. It is protected by fileNameInternLock.
+	fileNameInterns    = make(map[string]string)
+	fileNameInternLock = &sync.Mutex{}
+)
+
+// internFileName returns the shared copy of the name, so that FileNode with the
+// same name, such as date-partitioned directories, share one backing string. The
+// name itself is returned if interning is disabled or the pool is full, which
+// only costs memory. It never changes the value of the name.
+func internFileName(name string) string {
+	maxSize := viper.GetInt(MasterFileNameInternSize)
+	if maxSize <= 0 {
+		return name
+	}
+	fileNameInternLock.Lock()
+	defer fileNameInternLock.Unlock()
+	if interned, ok := fileNameInterns[name]; ok {
+		return interned
+	}
+	if len(fileNameInterns) >= maxSize {
+		return name
+	}
+	// The name may be a part of a larger string such as a line of snapshot, so
+	// a copy is kept to not pin the larger one.
+	interned := string([]byte(name))
+	fileNameInterns[interned] = interned
+	return interned
+}
+
+// resetFileNameInterns forgets all interned names, which is done when the
+// directory tree is replaced by a snapshot.
+func resetFileNameInterns() {
+	fileNameInternLock.Lock()
+	defer fileNameInternLock.Unlock()
+	fileNameInterns = make(map[string]string)
+}
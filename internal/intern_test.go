@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// addPartitions adds dirNum directories, each of which has a child directory
+// for each day. Every name is built separately, so that it has its own backing
+// string unless it is interned.
+func addPartitions(tb testing.TB, dirNum int, dayNum int) []*FileNode {
+	days := make([]*FileNode, 0, dirNum*dayNum)
+	for i := 0; i < dirNum; i++ {
+		dir, err := AddFileNode("/", fmt.Sprintf("table%d", i), 0, false)
+		assert.NoError(tb, err, "Unexpected error.")
+		for j := 0; j < dayNum; j++ {
+			day, err := AddFileNode("/"+dir.FileName, fmt.Sprintf("dt=2026-10-%02d", j+1), 0, false)
+			assert.NoError(tb, err, "Unexpected error.")
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// countBackingStrings counts the distinct backing arrays of names of the given
+// FileNode and of the keys they have in ChildNodes of their parent.
+func countBackingStrings(fileNodes []*FileNode) int {
+	pointers := make(map[uintptr]bool)
+	for _, fileNode := range fileNodes {
+		pointers[(*reflect.StringHeader)(unsafe.Pointer(&fileNode.FileName)).Data] = true
+		for name, child := range fileNode.ParentNode.ChildNodes {
+			if child == fileNode {
+				pointers[(*reflect.StringHeader)(unsafe.Pointer(&name)).Data] = true
+			}
+		}
+	}
+	return len(pointers)
+}
+
+func TestInternFileName(t *testing.T) {
+	internSize := viper.GetInt(MasterFileNameInternSize)
+	t.Cleanup(func() {
+		viper.Set(MasterFileNameInternSize, internSize)
+		resetFileNameInterns()
+		root.ChildNodes = map[string]*FileNode{}
+		root.subtreeSize = 0
+	})
+
+	viper.Set(MasterFileNameInternSize, 0)
+	days := addPartitions(t, 50, 4)
+	assert.Equal(t, 200, countBackingStrings(days), "Names should not be shared without interning.")
+	root.ChildNodes = map[string]*FileNode{}
+
+	viper.Set(MasterFileNameInternSize, 1000)
+	days = addPartitions(t, 50, 4)
+	assert.Equal(t, 4, countBackingStrings(days), "Same names should be shared.")
+	_, err := RenameFileNode("/table0/dt=2026-10-01", "dt=2026-10-02.bak", time.Now())
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = RenameFileNode("/table1/dt=2026-10-01", "dt=2026-10-02.bak", time.Now())
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 5, countBackingStrings(days), "Renamed names should be shared.")
+	_, isExist := getFileNodeFrom(root, "/table1/dt=2026-10-02.bak")
+	assert.True(t, isExist, "Interning should not change the name.")
+
+	// The pool is filled by the name of the first directory, so names of days
+	// are kept as they are.
+	resetFileNameInterns()
+	viper.Set(MasterFileNameInternSize, 1)
+	root.ChildNodes = map[string]*FileNode{}
+	days = addPartitions(t, 2, 2)
+	assert.Equal(t, 4, countBackingStrings(days), "Names beyond the pool size should not be shared.")
+}
+
+func BenchmarkAddFileNode_Intern(b *testing.B) {
+	internSize := viper.GetInt(MasterFileNameInternSize)
+	b.Cleanup(func() {
+		viper.Set(MasterFileNameInternSize, internSize)
+		resetFileNameInterns()
+		root.ChildNodes = map[string]*FileNode{}
+		root.subtreeSize = 0
+	})
+	for _, size := range []int{0, 1 << 16} {
+		b.Run(fmt.Sprintf("InternSize%d", size), func(b *testing.B) {
+			viper.Set(MasterFileNameInternSize, size)
+			stats := &runtime.MemStats{}
+			retained := uint64(0)
+			for i := 0; i < b.N; i++ {
+				root.ChildNodes = map[string]*FileNode{}
+				resetFileNameInterns()
+				runtime.GC()
+				runtime.ReadMemStats(stats)
+				before := stats.HeapAlloc
+				addPartitions(b, 100, 30)
+				runtime.GC()
+				runtime.ReadMemStats(stats)
+				retained += stats.HeapAlloc - before
+			}
+			b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+		})
+	}
+}
@@ -7,8 +7,11 @@ import (
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	"tinydfs-base/config"
 	"tinydfs-base/util"
@@ -21,6 +24,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
@@ -30,6 +34,9 @@ import (
 
 const (
 	ttl = 5
+	// Role of a master in the raft cluster.
+	leaderRole   = "leader"
+	followerRole = "follower"
 )
 
 var GlobalMasterHandler *MasterHandler
@@ -60,6 +67,14 @@ type MasterHandler struct {
 	raftAddress string
 	// SelfAddr represents the local address
 	SelfAddr string
+	// ctx is the root context of all background goroutines of this master, and
+	// cancel is used to stop them when shutting down.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// server is the gRPC server of this master.
+	server *grpc.Server
+	// snapshotStore stores snapshots of Raft and prunes old ones.
+	snapshotStore *snapshotStore
 	pb.UnimplementedRegisterServiceServer
 	pb.UnimplementedHeartbeatServiceServer
 	pb.UnimplementedMasterAddServiceServer
@@ -76,8 +91,11 @@ type MasterHandler struct {
 // CreateMasterHandler create a global MasterHandler.
 func CreateMasterHandler() {
 	var err error
+	ctx, cancel := context.WithCancel(context.Background())
 	GlobalMasterHandler = &MasterHandler{
-		FSM: &MasterFSM{},
+		FSM:    &MasterFSM{},
+		ctx:    ctx,
+		cancel: cancel,
 	}
 	GlobalMasterHandler.EtcdClient, err = clientv3.New(clientv3.Config{
 		Endpoints:   []string{viper.GetString(common.EtcdEndPoint)},
@@ -90,6 +108,7 @@ func CreateMasterHandler() {
 	if err != nil {
 		Logger.Panicf("Fail to init raft, error detail : %s", err.Error())
 	}
+	initAuditLogger(viper.GetString(MasterAuditLogPath), viper.GetInt(MasterAuditBufferSize))
 }
 
 // initRaft initials the raft config of the MasterHandler.
@@ -108,8 +127,7 @@ func (handler *MasterHandler) initRaft() error {
 
 	handler.MonitorChan = make(chan bool, 1)
 	raftConfig.NotifyCh = handler.MonitorChan
-	ctx := context.Background()
-	go handler.monitorCluster(ctx)
+	go handler.monitorCluster(handler.ctx)
 
 	addr, err := net.ResolveTCPAddr(common.TCP, handler.raftAddress)
 	if err != nil {
@@ -124,11 +142,12 @@ func (handler *MasterHandler) initRaft() error {
 	}
 
 	raftDir := viper.GetString(common.MasterRaftDir)
-	fss, err := raft.NewFileSnapshotStore(raftDir, 2, os.Stderr)
+	fss, err := newSnapshotStore(raftDir)
 	if err != nil {
 		Logger.Errorf("Fail to create file snapshot store, error detail: %s", err.Error())
 		return err
 	}
+	handler.snapshotStore = fss
 	logDB, err := raftboltdb.NewBoltStore(filepath.Join(raftDir, common.LogDBName))
 	if err != nil {
 		Logger.Errorf("Fail to create log DB, error detail: %s", err.Error())
@@ -268,6 +287,765 @@ func (handler *MasterHandler) JoinCluster(ctx context.Context, args *pb.JoinClus
 	return &pb.JoinClusterReply{}, nil
 }
 
+// MasterInfo describes a master in the raft configuration.
+type MasterInfo struct {
+	Id      string
+	Address string
+	// Suffrage is the suffrage of the master in the raft configuration, such as
+	// Voter or Nonvoter.
+	Suffrage string
+	// Role is either leader or follower.
+	Role string
+}
+
+// NotLeaderError is returned when an operation which can only be done by the
+// leader is requested on a follower. It carries the leader so that the caller
+// can redirect the request to it.
+type NotLeaderError struct {
+	LeaderId      string
+	LeaderAddress string
+}
+
+func (e *NotLeaderError) Error() string {
+	return fmt.Sprintf("current master is not leader, leader id: %s, leader address: %s",
+		e.LeaderId, e.LeaderAddress)
+}
+
+// checkLeader returns a NotLeaderError if current master is not the leader.
+func (handler *MasterHandler) checkLeader() error {
+	if handler.Raft.State() == raft.Leader {
+		return nil
+	}
+	address, id := handler.Raft.LeaderWithID()
+	return &NotLeaderError{
+		LeaderId:      string(id),
+		LeaderAddress: string(address),
+	}
+}
+
+// AddMaster is called by admin. Leader adds a master to the cluster as a voter.
+func (handler *MasterHandler) AddMaster(id string, address string) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.Infof("Get request to add master, id: %s, address: %s", id, address)
+	f := handler.Raft.AddVoter(raft.ServerID(id), raft.ServerAddress(address), 0, 0)
+	if err := f.Error(); err != nil {
+		Logger.Errorf("Fail to add master, id: %s, error detail: %s", id, err.Error())
+		return err
+	}
+	Logger.Infof("Success to add master, id: %s, address: %s", id, address)
+	return nil
+}
+
+// RemoveMaster is called by admin. Leader removes a master from the cluster.
+func (handler *MasterHandler) RemoveMaster(id string) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.Infof("Get request to remove master, id: %s", id)
+	f := handler.Raft.RemoveServer(raft.ServerID(id), 0, 0)
+	if err := f.Error(); err != nil {
+		Logger.Errorf("Fail to remove master, id: %s, error detail: %s", id, err.Error())
+		return err
+	}
+	Logger.Infof("Success to remove master, id: %s", id)
+	return nil
+}
+
+// ListMasters is called by admin. Leader returns all masters in the current
+// raft configuration.
+func (handler *MasterHandler) ListMasters() ([]MasterInfo, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	cf := handler.Raft.GetConfiguration()
+	if err := cf.Error(); err != nil {
+		Logger.Errorf("Fail to get raft config, error detail : %s", err.Error())
+		return nil, err
+	}
+	_, leaderId := handler.Raft.LeaderWithID()
+	servers := cf.Configuration().Servers
+	masters := make([]MasterInfo, len(servers))
+	for i, server := range servers {
+		role := followerRole
+		if server.ID == leaderId {
+			role = leaderRole
+		}
+		masters[i] = MasterInfo{
+			Id:       string(server.ID),
+			Address:  string(server.Address),
+			Suffrage: server.Suffrage.String(),
+			Role:     role,
+		}
+	}
+	return masters, nil
+}
+
+// NamespaceStats is called by admin. It returns the shape of the directory tree
+// of the given namespace.
+func (handler *MasterHandler) NamespaceStats(ctx context.Context, namespace string) (*NamespaceStatistics, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	if err := waitForMinIndex(ctx); err != nil {
+		return nil, err
+	}
+	stats, err := NamespaceStats(namespace)
+	if err != nil {
+		Logger.WithContext(ctx).Errorf("Fail to get namespace stats, namespace: %s, error detail: %s", namespace,
+			err.Error())
+		return nil, err
+	}
+	return stats, nil
+}
+
+// RenameHistory is called by admin. It returns the previous names of a FileNode
+// with when it was renamed from each of them.
+func (handler *MasterHandler) RenameHistory(ctx context.Context, path string) ([]RenameRecord, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	if err := waitForMinIndex(ctx); err != nil {
+		return nil, err
+	}
+	history, err := GetRenameHistory(path)
+	if err != nil {
+		Logger.WithContext(ctx).Errorf("Fail to get rename history, path: %s, error detail: %s", path, err.Error())
+		return nil, err
+	}
+	return history, nil
+}
+
+// MapRangeToChunks returns the ordered ChunkRange covering the byte range of
+// the file, so that clients do not need to compute it themselves.
+func (handler *MasterHandler) MapRangeToChunks(ctx context.Context, path string, offset int64,
+	length int64) ([]ChunkRange, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	path, err := ResolvePath(getWorkDir(ctx), path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkPermission(ctx, "", path, AccessRead); err != nil {
+		return nil, err
+	}
+	if err = waitForMinIndex(ctx); err != nil {
+		return nil, err
+	}
+	ranges, err := MapRangeToChunks(path, offset, length)
+	if err != nil {
+		Logger.WithContext(ctx).Errorf("Fail to map range to chunks, path: %s, offset: %d, length: %d, "+
+			"error detail: %s", path, offset, length, err.Error())
+		return nil, err
+	}
+	return ranges, nil
+}
+
+// CompactLog is called by admin. Leader takes a snapshot immediately, so that
+// all applied logs are rolled into it and the log can be truncated without
+// waiting for the next scheduled snapshot. It returns the index of the last log
+// in the snapshot.
+func (handler *MasterHandler) CompactLog() (uint64, error) {
+	if err := handler.checkLeader(); err != nil {
+		return 0, err
+	}
+	Logger.Infof("Get request to compact log.")
+	f := handler.Raft.Snapshot()
+	if err := f.Error(); err != nil {
+		if err != raft.ErrNothingNewToSnapshot {
+			Logger.Errorf("Fail to compact log, error detail: %s", err.Error())
+			return 0, err
+		}
+		// All applied logs are already in the latest snapshot.
+		index, err := strconv.ParseUint(handler.Raft.Stats()["last_snapshot_index"], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		Logger.Infof("Nothing new to compact, snapshot index: %d", index)
+		return index, nil
+	}
+	meta, reader, err := f.Open()
+	if err != nil {
+		Logger.Errorf("Fail to open the snapshot, error detail: %s", err.Error())
+		return 0, err
+	}
+	_ = reader.Close()
+	Logger.Infof("Success to compact log, snapshot index: %d", meta.Index)
+	return meta.Index, nil
+}
+
+// SnapshotInventory is called by admin. It returns all snapshots kept on disk
+// by this master, the most recent first. Every master takes its own snapshots,
+// so it can be called on followers as well.
+func (handler *MasterHandler) SnapshotInventory() ([]SnapshotInfo, error) {
+	if handler.snapshotStore == nil {
+		return nil, fmt.Errorf("snapshot store is not initialized")
+	}
+	infos, err := handler.snapshotStore.Inventory()
+	if err != nil {
+		Logger.Errorf("Fail to list snapshots, error detail: %s", err.Error())
+		return nil, err
+	}
+	return infos, nil
+}
+
+// QuarantinedReplicas is called by admin. It returns all replicas which failed
+// the checksum and are kept for inspection, see master.checksumMismatchMode.
+func (handler *MasterHandler) QuarantinedReplicas() ([]QuarantinedReplica, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	return ListQuarantinedReplicas(), nil
+}
+
+// ReleaseQuarantinedReplica is called by admin. Leader releases a replica which
+// failed the checksum once it has been inspected, so that its DataNode deletes
+// it.
+func (handler *MasterHandler) ReleaseQuarantinedReplica(chunkId string, dataNodeId string) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.Infof("Get request to release quarantined replica, chunk id: %s, datanode id: %s", chunkId, dataNodeId)
+	operation := &ReleaseReplicaOperation{
+		Id:         util.GenerateUUIDString(),
+		ChunkId:    chunkId,
+		DataNodeId: dataNodeId,
+	}
+	if err := handler.applyAdminOperation(operation, OperationReleaseReplica); err != nil {
+		Logger.Errorf("Fail to release quarantined replica, chunk id: %s, datanode id: %s, error detail: %s",
+			chunkId, dataNodeId, err.Error())
+		return err
+	}
+	Logger.Infof("Success to release quarantined replica, chunk id: %s, datanode id: %s", chunkId, dataNodeId)
+	return nil
+}
+
+// WhoReferences is called by admin. It returns all files referencing the Chunk
+// with their full paths, which is used to assess the blast radius of a corrupt
+// Chunk.
+func (handler *MasterHandler) WhoReferences(chunkId string) ([]ChunkReference, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	references, err := WhoReferences(chunkId)
+	if err != nil {
+		Logger.Errorf("Fail to find references of chunk, error detail: %s", err.Error())
+		return nil, err
+	}
+	return references, nil
+}
+
+// RebuildChunkIndex is called by admin. Leader repairs the reverse index from
+// Chunk to file on all masters and returns what is repaired.
+func (handler *MasterHandler) RebuildChunkIndex() (*ChunkIndexReport, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	Logger.Infof("Get request to rebuild chunk index")
+	operation := &RebuildChunkIndexOperation{Id: util.GenerateUUIDString()}
+	applyFuture := handler.Raft.Apply(getData4Apply(operation, OperationRebuildChunkIndex), 5*time.Second)
+	if err := applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to rebuild chunk index, error detail: %s", err.Error())
+		return nil, err
+	}
+	report := applyFuture.Response().(*ApplyResponse).Response.(ChunkIndexReport)
+	Logger.Infof("Success to rebuild chunk index, report: %+v", report)
+	return &report, nil
+}
+
+// SetQuiescent is called by admin. Leader sets or clears the quiescent flag of a
+// DataNode. Chunk reported by a quiescent DataNode, like one being formatted,
+// are not trusted until it is re-activated.
+func (handler *MasterHandler) SetQuiescent(id string, quiescent bool) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.Infof("Get request to set quiescent flag of datanode, datanode id: %s, quiescent: %v", id, quiescent)
+	operation := &SetQuiescentOperation{
+		Id:         util.GenerateUUIDString(),
+		DataNodeId: id,
+		Quiescent:  quiescent,
+	}
+	if err := handler.applyAdminOperation(operation, OperationSetQuiescent); err != nil {
+		Logger.Errorf("Fail to set quiescent flag of datanode, datanode id: %s, error detail: %s", id, err.Error())
+		return err
+	}
+	Logger.Infof("Success to set quiescent flag of datanode, datanode id: %s, quiescent: %v", id, quiescent)
+	return nil
+}
+
+// GetLostChunks is called by admin. It returns id of all Chunk which have no
+// alive DataNode to copy from and wait for a DataNode storing them to come
+// back.
+func (handler *MasterHandler) GetLostChunks() ([]string, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	return GetLostChunks(), nil
+}
+
+// PendingChunkAges is called by admin. It returns at most limit Chunk which
+// have waited in pendingChunkQueue for the longest time with the reason why
+// their last allocation failed, which reveals re-replication which is stuck.
+func (handler *MasterHandler) PendingChunkAges(limit int) ([]PendingChunkAge, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	return ListPendingChunkAges(limit), nil
+}
+
+// ExplainPlacement is called by admin. It tells which DataNode would receive a
+// missing replica of the Chunk and why other DataNode would not, without
+// allocating anything.
+func (handler *MasterHandler) ExplainPlacement(chunkId string) (*PlacementExplanation, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	explanation, err := ExplainPlacement(chunkId)
+	if err != nil {
+		Logger.Errorf("Fail to explain placement, error detail: %s", err.Error())
+		return nil, err
+	}
+	return explanation, nil
+}
+
+// ForceRemoveDataNode is called by admin. Leader removes a DataNode as dead
+// immediately, which is used when the DataNode is destroyed and will never come
+// back. Chunk stored by it will be replicated again.
+func (handler *MasterHandler) ForceRemoveDataNode(id string) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.Infof("Get request to force to remove datanode, id: %s", id)
+	operation := &ForceRemoveDataNodeOperation{
+		Id:         util.GenerateUUIDString(),
+		DataNodeId: id,
+		Time:       time.Now().UnixMilli(),
+	}
+	data := getData4Apply(operation, OperationForceRemoveDataNode)
+	applyFuture := handler.Raft.Apply(data, 5*time.Second)
+	if err := applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to force to remove datanode, id: %s, error detail: %s", id, err.Error())
+		return err
+	}
+	if err := applyFuture.Response().(*ApplyResponse).Error; err != nil {
+		Logger.Errorf("Fail to force to remove datanode, id: %s, error detail: %s", id, err.Error())
+		return err
+	}
+	// The DataNode is only counted once because the operation fails if it has
+	// been removed.
+	csCountMonitor.Dec()
+	Logger.Infof("Success to force to remove datanode, id: %s", id)
+	return nil
+}
+
+// ClearQuarantine is called by admin. Leader lets a DataNode quarantined for
+// flapping rejoin once its hardware has been checked.
+func (handler *MasterHandler) ClearQuarantine(id string) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.Infof("Get request to clear quarantine of datanode, id: %s", id)
+	operation := &ClearQuarantineOperation{
+		Id:         util.GenerateUUIDString(),
+		DataNodeId: id,
+	}
+	data := getData4Apply(operation, OperationClearQuarantine)
+	applyFuture := handler.Raft.Apply(data, 5*time.Second)
+	if err := applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to clear quarantine of datanode, id: %s, error detail: %s", id, err.Error())
+		return err
+	}
+	if err := applyFuture.Response().(*ApplyResponse).Error; err != nil {
+		Logger.Errorf("Fail to clear quarantine of datanode, id: %s, error detail: %s", id, err.Error())
+		return err
+	}
+	Logger.Infof("Success to clear quarantine of datanode, id: %s", id)
+	return nil
+}
+
+// Chmod is called by admin. It sets the mode of a FileNode, which is only
+// allowed for the owner of the FileNode if permission is enabled.
+func (handler *MasterHandler) Chmod(ctx context.Context, path string, mode uint32) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Get request to change mode, path: %s, mode: %o", path, mode)
+	if err := checkPermission(ctx, "", path, AccessOwner); err != nil {
+		Logger.Errorf("Fail to change mode, path: %s, error detail: %s", path, err.Error())
+		return err
+	}
+	operation := &ChmodOperation{
+		Id:   util.GenerateUUIDString(),
+		Path: path,
+		Mode: mode,
+	}
+	if err := handler.applyAdminOperation(operation, OperationChmod); err != nil {
+		Logger.Errorf("Fail to change mode, path: %s, error detail: %s", path, err.Error())
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Success to change mode, path: %s, mode: %o", path, mode)
+	return nil
+}
+
+// Chown is called by admin. It sets the owner and group of a FileNode, which
+// is only allowed for the owner of the FileNode if permission is enabled.
+func (handler *MasterHandler) Chown(ctx context.Context, path string, owner string, group string) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Get request to change owner, path: %s, owner: %s, group: %s", path, owner, group)
+	if err := checkPermission(ctx, "", path, AccessOwner); err != nil {
+		Logger.Errorf("Fail to change owner, path: %s, error detail: %s", path, err.Error())
+		return err
+	}
+	operation := &ChownOperation{
+		Id:    util.GenerateUUIDString(),
+		Path:  path,
+		Owner: owner,
+		Group: group,
+	}
+	if err := handler.applyAdminOperation(operation, OperationChown); err != nil {
+		Logger.Errorf("Fail to change owner, path: %s, error detail: %s", path, err.Error())
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Success to change owner, path: %s, owner: %s, group: %s", path, owner, group)
+	return nil
+}
+
+// GrantPrimary grants the lease of a Chunk to its primary replica, which orders
+// writes of the Chunk until the lease is revoked by a newer epoch.
+func (handler *MasterHandler) GrantPrimary(ctx context.Context, chunkId string) (*PrimaryLease, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	operation := &GrantPrimaryOperation{
+		Id:      util.GenerateUUIDString(),
+		ChunkId: chunkId,
+	}
+	applyFuture := handler.Raft.Apply(getData4Apply(operation, OperationGrantPrimary), 5*time.Second)
+	if err := applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to grant primary, chunk id: %s, error detail: %s", chunkId, err.Error())
+		return nil, err
+	}
+	response := applyFuture.Response().(*ApplyResponse)
+	if response.Error != nil {
+		Logger.Errorf("Fail to grant primary, chunk id: %s, error detail: %s", chunkId, response.Error.Error())
+		return nil, response.Error
+	}
+	lease := response.Response.(*PrimaryLease)
+	Logger.WithContext(ctx).Debugf("Success to grant primary, chunk id: %s, primary: %s, epoch: %d", chunkId,
+		lease.DataNodeId, lease.Epoch)
+	return lease, nil
+}
+
+// SetMaxPerDomain is called by admin. Leader sets the MaxReplicasPerDomain of
+// a file in the namespace, which limits the number of replicas of each of its
+// Chunk in a failure domain. 0 removes the limit.
+func (handler *MasterHandler) SetMaxPerDomain(ctx context.Context, namespace string, path string,
+	maxReplicasPerDomain int) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Get request to set max replicas per domain, namespace: %s, path: %s, max: %d",
+		namespace, path, maxReplicasPerDomain)
+	operation := &SetMaxPerDomainOperation{
+		Id:                   util.GenerateUUIDString(),
+		Namespace:            namespace,
+		Path:                 path,
+		MaxReplicasPerDomain: maxReplicasPerDomain,
+	}
+	if err := handler.applyAdminOperation(operation, OperationSetMaxPerDomain); err != nil {
+		Logger.Errorf("Fail to set max replicas per domain, path: %s, error detail: %s", path, err.Error())
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Success to set max replicas per domain, namespace: %s, path: %s, max: %d",
+		namespace, path, maxReplicasPerDomain)
+	return nil
+}
+
+// PinChunk is called by admin. Leader pins a Chunk to a DataNode so that the
+// DataNode always stores the Chunk, and a copy is scheduled if it has not
+// stored it.
+func (handler *MasterHandler) PinChunk(chunkId string, dataNodeId string) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.Infof("Get request to pin chunk, chunk id: %s, datanode id: %s", chunkId, dataNodeId)
+	operation := &PinChunkOperation{
+		Id:         util.GenerateUUIDString(),
+		ChunkId:    chunkId,
+		DataNodeId: dataNodeId,
+	}
+	if err := handler.applyAdminOperation(operation, OperationPinChunk); err != nil {
+		Logger.Errorf("Fail to pin chunk, chunk id: %s, datanode id: %s, error detail: %s", chunkId, dataNodeId,
+			err.Error())
+		return err
+	}
+	Logger.Infof("Success to pin chunk, chunk id: %s, datanode id: %s", chunkId, dataNodeId)
+	return nil
+}
+
+// UnpinChunk is called by admin. Leader removes the pin of a Chunk on a
+// DataNode, and the replica stored in the DataNode is kept.
+func (handler *MasterHandler) UnpinChunk(chunkId string, dataNodeId string) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.Infof("Get request to unpin chunk, chunk id: %s, datanode id: %s", chunkId, dataNodeId)
+	operation := &UnpinChunkOperation{
+		Id:         util.GenerateUUIDString(),
+		ChunkId:    chunkId,
+		DataNodeId: dataNodeId,
+	}
+	if err := handler.applyAdminOperation(operation, OperationUnpinChunk); err != nil {
+		Logger.Errorf("Fail to unpin chunk, chunk id: %s, datanode id: %s, error detail: %s", chunkId, dataNodeId,
+			err.Error())
+		return err
+	}
+	Logger.Infof("Success to unpin chunk, chunk id: %s, datanode id: %s", chunkId, dataNodeId)
+	return nil
+}
+
+// SetDataNodeTags is called by admin. Leader replaces all tags of a DataNode,
+// which are matched by the PlacementConstraint of files.
+func (handler *MasterHandler) SetDataNodeTags(id string, tags map[string]string) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.Infof("Get request to set tags of datanode, datanode id: %s, tags: %s", id, tags2String(tags))
+	operation := &SetDataNodeTagsOperation{
+		Id:         util.GenerateUUIDString(),
+		DataNodeId: id,
+		Tags:       tags,
+	}
+	if err := handler.applyAdminOperation(operation, OperationSetDataNodeTags); err != nil {
+		Logger.Errorf("Fail to set tags of datanode, datanode id: %s, error detail: %s", id, err.Error())
+		return err
+	}
+	Logger.Infof("Success to set tags of datanode, datanode id: %s, tags: %s", id, tags2String(tags))
+	return nil
+}
+
+// SetConstraint is called by admin. Leader sets the PlacementConstraint of a
+// file in the namespace, like "disk=ssd,rack!=r1". An empty expression removes
+// the constraint.
+func (handler *MasterHandler) SetConstraint(ctx context.Context, namespace string, path string,
+	constraint string) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Get request to set placement constraint, namespace: %s, path: %s, constraint: %s",
+		namespace, path, constraint)
+	operation := &SetConstraintOperation{
+		Id:         util.GenerateUUIDString(),
+		Namespace:  namespace,
+		Path:       path,
+		Constraint: constraint,
+	}
+	if err := handler.applyAdminOperation(operation, OperationSetConstraint); err != nil {
+		Logger.Errorf("Fail to set placement constraint, path: %s, error detail: %s", path, err.Error())
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Success to set placement constraint, namespace: %s, path: %s, constraint: %s",
+		namespace, path, constraint)
+	return nil
+}
+
+// GetColdChunks is called by admin. It returns id of all Chunk which have not
+// been read since the given time, which are candidates for fewer replicas or a
+// cheaper tier.
+func (handler *MasterHandler) GetColdChunks(before time.Time) ([]string, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	return GetColdChunks(before), nil
+}
+
+// DescribeDataNode is called by admin. It returns the state of a DataNode,
+// including its clock skew from master.
+func (handler *MasterHandler) DescribeDataNode(id string) (*DataNodeDescription, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	description, err := DescribeDataNode(id)
+	if err != nil {
+		Logger.Errorf("Fail to describe datanode, error detail: %s", err.Error())
+		return nil, err
+	}
+	return description, nil
+}
+
+// SetDirPolicy is called by admin. Leader sets the default ReplicaFactor and
+// StoragePolicy of files which will be created under a directory in the
+// namespace. 0 and empty remove the default.
+func (handler *MasterHandler) SetDirPolicy(ctx context.Context, namespace string, path string, replicaFactor int,
+	storagePolicy string) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Get request to set directory policy, namespace: %s, path: %s, replica factor: %d, storage policy: %s",
+		namespace, path, replicaFactor, storagePolicy)
+	operation := &SetDirPolicyOperation{
+		Id:            util.GenerateUUIDString(),
+		Namespace:     namespace,
+		Path:          path,
+		ReplicaFactor: replicaFactor,
+		StoragePolicy: storagePolicy,
+	}
+	if err := handler.applyAdminOperation(operation, OperationSetDirPolicy); err != nil {
+		Logger.Errorf("Fail to set directory policy, path: %s, error detail: %s", path, err.Error())
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Success to set directory policy, namespace: %s, path: %s, replica factor: %d, storage policy: %s",
+		namespace, path, replicaFactor, storagePolicy)
+	return nil
+}
+
+// SetReadFloor is called by admin. Leader sets the MinReadReplicas of a file in
+// the namespace, so that reading a Chunk of it with fewer alive replicas is
+// flagged as unsafe. 0 removes the floor.
+func (handler *MasterHandler) SetReadFloor(ctx context.Context, namespace string, path string,
+	minReadReplicas int) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Get request to set read floor, namespace: %s, path: %s, min read replicas: %d",
+		namespace, path, minReadReplicas)
+	operation := &SetReadFloorOperation{
+		Id:              util.GenerateUUIDString(),
+		Namespace:       namespace,
+		Path:            path,
+		MinReadReplicas: minReadReplicas,
+	}
+	if err := handler.applyAdminOperation(operation, OperationSetReadFloor); err != nil {
+		Logger.Errorf("Fail to set read floor, path: %s, error detail: %s", path, err.Error())
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Success to set read floor, namespace: %s, path: %s, min read replicas: %d",
+		namespace, path, minReadReplicas)
+	return nil
+}
+
+// EvictChunk is called by admin. Leader moves the replica of a Chunk off a
+// DataNode, like one whose disk is failing, and returns id of the DataNode
+// which will receive the replica.
+func (handler *MasterHandler) EvictChunk(chunkId string, dataNodeId string) (string, error) {
+	if err := handler.checkLeader(); err != nil {
+		return "", err
+	}
+	Logger.Infof("Get request to evict chunk, chunk id: %s, datanode id: %s", chunkId, dataNodeId)
+	operation := &EvictChunkOperation{
+		Id:         util.GenerateUUIDString(),
+		ChunkId:    chunkId,
+		DataNodeId: dataNodeId,
+	}
+	applyFuture := handler.Raft.Apply(getData4Apply(operation, OperationEvictChunk), 5*time.Second)
+	if err := applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to evict chunk, chunk id: %s, datanode id: %s, error detail: %s", chunkId, dataNodeId,
+			err.Error())
+		return "", err
+	}
+	response := applyFuture.Response().(*ApplyResponse)
+	if response.Error != nil {
+		Logger.Errorf("Fail to evict chunk, chunk id: %s, datanode id: %s, error detail: %s", chunkId, dataNodeId,
+			response.Error.Error())
+		return "", response.Error
+	}
+	target := response.Response.(string)
+	Logger.Infof("Success to evict chunk, chunk id: %s, datanode id: %s, target: %s", chunkId, dataNodeId, target)
+	return target, nil
+}
+
+// SetQuota is called by admin. Leader sets the Quota and SoftQuota of a
+// directory in the namespace. Creating a file which exceeds the Quota fails,
+// and exceeding the SoftQuota only logs a warning. 0 removes the limit.
+func (handler *MasterHandler) SetQuota(ctx context.Context, namespace string, path string, quota int64,
+	softQuota int64) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Get request to set quota, namespace: %s, path: %s, quota: %d, soft quota: %d",
+		namespace, path, quota, softQuota)
+	operation := &SetQuotaOperation{
+		Id:        util.GenerateUUIDString(),
+		Namespace: namespace,
+		Path:      path,
+		Quota:     quota,
+		SoftQuota: softQuota,
+	}
+	if err := handler.applyAdminOperation(operation, OperationSetQuota); err != nil {
+		Logger.Errorf("Fail to set quota, path: %s, error detail: %s", path, err.Error())
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Success to set quota, namespace: %s, path: %s, quota: %d, soft quota: %d",
+		namespace, path, quota, softQuota)
+	return nil
+}
+
+// SetMaxChildren is called by admin. Leader sets the MaxChildren of a directory
+// in the namespace, which overrides the configured maxChildrenPerDir. 0 removes
+// the override.
+func (handler *MasterHandler) SetMaxChildren(ctx context.Context, namespace string, path string,
+	maxChildren int) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Get request to set max children, namespace: %s, path: %s, max: %d",
+		namespace, path, maxChildren)
+	operation := &SetMaxChildrenOperation{
+		Id:          util.GenerateUUIDString(),
+		Namespace:   namespace,
+		Path:        path,
+		MaxChildren: maxChildren,
+	}
+	if err := handler.applyAdminOperation(operation, OperationSetMaxChildren); err != nil {
+		Logger.Errorf("Fail to set max children, path: %s, error detail: %s", path, err.Error())
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Success to set max children, namespace: %s, path: %s, max: %d",
+		namespace, path, maxChildren)
+	return nil
+}
+
+// SetReplicaFactor is called by admin. Leader sets the ReplicaFactor of a file
+// in the namespace. Existing Chunk of the file get missing replicas allocated
+// or excess replicas deleted.
+func (handler *MasterHandler) SetReplicaFactor(ctx context.Context, namespace string, path string,
+	replicaFactor int) error {
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Get request to set replica factor, namespace: %s, path: %s, replica factor: %d",
+		namespace, path, replicaFactor)
+	operation := &SetReplicaFactorOperation{
+		Id:            util.GenerateUUIDString(),
+		Namespace:     namespace,
+		Path:          path,
+		ReplicaFactor: replicaFactor,
+		Time:          time.Now().UnixMilli(),
+	}
+	if err := handler.applyAdminOperation(operation, OperationSetReplicaFactor); err != nil {
+		Logger.Errorf("Fail to set replica factor, path: %s, error detail: %s", path, err.Error())
+		return err
+	}
+	Logger.WithContext(ctx).Infof("Success to set replica factor, namespace: %s, path: %s, replica factor: %d",
+		namespace, path, replicaFactor)
+	return nil
+}
+
+// applyAdminOperation applies an Operation requested by admin and returns the
+// error of applying it.
+func (handler *MasterHandler) applyAdminOperation(operation Operation, opType string) error {
+	applyFuture := handler.Raft.Apply(getData4Apply(operation, opType), 5*time.Second)
+	if err := applyFuture.Error(); err != nil {
+		return err
+	}
+	return applyFuture.Response().(*ApplyResponse).Error
+}
+
 // monitorCluster run in a goroutine.
 // This function will monitor the change of current master's state (leader ->
 // follower, follower -> leader).
@@ -281,11 +1059,13 @@ func (handler *MasterHandler) JoinCluster(ctx context.Context, args *pb.JoinClus
 // 2. use cancel function to stop the goroutine which monitors heartbeat.
 // 3. register itself to etcd as follower.
 func (handler *MasterHandler) monitorCluster(ctx context.Context) {
+	cancel := context.CancelFunc(func() {})
 	for {
-		subContext, cancel := context.WithCancel(ctx)
 		select {
 		case isLeader := <-handler.MonitorChan:
 			if isLeader {
+				var subContext context.Context
+				subContext, cancel = context.WithCancel(ctx)
 				// todo 错误处理
 				kv := clientv3.NewKV(handler.EtcdClient)
 				_, err := kv.Put(ctx, common.LeaderAddressKey, handler.raftAddress)
@@ -306,8 +1086,77 @@ func (handler *MasterHandler) monitorCluster(ctx context.Context) {
 				go handler.putAndKeepFollower()
 				Logger.WithContext(ctx).Infof("Become follower, keep lease with etcd.")
 			}
+		case <-ctx.Done():
+			cancel()
+			return
+		}
+	}
+}
+
+// ShutdownOnSignal blocks until the process receives SIGTERM or SIGINT, then
+// shuts down the master within the configured timeout and exits.
+func (handler *MasterHandler) ShutdownOnSignal() {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signalChan
+	Logger.Infof("Receive signal %s, shutdown master.", sig)
+	timeout := defaultShutdownTimeout
+	if viper.IsSet(MasterShutdownTimeout) {
+		timeout = viper.GetInt(MasterShutdownTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Shutdown stops the master gracefully so that the next startup can recover
+// from a clean image. It will:
+// 1. Cancel the context of all background goroutines.
+// 2. Wait for them to finish their current iteration.
+// 3. Stop the gRPC server after in-flight requests are finished.
+// 4. Take a final Raft snapshot and shut down Raft.
+// All waiting is bounded by the given ctx.
+func (handler *MasterHandler) Shutdown(ctx context.Context) error {
+	Logger.Infof("Start to shutdown master.")
+	handler.cancel()
+	if err := WaitMonitor(ctx); err != nil {
+		Logger.Errorf("Fail to wait for background goroutines, error detail: %s", err.Error())
+		return err
+	}
+	if handler.server != nil {
+		stopped := make(chan struct{})
+		go func() {
+			handler.server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			handler.server.Stop()
 		}
 	}
+	if globalAuditLogger != nil {
+		globalAuditLogger.Close()
+	}
+	if handler.Raft != nil {
+		err := handler.Raft.Snapshot().Error()
+		if err != nil && err != raft.ErrNothingNewToSnapshot {
+			Logger.Errorf("Fail to take the final snapshot, error detail: %s", err.Error())
+			return err
+		}
+		if err = handler.Raft.Shutdown().Error(); err != nil {
+			Logger.Errorf("Fail to shutdown raft, error detail: %s", err.Error())
+			return err
+		}
+	}
+	if handler.EtcdClient != nil {
+		_ = handler.EtcdClient.Close()
+	}
+	Logger.Infof("Success to shutdown master.")
+	return nil
 }
 
 // getFollowerStateObserver return an Observer which can observe the follower state.
@@ -331,7 +1180,15 @@ func (handler *MasterHandler) Register(ctx context.Context, args *pb.DNRegisterA
 	address := strings.Split(p.Addr.String(), ":")[0]
 	Logger.WithContext(ctx).Infof("Get request for registering a datanode, address: %s", address)
 	need2Expand := IsNeed2Expand(int(args.UsedCapacity), int(args.FullCapacity))
-	dataNodeId := util.GenerateUUIDString()
+	dataNodeId, isFresh, err := getRegisterIdentity(ctx)
+	if err != nil {
+		Logger.Errorf("Fail to register, error code: %v, error detail: %s,", common.MasterRegisterFailed, err.Error())
+		details, _ := status.New(codes.InvalidArgument, "").WithDetails(&pb.RPCError{
+			Code: common.MasterRegisterFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
 	// register first
 	operation := &RegisterOperation{
 		Id:           util.GenerateUUIDString(),
@@ -341,6 +1198,8 @@ func (handler *MasterHandler) Register(ctx context.Context, args *pb.DNRegisterA
 		FullCapacity: int(args.FullCapacity),
 		UsedCapacity: int(args.UsedCapacity),
 		IsNeedExpand: need2Expand,
+		IsFresh:      isFresh,
+		Time:         time.Now().UnixMilli(),
 	}
 	data := getData4Apply(operation, common.OperationRegister)
 	applyFuture := handler.Raft.Apply(data, 5*time.Second)
@@ -383,6 +1242,33 @@ func (handler *MasterHandler) Heartbeat(ctx context.Context, args *pb.HeartbeatA
 	Logger.WithContext(ctx).Debugf("Get heartbeat, datanodeId: %s, isReady: %v", args.Id, args.IsReady)
 	successInfos := ConvChunkInfo(args.SuccessChunkInfos)
 	failInfos := ConvChunkInfo(args.FailChunkInfos)
+	sizeInfos, err := getChunkSizes(ctx)
+	if err != nil {
+		Logger.Errorf("Fail to heartbeat, error code: %v, error detail: %s,", common.MasterHeartbeatFailed, err.Error())
+		details, _ := status.New(codes.InvalidArgument, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterHeartbeatFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
+	accessInfos, err := getChunkAccess(ctx)
+	if err != nil {
+		Logger.Errorf("Fail to heartbeat, error code: %v, error detail: %s,", common.MasterHeartbeatFailed, err.Error())
+		details, _ := status.New(codes.InvalidArgument, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterHeartbeatFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
+	reportTime, err := getReportTime(ctx)
+	if err != nil {
+		Logger.Errorf("Fail to heartbeat, error code: %v, error detail: %s,", common.MasterHeartbeatFailed, err.Error())
+		details, _ := status.New(codes.InvalidArgument, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterHeartbeatFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
 	operation := &HeartbeatOperation{
 		Id:            util.GenerateUUIDString(),
 		DataNodeId:    args.Id,
@@ -394,6 +1280,10 @@ func (handler *MasterHandler) Heartbeat(ctx context.Context, args *pb.HeartbeatA
 		FailInfos:     failInfos,
 		InvalidChunks: args.InvalidChunks,
 		IsReady:       args.IsReady,
+		SizeInfos:     sizeInfos,
+		AccessInfos:   accessInfos,
+		ReportTime:    reportTime,
+		ReceiveTime:   time.Now().UnixMilli(),
 	}
 	data := getData4Apply(operation, common.OperationHeartbeat)
 	applyFuture := handler.Raft.Apply(data, 5*time.Second)
@@ -421,6 +1311,19 @@ func (handler *MasterHandler) Heartbeat(ctx context.Context, args *pb.HeartbeatA
 		DataNodeAddress: dataNodeAddress,
 		ChunkInfos:      nextChunkInfos,
 	}
+	if IsChunkReportRequested(args.Id) {
+		// It fails only if ctx is not of a gRPC call, in which case no one
+		// reads the header.
+		_ = grpc.SetHeader(ctx, metadata.Pairs(chunkReportMetadataKey, "true"))
+	}
+	if tasks := GetReconstructTasks(args.Id); len(tasks) != 0 {
+		header := metadata.MD{}
+		for _, task := range tasks {
+			value, _ := json.Marshal(task)
+			header.Append(reconstructTasksMetadataKey, string(value))
+		}
+		_ = grpc.SetHeader(ctx, header)
+	}
 	return heartbeatReply, nil
 }
 
@@ -433,12 +1336,25 @@ func (handler *MasterHandler) CheckArgs4Add(ctx context.Context, args *pb.CheckA
 	if int(StorableNum.Load()) < viper.GetInt(common.ReplicaNum) {
 		err := fmt.Errorf("insufficient free space in the catfs to store the file")
 		Logger.Errorf("Fail to check path and filename for add operation, error code: %v, error detail: %s,", common.MasterCheckArgs4AddFailed, err.Error())
-		details, _ := status.New(codes.Internal, err.Error()).WithDetails(&pb.RPCError{
+		details, _ := status.New(codes.Internal, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterCheckArgs4AddFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
+	if err := checkPermission(ctx, "", args.Path, AccessWrite); err != nil {
+		return nil, permissionDenied(err, common.MasterCheckArgs4AddFailed)
+	}
+	overwrite, err := getOverwrite(ctx)
+	if err != nil {
+		Logger.Errorf("Fail to check path and filename for add operation, error code: %v, error detail: %s,", common.MasterCheckArgs4AddFailed, err.Error())
+		details, _ := status.New(codes.InvalidArgument, err.Error()).WithDetails(&pb.RPCError{
 			Code: common.MasterCheckArgs4AddFailed,
 			Msg:  err.Error(),
 		})
 		return nil, details.Err()
 	}
+	identity := getRequestIdentity(ctx)
 	operation := &AddOperation{
 		Id:         util.GenerateUUIDString(),
 		FileNodeId: util.GenerateUUIDString(),
@@ -446,6 +1362,9 @@ func (handler *MasterHandler) CheckArgs4Add(ctx context.Context, args *pb.CheckA
 		FileName:   args.FileName,
 		Size:       args.Size,
 		Stage:      common.CheckArgs,
+		Owner:      identity.User,
+		Group:      identity.primaryGroup(),
+		Overwrite:  overwrite,
 	}
 	data := getData4Apply(operation, common.OperationAdd)
 	applyFuture := handler.Raft.Apply(data, 5*time.Second)
@@ -467,6 +1386,7 @@ func (handler *MasterHandler) CheckArgs4Add(ctx context.Context, args *pb.CheckA
 		return nil, details.Err()
 	}
 	Logger.WithContext(ctx).Infof("Success to check path and filename for add operation, path: %s, filename: %s, size: %d", args.Path, args.FileName, args.Size)
+	setAppliedIndexHeader(ctx, response.Index)
 	return (response.Response).(*pb.CheckArgs4AddReply), nil
 
 }
@@ -476,6 +1396,17 @@ func (handler *MasterHandler) CheckArgs4Add(ctx context.Context, args *pb.CheckA
 func (handler *MasterHandler) CheckAndGet(ctx context.Context, args *pb.CheckAndGetArgs) (*pb.CheckAndGetReply, error) {
 	Logger.WithContext(ctx).Infof("Get request for checking path for get operation, Path: %s", args.Path)
 	RequestCountInc(handler.SelfAddr, common.OperationGet)
+	if err := checkPermission(ctx, "", args.Path, AccessRead); err != nil {
+		return nil, permissionDenied(err, common.MasterCheckAndGetFailed)
+	}
+	if err := waitForMinIndex(ctx); err != nil {
+		Logger.Errorf("Fail to check path for get operation, error code: %v, error detail: %s", common.MasterCheckAndGetFailed, err)
+		details, _ := status.New(codes.Unavailable, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterCheckAndGetFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
 	operation := &GetOperation{
 		Id:    util.GenerateUUIDString(),
 		Path:  args.Path,
@@ -514,11 +1445,42 @@ func (handler *MasterHandler) CheckAndGet(ctx context.Context, args *pb.CheckAnd
 // GetDataNodes4Add is called by client. It allocates DataNode for a batch of Chunk.
 func (handler *MasterHandler) GetDataNodes4Add(ctx context.Context, args *pb.GetDataNodes4AddArgs) (*pb.GetDataNodes4AddReply, error) {
 	Logger.WithContext(ctx).Infof("Get request for getting dataNodes for single chunk, FileNodeId: %s, ChunkNum: %d", args.FileNodeId, args.ChunkNum)
+	chunkIndex, err := getChunkIndex(ctx)
+	if err != nil {
+		Logger.Errorf("Fail to get dataNodes for single chunk for add operation, error code: %v, error detail: %s,", common.MasterGetDataNodes4AddFailed, err.Error())
+		details, _ := status.New(codes.InvalidArgument, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterGetDataNodes4AddFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
+	scheme, err := getCodingScheme(ctx)
+	if err != nil {
+		Logger.Errorf("Fail to get dataNodes for single chunk for add operation, error code: %v, error detail: %s,", common.MasterGetDataNodes4AddFailed, err.Error())
+		details, _ := status.New(codes.InvalidArgument, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterGetDataNodes4AddFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
+	minAckNum, err := getRequestMinAckNum(ctx)
+	if err != nil {
+		Logger.Errorf("Fail to get dataNodes for single chunk for add operation, error code: %v, error detail: %s,", common.MasterGetDataNodes4AddFailed, err.Error())
+		details, _ := status.New(codes.InvalidArgument, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterGetDataNodes4AddFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
 	operation := &AddOperation{
-		Id:         util.GenerateUUIDString(),
-		FileNodeId: args.FileNodeId,
-		ChunkNum:   args.ChunkNum,
-		Stage:      common.GetDataNodes,
+		Id:           util.GenerateUUIDString(),
+		FileNodeId:   args.FileNodeId,
+		ChunkNum:     args.ChunkNum,
+		ChunkIndex:   chunkIndex,
+		Stage:        common.GetDataNodes,
+		CodingScheme: scheme,
+		MinAckNum:    minAckNum,
+		Placement:    getChunkPlacement(ctx),
 	}
 	data := getData4Apply(operation, common.OperationAdd)
 	applyFuture := handler.Raft.Apply(data, 5*time.Second)
@@ -546,11 +1508,22 @@ func (handler *MasterHandler) GetDataNodes4Add(ctx context.Context, args *pb.Get
 // GetDataNodes4Get is called by client. It finds the dataNodes for the specified ChunkId.
 func (handler *MasterHandler) GetDataNodes4Get(ctx context.Context, args *pb.GetDataNodes4GetArgs) (*pb.GetDataNodes4GetReply, error) {
 	Logger.WithContext(ctx).Infof("Get request for getting DataNodes, FileNodeId: %s", args.FileNodeId)
+	if err := waitForMinIndex(ctx); err != nil {
+		Logger.Errorf("Fail to get DataNodes for get operation, error code: %v, error detail: %s,", common.MasterGetDataNodes4GetFailed, err.Error())
+		details, _ := status.New(codes.Unavailable, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterGetDataNodes4GetFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
+	locality := getClientLocality(ctx)
 	operation := &GetOperation{
-		Id:         util.GenerateUUIDString(),
-		FileNodeId: args.FileNodeId,
-		ChunkIndex: args.ChunkIndex,
-		Stage:      common.GetDataNodes,
+		Id:            util.GenerateUUIDString(),
+		FileNodeId:    args.FileNodeId,
+		ChunkIndex:    args.ChunkIndex,
+		Stage:         common.GetDataNodes,
+		ClientAddress: locality.Address,
+		ClientTags:    locality.Tags,
 	}
 	data := getData4Apply(operation, common.OperationGet)
 	applyFuture := handler.Raft.Apply(data, 5*time.Second)
@@ -614,6 +1587,7 @@ func (handler *MasterHandler) Callback4Add(ctx context.Context, args *pb.Callbac
 		return nil, details.Err()
 	}
 
+	setAppliedIndexHeader(ctx, response.Index)
 	rep := &pb.Callback4AddReply{}
 	Logger.WithContext(ctx).Infof("Success to handle the result of add operation, FileNodeId: %s", args.FileNodeId)
 	SuccessCountInc(handler.SelfAddr, common.OperationAdd)
@@ -624,10 +1598,16 @@ func (handler *MasterHandler) Callback4Add(ctx context.Context, args *pb.Callbac
 func (handler *MasterHandler) CheckAndMkdir(ctx context.Context, args *pb.CheckAndMkDirArgs) (*pb.CheckAndMkDirReply, error) {
 	Logger.WithContext(ctx).Infof("Get request for making directory at target path, path: %s, dirName: %s", args.Path, args.DirName)
 	RequestCountInc(handler.SelfAddr, common.OperationMkdir)
+	if err := checkPermission(ctx, "", args.Path, AccessWrite); err != nil {
+		return nil, permissionDenied(err, common.MasterCheckAndMkdirFailed)
+	}
+	identity := getRequestIdentity(ctx)
 	operation := &MkdirOperation{
 		Id:       util.GenerateUUIDString(),
 		Path:     args.Path,
 		FileName: args.DirName,
+		Owner:    identity.User,
+		Group:    identity.primaryGroup(),
 	}
 	data := getData4Apply(operation, common.OperationMkdir)
 	applyFuture := handler.Raft.Apply(data, 5*time.Second)
@@ -649,6 +1629,7 @@ func (handler *MasterHandler) CheckAndMkdir(ctx context.Context, args *pb.CheckA
 		return nil, details.Err()
 	}
 
+	setAppliedIndexHeader(ctx, response.Index)
 	rep := &pb.CheckAndMkDirReply{}
 	Logger.WithContext(ctx).Infof("Success to make directory at target path, path: %s, dirName: %s", args.Path, args.DirName)
 	SuccessCountInc(handler.SelfAddr, common.OperationMkdir)
@@ -660,6 +1641,12 @@ func (handler *MasterHandler) CheckAndMkdir(ctx context.Context, args *pb.CheckA
 func (handler *MasterHandler) CheckAndMove(ctx context.Context, args *pb.CheckAndMoveArgs) (*pb.CheckAndMoveReply, error) {
 	Logger.WithContext(ctx).Infof("Get request for moving directory or file to target path, sourcePath: %s, targetPath: %s", args.SourcePath, args.TargetPath)
 	RequestCountInc(handler.SelfAddr, common.OperationMove)
+	if err := checkParentPermission(ctx, "", args.SourcePath, AccessWrite); err != nil {
+		return nil, permissionDenied(err, common.MasterCheckAndMoveFailed)
+	}
+	if err := checkPermission(ctx, "", args.TargetPath, AccessWrite); err != nil {
+		return nil, permissionDenied(err, common.MasterCheckAndMoveFailed)
+	}
 	operation := &MoveOperation{
 		Id:         util.GenerateUUIDString(),
 		SourcePath: args.SourcePath,
@@ -685,20 +1672,75 @@ func (handler *MasterHandler) CheckAndMove(ctx context.Context, args *pb.CheckAn
 		return nil, details.Err()
 	}
 
+	setAppliedIndexHeader(ctx, response.Index)
 	rep := &pb.CheckAndMoveReply{}
 	Logger.WithContext(ctx).Infof("Success to move directory or file to target path, sourcePath: %s, targetPath: %s", args.SourcePath, args.TargetPath)
 	SuccessCountInc(handler.SelfAddr, common.OperationMove)
 	return rep, nil
 }
 
+// SwapFileNodes is called by client. It exchanges two files or directories by
+// one Raft apply, so that readers see either the old pair or the new pair,
+// which is used to switch between blue and green versions of a deployment.
+func (handler *MasterHandler) SwapFileNodes(ctx context.Context, pathA string, pathB string) error {
+	Logger.WithContext(ctx).Infof("Get request for swapping, path a: %s, path b: %s", pathA, pathB)
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	paths := []string{pathA, pathB}
+	for i, path := range paths {
+		path, err := ResolvePath(getWorkDir(ctx), path)
+		if err != nil {
+			return err
+		}
+		if err = checkParentPermission(ctx, "", path, AccessWrite); err != nil {
+			return err
+		}
+		paths[i] = path
+	}
+	pathA, pathB = paths[0], paths[1]
+	operation := &SwapOperation{
+		Id:    util.GenerateUUIDString(),
+		PathA: pathA,
+		PathB: pathB,
+		Time:  time.Now().UnixMilli(),
+	}
+	applyFuture := handler.Raft.Apply(getData4Apply(operation, OperationSwap), 5*time.Second)
+	if err := applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to swap, path a: %s, path b: %s, error detail: %s", pathA, pathB, err.Error())
+		return err
+	}
+	response := applyFuture.Response().(*ApplyResponse)
+	if err := response.Error; err != nil {
+		Logger.Errorf("Fail to swap, path a: %s, path b: %s, error detail: %s", pathA, pathB, err.Error())
+		return err
+	}
+	setAppliedIndexHeader(ctx, response.Index)
+	Logger.WithContext(ctx).Infof("Success to swap, path a: %s, path b: %s", pathA, pathB)
+	return nil
+}
+
 // CheckAndRemove is called by client. It checks args and removes directory or
 // file at target path.
 func (handler *MasterHandler) CheckAndRemove(ctx context.Context, args *pb.CheckAndRemoveArgs) (*pb.CheckAndRemoveReply, error) {
 	Logger.WithContext(ctx).Infof("Get request for removing directory or file at target path, path: %s", args.Path)
 	RequestCountInc(handler.SelfAddr, common.OperationRemove)
+	if err := checkParentPermission(ctx, "", args.Path, AccessWrite); err != nil {
+		return nil, permissionDenied(err, common.MasterCheckAndRemoveFailed)
+	}
+	deleteMode, err := getDeleteMode(ctx)
+	if err != nil {
+		Logger.Errorf("Fail to remove directory or file at target path, error code: %v, error detail: %s,", common.MasterCheckAndRemoveFailed, err.Error())
+		details, _ := status.New(codes.InvalidArgument, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterCheckAndRemoveFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
 	operation := &RemoveOperation{
-		Id:   util.GenerateUUIDString(),
-		Path: args.Path,
+		Id:        util.GenerateUUIDString(),
+		Path:      args.Path,
+		Immediate: deleteMode == DeleteModeImmediate,
 	}
 	data := getData4Apply(operation, common.OperationRemove)
 	applyFuture := handler.Raft.Apply(data, 5*time.Second)
@@ -720,6 +1762,7 @@ func (handler *MasterHandler) CheckAndRemove(ctx context.Context, args *pb.Check
 		return nil, details.Err()
 	}
 
+	setAppliedIndexHeader(ctx, response.Index)
 	rep := &pb.CheckAndRemoveReply{}
 	Logger.WithContext(ctx).Infof("Success to remove directory or file at target path, path: %s", args.Path)
 	SuccessCountInc(handler.SelfAddr, common.OperationRemove)
@@ -734,9 +1777,22 @@ func (handler *MasterHandler) CheckAndList(ctx context.Context, args *pb.CheckAn
 		err      error
 	)
 	RequestCountInc(handler.SelfAddr, common.OperationList)
+	if err = checkPermission(ctx, "", args.Path, AccessRead); err != nil {
+		return nil, permissionDenied(err, common.MasterCheckAndListFailed)
+	}
+	includeDeleted, err := getIncludeDeleted(ctx)
+	if err != nil {
+		Logger.Errorf("Fail to list specified directory, error code: %v, error detail: %s,", common.MasterCheckAndListFailed, err.Error())
+		details, _ := status.New(codes.InvalidArgument, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterCheckAndListFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
+	}
 	operation := &ListOperation{
-		Id:   util.GenerateUUIDString(),
-		Path: args.Path,
+		Id:             util.GenerateUUIDString(),
+		Path:           args.Path,
+		IncludeDeleted: includeDeleted,
 	}
 	if args.IsLatest {
 		data := getData4Apply(operation, common.OperationList)
@@ -752,6 +1808,13 @@ func (handler *MasterHandler) CheckAndList(ctx context.Context, args *pb.CheckAn
 		applyResponse := applyFuture.Response().(*ApplyResponse)
 		response = applyResponse.Response
 		err = applyResponse.Error
+	} else if err = waitForMinIndex(ctx); err != nil {
+		Logger.Errorf("Fail to list specified directory, error code: %v, error detail: %s,", common.MasterCheckAndListFailed, err.Error())
+		details, _ := status.New(codes.Unavailable, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterCheckAndListFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
 	} else {
 		response, err = operation.Apply()
 	}
@@ -798,6 +1861,13 @@ func (handler *MasterHandler) CheckAndStat(ctx context.Context, args *pb.CheckAn
 		applyResponse := applyFuture.Response().(*ApplyResponse)
 		response = applyResponse.Response
 		err = applyResponse.Error
+	} else if err = waitForMinIndex(ctx); err != nil {
+		Logger.Errorf("Fail to get the specified file info, error code: %v, error detail: %s,", common.MasterCheckAndStatFailed, err.Error())
+		details, _ := status.New(codes.Unavailable, err.Error()).WithDetails(&pb.RPCError{
+			Code: common.MasterCheckAndStatFailed,
+			Msg:  err.Error(),
+		})
+		return nil, details.Err()
 	} else {
 		response, err = operation.Apply()
 	}
@@ -820,15 +1890,253 @@ func (handler *MasterHandler) CheckAndStat(ctx context.Context, args *pb.CheckAn
 	return rep, nil
 }
 
+// BatchStat is called by client. It stats many paths in one call, which saves
+// round-trips of calling CheckAndStat for each child of a directory. Each path
+// gets its own result, and a path which is illegal or does not exist only fails
+// its own result.
+func (handler *MasterHandler) BatchStat(ctx context.Context, paths []string) ([]StatResult, error) {
+	Logger.WithContext(ctx).Infof("Get request for batch stat, path num: %d", len(paths))
+	if err := waitForMinIndex(ctx); err != nil {
+		Logger.Errorf("Fail to batch stat, error detail: %s", err.Error())
+		return nil, err
+	}
+	workDir := getWorkDir(ctx)
+	resolved := make([]string, len(paths))
+	resolveErrs := make([]error, len(paths))
+	for i, path := range paths {
+		resolved[i], resolveErrs[i] = ResolvePath(workDir, path)
+	}
+	results, err := BatchStatFileNodesIn("", resolved)
+	if err != nil {
+		Logger.Errorf("Fail to batch stat, error detail: %s", err.Error())
+		return nil, err
+	}
+	for i, path := range paths {
+		results[i].Path = path
+		if resolveErrs[i] != nil {
+			results[i].FileNode, results[i].Err = nil, resolveErrs[i]
+		}
+	}
+	Logger.WithContext(ctx).Infof("Success to batch stat, path num: %d", len(paths))
+	return results, nil
+}
+
+// BatchAddFileNodes is called by client. It creates many files and directories
+// by one Raft apply, which is much faster than adding them one by one when a
+// dataset or a manifest is imported. Each entry gets its own result, and an
+// entry which is illegal or can not be created only fails its own result and
+// entries in it. Chunk of files are allocated as usual when they are written.
+func (handler *MasterHandler) BatchAddFileNodes(ctx context.Context, entries []AddEntry) ([]AddResult, error) {
+	Logger.WithContext(ctx).Infof("Get request for batch add, entry num: %d", len(entries))
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	workDir := getWorkDir(ctx)
+	results := make([]AddResult, len(entries))
+	accepted := make([]AddEntry, 0, len(entries))
+	acceptedIdx := make([]int, 0, len(entries))
+	for i, entry := range entries {
+		results[i].Path, results[i].Name = entry.Path, entry.Name
+		path, err := ResolvePath(workDir, entry.Path)
+		if err == nil {
+			err = checkPermission(ctx, "", path, AccessWrite)
+		}
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		entry.Path = path
+		accepted = append(accepted, entry)
+		acceptedIdx = append(acceptedIdx, i)
+	}
+	identity := getRequestIdentity(ctx)
+	operation := &BatchAddOperation{
+		Id:      util.GenerateUUIDString(),
+		Entries: accepted,
+		Owner:   identity.User,
+		Group:   identity.primaryGroup(),
+	}
+	data := getData4Apply(operation, OperationBatchAdd)
+	applyFuture := handler.Raft.Apply(data, 5*time.Second)
+	if err := applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to batch add, error detail: %s", err.Error())
+		return nil, err
+	}
+	response := applyFuture.Response().(*ApplyResponse)
+	if err := response.Error; err != nil {
+		Logger.Errorf("Fail to batch add, error detail: %s", err.Error())
+		return nil, err
+	}
+	for j, result := range response.Response.([]AddResult) {
+		results[acceptedIdx[j]].FileNode, results[acceptedIdx[j]].Err = result.FileNode, result.Err
+	}
+	Logger.WithContext(ctx).Infof("Success to batch add, entry num: %d", len(entries))
+	return results, nil
+}
+
+// AllocateNextChunk is called by client. It creates the next Chunk of a file
+// whose Chunk are created lazily, see master.lazyChunkThreshold. The client
+// then gets DataNode for the Chunk by the GetDataNodes stage of adding with
+// the index of the Chunk.
+func (handler *MasterHandler) AllocateNextChunk(ctx context.Context, path string) (string, error) {
+	Logger.WithContext(ctx).Infof("Get request for allocating next chunk, path: %s", path)
+	if err := handler.checkLeader(); err != nil {
+		return "", err
+	}
+	path, err := ResolvePath(getWorkDir(ctx), path)
+	if err != nil {
+		return "", err
+	}
+	if err = checkPermission(ctx, "", path, AccessWrite); err != nil {
+		return "", err
+	}
+	operation := &AllocateChunkOperation{
+		Id:   util.GenerateUUIDString(),
+		Path: path,
+	}
+	applyFuture := handler.Raft.Apply(getData4Apply(operation, OperationAllocateChunk), 5*time.Second)
+	if err = applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to allocate next chunk, path: %s, error detail: %s", path, err.Error())
+		return "", err
+	}
+	response := applyFuture.Response().(*ApplyResponse)
+	if response.Error != nil {
+		Logger.Errorf("Fail to allocate next chunk, path: %s, error detail: %s", path, response.Error.Error())
+		return "", response.Error
+	}
+	chunkId := response.Response.(string)
+	Logger.WithContext(ctx).Infof("Success to allocate next chunk, path: %s, chunk id: %s", path, chunkId)
+	return chunkId, nil
+}
+
+// ListTrash is called by client. It returns the deleted FileNode under the
+// directory with their names before deleted, whose id can be given to
+// RestoreDeleted.
+func (handler *MasterHandler) ListTrash(ctx context.Context, path string) ([]*FileNode, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	path, err := ResolvePath(getWorkDir(ctx), path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkPermission(ctx, "", path, AccessRead); err != nil {
+		return nil, err
+	}
+	if err = waitForMinIndex(ctx); err != nil {
+		return nil, err
+	}
+	trash, err := ListTrash(path)
+	if err != nil {
+		Logger.WithContext(ctx).Errorf("Fail to list trash, path: %s, error detail: %s", path, err.Error())
+		return nil, err
+	}
+	return trash, nil
+}
+
+// GetFileLocations is called by client. It returns the alive DataNode storing
+// each Chunk of the file, and flags Chunk whose replicas are below the
+// MinReadReplicas of the file as unsafe to read.
+func (handler *MasterHandler) GetFileLocations(ctx context.Context, path string) ([]ChunkLocation, error) {
+	if err := handler.checkLeader(); err != nil {
+		return nil, err
+	}
+	path, err := ResolvePath(getWorkDir(ctx), path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkPermission(ctx, "", path, AccessRead); err != nil {
+		return nil, err
+	}
+	if err = waitForMinIndex(ctx); err != nil {
+		return nil, err
+	}
+	locations, err := BeginReadView().GetFileLocations(path)
+	if err != nil {
+		Logger.WithContext(ctx).Errorf("Fail to get file locations, path: %s, error detail: %s", path, err.Error())
+		return nil, err
+	}
+	return locations, nil
+}
+
+// WalkFileTree is called by client. It recursively visits all FileNode under
+// the directory. The walk stops when master.walkTimeout is exceeded or the
+// request is cancelled, and then the FileNode visited so far are returned with
+// Truncated set.
+func (handler *MasterHandler) WalkFileTree(ctx context.Context, path string) (*WalkResult, error) {
+	path, err := ResolvePath(getWorkDir(ctx), path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkPermission(ctx, "", path, AccessRead); err != nil {
+		return nil, err
+	}
+	if err = waitForMinIndex(ctx); err != nil {
+		return nil, err
+	}
+	timeout := viper.GetInt(MasterWalkTimeout)
+	if timeout <= 0 {
+		timeout = defaultWalkTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+	result, err := WalkFileTree(ctx, path)
+	if err != nil {
+		Logger.WithContext(ctx).Errorf("Fail to walk file tree, path: %s, error detail: %s", path, err.Error())
+		return nil, err
+	}
+	return result, nil
+}
+
+// RestoreDeleted is called by client. It restores the deleted FileNode with the
+// given id under the directory with its name before deleted.
+func (handler *MasterHandler) RestoreDeleted(ctx context.Context, path string, fileNodeId string) error {
+	Logger.WithContext(ctx).Infof("Get request for restoring deleted file, path: %s, id: %s", path, fileNodeId)
+	if err := handler.checkLeader(); err != nil {
+		return err
+	}
+	path, err := ResolvePath(getWorkDir(ctx), path)
+	if err != nil {
+		return err
+	}
+	if err = checkPermission(ctx, "", path, AccessWrite); err != nil {
+		return err
+	}
+	operation := &RestoreDeletedOperation{
+		Id:         util.GenerateUUIDString(),
+		Path:       path,
+		FileNodeId: fileNodeId,
+	}
+	applyFuture := handler.Raft.Apply(getData4Apply(operation, OperationRestoreDeleted), 5*time.Second)
+	if err = applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to restore deleted file, path: %s, id: %s, error detail: %s", path, fileNodeId,
+			err.Error())
+		return err
+	}
+	response := applyFuture.Response().(*ApplyResponse)
+	if response.Error != nil {
+		Logger.Errorf("Fail to restore deleted file, path: %s, id: %s, error detail: %s", path, fileNodeId,
+			response.Error.Error())
+		return response.Error
+	}
+	setAppliedIndexHeader(ctx, response.Index)
+	Logger.WithContext(ctx).Infof("Success to restore deleted file, path: %s, id: %s", path, fileNodeId)
+	return nil
+}
+
 // CheckAndRename is called by client. It checks args and renames the specified
 // file to a new name.
 func (handler *MasterHandler) CheckAndRename(ctx context.Context, args *pb.CheckAndRenameArgs) (*pb.CheckAndRenameReply, error) {
 	Logger.WithContext(ctx).Infof("Get request for renaming the specified file to a new name, path: %s, new name: %s", args.Path, args.NewName)
 	RequestCountInc(handler.SelfAddr, common.OperationRename)
+	if err := checkParentPermission(ctx, "", args.Path, AccessWrite); err != nil {
+		return nil, permissionDenied(err, common.MasterCheckAndRenameFailed)
+	}
 	operation := &RenameOperation{
 		Id:      util.GenerateUUIDString(),
 		Path:    args.Path,
 		NewName: args.NewName,
+		Time:    time.Now().UnixMilli(),
 	}
 	data := getData4Apply(operation, common.OperationRename)
 	applyFuture := handler.Raft.Apply(data, 5*time.Second)
@@ -852,6 +2160,7 @@ func (handler *MasterHandler) CheckAndRename(ctx context.Context, args *pb.Check
 		return nil, details.Err()
 	}
 
+	setAppliedIndexHeader(ctx, response.Index)
 	rep := &pb.CheckAndRenameReply{}
 	Logger.WithContext(ctx).Infof("Success to rename the specified file to a new name, path: %s", args.Path)
 	SuccessCountInc(handler.SelfAddr, common.OperationRename)
@@ -864,11 +2173,13 @@ func (handler *MasterHandler) Server() {
 		Logger.Errorf("Fail to server, error code: %v, error detail: %s,", common.MasterRPCServerFailed, err.Error())
 		os.Exit(1)
 	}
-	server := grpc.NewServer(grpc.UnaryInterceptor(interceptor))
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(interceptor, workDirInterceptor, auditInterceptor))
+	handler.server = server
 	localIP, _ := util.GetLocalIP()
 	handler.SelfAddr = localIP
 	pb.RegisterRegisterServiceServer(server, handler)
 	pb.RegisterHeartbeatServiceServer(server, handler)
+	server.RegisterService(&ChunkReportService_ServiceDesc, handler)
 	pb.RegisterMasterAddServiceServer(server, handler)
 	pb.RegisterMasterMkdirServiceServer(server, handler)
 	pb.RegisterMasterMoveServiceServer(server, handler)
@@ -882,6 +2193,282 @@ func (handler *MasterHandler) Server() {
 	server.Serve(listener)
 }
 
+// permissionDenied converts a PermissionDeniedError to a gRPC error with the
+// given error code.
+func permissionDenied(err error, code int32) error {
+	Logger.Errorf("Permission denied, error code: %v, error detail: %s", code, err.Error())
+	details, _ := status.New(codes.PermissionDenied, err.Error()).WithDetails(&pb.RPCError{
+		Code: code,
+		Msg:  err.Error(),
+	})
+	return details.Err()
+}
+
+// workDirInterceptor resolves all paths in a namespace request against the
+// working directory given in the metadata of the request, so that the handler
+// always gets absolute paths. Paths are resolved against the root if no working
+// directory is given.
+var workDirInterceptor grpc.UnaryServerInterceptor = func(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := resolveRequestPaths(ctx, req); err != nil {
+		Logger.Errorf("Fail to resolve path, method: %s, error detail: %s", info.FullMethod, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return handler(ctx, req)
+}
+
+// getDeleteMode gets the delete mode of a remove request from its metadata, or
+// the configured one if it is not given.
+func getDeleteMode(ctx context.Context) (string, error) {
+	mode := viper.GetString(MasterDeleteMode)
+	if values := metadata.ValueFromIncomingContext(ctx, deleteModeMetadataKey); len(values) != 0 {
+		mode = values[0]
+	}
+	switch mode {
+	case "", DeleteModeDeferred:
+		return DeleteModeDeferred, nil
+	case DeleteModeImmediate:
+		return DeleteModeImmediate, nil
+	default:
+		return "", fmt.Errorf("illegal delete mode, mode: %s", mode)
+	}
+}
+
+// getOverwrite gets whether a CheckArgs4Add request replaces an existing file
+// from its metadata, or false if it is not given.
+func getOverwrite(ctx context.Context) (bool, error) {
+	values := metadata.ValueFromIncomingContext(ctx, overwriteMetadataKey)
+	if len(values) == 0 {
+		return false, nil
+	}
+	overwrite, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return false, fmt.Errorf("illegal overwrite flag, flag: %q", values[0])
+	}
+	return overwrite, nil
+}
+
+// getIncludeDeleted gets whether a CheckAndList request also lists deleted
+// FileNode from its metadata, or false if it is not given.
+func getIncludeDeleted(ctx context.Context) (bool, error) {
+	values := metadata.ValueFromIncomingContext(ctx, includeDeletedMetadataKey)
+	if len(values) == 0 {
+		return false, nil
+	}
+	includeDeleted, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return false, fmt.Errorf("illegal include deleted flag, flag: %q", values[0])
+	}
+	return includeDeleted, nil
+}
+
+// getChunkIndex gets the index of the first Chunk of a GetDataNodes4Add request
+// from its metadata, or 0 if it is not given.
+func getChunkIndex(ctx context.Context) (int, error) {
+	values := metadata.ValueFromIncomingContext(ctx, chunkIndexMetadataKey)
+	if len(values) == 0 {
+		return 0, nil
+	}
+	index, err := strconv.Atoi(values[0])
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("illegal chunk index, index: %q", values[0])
+	}
+	return index, nil
+}
+
+// getRequestMinAckNum gets the minimum-ack number of a GetDataNodes4Add request
+// from its metadata, or 0 if it is not given. Its range is checked when the
+// request is applied.
+func getRequestMinAckNum(ctx context.Context) (int, error) {
+	values := metadata.ValueFromIncomingContext(ctx, minAckNumMetadataKey)
+	if len(values) == 0 {
+		return 0, nil
+	}
+	minAckNum, err := strconv.Atoi(values[0])
+	if err != nil {
+		return 0, fmt.Errorf("illegal minimum-ack number, number: %q", values[0])
+	}
+	return minAckNum, nil
+}
+
+// getChunkPlacement gets the DataNode given by client for each Chunk of a
+// GetDataNodes4Add request from its metadata, or nil if it is not given.
+func getChunkPlacement(ctx context.Context) [][]string {
+	values := metadata.ValueFromIncomingContext(ctx, chunkPlacementMetadataKey)
+	if len(values) == 0 {
+		return nil
+	}
+	placement := make([][]string, len(values))
+	for i, value := range values {
+		if value != "" {
+			placement[i] = strings.Split(value, ",")
+		}
+	}
+	return placement
+}
+
+// getChunkSizes gets the size of Chunk reported by a heartbeat from its
+// metadata, or nil if it is not given.
+func getChunkSizes(ctx context.Context) ([]ChunkSizeInfo, error) {
+	var infos []ChunkSizeInfo
+	for _, value := range metadata.ValueFromIncomingContext(ctx, chunkSizesMetadataKey) {
+		for chunkId, s := range string2Tags(value) {
+			size, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("illegal chunk size, chunk id: %s, size: %q", chunkId, s)
+			}
+			infos = append(infos, ChunkSizeInfo{ChunkId: chunkId, Size: size})
+		}
+	}
+	return infos, nil
+}
+
+// getChunkAccess gets the last read time of Chunk reported by a heartbeat from
+// its metadata, or nil if it is not given.
+func getChunkAccess(ctx context.Context) ([]ChunkAccessInfo, error) {
+	var infos []ChunkAccessInfo
+	for _, value := range metadata.ValueFromIncomingContext(ctx, chunkAccessMetadataKey) {
+		for chunkId, s := range string2Tags(value) {
+			accessTime, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || accessTime < 0 {
+				return nil, fmt.Errorf("illegal chunk access time, chunk id: %s, time: %q", chunkId, s)
+			}
+			infos = append(infos, ChunkAccessInfo{ChunkId: chunkId, LastAccessTime: accessTime})
+		}
+	}
+	return infos, nil
+}
+
+// getReportTime gets the time of the DataNode when it sends a heartbeat from
+// its metadata, or 0 if it is not given.
+func getReportTime(ctx context.Context) (int64, error) {
+	values := metadata.ValueFromIncomingContext(ctx, reportTimeMetadataKey)
+	if len(values) == 0 {
+		return 0, nil
+	}
+	reportTime, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil || reportTime <= 0 {
+		return 0, fmt.Errorf("illegal report time, time: %q", values[0])
+	}
+	return reportTime, nil
+}
+
+// getRegisterIdentity gets the DataNode id and whether the DataNode is fresh
+// from the metadata of a register request. A new id is generated if it is not
+// given.
+func getRegisterIdentity(ctx context.Context) (string, bool, error) {
+	values := metadata.ValueFromIncomingContext(ctx, dataNodeIdMetadataKey)
+	if len(values) == 0 || values[0] == "" {
+		return util.GenerateUUIDString(), false, nil
+	}
+	isFresh := false
+	if fresh := metadata.ValueFromIncomingContext(ctx, dataNodeFreshMetadataKey); len(fresh) != 0 {
+		var err error
+		isFresh, err = strconv.ParseBool(fresh[0])
+		if err != nil {
+			return "", false, fmt.Errorf("illegal fresh flag, flag: %q", fresh[0])
+		}
+	}
+	return values[0], isFresh, nil
+}
+
+// getCodingScheme gets the CodingScheme of a GetDataNodes4Add request from its
+// metadata, or the zero value if it is not given.
+func getCodingScheme(ctx context.Context) (CodingScheme, error) {
+	values := metadata.ValueFromIncomingContext(ctx, codingSchemeMetadataKey)
+	if len(values) == 0 || values[0] == replicatedScheme {
+		return CodingScheme{}, nil
+	}
+	return ParseCodingScheme(values[0])
+}
+
+// getWorkDir gets the working directory of a request from its metadata, or the
+// root if it is not given.
+func getWorkDir(ctx context.Context) string {
+	if values := metadata.ValueFromIncomingContext(ctx, workDirMetadataKey); len(values) != 0 {
+		return values[0]
+	}
+	return pathSplitString
+}
+
+// getClientLocality gets the ClientLocality hint of the request. Fields which
+// are not given are empty.
+func getClientLocality(ctx context.Context) ClientLocality {
+	locality := ClientLocality{}
+	if values := metadata.ValueFromIncomingContext(ctx, clientAddressMetadataKey); len(values) != 0 {
+		locality.Address = values[0]
+	}
+	if values := metadata.ValueFromIncomingContext(ctx, clientTagsMetadataKey); len(values) != 0 {
+		locality.Tags = string2Tags(values[0])
+	}
+	return locality
+}
+
+// resolveRequestPaths replaces all paths in the request with the resolved ones.
+func resolveRequestPaths(ctx context.Context, req interface{}) error {
+	workDir := getWorkDir(ctx)
+	var paths []*string
+	switch args := req.(type) {
+	case *pb.CheckArgs4AddArgs:
+		paths = []*string{&args.Path}
+	case *pb.Callback4AddArgs:
+		paths = []*string{&args.FilePath}
+	case *pb.CheckAndGetArgs:
+		paths = []*string{&args.Path}
+	case *pb.CheckAndMkDirArgs:
+		paths = []*string{&args.Path}
+	case *pb.CheckAndMoveArgs:
+		paths = []*string{&args.SourcePath, &args.TargetPath}
+	case *pb.CheckAndRemoveArgs:
+		paths = []*string{&args.Path}
+	case *pb.CheckAndListArgs:
+		paths = []*string{&args.Path}
+	case *pb.CheckAndStatArgs:
+		paths = []*string{&args.Path}
+	case *pb.CheckAndRenameArgs:
+		paths = []*string{&args.Path}
+	}
+	for _, path := range paths {
+		resolved, err := ResolvePath(workDir, *path)
+		if err != nil {
+			return err
+		}
+		*path = resolved
+	}
+	return nil
+}
+
+// setAppliedIndexHeader tells the client the index of the Raft log of its
+// mutation through the header of the response. The client can give it back in
+// a later read so that the read sees the mutation on any master.
+func setAppliedIndexHeader(ctx context.Context, index uint64) {
+	// It fails only if ctx is not of a gRPC call, in which case no one reads
+	// the header.
+	_ = grpc.SetHeader(ctx, metadata.Pairs(appliedIndexMetadataKey, strconv.FormatUint(index, 10)))
+}
+
+// waitForMinIndex waits until this master has applied the Raft log whose index
+// is given by the client in the metadata of the request. It returns an error if
+// the index is illegal or this master can not catch up within the configured
+// readIndexTimeout.
+func waitForMinIndex(ctx context.Context) error {
+	values := metadata.ValueFromIncomingContext(ctx, minIndexMetadataKey)
+	if len(values) == 0 {
+		return nil
+	}
+	index, err := strconv.ParseUint(values[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("illegal min applied index, index: %q", values[0])
+	}
+	timeout := viper.GetInt(MasterReadIndexTimeout)
+	if timeout <= 0 {
+		timeout = defaultReadIndexTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+	return WaitForAppliedIndex(ctx, index)
+}
+
 // getData4Apply serializes an Operation and encapsulates the result in OpContainer
 // and serializes OpContainer again.
 func getData4Apply(operation Operation, opType string) []byte {
@@ -0,0 +1,404 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	set "github.com/deckarep/golang-set"
+	"github.com/hashicorp/raft"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"testing"
+	"time"
+	"tinydfs-base/common"
+	"tinydfs-base/protocol/pb"
+)
+
+func TestMasterHandler_Shutdown(t *testing.T) {
+	tests := []struct {
+		name         string
+		ignoreCancel bool
+		wantErr      bool
+	}{
+		{
+			name:    "Success",
+			wantErr: false,
+		},
+		{
+			name:         "Timeout",
+			ignoreCancel: true,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			originFuncs := monitorFuncs
+			t.Cleanup(func() {
+				monitorFuncs = originFuncs
+			})
+			var (
+				observed = atomic.NewInt32(0)
+				release  = make(chan struct{})
+			)
+			monitorFuncs = make([]monitorFunc, 0)
+			for i := 0; i < 3; i++ {
+				monitorFuncs = append(monitorFuncs, func(ctx context.Context) {
+					<-ctx.Done()
+					// Simulate finishing the current iteration.
+					time.Sleep(10 * time.Millisecond)
+					observed.Inc()
+				})
+			}
+			if tt.ignoreCancel {
+				monitorFuncs = append(monitorFuncs, func(ctx context.Context) {
+					<-release
+				})
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			handler := &MasterHandler{
+				ctx:    ctx,
+				cancel: cancel,
+			}
+			StartMonitor(handler.ctx)
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer shutdownCancel()
+			err := handler.Shutdown(shutdownCtx)
+			close(release)
+			if tt.wantErr {
+				assert.Error(t, err, "Expected an error.")
+				WaitMonitor(context.Background())
+				return
+			}
+			assert.NoError(t, err, "Unexpected error.")
+			assert.Equal(t, int32(3), observed.Load(), "All goroutines should observe cancellation before Shutdown returns.")
+		})
+	}
+}
+
+// newInmemRaft creates a raft node which uses in-memory transport and stores.
+func newInmemRaft(t *testing.T, id string) (*raft.Raft, *raft.InmemTransport) {
+	return newInmemRaftWithSnapshots(t, id, raft.NewInmemSnapshotStore())
+}
+
+func newInmemRaftWithSnapshots(t *testing.T, id string, snapshots raft.SnapshotStore) (*raft.Raft,
+	*raft.InmemTransport) {
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(id)
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	config.LogLevel = "ERROR"
+	_, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+	store := raft.NewInmemStore()
+	r, err := raft.NewRaft(config, &MasterFSM{}, store, store, snapshots, transport)
+	assert.NoError(t, err, "Unexpected error.")
+	t.Cleanup(func() {
+		_ = r.Shutdown().Error()
+	})
+	return r, transport
+}
+
+// newLeaderHandler starts a single master cluster and returns its handler after
+// it becomes the leader.
+func newLeaderHandler(t *testing.T) *MasterHandler {
+	leaderRaft, leaderTransport := newInmemRaft(t, "master1")
+	err := leaderRaft.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{{ID: "master1", Address: leaderTransport.LocalAddr()}},
+	}).Error()
+	assert.NoError(t, err, "Unexpected error.")
+	select {
+	case <-leaderRaft.LeaderCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fail to elect leader.")
+	}
+	return &MasterHandler{Raft: leaderRaft}
+}
+
+func TestMasterHandler_AddMaster(t *testing.T) {
+	leaderRaft, leaderTransport := newInmemRaft(t, "master1")
+	followerRaft, followerTransport := newInmemRaft(t, "master2")
+	leaderTransport.Connect(followerTransport.LocalAddr(), followerTransport)
+	followerTransport.Connect(leaderTransport.LocalAddr(), leaderTransport)
+	err := leaderRaft.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{{ID: "master1", Address: leaderTransport.LocalAddr()}},
+	}).Error()
+	assert.NoError(t, err, "Unexpected error.")
+	select {
+	case <-leaderRaft.LeaderCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fail to elect leader.")
+	}
+	leader := &MasterHandler{Raft: leaderRaft}
+	follower := &MasterHandler{Raft: followerRaft}
+
+	err = leader.AddMaster("master2", string(followerTransport.LocalAddr()))
+	assert.NoError(t, err, "Unexpected error.")
+	masters, err := leader.ListMasters()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 2, len(masters), "Unexpected number of masters.")
+	roles := make(map[string]string)
+	for _, master := range masters {
+		roles[master.Id] = master.Role
+		assert.Equal(t, raft.Voter.String(), master.Suffrage, "Unexpected suffrage.")
+	}
+	assert.Equal(t, map[string]string{"master1": leaderRole, "master2": followerRole}, roles,
+		"Unexpected roles.")
+
+	err = follower.AddMaster("master3", "master3")
+	var notLeaderErr *NotLeaderError
+	assert.ErrorAs(t, err, &notLeaderErr, "Follower should redirect to leader.")
+
+	err = leader.RemoveMaster("master2")
+	assert.NoError(t, err, "Unexpected error.")
+	masters, err = leader.ListMasters()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 1, len(masters), "Unexpected number of masters.")
+}
+
+func TestMasterHandler_CompactLog(t *testing.T) {
+	oldRoot := root
+	t.Cleanup(func() {
+		root = oldRoot
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	snapshots := raft.NewInmemSnapshotStore()
+	leaderRaft, leaderTransport := newInmemRaftWithSnapshots(t, "master1", snapshots)
+	err := leaderRaft.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{{ID: "master1", Address: leaderTransport.LocalAddr()}},
+	}).Error()
+	assert.NoError(t, err, "Unexpected error.")
+	select {
+	case <-leaderRaft.LeaderCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fail to elect leader.")
+	}
+	leader := &MasterHandler{Raft: leaderRaft}
+
+	var lastIndex uint64
+	for _, op := range []MkdirOperation{{Path: "/", FileName: "a"}, {Path: "/a", FileName: "b"}} {
+		f := leaderRaft.Apply(getData4Apply(op, common.OperationMkdir), time.Second)
+		assert.NoError(t, f.Error(), "Unexpected error.")
+		assert.NoError(t, f.Response().(*ApplyResponse).Error, "Unexpected error.")
+		lastIndex = f.Index()
+	}
+	index, err := leader.CompactLog()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.GreaterOrEqual(t, index, lastIndex, "Snapshot should include all applied logs.")
+	// Compacting again without new logs returns the same snapshot.
+	againIndex, err := leader.CompactLog()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, index, againIndex, "Unexpected snapshot index.")
+
+	metas, err := snapshots.List()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, index, metas[0].Index, "Unexpected snapshot index.")
+	_, reader, err := snapshots.Open(metas[0].ID)
+	assert.NoError(t, err, "Unexpected error.")
+	root.ChildNodes = map[string]*FileNode{}
+	err = MasterFSM{}.Restore(reader)
+	assert.NoError(t, err, "Unexpected error.")
+	_, ok := getFileNode("/a/b")
+	assert.True(t, ok, "Directory should be recovered from the snapshot.")
+
+	followerRaft, _ := newInmemRaft(t, "master2")
+	follower := &MasterHandler{Raft: followerRaft}
+	_, err = follower.CompactLog()
+	var notLeaderErr *NotLeaderError
+	assert.ErrorAs(t, err, &notLeaderErr, "Follower should redirect to leader.")
+}
+
+func TestResolveRequestPaths(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(workDirMetadataKey, "/home/alice"))
+	moveArgs := &pb.CheckAndMoveArgs{SourcePath: "docs/a.txt", TargetPath: "../bob"}
+	assert.NoError(t, resolveRequestPaths(ctx, moveArgs), "Unexpected error.")
+	assert.Equal(t, "/home/alice/docs/a.txt", moveArgs.SourcePath, "Unexpected source path.")
+	assert.Equal(t, "/home/bob", moveArgs.TargetPath, "Unexpected target path.")
+
+	listArgs := &pb.CheckAndListArgs{Path: "../../.."}
+	assert.Error(t, resolveRequestPaths(ctx, listArgs), "Path should not escape the root.")
+
+	// Relative paths are resolved against the root without working directory.
+	mkdirArgs := &pb.CheckAndMkDirArgs{Path: "usr/../tmp", DirName: "a"}
+	assert.NoError(t, resolveRequestPaths(context.Background(), mkdirArgs), "Unexpected error.")
+	assert.Equal(t, "/tmp", mkdirArgs.Path, "Unexpected path.")
+}
+
+func TestGetDeleteMode(t *testing.T) {
+	mode := viper.GetString(MasterDeleteMode)
+	t.Cleanup(func() {
+		viper.Set(MasterDeleteMode, mode)
+	})
+	viper.Set(MasterDeleteMode, DeleteModeImmediate)
+	got, err := getDeleteMode(context.Background())
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, DeleteModeImmediate, got, "Configured mode should be used.")
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(deleteModeMetadataKey, DeleteModeDeferred))
+	got, err = getDeleteMode(ctx)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, DeleteModeDeferred, got, "Mode of request should override the configured one.")
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(deleteModeMetadataKey, "never"))
+	_, err = getDeleteMode(ctx)
+	assert.Error(t, err, "Expected an error.")
+}
+
+func TestGetRegisterIdentity(t *testing.T) {
+	id, isFresh, err := getRegisterIdentity(context.Background())
+	assert.NoError(t, err, "Unexpected error.")
+	assert.NotEmpty(t, id, "A new id should be generated.")
+	assert.False(t, isFresh, "Unexpected fresh flag.")
+
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(dataNodeIdMetadataKey, "dataNode1", dataNodeFreshMetadataKey, "true"))
+	id, isFresh, err = getRegisterIdentity(ctx)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, "dataNode1", id, "Id of request should be used.")
+	assert.True(t, isFresh, "Unexpected fresh flag.")
+
+	ctx = metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(dataNodeIdMetadataKey, "dataNode1", dataNodeFreshMetadataKey, "maybe"))
+	_, _, err = getRegisterIdentity(ctx)
+	assert.Error(t, err, "Expected an error.")
+}
+
+func TestMasterHandler_HeartbeatChunkSizes(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	handler := newLeaderHandler(t)
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive,
+		Chunks: set.NewSet("chunk1"), FutureSendChunks: make(map[ChunkSendInfo]int)}
+	heartbeat := func(sizes string) error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(chunkSizesMetadataKey, sizes))
+		ctx = grpc.NewContextWithServerTransportStream(ctx, &headerRecorder{})
+		_, err := handler.Heartbeat(ctx, &pb.HeartbeatArgs{Id: "dataNode1", ChunkId: []string{"chunk1"}})
+		return err
+	}
+
+	assert.NoError(t, heartbeat("chunk1=1024"), "Unexpected error.")
+	assert.Equal(t, int64(1024), chunksMap["chunk1"].Size, "Size of heartbeat should be recorded.")
+
+	assert.Error(t, heartbeat("chunk1=big"), "Expected an error.")
+	assert.Equal(t, int64(1024), chunksMap["chunk1"].Size, "Illegal size should not be recorded.")
+}
+
+func TestMasterHandler_ChunkAccess(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	handler := newLeaderHandler(t)
+	for _, id := range []string{"chunk1", "chunk2"} {
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	}
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive,
+		Chunks: set.NewSet("chunk1", "chunk2"), FutureSendChunks: make(map[ChunkSendInfo]int)}
+	heartbeat := func(access string) error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(chunkAccessMetadataKey, access))
+		ctx = grpc.NewContextWithServerTransportStream(ctx, &headerRecorder{})
+		_, err := handler.Heartbeat(ctx, &pb.HeartbeatArgs{Id: "dataNode1", ChunkId: []string{"chunk1", "chunk2"}})
+		return err
+	}
+	now := time.Now()
+
+	assert.NoError(t, heartbeat(fmt.Sprintf("chunk1=%d", now.Unix())), "Unexpected error.")
+	cold, err := handler.GetColdChunks(now.Add(-time.Hour))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []string{"chunk2"}, cold, "Chunk never read should be cold.")
+
+	assert.Error(t, heartbeat("chunk2=yesterday"), "Expected an error.")
+	_, ok := GetChunkLastAccess("chunk2")
+	assert.False(t, ok, "Illegal access time should not be recorded.")
+}
+
+func TestMasterHandler_ClockSkew(t *testing.T) {
+	t.Cleanup(func() {
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	handler := newLeaderHandler(t)
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive, Chunks: set.NewSet(),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+	heartbeat := func(reportTime string) error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(reportTimeMetadataKey, reportTime))
+		ctx = grpc.NewContextWithServerTransportStream(ctx, &headerRecorder{})
+		_, err := handler.Heartbeat(ctx, &pb.HeartbeatArgs{Id: "dataNode1"})
+		return err
+	}
+
+	// The clock of the DataNode is 10 minutes ahead.
+	assert.NoError(t, heartbeat(fmt.Sprint(time.Now().Add(10*time.Minute).UnixMilli())), "Unexpected error.")
+	description, err := handler.DescribeDataNode("dataNode1")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.InDelta(t, float64(10*time.Minute), float64(description.ClockSkew), float64(time.Second),
+		"Unexpected clock skew.")
+
+	assert.Error(t, heartbeat("now"), "Expected an error.")
+	_, err = handler.DescribeDataNode("notExist")
+	assert.Error(t, err, "Expected an error.")
+}
+
+func TestMasterHandler_SwapFileNodes(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		root.subtreeSize = 0
+	})
+	leader := newLeaderHandler(t)
+	for _, dir := range []string{"blue", "green"} {
+		_, err := AddFileNode("/", dir, 0, false)
+		assert.NoError(t, err, "Unexpected error.")
+		_, err = AddFileNode("/"+dir, "app.bin", 0, true)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+	green, _ := getFileNode("/green/app.bin")
+	_, err := AddFileNode("/green", "app-v2.bin", 0, true)
+	assert.NoError(t, err, "Unexpected error.")
+
+	// Paths are resolved against the work directory of the request, and the
+	// time of the leader is recorded.
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(workDirMetadataKey, "/green"))
+	before := time.Now()
+	assert.NoError(t, leader.SwapFileNodes(ctx, "app.bin", "../blue/app.bin"), "Unexpected error.")
+	fileNode, _ := getFileNode("/blue/app.bin")
+	assert.Equal(t, green.Id, fileNode.Id, "Path should resolve to the other file.")
+	assert.NoError(t, leader.SwapFileNodes(ctx, "app.bin", "app-v2.bin"), "Unexpected error.")
+	fileNode, _ = getFileNode("/green/app-v2.bin")
+	assert.Len(t, fileNode.RenameHistory, 1, "Unexpected rename history.")
+	assert.False(t, fileNode.RenameHistory[0].Time.Before(before.Truncate(time.Millisecond)),
+		"Time of the leader should be recorded.")
+	assert.Error(t, leader.SwapFileNodes(ctx, "../../app.bin", "app.bin"), "Path should not escape the root.")
+}
+
+func TestMasterHandler_RestoreDeleted(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	leader := newLeaderHandler(t)
+	_, err := AddFileNode("/", "a", 0, false)
+	assert.NoError(t, err, "Unexpected error.")
+	removed := make([]string, 2)
+	for i := range removed {
+		_, err = AddFileNode("/a", "foo", int64(i), true)
+		assert.NoError(t, err, "Unexpected error.")
+		fileNode, err := RemoveFileNode("/a/foo")
+		assert.NoError(t, err, "Unexpected error.")
+		removed[i] = fileNode.Id
+	}
+
+	// Paths are resolved against the work directory of the request.
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(workDirMetadataKey, "/a"))
+	trash, err := leader.ListTrash(ctx, ".")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Len(t, trash, 2, "Unexpected trash.")
+	assert.NoError(t, leader.RestoreDeleted(ctx, ".", removed[0]), "Unexpected error.")
+	fileNode, ok := getFileNode("/a/foo")
+	assert.True(t, ok, "Deleted file should be restored.")
+	assert.Equal(t, removed[0], fileNode.Id, "The chosen file should be restored.")
+	assert.Error(t, leader.RestoreDeleted(ctx, ".", removed[1]), "Restoring over an existing file should fail.")
+	assert.Error(t, leader.RestoreDeleted(ctx, ".", "unknown"), "Expected an error.")
+}
@@ -2,10 +2,13 @@ package internal
 
 import (
 	"context"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/spf13/viper"
 	"google.golang.org/grpc"
+	"sort"
+	"sync"
 	"time"
 	"tinydfs-base/common"
 	"tinydfs-base/util"
@@ -14,9 +17,25 @@ import (
 const (
 	Request = "request"
 	Success = "success"
+	// Label values of the result of allocating dfs.
+	dfsEarlyExit = "early_exit"
+	dfsExhausted = "exhausted"
+	dfsNodeLimit = "node_limit"
+	// Label values of the repair of chunk locations.
+	repairRemoveFromDataNode     = "remove_from_datanode"
+	repairAddToDataNode          = "add_to_datanode"
+	repairRemoveDanglingDataNode = "remove_dangling_datanode"
+	repairRecountDataNode        = "recount_datanode"
+	// Label values of the result of auditing the spread of a chunk.
+	spreadMoveScheduled = "move_scheduled"
+	spreadNoTarget      = "no_target"
 )
 
-var monitorFuncs = make([]monitorFunc, 0)
+var (
+	monitorFuncs = make([]monitorFunc, 0)
+	// monitorWaitGroup is used to wait for all monitor goroutines to exit.
+	monitorWaitGroup = &sync.WaitGroup{}
+)
 
 func init() {
 	monitorFuncs = append(monitorFuncs, MonitorHeartbeat)
@@ -24,11 +43,32 @@ func init() {
 	monitorFuncs = append(monitorFuncs, CheckChunks)
 	monitorFuncs = append(monitorFuncs, CheckFileTree)
 	monitorFuncs = append(monitorFuncs, CheckStorableDataNode)
+	monitorFuncs = append(monitorFuncs, ReleaseStaged)
 }
 
 func StartMonitor(ctx context.Context) {
 	for _, f := range monitorFuncs {
-		go f(ctx)
+		monitorWaitGroup.Add(1)
+		go func(f monitorFunc) {
+			defer monitorWaitGroup.Done()
+			f(ctx)
+		}(f)
+	}
+}
+
+// WaitMonitor waits for all monitor goroutines to exit after their context is
+// cancelled. It returns an error if they have not exited when ctx is done.
+func WaitMonitor(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		monitorWaitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("monitor goroutines have not exited, error detail: %s", ctx.Err())
 	}
 }
 
@@ -43,47 +83,107 @@ type monitorFunc func(ctx context.Context)
 //    over 30 seconds, we will set Status to waiting.
 // 3. The Status of DataNode is waiting, and we have not received heartbeat of it
 //    over 10 minute, we will think this DataNode is dead and start a shrink.
+// DataNode degraded to the same stage in a round are applied in one
+// BatchDegradeOperation, and at most "degradeBatchSize" DataNode are degraded
+// to each stage in a round, so that re-replication ramps up gradually.
 func MonitorHeartbeat(ctx context.Context) {
 	for {
 		select {
 		default:
-			updateMapLock.Lock()
-			for _, node := range dataNodeMap {
-				Logger.WithContext(ctx).Debugf("Datanode id: %s, chunk set: %s", node.Id, node.Chunks.String())
-				// Give died datanode a second chance to restart.
-				if int(time.Now().Sub(node.HeartbeatTime).Seconds()) > viper.GetInt(common.ChunkWaitingTime)*
-					viper.GetInt(common.ChunkHeartbeatTime) && node.Status == common.Alive {
-					operation := &DegradeOperation{
-						Id:         util.GenerateUUIDString(),
-						DataNodeId: node.Id,
-						Stage:      common.Degrade2Waiting,
-					}
-					data := getData4Apply(operation, common.OperationDegrade)
-					_ = GlobalMasterHandler.Raft.Apply(data, 5*time.Second)
-					continue
-				}
-				if int(time.Now().Sub(node.HeartbeatTime).Seconds()) > viper.GetInt(common.ChunkDieTime) &&
-					node.Status == common.Waiting {
-					csCountMonitor.Dec()
-					operation := &DegradeOperation{
-						Id:         util.GenerateUUIDString(),
-						DataNodeId: node.Id,
-						Stage:      common.Degrade2Dead,
-					}
-					data := getData4Apply(operation, common.OperationDegrade)
-					_ = GlobalMasterHandler.Raft.Apply(data, 5*time.Second)
-					continue
-				}
-			}
-			updateMapLock.Unlock()
+			checkHeartbeat(ctx, applyBatchDegrade)
 			Logger.WithContext(ctx).Infof("Complete a round of check, time: %s", time.Now().String())
-			time.Sleep(time.Duration(viper.GetInt(common.MasterCheckTime)) * time.Second)
+			select {
+			case <-time.After(time.Duration(viper.GetInt(common.MasterCheckTime)) * time.Second):
+			case <-ctx.Done():
+				return
+			}
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// checkHeartbeat does a round of heartbeat check and passes DataNode which need
+// to be degraded to the apply function, at most one BatchDegradeOperation for
+// each stage.
+func checkHeartbeat(ctx context.Context, apply func(operation *BatchDegradeOperation)) {
+	batchSize := viper.GetInt(MasterDegradeBatchSize)
+	if batchSize <= 0 {
+		batchSize = defaultDegradeBatchSize
+	}
+	waitingNodes := make([]*DataNode, 0)
+	deadNodes := make([]*DataNode, 0)
+	updateMapLock.RLock()
+	for _, node := range dataNodeMap {
+		Logger.WithContext(ctx).Debugf("Datanode id: %s, chunk set: %s", node.Id, node.Chunks.String())
+		// Give died datanode a second chance to restart.
+		if int(time.Now().Sub(node.HeartbeatTime).Seconds()) > viper.GetInt(common.ChunkWaitingTime)*
+			viper.GetInt(common.ChunkHeartbeatTime) && node.Status == common.Alive {
+			waitingNodes = append(waitingNodes, node)
+			continue
+		}
+		if int(time.Now().Sub(node.HeartbeatTime).Seconds()) > viper.GetInt(common.ChunkDieTime) &&
+			(node.Status == common.Waiting || node.Status == Quarantined) {
+			deadNodes = append(deadNodes, node)
+		}
+	}
+	waitingIds := getDegradeBatch(waitingNodes, batchSize)
+	deadIds := getDegradeBatch(deadNodes, batchSize)
+	updateMapLock.RUnlock()
+
+	if len(waitingIds) != 0 {
+		apply(&BatchDegradeOperation{
+			Id:          util.GenerateUUIDString(),
+			DataNodeIds: waitingIds,
+			Stage:       common.Degrade2Waiting,
+			Time:        time.Now().UnixMilli(),
+		})
+	}
+	if len(deadIds) != 0 {
+		apply(&BatchDegradeOperation{
+			Id:          util.GenerateUUIDString(),
+			DataNodeIds: deadIds,
+			Stage:       common.Degrade2Dead,
+			Time:        time.Now().UnixMilli(),
+		})
+	}
+}
+
+// getDegradeBatch returns id of at most batchSize DataNode which have not sent
+// heartbeat for the longest time. The caller must hold updateMapLock.
+func getDegradeBatch(nodes []*DataNode, batchSize int) []string {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].HeartbeatTime.Before(nodes[j].HeartbeatTime)
+	})
+	if len(nodes) > batchSize {
+		nodes = nodes[:batchSize]
+	}
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.Id
+	}
+	return ids
+}
+
+// applyBatchDegrade applies the BatchDegradeOperation through Raft.
+func applyBatchDegrade(operation *BatchDegradeOperation) {
+	Logger.Infof("Degrade a batch of datanodes, stage: %v, datanode ids: %v", operation.Stage,
+		operation.DataNodeIds)
+	data := getData4Apply(operation, OperationBatchDegrade)
+	applyFuture := GlobalMasterHandler.Raft.Apply(data, 5*time.Second)
+	if err := applyFuture.Error(); err != nil {
+		Logger.Errorf("Fail to degrade a batch of datanodes, error detail: %s", err.Error())
+		return
+	}
+	// Only count DataNode which are really removed, some of them may have been
+	// removed by others such as ForceRemoveDataNode.
+	if operation.Stage == common.Degrade2Dead {
+		if degraded, ok := applyFuture.Response().(*ApplyResponse).Response.(int); ok {
+			csCountMonitor.Sub(float64(degraded))
+		}
+	}
+}
+
 // ConsumePendingChunk runs in a goroutine. This function will keep looping to
 // check the pendingChunkQueue, there are 3 situations:
 // 1. The timer is up, allocate all pending chunks in the pendingChunkQueue.
@@ -99,6 +199,8 @@ func ConsumePendingChunk(ctx context.Context) {
 		select {
 		case <-timer.C:
 			BatchAllocateChunks()
+			BatchReconstructFragments()
+			updatePendingAgeMonitor(time.Now())
 		case <-ctx.Done():
 			timer.Stop()
 			return
@@ -111,14 +213,23 @@ func ConsumePendingChunk(ctx context.Context) {
 }
 
 // CheckChunks checks dataNodeMap and chunkMap to remove the deleted chunks
-// whose storing fileNode id is not found in directory tree.
+// whose storing fileNode id is not found in directory tree. It also expires
+// the stale pending replicas found by the leader.
 func CheckChunks(ctx context.Context) {
 	timer := time.NewTicker(time.Duration(viper.GetInt(common.CleanupTime)) * time.Second)
 	for {
 		select {
 		case <-timer.C:
-			data := getData4Apply(CheckChunksOperation{Id: util.GenerateUUIDString()}, common.OperationChunksCheck)
+			data := getData4Apply(CheckChunksOperation{
+				Id:   util.GenerateUUIDString(),
+				Time: time.Now().UnixMilli(),
+			}, common.OperationChunksCheck)
 			GlobalMasterHandler.Raft.Apply(data, 5*time.Second)
+			if stale := FindStalePendingDataNodes(); len(stale) != 0 {
+				operation := ExpirePendingOperation{Id: util.GenerateUUIDString(), Replicas: stale}
+				data = getData4Apply(operation, OperationExpirePending)
+				GlobalMasterHandler.Raft.Apply(data, 5*time.Second)
+			}
 		case <-ctx.Done():
 			return
 		}
@@ -155,11 +266,127 @@ func CheckStorableDataNode(ctx context.Context) {
 	}
 }
 
+// ReleaseStaged puts staged Chunk of dead DataNode to pendingChunkQueue when
+// their release time comes. It checks every heartbeat interval and applies
+// nothing if there is no staged Chunk.
+func ReleaseStaged(ctx context.Context) {
+	timer := time.NewTicker(time.Duration(viper.GetInt(common.ChunkHeartbeatTime)) * time.Second)
+	for {
+		select {
+		case <-timer.C:
+			if getStagedChunkNum() == 0 {
+				continue
+			}
+			data := getData4Apply(ReleaseStagedOperation{
+				Id:   util.GenerateUUIDString(),
+				Time: time.Now().UnixMilli(),
+			}, OperationReleaseStaged)
+			GlobalMasterHandler.Raft.Apply(data, 5*time.Second)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
 var (
 	csCountMonitor = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "chunkserver_count",
 		Help: "the number of chunkserver",
 	})
+	clusterFreeCapacityMonitor = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cluster_free_capacity",
+		Help: "the free capacity of all alive chunkserver in bytes",
+	})
+	lostChunkCountMonitor = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "lost_chunk_count",
+		Help: "the number of chunk which is not stored by any alive chunkserver",
+	})
+	allocateDFSDurationMonitor = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "allocate_dfs_duration_seconds",
+		Help:    "the duration of each search of chunk allocating plan",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+	allocateDFSExploredNodesMonitor = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "allocate_dfs_explored_nodes",
+		Help: "the number of nodes explored by the search of chunk allocating plan",
+	})
+	allocateDFSResultMonitor = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "allocate_dfs_result_count",
+		Help: "the number of searches of chunk allocating plan which exit early, exhaust the search or reach the node limit",
+	}, []string{"result"})
+	allocateDFSVarianceMonitor = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "allocate_dfs_variance",
+		Help: "the variance or the weighted cost of the last chunk allocating plan",
+	})
+	skippedPlacementCountMonitor = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "skipped_placement_count",
+		Help: "the number of planned replicas skipped because the chunkserver already stores the chunk",
+	})
+	pendingQueueSaturatedMonitor = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_queue_saturated",
+		Help: "1 if the length of the pending chunk queue reaches the high watermark, otherwise 0",
+	})
+	pendingChunkMaxAgeMonitor = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_chunk_max_age_seconds",
+		Help: "the longest time a chunk has waited in the pending chunk queue",
+	})
+	pendingChunkAvgAgeMonitor = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_chunk_avg_age_seconds",
+		Help: "the average time chunks have waited in the pending chunk queue",
+	})
+	pendingChunkStuckCountMonitor = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_chunk_stuck_count",
+		Help: "the number of chunks which have waited in the pending chunk queue longer than the threshold",
+	})
+	deferredChunkCountMonitor = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "deferred_chunk_count",
+		Help: "the number of chunk deferred because the pending chunk queue is saturated",
+	})
+	chunkLocationRepairCountMonitor = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chunk_location_repair_count",
+		Help: "the number of drifts between chunks of chunkserver and chunkservers of chunk which are repaired",
+	}, []string{"repair"})
+	chunkSpreadViolationCountMonitor = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chunk_spread_violation_count",
+		Help: "the number of replicas found exceeding the max replicas per failure domain of their file",
+	}, []string{"result"})
+	softQuotaExceededCountMonitor = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "soft_quota_exceeded_count",
+		Help: "the number of file creations which exceed the soft quota of a directory",
+	})
+	quarantinedDataNodeCountMonitor = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "quarantined_datanode_count",
+		Help: "the number of datanodes quarantined for flapping",
+	})
+	dataNodeChunkCountMonitor = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "datanode_chunk_count",
+		Help: "the number of chunks stored by each chunkserver",
+	}, []string{"datanode"})
+	dataNodeChunkBytesMonitor = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "datanode_chunk_bytes",
+		Help: "the sum of sizes of chunks stored by each chunkserver as reported by it",
+	}, []string{"datanode"})
+	namespaceMaxDepthMonitor = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "namespace_max_depth",
+		Help: "the depth of the deepest file or directory in each namespace",
+	}, []string{"namespace"})
+	namespaceNodeCountMonitor = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "namespace_node_count",
+		Help: "the number of files and directories in each namespace",
+	}, []string{"namespace"})
+	namespaceTombstoneCountMonitor = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "namespace_tombstone_count",
+		Help: "the number of deleted files and directories which have not been cleaned in each namespace",
+	}, []string{"namespace"})
+	namespaceMaxChildrenMonitor = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "namespace_max_children",
+		Help: "the maximum number of children of a directory in each namespace",
+	}, []string{"namespace"})
+	namespaceAvgChildrenMonitor = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "namespace_avg_children",
+		Help: "the average number of children of a directory in each namespace",
+	}, []string{"namespace"})
 	rpcCountMonitor = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "rpc_count",
 		Help: "the number of rpc call",
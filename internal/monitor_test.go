@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	set "github.com/deckarep/golang-set"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"tinydfs-base/common"
+	"tinydfs-base/util"
+)
+
+func TestCheckHeartbeat_BatchDegrade(t *testing.T) {
+	const (
+		nodeNum   = 20
+		batchSize = 8
+	)
+	viper.Set(MasterDegradeBatchSize, batchSize)
+	t.Cleanup(func() {
+		viper.Set(MasterDegradeBatchSize, defaultDegradeBatchSize)
+		dataNodeMap = make(map[string]*DataNode)
+		chunksMap = make(map[string]*Chunk)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	deadTime := time.Now().Add(-time.Duration(viper.GetInt(common.ChunkDieTime)+1) * time.Second)
+	for i := 0; i < nodeNum; i++ {
+		id := fmt.Sprintf("dataNode%d", i)
+		dataNodeMap[id] = &DataNode{
+			Id:               id,
+			Status:           common.Waiting,
+			Chunks:           set.NewSet(),
+			FutureSendChunks: make(map[ChunkSendInfo]int),
+			HeartbeatTime:    deadTime,
+		}
+	}
+
+	applyNum := 0
+	apply := func(operation *BatchDegradeOperation) {
+		applyNum++
+		assert.Equal(t, common.Degrade2Dead, operation.Stage, "Unexpected stage.")
+		assert.LessOrEqual(t, len(operation.DataNodeIds), batchSize, "Batch is too large.")
+		_, err := operation.Apply()
+		assert.NoError(t, err, "Unexpected error.")
+	}
+	rounds := 0
+	for len(dataNodeMap) != 0 && rounds < nodeNum {
+		checkHeartbeat(context.Background(), apply)
+		rounds++
+	}
+	assert.Equal(t, 0, len(dataNodeMap), "All dead datanodes should be degraded.")
+	// 20 datanodes are degraded in 3 rounds with one batched apply each.
+	assert.Equal(t, 3, rounds, "Unexpected number of rounds.")
+	assert.Equal(t, 3, applyNum, "Unexpected number of applies.")
+}
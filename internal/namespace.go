@@ -3,13 +3,15 @@ package internal
 import (
 	"bufio"
 	"container/list"
+	"context"
 	"fmt"
 	mapset "github.com/deckarep/golang-set"
 	"github.com/hashicorp/raft"
-	"math"
+	"github.com/spf13/viper"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"tinydfs-base/common"
 	"tinydfs-base/util"
@@ -25,6 +27,18 @@ const (
 	isFileIdx
 	delTimeIdx
 	isDelIdx
+	constraintIdx
+	replicaFactorIdx
+	storagePolicyIdx
+	minReadReplicasIdx
+	quotaIdx
+	softQuotaIdx
+	maxChildrenIdx
+	ownerIdx
+	groupIdx
+	modeIdx
+	maxReplicasPerDomainIdx
+	renameHistoryIdx
 )
 
 const (
@@ -32,6 +46,9 @@ const (
 	pathSplitString  = "/"
 	deleteFilePrefix = "delete_"
 	deleteDelimiter  = "_"
+	// walkDeadlineExceeded is the TruncatedReason of a WalkResult whose
+	// context is done before the walk finishes.
+	walkDeadlineExceeded = "deadline exceeded"
 )
 
 var (
@@ -46,8 +63,43 @@ var (
 	}
 	// fileNodeIdSet includes all fileNode id stored in the root.
 	fileNodeIdSet = mapset.NewSet()
+	// fileNodeIndex stores all FileNode in fileNodeIdSet using their id as the
+	// key, so that a FileNode can be found by id without walking the directory
+	// trees. It is protected by createFileNodeLock.
+	fileNodeIndex = make(map[string]*FileNode)
+	// namespaceRoots stores roots of all namespaces except the default one,
+	// using namespace name as the key. Each namespace is an isolated directory
+	// tree, and the FileName of its root is the name of the namespace. It is
+	// written under createFileNodeLock.
+	namespaceRoots = make(map[string]*FileNode)
+	// createFileNodeLock makes checking the existence of a FileNode and creating
+	// it atomic, so that callers outside the FSM can also create FileNode safely.
+	createFileNodeLock = newContextMutex()
+	// constrainedFileNodes stores all FileNode which has a PlacementConstraint,
+	// using FileNode id as the key. It is used to find the constraint of a Chunk
+	// when allocating DataNode for it.
+	constrainedFileNodes = make(map[string]*FileNode)
+	// replicaFactorFileNodes stores all FileNode which has a ReplicaFactor,
+	// using FileNode id as the key. It is used to find how many replicas a
+	// Chunk needs when it is re-replicated.
+	replicaFactorFileNodes = make(map[string]*FileNode)
+	// spreadFileNodes stores all FileNode which has a MaxReplicasPerDomain,
+	// using FileNode id as the key. It is used by the allocator and the spread
+	// auditor to keep replicas of a Chunk spread across failure domains.
+	spreadFileNodes = make(map[string]*FileNode)
+	// updateConstraintLock protects constrainedFileNodes, replicaFactorFileNodes,
+	// spreadFileNodes and Constraint of all FileNode, because they are also read
+	// by the allocation goroutine.
+	updateConstraintLock = &sync.RWMutex{}
+	// moveHooks are invoked in order after a FileNode is moved.
+	moveHooks = []MoveHook{adjustSubtreeSize4Move}
 )
 
+// MoveHook is invoked after a FileNode is moved from oldParent to newParent. It
+// is used to adjust cached aggregates on both ancestor chains, and it should
+// not walk the subtree of the moved FileNode.
+type MoveHook func(fileNode *FileNode, oldParent *FileNode, newParent *FileNode)
+
 // FileNode represents a file or directory in the file system.
 type FileNode struct {
 	Id         string
@@ -65,174 +117,1901 @@ type FileNode struct {
 	// determine whether this FileNode can be permanently deleted.
 	DelTime *time.Time
 	IsDel   bool
+	// Constraint restricts which DataNode can store replicas of this file.
+	Constraint PlacementConstraint
+	// ReplicaFactor is the number of replicas of each Chunk of a file. For a
+	// directory, it is the default of files created under it. 0 means it is
+	// not set and the configured ReplicaNum is used.
+	ReplicaFactor int
+	// StoragePolicy is the storage policy of a file. For a directory, it is the
+	// default of files created under it. Empty means it is not set.
+	StoragePolicy string
+	// MinReadReplicas is the minimum number of alive replicas of a Chunk of a
+	// file to read the Chunk safely. Reading a Chunk with fewer replicas is
+	// flagged as unsafe. 0 means there is no floor.
+	MinReadReplicas int
+	// Quota is the maximum total size of all files under a directory. Creating
+	// a file which makes the size exceed it is rejected. 0 means there is no
+	// quota.
+	Quota int64
+	// SoftQuota is the size of all files under a directory beyond which creating
+	// a file is still allowed but a warning is emitted. 0 means there is no soft
+	// quota.
+	SoftQuota int64
+	// MaxChildren is the maximum number of direct children of a directory. 0
+	// means the configured maxChildrenPerDir is used.
+	MaxChildren int
+	// Owner and Group are the user and group of the requester who creates the
+	// FileNode. They are empty if the requester is unknown.
+	Owner string
+	Group string
+	// Mode is the owner, group and other rwx permission bits like POSIX. 0 means
+	// it is not set and everyone can access the FileNode.
+	Mode uint32
+	// MaxReplicasPerDomain is the maximum number of replicas of a Chunk of a
+	// file in the same failure domain. 0 means the default replica number, which
+	// means there is no constraint.
+	MaxReplicasPerDomain int
+	// RenameHistory includes the previous names of the FileNode from the oldest
+	// to the latest, at most the configured renameHistoryLength of them.
+	RenameHistory []RenameRecord
+	// subtreeSize is the cached total size of all files in the subtree rooted
+	// at this FileNode, including deleted files which have not been cleaned.
+	subtreeSize int64
+}
+
+// CreateNamespace creates a new namespace with an empty directory tree. The
+// name of the namespace is the file name of its root, so it can not be empty
+// or include the path separator. It can not include "$" or a line break
+// either, which would break a snapshot record or the SnapshotDelimiter.
+func CreateNamespace(namespace string) (*FileNode, error) {
+	if namespace == rootFileName {
+		return nil, fmt.Errorf("namespace name can not be empty")
+	}
+	if strings.ContainsAny(namespace, pathSplitString+common.DollarDelimiter+"\n") {
+		return nil, fmt.Errorf("illegal namespace name, namespace : %q", namespace)
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	if _, ok := namespaceRoots[namespace]; ok {
+		return nil, fmt.Errorf("namespace already exist, namespace : %s", namespace)
+	}
+	nsRoot := &FileNode{
+		Id:         util.GenerateUUIDString(),
+		FileName:   namespace,
+		ChildNodes: make(map[string]*FileNode),
+	}
+	namespaceRoots[namespace] = nsRoot
+	return nsRoot, nil
+}
+
+// getNamespaceRoot gets the root of the given namespace. An empty namespace
+// means the default namespace whose root is root.
+func getNamespaceRoot(namespace string) (*FileNode, error) {
+	if namespace == rootFileName {
+		return root, nil
+	}
+	nsRoot, ok := namespaceRoots[namespace]
+	if !ok {
+		return nil, fmt.Errorf("namespace not exist, namespace : %s", namespace)
+	}
+	return nsRoot, nil
+}
+
+// allNamespaceRoots returns roots of all namespaces, the default root is always
+// the first one.
+func allNamespaceRoots() []*FileNode {
+	names := make([]string, 0, len(namespaceRoots))
+	for name := range namespaceRoots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	roots := make([]*FileNode, 0, len(names)+1)
+	roots = append(roots, root)
+	for _, name := range names {
+		roots = append(roots, namespaceRoots[name])
+	}
+	return roots
+}
+
+// CheckAndGetFileNode gets a FileNode by given path if the given path is legal.
+func CheckAndGetFileNode(path string) (*FileNode, error) {
+	return checkAndGetFileNode(root, path)
+}
+
+// CheckAndGetFileNodeIn gets a FileNode by given path in the given namespace.
+func CheckAndGetFileNodeIn(namespace string, path string) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return checkAndGetFileNode(nsRoot, path)
+}
+
+func checkAndGetFileNode(nsRoot *FileNode, path string) (*FileNode, error) {
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist {
+		return nil, fmt.Errorf("path not exist, path : %s", path)
+	}
+	return fileNode, nil
+}
+
+// getFileNode gets target FileNode in the default namespace.
+func getFileNode(path string) (*FileNode, bool) {
+	return getFileNodeFrom(root, path)
+}
+
+// getFileNodeFrom gets target FileNode in the directory tree of the given root.
+func getFileNodeFrom(nsRoot *FileNode, path string) (*FileNode, bool) {
+	currentNode := nsRoot
+	path = strings.Trim(path, pathSplitString)
+	fileNames := strings.Split(path, pathSplitString)
+	if path == rootFileName {
+		return currentNode, true
+	}
+
+	for _, name := range fileNames {
+		nextNode, exist := currentNode.ChildNodes[name]
+		if !exist {
+			return nil, false
+		}
+		if nextNode.IsDel {
+			return nil, false
+		}
+		currentNode = nextNode
+	}
+	return currentNode, true
+}
+
+// ResolvePath resolves the path against the working directory and returns the
+// absolute path without ".", ".." and empty elements. An absolute path is only
+// cleaned, and a relative path is resolved against the working directory which
+// must be absolute. It is an error if the path goes above the root.
+func ResolvePath(workDir string, path string) (string, error) {
+	if !strings.HasPrefix(path, pathSplitString) {
+		if !strings.HasPrefix(workDir, pathSplitString) {
+			return "", fmt.Errorf("working directory is not absolute, working directory: %s", workDir)
+		}
+		path = workDir + pathSplitString + path
+	}
+	names := make([]string, 0)
+	for _, name := range strings.Split(path, pathSplitString) {
+		switch name {
+		case "", ".":
+		case "..":
+			if len(names) == 0 {
+				return "", fmt.Errorf("path escapes the root, path: %s", path)
+			}
+			names = names[:len(names)-1]
+		default:
+			names = append(names, name)
+		}
+	}
+	return pathSplitString + strings.Join(names, pathSplitString), nil
+}
+
+// AddFileNode add a FileNode to directory tree. It is generally used to add a
+// directory because it will unlock all FileNode after adding the FileNode to
+// directory tree.
+func AddFileNode(path string, filename string, size int64, isFile bool) (*FileNode, error) {
+	return addFileNode(root, path, filename, size, isFile)
+}
+
+// AddFileNodeIn add a FileNode to the directory tree of the given namespace.
+func AddFileNodeIn(namespace string, path string, filename string, size int64, isFile bool) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return addFileNode(nsRoot, path, filename, size, isFile)
+}
+
+func addFileNode(nsRoot *FileNode, path string, filename string, size int64, isFile bool) (*FileNode, error) {
+	if isFile {
+		if err := checkFileSize(size); err != nil {
+			return nil, err
+		}
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, err := getParentDir(nsRoot, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := fileNode.ChildNodes[filename]; ok {
+		return nil, fmt.Errorf("target path already has file with the same name, path : %s", path)
+	}
+	if err := checkFanOut(fileNode); err != nil {
+		return nil, err
+	}
+	if err := checkQuota(fileNode, size); err != nil {
+		return nil, err
+	}
+	return createFileNode(fileNode, filename, size, isFile), nil
+}
+
+// getParentDir gets the directory in which a FileNode will be created. A file
+// has no ChildNodes, so it fails with a clear error rather than letting the
+// caller write into it.
+func getParentDir(nsRoot *FileNode, path string) (*FileNode, error) {
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist {
+		return nil, fmt.Errorf("path not exist, path : %s", path)
+	}
+	if fileNode.IsFile {
+		return nil, fmt.Errorf("parent is not a directory, path : %s", path)
+	}
+	return fileNode, nil
+}
+
+// CreateOrReplaceFileNode adds a file to directory tree. If a file with the same
+// name exists, it will be erased and replaced by the new one atomically. It
+// returns the new FileNode and id of all Chunk of the replaced file, which will
+// be cleaned with the replaced file. A directory can not be replaced.
+func CreateOrReplaceFileNode(path string, filename string, size int64) (*FileNode, []string, error) {
+	return createOrReplaceFileNode(root, path, filename, size)
+}
+
+// CreateOrReplaceFileNodeIn does the same thing as CreateOrReplaceFileNode in
+// the given namespace.
+func CreateOrReplaceFileNodeIn(namespace string, path string, filename string, size int64) (*FileNode,
+	[]string, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	return createOrReplaceFileNode(nsRoot, path, filename, size)
+}
+
+func createOrReplaceFileNode(nsRoot *FileNode, path string, filename string, size int64) (*FileNode,
+	[]string, error) {
+	if err := checkFileSize(size); err != nil {
+		return nil, nil, err
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, err := getParentDir(nsRoot, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The replaced file is still counted until it is cleaned.
+	if err := checkFanOut(fileNode); err != nil {
+		return nil, nil, err
+	}
+	if err := checkQuota(fileNode, size); err != nil {
+		return nil, nil, err
+	}
+	var oldChunks []string
+	if existNode, ok := fileNode.ChildNodes[filename]; ok {
+		if !existNode.IsFile {
+			return nil, nil, fmt.Errorf("can not replace a directory with a file, path : %s, name: %s",
+				path, filename)
+		}
+		oldChunks = existNode.Chunks
+		tombstoneFileNode(existNode, false)
+	}
+	return createFileNode(fileNode, filename, size, true), oldChunks, nil
+}
+
+// GetOrCreateFileNode gets the FileNode with the given name under the given
+// path, or adds it to directory tree if it does not exist. The returned bool is
+// true only if the FileNode is created by this call. It is an error if the
+// existing FileNode is not the same type as the given one.
+func GetOrCreateFileNode(path string, filename string, size int64, isFile bool) (*FileNode, bool, error) {
+	return getOrCreateFileNode(root, path, filename, size, isFile)
+}
+
+// GetOrCreateFileNodeIn does the same thing as GetOrCreateFileNode in the given
+// namespace.
+func GetOrCreateFileNodeIn(namespace string, path string, filename string, size int64,
+	isFile bool) (*FileNode, bool, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, false, err
+	}
+	return getOrCreateFileNode(nsRoot, path, filename, size, isFile)
+}
+
+func getOrCreateFileNode(nsRoot *FileNode, path string, filename string, size int64,
+	isFile bool) (*FileNode, bool, error) {
+	if isFile {
+		if err := checkFileSize(size); err != nil {
+			return nil, false, err
+		}
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist || fileNode.IsFile {
+		return nil, false, fmt.Errorf("path not exist, path : %s", path)
+	}
+
+	if existNode, ok := fileNode.ChildNodes[filename]; ok {
+		if existNode.IsFile != isFile {
+			return nil, false, fmt.Errorf("target path already has a FileNode of different type, path : %s, isFile: %v",
+				path, existNode.IsFile)
+		}
+		return existNode, false, nil
+	}
+	if err := checkFanOut(fileNode); err != nil {
+		return nil, false, err
+	}
+	if err := checkQuota(fileNode, size); err != nil {
+		return nil, false, err
+	}
+	return createFileNode(fileNode, filename, size, isFile), true, nil
+}
+
+// checkFanOut checks whether one more child can be put into the directory. The
+// limit is the MaxChildren of the directory, or the configured
+// maxChildrenPerDir if it is not set. Deleted children which have not been
+// cleaned are also counted. The caller must hold createFileNodeLock.
+func checkFanOut(fileNode *FileNode) error {
+	maxChildren := getMaxChildren(fileNode)
+	if len(fileNode.ChildNodes) >= maxChildren {
+		return fmt.Errorf("directory has too many children, directory id: %s, max children: %d",
+			fileNode.Id, maxChildren)
+	}
+	return nil
+}
+
+// getMaxChildren gets the max number of children of the directory, which is
+// its MaxChildren or master.maxChildrenPerDir.
+func getMaxChildren(fileNode *FileNode) int {
+	maxChildren := fileNode.MaxChildren
+	if maxChildren == 0 {
+		maxChildren = viper.GetInt(MasterMaxChildrenPerDir)
+	}
+	if maxChildren <= 0 {
+		maxChildren = defaultMaxChildrenPerDir
+	}
+	return maxChildren
+}
+
+// checkQuota checks whether the given size can be added under the directory
+// without exceeding the Quota of it or any of its ancestors. A warning is
+// emitted for each of them whose SoftQuota is exceeded after adding the size.
+// The caller must hold createFileNodeLock.
+func checkQuota(fileNode *FileNode, size int64) error {
+	return checkQuotaUntil(fileNode, nil, size)
+}
+
+// checkQuotaUntil is checkQuota which only checks the directory and its
+// ancestors below stop. It is used when the size is moved inside the subtree
+// of stop, whose used size does not change.
+func checkQuotaUntil(fileNode *FileNode, stop *FileNode, size int64) error {
+	for cur := fileNode; cur != nil && cur != stop; cur = cur.ParentNode {
+		if cur.Quota != 0 && cur.subtreeSize+size > cur.Quota {
+			return fmt.Errorf("quota of directory is exceeded, directory id: %s, quota: %d, used: %d, size: %d",
+				cur.Id, cur.Quota, cur.subtreeSize, size)
+		}
+	}
+	for cur := fileNode; cur != nil && cur != stop; cur = cur.ParentNode {
+		if cur.SoftQuota != 0 && cur.subtreeSize+size > cur.SoftQuota {
+			Logger.Warnf("Soft quota of directory is exceeded, directory id: %s, soft quota: %d, used: %d",
+				cur.Id, cur.SoftQuota, cur.subtreeSize+size)
+			softQuotaExceededCountMonitor.Inc()
+		}
+	}
+	return nil
+}
+
+// createFileNode creates a FileNode and adds it to the given parent FileNode. The
+// caller must hold createFileNodeLock.
+func createFileNode(fileNode *FileNode, filename string, size int64, isFile bool) *FileNode {
+	id := util.GenerateUUIDString()
+	newNode := &FileNode{
+		Id:         id,
+		FileName:   internFileName(filename),
+		ParentNode: fileNode,
+		Size:       size,
+		IsFile:     isFile,
+		IsDel:      false,
+		DelTime:    nil,
+	}
+	indexFileNode(newNode)
+	if isFile {
+		newNode.Mode = defaultFileMode
+		if !isLazyChunkFile(size) {
+			newNode.Chunks = initChunks(size, id)
+		}
+		var replicaFactor int
+		replicaFactor, newNode.StoragePolicy = inheritPolicy(fileNode)
+		applyFileNodeReplicaFactor(newNode, replicaFactor)
+	} else {
+		newNode.Mode = defaultDirMode
+		newNode.ChildNodes = make(map[string]*FileNode)
+	}
+	// The interned name is also used as the key, otherwise the map would keep
+	// the backing string of the given name alive.
+	fileNode.ChildNodes[newNode.FileName] = newNode
+	newNode.subtreeSize = size
+	updateSubtreeSize(fileNode, size)
+	return newNode
+}
+
+func initChunks(size int64, id string) []string {
+	chunks := make([]string, getChunkNum(size))
+	for i := 0; i < len(chunks); i++ {
+		chunks[i] = util.CombineString(id, common.ChunkIdDelimiter, strconv.Itoa(i))
+	}
+	return chunks
+}
+
+// isLazyChunkFile checks whether Chunk of a file with the given size are
+// created one by one by AllocateNextChunk rather than all at creation, which
+// is the case if the file has more Chunk than the configured
+// lazyChunkThreshold.
+func isLazyChunkFile(size int64) bool {
+	threshold := viper.GetInt64(MasterLazyChunkThreshold)
+	return threshold > 0 && getChunkNum(size) > threshold
+}
+
+// AllocateNextChunk creates the next Chunk of a file whose Chunk are created
+// lazily and returns its id. The Size of the file is still the declared size,
+// while only Chunk which have been allocated are in Chunks, so the rest of the
+// file is read as a hole.
+func AllocateNextChunk(path string) (string, error) {
+	return allocateNextChunk(root, path)
+}
+
+// AllocateNextChunkIn creates the next Chunk of a file in the given namespace.
+func AllocateNextChunkIn(namespace string, path string) (string, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return "", err
+	}
+	return allocateNextChunk(nsRoot, path)
+}
+
+func allocateNextChunk(nsRoot *FileNode, path string) (string, error) {
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist || !fileNode.IsFile {
+		return "", fmt.Errorf("file not exist, path : %s", path)
+	}
+	index := int64(len(fileNode.Chunks))
+	if index >= getChunkNum(fileNode.Size) {
+		return "", fmt.Errorf("all chunks of file have been allocated, path : %s, chunk num: %d", path, index)
+	}
+	chunkId := util.CombineString(fileNode.Id, common.ChunkIdDelimiter, strconv.FormatInt(index, 10))
+	// Chunks of files with a MaxReplicasPerDomain are also read by the audit.
+	updateConstraintLock.Lock()
+	fileNode.Chunks = append(fileNode.Chunks, chunkId)
+	updateConstraintLock.Unlock()
+	return chunkId, nil
+}
+
+// checkChunkRange checks whether the file with the given id has the chunkNum
+// Chunk starting from chunkIndex. Chunk of a lazy file only exist after they
+// are allocated by AllocateNextChunk.
+func checkChunkRange(fileNodeId string, chunkIndex int, chunkNum int) error {
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, ok := getIndexedFileNode(fileNodeId)
+	if !ok || !fileNode.IsFile {
+		return fmt.Errorf("file not exist, file node id: %s", fileNodeId)
+	}
+	if chunkIndex < 0 || chunkNum < 0 || chunkIndex+chunkNum > len(fileNode.Chunks) {
+		return fmt.Errorf("chunk index out of range, file node id: %s, chunk index: %d, chunk num: %d, "+
+			"allocated chunk num: %d", fileNodeId, chunkIndex, chunkNum, len(fileNode.Chunks))
+	}
+	return nil
+}
+
+// getChunkNum gets the number of Chunk of a file with the given size. It uses
+// integer arithmetic so that a huge size will not overflow.
+func getChunkNum(size int64) int64 {
+	nums := size / common.ChunkSize
+	if size%common.ChunkSize != 0 {
+		nums++
+	}
+	return nums
+}
+
+// checkFileSize checks whether a file with the given size can be created. The
+// number of Chunk of the file can not exceed the configured maxChunksPerFile.
+func checkFileSize(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("file size can not be negative, size: %d", size)
+	}
+	maxChunks := viper.GetInt64(MasterMaxChunksPerFile)
+	if maxChunks <= 0 {
+		maxChunks = defaultMaxChunksPerFile
+	}
+	if nums := getChunkNum(size); nums > maxChunks {
+		return fmt.Errorf("file has too many chunks, size: %d, chunk num: %d, max chunk num: %d",
+			size, nums, maxChunks)
+	}
+	return nil
+}
+
+// MoveFileNode move a FileNode to target path. Moving a FileNode into its
+// current parent succeeds without change.
+func MoveFileNode(currentPath string, targetPath string) (*FileNode, error) {
+	return moveFileNode(root, currentPath, targetPath)
+}
+
+// MoveFileNodeIn move a FileNode to target path in the given namespace.
+func MoveFileNodeIn(namespace string, currentPath string, targetPath string) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return moveFileNode(nsRoot, currentPath, targetPath)
+}
+
+func moveFileNode(nsRoot *FileNode, currentPath string, targetPath string) (*FileNode, error) {
+	// Moving also puts a FileNode into a directory, so it must not interleave
+	// with creating a FileNode.
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, currentPath)
+	newParentNode, isParentExist := getFileNodeFrom(nsRoot, targetPath)
+	if !isExist {
+		return nil, fmt.Errorf("current path not exist, path : %s", currentPath)
+	}
+	if !isParentExist {
+		return nil, fmt.Errorf("target path not exist, path : %s", targetPath)
+	}
+	if newParentNode.IsFile {
+		return nil, fmt.Errorf("target is not a directory, path : %s", targetPath)
+	}
+	// Moving a FileNode into its current parent changes nothing, and the
+	// FileNode must not be taken as a collision with itself.
+	if newParentNode == fileNode.ParentNode {
+		return fileNode, nil
+	}
+	// A directory can not be moved into itself or its descendant, which would
+	// detach the subtree from the directory tree as a cycle.
+	for cur := newParentNode; cur != nil; cur = cur.ParentNode {
+		if cur == fileNode {
+			return nil, fmt.Errorf("can not move a directory into itself, current path : %s, target path : %s",
+				currentPath, targetPath)
+		}
+	}
+	if newParentNode.ChildNodes[fileNode.FileName] != nil {
+		return nil, fmt.Errorf("target path already has file with the same name, filename : %s", fileNode.FileName)
+	}
+	if err := checkFanOut(newParentNode); err != nil {
+		return nil, err
+	}
+	// The used size of the lowest ancestor shared by both parents and above
+	// does not change, so only the directories below it are checked.
+	oldParentNode := fileNode.ParentNode
+	shared := lowestCommonAncestor(oldParentNode, newParentNode)
+	if err := checkQuotaUntil(newParentNode, shared, fileNode.subtreeSize); err != nil {
+		return nil, err
+	}
+
+	newParentNode.ChildNodes[fileNode.FileName] = fileNode
+	delete(oldParentNode.ChildNodes, fileNode.FileName)
+	fileNode.ParentNode = newParentNode
+	for _, hook := range moveHooks {
+		hook(fileNode, oldParentNode, newParentNode)
+	}
+	return fileNode, nil
+}
+
+// SwapFileNodes exchanges the positions of the FileNode at pathA and pathB, so
+// that each path resolves to the FileNode which was at the other one. The
+// swapTime is recorded in RenameHistory of both of them.
+func SwapFileNodes(pathA string, pathB string, swapTime time.Time) error {
+	return swapFileNodes(root, pathA, pathB, swapTime)
+}
+
+// SwapFileNodesIn exchanges the positions of two FileNode in the given
+// namespace.
+func SwapFileNodesIn(namespace string, pathA string, pathB string, swapTime time.Time) error {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return err
+	}
+	return swapFileNodes(nsRoot, pathA, pathB, swapTime)
+}
+
+// swapFileNodes exchanges the positions of two FileNode. The whole directory
+// tree is protected by createFileNodeLock, so both of them are swapped in one
+// critical section without locking them in any order, and readers see either
+// both or none of them swapped. Swapping across directories is checked against
+// their fan-out and quota like a move.
+func swapFileNodes(nsRoot *FileNode, pathA string, pathB string, swapTime time.Time) error {
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	nodeA, isExist := getFileNodeFrom(nsRoot, pathA)
+	if !isExist {
+		return fmt.Errorf("path not exist, path : %s", pathA)
+	}
+	nodeB, isExist := getFileNodeFrom(nsRoot, pathB)
+	if !isExist {
+		return fmt.Errorf("path not exist, path : %s", pathB)
+	}
+	if nodeA == nodeB {
+		return nil
+	}
+	for _, fileNode := range []*FileNode{nodeA, nodeB} {
+		if fileNode == nsRoot || fileNode.ParentNode == nil {
+			return fmt.Errorf("can not swap the root, path : %s, path : %s", pathA, pathB)
+		}
+		if fileNode.IsDel {
+			return fmt.Errorf("can not swap a deleted file, file node id: %s", fileNode.Id)
+		}
+	}
+	// Swapping a directory with its descendant would put the directory into
+	// its own subtree.
+	if isAncestor(nodeA, nodeB) || isAncestor(nodeB, nodeA) {
+		return fmt.Errorf("can not swap a directory with its descendant, path : %s, path : %s", pathA, pathB)
+	}
+
+	parentA, nameA := nodeA.ParentNode, nodeA.FileName
+	parentB, nameB := nodeB.ParentNode, nodeB.FileName
+	if parentA != parentB {
+		if err := checkSwapLimits(nodeA, nodeB); err != nil {
+			return err
+		}
+	}
+	parentA.ChildNodes[nameA] = nodeB
+	parentB.ChildNodes[nameB] = nodeA
+	nodeA.ParentNode, nodeA.FileName = parentB, nameB
+	nodeB.ParentNode, nodeB.FileName = parentA, nameA
+	if nameA != nameB {
+		nodeA.addRenameRecord(nameA, swapTime)
+		nodeB.addRenameRecord(nameB, swapTime)
+	}
+	if parentA != parentB {
+		for _, hook := range moveHooks {
+			hook(nodeA, parentA, parentB)
+			hook(nodeB, parentB, parentA)
+		}
+	}
+	return nil
+}
+
+// checkSwapLimits checks whether two FileNode in different directories can be
+// swapped. Each directory gets one child for the one it loses, so neither of
+// them may be beyond its max number of children, and the directory getting the
+// larger subtree must have quota for the difference up to the lowest ancestor
+// shared by both directories, whose used size does not change. The caller must
+// hold createFileNodeLock.
+func checkSwapLimits(nodeA *FileNode, nodeB *FileNode) error {
+	parentA, parentB := nodeA.ParentNode, nodeB.ParentNode
+	for _, parent := range []*FileNode{parentA, parentB} {
+		if maxChildren := getMaxChildren(parent); len(parent.ChildNodes) > maxChildren {
+			return fmt.Errorf("directory has too many children, directory id: %s, max children: %d",
+				parent.Id, maxChildren)
+		}
+	}
+	shared := lowestCommonAncestor(parentA, parentB)
+	if diff := nodeA.subtreeSize - nodeB.subtreeSize; diff > 0 {
+		return checkQuotaUntil(parentB, shared, diff)
+	} else if diff < 0 {
+		return checkQuotaUntil(parentA, shared, -diff)
+	}
+	return nil
+}
+
+// lowestCommonAncestor gets the lowest FileNode which is the given FileNode or
+// an ancestor of it for both of them.
+func lowestCommonAncestor(a *FileNode, b *FileNode) *FileNode {
+	ancestors := make(map[*FileNode]bool)
+	for cur := a; cur != nil; cur = cur.ParentNode {
+		ancestors[cur] = true
+	}
+	for cur := b; cur != nil; cur = cur.ParentNode {
+		if ancestors[cur] {
+			return cur
+		}
+	}
+	return nil
+}
+
+// isAncestor checks whether ancestor is a proper ancestor of the FileNode.
+func isAncestor(ancestor *FileNode, fileNode *FileNode) bool {
+	for cur := fileNode.ParentNode; cur != nil; cur = cur.ParentNode {
+		if cur == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterMoveHook adds a MoveHook which will be invoked after every move.
+func RegisterMoveHook(hook MoveHook) {
+	moveHooks = append(moveHooks, hook)
+}
+
+// adjustSubtreeSize4Move moves the cached size of the moved subtree from the
+// old ancestor chain to the new one.
+func adjustSubtreeSize4Move(fileNode *FileNode, oldParent *FileNode, newParent *FileNode) {
+	updateSubtreeSize(oldParent, -fileNode.subtreeSize)
+	updateSubtreeSize(newParent, fileNode.subtreeSize)
+}
+
+// updateSubtreeSize adds delta to the cached size of the given FileNode and all
+// its ancestors. It stops at a FileNode which has been detached from its parent,
+// so that the size of a removed subtree will not be subtracted twice.
+func updateSubtreeSize(fileNode *FileNode, delta int64) {
+	for cur := fileNode; cur != nil; cur = cur.ParentNode {
+		cur.subtreeSize += delta
+		if cur.ParentNode != nil && cur.ParentNode.ChildNodes[cur.FileName] != cur {
+			return
+		}
+	}
+}
+
+// SubtreeSize returns the total size of all files in the subtree rooted at this
+// FileNode without walking the subtree.
+func (f *FileNode) SubtreeSize() int64 {
+	return f.subtreeSize
+}
+
+// RemoveFileNode remove a FileNode from file system. It should be noted that
+// this method is dummy delete, and does not actually remove the FileNode from
+// the directory tree. This method will prefix the node's name with "delete"
+// and update isDel and delTime of the FileNode. The delete state will be
+// canceled when the user renames the FileNode within a certain period of time.
+func RemoveFileNode(path string) (*FileNode, error) {
+	return removeFileNode(root, path, true)
+}
+
+// RemoveFileNodeIn remove a FileNode from the given namespace. It is dummy
+// delete as RemoveFileNode.
+func RemoveFileNodeIn(namespace string, path string) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return removeFileNode(nsRoot, path, true)
+}
+
+// EraseFileNode will completely delete a FileNode. It is only used internally.
+// It will set the delTime of a FileNode to one year ago, so the monitor goroutine
+// will completely delete the FileNode
+func EraseFileNode(path string) (*FileNode, error) {
+	return removeFileNode(root, path, false)
+}
+
+// EraseFileNodeIn will completely delete a FileNode in the given namespace.
+func EraseFileNodeIn(namespace string, path string) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return removeFileNode(nsRoot, path, false)
+}
+
+// Delete mode of removing a FileNode, see master.deleteMode.
+const (
+	// DeleteModeDeferred puts the FileNode to trash, and its Chunk are
+	// reclaimed when the trash is cleaned.
+	DeleteModeDeferred = "deferred"
+	// DeleteModeImmediate skips the trash and reclaims Chunk at once.
+	DeleteModeImmediate = "immediate"
+)
+
+// RemoveFileNodeImmediately removes a FileNode without putting it to trash. The
+// FileNode and its subtree are unlinked from the directory tree right away, and
+// all their Chunk are reclaimed at once instead of by the file tree check. It
+// can not be recovered. It returns id of the reclaimed Chunk.
+func RemoveFileNodeImmediately(path string) (*FileNode, []string, error) {
+	return removeFileNodeImmediately(root, path)
+}
+
+// RemoveFileNodeImmediatelyIn removes a FileNode from the given namespace
+// without putting it to trash.
+func RemoveFileNodeImmediatelyIn(namespace string, path string) (*FileNode, []string, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	return removeFileNodeImmediately(nsRoot, path)
+}
+
+func removeFileNodeImmediately(nsRoot *FileNode, path string) (*FileNode, []string, error) {
+	createFileNodeLock.Lock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist || fileNode.ParentNode == nil {
+		createFileNodeLock.Unlock()
+		return nil, nil, fmt.Errorf("path not exist, path : %s", path)
+	}
+	delete(fileNode.ParentNode.ChildNodes, fileNode.FileName)
+	updateSubtreeSize(fileNode.ParentNode, -fileNode.subtreeSize)
+	chunkIds := make([]string, 0)
+	nodes := []*FileNode{fileNode}
+	for len(nodes) != 0 {
+		cur := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+		unindexFileNode(cur.Id)
+		chunkIds = append(chunkIds, cur.Chunks...)
+		for _, child := range cur.ChildNodes {
+			nodes = append(nodes, child)
+		}
+	}
+	createFileNodeLock.Unlock()
+	ReclaimChunks(chunkIds)
+	return fileNode, chunkIds, nil
+}
+
+func removeFileNode(nsRoot *FileNode, path string, isDummy bool) (*FileNode, error) {
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist {
+		return nil, fmt.Errorf("path not exist, path : %s", path)
+	}
+	tombstoneFileNode(fileNode, isDummy)
+	return fileNode, nil
+}
+
+// tombstoneFileNode renames the FileNode with deleteFilePrefix and marks it as
+// deleted. It will be permanently deleted with its Chunk by the file tree check.
+// A FileNode which is not dummy deleted can not be recovered, so its DelTime is
+// set to a year ago to make it be cleaned in the next check. The caller must hold
+// createFileNodeLock.
+func tombstoneFileNode(fileNode *FileNode, isDummy bool) {
+	delete(fileNode.ParentNode.ChildNodes, fileNode.FileName)
+	fileNode.FileName = util.CombineString(deleteFilePrefix, fileNode.Id, deleteDelimiter, fileNode.FileName)
+	fileNode.ParentNode.ChildNodes[fileNode.FileName] = fileNode
+
+	fileNode.IsDel = true
+	delTime := time.Now()
+	if !isDummy {
+		delTime = delTime.AddDate(-1, 0, 0)
+	}
+	fileNode.DelTime = &(delTime)
+}
+
+// ListFileNode get a slice including all FileNode under the specified path.
+// The path must be a directory not a file. Deleted FileNode are only included
+// if includeDeleted is true.
+func ListFileNode(path string, includeDeleted bool) ([]*FileNode, error) {
+	return listFileNode(root, path, includeDeleted)
+}
+
+// ListFileNodeIn get a slice including all FileNode under the specified path
+// in the given namespace.
+func ListFileNodeIn(namespace string, path string, includeDeleted bool) ([]*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return listFileNode(nsRoot, path, includeDeleted)
+}
+
+func listFileNode(nsRoot *FileNode, path string, includeDeleted bool) ([]*FileNode, error) {
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist || fileNode.IsFile {
+		return nil, fmt.Errorf("path not exist, path : %s", path)
+	}
+
+	// Copies are returned so that callers will never be raced by modification
+	// of the directory tree after listing.
+	fileNodes := make([]*FileNode, 0, len(fileNode.ChildNodes))
+	for _, n := range fileNode.ChildNodes {
+		if n.IsDel && !includeDeleted {
+			continue
+		}
+		fileNodes = append(fileNodes, n.copyMeta())
+	}
+	return fileNodes, nil
+}
+
+// ListTrash get a slice including all deleted FileNode under the specified
+// path, so that they can be found and recovered by renaming or
+// RestoreDeletedFileNode. The FileName of each returned FileNode is its name
+// before deleted. The name of a deleted FileNode contains its id, so FileNode
+// deleted with the same name never collide, and they are sorted by name and
+// then DelTime.
+func ListTrash(path string) ([]*FileNode, error) {
+	return listTrash(root, path)
+}
+
+// ListTrashIn get a slice including all deleted FileNode under the specified
+// path in the given namespace.
+func ListTrashIn(namespace string, path string) ([]*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return listTrash(nsRoot, path)
+}
+
+func listTrash(nsRoot *FileNode, path string) ([]*FileNode, error) {
+	fileNodes, err := listFileNode(nsRoot, path, true)
+	if err != nil {
+		return nil, err
+	}
+	trash := make([]*FileNode, 0)
+	for _, n := range fileNodes {
+		if !n.IsDel {
+			continue
+		}
+		n.FileName = getNameBeforeDeleted(n)
+		trash = append(trash, n)
+	}
+	sort.Slice(trash, func(i, j int) bool {
+		if trash[i].FileName != trash[j].FileName {
+			return trash[i].FileName < trash[j].FileName
+		}
+		return trash[i].DelTime.Before(*trash[j].DelTime)
+	})
+	return trash, nil
+}
+
+// RestoreDeletedFileNode restores the deleted FileNode with the given id under
+// the directory with its name before deleted. Several deleted FileNode may have
+// the same name, so they are told apart by id, which can be found by ListTrash.
+// It fails if there is a FileNode with the name which is not deleted.
+func RestoreDeletedFileNode(path string, fileNodeId string) (*FileNode, error) {
+	return restoreDeletedFileNode(root, path, fileNodeId)
+}
+
+// RestoreDeletedFileNodeIn restores a deleted FileNode under the directory in
+// the given namespace.
+func RestoreDeletedFileNodeIn(namespace string, path string, fileNodeId string) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return restoreDeletedFileNode(nsRoot, path, fileNodeId)
+}
+
+func restoreDeletedFileNode(nsRoot *FileNode, path string, fileNodeId string) (*FileNode, error) {
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	dir, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist || dir.IsFile {
+		return nil, fmt.Errorf("path not exist, path : %s", path)
+	}
+	var target *FileNode
+	for _, n := range dir.ChildNodes {
+		if n.IsDel && n.Id == fileNodeId {
+			target = n
+			break
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("deleted file or directory not exist, path : %s, id: %s", path, fileNodeId)
+	}
+	name := getNameBeforeDeleted(target)
+	if _, ok := dir.ChildNodes[name]; ok {
+		return nil, fmt.Errorf("file or directory already exist, path : %s, name: %s", path, name)
+	}
+	delete(dir.ChildNodes, target.FileName)
+	target.FileName = internFileName(name)
+	target.IsDel = false
+	target.DelTime = nil
+	dir.ChildNodes[target.FileName] = target
+	return target, nil
+}
+
+// getNameBeforeDeleted gets the name of a deleted FileNode before it was
+// deleted.
+func getNameBeforeDeleted(fileNode *FileNode) string {
+	return strings.TrimPrefix(fileNode.FileName, util.CombineString(deleteFilePrefix, fileNode.Id, deleteDelimiter))
+}
+
+// WalkEntry is a FileNode visited by WalkFileTree.
+type WalkEntry struct {
+	Path string
+	// FileNode is a copy of the visited FileNode without ParentNode and
+	// ChildNodes.
+	FileNode *FileNode
+}
+
+// WalkResult is the result of WalkFileTree.
+type WalkResult struct {
+	// Entries include all FileNode visited, parent directories always come
+	// before their children.
+	Entries []WalkEntry
+	// Truncated means the walk stops before all FileNode are visited, and
+	// TruncatedReason tells why.
+	Truncated       bool
+	TruncatedReason string
+}
+
+// WalkFileTree recursively visits all FileNode under the specified directory
+// except deleted ones. The directory tree is locked for each directory rather
+// than for the whole walk, so a long walk never blocks writers for long and
+// it is not a consistent snapshot of the subtree. If the lock can not be
+// acquired before ctx is done, the FileNode visited so far are returned with
+// Truncated set.
+func WalkFileTree(ctx context.Context, path string) (*WalkResult, error) {
+	return walkFileTree(ctx, root, path, nil)
+}
+
+// WalkFileTreeIn recursively visits all FileNode under the specified directory
+// in the given namespace.
+func WalkFileTreeIn(ctx context.Context, namespace string, path string) (*WalkResult, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return walkFileTree(ctx, nsRoot, path, nil)
+}
+
+// walkFileTree visits the directory tree of nsRoot in breadth first order.
+// visit is called without lock after the children of each directory are
+// visited, it can be nil.
+func walkFileTree(ctx context.Context, nsRoot *FileNode, path string,
+	visit func(entries []WalkEntry)) (*WalkResult, error) {
+	result := &WalkResult{Entries: make([]WalkEntry, 0)}
+	if !createFileNodeLock.LockContext(ctx) {
+		result.Truncated = true
+		result.TruncatedReason = walkDeadlineExceeded
+		return result, nil
+	}
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	createFileNodeLock.Unlock()
+	if !isExist || fileNode.IsFile {
+		return nil, fmt.Errorf("path not exist, path : %s", path)
+	}
+
+	dirs := []*FileNode{fileNode}
+	dirPaths := []string{strings.TrimRight(path, pathSplitString)}
+	for len(dirs) != 0 {
+		dir, dirPath := dirs[0], dirPaths[0]
+		dirs, dirPaths = dirs[1:], dirPaths[1:]
+		if !createFileNodeLock.LockContext(ctx) {
+			Logger.Warnf("Walk of directory tree is truncated, path: %s, visited: %d", path, len(result.Entries))
+			result.Truncated = true
+			result.TruncatedReason = walkDeadlineExceeded
+			return result, nil
+		}
+		names := make([]string, 0, len(dir.ChildNodes))
+		for name, child := range dir.ChildNodes {
+			if !child.IsDel {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		entries := make([]WalkEntry, 0, len(names))
+		for _, name := range names {
+			child := dir.ChildNodes[name]
+			childPath := util.CombineString(dirPath, pathSplitString, name)
+			entries = append(entries, WalkEntry{Path: childPath, FileNode: child.copyMeta()})
+			if !child.IsFile {
+				dirs = append(dirs, child)
+				dirPaths = append(dirPaths, childPath)
+			}
+		}
+		createFileNodeLock.Unlock()
+		result.Entries = append(result.Entries, entries...)
+		if visit != nil {
+			visit(entries)
+		}
+	}
+	return result, nil
+}
+
+// contextMutex is a mutex which can also be acquired until a context is done.
+// It is a semaphore with one slot, so a waiter gets the lock as soon as it is
+// released rather than polling for it.
+type contextMutex struct {
+	sem chan struct{}
+}
+
+func newContextMutex() *contextMutex {
+	return &contextMutex{sem: make(chan struct{}, 1)}
+}
+
+func (m *contextMutex) Lock() {
+	m.sem <- struct{}{}
+}
+
+func (m *contextMutex) Unlock() {
+	select {
+	case <-m.sem:
+	default:
+		panic("unlock of unlocked contextMutex")
+	}
+}
+
+// TryLock acquires the lock if it is not held, and returns whether it is
+// acquired.
+func (m *contextMutex) TryLock() bool {
+	select {
+	case m.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// LockContext acquires the lock unless ctx is done first. It returns true if
+// the lock is acquired.
+func (m *contextMutex) LockContext(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case m.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// copyMeta copies all metadata of the FileNode except its ParentNode and
+// ChildNodes.
+func (f *FileNode) copyMeta() *FileNode {
+	newNode := &FileNode{
+		Id:                   f.Id,
+		FileName:             f.FileName,
+		Size:                 f.Size,
+		IsFile:               f.IsFile,
+		IsDel:                f.IsDel,
+		Constraint:           f.Constraint,
+		ReplicaFactor:        f.ReplicaFactor,
+		StoragePolicy:        f.StoragePolicy,
+		MinReadReplicas:      f.MinReadReplicas,
+		Quota:                f.Quota,
+		SoftQuota:            f.SoftQuota,
+		MaxChildren:          f.MaxChildren,
+		Owner:                f.Owner,
+		Group:                f.Group,
+		Mode:                 f.Mode,
+		MaxReplicasPerDomain: f.MaxReplicasPerDomain,
+		subtreeSize:          f.subtreeSize,
+	}
+	if f.RenameHistory != nil {
+		newNode.RenameHistory = make([]RenameRecord, len(f.RenameHistory))
+		copy(newNode.RenameHistory, f.RenameHistory)
+	}
+	if f.Chunks != nil {
+		newNode.Chunks = make([]string, len(f.Chunks))
+		copy(newNode.Chunks, f.Chunks)
+	}
+	if f.DelTime != nil {
+		delTime := *f.DelTime
+		newNode.DelTime = &delTime
+	}
+	return newNode
+}
+
+// RenameFileNode rename a FileNode to given name. renameTime is recorded in
+// RenameHistory of the FileNode.
+func RenameFileNode(path string, newName string, renameTime time.Time) (*FileNode, error) {
+	return renameFileNode(root, path, newName, renameTime)
+}
+
+// RenameFileNodeIn rename a FileNode in the given namespace to given name.
+func RenameFileNodeIn(namespace string, path string, newName string, renameTime time.Time) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return renameFileNode(nsRoot, path, newName, renameTime)
+}
+
+func renameFileNode(nsRoot *FileNode, path string, newName string, renameTime time.Time) (*FileNode, error) {
+	// Readers outside the FSM iterate ChildNodes under createFileNodeLock.
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist {
+		return nil, fmt.Errorf("path not exist, path : %s", path)
+	}
+
+	// The name of a deleted FileNode is only used to keep it in the trash, so
+	// its name before deleted is recorded.
+	oldName := fileNode.FileName
+	if fileNode.IsDel {
+		oldName = getNameBeforeDeleted(fileNode)
+	}
+	delete(fileNode.ParentNode.ChildNodes, fileNode.FileName)
+	fileNode.FileName = internFileName(newName)
+	fileNode.ParentNode.ChildNodes[fileNode.FileName] = fileNode
+	if fileNode.IsDel {
+		fileNode.IsDel = false
+		fileNode.DelTime = nil
+	}
+	if oldName != newName {
+		fileNode.addRenameRecord(oldName, renameTime)
+	}
+	return fileNode, nil
+}
+
+// RenameRecord is a previous name of a FileNode and when it was renamed from
+// the name.
+type RenameRecord struct {
+	Name string
+	Time time.Time
+}
+
+// addRenameRecord appends a previous name to RenameHistory of the FileNode,
+// and evicts the oldest ones if there are more than the configured
+// renameHistoryLength.
+func (f *FileNode) addRenameRecord(name string, renameTime time.Time) {
+	maxLength := viper.GetInt(MasterRenameHistoryLength)
+	if maxLength <= 0 {
+		maxLength = defaultRenameHistoryLength
+	}
+	f.RenameHistory = append(f.RenameHistory, RenameRecord{Name: name, Time: renameTime})
+	if len(f.RenameHistory) > maxLength {
+		f.RenameHistory = append([]RenameRecord(nil), f.RenameHistory[len(f.RenameHistory)-maxLength:]...)
+	}
+}
+
+// GetRenameHistory gets the previous names of a FileNode from the oldest to
+// the latest.
+func GetRenameHistory(path string) ([]RenameRecord, error) {
+	return getRenameHistory(root, path)
+}
+
+// GetRenameHistoryIn gets the previous names of a FileNode in the given
+// namespace.
+func GetRenameHistoryIn(namespace string, path string) ([]RenameRecord, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return getRenameHistory(nsRoot, path)
+}
+
+func getRenameHistory(nsRoot *FileNode, path string) ([]RenameRecord, error) {
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist {
+		return nil, fmt.Errorf("path not exist, path : %s", path)
+	}
+	history := make([]RenameRecord, len(fileNode.RenameHistory))
+	copy(history, fileNode.RenameHistory)
+	return history, nil
+}
+
+// renameHistoryString encodes RenameHistory as "time:name" of each record in
+// unix nanoseconds, separated by pathSplitString which can not be in a name.
+func renameHistoryString(history []RenameRecord) string {
+	records := make([]string, len(history))
+	for i, record := range history {
+		records[i] = util.CombineString(strconv.FormatInt(record.Time.UnixNano(), 10), ":", record.Name)
+	}
+	return strings.Join(records, pathSplitString)
+}
+
+// parseRenameHistory decodes RenameHistory encoded by renameHistoryString.
+func parseRenameHistory(s string) ([]RenameRecord, error) {
+	if s == "" {
+		return nil, nil
+	}
+	records := strings.Split(s, pathSplitString)
+	history := make([]RenameRecord, len(records))
+	for i, record := range records {
+		timeAndName := strings.SplitN(record, ":", 2)
+		if len(timeAndName) != 2 {
+			return nil, fmt.Errorf("illegal rename record: %q", record)
+		}
+		nanos, err := strconv.ParseInt(timeAndName[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		history[i] = RenameRecord{Name: timeAndName[1], Time: time.Unix(0, nanos)}
+	}
+	return history, nil
+}
+
+// SetFileNodeConstraint sets the PlacementConstraint of a file. An empty
+// expression removes the constraint.
+func SetFileNodeConstraint(path string, expr string) (*FileNode, error) {
+	return setFileNodeConstraint(root, path, expr)
+}
+
+// SetFileNodeConstraintIn sets the PlacementConstraint of a file in the given
+// namespace.
+func SetFileNodeConstraintIn(namespace string, path string, expr string) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return setFileNodeConstraint(nsRoot, path, expr)
+}
+
+func setFileNodeConstraint(nsRoot *FileNode, path string, expr string) (*FileNode, error) {
+	constraint, err := ParsePlacementConstraint(expr)
+	if err != nil {
+		return nil, err
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist || !fileNode.IsFile {
+		return nil, fmt.Errorf("file not exist, path : %s", path)
+	}
+	applyFileNodeConstraint(fileNode, constraint)
+	return fileNode, nil
+}
+
+// applyFileNodeConstraint sets the PlacementConstraint of the FileNode and
+// updates constrainedFileNodes.
+func applyFileNodeConstraint(fileNode *FileNode, constraint PlacementConstraint) {
+	updateConstraintLock.Lock()
+	defer updateConstraintLock.Unlock()
+	fileNode.Constraint = constraint
+	if constraint.IsEmpty() {
+		delete(constrainedFileNodes, fileNode.Id)
+	} else {
+		constrainedFileNodes[fileNode.Id] = fileNode
+	}
+}
+
+// getPlacementConstraint gets the PlacementConstraint of the file which the
+// given Chunk belongs to.
+func getPlacementConstraint(chunkId string) PlacementConstraint {
+	fileNodeId := chunkId
+	if i := strings.LastIndex(chunkId, common.ChunkIdDelimiter); i != -1 {
+		fileNodeId = chunkId[:i]
+	}
+	return getFileNodeConstraint(fileNodeId)
+}
+
+// ChunkReference is a file which a Chunk belongs to.
+type ChunkReference struct {
+	// Namespace is empty if the file is in the default namespace.
+	Namespace  string
+	Path       string
+	FileNodeId string
+	// Index is the index of the Chunk in the file.
+	Index int
+}
+
+// WhoReferences finds all files referencing the given Chunk with their full
+// paths, so that the blast radius of a corrupt Chunk can be assessed. The file
+// is found in fileNodeIndex by the id in the Chunk id, and its path is rebuilt
+// by walking up ParentNode to the root. createFileNodeLock is held for the
+// whole lookup, which is also held by moving, renaming and removing a
+// FileNode, so the parent chain can not be changed during the lookup.
+func WhoReferences(chunkId string) ([]ChunkReference, error) {
+	fileNodeId, _ := getChunkFileNodeId(chunkId)
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	references := make([]ChunkReference, 0)
+	if fileNode, ok := getIndexedFileNode(fileNodeId); ok {
+		for index, id := range fileNode.Chunks {
+			if id != chunkId {
+				continue
+			}
+			namespace, path := getFullPath(fileNode)
+			references = append(references, ChunkReference{
+				Namespace:  namespace,
+				Path:       path,
+				FileNodeId: fileNode.Id,
+				Index:      index,
+			})
+		}
+	}
+	if len(references) == 0 {
+		return nil, fmt.Errorf("no file references the chunk, chunk id: %s", chunkId)
+	}
+	return references, nil
+}
+
+// getFullPath rebuilds the path of the FileNode by walking up ParentNode, and
+// returns it with the namespace of the FileNode. The caller must hold
+// createFileNodeLock.
+func getFullPath(fileNode *FileNode) (string, string) {
+	names := make([]string, 0)
+	cur := fileNode
+	for ; cur.ParentNode != nil; cur = cur.ParentNode {
+		names = append(names, cur.FileName)
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return cur.FileName, pathSplitString + strings.Join(names, pathSplitString)
+}
+
+// getFileNodeConstraint gets the PlacementConstraint of the file with the given
+// id.
+func getFileNodeConstraint(fileNodeId string) PlacementConstraint {
+	updateConstraintLock.RLock()
+	defer updateConstraintLock.RUnlock()
+	if fileNode, ok := constrainedFileNodes[fileNodeId]; ok {
+		return fileNode.Constraint
+	}
+	return PlacementConstraint{}
+}
+
+// SetFileNodeReplicaFactor sets the ReplicaFactor of a file. Existing Chunk of
+// the file are reconciled with the new ReplicaFactor: Chunk missing replicas
+// are put to pendingChunkQueue and excess replicas are deleted. now is the time
+// of the leader when the change is requested.
+func SetFileNodeReplicaFactor(path string, replicaFactor int, now time.Time) (*FileNode, error) {
+	return setFileNodeReplicaFactor(root, path, replicaFactor, now)
+}
+
+// SetFileNodeReplicaFactorIn sets the ReplicaFactor of a file in the given
+// namespace.
+func SetFileNodeReplicaFactorIn(namespace string, path string, replicaFactor int,
+	now time.Time) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return setFileNodeReplicaFactor(nsRoot, path, replicaFactor, now)
+}
+
+func setFileNodeReplicaFactor(nsRoot *FileNode, path string, replicaFactor int, now time.Time) (*FileNode, error) {
+	if replicaFactor <= 0 {
+		return nil, fmt.Errorf("replica factor must be positive, replica factor: %d", replicaFactor)
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist || !fileNode.IsFile {
+		return nil, fmt.Errorf("file not exist, path : %s", path)
+	}
+	applyFileNodeReplicaFactor(fileNode, replicaFactor)
+	queued, removed := ReconcileReplicaFactor(fileNode.Chunks, replicaFactor, now)
+	Logger.Infof("Set replica factor of file, path: %s, replica factor: %d, queued replicas: %d, "+
+		"removed replicas: %d", path, replicaFactor, queued, removed)
+	return fileNode, nil
+}
+
+// applyFileNodeReplicaFactor sets the ReplicaFactor of the FileNode and updates
+// replicaFactorFileNodes.
+func applyFileNodeReplicaFactor(fileNode *FileNode, replicaFactor int) {
+	updateConstraintLock.Lock()
+	defer updateConstraintLock.Unlock()
+	fileNode.ReplicaFactor = replicaFactor
+	if replicaFactor == 0 {
+		delete(replicaFactorFileNodes, fileNode.Id)
+	} else {
+		replicaFactorFileNodes[fileNode.Id] = fileNode
+	}
+}
+
+// getChunkReplicaFactor gets the number of replicas the given Chunk needs,
+// which is the ReplicaFactor of its file or the default replica number.
+func getChunkReplicaFactor(chunkId string) int {
+	fileNodeId := chunkId
+	if i := strings.LastIndex(chunkId, common.ChunkIdDelimiter); i != -1 {
+		fileNodeId = chunkId[:i]
+	}
+	updateConstraintLock.RLock()
+	defer updateConstraintLock.RUnlock()
+	if fileNode, ok := replicaFactorFileNodes[fileNodeId]; ok {
+		return fileNode.ReplicaFactor
+	}
+	return viper.GetInt(common.ReplicaNum)
+}
+
+// SetFileNodeMaxReplicasPerDomain sets the MaxReplicasPerDomain of a file. 0
+// removes the policy. Existing Chunk of the file which violate the new policy
+// are not moved immediately but by the spread auditor.
+func SetFileNodeMaxReplicasPerDomain(path string, maxReplicasPerDomain int) (*FileNode, error) {
+	return setFileNodeMaxReplicasPerDomain(root, path, maxReplicasPerDomain)
+}
+
+// SetFileNodeMaxReplicasPerDomainIn sets the MaxReplicasPerDomain of a file in
+// the given namespace.
+func SetFileNodeMaxReplicasPerDomainIn(namespace string, path string, maxReplicasPerDomain int) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return setFileNodeMaxReplicasPerDomain(nsRoot, path, maxReplicasPerDomain)
+}
+
+func setFileNodeMaxReplicasPerDomain(nsRoot *FileNode, path string, maxReplicasPerDomain int) (*FileNode, error) {
+	if maxReplicasPerDomain < 0 {
+		return nil, fmt.Errorf("max replicas per domain can not be negative, max replicas per domain: %d",
+			maxReplicasPerDomain)
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist || !fileNode.IsFile {
+		return nil, fmt.Errorf("file not exist, path : %s", path)
+	}
+	applyFileNodeMaxReplicasPerDomain(fileNode, maxReplicasPerDomain)
+	Logger.Infof("Set max replicas per domain of file, path: %s, max replicas per domain: %d", path,
+		maxReplicasPerDomain)
+	return fileNode, nil
+}
+
+// applyFileNodeMaxReplicasPerDomain sets the MaxReplicasPerDomain of the
+// FileNode and updates spreadFileNodes.
+func applyFileNodeMaxReplicasPerDomain(fileNode *FileNode, maxReplicasPerDomain int) {
+	updateConstraintLock.Lock()
+	defer updateConstraintLock.Unlock()
+	fileNode.MaxReplicasPerDomain = maxReplicasPerDomain
+	if maxReplicasPerDomain == 0 {
+		delete(spreadFileNodes, fileNode.Id)
+	} else {
+		spreadFileNodes[fileNode.Id] = fileNode
+	}
 }
 
-// CheckAndGetFileNode gets a FileNode by given path if the given path is legal.
-func CheckAndGetFileNode(path string) (*FileNode, error) {
-	fileNode, isExist := getFileNode(path)
-	if !isExist {
-		return nil, fmt.Errorf("path not exist, path : %s", path)
+// getFileNodeMaxReplicasPerDomain gets the MaxReplicasPerDomain of the file
+// with the given id. 0 means there is no constraint.
+func getFileNodeMaxReplicasPerDomain(fileNodeId string) int {
+	updateConstraintLock.RLock()
+	defer updateConstraintLock.RUnlock()
+	if fileNode, ok := spreadFileNodes[fileNodeId]; ok {
+		return fileNode.MaxReplicasPerDomain
 	}
-	return fileNode, nil
+	return 0
 }
 
-// getAndLockByPath gets target FileNode.
-func getFileNode(path string) (*FileNode, bool) {
-	currentNode := root
-	path = strings.Trim(path, pathSplitString)
-	fileNames := strings.Split(path, pathSplitString)
-	if path == root.FileName {
-		return currentNode, true
+// getChunkMaxReplicasPerDomain gets the MaxReplicasPerDomain of the file which
+// the given Chunk belongs to.
+func getChunkMaxReplicasPerDomain(chunkId string) int {
+	fileNodeId := chunkId
+	if i := strings.LastIndex(chunkId, common.ChunkIdDelimiter); i != -1 {
+		fileNodeId = chunkId[:i]
 	}
+	return getFileNodeMaxReplicasPerDomain(fileNodeId)
+}
 
-	for _, name := range fileNames {
-		nextNode, exist := currentNode.ChildNodes[name]
-		if !exist {
-			return nil, false
-		}
-		if nextNode.IsDel {
-			return nil, false
-		}
-		currentNode = nextNode
+// SetDirPolicy sets the default ReplicaFactor and StoragePolicy of files which
+// will be created under the directory. 0 and empty remove the default. Files
+// which already exist are not changed.
+func SetDirPolicy(path string, replicaFactor int, storagePolicy string) (*FileNode, error) {
+	return setDirPolicy(root, path, replicaFactor, storagePolicy)
+}
+
+// SetDirPolicyIn sets the default ReplicaFactor and StoragePolicy of a
+// directory in the given namespace.
+func SetDirPolicyIn(namespace string, path string, replicaFactor int, storagePolicy string) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
 	}
-	return currentNode, true
+	return setDirPolicy(nsRoot, path, replicaFactor, storagePolicy)
 }
 
-// AddFileNode add a FileNode to directory tree. It is generally used to add a
-// directory because it will unlock all FileNode after adding the FileNode to
-// directory tree.
-func AddFileNode(path string, filename string, size int64, isFile bool) (*FileNode, error) {
-	fileNode, isExist := getFileNode(path)
+func setDirPolicy(nsRoot *FileNode, path string, replicaFactor int, storagePolicy string) (*FileNode, error) {
+	if err := checkPolicy(replicaFactor, storagePolicy); err != nil {
+		return nil, err
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
 	if !isExist || fileNode.IsFile {
-		return nil, fmt.Errorf("path not exist, path : %s", path)
+		return nil, fmt.Errorf("directory not exist, path : %s", path)
 	}
+	fileNode.ReplicaFactor = replicaFactor
+	fileNode.StoragePolicy = storagePolicy
+	return fileNode, nil
+}
 
-	if _, ok := fileNode.ChildNodes[filename]; ok {
-		return nil, fmt.Errorf("target path already has file with the same name, path : %s", path)
+// SetFileNodeMinReadReplicas sets the MinReadReplicas of a file. 0 removes the
+// floor.
+func SetFileNodeMinReadReplicas(path string, minReadReplicas int) (*FileNode, error) {
+	return setFileNodeMinReadReplicas(root, path, minReadReplicas)
+}
+
+// SetFileNodeMinReadReplicasIn sets the MinReadReplicas of a file in the given
+// namespace.
+func SetFileNodeMinReadReplicasIn(namespace string, path string, minReadReplicas int) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
 	}
+	return setFileNodeMinReadReplicas(nsRoot, path, minReadReplicas)
+}
 
-	id := util.GenerateUUIDString()
-	newNode := &FileNode{
-		Id:         id,
-		FileName:   filename,
-		ParentNode: fileNode,
-		Size:       size,
-		IsFile:     isFile,
-		IsDel:      false,
-		DelTime:    nil,
+func setFileNodeMinReadReplicas(nsRoot *FileNode, path string, minReadReplicas int) (*FileNode, error) {
+	if minReadReplicas < 0 {
+		return nil, fmt.Errorf("min read replicas can not be negative, min read replicas: %d", minReadReplicas)
 	}
-	fileNodeIdSet.Add(newNode.Id)
-	if isFile {
-		newNode.Chunks = initChunks(size, id)
-	} else {
-		newNode.ChildNodes = make(map[string]*FileNode)
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist || !fileNode.IsFile {
+		return nil, fmt.Errorf("file not exist, path : %s", path)
 	}
-	fileNode.ChildNodes[filename] = newNode
-	return newNode, nil
+	fileNode.MinReadReplicas = minReadReplicas
+	return fileNode, nil
 }
 
-func initChunks(size int64, id string) []string {
-	nums := int(math.Ceil(float64(size) / float64(common.ChunkSize)))
-	chunks := make([]string, nums)
-	for i := 0; i < len(chunks); i++ {
-		chunks[i] = util.CombineString(id, strconv.Itoa(i))
+// SetDirQuota sets the Quota and SoftQuota of the directory. 0 removes the
+// limit. Files which already exist are not affected even if they exceed it.
+func SetDirQuota(path string, quota int64, softQuota int64) (*FileNode, error) {
+	return setDirQuota(root, path, quota, softQuota)
+}
+
+// SetDirQuotaIn sets the Quota and SoftQuota of a directory in the given
+// namespace.
+func SetDirQuotaIn(namespace string, path string, quota int64, softQuota int64) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
 	}
-	return chunks
+	return setDirQuota(nsRoot, path, quota, softQuota)
 }
 
-// MoveFileNode move a FileNode to target path.
-func MoveFileNode(currentPath string, targetPath string) (*FileNode, error) {
-	fileNode, isExist := getFileNode(currentPath)
-	newParentNode, isParentExist := getFileNode(targetPath)
-	if !isExist {
-		return nil, fmt.Errorf("current path not exist, path : %s", currentPath)
+func setDirQuota(nsRoot *FileNode, path string, quota int64, softQuota int64) (*FileNode, error) {
+	if quota < 0 || softQuota < 0 {
+		return nil, fmt.Errorf("quota can not be negative, quota: %d, soft quota: %d", quota, softQuota)
 	}
-	if !isParentExist {
-		return nil, fmt.Errorf("target path not exist, path : %s", targetPath)
+	if quota != 0 && softQuota > quota {
+		return nil, fmt.Errorf("soft quota can not exceed quota, quota: %d, soft quota: %d", quota, softQuota)
 	}
-	if newParentNode.ChildNodes[fileNode.FileName] != nil {
-		return nil, fmt.Errorf("target path already has file with the same name, filename : %s", fileNode.FileName)
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist || fileNode.IsFile {
+		return nil, fmt.Errorf("directory not exist, path : %s", path)
 	}
-
-	newParentNode.ChildNodes[fileNode.FileName] = fileNode
-	delete(fileNode.ParentNode.ChildNodes, fileNode.FileName)
-	fileNode.ParentNode = newParentNode
+	fileNode.Quota = quota
+	fileNode.SoftQuota = softQuota
 	return fileNode, nil
 }
 
-// RemoveFileNode remove a FileNode from file system. It should be noted that
-// this method is dummy delete, and does not actually remove the FileNode from
-// the directory tree. This method will prefix the node's name with "delete"
-// and update isDel and delTime of the FileNode. The delete state will be
-// canceled when the user renames the FileNode within a certain period of time.
-func RemoveFileNode(path string) (*FileNode, error) {
-	return removeFileNode(path, true)
+// SetDirMaxChildren sets the MaxChildren of the directory. 0 removes the
+// override. Children which already exist are not removed even if they exceed
+// it.
+func SetDirMaxChildren(path string, maxChildren int) (*FileNode, error) {
+	return setDirMaxChildren(root, path, maxChildren)
 }
 
-// EraseFileNode will completely delete a FileNode. It is only used internally.
-// It will set the delTime of a FileNode to one year ago, so the monitor goroutine
-// will completely delete the FileNode
-func EraseFileNode(path string) (*FileNode, error) {
-	return removeFileNode(path, false)
+// SetDirMaxChildrenIn sets the MaxChildren of a directory in the given
+// namespace.
+func SetDirMaxChildrenIn(namespace string, path string, maxChildren int) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return setDirMaxChildren(nsRoot, path, maxChildren)
 }
 
-func removeFileNode(path string, isDummy bool) (*FileNode, error) {
-	fileNode, isExist := getFileNode(path)
-	if !isExist {
-		return nil, fmt.Errorf("path not exist, path : %s", path)
+func setDirMaxChildren(nsRoot *FileNode, path string, maxChildren int) (*FileNode, error) {
+	if maxChildren < 0 {
+		return nil, fmt.Errorf("max children can not be negative, max children: %d", maxChildren)
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist || fileNode.IsFile {
+		return nil, fmt.Errorf("directory not exist, path : %s", path)
 	}
+	fileNode.MaxChildren = maxChildren
+	return fileNode, nil
+}
 
-	delete(fileNode.ParentNode.ChildNodes, fileNode.FileName)
-	fileNode.FileName = util.CombineString(deleteFilePrefix, fileNode.Id, deleteDelimiter, fileNode.FileName)
-	fileNode.ParentNode.ChildNodes[fileNode.FileName] = fileNode
+// ChmodFileNode sets the Mode of a FileNode.
+func ChmodFileNode(path string, mode uint32) (*FileNode, error) {
+	return chmodFileNode(root, path, mode)
+}
 
-	fileNode.IsDel = true
-	delTime := time.Now()
-	if !isDummy {
-		delTime = delTime.AddDate(-1, 0, 0)
+// ChmodFileNodeIn sets the Mode of a FileNode in the given namespace.
+func ChmodFileNodeIn(namespace string, path string, mode uint32) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
 	}
-	fileNode.DelTime = &(delTime)
-	return fileNode, nil
+	return chmodFileNode(nsRoot, path, mode)
 }
 
-// ListFileNode get a slice including all FileNode under the specified path.
-// The path must be a directory not a file.
-func ListFileNode(path string) ([]*FileNode, error) {
-	fileNode, isExist := getFileNode(path)
-	if !isExist || fileNode.IsFile {
+func chmodFileNode(nsRoot *FileNode, path string, mode uint32) (*FileNode, error) {
+	if err := checkMode(mode); err != nil {
+		return nil, err
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist {
 		return nil, fmt.Errorf("path not exist, path : %s", path)
 	}
+	fileNode.Mode = mode
+	return fileNode, nil
+}
 
-	fileNodes := make([]*FileNode, len(fileNode.ChildNodes))
-	nodeIndex := 0
-	for _, n := range fileNode.ChildNodes {
-		fileNodes[nodeIndex] = n
-		nodeIndex++
+// ChownFileNode sets the Owner and Group of a FileNode. An empty owner or group
+// keeps the current one.
+func ChownFileNode(path string, owner string, group string) (*FileNode, error) {
+	return chownFileNode(root, path, owner, group)
+}
+
+// ChownFileNodeIn sets the Owner and Group of a FileNode in the given namespace.
+func ChownFileNodeIn(namespace string, path string, owner string, group string) (*FileNode, error) {
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
 	}
-	return fileNodes, nil
+	return chownFileNode(nsRoot, path, owner, group)
 }
 
-// RenameFileNode rename a FileNode to given name.
-func RenameFileNode(path string, newName string) (*FileNode, error) {
-	fileNode, isExist := getFileNode(path)
+func chownFileNode(nsRoot *FileNode, path string, owner string, group string) (*FileNode, error) {
+	if err := checkOwner(owner, group); err != nil {
+		return nil, err
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
 	if !isExist {
 		return nil, fmt.Errorf("path not exist, path : %s", path)
 	}
-
-	delete(fileNode.ParentNode.ChildNodes, fileNode.FileName)
-	fileNode.FileName = newName
-	fileNode.ParentNode.ChildNodes[fileNode.FileName] = fileNode
-	if fileNode.IsDel {
-		fileNode.IsDel = false
-		fileNode.DelTime = nil
+	if owner != "" {
+		fileNode.Owner = owner
+	}
+	if group != "" {
+		fileNode.Group = group
 	}
 	return fileNode, nil
 }
 
+// checkPolicy checks whether the ReplicaFactor and StoragePolicy are legal.
+// StoragePolicy can not contain any delimiter used in snapshot.
+func checkPolicy(replicaFactor int, storagePolicy string) error {
+	if replicaFactor < 0 {
+		return fmt.Errorf("replica factor can not be negative, replica factor: %d", replicaFactor)
+	}
+	if strings.ContainsAny(storagePolicy, common.DollarDelimiter+" \n") {
+		return fmt.Errorf("illegal storage policy, storage policy: %q", storagePolicy)
+	}
+	return nil
+}
+
+// inheritPolicy gets the ReplicaFactor and StoragePolicy of a new file created
+// under the given directory. Each of them is taken from the nearest ancestor
+// which sets it.
+func inheritPolicy(dir *FileNode) (int, string) {
+	replicaFactor, storagePolicy := 0, ""
+	for node := dir; node != nil; node = node.ParentNode {
+		if replicaFactor == 0 {
+			replicaFactor = node.ReplicaFactor
+		}
+		if storagePolicy == "" {
+			storagePolicy = node.StoragePolicy
+		}
+		if replicaFactor != 0 && storagePolicy != "" {
+			break
+		}
+	}
+	return replicaFactor, storagePolicy
+}
+
 func StatFileNode(path string) (*FileNode, error) {
 	return CheckAndGetFileNode(path)
 }
 
+func StatFileNodeIn(namespace string, path string) (*FileNode, error) {
+	return CheckAndGetFileNodeIn(namespace, path)
+}
+
+// StatResult is the result of stating one path of a batch. Exactly one of
+// FileNode and Err is set.
+type StatResult struct {
+	Path     string
+	FileNode *FileNode
+	Err      error
+}
+
+// BatchStatFileNodesIn stats many paths in the given namespace at once and
+// returns a StatResult for each path in order, a path which does not exist only
+// fails its own result. All paths are resolved holding createFileNodeLock once,
+// which is the only lock of directory trees, so paths sharing ancestors can not
+// deadlock and all results are from the same version of the tree. FileNode in
+// results are copies, so they can be read after the lock is released. It fails
+// if there are more paths than the configured maxBatchStatSize.
+func BatchStatFileNodesIn(namespace string, paths []string) ([]StatResult, error) {
+	maxSize := viper.GetInt(MasterMaxBatchStatSize)
+	if maxSize <= 0 {
+		maxSize = defaultMaxBatchStatSize
+	}
+	if len(paths) > maxSize {
+		return nil, fmt.Errorf("too many paths in a batch stat, path num: %d, max: %d", len(paths), maxSize)
+	}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]StatResult, len(paths))
+	for i, path := range paths {
+		results[i].Path = path
+		fileNode, err := checkAndGetFileNode(nsRoot, path)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].FileNode = fileNode.copyMeta()
+	}
+	return results, nil
+}
+
+// AddEntry is a FileNode to be created by a batch add.
+type AddEntry struct {
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	IsFile bool   `json:"is_file"`
+}
+
+// AddResult is the result of creating one AddEntry of a batch. Exactly one of
+// FileNode and Err is set.
+type AddResult struct {
+	Path     string
+	Name     string
+	FileNode *FileNode
+	Err      error
+}
+
+// BatchAddFileNodesIn creates many FileNode in the given namespace at once and
+// returns an AddResult for each entry in order. Each entry is checked like
+// AddFileNode and only fails its own result, but it fails if its parent is an
+// entry which fails. Entries are created from the shallowest path to the
+// deepest one holding createFileNodeLock once, so a directory is always created
+// before entries in it whatever their order is. Like AddFileNode, Chunk of
+// files are not allocated. It fails if there are more entries than the
+// configured maxBatchAddSize.
+func BatchAddFileNodesIn(namespace string, entries []AddEntry) ([]AddResult, error) {
+	maxSize := viper.GetInt(MasterMaxBatchAddSize)
+	if maxSize <= 0 {
+		maxSize = defaultMaxBatchAddSize
+	}
+	if len(entries) > maxSize {
+		return nil, fmt.Errorf("too many entries in a batch add, entry num: %d, max: %d", len(entries), maxSize)
+	}
+	order := make([]int, len(entries))
+	depths := make([]int, len(entries))
+	for i, entry := range entries {
+		order[i] = i
+		for _, name := range strings.Split(entry.Path, pathSplitString) {
+			if name != "" {
+				depths[i]++
+			}
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return depths[order[i]] < depths[order[j]]
+	})
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]AddResult, len(entries))
+	for _, i := range order {
+		entry := entries[i]
+		results[i].Path, results[i].Name = entry.Path, entry.Name
+		results[i].FileNode, results[i].Err = addEntry(nsRoot, entry)
+	}
+	return results, nil
+}
+
+// addEntry creates the FileNode of the AddEntry. The caller must hold
+// createFileNodeLock.
+func addEntry(nsRoot *FileNode, entry AddEntry) (*FileNode, error) {
+	if entry.IsFile {
+		if err := checkFileSize(entry.Size); err != nil {
+			return nil, err
+		}
+	}
+	if entry.Name == "" || strings.Contains(entry.Name, pathSplitString) {
+		return nil, fmt.Errorf("illegal name, name: %s", entry.Name)
+	}
+	parent, err := getParentDir(nsRoot, entry.Path)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := parent.ChildNodes[entry.Name]; ok {
+		return nil, fmt.Errorf("target path already has file with the same name, path : %s", entry.Path)
+	}
+	if err := checkFanOut(parent); err != nil {
+		return nil, err
+	}
+	size := entry.Size
+	if !entry.IsFile {
+		size = common.DirSize
+	}
+	if err := checkQuota(parent, size); err != nil {
+		return nil, err
+	}
+	return createFileNode(parent, entry.Name, size, entry.IsFile), nil
+}
+
 func (f *FileNode) String() string {
 	res := strings.Builder{}
 	childrenIds := make([]string, 0)
@@ -240,15 +2019,54 @@ func (f *FileNode) String() string {
 		childrenIds = append(childrenIds, n.Id)
 	}
 	if f.ParentNode == nil {
-		res.WriteString(fmt.Sprintf("%s$%s$%s$%v$%s$%d$%v$%v$%v\n",
+		res.WriteString(fmt.Sprintf("%s$%s$%s$%v$%s$%d$%v$%v$%v",
 			f.Id, f.FileName, common.MinusOneString, childrenIds, f.Chunks,
 			f.Size, f.IsFile, f.DelTime, f.IsDel))
 	} else {
-		res.WriteString(fmt.Sprintf("%s$%s$%s$%v$%s$%d$%v$%v$%v\n",
+		res.WriteString(fmt.Sprintf("%s$%s$%s$%v$%s$%d$%v$%v$%v",
 			f.Id, f.FileName, f.ParentNode.Id, childrenIds, f.Chunks,
 			f.Size, f.IsFile, f.DelTime, f.IsDel))
 
 	}
+	// Constraint, ReplicaFactor, StoragePolicy, MinReadReplicas, Quota,
+	// SoftQuota, MaxChildren, Owner, Group, Mode, MaxReplicasPerDomain and
+	// RenameHistory are optional, so they are only written when they or fields
+	// after them exist.
+	optionalFields := []string{f.Constraint.String(), strconv.Itoa(f.ReplicaFactor), f.StoragePolicy,
+		strconv.Itoa(f.MinReadReplicas), strconv.FormatInt(f.Quota, 10), strconv.FormatInt(f.SoftQuota, 10),
+		strconv.Itoa(f.MaxChildren), f.Owner, f.Group, strconv.FormatUint(uint64(f.Mode), 8),
+		strconv.Itoa(f.MaxReplicasPerDomain), renameHistoryString(f.RenameHistory)}
+	optionalNum := 0
+	switch {
+	case len(f.RenameHistory) != 0:
+		optionalNum = 12
+	case f.MaxReplicasPerDomain != 0:
+		optionalNum = 11
+	case f.Mode != 0:
+		optionalNum = 10
+	case f.Group != "":
+		optionalNum = 9
+	case f.Owner != "":
+		optionalNum = 8
+	case f.MaxChildren != 0:
+		optionalNum = 7
+	case f.SoftQuota != 0:
+		optionalNum = 6
+	case f.Quota != 0:
+		optionalNum = 5
+	case f.MinReadReplicas != 0:
+		optionalNum = 4
+	case f.StoragePolicy != "":
+		optionalNum = 3
+	case f.ReplicaFactor != 0:
+		optionalNum = 2
+	case !f.Constraint.IsEmpty():
+		optionalNum = 1
+	}
+	for _, field := range optionalFields[:optionalNum] {
+		res.WriteString("$" + field)
+	}
+	res.WriteString("\n")
 
 	return res.String()
 }
@@ -288,11 +2106,16 @@ func (f *FileNode) add2Arr(arr *[]*FileNode) {
 	}
 }
 
-// PersistDirTree writes all FileNode in the directory tree to the sink for
-// persistence.
+// PersistDirTree writes all FileNode in the directory trees of all namespaces
+// to the sink for persistence. The caller must hold createFileNodeLock.
 func PersistDirTree(sink raft.SnapshotSink) error {
+	if err := writeSectionHeader(sink); err != nil {
+		return err
+	}
 	queue := list.New()
-	queue.PushBack(root)
+	for _, nsRoot := range allNamespaceRoots() {
+		queue.PushBack(nsRoot)
+	}
 	for queue.Len() != 0 {
 		cur := queue.Front()
 		queue.Remove(cur)
@@ -317,21 +2140,73 @@ func PersistDirTree(sink raft.SnapshotSink) error {
 
 // RestoreDirTree restore the directory tree from buf.
 func RestoreDirTree(buf *bufio.Scanner) error {
-	rootMap := ReadDirTree(buf)
-	if rootMap != nil && len(rootMap) != 0 {
+	rootMap, err := ReadDirTree(buf)
+	if err != nil {
+		return err
+	}
+	// A ReadView copies the directory trees under createFileNodeLock only.
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	updateConstraintLock.Lock()
+	defer updateConstraintLock.Unlock()
+	constrainedFileNodes = make(map[string]*FileNode)
+	replicaFactorFileNodes = make(map[string]*FileNode)
+	spreadFileNodes = make(map[string]*FileNode)
+	resetFileNameInterns()
+	for _, fileNode := range rootMap {
+		// Names of deleted FileNode include their id, so they are never shared.
+		if !fileNode.IsDel {
+			fileNode.FileName = internFileName(fileNode.FileName)
+		}
+	}
+	if len(rootMap) != 0 {
+		// FileNode of the replaced trees must not be found by id any more, the
+		// restored ones are indexed again when the trees are built.
+		fileNodeIdSet = mapset.NewSet()
+		fileNodeIndex = make(map[string]*FileNode)
+		// Roots of namespaces must be found before RootDeserialize clears the
+		// ParentNode of the default root.
+		namespaceRoots = NamespaceRootsDeserialize(rootMap)
 		root = RootDeserialize(rootMap)
 	}
 	return nil
 }
 
+// migrateChunkIds upgrades a record of the directory tree from version 2 by
+// rebuilding the Chunk ids of a file, which were created without the
+// ChunkIdDelimiter before version 3.
+func migrateChunkIds(line string) (string, error) {
+	data := strings.Split(line, "$")
+	if len(data) <= isFileIdx {
+		return "", fmt.Errorf("illegal directory tree record: %q", line)
+	}
+	isFile, _ := strconv.ParseBool(data[isFileIdx])
+	chunksData := strings.TrimSuffix(strings.TrimPrefix(data[fileChunksIdx], "["), "]")
+	if !isFile || chunksData == "" {
+		return line, nil
+	}
+	if strings.Split(chunksData, " ")[0] == util.CombineString(data[FileNodeIdIdx], common.ChunkIdDelimiter, "0") {
+		return line, nil
+	}
+	size, err := strconv.ParseInt(data[sizeIdx], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("illegal size of directory tree record: %q", line)
+	}
+	data[fileChunksIdx] = fmt.Sprint(initChunks(size, data[FileNodeIdIdx]))
+	return strings.Join(data, "$"), nil
+}
+
 // ReadDirTree reads all FileNode from the buf and puts them into a map.
-func ReadDirTree(buf *bufio.Scanner) map[string]*FileNode {
+// FileNode which have been deleted for a long time are dropped.
+func ReadDirTree(buf *bufio.Scanner) (map[string]*FileNode, error) {
+	return readDirTree(buf, true)
+}
+
+// readDirTree reads all FileNode from the buf and puts them into a map. FileNode
+// deleted for a long time before now are dropped only if dropExpired is true.
+func readDirTree(buf *bufio.Scanner, dropExpired bool) (map[string]*FileNode, error) {
 	res := map[string]*FileNode{}
-	for buf.Scan() {
-		line := buf.Text()
-		if line == common.SnapshotDelimiter {
-			return res
-		}
+	err := scanSection(buf, sectionDirTree, func(line string) error {
 		data := strings.Split(line, "$")
 		childrenLen := len(data[childrenIdx])
 		childrenData := data[childrenIdx][1 : childrenLen-1]
@@ -365,8 +2240,8 @@ func ReadDirTree(buf *bufio.Scanner) map[string]*FileNode {
 			delTimePtr = &delTime
 		}
 		isDel, _ := strconv.ParseBool(data[isDelIdx])
-		if isDel && time.Now().Sub(delTime).Hours() > 23 {
-			continue
+		if dropExpired && isDel && time.Now().Sub(delTime).Hours() > 23 {
+			return nil
 		}
 		fn := &FileNode{
 			Id:       data[FileNodeIdIdx],
@@ -381,9 +2256,85 @@ func ReadDirTree(buf *bufio.Scanner) map[string]*FileNode {
 			DelTime:    delTimePtr,
 			IsDel:      isDel,
 		}
+		if len(data) > constraintIdx {
+			constraint, err := ParsePlacementConstraint(data[constraintIdx])
+			if err != nil {
+				return err
+			}
+			fn.Constraint = constraint
+		}
+		if len(data) > replicaFactorIdx {
+			replicaFactor, err := strconv.Atoi(data[replicaFactorIdx])
+			if err != nil {
+				return err
+			}
+			fn.ReplicaFactor = replicaFactor
+		}
+		if len(data) > storagePolicyIdx {
+			fn.StoragePolicy = data[storagePolicyIdx]
+		}
+		if len(data) > minReadReplicasIdx {
+			minReadReplicas, err := strconv.Atoi(data[minReadReplicasIdx])
+			if err != nil {
+				return err
+			}
+			fn.MinReadReplicas = minReadReplicas
+		}
+		if len(data) > quotaIdx {
+			quota, err := strconv.ParseInt(data[quotaIdx], 10, 64)
+			if err != nil {
+				return err
+			}
+			fn.Quota = quota
+		}
+		if len(data) > softQuotaIdx {
+			softQuota, err := strconv.ParseInt(data[softQuotaIdx], 10, 64)
+			if err != nil {
+				return err
+			}
+			fn.SoftQuota = softQuota
+		}
+		if len(data) > maxChildrenIdx {
+			maxChildren, err := strconv.Atoi(data[maxChildrenIdx])
+			if err != nil {
+				return err
+			}
+			fn.MaxChildren = maxChildren
+		}
+		if len(data) > ownerIdx {
+			fn.Owner = data[ownerIdx]
+		}
+		if len(data) > groupIdx {
+			fn.Group = data[groupIdx]
+		}
+		if len(data) > modeIdx {
+			mode, err := strconv.ParseUint(data[modeIdx], 8, 32)
+			if err != nil {
+				return err
+			}
+			fn.Mode = uint32(mode)
+		}
+		if len(data) > maxReplicasPerDomainIdx {
+			maxReplicasPerDomain, err := strconv.Atoi(data[maxReplicasPerDomainIdx])
+			if err != nil {
+				return err
+			}
+			fn.MaxReplicasPerDomain = maxReplicasPerDomain
+		}
+		if len(data) > renameHistoryIdx {
+			history, err := parseRenameHistory(data[renameHistoryIdx])
+			if err != nil {
+				return err
+			}
+			fn.RenameHistory = history
+		}
 		res[fn.Id] = fn
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return res
+	return res, nil
 }
 
 // RootDeserialize rebuild the directory tree from rootMap.
@@ -391,7 +2342,7 @@ func RootDeserialize(rootMap map[string]*FileNode) *FileNode {
 	// Look for root
 	newRoot := &FileNode{}
 	for _, r := range rootMap {
-		if r.ParentNode.Id == common.MinusOneString {
+		if r.ParentNode != nil && r.ParentNode.Id == common.MinusOneString && r.FileName == rootFileName {
 			newRoot = r
 			break
 		}
@@ -401,22 +2352,185 @@ func RootDeserialize(rootMap map[string]*FileNode) *FileNode {
 	return newRoot
 }
 
+// NamespaceRootsDeserialize rebuild the directory trees of all namespaces except
+// the default one from rootMap.
+func NamespaceRootsDeserialize(rootMap map[string]*FileNode) map[string]*FileNode {
+	roots := make(map[string]*FileNode)
+	for _, r := range rootMap {
+		if r.ParentNode != nil && r.ParentNode.Id == common.MinusOneString && r.FileName != rootFileName {
+			roots[r.FileName] = r
+		}
+	}
+	for _, r := range roots {
+		if r.ChildNodes == nil {
+			r.ChildNodes = make(map[string]*FileNode)
+		}
+		buildTree(r, rootMap)
+		r.ParentNode = nil
+	}
+	return roots
+}
+
 // buildTree build the directory tree from given map containing all FileNode.
 func buildTree(cur *FileNode, nodeMap map[string]*FileNode) {
 	if cur == nil {
 		return
 	}
+	cur.subtreeSize = cur.Size
+	if cur.ChildNodes == nil {
+		return
+	}
 	// id is the key of cur.ChildNodes which is uuid
 	ids := make([]string, 0)
 	for id, _ := range cur.ChildNodes {
 		ids = append(ids, id)
 	}
+	// Sort so that duplicate names are repaired in the same way on every master.
+	sort.Strings(ids)
+	cur.ChildNodes = make(map[string]*FileNode, len(ids))
 	for _, id := range ids {
-		node := nodeMap[id]
-		delete(cur.ChildNodes, id)
+		node, ok := nodeMap[id]
+		// The child may have been dropped by ReadDirTree because it has been
+		// deleted for a long time.
+		if !ok {
+			continue
+		}
+		// A corrupt snapshot may have children with the same name. Rename the
+		// later ones rather than dropping them, so that they can still be found.
+		for cur.ChildNodes[node.FileName] != nil {
+			newName := util.CombineString(node.FileName, deleteDelimiter, node.Id)
+			Logger.Warnf("Rename FileNode with duplicate name when restoring, parent id: %s, id: %s, name: %s, new name: %s",
+				cur.Id, node.Id, node.FileName, newName)
+			node.FileName = newName
+		}
 		cur.ChildNodes[node.FileName] = node
 		node.ParentNode = cur
-		fileNodeIdSet.Add(node.Id)
+		indexFileNode(node)
+		if !node.Constraint.IsEmpty() {
+			constrainedFileNodes[node.Id] = node
+		}
+		if node.IsFile && node.ReplicaFactor != 0 {
+			replicaFactorFileNodes[node.Id] = node
+		}
+		if node.IsFile && node.MaxReplicasPerDomain != 0 {
+			spreadFileNodes[node.Id] = node
+		}
 		buildTree(node, nodeMap)
+		cur.subtreeSize += node.subtreeSize
+	}
+}
+
+// NamespaceReport is the result of verifying all directory trees.
+type NamespaceReport struct {
+	// FileNodes is the number of FileNode reached from all roots.
+	FileNodes int
+	// Issues are all inconsistencies found in the directory trees.
+	Issues []NamespaceIssue
+}
+
+// IsValid returns true if no inconsistency is found.
+func (r *NamespaceReport) IsValid() bool {
+	return len(r.Issues) == 0
+}
+
+// NamespaceIssue is an inconsistency of a FileNode.
+type NamespaceIssue struct {
+	// Namespace is empty for the default namespace.
+	Namespace  string
+	FileNodeId string
+	Path       string
+	Problem    string
+}
+
+// VerifyNamespace walks all directory trees and reports every inconsistency
+// found, including a wrong ParentNode, a child stored under a wrong name, two
+// children with the same name, a cycle, a FileNode reached more than once, a
+// FileNode in fileNodeIdSet which can not be reached and a Chunk of a file which
+// does not exist in chunksMap. Nothing is changed.
+func VerifyNamespace() *NamespaceReport {
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	report := &NamespaceReport{Issues: make([]NamespaceIssue, 0)}
+	reached := make(map[*FileNode]bool)
+	reachedIds := mapset.NewSet()
+	for _, nsRoot := range allNamespaceRoots() {
+		namespace := nsRoot.FileName
+		addIssue := func(fileNode *FileNode, path string, problem string) {
+			report.Issues = append(report.Issues, NamespaceIssue{
+				Namespace:  namespace,
+				FileNodeId: fileNode.Id,
+				Path:       path,
+				Problem:    problem,
+			})
+		}
+		if nsRoot.ParentNode != nil {
+			addIssue(nsRoot, pathSplitString, "root has a parent")
+		}
+		verifyFileNode(nsRoot, pathSplitString, make(map[*FileNode]bool), reached, reachedIds, addIssue)
+	}
+	report.FileNodes = len(reached)
+	for _, id := range set2SortedStrings(fileNodeIdSet) {
+		if !reachedIds.Contains(id) {
+			report.Issues = append(report.Issues, NamespaceIssue{
+				FileNodeId: id,
+				Problem:    "orphaned, it can not be reached from any root",
+			})
+		}
+	}
+	return report
+}
+
+// verifyFileNode verifies a FileNode and its subtree. ancestors includes all
+// FileNode on the path from the root to cur, and reached includes all FileNode
+// which have been verified. The caller must hold createFileNodeLock and
+// updateChunksLock.
+func verifyFileNode(cur *FileNode, path string, ancestors map[*FileNode]bool, reached map[*FileNode]bool,
+	reachedIds mapset.Set, addIssue func(fileNode *FileNode, path string, problem string)) {
+	reached[cur] = true
+	reachedIds.Add(cur.Id)
+	if cur.IsFile {
+		for i := range cur.Chunks {
+			chunkId := util.CombineString(cur.Id, common.ChunkIdDelimiter, strconv.Itoa(i))
+			if _, ok := chunksMap[chunkId]; !ok {
+				addIssue(cur, path, fmt.Sprintf("chunk %s not exist", chunkId))
+			}
+		}
+	}
+	ancestors[cur] = true
+	defer delete(ancestors, cur)
+	names := make([]string, 0, len(cur.ChildNodes))
+	for name := range cur.ChildNodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fileNames := make(map[string]bool, len(names))
+	for _, name := range names {
+		child := cur.ChildNodes[name]
+		childPath := strings.TrimSuffix(path, pathSplitString) + pathSplitString + name
+		if child == nil {
+			addIssue(cur, childPath, "child is nil")
+			continue
+		}
+		if ancestors[child] {
+			addIssue(child, childPath, "cycle, it is an ancestor of itself")
+			continue
+		}
+		if reached[child] {
+			addIssue(child, childPath, "reached more than once")
+			continue
+		}
+		if child.ParentNode != cur {
+			addIssue(child, childPath, fmt.Sprintf("parent does not point back, parent id: %s", cur.Id))
+		}
+		if child.FileName != name {
+			addIssue(child, childPath, fmt.Sprintf("stored under a wrong name, file name: %s", child.FileName))
+		}
+		if fileNames[child.FileName] {
+			addIssue(child, childPath, fmt.Sprintf("duplicate name in parent, file name: %s", child.FileName))
+		}
+		fileNames[child.FileName] = true
+		verifyFileNode(child, childPath, ancestors, reached, reachedIds, addIssue)
 	}
 }
@@ -0,0 +1,88 @@
+package internal
+
+// NamespaceStatistics is the shape of the directory tree of a namespace, which
+// is used to catch pathological namespaces such as too deep or too wide ones.
+type NamespaceStatistics struct {
+	// Namespace is empty for the default namespace.
+	Namespace string
+	// MaxDepth is the depth of the deepest FileNode. The root is at depth 0.
+	MaxDepth int
+	// NodeCount is the number of FileNode except the root, including deleted
+	// ones which have not been cleaned.
+	NodeCount int
+	// DirCount is the number of directories including the root.
+	DirCount int
+	// TombstoneCount is the number of deleted FileNode which have not been
+	// cleaned, FileNode under a deleted directory are not included.
+	TombstoneCount int
+	// MaxChildren and AvgChildren are the maximum and average number of direct
+	// children of a directory.
+	MaxChildren int
+	AvgChildren float64
+}
+
+// NamespaceStats walks the directory tree of the given namespace and returns
+// its shape. The tree can be changed by many operations including restoring
+// and cleaning the trash, so the statistics are computed by a walk holding
+// createFileNodeLock rather than kept by counters which may drift.
+func NamespaceStats(namespace string) (*NamespaceStatistics, error) {
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return getNamespaceStats(nsRoot), nil
+}
+
+// getNamespaceStats walks the directory tree of nsRoot. The caller must hold
+// createFileNodeLock.
+func getNamespaceStats(nsRoot *FileNode) *NamespaceStatistics {
+	stats := &NamespaceStatistics{}
+	if nsRoot != root {
+		stats.Namespace = nsRoot.FileName
+	}
+	totalChildren := 0
+	nodes := []*FileNode{nsRoot}
+	depths := []int{0}
+	for len(nodes) != 0 {
+		cur, depth := nodes[len(nodes)-1], depths[len(depths)-1]
+		nodes, depths = nodes[:len(nodes)-1], depths[:len(depths)-1]
+		if depth > stats.MaxDepth {
+			stats.MaxDepth = depth
+		}
+		if cur != nsRoot {
+			stats.NodeCount++
+		}
+		if cur.IsDel {
+			stats.TombstoneCount++
+		}
+		if cur.IsFile {
+			continue
+		}
+		stats.DirCount++
+		totalChildren += len(cur.ChildNodes)
+		if len(cur.ChildNodes) > stats.MaxChildren {
+			stats.MaxChildren = len(cur.ChildNodes)
+		}
+		for _, child := range cur.ChildNodes {
+			nodes = append(nodes, child)
+			depths = append(depths, depth+1)
+		}
+	}
+	stats.AvgChildren = float64(totalChildren) / float64(stats.DirCount)
+	return stats
+}
+
+// updateNamespaceStatsMonitor walks the directory trees of all namespaces and
+// exposes their shape through metrics. The caller must hold createFileNodeLock.
+func updateNamespaceStatsMonitor() {
+	for _, nsRoot := range allNamespaceRoots() {
+		stats := getNamespaceStats(nsRoot)
+		namespaceMaxDepthMonitor.WithLabelValues(stats.Namespace).Set(float64(stats.MaxDepth))
+		namespaceNodeCountMonitor.WithLabelValues(stats.Namespace).Set(float64(stats.NodeCount))
+		namespaceTombstoneCountMonitor.WithLabelValues(stats.Namespace).Set(float64(stats.TombstoneCount))
+		namespaceMaxChildrenMonitor.WithLabelValues(stats.Namespace).Set(float64(stats.MaxChildren))
+		namespaceAvgChildrenMonitor.WithLabelValues(stats.Namespace).Set(stats.AvgChildren)
+	}
+}
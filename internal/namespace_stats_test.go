@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"tinydfs-base/common"
+)
+
+func TestNamespaceStats(t *testing.T) {
+	oldRoot := root
+	t.Cleanup(func() {
+		root = oldRoot
+		root.ChildNodes = map[string]*FileNode{}
+		namespaceRoots = make(map[string]*FileNode)
+	})
+	// The tree is /a/b/c/f.txt, /a/x.txt and /d with three files, one of
+	// which is deleted.
+	for _, dir := range [][2]string{{"/", "a"}, {"/a", "b"}, {"/a/b", "c"}, {"/", "d"}} {
+		_, err := AddFileNode(dir[0], dir[1], common.DirSize, false)
+		assert.NoError(t, err)
+	}
+	for _, file := range [][2]string{{"/a/b/c", "f.txt"}, {"/a", "x.txt"}, {"/d", "1.txt"}, {"/d", "2.txt"},
+		{"/d", "3.txt"}} {
+		_, err := AddFileNode(file[0], file[1], 0, true)
+		assert.NoError(t, err)
+	}
+	_, err := RemoveFileNode("/d/3.txt")
+	assert.NoError(t, err)
+
+	stats, err := NamespaceStats("")
+	assert.NoError(t, err)
+	assert.Equal(t, &NamespaceStatistics{
+		MaxDepth:       4,
+		NodeCount:      9,
+		DirCount:       5,
+		TombstoneCount: 1,
+		MaxChildren:    3,
+		AvgChildren:    9.0 / 5,
+	}, stats)
+
+	_, err = CreateNamespace("tenantA")
+	assert.NoError(t, err)
+	stats, err = NamespaceStats("tenantA")
+	assert.NoError(t, err)
+	assert.Equal(t, &NamespaceStatistics{Namespace: "tenantA", DirCount: 1}, stats)
+	_, err = NamespaceStats("tenantB")
+	assert.Error(t, err)
+
+	// Stats are exposed through metrics.
+	createFileNodeLock.Lock()
+	updateNamespaceStatsMonitor()
+	createFileNodeLock.Unlock()
+	assert.Equal(t, float64(4), testutil.ToFloat64(namespaceMaxDepthMonitor.WithLabelValues("")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(namespaceTombstoneCountMonitor.WithLabelValues("")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(namespaceNodeCountMonitor.WithLabelValues("tenantA")))
+}
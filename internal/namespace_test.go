@@ -1,11 +1,24 @@
 package internal
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	set "github.com/deckarep/golang-set"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc/metadata"
+	"math"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 	"tinydfs-base/common"
+	"tinydfs-base/protocol/pb"
 	"tinydfs-base/util"
 )
 
@@ -143,20 +156,20 @@ func TestInitChunks(t *testing.T) {
 		"a": {
 			size:                 common.ChunkSize,
 			id:                   "a",
-			expectFirstChunkName: "a0",
-			expectLastChunkName:  "a0",
+			expectFirstChunkName: "a_0",
+			expectLastChunkName:  "a_0",
 		},
 		"b": {
 			size:                 common.ChunkSize - 1,
 			id:                   "b",
-			expectFirstChunkName: "b0",
-			expectLastChunkName:  "b0",
+			expectFirstChunkName: "b_0",
+			expectLastChunkName:  "b_0",
 		},
 		"c": {
 			size:                 common.ChunkSize + 1,
 			id:                   "c",
-			expectFirstChunkName: "c0",
-			expectLastChunkName:  "c1",
+			expectFirstChunkName: "c_0",
+			expectLastChunkName:  "c_1",
 		},
 	}
 	for name, c := range test {
@@ -168,6 +181,110 @@ func TestInitChunks(t *testing.T) {
 	}
 }
 
+func TestResolvePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		workDir string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "Absolute", workDir: "/home", path: "/usr/./bin/", want: "/usr/bin"},
+		{name: "Relative", workDir: "/home/alice", path: "docs/a.txt", want: "/home/alice/docs/a.txt"},
+		{name: "Parent", workDir: "/home/alice/", path: "../bob//b.txt", want: "/home/bob/b.txt"},
+		{name: "Root", workDir: "/home/alice", path: "../..", want: "/"},
+		{name: "Empty", workDir: "/home", path: "", want: "/home"},
+		{name: "Escape", workDir: "/home/alice", path: "../../../etc", wantErr: true},
+		{name: "AbsoluteEscape", workDir: "/", path: "/home/../..", wantErr: true},
+		{name: "RelativeWorkDir", workDir: "home", path: "a.txt", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolvePath(tt.workDir, tt.path)
+			if tt.wantErr {
+				assert.Error(t, err, "Expected an error.")
+				return
+			}
+			assert.NoError(t, err, "Unexpected error.")
+			assert.Equal(t, tt.want, got, "Unexpected path.")
+		})
+	}
+}
+
+func TestAddFileNode_ParentIsFile(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	_, err := AddFileNode("/", "a.txt", 1, true)
+	assert.NoError(t, err, "Unexpected error.")
+
+	for _, isFile := range []bool{true, false} {
+		assert.NotPanics(t, func() {
+			_, err = AddFileNode("/a.txt", "b", 1, isFile)
+		})
+		assert.EqualError(t, err, "parent is not a directory, path : /a.txt")
+	}
+	assert.NotPanics(t, func() {
+		_, _, err = CreateOrReplaceFileNode("/a.txt", "b", 1)
+	})
+	assert.EqualError(t, err, "parent is not a directory, path : /a.txt")
+	_, err = AddFileNode("/missing", "b", 1, true)
+	assert.EqualError(t, err, "path not exist, path : /missing")
+
+	// The lock is released, so creating FileNode still works.
+	_, err = AddFileNode("/", "c", 0, false)
+	assert.NoError(t, err, "Unexpected error.")
+}
+
+func TestAddFileNode_MaxChunks(t *testing.T) {
+	viper.Set(MasterMaxChunksPerFile, 4)
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		viper.Set(MasterMaxChunksPerFile, defaultMaxChunksPerFile)
+	})
+	tests := []struct {
+		name    string
+		size    int64
+		wantErr bool
+	}{
+		{
+			name: "MaxChunks",
+			size: 4 * common.ChunkSize,
+		},
+		{
+			name:    "TooManyChunks",
+			size:    4*common.ChunkSize + 1,
+			wantErr: true,
+		},
+		{
+			name:    "HugeSize",
+			size:    math.MaxInt64,
+			wantErr: true,
+		},
+		{
+			name:    "NegativeSize",
+			size:    -1,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileNode, err := AddFileNode("/", tt.name, tt.size, true)
+			_, exist := getFileNode("/" + tt.name)
+			if tt.wantErr {
+				assert.Error(t, err, "Expected an error.")
+				assert.False(t, exist, "File should not be created.")
+				_, _, err = GetOrCreateFileNode("/", tt.name, tt.size, true)
+				assert.Error(t, err, "Expected an error.")
+				return
+			}
+			assert.NoError(t, err, "Unexpected error.")
+			assert.True(t, exist, "File should be created.")
+			assert.Equal(t, 4, len(fileNode.Chunks), "Unexpected chunk num.")
+		})
+	}
+}
+
 func TestRemoveFileNode(t *testing.T) {
 	test := map[string]*struct {
 		initRoot    func(path string)
@@ -229,7 +346,7 @@ func TestListFileNode(t *testing.T) {
 			if c.initRoot != nil {
 				c.initRoot(c.directory)
 			}
-			nodes, err := ListFileNode(c.path)
+			nodes, err := ListFileNode(c.path, false)
 			if c.initRoot == nil {
 				assert.Nil(t, nodes)
 				assert.Error(t, err)
@@ -242,6 +359,221 @@ func TestListFileNode(t *testing.T) {
 	}
 }
 
+func TestListFileNode_Copy(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	initRoot("/a/b.txt")
+	nodes, err := ListFileNode("/a", false)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Len(t, nodes, 1, "Unexpected len.")
+
+	child, _ := getFileNode("/a/b.txt")
+	child.FileName = "c.txt"
+	child.Size = 1024
+	child.Chunks = append(child.Chunks, "chunk1")
+	_, err = AddFileNode("/a", "d.txt", 0, true)
+	assert.NoError(t, err, "Unexpected error.")
+
+	assert.Len(t, nodes, 1, "Listed result should not change.")
+	assert.Equal(t, "b.txt", nodes[0].FileName, "Listed result should not change.")
+	assert.Equal(t, int64(0), nodes[0].Size, "Listed result should not change.")
+	assert.Empty(t, nodes[0].Chunks, "Listed result should not change.")
+	assert.Nil(t, nodes[0].ParentNode, "Listed result should not expose the directory tree.")
+}
+
+func TestListTrash(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	initRoot("/a/b.txt")
+	_, err := AddFileNode("/a", "c.txt", 0, true)
+	assert.NoError(t, err)
+	removed, err := RemoveFileNode("/a/b.txt")
+	assert.NoError(t, err)
+
+	// Deleted FileNode are hidden unless they are asked for.
+	nodes, err := ListFileNode("/a", false)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+	assert.Equal(t, "c.txt", nodes[0].FileName)
+	nodes, err = ListFileNode("/a", true)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 2)
+	handler := newLeaderHandler(t)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(includeDeletedMetadataKey, "true"))
+	rep, err := handler.CheckAndList(ctx, &pb.CheckAndListArgs{Path: "/a", IsLatest: true})
+	assert.NoError(t, err)
+	assert.Len(t, rep.Files, 2)
+	rep, err = handler.CheckAndList(context.Background(), &pb.CheckAndListArgs{Path: "/a"})
+	assert.NoError(t, err)
+	assert.Len(t, rep.Files, 1)
+
+	trash, err := ListTrash("/a")
+	assert.NoError(t, err)
+	assert.Len(t, trash, 1)
+	assert.Equal(t, removed.Id, trash[0].Id)
+	assert.Equal(t, "b.txt", trash[0].FileName)
+	assert.True(t, trash[0].IsDel)
+	assert.Equal(t, *removed.DelTime, *trash[0].DelTime)
+	// The FileNode in the directory tree keeps its deleted name.
+	assert.NotEqual(t, "b.txt", removed.FileName)
+
+	_, err = ListTrash("/a/c.txt")
+	assert.Error(t, err)
+}
+
+func TestRestoreDeletedFileNode(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	_, err := AddFileNode("/", "a", 0, false)
+	assert.NoError(t, err)
+	removed := make([]*FileNode, 2)
+	for i := range removed {
+		_, err = AddFileNode("/a", "foo", int64(i+1), true)
+		assert.NoError(t, err)
+		removed[i], err = RemoveFileNode("/a/foo")
+		assert.NoError(t, err)
+	}
+	// Make the first one be deleted earlier.
+	earlier := removed[1].DelTime.Add(-time.Hour)
+	removed[0].DelTime = &earlier
+
+	// Both tombstones survive in the trash.
+	trash, err := ListTrash("/a")
+	assert.NoError(t, err)
+	assert.Len(t, trash, 2)
+	for i, n := range trash {
+		assert.Equal(t, "foo", n.FileName)
+		assert.Equal(t, removed[i].Id, n.Id, "Trash should be sorted by delete time.")
+	}
+
+	// The earlier one is restored by its id.
+	restored, err := RestoreDeletedFileNode("/a", removed[0].Id)
+	assert.NoError(t, err)
+	assert.Equal(t, removed[0].Id, restored.Id)
+	assert.False(t, restored.IsDel)
+	assert.Nil(t, restored.DelTime)
+	node, ok := getFileNode("/a/foo")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), node.Size)
+	_, err = RestoreDeletedFileNode("/a", removed[1].Id)
+	assert.Error(t, err, "Restoring over an existing file should fail.")
+
+	// The later one is restored independently after the name is free.
+	_, err = RenameFileNode("/a/foo", "bar", time.Now())
+	assert.NoError(t, err)
+	restored, err = RestoreDeletedFileNode("/a", removed[1].Id)
+	assert.NoError(t, err)
+	assert.Equal(t, removed[1].Id, restored.Id)
+	trash, err = ListTrash("/a")
+	assert.NoError(t, err)
+	assert.Len(t, trash, 0)
+	_, err = RestoreDeletedFileNode("/a", removed[0].Id)
+	assert.Error(t, err, "Nothing is left to restore.")
+}
+
+func TestWalkFileTree(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	initRoot("/a/b/c/d.txt")
+	_, err := AddFileNode("/a", "x.txt", 0, true)
+	assert.NoError(t, err)
+
+	result, err := WalkFileTree(context.Background(), "/")
+	assert.NoError(t, err)
+	assert.False(t, result.Truncated)
+	paths := make([]string, len(result.Entries))
+	for i, entry := range result.Entries {
+		paths[i] = entry.Path
+	}
+	assert.Equal(t, []string{"/a", "/a/b", "/a/x.txt", "/a/b/c", "/a/b/c/d.txt"}, paths)
+	_, err = WalkFileTree(context.Background(), "/a/x.txt")
+	assert.Error(t, err)
+
+	// A writer takes the lock after the first directory is visited, the walk
+	// returns what it has visited when the deadline is exceeded.
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result, err = walkFileTree(ctx, root, "/", func(entries []WalkEntry) {
+		once.Do(func() {
+			go func() {
+				createFileNodeLock.Lock()
+				close(locked)
+				<-release
+				createFileNodeLock.Unlock()
+			}()
+			<-locked
+		})
+	})
+	close(release)
+	assert.NoError(t, err)
+	assert.True(t, result.Truncated)
+	assert.Equal(t, walkDeadlineExceeded, result.TruncatedReason)
+	assert.Len(t, result.Entries, 1)
+	assert.Equal(t, "/a", result.Entries[0].Path)
+
+	// The walk of a client gives up after the configured timeout.
+	timeout := viper.GetInt(MasterWalkTimeout)
+	viper.Set(MasterWalkTimeout, 20)
+	defer viper.Set(MasterWalkTimeout, timeout)
+	createFileNodeLock.Lock()
+	result, err = (&MasterHandler{}).WalkFileTree(context.Background(), "/")
+	createFileNodeLock.Unlock()
+	assert.NoError(t, err)
+	assert.True(t, result.Truncated)
+	assert.Empty(t, result.Entries)
+}
+
+func TestWalkFileTree_ConcurrentMutation(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	_, err := AddFileNode("/", "a", 0, false)
+	assert.NoError(t, err, "Unexpected error.")
+	for i := 0; i < 10; i++ {
+		_, err = AddFileNode("/a", strconv.Itoa(i), 0, false)
+		assert.NoError(t, err, "Unexpected error.")
+		_, err = AddFileNode("/a/"+strconv.Itoa(i), "x.txt", 1, true)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+
+	// Renaming and removing by the FSM must not race with walking by clients,
+	// which is checked by go test -race.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			name := strconv.Itoa(i)
+			_, err := RenameFileNode("/a/"+name, "renamed-"+name, time.Now())
+			assert.NoError(t, err, "Unexpected error.")
+			_, err = RemoveOperation{Path: "/a/renamed-" + name + "/x.txt"}.Apply()
+			assert.NoError(t, err, "Unexpected error.")
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		result, err := WalkFileTree(context.Background(), "/")
+		assert.NoError(t, err, "Unexpected error.")
+		assert.False(t, result.Truncated, "Walk should not be truncated.")
+	}
+	result, err := WalkFileTree(context.Background(), "/a")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Len(t, result.Entries, 10, "Only the renamed directories should be visited.")
+	for _, entry := range result.Entries {
+		assert.True(t, strings.HasPrefix(entry.Path, "/a/renamed-"), "Unexpected path.")
+	}
+}
+
 func TestRenameFileNode(t *testing.T) {
 	test := map[string]*struct {
 		initRoot       func(path string)
@@ -270,7 +602,7 @@ func TestRenameFileNode(t *testing.T) {
 			if c.initRoot != nil {
 				c.initRoot(c.directory)
 			}
-			node, err := RenameFileNode(c.path, c.newName)
+			node, err := RenameFileNode(c.path, c.newName, time.Now())
 			if c.initRoot == nil {
 				assert.Nil(t, node)
 				assert.Error(t, err)
@@ -340,3 +672,1118 @@ func GetRootA() *FileNode {
 	a.ChildNodes[c.FileName] = c
 	return a
 }
+
+func TestRestoreDirTree(t *testing.T) {
+	test := map[string]*struct {
+		data      string
+		expectErr bool
+	}{
+		"Success": {
+			data: "root$$-1$[]$[]$0$false$<nil>$false\n" + common.SnapshotDelimiter,
+		},
+		"Truncated": {
+			data:      "root$$-1$[]$[]$0$false$<nil>$false\n",
+			expectErr: true,
+		},
+	}
+	for name, c := range test {
+		t.Run(name, func(t *testing.T) {
+			oldRoot := root
+			defer func() {
+				root = oldRoot
+			}()
+			err := RestoreDirTree(bufio.NewScanner(strings.NewReader(c.data)))
+			if c.expectErr {
+				assert.Error(t, err)
+				assert.Equal(t, oldRoot, root)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "root", root.Id)
+			}
+		})
+	}
+}
+
+// memorySink is a raft.SnapshotSink which keeps all data in memory.
+type memorySink struct {
+	bytes.Buffer
+}
+
+func (s *memorySink) ID() string {
+	return "memory"
+}
+
+func (s *memorySink) Cancel() error {
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func TestNamespace(t *testing.T) {
+	oldRoot := root
+	defer func() {
+		root = oldRoot
+		root.ChildNodes = map[string]*FileNode{}
+		namespaceRoots = make(map[string]*FileNode)
+	}()
+	for _, namespace := range []string{"tenantA", "tenantB"} {
+		_, err := CreateNamespace(namespace)
+		assert.NoError(t, err)
+		_, err = AddFileNodeIn(namespace, "/", "usr", common.DirSize, false)
+		assert.NoError(t, err)
+		_, err = AddFileNodeIn(namespace, "/usr", "abc.txt", common.ChunkSize, true)
+		assert.NoError(t, err)
+	}
+	_, err := CreateNamespace("tenantA")
+	assert.Error(t, err)
+	for _, namespace := range []string{"", "tenant/C", "tenant$C", "tenant" + common.SnapshotDelimiter} {
+		_, err = CreateNamespace(namespace)
+		assert.Error(t, err, "Illegal namespace name %q should be rejected.", namespace)
+	}
+	_, err = AddFileNodeIn("tenantC", "/", "usr", common.DirSize, false)
+	assert.Error(t, err)
+
+	nodeA, err := CheckAndGetFileNodeIn("tenantA", "/usr/abc.txt")
+	assert.NoError(t, err)
+	nodeB, err := CheckAndGetFileNodeIn("tenantB", "/usr/abc.txt")
+	assert.NoError(t, err)
+	assert.NotEqual(t, nodeA.Id, nodeB.Id)
+	_, err = CheckAndGetFileNode("/usr/abc.txt")
+	assert.Error(t, err)
+
+	_, err = RemoveFileNodeIn("tenantA", "/usr/abc.txt")
+	assert.NoError(t, err)
+	_, err = CheckAndGetFileNodeIn("tenantA", "/usr/abc.txt")
+	assert.Error(t, err)
+	_, err = CheckAndGetFileNodeIn("tenantB", "/usr/abc.txt")
+	assert.NoError(t, err)
+
+	sink := &memorySink{}
+	assert.NoError(t, PersistDirTree(sink))
+	namespaceRoots = make(map[string]*FileNode)
+	assert.NoError(t, RestoreDirTree(bufio.NewScanner(&sink.Buffer)))
+	assert.Equal(t, 2, len(namespaceRoots))
+	restoredB, err := CheckAndGetFileNodeIn("tenantB", "/usr/abc.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, nodeB.Id, restoredB.Id)
+}
+
+func TestGetOrCreateFileNode(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	initRoot("/a/b/c.txt")
+
+	node, created, err := GetOrCreateFileNode("/a/b", "c.txt", 0, true)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.False(t, created, "Existing file should not be created.")
+	assert.Equal(t, "c.txt", node.FileName, "Unexpected file name.")
+
+	_, _, err = GetOrCreateFileNode("/a/b", "c.txt", 0, false)
+	assert.Error(t, err, "Expected an error for existing FileNode of different type.")
+
+	_, _, err = GetOrCreateFileNode("/a/b/c.txt", "d.txt", 0, true)
+	assert.Error(t, err, "Expected an error for parent which is a file.")
+
+	const goroutineNum = 64
+	var (
+		wg           sync.WaitGroup
+		createdCount atomic.Int32
+		nodes        = make([]*FileNode, goroutineNum)
+	)
+	for i := 0; i < goroutineNum; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			node, created, err := GetOrCreateFileNode("/a/b", "e.txt", 1, true)
+			assert.NoError(t, err, "Unexpected error.")
+			if created {
+				createdCount.Inc()
+			}
+			nodes[i] = node
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), createdCount.Load(), "Exactly one goroutine should create the FileNode.")
+	for i := 1; i < goroutineNum; i++ {
+		assert.Same(t, nodes[0], nodes[i], "All goroutines should get the same FileNode.")
+	}
+}
+
+func TestMoveFileNode(t *testing.T) {
+	tests := []struct {
+		name       string
+		targetPath string
+		wantParent string
+		wantErr    string
+	}{
+		{
+			name:       "Success",
+			targetPath: "/c",
+			wantParent: "c",
+		},
+		{
+			name:       "SameParent",
+			targetPath: "/a",
+			wantParent: "a",
+		},
+		{
+			name:       "TargetNotExist",
+			targetPath: "/d",
+			wantErr:    "target path not exist",
+		},
+		{
+			name:       "TargetIsFile",
+			targetPath: "/c/d.txt",
+			wantErr:    "target is not a directory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() {
+				root.ChildNodes = map[string]*FileNode{}
+			})
+			initRoot("/a/b.txt")
+			initRoot("/c/d.txt")
+			var (
+				fileNode *FileNode
+				err      error
+			)
+			assert.NotPanics(t, func() {
+				fileNode, err = MoveFileNode("/a/b.txt", tt.targetPath)
+			}, "Move should not panic.")
+			// The lock must be released on every path.
+			assert.True(t, createFileNodeLock.TryLock(), "Lock is leaked.")
+			createFileNodeLock.Unlock()
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr, "Unexpected error.")
+				_, ok := getFileNode("/a/b.txt")
+				assert.True(t, ok, "FileNode should stay in the current path.")
+				return
+			}
+			assert.NoError(t, err, "Unexpected error.")
+			_, ok := getFileNode(tt.targetPath + "/b.txt")
+			assert.True(t, ok, "FileNode should be moved to the target path.")
+			assert.Equal(t, tt.wantParent, fileNode.ParentNode.FileName, "Unexpected parent.")
+		})
+	}
+}
+
+func TestMoveFileNode_IntoSelf(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	initRoot("/a/b/c.txt")
+	for _, targetPath := range []string{"/a", "/a/b"} {
+		_, err := MoveFileNode("/a", targetPath)
+		assert.ErrorContains(t, err, "can not move a directory into itself", "Unexpected error.")
+	}
+	fileNode, ok := getFileNode("/a/b/c.txt")
+	assert.True(t, ok, "Directory tree should not be changed.")
+	assert.Equal(t, root, fileNode.ParentNode.ParentNode.ParentNode, "Directory tree should not be changed.")
+	assert.True(t, createFileNodeLock.TryLock(), "Lock is leaked.")
+	createFileNodeLock.Unlock()
+}
+
+func TestMoveFileNode_SubtreeSize(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		root.subtreeSize = 0
+	})
+	root.ChildNodes = map[string]*FileNode{}
+	root.subtreeSize = 0
+	for _, dir := range [][2]string{{"/", "a"}, {"/a", "b"}, {"/a/b", "heavy"}, {"/", "c"}, {"/c", "d"}} {
+		_, err := AddFileNode(dir[0], dir[1], 0, false)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+	const fileNum = 100
+	for i := 0; i < fileNum; i++ {
+		_, err := AddFileNode("/a/b/heavy", fmt.Sprintf("file%d", i), common.ChunkSize, true)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+	_, err := AddFileNode("/a", "light.txt", 1, true)
+	assert.NoError(t, err, "Unexpected error.")
+	heavySize := int64(fileNum * common.ChunkSize)
+
+	_, err = MoveFileNode("/a/b/heavy", "/c/d")
+	assert.NoError(t, err, "Unexpected error.")
+
+	wantSizes := map[string]int64{
+		"/a":         1,
+		"/a/b":       0,
+		"/c":         heavySize,
+		"/c/d":       heavySize,
+		"/c/d/heavy": heavySize,
+	}
+	for path, want := range wantSizes {
+		fileNode, ok := getFileNode(path)
+		assert.True(t, ok, "FileNode should exist, path: %s", path)
+		assert.Equal(t, want, fileNode.SubtreeSize(), "Unexpected cached size, path: %s", path)
+	}
+	assert.Equal(t, heavySize+1, root.SubtreeSize(), "Unexpected cached size of root.")
+}
+
+func TestSetDirPolicy_Inherit(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	_, err := AddFileNode("/", "a", 0, false)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = AddFileNode("/a", "b", 0, false)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = SetDirPolicy("/a", 2, "ssd")
+	assert.NoError(t, err, "Unexpected error.")
+	// The nearest ancestor wins for each field independently.
+	_, err = SetDirPolicy("/a/b", 0, "archive")
+	assert.NoError(t, err, "Unexpected error.")
+
+	file, err := AddFileNode("/a/b", "c.txt", 0, true)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 2, file.ReplicaFactor, "Unexpected replica factor.")
+	assert.Equal(t, "archive", file.StoragePolicy, "Unexpected storage policy.")
+
+	// Changing the default only affects files created later.
+	handler := newLeaderHandler(t)
+	assert.NoError(t, handler.SetDirPolicy(context.Background(), "", "/a", 5, "ssd"), "Unexpected error.")
+	newFile, err := AddFileNode("/a/b", "d.txt", 0, true)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 2, file.ReplicaFactor, "Existing file should not be changed.")
+	assert.Equal(t, 5, newFile.ReplicaFactor, "Unexpected replica factor.")
+
+	_, err = SetDirPolicy("/a/b/c.txt", 3, "")
+	assert.Error(t, err, "Policy can not be set on a file.")
+	assert.Error(t, handler.SetDirPolicy(context.Background(), "", "/a", 1, "bad$policy"),
+		"Illegal storage policy should be rejected.")
+
+	// Directory defaults are persisted.
+	dir, _ := getFileNode("/a")
+	nodes, err := ReadDirTree(bufio.NewScanner(strings.NewReader(dir.String() + common.SnapshotDelimiter)))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 5, nodes[dir.Id].ReplicaFactor, "Unexpected replica factor.")
+	assert.Equal(t, "ssd", nodes[dir.Id].StoragePolicy, "Unexpected storage policy.")
+	assert.True(t, nodes[dir.Id].Constraint.IsEmpty(), "Unexpected constraint.")
+}
+
+func TestSetFileNodeReplicaFactor(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	file, err := AddFileNode("/", "a.txt", 2*common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	chunkIds := file.Chunks
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Chunks: set.NewSet(chunkIds[0], chunkIds[1]),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Chunks: set.NewSet(chunkIds[0], chunkIds[1], "other1", "other2"),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+	for _, id := range chunkIds {
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet("dataNode1", "dataNode2"), pendingDataNodes: set.NewSet()}
+	}
+
+	// Raising the factor queues each Chunk once for each missing replica.
+	handler := newLeaderHandler(t)
+	assert.NoError(t, handler.SetReplicaFactor(context.Background(), "", "/a.txt", 4), "Unexpected error.")
+	assert.Equal(t, 4, getChunkReplicaFactor(chunkIds[0]), "Unexpected replica factor.")
+	queued := make([]string, 0)
+	for _, id := range pendingChunkQueue.BatchTop(pendingChunkQueue.Len()) {
+		queued = append(queued, id.String())
+	}
+	assert.Equal(t, []string{chunkIds[0], chunkIds[0], chunkIds[1], chunkIds[1]}, queued, "Unexpected queue.")
+	assert.Equal(t, queued, BatchFilterChunk(queued), "All missing replicas should be allocated.")
+	assert.Equal(t, queued, BatchFilterChunk(append(queued, chunkIds[0])), "Excess entries should be filtered.")
+
+	// Lowering the factor deletes the replica on the busiest DataNode.
+	pendingChunkQueue = util.NewQueue[String]()
+	_, err = SetFileNodeReplicaFactor("/a.txt", 1, time.Now())
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 0, pendingChunkQueue.Len(), "Nothing should be queued.")
+	for _, id := range chunkIds {
+		assert.Equal(t, []string{"dataNode1"}, set2SortedStrings(chunksMap[id].dataNodes), "Unexpected data nodes.")
+		assert.Equal(t, common.WaitToInform, dataNodeMap["dataNode2"].FutureSendChunks[ChunkSendInfo{
+			ChunkId:  id,
+			SendType: common.DeleteSendType,
+		}], "Replica should be deleted.")
+	}
+	assert.Equal(t, 0, len(dataNodeMap["dataNode1"].FutureSendChunks), "Unexpected deletion.")
+
+	assert.Error(t, handler.SetReplicaFactor(context.Background(), "", "/a.txt", 0),
+		"Replica factor must be positive.")
+	_, err = SetFileNodeReplicaFactor("/", 2, time.Now())
+	assert.Error(t, err, "Replica factor can only be set on a file.")
+
+	// An erased file is dropped from all indexes of FileNode.
+	_, err = SetFileNodeConstraint("/a.txt", "disk=ssd")
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = SetFileNodeMaxReplicasPerDomain("/a.txt", 1)
+	assert.NoError(t, err, "Unexpected error.")
+	_, _, err = RemoveFileNodeImmediately("/a.txt")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.NotContains(t, constrainedFileNodes, file.Id, "Erased file should not be constrained.")
+	assert.NotContains(t, replicaFactorFileNodes, file.Id, "Erased file should not have a replica factor.")
+	assert.NotContains(t, spreadFileNodes, file.Id, "Erased file should not be spread.")
+}
+
+func TestSetReplicaFactorOperation_LeaderTime(t *testing.T) {
+	watermark := viper.GetInt(MasterPendingQueueWatermark)
+	viper.Set(MasterPendingQueueWatermark, 1)
+	t.Cleanup(func() {
+		viper.Set(MasterPendingQueueWatermark, watermark)
+		root.ChildNodes = map[string]*FileNode{}
+		chunksMap = make(map[string]*Chunk)
+		pendingChunkQueue = util.NewQueue[String]()
+		stagedChunks = make([]stagedChunk, 0)
+	})
+	file, err := AddFileNode("/", "a.txt", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	chunkId := file.Chunks[0]
+	chunksMap[chunkId] = &Chunk{Id: chunkId, dataNodes: set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet()}
+	pendingChunkQueue.Push("chunk0")
+
+	// The queue is saturated, so the missing replica is deferred with the time
+	// of the leader rather than the time when it is applied.
+	leaderTime := time.Now().Add(-time.Hour)
+	_, err = SetReplicaFactorOperation{Path: "/a.txt", ReplicaFactor: 3, Time: leaderTime.UnixMilli()}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []stagedChunk{{chunkId: chunkId, releaseTime: time.UnixMilli(leaderTime.UnixMilli())}},
+		stagedChunks, "Unexpected staged chunks.")
+}
+
+func TestCreateOrReplaceFileNode(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	_, err := AddFileNode("/", "a", 0, false)
+	assert.NoError(t, err, "Unexpected error.")
+	oldFile, err := AddFileNode("/a", "b.txt", common.ChunkSize+1, true)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = AddFileNode("/a", "c", 0, false)
+	assert.NoError(t, err, "Unexpected error.")
+
+	newFile, oldChunks, err := CreateOrReplaceFileNode("/a", "b.txt", 1)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, oldFile.Chunks, oldChunks, "Unexpected old chunks.")
+	current, _ := getFileNode("/a/b.txt")
+	assert.Equal(t, newFile.Id, current.Id, "Old file should be replaced.")
+	assert.True(t, oldFile.IsDel, "Old file should be deleted.")
+	assert.Equal(t, 1, len(newFile.Chunks), "Unexpected chunk num.")
+
+	_, oldChunks, err = CreateOrReplaceFileNode("/a", "new.txt", 1)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Nil(t, oldChunks, "No file should be replaced.")
+
+	_, _, err = CreateOrReplaceFileNode("/a", "c", 1)
+	assert.Error(t, err, "Directory should not be replaced.")
+	dir, ok := getFileNode("/a/c")
+	assert.True(t, ok && !dir.IsFile, "Directory should not be changed.")
+
+	// Client asks to replace a file in the metadata of its request.
+	storableNum := StorableNum.Load()
+	StorableNum.Store(math.MaxInt32)
+	t.Cleanup(func() {
+		StorableNum.Store(storableNum)
+	})
+	handler := newLeaderHandler(t)
+	args := &pb.CheckArgs4AddArgs{Path: "/a", FileName: "b.txt", Size: 1}
+	_, err = handler.CheckArgs4Add(context.Background(), args)
+	assert.Error(t, err, "Existing file should not be replaced without overwrite.")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(overwriteMetadataKey, "true"))
+	_, err = handler.CheckArgs4Add(ctx, args)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.True(t, newFile.IsDel, "File should be replaced.")
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(overwriteMetadataKey, "yes please"))
+	_, err = handler.CheckArgs4Add(ctx, args)
+	assert.Error(t, err, "Illegal overwrite flag should be rejected.")
+}
+
+func TestCreateOrReplaceFileNode_Atomic(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	_, err := AddFileNode("/", "a", 0, false)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = AddFileNode("/a", "b.txt", 1, true)
+	assert.NoError(t, err, "Unexpected error.")
+
+	done := make(chan struct{})
+	missing := atomic.NewInt32(0)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			nodes, _ := ListFileNode("/a", false)
+			alive := 0
+			for _, node := range nodes {
+				if node.FileName == "b.txt" && !node.IsDel {
+					alive++
+				}
+			}
+			if alive != 1 {
+				missing.Inc()
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_, _, err = CreateOrReplaceFileNode("/a", "b.txt", 1)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+	close(done)
+	wg.Wait()
+	assert.Equal(t, int32(0), missing.Load(), "Reader should always see exactly one file.")
+}
+
+func TestVerifyNamespace(t *testing.T) {
+	roots := namespaceRoots
+	namespaceRoots = make(map[string]*FileNode)
+	fileNodeIdSet.Clear()
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		namespaceRoots = roots
+		fileNodeIdSet.Clear()
+		chunksMap = make(map[string]*Chunk)
+	})
+	dir, err := AddFileNode("/", "a", 0, false)
+	assert.NoError(t, err, "Unexpected error.")
+	file, err := AddFileNode("/a", "b.txt", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	chunkId := file.Id + common.ChunkIdDelimiter + "0"
+	chunksMap[chunkId] = &Chunk{Id: chunkId}
+
+	report := VerifyNamespace()
+	assert.True(t, report.IsValid(), "Unexpected issues: %v", report.Issues)
+	assert.Equal(t, 3, report.FileNodes, "Unexpected file node num.")
+
+	// Corrupt the parent pointer of the file.
+	file.ParentNode = root
+	report = VerifyNamespace()
+	assert.False(t, report.IsValid(), "Corrupted parent should be detected.")
+	assert.Equal(t, 1, len(report.Issues), "Unexpected issues: %v", report.Issues)
+	assert.Equal(t, file.Id, report.Issues[0].FileNodeId, "Unexpected file node id.")
+	assert.Equal(t, "/a/b.txt", report.Issues[0].Path, "Unexpected path.")
+	file.ParentNode = dir
+
+	// Create a cycle, a missing chunk and an orphaned FileNode.
+	dir.ChildNodes["loop"] = root
+	delete(chunksMap, chunkId)
+	fileNodeIdSet.Add("orphan")
+	report = VerifyNamespace()
+	problems := make([]string, len(report.Issues))
+	for i, issue := range report.Issues {
+		problems[i] = issue.FileNodeId + ": " + issue.Problem
+	}
+	assert.Equal(t, []string{
+		file.Id + ": chunk " + chunkId + " not exist",
+		root.Id + ": cycle, it is an ancestor of itself",
+		"orphan: orphaned, it can not be reached from any root",
+	}, problems, "Unexpected issues.")
+}
+
+func TestSetDirQuota(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	_, err := AddFileNode("/", "quota", common.DirSize, false)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = SetDirQuota("/quota", common.ChunkSize, 2*common.ChunkSize)
+	assert.Error(t, err, "Expected an error for soft quota exceeding quota.")
+	handler := newLeaderHandler(t)
+	assert.Error(t, handler.SetQuota(context.Background(), "", "/quota", -1, 0),
+		"Expected an error for negative quota.")
+	assert.NoError(t, handler.SetQuota(context.Background(), "", "/quota", 10*common.ChunkSize, 8*common.ChunkSize),
+		"Unexpected error.")
+	dir, _ := getFileNode("/quota")
+
+	warnings := testutil.ToFloat64(softQuotaExceededCountMonitor)
+	_, err = AddFileNode("/quota", "a.txt", 5*common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, warnings, testutil.ToFloat64(softQuotaExceededCountMonitor), "Unexpected warning.")
+	// Crossing the soft quota is allowed with a warning.
+	_, err = AddFileNode("/quota", "b.txt", 4*common.ChunkSize, true)
+	assert.NoError(t, err, "Write across the soft quota should succeed.")
+	assert.Equal(t, warnings+1, testutil.ToFloat64(softQuotaExceededCountMonitor), "Warning should be emitted.")
+	// Crossing the quota is rejected.
+	_, err = AddFileNode("/quota", "c.txt", 2*common.ChunkSize, true)
+	assert.Error(t, err, "Write across the quota should be rejected.")
+	_, _, err = CreateOrReplaceFileNode("/quota", "a.txt", 2*common.ChunkSize)
+	assert.Error(t, err, "Write across the quota should be rejected.")
+	_, err = AddFileNode("/quota", "c.txt", common.ChunkSize, true)
+	assert.NoError(t, err, "Write within the quota should succeed.")
+	assert.Equal(t, int64(10*common.ChunkSize), dir.SubtreeSize(), "Unexpected used size.")
+
+	// Moving into the directory is checked against the quota, moving inside
+	// it is not.
+	_, err = AddFileNode("/", "d.txt", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = MoveFileNode("/d.txt", "/quota")
+	assert.Error(t, err, "Move across the quota should be rejected.")
+	_, err = AddFileNode("/quota", "sub", common.DirSize, false)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = MoveFileNode("/quota/a.txt", "/quota/sub")
+	assert.NoError(t, err, "Move inside the directory should succeed.")
+	assert.Equal(t, int64(10*common.ChunkSize), dir.SubtreeSize(), "Unexpected used size.")
+
+	// Quota is persisted in snapshot.
+	sink := &memorySink{}
+	assert.NoError(t, PersistDirTree(sink))
+	assert.NoError(t, RestoreDirTree(bufio.NewScanner(&sink.Buffer)))
+	restored, err := CheckAndGetFileNode("/quota")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, int64(10*common.ChunkSize), restored.Quota, "Unexpected quota.")
+	assert.Equal(t, int64(8*common.ChunkSize), restored.SoftQuota, "Unexpected soft quota.")
+}
+
+func TestCheckFanOut(t *testing.T) {
+	maxChildren := viper.GetInt(MasterMaxChildrenPerDir)
+	viper.Set(MasterMaxChildrenPerDir, 3)
+	t.Cleanup(func() {
+		viper.Set(MasterMaxChildrenPerDir, maxChildren)
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	_, err := AddFileNode("/", "fan", common.DirSize, false)
+	assert.NoError(t, err, "Unexpected error.")
+	for i := 0; i < 3; i++ {
+		_, err = AddFileNode("/fan", fmt.Sprintf("%d.txt", i), 0, true)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+	_, err = AddFileNode("/fan", "3.txt", 0, true)
+	assert.Error(t, err, "Expected an error for a full directory.")
+	_, _, err = GetOrCreateFileNode("/fan", "3.txt", 0, true)
+	assert.Error(t, err, "Expected an error for a full directory.")
+	_, _, err = CreateOrReplaceFileNode("/fan", "0.txt", 0)
+	assert.Error(t, err, "Expected an error for a full directory.")
+	node, created, err := GetOrCreateFileNode("/fan", "0.txt", 0, true)
+	assert.NoError(t, err, "Getting an existing child should succeed.")
+	assert.False(t, created, "Existing child should not be created.")
+	_, err = AddFileNode("/", "3.txt", 0, true)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = MoveFileNode("/3.txt", "/fan")
+	assert.Error(t, err, "Expected an error for moving into a full directory.")
+	_, err = RenameFileNode("/fan/0.txt", "00.txt", time.Now())
+	assert.NoError(t, err, "Renaming in a full directory should succeed.")
+	assert.Equal(t, "00.txt", node.FileName, "Unexpected name.")
+
+	// The directory overrides the configured limit.
+	handler := newLeaderHandler(t)
+	assert.Error(t, handler.SetMaxChildren(context.Background(), "", "/fan", -1),
+		"Expected an error for negative max children.")
+	assert.NoError(t, handler.SetMaxChildren(context.Background(), "", "/fan", 4), "Unexpected error.")
+	_, err = MoveFileNode("/3.txt", "/fan")
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = AddFileNode("/fan", "4.txt", 0, true)
+	assert.Error(t, err, "Expected an error for a full directory.")
+
+	// MaxChildren is persisted in snapshot.
+	sink := &memorySink{}
+	assert.NoError(t, PersistDirTree(sink))
+	assert.NoError(t, RestoreDirTree(bufio.NewScanner(&sink.Buffer)))
+	restored, err := CheckAndGetFileNode("/fan")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 4, restored.MaxChildren, "Unexpected max children.")
+	assert.Equal(t, 4, len(restored.ChildNodes), "Unexpected children.")
+}
+
+func TestWhoReferences(t *testing.T) {
+	oldRoot := root
+	t.Cleanup(func() {
+		root = oldRoot
+		root.ChildNodes = map[string]*FileNode{}
+		namespaceRoots = make(map[string]*FileNode)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	_, err := CreateNamespace("tenantA")
+	assert.NoError(t, err)
+	_, err = AddFileNodeIn("tenantA", "/", "usr", common.DirSize, false)
+	assert.NoError(t, err)
+	oldSink := &memorySink{}
+	assert.NoError(t, PersistDirTree(oldSink))
+	fileNode, err := AddFileNodeIn("tenantA", "/usr", "abc.txt", 3*common.ChunkSize, true)
+	assert.NoError(t, err)
+	corruptId := fileNode.Chunks[1]
+
+	// dataNode1 finds its replica of the Chunk corrupt.
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive, Chunks: set.NewSet(corruptId),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+	chunksMap[corruptId] = &Chunk{Id: corruptId, dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	_, err = HeartbeatOperation{DataNodeId: "dataNode1", InvalidChunks: []string{corruptId}}.Apply()
+	assert.NoError(t, err)
+
+	references, err := WhoReferences(corruptId)
+	assert.NoError(t, err)
+	assert.Equal(t, []ChunkReference{{Namespace: "tenantA", Path: "/usr/abc.txt", FileNodeId: fileNode.Id,
+		Index: 1}}, references)
+
+	// The path is rebuilt after the file is moved.
+	_, err = RenameFileNodeIn("tenantA", "/usr/abc.txt", "def.txt", time.Now())
+	assert.NoError(t, err)
+	references, err = WhoReferences(corruptId)
+	assert.NoError(t, err)
+	assert.Equal(t, "/usr/def.txt", references[0].Path)
+
+	_, err = WhoReferences("unknown_0")
+	assert.Error(t, err)
+
+	handler := newLeaderHandler(t)
+	references, err = handler.WhoReferences(corruptId)
+	assert.NoError(t, err)
+	assert.Equal(t, fileNode.Id, references[0].FileNodeId)
+
+	// The file is not in the installed snapshot, so it can not be found in
+	// the discarded directory tree any more.
+	assert.NoError(t, RestoreDirTree(bufio.NewScanner(&oldSink.Buffer)))
+	_, ok := getIndexedFileNode(fileNode.Id)
+	assert.False(t, ok, "FileNode of the discarded tree should not be indexed.")
+	_, err = WhoReferences(corruptId)
+	assert.Error(t, err)
+}
+
+func TestRemoveFileNode_DeleteMode(t *testing.T) {
+	oldRoot := root
+	t.Cleanup(func() {
+		root = oldRoot
+		root.ChildNodes = map[string]*FileNode{}
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		fileNodeIdSet.Clear()
+	})
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive, Chunks: set.NewSet(),
+		FutureSendChunks: make(map[ChunkSendInfo]int)}
+	addFile := func(path string, name string) *FileNode {
+		fileNode, err := AddFileNode(path, name, common.ChunkSize, true)
+		assert.NoError(t, err)
+		for _, id := range fileNode.Chunks {
+			chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+			dataNodeMap["dataNode1"].Chunks.Add(id)
+		}
+		return fileNode
+	}
+	for _, dir := range []string{"deferred", "immediate"} {
+		_, err := AddFileNode("/", dir, common.DirSize, false)
+		assert.NoError(t, err)
+		_, err = AddFileNode("/"+dir, "sub", common.DirSize, false)
+		assert.NoError(t, err)
+	}
+	deferredFile := addFile("/deferred/sub", "a.txt")
+	immediateFiles := []*FileNode{addFile("/immediate", "a.txt"), addFile("/immediate/sub", "b.txt")}
+
+	// A deferred delete keeps the FileNode in trash and its Chunk until the
+	// trash is cleaned.
+	_, err := RemoveOperation{Path: "/deferred"}.Apply()
+	assert.NoError(t, err)
+	trash, err := ListTrash("/")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(trash))
+	assert.NotNil(t, chunksMap[deferredFile.Chunks[0]], "Chunk should be reclaimed later.")
+	assert.True(t, fileNodeIdSet.Contains(deferredFile.Id))
+
+	// An immediate delete unlinks the whole directory and reclaims its Chunk
+	// at once.
+	_, err = RemoveOperation{Path: "/immediate", Immediate: true}.Apply()
+	assert.NoError(t, err)
+	trash, err = ListTrash("/")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(trash), "Immediate delete should skip the trash.")
+	assert.Equal(t, int64(common.ChunkSize), root.SubtreeSize())
+	for _, fileNode := range immediateFiles {
+		chunkId := fileNode.Chunks[0]
+		assert.Nil(t, chunksMap[chunkId], "Chunk should be reclaimed at once.")
+		assert.False(t, fileNodeIdSet.Contains(fileNode.Id))
+		assert.True(t, dataNodeMap["dataNode1"].Chunks.Contains(chunkId),
+			"Chunk should stay on the datanode until the deleting is confirmed.")
+		assert.Contains(t, dataNodeMap["dataNode1"].FutureSendChunks,
+			ChunkSendInfo{ChunkId: chunkId, SendType: common.DeleteSendType}, "Chunk should be deleted.")
+	}
+	assert.True(t, dataNodeMap["dataNode1"].Chunks.Contains(deferredFile.Chunks[0]))
+	_, err = RemoveOperation{Path: "/", Immediate: true}.Apply()
+	assert.Error(t, err, "Root can not be removed.")
+}
+
+func TestBatchStatFileNodesIn(t *testing.T) {
+	maxSize := viper.GetInt(MasterMaxBatchStatSize)
+	viper.Set(MasterMaxBatchStatSize, 4)
+	t.Cleanup(func() {
+		viper.Set(MasterMaxBatchStatSize, maxSize)
+		root.ChildNodes = map[string]*FileNode{}
+		root.subtreeSize = 0
+	})
+	for _, dir := range [][2]string{{"/", "a"}, {"/a", "b"}} {
+		_, err := AddFileNode(dir[0], dir[1], 0, false)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+	for _, name := range []string{"x.txt", "y.txt"} {
+		_, err := AddFileNode("/a/b", name, 1, true)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+
+	// Paths sharing ancestors are stated concurrently without deadlock.
+	paths := []string{"/a/b/x.txt", "/a/b/missing", "/a/b", "/a/b/y.txt"}
+	results := make([][]StatResult, 8)
+	wg := &sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := BatchStatFileNodesIn("", paths)
+			assert.NoError(t, err, "Unexpected error.")
+			results[i] = res
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Batch stat is deadlocked.")
+	}
+	for _, res := range results {
+		assert.Len(t, res, len(paths), "Each path should have a result.")
+		for i, result := range res {
+			assert.Equal(t, paths[i], result.Path, "Results should be in order.")
+		}
+		assert.Equal(t, "x.txt", res[0].FileNode.FileName, "Unexpected file name.")
+		assert.NoError(t, res[0].Err, "Unexpected error.")
+		assert.Nil(t, res[1].FileNode, "Missing path should have no FileNode.")
+		assert.Error(t, res[1].Err, "Missing path should fail.")
+		assert.False(t, res[2].FileNode.IsFile, "Unexpected file type.")
+		assert.Equal(t, int64(1), res[3].FileNode.Size, "Unexpected size.")
+	}
+
+	_, err := BatchStatFileNodesIn("", append(paths, "/a"))
+	assert.Error(t, err, "Batch exceeding the max size should be rejected.")
+	_, err = BatchStatFileNodesIn("missing", paths)
+	assert.Error(t, err, "Missing namespace should be rejected.")
+}
+
+func TestBatchStatFileNodesIn_ConcurrentMutation(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		root.subtreeSize = 0
+	})
+	_, err := AddFileNode("/", "a", 0, false)
+	assert.NoError(t, err, "Unexpected error.")
+	for i := 0; i < 20; i++ {
+		_, err = AddFileNode("/a", fmt.Sprintf("%d.txt", i), 1, true)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+
+	// Renaming, removing and listing by the FSM must not race with stating
+	// and listing by clients, which is checked by go test -race.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			name := fmt.Sprintf("%d.txt", i)
+			_, err := RenameFileNode("/a/"+name, "renamed-"+name, time.Now())
+			assert.NoError(t, err, "Unexpected error.")
+			_, err = SetFileNodeConstraint("/a/renamed-"+name, "")
+			assert.NoError(t, err, "Unexpected error.")
+			_, err = RemoveFileNode("/a/renamed-" + name)
+			assert.NoError(t, err, "Unexpected error.")
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		_, err = BatchStatFileNodesIn("", []string{"/a", "/a/0.txt", "/a/renamed-1.txt"})
+		assert.NoError(t, err, "Unexpected error.")
+		_, err = ListFileNode("/a", true)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+	fileNodes, err := ListFileNode("/a", false)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Empty(t, fileNodes, "All files should be removed.")
+}
+
+func TestBatchAddOperation(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		root.subtreeSize = 0
+	})
+	// Entries are given children first, and each directory of 10 directories
+	// has 30 files.
+	entries := make([]AddEntry, 0)
+	want := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		dir := fmt.Sprintf("/data/dir%d", i)
+		for j := 0; j < 30; j++ {
+			entries = append(entries, AddEntry{Path: dir, Name: fmt.Sprintf("file%d", j), Size: 1, IsFile: true})
+			want = append(want, fmt.Sprintf("%s/file%d", dir, j))
+		}
+		entries = append(entries, AddEntry{Path: "/data", Name: fmt.Sprintf("dir%d", i)})
+		want = append(want, dir)
+	}
+	entries = append(entries, AddEntry{Path: "/", Name: "data"})
+	want = append(want, "/data")
+	entries = append(entries, AddEntry{Path: "/data", Name: "dir0"}, AddEntry{Path: "/missing", Name: "file"},
+		AddEntry{Path: "/data/dir0/file0", Name: "file"})
+
+	res, err := BatchAddOperation{Entries: entries, Owner: "alice"}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	results := res.([]AddResult)
+	assert.Len(t, results, len(entries), "Each entry should have a result.")
+	for i, result := range results[:len(want)] {
+		assert.NoError(t, result.Err, "Unexpected error.")
+		assert.Equal(t, entries[i].Name, result.FileNode.FileName, "Results should be in the order of entries.")
+		assert.Equal(t, "alice", result.FileNode.Owner, "Unexpected owner.")
+	}
+	for _, result := range results[len(want):] {
+		assert.Nil(t, result.FileNode, "Invalid entry should not be created.")
+		assert.Error(t, result.Err, "Expected an error.")
+	}
+
+	got := make([]string, 0)
+	nodes := make([]*FileNode, 0)
+	root.add2Arr(&nodes)
+	for _, node := range nodes[1:] {
+		_, path := getFullPath(node)
+		got = append(got, path)
+		assert.Equal(t, !strings.HasPrefix(node.FileName, "file"), !node.IsFile, "Unexpected type.")
+	}
+	assert.ElementsMatch(t, want, got, "Unexpected tree.")
+	assert.Equal(t, int64(300)+11*common.DirSize, root.subtreeSize, "Unexpected subtree size.")
+
+	// Too many entries fail as a whole.
+	maxSize := viper.GetInt(MasterMaxBatchAddSize)
+	viper.Set(MasterMaxBatchAddSize, 2)
+	t.Cleanup(func() {
+		viper.Set(MasterMaxBatchAddSize, maxSize)
+	})
+	_, err = BatchAddFileNodesIn("", entries)
+	assert.Error(t, err, "Expected an error.")
+}
+
+func TestRenameHistory(t *testing.T) {
+	length := viper.GetInt(MasterRenameHistoryLength)
+	viper.Set(MasterRenameHistoryLength, 3)
+	t.Cleanup(func() {
+		viper.Set(MasterRenameHistoryLength, length)
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	file, err := AddFileNode("/", "a.txt", 0, true)
+	assert.NoError(t, err)
+	start := time.UnixMilli(1700000000000)
+	for i, names := range [][2]string{{"/a.txt", "b.txt"}, {"/b.txt", "c.txt"}, {"/c.txt", "d.txt"}} {
+		// The time of the leader in the operation is recorded.
+		operation := RenameOperation{Path: names[0], NewName: names[1],
+			Time: start.Add(time.Duration(i) * time.Second).UnixMilli()}
+		_, err = operation.Apply()
+		assert.NoError(t, err)
+	}
+	history, err := GetRenameHistory("/d.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt"}, renameHistoryNames(history))
+	for i, record := range history {
+		assert.True(t, record.Time.Equal(start.Add(time.Duration(i)*time.Second)), "Unexpected rename time.")
+	}
+
+	// Deleting and restoring keep the history, and the oldest name is evicted
+	// by the next rename.
+	removed, err := RemoveFileNode("/d.txt")
+	assert.NoError(t, err)
+	_, err = RestoreDeletedFileNode("/", removed.Id)
+	assert.NoError(t, err)
+	_, err = RenameFileNode("/d.txt", "e.txt", time.Now())
+	assert.NoError(t, err)
+	history, err = GetRenameHistory("/e.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.txt", "c.txt", "d.txt"}, renameHistoryNames(history))
+
+	// History is persisted in the snapshot.
+	nodes, err := ReadDirTree(bufio.NewScanner(strings.NewReader(file.String() + common.SnapshotDelimiter)))
+	assert.NoError(t, err)
+	restored := nodes[file.Id].RenameHistory
+	assert.Equal(t, renameHistoryNames(history), renameHistoryNames(restored))
+	for i := range history {
+		assert.True(t, history[i].Time.Equal(restored[i].Time), "Unexpected restored rename time.")
+	}
+
+	_, err = GetRenameHistory("/d.txt")
+	assert.Error(t, err)
+}
+
+func renameHistoryNames(history []RenameRecord) []string {
+	names := make([]string, len(history))
+	for i, record := range history {
+		names[i] = record.Name
+	}
+	return names
+}
+
+func TestAllocateNextChunk_Lazy(t *testing.T) {
+	viper.Set(MasterLazyChunkThreshold, 4)
+	t.Cleanup(func() {
+		viper.Set(MasterLazyChunkThreshold, 0)
+		root.ChildNodes = map[string]*FileNode{}
+		root.subtreeSize = 0
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: common.Alive, Chunks: set.NewSet(),
+		FullCapacity: 100, FutureSendChunks: make(map[ChunkSendInfo]int)}
+
+	// Small files still get all Chunk at creation.
+	small, err := AddFileNode("/", "small.txt", 4*common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Len(t, small.Chunks, 4, "Small file should be created eagerly.")
+	_, err = AllocateNextChunk("/small.txt")
+	assert.ErrorContains(t, err, "all chunks of file have been allocated", "Unexpected error.")
+
+	const size = 1 << 20 * common.ChunkSize
+	large, err := AddFileNode("/", "large.txt", size, true)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Empty(t, large.Chunks, "Large file should have no chunk before writing.")
+	assert.Equal(t, int64(size), large.Size, "Declared size should be kept.")
+	assert.Equal(t, int64(size+4*common.ChunkSize), root.SubtreeSize(), "Declared size should be counted.")
+
+	for i := 0; i < 2; i++ {
+		chunkId, err := AllocateChunkOperation{Path: "/large.txt"}.Apply()
+		assert.NoError(t, err, "Unexpected error.")
+		assert.Equal(t, util.CombineString(large.Id, common.ChunkIdDelimiter, fmt.Sprint(i)), chunkId,
+			"Unexpected chunk id.")
+	}
+	_, err = AddOperation{FileNodeId: large.Id, ChunkIndex: 1, ChunkNum: 1, Stage: common.GetDataNodes}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Len(t, chunksMap, 1, "Only the written chunk should be added.")
+	_, ok := chunksMap[large.Chunks[1]]
+	assert.True(t, ok, "Written chunk should be added.")
+	_, err = AddOperation{FileNodeId: large.Id, ChunkIndex: 1, ChunkNum: 2, Stage: common.GetDataNodes}.Apply()
+	assert.ErrorContains(t, err, "chunk index out of range", "Chunk which is not allocated can not be written.")
+	_, err = AddOperation{FileNodeId: "unknown", ChunkNum: 1, Stage: common.GetDataNodes}.Apply()
+	assert.ErrorContains(t, err, "file not exist", "Unexpected error.")
+
+	// The client gives the chunk index through the metadata.
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(chunkIndexMetadataKey, "1"))
+	index, err := getChunkIndex(ctx)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 1, index, "Unexpected chunk index.")
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(chunkIndexMetadataKey, "-1"))
+	_, err = getChunkIndex(ctx)
+	assert.Error(t, err, "Expected an error.")
+
+	// Allocated Chunk are persisted, and the rest are still lazy after restoring.
+	nodes, err := ReadDirTree(bufio.NewScanner(strings.NewReader(large.String() + common.SnapshotDelimiter)))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, large.Chunks, nodes[large.Id].Chunks, "Unexpected restored chunks.")
+	ranges, err := MapRangeToChunks("/large.txt", 2*common.ChunkSize, common.ChunkSize)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []ChunkRange{{Length: common.ChunkSize}}, ranges, "Chunk which is not allocated should be a hole.")
+}
+
+func TestSwapFileNodes(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		root.subtreeSize = 0
+	})
+	root.ChildNodes = map[string]*FileNode{}
+	root.subtreeSize = 0
+	for _, dir := range []string{"blue", "green"} {
+		_, err := AddFileNode("/", dir, 0, false)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+	blue, err := AddFileNode("/blue", "app.bin", 2*common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	green, err := AddFileNode("/green", "app-v2.bin", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+
+	_, err = SwapOperation{PathA: "/blue/app.bin", PathB: "/green/app-v2.bin"}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	fileNode, ok := getFileNode("/blue/app.bin")
+	assert.True(t, ok, "Path should still exist.")
+	assert.Equal(t, green.Id, fileNode.Id, "Path should resolve to the other file.")
+	assert.Equal(t, green.Chunks, fileNode.Chunks, "Unexpected chunks.")
+	fileNode, ok = getFileNode("/green/app-v2.bin")
+	assert.True(t, ok, "Path should still exist.")
+	assert.Equal(t, blue.Id, fileNode.Id, "Path should resolve to the other file.")
+	assert.Equal(t, []string{"app.bin"}, renameHistoryNames(fileNode.RenameHistory), "Unexpected rename history.")
+	for path, want := range map[string]int64{"/blue": common.ChunkSize, "/green": 2 * common.ChunkSize} {
+		fileNode, _ = getFileNode(path)
+		assert.Equal(t, want, fileNode.SubtreeSize(), "Unexpected cached size, path: %s", path)
+	}
+
+	// Readers never see both paths resolve to the same file.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			createFileNodeLock.Lock()
+			a, _ := getFileNode("/blue/app.bin")
+			b, _ := getFileNode("/green/app-v2.bin")
+			createFileNodeLock.Unlock()
+			assert.NotSame(t, a, b, "Half swapped state should not be observed.")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, SwapFileNodes("/blue/app.bin", "/green/app-v2.bin", time.Now()), "Unexpected error.")
+	}
+	close(done)
+	wg.Wait()
+
+	assert.NoError(t, SwapFileNodes("/blue", "/blue", time.Now()), "Swapping with itself should change nothing.")
+	assert.ErrorContains(t, SwapFileNodes("/blue", "/blue/app.bin", time.Now()), "descendant", "Unexpected error.")
+	assert.ErrorContains(t, SwapFileNodes("/blue", "/red", time.Now()), "path not exist", "Unexpected error.")
+	assert.True(t, createFileNodeLock.TryLock(), "Lock is leaked.")
+	createFileNodeLock.Unlock()
+}
+
+func TestSwapFileNodes_Limits(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		root.subtreeSize = 0
+	})
+	root.ChildNodes = map[string]*FileNode{}
+	root.subtreeSize = 0
+	for _, dir := range [][]string{{"/", "team"}, {"/team", "blue"}, {"/", "green"}} {
+		_, err := AddFileNode(dir[0], dir[1], 0, false)
+		assert.NoError(t, err, "Unexpected error.")
+	}
+	_, err := AddFileNode("/team/blue", "small.bin", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = AddFileNode("/team", "large.bin", 3*common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = AddFileNode("/green", "large.bin", 3*common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	team, _ := getFileNode("/team")
+	blue, _ := getFileNode("/team/blue")
+
+	// Only the directory getting the larger file is checked against its quota,
+	// and the shared ancestor keeps its used size.
+	blue.Quota = 2 * common.ChunkSize
+	team.Quota = 4 * common.ChunkSize
+	assert.ErrorContains(t, SwapFileNodes("/team/blue/small.bin", "/green/large.bin", time.Now()), "quota",
+		"Unexpected error.")
+	blue.Quota = 3 * common.ChunkSize
+	assert.NoError(t, SwapFileNodes("/team/blue/small.bin", "/team/large.bin", time.Now()), "Unexpected error.")
+	assert.Equal(t, 4*common.ChunkSize, int(team.SubtreeSize()), "Unexpected cached size.")
+
+	// A directory beyond its max number of children can not get another one.
+	blue.MaxChildren = 1
+	_, err = AddFileNode("/team/blue", "other.bin", 0, true)
+	assert.Error(t, err, "Expected an error.")
+	blue.ChildNodes["other.bin"] = &FileNode{Id: "other", FileName: "other.bin", IsFile: true, ParentNode: blue}
+	assert.ErrorContains(t, SwapFileNodes("/team/blue/small.bin", "/team/large.bin", time.Now()), "too many",
+		"Unexpected error.")
+}
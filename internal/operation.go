@@ -7,7 +7,6 @@ import (
 	"github.com/spf13/viper"
 	"reflect"
 	"strconv"
-	"strings"
 	"time"
 	"tinydfs-base/common"
 	"tinydfs-base/protocol/pb"
@@ -16,30 +15,80 @@ import (
 
 var (
 	// OpTypeMap is used to include all types of Operation. When implementing
-	// a new type of Operation, we should put <name of operation, type of
-	// operation> into this map.
+	// a new type of Operation, we should register it by RegisterOperationType
+	// rather than putting it into this map directly.
 	OpTypeMap = make(map[string]reflect.Type)
 )
 
+// RegisterOperationType registers the type of an Operation with its operation
+// type, so that the Operation applied with the operation type can be decoded
+// and applied by MasterFSM. It is called in init, and it panics if the
+// operation type is empty or has been registered, because a mismatch between
+// an operation type and its payload would misapply logs.
+func RegisterOperationType(opType string, operation Operation) {
+	if opType == "" {
+		panic("operation type can not be empty")
+	}
+	if registered, ok := OpTypeMap[opType]; ok {
+		panic(fmt.Sprintf("operation type %s has been registered by %v", opType, registered))
+	}
+	t := reflect.TypeOf(operation)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	OpTypeMap[opType] = t
+}
+
 const DayHour = 24
 
 func init() {
-	OpTypeMap[common.OperationRegister] = reflect.TypeOf(RegisterOperation{})
-	OpTypeMap[common.OperationHeartbeat] = reflect.TypeOf(HeartbeatOperation{})
-	OpTypeMap[common.OperationAdd] = reflect.TypeOf(AddOperation{})
-	OpTypeMap[common.OperationGet] = reflect.TypeOf(GetOperation{})
-	OpTypeMap[common.OperationMkdir] = reflect.TypeOf(MkdirOperation{})
-	OpTypeMap[common.OperationMove] = reflect.TypeOf(MoveOperation{})
-	OpTypeMap[common.OperationRemove] = reflect.TypeOf(RemoveOperation{})
-	OpTypeMap[common.OperationList] = reflect.TypeOf(ListOperation{})
-	OpTypeMap[common.OperationStat] = reflect.TypeOf(StatOperation{})
-	OpTypeMap[common.OperationRename] = reflect.TypeOf(RenameOperation{})
-	OpTypeMap[common.OperationAllocateChunks] = reflect.TypeOf(AllocateChunksOperation{})
-	OpTypeMap[common.OperationExpand] = reflect.TypeOf(ExpandOperation{})
-	OpTypeMap[common.OperationDegrade] = reflect.TypeOf(DegradeOperation{})
-	OpTypeMap[common.OperationFileTreeCheck] = reflect.TypeOf(CheckFileTreeOperation{})
-	OpTypeMap[common.OperationChunksCheck] = reflect.TypeOf(CheckChunksOperation{})
-	OpTypeMap[common.OperationDataNodesCheck] = reflect.TypeOf(CheckDataNodesOperation{})
+	RegisterOperationType(common.OperationRegister, RegisterOperation{})
+	RegisterOperationType(common.OperationHeartbeat, HeartbeatOperation{})
+	RegisterOperationType(common.OperationAdd, AddOperation{})
+	RegisterOperationType(common.OperationGet, GetOperation{})
+	RegisterOperationType(common.OperationMkdir, MkdirOperation{})
+	RegisterOperationType(common.OperationMove, MoveOperation{})
+	RegisterOperationType(common.OperationRemove, RemoveOperation{})
+	RegisterOperationType(common.OperationList, ListOperation{})
+	RegisterOperationType(common.OperationStat, StatOperation{})
+	RegisterOperationType(common.OperationRename, RenameOperation{})
+	RegisterOperationType(common.OperationAllocateChunks, AllocateChunksOperation{})
+	RegisterOperationType(common.OperationExpand, ExpandOperation{})
+	RegisterOperationType(common.OperationDegrade, DegradeOperation{})
+	RegisterOperationType(common.OperationFileTreeCheck, CheckFileTreeOperation{})
+	RegisterOperationType(common.OperationChunksCheck, CheckChunksOperation{})
+	RegisterOperationType(common.OperationDataNodesCheck, CheckDataNodesOperation{})
+	RegisterOperationType(OperationCreateNamespace, CreateNamespaceOperation{})
+	RegisterOperationType(OperationPinChunk, PinChunkOperation{})
+	RegisterOperationType(OperationUnpinChunk, UnpinChunkOperation{})
+	RegisterOperationType(OperationSetDataNodeTags, SetDataNodeTagsOperation{})
+	RegisterOperationType(OperationSetConstraint, SetConstraintOperation{})
+	RegisterOperationType(OperationBatchDegrade, BatchDegradeOperation{})
+	RegisterOperationType(OperationSetDirPolicy, SetDirPolicyOperation{})
+	RegisterOperationType(OperationSetReadFloor, SetReadFloorOperation{})
+	RegisterOperationType(OperationReleaseStaged, ReleaseStagedOperation{})
+	RegisterOperationType(OperationReconstruct, ReconstructOperation{})
+	RegisterOperationType(OperationEvictChunk, EvictChunkOperation{})
+	RegisterOperationType(OperationSetQuiescent, SetQuiescentOperation{})
+	RegisterOperationType(OperationForceRemoveDataNode, ForceRemoveDataNodeOperation{})
+	RegisterOperationType(OperationSetReplicaFactor, SetReplicaFactorOperation{})
+	RegisterOperationType(OperationSetQuota, SetQuotaOperation{})
+	RegisterOperationType(OperationSetMaxChildren, SetMaxChildrenOperation{})
+	RegisterOperationType(OperationChmod, ChmodOperation{})
+	RegisterOperationType(OperationChown, ChownOperation{})
+	RegisterOperationType(OperationBeginChunkReport, BeginChunkReportOperation{})
+	RegisterOperationType(OperationChunkReport, ChunkReportOperation{})
+	RegisterOperationType(OperationAbortChunkReport, AbortChunkReportOperation{})
+	RegisterOperationType(OperationGrantPrimary, GrantPrimaryOperation{})
+	RegisterOperationType(OperationSetMaxPerDomain, SetMaxPerDomainOperation{})
+	RegisterOperationType(OperationRestoreDeleted, RestoreDeletedOperation{})
+	RegisterOperationType(OperationClearQuarantine, ClearQuarantineOperation{})
+	RegisterOperationType(OperationReleaseReplica, ReleaseReplicaOperation{})
+	RegisterOperationType(OperationBatchAdd, BatchAddOperation{})
+	RegisterOperationType(OperationAllocateChunk, AllocateChunkOperation{})
+	RegisterOperationType(OperationSwap, SwapOperation{})
+	RegisterOperationType(OperationExpirePending, ExpirePendingOperation{})
+	RegisterOperationType(OperationRebuildChunkIndex, RebuildChunkIndexOperation{})
 }
 
 // Operation represents requests to make changes to metadata. If we want to modify the metadata,
@@ -65,6 +114,12 @@ type RegisterOperation struct {
 	FullCapacity int      `json:"full_capacity"`
 	UsedCapacity int      `json:"used_capacity"`
 	IsNeedExpand bool     `json:"is_need_expand"`
+	// IsFresh means the DataNode has been formatted, so it replaces the
+	// registered DataNode with the same id instead of being merged into it.
+	IsFresh bool `json:"is_fresh"`
+	// Time is the time(unix milliseconds) of the leader when it creates the
+	// operation.
+	Time int64 `json:"time"`
 }
 
 func (o RegisterOperation) Apply() (interface{}, error) {
@@ -88,7 +143,14 @@ func (o RegisterOperation) Apply() (interface{}, error) {
 		HeartbeatTime:    time.Now(),
 		FutureSendChunks: make(map[ChunkSendInfo]int),
 	}
-	AddDataNode(datanode)
+	if AddDataNode(datanode, o.IsFresh, time.UnixMilli(o.Time)) {
+		Logger.Infof("Datanode re-registers, datanode id: %s", o.DataNodeId)
+	}
+	// Chunk on a quarantined DataNode are not trusted until it is cleared.
+	if dataNode := GetDataNode(o.DataNodeId); dataNode != nil && dataNode.Status != Quarantined {
+		CancelStagedChunks(o.Address, o.DataNodeId, o.ChunkIds)
+		RecoverLostChunks(o.DataNodeId, o.ChunkIds)
+	}
 	Logger.Infof("[Id = %s] Connected, Status %v", o.DataNodeId, status)
 	return o.DataNodeId, nil
 }
@@ -104,19 +166,47 @@ type HeartbeatOperation struct {
 	FailInfos     []ChunkSendInfo `json:"fail_infos"`
 	InvalidChunks []string        `json:"invalid_chunks"`
 	IsReady       bool            `json:"is_ready"`
+	// AccessInfos is the read access of Chunk on the DataNode since the last
+	// heartbeat.
+	AccessInfos []ChunkAccessInfo `json:"access_infos"`
+	// SizeInfos is the size of Chunk stored on the DataNode.
+	SizeInfos []ChunkSizeInfo `json:"size_infos"`
+	// ReportTime is the time(unix milliseconds) of the DataNode when it sends
+	// the heartbeat. It is 0 if the DataNode does not report it.
+	ReportTime int64 `json:"report_time"`
+	// ReceiveTime is the time(unix milliseconds) of the master when it receives
+	// the heartbeat.
+	ReceiveTime int64 `json:"receive_time"`
 }
 
 func (o HeartbeatOperation) Apply() (interface{}, error) {
-	nextChunkInfos, ok := UpdateDataNode4Heartbeat(o)
+	// Chunk reported by a quiescent DataNode may be truncated or empty, so only
+	// its liveness, load and sending results are accepted.
+	if IsDataNodeQuiescent(o.DataNodeId) {
+		o.ChunkIds = nil
+		o.InvalidChunks = nil
+		o.SizeInfos = nil
+	}
+	// Retried sending keeps its target pending in Chunk, so it is not handled
+	// as failure.
+	o.FailInfos = RetryFailedSends(o.DataNodeId, o.FailInfos)
+	nextChunkInfos, abandonedInfos, ok := UpdateDataNode4Heartbeat(o)
 	if !ok {
 		return nil, fmt.Errorf("datanode %s not exist", o.DataNodeId)
 	}
+	// Abandoned sending is handled as failure in Chunk.
+	o.FailInfos = append(o.FailInfos, abandonedInfos...)
 	UpdateChunk4Heartbeat(o)
+	UpdateChunkAccess(o.AccessInfos)
+	UpdateChunkSize(o.DataNodeId, o.SizeInfos)
+	RecoverLostChunks(o.DataNodeId, o.ChunkIds)
+	RestorePinnedReplicas(o.DataNodeId, o.InvalidChunks)
 	return nextChunkInfos, nil
 }
 
 type AddOperation struct {
 	Id           string                 `json:"id"`
+	Namespace    string                 `json:"namespace"`
 	Path         string                 `json:"path"`
 	FileName     string                 `json:"file_name"`
 	Size         int64                  `json:"size"`
@@ -126,31 +216,128 @@ type AddOperation struct {
 	Infos        []util.ChunkTaskResult `json:"infos"`
 	FailChunkIds []string               `json:"fail_chunk_ids"`
 	Stage        int                    `json:"stage"`
+	// Constraint is the expression of PlacementConstraint of the file. It is
+	// only used in CheckArgs stage.
+	Constraint string `json:"constraint"`
+	// ReplicaFactor and StoragePolicy of the file. The default of the nearest
+	// ancestor directory will be used if they are not given. They are only used
+	// in CheckArgs stage.
+	ReplicaFactor int    `json:"replica_factor"`
+	StoragePolicy string `json:"storage_policy"`
+	// Overwrite means an existing file with the same name will be replaced. It
+	// is only used in CheckArgs stage.
+	Overwrite bool `json:"overwrite"`
+	// MinAckNum is the number of replicas which must be stored before a Chunk
+	// of the file is committed. 0 means all replicas. It is only used in
+	// GetDataNodes stage.
+	MinAckNum int `json:"min_ack_num"`
+	// Placement is the ordered DataNode id given by client for each Chunk of
+	// the file. It overrides the allocator for these Chunk, and invalid DataNode
+	// in it will be replaced by allocated ones. It is only used in GetDataNodes
+	// stage.
+	Placement [][]string `json:"placement"`
+	// CodingScheme of all Chunk of the file. Erasure coded Chunk get a DataNode
+	// for each fragment instead of each replica, and MinAckNum, Placement and
+	// the PlacementConstraint are ignored. It is only used in GetDataNodes stage.
+	CodingScheme CodingScheme `json:"coding_scheme"`
+	// ChunkIndex is the index of the first Chunk to get DataNode for, which is
+	// not 0 when Chunk of a lazy file are written one by one, see
+	// AllocateNextChunk. It is only used in GetDataNodes stage.
+	ChunkIndex int `json:"chunk_index"`
+	// Owner and Group of the file, which are taken from the requester. They
+	// are only used in CheckArgs stage.
+	Owner string `json:"owner"`
+	Group string `json:"group"`
 }
 
 func (o AddOperation) Apply() (interface{}, error) {
 	switch o.Stage {
 	case common.CheckArgs:
-		fileNode, err := AddFileNode(o.Path, o.FileName, o.Size, common.IsFile4AddFile)
+		constraint, err := ParsePlacementConstraint(o.Constraint)
 		if err != nil {
 			return nil, err
 		}
+		if err = checkPolicy(o.ReplicaFactor, o.StoragePolicy); err != nil {
+			return nil, err
+		}
+		if err = checkOwner(o.Owner, o.Group); err != nil {
+			return nil, err
+		}
+		var fileNode *FileNode
+		if o.Overwrite {
+			var oldChunks []string
+			fileNode, oldChunks, err = CreateOrReplaceFileNodeIn(o.Namespace, o.Path, o.FileName, o.Size)
+			if err == nil && oldChunks != nil {
+				Logger.Infof("Replace file, path: %s, name: %s, old chunk num: %d", o.Path, o.FileName,
+					len(oldChunks))
+			}
+		} else {
+			fileNode, err = AddFileNodeIn(o.Namespace, o.Path, o.FileName, o.Size, common.IsFile4AddFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !constraint.IsEmpty() {
+			applyFileNodeConstraint(fileNode, constraint)
+		}
+		if o.ReplicaFactor != 0 {
+			applyFileNodeReplicaFactor(fileNode, o.ReplicaFactor)
+		}
+		if o.StoragePolicy != "" {
+			fileNode.StoragePolicy = o.StoragePolicy
+		}
+		fileNode.Owner, fileNode.Group = o.Owner, o.Group
 		rep := &pb.CheckArgs4AddReply{
 			FileNodeId: fileNode.Id,
 			ChunkNum:   int32(len(fileNode.Chunks)),
 		}
 		return rep, nil
 	case common.GetDataNodes:
-		dataNodes := BatchAllocateDataNodes(int(o.ChunkNum))
+		if err := checkChunkRange(o.FileNodeId, o.ChunkIndex, int(o.ChunkNum)); err != nil {
+			return nil, err
+		}
+		if o.CodingScheme.IsErasureCoded() {
+			return allocateECChunks(o.FileNodeId, o.ChunkIndex, int(o.ChunkNum), o.CodingScheme)
+		}
+		// The file may need a different number of replicas than the default.
+		replicaNum := getChunkReplicaFactor(o.FileNodeId)
+		minAckNum, err := getMinAckNum(o.MinAckNum, replicaNum)
+		if err != nil {
+			return nil, err
+		}
+		// Replicas acknowledged first may be in the same domain, so a write
+		// with the write quorum placement waits for all replicas.
+		writeQuorumDomains := viper.GetInt(MasterWriteQuorumDomains)
+		if writeQuorumDomains > 0 {
+			minAckNum = replicaNum
+		}
+		constraint := getFileNodeConstraint(o.FileNodeId)
+		dataNodes := BatchAllocateDataNodes(int(o.ChunkNum), replicaNum, constraint)
+		if len(dataNodes) != 0 && len(dataNodes[0]) == 0 {
+			return nil, fmt.Errorf("no datanode satisfies the placement constraint, constraint: %s", constraint)
+		}
+		if len(o.Placement) != 0 {
+			dataNodes = MergeClientPlacement(o.Placement, dataNodes, constraint, replicaNum)
+		}
+		dataNodes = limitReplicasPerDomain(dataNodes, getFileNodeMaxReplicasPerDomain(o.FileNodeId))
+		if writeQuorumDomains > 0 {
+			if dataNodes, err = spreadWriteReplicas(dataNodes, constraint, writeQuorumDomains, replicaNum); err != nil {
+				return nil, err
+			}
+		}
+		if len(dataNodes) != 0 && len(dataNodes[0]) < replicaNum {
+			Logger.Warnf("Replica target can not be met, file node id: %s, datanode num: %d, replica num: %d",
+				o.FileNodeId, len(dataNodes[0]), replicaNum)
+		}
 		chunks := make([]*Chunk, o.ChunkNum)
 		dataNodeIds := make([]*pb.GetDataNodes4AddReply_Array, int(o.ChunkNum))
 		dataNodeAdds := make([]*pb.GetDataNodes4AddReply_Array, int(o.ChunkNum))
 		for i := 0; i < int(o.ChunkNum); i++ {
-			chunkId := util.CombineString(o.FileNodeId, common.ChunkIdDelimiter, strconv.Itoa(i))
+			chunkId := util.CombineString(o.FileNodeId, common.ChunkIdDelimiter, strconv.Itoa(o.ChunkIndex+i))
 			var (
 				dataNodeIdSet = set.NewSet()
-				dnIds         = make([]string, len(dataNodes[0]))
-				dnAdds        = make([]string, len(dataNodes[0]))
+				dnIds         = make([]string, len(dataNodes[i]))
+				dnAdds        = make([]string, len(dataNodes[i]))
 			)
 			for j, node := range dataNodes[i] {
 				dataNodeIdSet.Add(node.Id)
@@ -161,6 +348,7 @@ func (o AddOperation) Apply() (interface{}, error) {
 				Id:               chunkId,
 				dataNodes:        set.NewSet(),
 				pendingDataNodes: dataNodeIdSet,
+				minAckNum:        minAckNum,
 			}
 			Logger.Debugf("Chunk index: %v, dnIds: %v, dnAdds: %v", i, dnIds, dnAdds)
 			chunks[i] = chunk
@@ -179,7 +367,7 @@ func (o AddOperation) Apply() (interface{}, error) {
 		return rep, nil
 	case common.UnlockDic:
 		if o.FailChunkIds != nil {
-			_, _ = EraseFileNode(o.Path)
+			_, _ = EraseFileNodeIn(o.Namespace, o.Path)
 			BatchClearPendingDataNodes(o.FailChunkIds)
 		}
 		BatchUpdatePendingDataNodes(o.Infos)
@@ -193,21 +381,28 @@ func (o AddOperation) Apply() (interface{}, error) {
 
 type GetOperation struct {
 	Id         string `json:"id"`
+	Namespace  string `json:"namespace"`
 	Path       string `json:"path"`
 	FileNodeId string `json:"file_node_id"`
 	ChunkIndex int32  `json:"chunk_index"`
 	ChunkId    string `json:"chunk_id"`
 	Stage      int    `json:"stage"`
+	// ClientAddress and ClientTags are the ClientLocality hint of the client.
+	ClientAddress string            `json:"client_address"`
+	ClientTags    map[string]string `json:"client_tags"`
 }
 
 func (o GetOperation) Apply() (interface{}, error) {
 	switch o.Stage {
 	case common.CheckArgs:
-		return CheckAndGetFileNode(o.Path)
+		return CheckAndGetFileNodeIn(o.Namespace, o.Path)
 	case common.GetDataNodes:
 		chunkId := util.CombineString(o.FileNodeId, common.ChunkIdDelimiter, strconv.FormatInt(int64(o.ChunkIndex), 10))
 		chunk := GetChunk(chunkId)
-		dataNodeIds, dataNodeAddrs := GetSortedDataNodeIds(chunk.dataNodes)
+		dataNodeIds, dataNodeAddrs := GetReadReplicas(chunk.dataNodes, ClientLocality{
+			Address: o.ClientAddress,
+			Tags:    o.ClientTags,
+		})
 		rep := &pb.GetDataNodes4GetReply{
 			DataNodeIds:   dataNodeIds,
 			DataNodeAddrs: dataNodeAddrs,
@@ -220,61 +415,377 @@ func (o GetOperation) Apply() (interface{}, error) {
 }
 
 type MkdirOperation struct {
-	Id       string `json:"id"`
-	Path     string `json:"path"`
-	FileName string `json:"file_name"`
+	Id        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	FileName  string `json:"file_name"`
+	Owner     string `json:"owner"`
+	Group     string `json:"group"`
 }
 
 func (o MkdirOperation) Apply() (interface{}, error) {
-	return AddFileNode(o.Path, o.FileName, common.DirSize, false)
+	if err := checkOwner(o.Owner, o.Group); err != nil {
+		return nil, err
+	}
+	fileNode, err := AddFileNodeIn(o.Namespace, o.Path, o.FileName, common.DirSize, false)
+	if err != nil {
+		return nil, err
+	}
+	fileNode.Owner, fileNode.Group = o.Owner, o.Group
+	return fileNode, nil
+}
+
+type BatchAddOperation struct {
+	Id        string     `json:"id"`
+	Namespace string     `json:"namespace"`
+	Entries   []AddEntry `json:"entries"`
+	Owner     string     `json:"owner"`
+	Group     string     `json:"group"`
+}
+
+func (o BatchAddOperation) Apply() (interface{}, error) {
+	if err := checkOwner(o.Owner, o.Group); err != nil {
+		return nil, err
+	}
+	results, err := BatchAddFileNodesIn(o.Namespace, o.Entries)
+	if err != nil {
+		return nil, err
+	}
+	// FileNode in results are copies, so they can be read after applying.
+	for i := range results {
+		if results[i].FileNode != nil {
+			results[i].FileNode.Owner, results[i].FileNode.Group = o.Owner, o.Group
+			results[i].FileNode = results[i].FileNode.copyMeta()
+		}
+	}
+	return results, nil
+}
+
+type AllocateChunkOperation struct {
+	Id        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+}
+
+func (o AllocateChunkOperation) Apply() (interface{}, error) {
+	return AllocateNextChunkIn(o.Namespace, o.Path)
 }
 
 type MoveOperation struct {
 	Id         string `json:"id"`
+	Namespace  string `json:"namespace"`
 	SourcePath string `json:"source_path"`
 	TargetPath string `json:"target_path"`
 }
 
 func (o MoveOperation) Apply() (interface{}, error) {
-	return MoveFileNode(o.SourcePath, o.TargetPath)
+	return MoveFileNodeIn(o.Namespace, o.SourcePath, o.TargetPath)
+}
+
+// SwapOperation exchanges two FileNode. Time is the time(unix milliseconds) of
+// the leader when it creates the operation, which is recorded in RenameHistory.
+type SwapOperation struct {
+	Id        string `json:"id"`
+	Namespace string `json:"namespace"`
+	PathA     string `json:"path_a"`
+	PathB     string `json:"path_b"`
+	Time      int64  `json:"time"`
+}
+
+func (o SwapOperation) Apply() (interface{}, error) {
+	return nil, SwapFileNodesIn(o.Namespace, o.PathA, o.PathB, time.UnixMilli(o.Time))
 }
 
 type RemoveOperation struct {
-	Id   string `json:"id"`
-	Path string `json:"path"`
+	Id        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	// Immediate means the FileNode skips the trash and its Chunk are reclaimed
+	// at once.
+	Immediate bool `json:"immediate"`
 }
 
 func (o RemoveOperation) Apply() (interface{}, error) {
-	return RemoveFileNode(o.Path)
+	if o.Immediate {
+		fileNode, _, err := RemoveFileNodeImmediatelyIn(o.Namespace, o.Path)
+		return fileNode, err
+	}
+	return RemoveFileNodeIn(o.Namespace, o.Path)
 }
 
 type ListOperation struct {
-	Id   string `json:"id"`
-	Path string `json:"path"`
+	Id             string `json:"id"`
+	Namespace      string `json:"namespace"`
+	Path           string `json:"path"`
+	IncludeDeleted bool   `json:"include_deleted"`
 }
 
 func (o ListOperation) Apply() (interface{}, error) {
-	fileNodes, err := ListFileNode(o.Path)
+	fileNodes, err := ListFileNodeIn(o.Namespace, o.Path, o.IncludeDeleted)
 	return fileNode2FileInfo(fileNodes), err
 }
 
 type StatOperation struct {
-	Id   string `json:"id"`
-	Path string `json:"path"`
+	Id        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
 }
 
 func (o StatOperation) Apply() (interface{}, error) {
-	return StatFileNode(o.Path)
+	return StatFileNodeIn(o.Namespace, o.Path)
 }
 
+// RestoreDeletedOperation restores the deleted FileNode with FileNodeId under
+// the directory of Path. The id tells apart deleted FileNode with the same name.
+type RestoreDeletedOperation struct {
+	Id         string `json:"id"`
+	Namespace  string `json:"namespace"`
+	Path       string `json:"path"`
+	FileNodeId string `json:"file_node_id"`
+}
+
+func (o RestoreDeletedOperation) Apply() (interface{}, error) {
+	return RestoreDeletedFileNodeIn(o.Namespace, o.Path, o.FileNodeId)
+}
+
+// RenameOperation renames the FileNode at Path to NewName. Time is the
+// time(unix milliseconds) of the leader when it creates the operation, which is
+// recorded in RenameHistory.
 type RenameOperation struct {
-	Id      string `json:"id"`
-	Path    string `json:"path"`
-	NewName string `json:"new_name"`
+	Id        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	NewName   string `json:"new_name"`
+	Time      int64  `json:"time"`
 }
 
 func (o RenameOperation) Apply() (interface{}, error) {
-	return RenameFileNode(o.Path, o.NewName)
+	return RenameFileNodeIn(o.Namespace, o.Path, o.NewName, time.UnixMilli(o.Time))
+}
+
+type CreateNamespaceOperation struct {
+	Id        string `json:"id"`
+	Namespace string `json:"namespace"`
+}
+
+func (o CreateNamespaceOperation) Apply() (interface{}, error) {
+	return CreateNamespace(o.Namespace)
+}
+
+type PinChunkOperation struct {
+	Id         string `json:"id"`
+	ChunkId    string `json:"chunk_id"`
+	DataNodeId string `json:"data_node_id"`
+}
+
+func (o PinChunkOperation) Apply() (interface{}, error) {
+	return nil, PinChunk(o.ChunkId, o.DataNodeId)
+}
+
+// EvictChunkOperation moves the replica of a Chunk off a DataNode. It returns
+// id of the DataNode which will receive the replica.
+type EvictChunkOperation struct {
+	Id         string `json:"id"`
+	ChunkId    string `json:"chunk_id"`
+	DataNodeId string `json:"data_node_id"`
+}
+
+func (o EvictChunkOperation) Apply() (interface{}, error) {
+	return EvictChunkFromNode(o.ChunkId, o.DataNodeId)
+}
+
+type UnpinChunkOperation struct {
+	Id         string `json:"id"`
+	ChunkId    string `json:"chunk_id"`
+	DataNodeId string `json:"data_node_id"`
+}
+
+func (o UnpinChunkOperation) Apply() (interface{}, error) {
+	return nil, UnpinChunk(o.ChunkId, o.DataNodeId)
+}
+
+type SetDataNodeTagsOperation struct {
+	Id         string            `json:"id"`
+	DataNodeId string            `json:"data_node_id"`
+	Tags       map[string]string `json:"tags"`
+}
+
+func (o SetDataNodeTagsOperation) Apply() (interface{}, error) {
+	return nil, SetDataNodeTags(o.DataNodeId, o.Tags)
+}
+
+type SetQuiescentOperation struct {
+	Id         string `json:"id"`
+	DataNodeId string `json:"data_node_id"`
+	Quiescent  bool   `json:"quiescent"`
+}
+
+func (o SetQuiescentOperation) Apply() (interface{}, error) {
+	return nil, SetDataNodeQuiescent(o.DataNodeId, o.Quiescent)
+}
+
+type SetReplicaFactorOperation struct {
+	Id            string `json:"id"`
+	Namespace     string `json:"namespace"`
+	Path          string `json:"path"`
+	ReplicaFactor int    `json:"replica_factor"`
+	// Time is the time(unix milliseconds) of the leader when it creates the
+	// operation.
+	Time int64 `json:"time"`
+}
+
+func (o SetReplicaFactorOperation) Apply() (interface{}, error) {
+	return SetFileNodeReplicaFactorIn(o.Namespace, o.Path, o.ReplicaFactor, time.UnixMilli(o.Time))
+}
+
+type SetConstraintOperation struct {
+	Id         string `json:"id"`
+	Namespace  string `json:"namespace"`
+	Path       string `json:"path"`
+	Constraint string `json:"constraint"`
+}
+
+func (o SetConstraintOperation) Apply() (interface{}, error) {
+	return SetFileNodeConstraintIn(o.Namespace, o.Path, o.Constraint)
+}
+
+type SetDirPolicyOperation struct {
+	Id            string `json:"id"`
+	Namespace     string `json:"namespace"`
+	Path          string `json:"path"`
+	ReplicaFactor int    `json:"replica_factor"`
+	StoragePolicy string `json:"storage_policy"`
+}
+
+func (o SetDirPolicyOperation) Apply() (interface{}, error) {
+	return SetDirPolicyIn(o.Namespace, o.Path, o.ReplicaFactor, o.StoragePolicy)
+}
+
+type SetReadFloorOperation struct {
+	Id              string `json:"id"`
+	Namespace       string `json:"namespace"`
+	Path            string `json:"path"`
+	MinReadReplicas int    `json:"min_read_replicas"`
+}
+
+func (o SetReadFloorOperation) Apply() (interface{}, error) {
+	return SetFileNodeMinReadReplicasIn(o.Namespace, o.Path, o.MinReadReplicas)
+}
+
+type SetQuotaOperation struct {
+	Id        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	Quota     int64  `json:"quota"`
+	SoftQuota int64  `json:"soft_quota"`
+}
+
+func (o SetQuotaOperation) Apply() (interface{}, error) {
+	return SetDirQuotaIn(o.Namespace, o.Path, o.Quota, o.SoftQuota)
+}
+
+type SetMaxChildrenOperation struct {
+	Id          string `json:"id"`
+	Namespace   string `json:"namespace"`
+	Path        string `json:"path"`
+	MaxChildren int    `json:"max_children"`
+}
+
+func (o SetMaxChildrenOperation) Apply() (interface{}, error) {
+	return SetDirMaxChildrenIn(o.Namespace, o.Path, o.MaxChildren)
+}
+
+type SetMaxPerDomainOperation struct {
+	Id                   string `json:"id"`
+	Namespace            string `json:"namespace"`
+	Path                 string `json:"path"`
+	MaxReplicasPerDomain int    `json:"max_replicas_per_domain"`
+}
+
+func (o SetMaxPerDomainOperation) Apply() (interface{}, error) {
+	return SetFileNodeMaxReplicasPerDomainIn(o.Namespace, o.Path, o.MaxReplicasPerDomain)
+}
+
+type ChmodOperation struct {
+	Id        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	Mode      uint32 `json:"mode"`
+}
+
+func (o ChmodOperation) Apply() (interface{}, error) {
+	return ChmodFileNodeIn(o.Namespace, o.Path, o.Mode)
+}
+
+type ChownOperation struct {
+	Id        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	Owner     string `json:"owner"`
+	Group     string `json:"group"`
+}
+
+func (o ChownOperation) Apply() (interface{}, error) {
+	return ChownFileNodeIn(o.Namespace, o.Path, o.Owner, o.Group)
+}
+
+// BeginChunkReportOperation is applied when a DataNode begins to stream its
+// full chunk report.
+type BeginChunkReportOperation struct {
+	Id         string `json:"id"`
+	DataNodeId string `json:"data_node_id"`
+}
+
+func (o BeginChunkReportOperation) Apply() (interface{}, error) {
+	return nil, BeginChunkReport(o.DataNodeId)
+}
+
+// ChunkReportOperation carries a bounded part of the full chunk report of a
+// DataNode. A partial one only adds ChunkIds to the report in progress, and
+// the last one reconciles the whole report and returns id of Chunk which do
+// not exist in master.
+type ChunkReportOperation struct {
+	Id         string   `json:"id"`
+	DataNodeId string   `json:"data_node_id"`
+	ChunkIds   []string `json:"chunk_ids"`
+	IsPartial  bool     `json:"is_partial"`
+	// Time is the time(unix milliseconds) of the leader when it creates the
+	// operation.
+	Time int64 `json:"time"`
+}
+
+func (o ChunkReportOperation) Apply() (interface{}, error) {
+	if o.IsPartial {
+		return nil, AddChunkReport(o.DataNodeId, o.ChunkIds)
+	}
+	added, _, unknown, err := FinishChunkReport(o.DataNodeId, o.ChunkIds, time.UnixMilli(o.Time))
+	if err != nil {
+		return nil, err
+	}
+	RecoverLostChunks(o.DataNodeId, added)
+	return unknown, nil
+}
+
+// AbortChunkReportOperation is applied when the chunk report stream of a
+// DataNode fails, so the report in progress is dropped.
+type AbortChunkReportOperation struct {
+	Id         string `json:"id"`
+	DataNodeId string `json:"data_node_id"`
+}
+
+func (o AbortChunkReportOperation) Apply() (interface{}, error) {
+	return nil, AbortChunkReport(o.DataNodeId)
+}
+
+// GrantPrimaryOperation grants the lease of a Chunk to its primary. It returns
+// the *PrimaryLease.
+type GrantPrimaryOperation struct {
+	Id      string `json:"id"`
+	ChunkId string `json:"chunk_id"`
+}
+
+func (o GrantPrimaryOperation) Apply() (interface{}, error) {
+	return GrantPrimary(o.ChunkId)
 }
 
 // fileNode2FileInfo converts []*FileNode to []*pb.FileInfo.
@@ -293,10 +804,110 @@ type DegradeOperation struct {
 	Id         string `json:"id"`
 	DataNodeId string `json:"dataNodeId"`
 	Stage      int    `json:"stage"`
+	// Time is the time(unix milliseconds) of the leader when it creates the
+	// operation.
+	Time int64 `json:"time"`
 }
 
 func (o DegradeOperation) Apply() (interface{}, error) {
-	DegradeDataNode(o.DataNodeId, o.Stage)
+	DegradeDataNode(o.DataNodeId, o.Stage, time.UnixMilli(o.Time))
+	return nil, nil
+}
+
+// BatchDegradeOperation degrades a batch of DataNode to the same stage in one
+// apply, so that a mass failure will not flood Raft with DegradeOperation.
+type BatchDegradeOperation struct {
+	Id          string   `json:"id"`
+	DataNodeIds []string `json:"data_node_ids"`
+	Stage       int      `json:"stage"`
+	// Time is the time(unix milliseconds) of the leader when it creates the
+	// operation.
+	Time int64 `json:"time"`
+}
+
+// Apply returns the number of DataNode degraded. DataNode which has been
+// removed since the operation is created are not counted.
+func (o BatchDegradeOperation) Apply() (interface{}, error) {
+	degraded := 0
+	for _, dataNodeId := range o.DataNodeIds {
+		if DegradeDataNode(dataNodeId, o.Stage, time.UnixMilli(o.Time)) {
+			degraded++
+		}
+	}
+	return degraded, nil
+}
+
+// ForceRemoveDataNodeOperation removes a DataNode as dead immediately.
+type ForceRemoveDataNodeOperation struct {
+	Id         string `json:"id"`
+	DataNodeId string `json:"data_node_id"`
+	// Time is the time(unix milliseconds) of the leader when it creates the
+	// operation.
+	Time int64 `json:"time"`
+}
+
+func (o ForceRemoveDataNodeOperation) Apply() (interface{}, error) {
+	return nil, ForceRemoveDataNode(o.DataNodeId, time.UnixMilli(o.Time))
+}
+
+// ClearQuarantineOperation lets a quarantined DataNode rejoin.
+type ClearQuarantineOperation struct {
+	Id         string `json:"id"`
+	DataNodeId string `json:"data_node_id"`
+}
+
+func (o ClearQuarantineOperation) Apply() (interface{}, error) {
+	return nil, ClearDataNodeQuarantine(o.DataNodeId)
+}
+
+// ReleaseReplicaOperation releases a quarantined replica of a Chunk so that it
+// is deleted.
+type ReleaseReplicaOperation struct {
+	Id         string `json:"id"`
+	ChunkId    string `json:"chunk_id"`
+	DataNodeId string `json:"data_node_id"`
+}
+
+func (o ReleaseReplicaOperation) Apply() (interface{}, error) {
+	return nil, ReleaseQuarantinedReplica(o.ChunkId, o.DataNodeId)
+}
+
+// RebuildChunkIndexOperation repairs the reverse index from Chunk to file on all
+// masters, see RebuildChunkIndex.
+type RebuildChunkIndexOperation struct {
+	Id string `json:"id"`
+}
+
+func (o RebuildChunkIndexOperation) Apply() (interface{}, error) {
+	return RebuildChunkIndex(), nil
+}
+
+// ReleaseStagedOperation puts staged Chunk of dead DataNode whose release time
+// has come to pendingChunkQueue. Time is the time(unix milliseconds) of the
+// leader when it creates the operation, so that all masters release the same
+// Chunk.
+type ReleaseStagedOperation struct {
+	Id   string `json:"id"`
+	Time int64  `json:"time"`
+}
+
+func (o ReleaseStagedOperation) Apply() (interface{}, error) {
+	return ReleaseStagedChunks(time.UnixMilli(o.Time)), nil
+}
+
+// ReconstructOperation applies the plan of reconstructing a batch of lost
+// fragments of erasure coded Chunk.
+type ReconstructOperation struct {
+	Id       string            `json:"id"`
+	Tasks    []ReconstructTask `json:"tasks"`
+	BatchLen int               `json:"batch_len"`
+	// Unsatisfied includes fragments in the batch which can not be reconstructed
+	// now, they will be put back to lostFragmentQueue.
+	Unsatisfied []Fragment `json:"unsatisfied"`
+}
+
+func (o ReconstructOperation) Apply() (interface{}, error) {
+	ApplyReconstructPlan(o.Tasks, o.BatchLen, o.Unsatisfied)
 	return nil, nil
 }
 
@@ -306,11 +917,21 @@ type AllocateChunksOperation struct {
 	ReceiverPlan []int    `json:"receiver_plan"`
 	ChunkIds     []string `json:"chunk_ids"`
 	DataNodeIds  []string `json:"data_node_ids"`
-	BatchLen     int      `json:"batch_len"`
+	// BatchChunkIds is the batch of Chunk taken from pendingChunkQueue when
+	// planning, they will be removed from pendingChunkQueue.
+	BatchChunkIds []string `json:"batch_chunk_ids"`
+	BatchLen      int      `json:"batch_len"`
+	// UnsatisfiedChunkIds includes Chunk in the batch which can not be placed
+	// now, they will be put back to pendingChunkQueue.
+	UnsatisfiedChunkIds []string `json:"unsatisfied_chunk_ids"`
+	// LostChunkIds includes Chunk in the batch which is not stored by any alive
+	// DataNode, they will be marked as lost.
+	LostChunkIds []string `json:"lost_chunk_ids"`
 }
 
 func (o AllocateChunksOperation) Apply() (interface{}, error) {
-	ApplyAllocatePlan(o.SenderPlan, o.ReceiverPlan, o.ChunkIds, o.DataNodeIds, o.BatchLen)
+	ApplyAllocatePlan(o.SenderPlan, o.ReceiverPlan, o.ChunkIds, o.DataNodeIds, o.BatchChunkIds, o.BatchLen,
+		o.UnsatisfiedChunkIds, o.LostChunkIds)
 	return nil, nil
 }
 
@@ -353,31 +974,40 @@ type CheckFileTreeOperation struct {
 func (t CheckFileTreeOperation) Apply() (interface{}, error) {
 	Logger.Infof("Start to check direcotry tree.")
 	queue := util.NewQueue[*FileNode]()
-	queue.Push(root)
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	for _, nsRoot := range allNamespaceRoots() {
+		queue.Push(nsRoot)
+	}
 	for queue.Len() != 0 {
 		cur := queue.Pop()
 		if cur.IsDel && time.Now().Sub(*cur.DelTime).Hours() >= DayHour {
-			fileNodeIdSet.Remove(cur.Id)
+			unindexFileNode(cur.Id)
 			if cur.ParentNode != nil {
 				Logger.Debugf("Delete FileNode %s", cur.FileName)
 				delete(cur.ParentNode.ChildNodes, cur.FileName)
+				updateSubtreeSize(cur.ParentNode, -cur.subtreeSize)
 			}
 		}
 		if cur.ChildNodes != nil && len(cur.ChildNodes) != 0 {
 			for _, node := range cur.ChildNodes {
 				if !fileNodeIdSet.Contains(cur.ParentNode.Id) {
-					fileNodeIdSet.Remove(node.Id)
+					unindexFileNode(node.Id)
 				}
 				queue.Push(node)
 			}
 		}
 	}
+	updateNamespaceStatsMonitor()
 	Logger.Infof("Check done.")
 	return nil, nil
 }
 
 type CheckChunksOperation struct {
 	Id string `json:"id"`
+	// Time is the time(unix milliseconds) of the leader when it creates the
+	// operation.
+	Time int64 `json:"time"`
 }
 
 func (d CheckChunksOperation) Apply() (interface{}, error) {
@@ -385,31 +1015,39 @@ func (d CheckChunksOperation) Apply() (interface{}, error) {
 	updateMapLock.Lock()
 	for _, node := range dataNodeMap {
 		for _, chunkId := range node.Chunks.ToSlice() {
-			fileNodeId := strings.Split(chunkId.(string), common.ChunkIdDelimiter)[0]
-			if !fileNodeIdSet.Contains(fileNodeId) {
+			if _, ok := getChunkFileNodeId(chunkId.(string)); !ok {
 				Logger.Debugf("Find rubbish chunk %s in dataNode %s", chunkId, node.Id)
-				node.FutureSendChunks[ChunkSendInfo{
-					ChunkId:    chunkId.(string),
-					DataNodeId: "",
-					SendType:   common.DeleteSendType,
-				}] = common.WaitToInform
-				node.Chunks.Remove(chunkId)
+				node.scheduleChunkDelete(chunkId.(string))
 			}
 		}
 	}
 	updateMapLock.Unlock()
 	updateChunksLock.Lock()
 	for id := range chunksMap {
-		fileNodeId := strings.Split(id, common.ChunkIdDelimiter)[0]
-		if !fileNodeIdSet.Contains(fileNodeId) {
+		if _, ok := getChunkFileNodeId(id); !ok {
 			delete(chunksMap, id)
+			lostChunkIds.Remove(id)
 		}
 	}
+	lostChunkCountMonitor.Set(float64(lostChunkIds.Cardinality()))
 	updateChunksLock.Unlock()
+	ReconcileChunkLocations(time.UnixMilli(d.Time))
+	AuditChunkSpread()
 	Logger.Infof("Clean up done.")
 	return nil, nil
 }
 
+// ExpirePendingOperation removes the stale pending replicas found by the
+// leader. Replicas is the id of stale DataNode of each Chunk.
+type ExpirePendingOperation struct {
+	Id       string              `json:"id"`
+	Replicas map[string][]string `json:"replicas"`
+}
+
+func (o ExpirePendingOperation) Apply() (interface{}, error) {
+	return ExpirePendingDataNodes(o.Replicas), nil
+}
+
 type CheckDataNodesOperation struct {
 	Id string `json:"id"`
 }
@@ -423,8 +1061,14 @@ func (o CheckDataNodesOperation) Apply() (interface{}, error) {
 			num++
 		}
 	}
+	capacity := calClusterCapacity()
 	updateMapLock.RUnlock()
 	StorableNum.Store(num)
+	clusterFreeCapacityMonitor.Set(float64(capacity.FreeCapacity))
+	if isNeed2ExpandByBytes(capacity) {
+		Logger.Warnf("Free space of cluster is running low, free: %d, full: %d, more DataNode are needed.",
+			capacity.FreeCapacity, capacity.FullCapacity)
+	}
 	Logger.Debugf("Check done.")
 	return nil, nil
 }
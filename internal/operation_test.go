@@ -1,9 +1,13 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"github.com/agiledragon/gomonkey"
+	set "github.com/deckarep/golang-set"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
 	"io"
 	"os"
 	"sync"
@@ -101,7 +105,7 @@ func TestAddOperation_Apply(t *testing.T) {
 				},
 			},
 			Setup: func(t *testing.T) {
-				batchAllocateDataNodes := gomonkey.ApplyFunc(BatchAllocateDataNodes, func(_ int) [][]*DataNode {
+				batchAllocateDataNodes := gomonkey.ApplyFunc(BatchAllocateDataNodes, func(_ int, _ PlacementConstraint) [][]*DataNode {
 					return [][]*DataNode{
 						{
 							&DataNode{
@@ -176,3 +180,98 @@ func TestAddOperation_Apply(t *testing.T) {
 		})
 	}
 }
+
+func TestAddOperation_Placement(t *testing.T) {
+	t.Cleanup(func() {
+		dataNodeMap = make(map[string]*DataNode)
+		chunksMap = make(map[string]*Chunk)
+	})
+	for i := 1; i <= 4; i++ {
+		id := fmt.Sprintf("dataNode%d", i)
+		dataNodeMap[id] = &DataNode{
+			Id:           id,
+			Address:      fmt.Sprintf("address%d", i),
+			Status:       common.Alive,
+			Chunks:       set.NewSet(),
+			FullCapacity: 1 << 40,
+		}
+	}
+	// dataNode4 is full. It also stores the most Chunk so that the allocator
+	// will never choose it.
+	dataNodeMap["dataNode4"].UsedCapacity = 1 << 40
+	dataNodeMap["dataNode4"].Chunks = set.NewSet("chunk1", "chunk2")
+	indexTestFile(t, "file1", 2)
+	o := AddOperation{
+		FileNodeId: "file1",
+		ChunkNum:   2,
+		Stage:      common.GetDataNodes,
+		Placement: [][]string{
+			{"dataNode3", "dataNode1", "dataNode2"},
+			{"dataNode4", "notExist", "dataNode2", "dataNode2"},
+		},
+	}
+	rep, err := o.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	dataNodeIds := rep.(*pb.GetDataNodes4AddReply).DataNodeIds
+
+	assert.Equal(t, []string{"dataNode3", "dataNode1", "dataNode2"}, dataNodeIds[0].Items,
+		"Explicit placement should be used in order.")
+	pendingDataNodes := chunksMap["file1_0"].pendingDataNodes
+	assert.True(t, pendingDataNodes.Equal(set.NewSet("dataNode3", "dataNode1", "dataNode2")),
+		"Unexpected pendingDataNodes: %s", pendingDataNodes)
+
+	// Invalid datanodes fall back to normal allocation.
+	items := dataNodeIds[1].Items
+	assert.Equal(t, 3, len(items), "Unexpected number of replicas.")
+	assert.Equal(t, "dataNode2", items[0], "Valid datanode given by client should be used first.")
+	assert.NotContains(t, items, "dataNode4", "Full datanode should not be used.")
+	assert.Equal(t, 3, chunksMap["file1_1"].pendingDataNodes.Cardinality(), "Unexpected pendingDataNodes.")
+
+	// Client gives the placement in the metadata of its request.
+	handler := newLeaderHandler(t)
+	indexTestFile(t, "file2", 2)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		chunkPlacementMetadataKey, "dataNode2,dataNode3", chunkPlacementMetadataKey, ""))
+	rep, err = handler.GetDataNodes4Add(ctx, &pb.GetDataNodes4AddArgs{FileNodeId: "file2", ChunkNum: 2})
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []string{"dataNode2", "dataNode3"}, rep.(*pb.GetDataNodes4AddReply).DataNodeIds[0].Items[:2],
+		"Explicit placement should be used in order.")
+	assert.Equal(t, 3, len(rep.(*pb.GetDataNodes4AddReply).DataNodeIds[1].Items), "Unexpected number of replicas.")
+}
+
+func TestAddOperation_ReplicaFactor(t *testing.T) {
+	replicaNum := viper.GetInt(common.ReplicaNum)
+	viper.Set(common.ReplicaNum, 3)
+	t.Cleanup(func() {
+		viper.Set(common.ReplicaNum, replicaNum)
+		dataNodeMap = make(map[string]*DataNode)
+		chunksMap = make(map[string]*Chunk)
+		replicaFactorFileNodes = make(map[string]*FileNode)
+	})
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprintf("dataNode%d", i)
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet(), FullCapacity: 1 << 40}
+	}
+	small := indexTestFile(t, "file1", 1)
+	applyFileNodeReplicaFactor(small, 2)
+	large := indexTestFile(t, "file2", 1)
+	applyFileNodeReplicaFactor(large, 4)
+
+	// Chunk of the file get the ReplicaFactor of the file rather than the
+	// default replica number, even with a longer client placement.
+	rep, err := AddOperation{FileNodeId: "file1", ChunkNum: 1, Stage: common.GetDataNodes,
+		Placement: [][]string{{"dataNode1", "dataNode2", "dataNode3"}}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []string{"dataNode1", "dataNode2"}, rep.(*pb.GetDataNodes4AddReply).DataNodeIds[0].Items,
+		"Unexpected allocated datanodes.")
+	assert.Equal(t, 2, chunksMap["file1_0"].minAckNum, "Unexpected minimum-ack number.")
+
+	rep, err = AddOperation{FileNodeId: "file2", ChunkNum: 1, Stage: common.GetDataNodes}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 4, len(rep.(*pb.GetDataNodes4AddReply).DataNodeIds[0].Items), "Unexpected replica num.")
+	assert.Equal(t, 4, chunksMap["file2_0"].minAckNum, "Unexpected minimum-ack number.")
+
+	// The minimum-ack number is checked against the ReplicaFactor.
+	_, err = AddOperation{FileNodeId: "file1", ChunkNum: 1, MinAckNum: 3, Stage: common.GetDataNodes}.Apply()
+	assert.Error(t, err, "Expected an error.")
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Reasons why the last allocation could not make up the missing replica of a
+// Chunk in pendingChunkQueue.
+const (
+	// PendingReasonNoTarget means no alive DataNode could receive the Chunk,
+	// e.g. none matches the PlacementConstraint or all store it already.
+	PendingReasonNoTarget = "no_target"
+	// PendingReasonSendFailed means a DataNode was allocated but sending the
+	// Chunk to it failed.
+	PendingReasonSendFailed = "send_failed"
+	// PendingReasonSendTimeout means a DataNode was allocated but sending the
+	// Chunk to it never finished in time.
+	PendingReasonSendTimeout = "send_timeout"
+)
+
+var (
+	// pendingChunkStates stores when each Chunk in pendingChunkQueue was put
+	// into it, using id as the key. It is protected by pendingStateLock, which
+	// must be the innermost lock.
+	pendingChunkStates = make(map[string]*pendingChunkState)
+	pendingStateLock   = &sync.Mutex{}
+)
+
+// pendingChunkState is how long a Chunk has been in pendingChunkQueue. A Chunk
+// may be in the queue more than once, and it keeps the time it was put into
+// the queue first until all of them are removed. Chunk which can not be placed
+// are put back without losing their time, so the age is how long the Chunk has
+// missed a replica rather than how long it has been at its current position.
+type pendingChunkState struct {
+	since  time.Time
+	count  int
+	reason string
+}
+
+// PendingChunkAge is how long a Chunk has been waiting in pendingChunkQueue.
+type PendingChunkAge struct {
+	ChunkId string
+	Since   time.Time
+	Age     time.Duration
+	// Reason is why the last allocation could not make up the Chunk. It is
+	// empty if no allocation has failed for it.
+	Reason string
+}
+
+// enqueuePendingChunk puts a Chunk to pendingChunkQueue and records when it
+// was put. The reason is the result of the last allocation of the Chunk, it
+// can be empty if the Chunk is put for another reason.
+func enqueuePendingChunk(chunkId string, reason string) {
+	pendingChunkQueue.Push(String(chunkId))
+	trackPendingChunks([]string{chunkId}, reason, time.Now())
+}
+
+// trackPendingChunks records that the Chunk are put to pendingChunkQueue at
+// now. It must be called once for each time a Chunk is put.
+func trackPendingChunks(chunkIds []string, reason string, now time.Time) {
+	pendingStateLock.Lock()
+	defer pendingStateLock.Unlock()
+	for _, id := range chunkIds {
+		state, ok := pendingChunkStates[id]
+		if !ok {
+			state = &pendingChunkState{since: now}
+			pendingChunkStates[id] = state
+		}
+		state.count++
+		if reason != "" {
+			state.reason = reason
+		}
+	}
+}
+
+// untrackPendingChunks records that the Chunk are removed from
+// pendingChunkQueue. It must be called once for each time a Chunk is removed.
+func untrackPendingChunks(chunkIds []String) {
+	pendingStateLock.Lock()
+	defer pendingStateLock.Unlock()
+	for _, id := range chunkIds {
+		state, ok := pendingChunkStates[string(id)]
+		if !ok {
+			continue
+		}
+		if state.count--; state.count <= 0 {
+			delete(pendingChunkStates, string(id))
+		}
+	}
+}
+
+// ListPendingChunkAges returns at most limit Chunk which have waited in
+// pendingChunkQueue for the longest time, the oldest first. All of them are
+// returned if limit is not positive.
+func ListPendingChunkAges(limit int) []PendingChunkAge {
+	now := time.Now()
+	pendingStateLock.Lock()
+	ages := make([]PendingChunkAge, 0, len(pendingChunkStates))
+	for id, state := range pendingChunkStates {
+		ages = append(ages, PendingChunkAge{
+			ChunkId: id,
+			Since:   state.since,
+			Age:     now.Sub(state.since),
+			Reason:  state.reason,
+		})
+	}
+	pendingStateLock.Unlock()
+	sort.Slice(ages, func(i, j int) bool {
+		if !ages[i].Since.Equal(ages[j].Since) {
+			return ages[i].Since.Before(ages[j].Since)
+		}
+		return ages[i].ChunkId < ages[j].ChunkId
+	})
+	if limit > 0 && len(ages) > limit {
+		ages = ages[:limit]
+	}
+	return ages
+}
+
+// updatePendingAgeMonitor exposes the max and average age of Chunk in
+// pendingChunkQueue and the number of them older than the configured
+// pendingAgeThreshold.
+func updatePendingAgeMonitor(now time.Time) {
+	threshold := time.Duration(viper.GetInt(MasterPendingAgeThreshold)) * time.Second
+	if threshold <= 0 {
+		threshold = defaultPendingAgeThreshold * time.Second
+	}
+	pendingStateLock.Lock()
+	defer pendingStateLock.Unlock()
+	var maxAge, totalAge time.Duration
+	stuck := 0
+	for _, state := range pendingChunkStates {
+		age := now.Sub(state.since)
+		totalAge += age
+		if age > maxAge {
+			maxAge = age
+		}
+		if age > threshold {
+			stuck++
+		}
+	}
+	avgAge := 0.0
+	if len(pendingChunkStates) != 0 {
+		avgAge = totalAge.Seconds() / float64(len(pendingChunkStates))
+	}
+	pendingChunkMaxAgeMonitor.Set(maxAge.Seconds())
+	pendingChunkAvgAgeMonitor.Set(avgAge)
+	pendingChunkStuckCountMonitor.Set(float64(stuck))
+}
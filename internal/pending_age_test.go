@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	set "github.com/deckarep/golang-set"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"tinydfs-base/common"
+	"tinydfs-base/util"
+)
+
+func TestPendingChunkAges(t *testing.T) {
+	replicaNum := viper.GetInt(common.ReplicaNum)
+	copyThreshold := viper.GetInt(common.ChunkDeadChunkCopyThreshold)
+	viper.Set(common.ReplicaNum, 3)
+	viper.Set(common.ChunkDeadChunkCopyThreshold, 10)
+	resetPendingState := func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+		pendingChunkStates = make(map[string]*pendingChunkState)
+	}
+	t.Cleanup(func() {
+		viper.Set(common.ReplicaNum, replicaNum)
+		viper.Set(common.ChunkDeadChunkCopyThreshold, copyThreshold)
+		resetPendingState()
+	})
+	resetPendingState()
+	addDataNode := func(id string) {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet(),
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	// The only alive DataNode already stores the Chunk, so it can not be placed.
+	addDataNode("dataNode1")
+	dataNodeMap["dataNode1"].Chunks.Add("chunk1")
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	pushPendingChunks([]string{"chunk1"}, time.Now())
+	since := time.Now().Add(-time.Hour)
+	pendingChunkStates["chunk1"].since = since
+
+	_, err := planAllocateChunks().Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 1, pendingChunkQueue.Len(), "Chunk should stay in the queue.")
+	ages := ListPendingChunkAges(10)
+	assert.Len(t, ages, 1, "Unexpected pending chunk num.")
+	assert.Equal(t, "chunk1", ages[0].ChunkId, "Unexpected chunk id.")
+	assert.Equal(t, since, ages[0].Since, "Chunk put back should keep its time.")
+	assert.GreaterOrEqual(t, ages[0].Age, time.Hour, "Unexpected age.")
+	assert.Equal(t, PendingReasonNoTarget, ages[0].Reason, "Unexpected reason.")
+	updatePendingAgeMonitor(time.Now())
+	assert.GreaterOrEqual(t, testutil.ToFloat64(pendingChunkMaxAgeMonitor), time.Hour.Seconds(), "Unexpected max age.")
+	assert.Equal(t, 1.0, testutil.ToFloat64(pendingChunkStuckCountMonitor), "Chunk should be stuck.")
+
+	// A newer Chunk is listed after the older one.
+	chunksMap["chunk2"] = &Chunk{Id: "chunk2", dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+	pushPendingChunks([]string{"chunk2"}, time.Now())
+	ages = ListPendingChunkAges(0)
+	assert.Equal(t, []string{"chunk1", "chunk2"}, []string{ages[0].ChunkId, ages[1].ChunkId}, "Oldest should be first.")
+	assert.Equal(t, "", ages[1].Reason, "Chunk which is not allocated should have no reason.")
+	assert.Len(t, ListPendingChunkAges(1), 1, "Unexpected limit.")
+
+	// Chunk are no longer tracked once they are placed.
+	addDataNode("dataNode2")
+	_, err = planAllocateChunks().Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 0, pendingChunkQueue.Len(), "Chunk should be placed.")
+	assert.Empty(t, ListPendingChunkAges(0), "Placed chunk should not be tracked.")
+	updatePendingAgeMonitor(time.Now())
+	assert.Equal(t, 0.0, testutil.ToFloat64(pendingChunkStuckCountMonitor), "No chunk should be stuck.")
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/metadata"
+	"strings"
+	"tinydfs-base/common"
+)
+
+// Access is the access an operation needs on a FileNode. Read, write and
+// execute are the same as POSIX permission bits.
+type Access uint32
+
+const (
+	AccessExecute Access = 1
+	AccessWrite   Access = 2
+	AccessRead    Access = 4
+	// AccessOwner is needed to change the owner or the mode of a FileNode.
+	AccessOwner Access = 8
+)
+
+const (
+	// GroupsMetadataKey is the key of gRPC metadata which carries the groups of
+	// the requester. The user of the requester is carried by AuditIdentityKey.
+	GroupsMetadataKey = "groups"
+	// maxMode is the largest mode with owner, group and other rwx bits.
+	maxMode         = 0777
+	defaultFileMode = 0644
+	defaultDirMode  = 0755
+)
+
+var (
+	// authorizer decides whether a request can access a FileNode. It is only
+	// consulted when master.permissionEnabled is true.
+	authorizer Authorizer = posixAuthorizer
+)
+
+// Identity is the user and groups of the requester of an operation.
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+// Authorizer returns true if the identity is allowed to access the FileNode.
+// It is called with createFileNodeLock held, so it should not modify the
+// directory tree.
+type Authorizer func(identity Identity, fileNode *FileNode, access Access) bool
+
+// SetAuthorizer replaces the Authorizer used by all namespace operations. It
+// should be called before the master starts serving.
+func SetAuthorizer(a Authorizer) {
+	authorizer = a
+}
+
+// PermissionDeniedError is returned when the requester is not allowed to access
+// a FileNode.
+type PermissionDeniedError struct {
+	User   string
+	Path   string
+	Access Access
+}
+
+func (e *PermissionDeniedError) Error() string {
+	return fmt.Sprintf("permission denied, user: %s, path: %s, access: %s", e.User, e.Path, e.Access)
+}
+
+func (a Access) String() string {
+	if a == AccessOwner {
+		return "owner"
+	}
+	res := strings.Builder{}
+	for i, c := range "rwx" {
+		if a&(AccessRead>>i) != 0 {
+			res.WriteRune(c)
+		} else {
+			res.WriteRune('-')
+		}
+	}
+	return res.String()
+}
+
+// posixAuthorizer checks the mode of the FileNode like POSIX. The owner bits
+// are used if the user is the owner, then the group bits are used if the user
+// is in the group, otherwise the other bits are used. Only the owner can
+// change the owner or the mode, except that anyone can change them for a
+// FileNode without owner, e.g. one created by an anonymous request. A FileNode
+// whose mode is 0, such as the root or FileNode created by old versions, is
+// accessible to everyone, and master.superuser can access all FileNode.
+func posixAuthorizer(identity Identity, fileNode *FileNode, access Access) bool {
+	if fileNode.Mode == 0 {
+		return true
+	}
+	if superuser := viper.GetString(MasterSuperuser); superuser != "" && identity.User == superuser {
+		return true
+	}
+	isOwner := identity.User != "" && identity.User == fileNode.Owner
+	if access == AccessOwner {
+		return isOwner || fileNode.Owner == ""
+	}
+	bits := fileNode.Mode
+	switch {
+	case isOwner:
+		bits >>= 6
+	case fileNode.Group != "" && containsString(identity.Groups, fileNode.Group):
+		bits >>= 3
+	}
+	return Access(bits)&access == access
+}
+
+// getRequestIdentity gets the Identity of the requester from gRPC metadata.
+// Both of the user and groups are empty if they are not given.
+func getRequestIdentity(ctx context.Context) Identity {
+	identity := Identity{}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if users := md.Get(AuditIdentityKey); len(users) != 0 {
+			identity.User = users[0]
+		}
+		identity.Groups = md.Get(GroupsMetadataKey)
+	}
+	return identity
+}
+
+// primaryGroup is the group of FileNode created by the identity.
+func (i Identity) primaryGroup() string {
+	if len(i.Groups) == 0 {
+		return ""
+	}
+	return i.Groups[0]
+}
+
+// checkPermission checks whether the requester is allowed to access the
+// FileNode at the given path. It does nothing if permission is disabled, and a
+// path which does not exist is left to the operation to report.
+func checkPermission(ctx context.Context, namespace string, path string, access Access) error {
+	if !viper.GetBool(MasterPermissionEnabled) {
+		return nil
+	}
+	nsRoot, err := getNamespaceRoot(namespace)
+	if err != nil {
+		return nil
+	}
+	identity := getRequestIdentity(ctx)
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	fileNode, isExist := getFileNodeFrom(nsRoot, path)
+	if !isExist {
+		return nil
+	}
+	if !authorizer(identity, fileNode, access) {
+		return &PermissionDeniedError{
+			User:   identity.User,
+			Path:   path,
+			Access: access,
+		}
+	}
+	return nil
+}
+
+// checkParentPermission checks the access to the parent directory of the given
+// path, which is needed to remove or rename a FileNode.
+func checkParentPermission(ctx context.Context, namespace string, path string, access Access) error {
+	path = strings.TrimRight(path, pathSplitString)
+	index := strings.LastIndex(path, pathSplitString)
+	if index < 0 {
+		return checkPermission(ctx, namespace, pathSplitString, access)
+	}
+	return checkPermission(ctx, namespace, path[:index+1], access)
+}
+
+// checkMode checks whether the mode is legal.
+func checkMode(mode uint32) error {
+	if mode > maxMode {
+		return fmt.Errorf("illegal mode, mode: %o", mode)
+	}
+	return nil
+}
+
+// checkOwner checks whether the owner or group can be written in snapshot.
+func checkOwner(owner string, group string) error {
+	if strings.ContainsAny(owner+group, common.DollarDelimiter+" \n") {
+		return fmt.Errorf("illegal owner or group, owner: %q, group: %q", owner, group)
+	}
+	return nil
+}
+
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"tinydfs-base/protocol/pb"
+)
+
+func newIdentityContext(user string, groups ...string) context.Context {
+	pairs := []string{AuditIdentityKey, user}
+	for _, group := range groups {
+		pairs = append(pairs, GroupsMetadataKey, group)
+	}
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(pairs...))
+}
+
+func TestPermission(t *testing.T) {
+	oldRoot := root
+	viper.Set(MasterPermissionEnabled, true)
+	t.Cleanup(func() {
+		viper.Set(MasterPermissionEnabled, false)
+		SetAuthorizer(posixAuthorizer)
+		root = oldRoot
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	leaderRaft, leaderTransport := newInmemRaft(t, "master1")
+	err := leaderRaft.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{{ID: "master1", Address: leaderTransport.LocalAddr()}},
+	}).Error()
+	assert.NoError(t, err, "Unexpected error.")
+	select {
+	case <-leaderRaft.LeaderCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fail to elect leader.")
+	}
+	handler := &MasterHandler{Raft: leaderRaft}
+	alice := newIdentityContext("alice", "staff")
+	bob := newIdentityContext("bob", "guest")
+	carol := newIdentityContext("carol", "guest", "staff")
+
+	// The root has no mode, so everyone can create under it.
+	_, err = handler.CheckAndMkdir(alice, &pb.CheckAndMkDirArgs{Path: "/", DirName: "home"})
+	assert.NoError(t, err, "Unexpected error.")
+	fileNode, err := CheckAndGetFileNode("/home")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, "alice", fileNode.Owner, "Unexpected owner.")
+	assert.Equal(t, "staff", fileNode.Group, "Unexpected group.")
+	assert.Equal(t, uint32(defaultDirMode), fileNode.Mode, "Unexpected mode.")
+
+	// Only the owner can change the mode.
+	var deniedErr *PermissionDeniedError
+	err = handler.Chmod(bob, "/home", 0777)
+	assert.ErrorAs(t, err, &deniedErr, "Only owner can change mode.")
+	assert.NoError(t, handler.Chmod(alice, "/home", 0750), "Unexpected error.")
+	assert.True(t, strings.HasSuffix(fileNode.String(), "$alice$staff$750\n"), "Mode should be persisted.")
+
+	// The owner can write, a user in the group can read but not write, and
+	// others can not read.
+	_, err = handler.CheckAndMkdir(alice, &pb.CheckAndMkDirArgs{Path: "/home", DirName: "a"})
+	assert.NoError(t, err, "Owner should be allowed to write.")
+	_, err = handler.CheckAndList(carol, &pb.CheckAndListArgs{Path: "/home", IsLatest: true})
+	assert.NoError(t, err, "Group should be allowed to read.")
+	_, err = handler.CheckAndMkdir(carol, &pb.CheckAndMkDirArgs{Path: "/home", DirName: "b"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "Group should not be allowed to write.")
+	_, err = handler.CheckAndList(bob, &pb.CheckAndListArgs{Path: "/home", IsLatest: true})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "Other should not be allowed to read.")
+	_, err = handler.CheckAndRemove(bob, &pb.CheckAndRemoveArgs{Path: "/home/a"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "Other should not be allowed to remove.")
+	_, err = handler.MapRangeToChunks(bob, "/home", 0, 10)
+	assert.ErrorAs(t, err, &deniedErr, "Other should not be allowed to map range.")
+
+	// The superuser can access everything.
+	viper.Set(MasterSuperuser, "root")
+	_, err = handler.CheckAndList(newIdentityContext("root"), &pb.CheckAndListArgs{Path: "/home", IsLatest: true})
+	assert.NoError(t, err, "Superuser should be allowed to read.")
+	viper.Set(MasterSuperuser, "")
+
+	// A FileNode created by an anonymous request has no owner, so anyone can
+	// take it over.
+	_, err = handler.CheckAndMkdir(context.Background(), &pb.CheckAndMkDirArgs{Path: "/", DirName: "tmp"})
+	assert.NoError(t, err, "Unexpected error.")
+	assert.NoError(t, handler.Chown(bob, "/tmp", "bob", "guest"), "Unowned file should be taken over.")
+	err = handler.Chmod(alice, "/tmp", 0777)
+	assert.ErrorAs(t, err, &deniedErr, "Only new owner can change mode.")
+
+	// Permission is not checked if it is disabled.
+	viper.Set(MasterPermissionEnabled, false)
+	_, err = handler.CheckAndList(bob, &pb.CheckAndListArgs{Path: "/home", IsLatest: true})
+	assert.NoError(t, err, "Unexpected error.")
+	viper.Set(MasterPermissionEnabled, true)
+
+	// A custom Authorizer replaces the mode.
+	SetAuthorizer(func(identity Identity, fileNode *FileNode, access Access) bool {
+		return identity.User == "bob"
+	})
+	_, err = handler.CheckAndList(bob, &pb.CheckAndListArgs{Path: "/home", IsLatest: true})
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = handler.CheckAndList(alice, &pb.CheckAndListArgs{Path: "/home", IsLatest: true})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "Authorizer should deny the read.")
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	constraintTermDelimiter = ","
+	tagDelimiter            = "="
+	notEqualDelimiter       = "!="
+)
+
+// PlacementConstraint restricts which DataNode can store replicas of a file. It
+// is a conjunction of terms against the Tags of DataNode, e.g. "zone=eu,gpu!=true"
+// means all replicas must be stored in DataNode whose zone is eu and whose gpu
+// is not true. An empty PlacementConstraint matches all DataNode.
+type PlacementConstraint struct {
+	terms []constraintTerm
+}
+
+// constraintTerm is a single "key=value" or "key!=value" term of a
+// PlacementConstraint.
+type constraintTerm struct {
+	key      string
+	value    string
+	notEqual bool
+}
+
+// ParsePlacementConstraint parses a PlacementConstraint from its expression.
+func ParsePlacementConstraint(expr string) (PlacementConstraint, error) {
+	constraint := PlacementConstraint{}
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return constraint, nil
+	}
+	for _, t := range strings.Split(expr, constraintTermDelimiter) {
+		term := constraintTerm{}
+		delimiter := tagDelimiter
+		if strings.Contains(t, notEqualDelimiter) {
+			delimiter = notEqualDelimiter
+			term.notEqual = true
+		}
+		kv := strings.SplitN(t, delimiter, 2)
+		if len(kv) != 2 {
+			return PlacementConstraint{}, fmt.Errorf("illegal placement constraint term, term: %s", t)
+		}
+		term.key, term.value = strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if term.key == "" || !isLegalTag(term.key) || !isLegalTag(term.value) {
+			return PlacementConstraint{}, fmt.Errorf("illegal placement constraint term, term: %s", t)
+		}
+		constraint.terms = append(constraint.terms, term)
+	}
+	return constraint, nil
+}
+
+// Match checks whether the given Tags of a DataNode satisfy the constraint. A
+// tag which is not set is regarded as an empty value.
+func (c PlacementConstraint) Match(tags map[string]string) bool {
+	for _, term := range c.terms {
+		if (tags[term.key] == term.value) == term.notEqual {
+			return false
+		}
+	}
+	return true
+}
+
+// IsEmpty checks whether the constraint has no term.
+func (c PlacementConstraint) IsEmpty() bool {
+	return len(c.terms) == 0
+}
+
+func (c PlacementConstraint) String() string {
+	terms := make([]string, len(c.terms))
+	for i, term := range c.terms {
+		delimiter := tagDelimiter
+		if term.notEqual {
+			delimiter = notEqualDelimiter
+		}
+		terms[i] = term.key + delimiter + term.value
+	}
+	return strings.Join(terms, constraintTermDelimiter)
+}
+
+// isLegalTag checks whether a tag key or value can be persisted in snapshot.
+func isLegalTag(s string) bool {
+	return !strings.ContainsAny(s, "$ \n!="+constraintTermDelimiter)
+}
+
+// tags2String converts Tags of a DataNode to a string like "k1=v1,k2=v2" which
+// is sorted by key.
+func tags2String(tags map[string]string) string {
+	res := make([]string, 0, len(tags))
+	for k, v := range tags {
+		res = append(res, k+tagDelimiter+v)
+	}
+	sort.Strings(res)
+	return strings.Join(res, constraintTermDelimiter)
+}
+
+// string2Tags parses Tags of a DataNode from the string created by tags2String.
+func string2Tags(s string) map[string]string {
+	tags := make(map[string]string)
+	if s == "" {
+		return tags
+	}
+	for _, kv := range strings.Split(s, constraintTermDelimiter) {
+		if pair := strings.SplitN(kv, tagDelimiter, 2); len(pair) == 2 {
+			tags[pair[0]] = pair[1]
+		}
+	}
+	return tags
+}
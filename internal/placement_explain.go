@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
+	"tinydfs-base/common"
+)
+
+// Reasons why a DataNode can not receive a Chunk, see ExplainPlacement.
+const (
+	// ExcludeNotAlive means the DataNode is not alive, e.g. it is waiting,
+	// dead, cold or quarantined.
+	ExcludeNotAlive = "not_alive"
+	// ExcludeStored means the DataNode already stores the Chunk.
+	ExcludeStored = "already_stored"
+	// ExcludePending means the DataNode has been allocated to store the Chunk.
+	ExcludePending = "pending"
+	// ExcludeQuarantined means the replica of the Chunk on the DataNode failed
+	// the checksum and is kept for inspection.
+	ExcludeQuarantined = "quarantined_replica"
+	// ExcludeConstraint means the Tags of the DataNode do not match the
+	// PlacementConstraint of the file.
+	ExcludeConstraint = "constraint_mismatch"
+	// ExcludeDomainFull means the failure domain of the DataNode already has
+	// MaxReplicasPerDomain replicas of the Chunk.
+	ExcludeDomainFull = "domain_full"
+)
+
+// CandidateExplanation explains whether a DataNode can receive a Chunk.
+type CandidateExplanation struct {
+	DataNodeId string
+	Status     int
+	Tags       map[string]string
+	// Reason is why the DataNode can not receive the Chunk. It is empty if the
+	// DataNode is eligible.
+	Reason string
+	// Cost is the cost of the plan which sends the Chunk to the DataNode, the
+	// lower the better. It is only set for eligible DataNode.
+	Cost float64
+}
+
+// PlacementExplanation explains where a missing replica of a Chunk would be
+// placed by the background allocator.
+type PlacementExplanation struct {
+	ChunkId    string
+	Constraint string
+	// Lost means no alive DataNode stores the Chunk, so it is not allocated
+	// until one comes back.
+	Lost bool
+	// Candidates include all DataNode ordered by id.
+	Candidates []CandidateExplanation
+	// Chosen is the eligible DataNode with the least cost. The allocator plans
+	// a batch of Chunk together, so it may choose another one with the same
+	// cost. It is empty if no DataNode is eligible.
+	Chosen string
+}
+
+// ExplainPlacement re-runs the filtering and the costing of the allocator for a
+// missing replica of the Chunk as if it were allocated alone, and tells why each
+// DataNode is or is not a candidate. Nothing is applied, and the result is what
+// the allocator would do at the time of calling.
+func ExplainPlacement(chunkId string) (*PlacementExplanation, error) {
+	updateChunksLock.RLock()
+	chunk, ok := chunksMap[chunkId]
+	if !ok {
+		updateChunksLock.RUnlock()
+		return nil, fmt.Errorf("chunk not exist, chunk id: %s", chunkId)
+	}
+	if chunk.codingScheme.IsErasureCoded() {
+		updateChunksLock.RUnlock()
+		return nil, fmt.Errorf("erasure coded chunk is reconstructed rather than placed, chunk id: %s", chunkId)
+	}
+	stored, pending := chunk.dataNodes.Clone(), chunk.pendingDataNodes.Clone()
+	isQuarantinedOn := make(map[string]bool)
+	if chunk.hasQuarantinedReplica() {
+		for _, id := range set2SortedStrings(chunk.quarantinedDataNodes) {
+			isQuarantinedOn[id] = true
+		}
+	}
+	updateChunksLock.RUnlock()
+
+	explanation := &PlacementExplanation{
+		ChunkId:    chunkId,
+		Constraint: getPlacementConstraint(chunkId).String(),
+	}
+	aliveIds := GetAliveDataNodeIds()
+	sort.Strings(aliveIds)
+	// Same as filterLostChunks, a Chunk without alive DataNode storing it has
+	// no source to copy from.
+	explanation.Lost = true
+	for _, id := range aliveIds {
+		if stored.Contains(id) {
+			explanation.Lost = false
+		}
+	}
+	chunkIds := []string{chunkId}
+	isStore := getStoreState(chunkIds, aliveIds)
+	reasons := explainBlockedState(chunkId, aliveIds, isStore[0])
+	cost := newAllocateCost(1, aliveIds, isStore, getAllocateCostWeights())
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	aliveIndexes := make(map[string]int)
+	for j, id := range aliveIds {
+		aliveIndexes[id] = j
+	}
+	dataNodeIds := make([]string, 0, len(dataNodeMap))
+	for id := range dataNodeMap {
+		dataNodeIds = append(dataNodeIds, id)
+	}
+	sort.Strings(dataNodeIds)
+	minCost := 0.0
+	for _, id := range dataNodeIds {
+		dataNode := dataNodeMap[id]
+		candidate := CandidateExplanation{DataNodeId: id, Status: dataNode.Status, Tags: dataNode.Tags}
+		j, isAlive := aliveIndexes[id]
+		switch {
+		case !isAlive:
+			candidate.Reason = ExcludeNotAlive
+		case stored.Contains(id):
+			candidate.Reason = ExcludeStored
+		case pending.Contains(id):
+			candidate.Reason = ExcludePending
+		case isQuarantinedOn[id]:
+			candidate.Reason = ExcludeQuarantined
+		default:
+			candidate.Reason = reasons[j]
+		}
+		if candidate.Reason == "" {
+			candidate.Cost = calPlacementCost(cost, len(aliveIds), j)
+			if explanation.Chosen == "" || candidate.Cost < minCost {
+				explanation.Chosen, minCost = id, candidate.Cost
+			}
+		}
+		explanation.Candidates = append(explanation.Candidates, candidate)
+	}
+	if explanation.Lost {
+		explanation.Chosen = ""
+	}
+	return explanation, nil
+}
+
+// explainBlockedState does the same thing as getBlockedState for one Chunk, but
+// returns the reason why each DataNode is blocked, which is empty if it is not
+// blocked. DataNode storing the Chunk get ExcludeStored, and the caller should
+// tell them apart.
+func explainBlockedState(chunkId string, dataNodeIds []string, isStore []bool) []string {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	constraint := getPlacementConstraint(chunkId)
+	dataNodes := make([]*DataNode, len(dataNodeIds))
+	reasons := make([]string, len(dataNodeIds))
+	isBlocked := make([]bool, len(dataNodeIds))
+	for j, id := range dataNodeIds {
+		dataNodes[j] = dataNodeMap[id]
+		switch {
+		case isStore[j]:
+			reasons[j] = ExcludeStored
+		case dataNodes[j] == nil || dataNodes[j].Status != common.Alive:
+			reasons[j] = ExcludeNotAlive
+		case !constraint.Match(dataNodes[j].Tags):
+			reasons[j] = ExcludeConstraint
+		}
+		isBlocked[j] = reasons[j] != ""
+	}
+	if len(topologyKeys) == 0 {
+		return reasons
+	}
+	markBlocked := func(reason string) {
+		for j, blocked := range isBlocked {
+			if blocked && reasons[j] == "" {
+				reasons[j] = reason
+			}
+		}
+	}
+	if maxPerDomain := getChunkMaxReplicasPerDomain(chunkId); maxPerDomain != 0 {
+		blockFullDomains(isBlocked, isStore, dataNodes, topologyKeys, maxPerDomain)
+		markBlocked(ExcludeDomainFull)
+	}
+	return reasons
+}
+
+// calPlacementCost calculates the cost of the plan which sends one Chunk to the
+// DataNode at the given index, in the same way as the allocator does.
+func calPlacementCost(cost *allocateCost, dataNodeNum int, index int) float64 {
+	// Only one DataNode receives the Chunk, so the variance of the number of
+	// Chunk received by each DataNode is the same for all plans.
+	variance := 1
+	if dataNodeNum == 1 {
+		variance = 0
+	}
+	if cost == nil {
+		return float64(variance)
+	}
+	currentResult := make([][]int, dataNodeNum)
+	currentResult[index] = []int{0}
+	return cost.calculate(currentResult, variance)
+}
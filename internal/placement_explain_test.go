@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	set "github.com/deckarep/golang-set"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"tinydfs-base/common"
+)
+
+func TestExplainPlacement(t *testing.T) {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	capacityWeight := viper.GetFloat64(MasterAllocateCapacityWeight)
+	viper.Set(MasterTopologyKeys, []string{"rack"})
+	viper.Set(MasterAllocateCapacityWeight, 1.0)
+	t.Cleanup(func() {
+		viper.Set(MasterTopologyKeys, topologyKeys)
+		viper.Set(MasterAllocateCapacityWeight, capacityWeight)
+		root.ChildNodes = map[string]*FileNode{}
+		constrainedFileNodes = make(map[string]*FileNode)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	handler := newLeaderHandler(t)
+	file, err := AddFileNode("/", "ssd.txt", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.NoError(t, handler.SetConstraint(context.Background(), "", "/ssd.txt", "disk=ssd"), "Unexpected error.")
+	chunkId := file.Chunks[0]
+	addDataNode := func(id string, status int, rack string, disk string, usedCapacity int) {
+		dataNodeMap[id] = &DataNode{Id: id, Status: status, Tags: map[string]string{"rack": rack, "disk": disk},
+			Chunks: set.NewSet(), UsedCapacity: usedCapacity * common.ChunkSize, FullCapacity: 100 * common.ChunkSize,
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	addDataNode("holder", common.Alive, "rack1", "ssd", 0)
+	addDataNode("pending", common.Alive, "rack2", "ssd", 0)
+	addDataNode("waiting", common.Waiting, "rack3", "ssd", 0)
+	addDataNode("hdd", common.Alive, "rack3", "ssd", 0)
+	assert.NoError(t, handler.SetDataNodeTags("hdd", map[string]string{"rack": "rack3", "disk": "hdd"}),
+		"Unexpected error.")
+	addDataNode("sameRack", common.Alive, "rack1", "ssd", 0)
+	addDataNode("busy", common.Alive, "rack3", "ssd", 90)
+	addDataNode("idle", common.Alive, "rack4", "ssd", 10)
+	chunksMap[chunkId] = &Chunk{Id: chunkId, dataNodes: set.NewSet("holder"), pendingDataNodes: set.NewSet("pending")}
+
+	explanation, err := ExplainPlacement(chunkId)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.False(t, explanation.Lost, "Chunk with an alive holder is not lost.")
+	assert.Equal(t, "disk=ssd", explanation.Constraint, "Unexpected constraint.")
+	reasons := make(map[string]string)
+	for _, candidate := range explanation.Candidates {
+		reasons[candidate.DataNodeId] = candidate.Reason
+		if candidate.Reason != "" {
+			assert.Zero(t, candidate.Cost, "Excluded datanode should not be costed.")
+		}
+	}
+	assert.Equal(t, map[string]string{"holder": ExcludeStored, "pending": ExcludePending, "waiting": ExcludeNotAlive,
+		"hdd": ExcludeConstraint, "sameRack": "", "busy": "", "idle": ""}, reasons, "Unexpected reasons.")
+	costs := make(map[string]float64)
+	for _, candidate := range explanation.Candidates {
+		costs[candidate.DataNodeId] = candidate.Cost
+	}
+	assert.Greater(t, costs["sameRack"], costs["idle"], "Datanode near the replica should cost more.")
+	assert.Equal(t, "idle", explanation.Chosen, "Less used datanode should be chosen.")
+	assert.Equal(t, []string{"pending"}, set2SortedStrings(chunksMap[chunkId].pendingDataNodes),
+		"Nothing should be allocated.")
+
+	// Nothing can be placed once the only holder is gone.
+	dataNodeMap["holder"].Status = common.Waiting
+	explanation, err = ExplainPlacement(chunkId)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.True(t, explanation.Lost, "Chunk without alive holder is lost.")
+	assert.Equal(t, "", explanation.Chosen, "Lost chunk should not be placed.")
+
+	_, err = ExplainPlacement("notExist")
+	assert.Error(t, err, "Expected an error.")
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParsePlacementConstraint(t *testing.T) {
+	tests := []struct {
+		name      string
+		expr      string
+		tags      map[string]string
+		wantMatch bool
+		wantErr   bool
+	}{
+		{
+			name:      "Empty",
+			expr:      "",
+			tags:      map[string]string{"zone": "us"},
+			wantMatch: true,
+		},
+		{
+			name:      "Equal",
+			expr:      "zone=eu",
+			tags:      map[string]string{"zone": "eu", "gpu": "true"},
+			wantMatch: true,
+		},
+		{
+			name:      "NotEqual",
+			expr:      "zone=eu,gpu!=true",
+			tags:      map[string]string{"zone": "eu", "gpu": "true"},
+			wantMatch: false,
+		},
+		{
+			name:      "MissingTag",
+			expr:      "zone=eu",
+			tags:      nil,
+			wantMatch: false,
+		},
+		{
+			name:    "Illegal",
+			expr:    "zone",
+			wantErr: true,
+		},
+		{
+			name:    "IllegalValue",
+			expr:    "zone=e$u",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			constraint, err := ParsePlacementConstraint(tt.expr)
+			if tt.wantErr {
+				assert.Error(t, err, "Expected an error.")
+				return
+			}
+			assert.NoError(t, err, "Unexpected error.")
+			assert.Equal(t, tt.expr, constraint.String(), "Unexpected string.")
+			assert.Equal(t, tt.wantMatch, constraint.Match(tt.tags), "Unexpected match result.")
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"fmt"
+	"tinydfs-base/common"
+)
+
+// PrimaryLease is the lease granted to the primary replica of a Chunk, which
+// orders writes of the Chunk. A write carrying an Epoch older than the one of
+// the Chunk is from a revoked lease and should be rejected by DataNode.
+type PrimaryLease struct {
+	ChunkId    string
+	DataNodeId string
+	Epoch      int64
+}
+
+// GrantPrimary grants the lease of the Chunk. The current primary keeps the
+// lease if it is still an alive holder of the Chunk, otherwise the least-loaded
+// alive holder becomes the primary with a new epoch.
+func GrantPrimary(chunkId string) (*PrimaryLease, error) {
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	chunk, ok := chunksMap[chunkId]
+	if !ok {
+		return nil, fmt.Errorf("chunk not exist, chunk id: %s", chunkId)
+	}
+	if !isPrimaryAvailable(chunk) {
+		primary := selectPrimary(chunk)
+		if primary == "" {
+			return nil, fmt.Errorf("no alive datanode stores the chunk, chunk id: %s", chunkId)
+		}
+		setPrimary(chunk, primary)
+	}
+	return &PrimaryLease{
+		ChunkId:    chunk.Id,
+		DataNodeId: chunk.primary,
+		Epoch:      chunk.primaryEpoch,
+	}, nil
+}
+
+// reassignPrimaries moves the primary of Chunk whose primary is the given
+// DataNode to the least-loaded surviving holder, which revokes the lease of the
+// DataNode. It is called when the DataNode dies or loses the Chunk. The caller
+// must hold updateMapLock and updateChunksLock.
+func reassignPrimaries(dataNodeId string, chunkIds []string) {
+	reassigned := 0
+	for _, id := range chunkIds {
+		chunk, ok := chunksMap[id]
+		if !ok || chunk.primary != dataNodeId {
+			continue
+		}
+		setPrimary(chunk, selectPrimary(chunk))
+		if chunk.primary == "" {
+			Logger.Warnf("No surviving datanode can be primary, chunk id: %s", id)
+		}
+		reassigned++
+	}
+	if reassigned != 0 {
+		Logger.Infof("Reassign primary of %d chunks, old primary: %s", reassigned, dataNodeId)
+	}
+}
+
+// isPrimaryAvailable checks whether the primary of the Chunk is alive and still
+// stores it.
+func isPrimaryAvailable(chunk *Chunk) bool {
+	if chunk.primary == "" || !chunk.dataNodes.Contains(chunk.primary) {
+		return false
+	}
+	dataNode, ok := dataNodeMap[chunk.primary]
+	return ok && dataNode.Status == common.Alive
+}
+
+// selectPrimary selects the alive DataNode storing the Chunk with the least
+// IOLoad, and the one with the smaller id if IOLoad is the same. It returns an
+// empty string if no alive DataNode stores the Chunk.
+func selectPrimary(chunk *Chunk) string {
+	primary := ""
+	minLoad := 0
+	for _, id := range set2SortedStrings(chunk.dataNodes) {
+		dataNode, ok := dataNodeMap[id]
+		if !ok || dataNode.Status != common.Alive {
+			continue
+		}
+		if primary == "" || dataNode.IOLoad < minLoad {
+			primary = id
+			minLoad = dataNode.IOLoad
+		}
+	}
+	return primary
+}
+
+// setPrimary changes the primary of the Chunk and increases its epoch.
+func setPrimary(chunk *Chunk, primary string) {
+	chunk.primary = primary
+	chunk.primaryEpoch++
+}
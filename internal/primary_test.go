@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	set "github.com/deckarep/golang-set"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"tinydfs-base/common"
+	"tinydfs-base/util"
+)
+
+func TestGrantPrimary_ReassignOnDeadDataNode(t *testing.T) {
+	window := viper.GetInt(MasterDegradeRequeueWindow)
+	viper.Set(MasterDegradeRequeueWindow, 0)
+	t.Cleanup(func() {
+		viper.Set(MasterDegradeRequeueWindow, window)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+		stagedChunks = make([]stagedChunk, 0)
+	})
+	for id, ioLoad := range map[string]int{"dataNode1": 1, "dataNode2": 5, "dataNode3": 3} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, IOLoad: ioLoad, Chunks: set.NewSet("chunk1"),
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1", "dataNode2", "dataNode3"),
+		pendingDataNodes: set.NewSet()}
+
+	// The least-loaded holder becomes the primary and keeps the lease.
+	lease, err := GrantPrimary("chunk1")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, &PrimaryLease{ChunkId: "chunk1", DataNodeId: "dataNode1", Epoch: 1}, lease)
+	lease, err = GrantPrimary("chunk1")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, int64(1), lease.Epoch, "Lease should be kept.")
+
+	// The primary dies, so the least-loaded survivor becomes the primary and
+	// the old lease is revoked.
+	DegradeDataNode("dataNode1", common.Degrade2Dead, time.Now())
+	chunk := chunksMap["chunk1"]
+	assert.Equal(t, "dataNode3", chunk.primary, "Primary should be reassigned to a survivor.")
+	assert.Equal(t, int64(2), chunk.primaryEpoch, "Old lease should be revoked.")
+	restored, err := parseChunk(strings.TrimSuffix(chunk.String(), "\n"))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, "dataNode3", restored.primary, "Primary should be persisted.")
+	assert.Equal(t, int64(2), restored.primaryEpoch, "Epoch should be persisted.")
+
+	// Killing a DataNode which is not the primary keeps the lease.
+	DegradeDataNode("dataNode2", common.Degrade2Dead, time.Now())
+	assert.Equal(t, "dataNode3", chunk.primary, "Unexpected primary.")
+	assert.Equal(t, int64(2), chunk.primaryEpoch, "Unexpected epoch.")
+
+	// No lease can be granted after all holders die.
+	DegradeDataNode("dataNode3", common.Degrade2Dead, time.Now())
+	assert.Equal(t, "", chunk.primary, "Primary should be cleared.")
+	_, err = GrantPrimary("chunk1")
+	assert.Error(t, err, "Expected an error.")
+}
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	set "github.com/deckarep/golang-set"
+	"github.com/spf13/viper"
+	"tinydfs-base/common"
+)
+
+const (
+	// flapTimeDelimiter separates FlapTimes of a DataNode in the snapshot.
+	flapTimeDelimiter = ","
+	// flapRecordPrefix starts the line of a flapRecord in the datanodes section
+	// of the snapshot, like "#flap:10.0.0.1$true$1700000000".
+	flapRecordPrefix = "#flap:"
+)
+
+// flapRecord is the flaps of a DataNode which has been removed as dead. A
+// DataNode registers with a new id after it dies, so the record is kept by its
+// address and given back when it registers again. Otherwise a flapping or
+// quarantined DataNode would get rid of its flaps by dying once.
+type flapRecord struct {
+	FlapTimes   []int64
+	Quarantined bool
+}
+
+// removedFlapRecords includes flapRecord of all removed DataNode using their
+// address as the key. It is protected by updateMapLock.
+var removedFlapRecords = make(map[string]*flapRecord)
+
+// keepFlapRecord keeps the flaps of a DataNode which is being removed. Nothing
+// is kept if it never flaps. The caller must hold updateMapLock.
+func keepFlapRecord(dataNode *DataNode) {
+	quarantined := dataNode.Status == Quarantined
+	if !quarantined && len(dataNode.FlapTimes) == 0 {
+		return
+	}
+	removedFlapRecords[dataNode.Address] = &flapRecord{
+		FlapTimes:   dataNode.FlapTimes,
+		Quarantined: quarantined,
+	}
+}
+
+// restoreFlapRecord gives the kept flaps back to a DataNode registering at the
+// address of a removed one. The DataNode stays quarantined if the removed one
+// was, and its Chunks are forgotten like quarantineDataNode. The caller must
+// hold updateMapLock.
+func restoreFlapRecord(dataNode *DataNode) {
+	record, ok := removedFlapRecords[dataNode.Address]
+	if !ok {
+		return
+	}
+	delete(removedFlapRecords, dataNode.Address)
+	dataNode.FlapTimes = record.FlapTimes
+	if record.Quarantined {
+		Logger.Warnf("Datanode registers at the address of a quarantined one, keep it quarantined, "+
+			"datanode id: %s, address: %s", dataNode.Id, dataNode.Address)
+		dataNode.Status = Quarantined
+		dataNode.Chunks = set.NewSet()
+	}
+}
+
+// recordFlap records that the DataNode rejoins at now after being Waiting.
+// Flaps out of the flap window are forgotten, and the DataNode is quarantined if
+// it flaps more than the threshold within the window. The caller must hold
+// updateMapLock.
+func recordFlap(dataNode *DataNode, now time.Time) {
+	threshold := defaultFlapThreshold
+	if viper.IsSet(MasterFlapThreshold) {
+		threshold = viper.GetInt(MasterFlapThreshold)
+	}
+	window := int64(defaultFlapWindow)
+	if viper.IsSet(MasterFlapWindow) {
+		window = viper.GetInt64(MasterFlapWindow)
+	}
+	if threshold <= 0 {
+		return
+	}
+	flapTimes := make([]int64, 0, len(dataNode.FlapTimes)+1)
+	for _, flapTime := range dataNode.FlapTimes {
+		if now.Unix()-flapTime < window {
+			flapTimes = append(flapTimes, flapTime)
+		}
+	}
+	dataNode.FlapTimes = append(flapTimes, now.Unix())
+	if len(dataNode.FlapTimes) > threshold {
+		quarantineDataNode(dataNode, now)
+	}
+}
+
+// quarantineDataNode excludes the DataNode from allocation and puts its Chunk to
+// be replicated again defensively. The DataNode forgets its Chunks, they will be
+// re-validated by a full chunk report once it is cleared. The caller must hold
+// updateMapLock.
+func quarantineDataNode(dataNode *DataNode, now time.Time) {
+	Logger.Warnf("Quarantine flapping datanode, datanode id: %s, flap num: %d", dataNode.Id,
+		len(dataNode.FlapTimes))
+	dataNode.Status = Quarantined
+	dataNode.reportRequested = false
+	evacuateDataNode(dataNode, now)
+	dataNode.Chunks = set.NewSet()
+	dataNode.recountChunks()
+	dataNode.FutureSendChunks = make(map[ChunkSendInfo]int)
+	dataNode.SendAttempts = nil
+	dataNode.SendRetries = nil
+	quarantinedDataNodeCountMonitor.Inc()
+}
+
+// ClearDataNodeQuarantine lets a quarantined DataNode rejoin as Alive with its
+// flaps forgotten. A full chunk report is requested, so that Chunk it still
+// stores are known again. The id can also be the address of a removed
+// DataNode, whose kept flaps are forgotten.
+func ClearDataNodeQuarantine(id string) error {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	dataNode, ok := dataNodeMap[id]
+	if !ok {
+		if _, ok = removedFlapRecords[id]; ok {
+			delete(removedFlapRecords, id)
+			Logger.Infof("Clear flaps of removed datanode, address: %s", id)
+			return nil
+		}
+		return fmt.Errorf("datanode not exist, datanode id: %s", id)
+	}
+	if dataNode.Status != Quarantined {
+		return fmt.Errorf("datanode is not quarantined, datanode id: %s", id)
+	}
+	dataNode.Status = common.Alive
+	dataNode.FlapTimes = nil
+	dataNode.reportRequested = true
+	Logger.Infof("Clear quarantine of datanode, request a full chunk report, datanode id: %s", id)
+	return nil
+}
+
+// flapTimes2String converts FlapTimes to a string in the snapshot.
+func flapTimes2String(flapTimes []int64) string {
+	res := make([]string, len(flapTimes))
+	for i, flapTime := range flapTimes {
+		res[i] = strconv.FormatInt(flapTime, 10)
+	}
+	return strings.Join(res, flapTimeDelimiter)
+}
+
+// parseFlapTimes parses FlapTimes from the string created by flapTimes2String.
+func parseFlapTimes(data string) ([]int64, error) {
+	if data == "" {
+		return nil, nil
+	}
+	fields := strings.Split(data, flapTimeDelimiter)
+	flapTimes := make([]int64, len(fields))
+	for i, field := range fields {
+		flapTime, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		flapTimes[i] = flapTime
+	}
+	return flapTimes, nil
+}
+
+// flapRecord2String converts the flapRecord of a removed DataNode to a line in
+// the datanodes section of the snapshot.
+func flapRecord2String(address string, record *flapRecord) string {
+	return fmt.Sprintf("%s%s$%t$%s\n", flapRecordPrefix, address, record.Quarantined,
+		flapTimes2String(record.FlapTimes))
+}
+
+// parseFlapRecord parses the address and flapRecord from the line created by
+// flapRecord2String.
+func parseFlapRecord(line string) (string, *flapRecord, error) {
+	data := strings.Split(strings.TrimPrefix(line, flapRecordPrefix), common.DollarDelimiter)
+	if len(data) != 3 || data[0] == "" {
+		return "", nil, fmt.Errorf("illegal flap record: %q", line)
+	}
+	quarantined, err := strconv.ParseBool(data[1])
+	if err != nil {
+		return "", nil, err
+	}
+	flapTimes, err := parseFlapTimes(data[2])
+	if err != nil {
+		return "", nil, err
+	}
+	return data[0], &flapRecord{FlapTimes: flapTimes, Quarantined: quarantined}, nil
+}
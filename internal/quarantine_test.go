@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	set "github.com/deckarep/golang-set"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"tinydfs-base/common"
+	"tinydfs-base/util"
+)
+
+func TestRecordFlap_Quarantine(t *testing.T) {
+	threshold := viper.GetInt(MasterFlapThreshold)
+	window := viper.GetInt(MasterDegradeRequeueWindow)
+	viper.Set(MasterFlapThreshold, 2)
+	viper.Set(MasterDegradeRequeueWindow, 0)
+	t.Cleanup(func() {
+		viper.Set(MasterFlapThreshold, threshold)
+		viper.Set(MasterDegradeRequeueWindow, window)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+		stagedChunks = make([]stagedChunk, 0)
+	})
+	for _, id := range []string{"dataNode1", "dataNode2"} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet("chunk1"),
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet()}
+
+	start := time.Unix(1700000000, 0)
+	flaps := 0
+	flap := func() {
+		now := start.Add(time.Duration(flaps) * time.Second)
+		flaps++
+		assert.True(t, DegradeDataNode("dataNode1", common.Degrade2Waiting, now), "Unexpected degrade result.")
+		_, err := HeartbeatOperation{DataNodeId: "dataNode1", IsReady: true, ReceiveTime: now.UnixMilli()}.Apply()
+		assert.NoError(t, err, "Unexpected error.")
+	}
+	flap()
+	flap()
+	assert.Equal(t, common.Alive, dataNodeMap["dataNode1"].Status, "Flaps within threshold should be tolerated.")
+	flap()
+	dataNode := dataNodeMap["dataNode1"]
+	assert.Equal(t, Quarantined, dataNode.Status, "Flapping datanode should be quarantined.")
+	assert.Equal(t, []int64{start.Unix(), start.Unix() + 1, start.Unix() + 2}, dataNode.FlapTimes,
+		"The time of the leader should be recorded.")
+	assert.Equal(t, []string{"dataNode2"}, set2SortedStrings(chunksMap["chunk1"].dataNodes),
+		"Replica on quarantined datanode should not be counted.")
+	assert.Equal(t, 1, pendingChunkQueue.Len(), "Chunk should be re-replicated.")
+	dataNodes, num := AllocateDataNodes()
+	assert.Equal(t, 1, num, "Quarantined datanode should not be allocated.")
+	assert.Equal(t, "dataNode2", dataNodes[0].Id, "Unexpected allocated datanode.")
+
+	// Quarantine survives heartbeats and snapshots.
+	_, err := HeartbeatOperation{DataNodeId: "dataNode1", IsReady: true}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, Quarantined, dataNode.Status, "Heartbeat should not clear quarantine.")
+	restored, err := parseDataNode(strings.TrimSuffix(dataNode.String(), "\n"))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, Quarantined, restored.Status, "Quarantine should be persisted.")
+	assert.Equal(t, dataNode.FlapTimes, restored.FlapTimes, "Flap times should be persisted.")
+
+	assert.Error(t, ClearDataNodeQuarantine("dataNode2"), "Expected an error for a datanode not quarantined.")
+	_, err = ClearQuarantineOperation{DataNodeId: "dataNode1"}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, common.Alive, dataNode.Status, "Cleared datanode should be alive.")
+	assert.Empty(t, dataNode.FlapTimes, "Flaps should be forgotten.")
+	assert.True(t, IsChunkReportRequested("dataNode1"), "Cleared datanode should report its chunks.")
+}
+
+func TestFlapRecord_KeptAfterRemoval(t *testing.T) {
+	window := viper.GetInt(MasterDegradeRequeueWindow)
+	viper.Set(MasterDegradeRequeueWindow, 0)
+	t.Cleanup(func() {
+		viper.Set(MasterDegradeRequeueWindow, window)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+		stagedChunks = make([]stagedChunk, 0)
+		removedFlapRecords = make(map[string]*flapRecord)
+	})
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Status: Quarantined, Address: "10.0.0.1",
+		Chunks: set.NewSet(), FutureSendChunks: make(map[ChunkSendInfo]int), FlapTimes: []int64{1, 2, 3}}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Status: common.Waiting, Address: "10.0.0.2",
+		Chunks: set.NewSet(), FutureSendChunks: make(map[ChunkSendInfo]int), FlapTimes: []int64{4}}
+	for _, id := range []string{"dataNode1", "dataNode2"} {
+		assert.True(t, DegradeDataNode(id, common.Degrade2Dead, time.Now()), "Unexpected degrade result.")
+	}
+
+	// Flaps survive snapshots.
+	sink := &bufferSink{}
+	assert.NoError(t, PersistDataNodes(sink), "Unexpected error.")
+	removedFlapRecords = make(map[string]*flapRecord)
+	assert.NoError(t, RestoreDataNodes(bufio.NewScanner(sink)), "Unexpected error.")
+	assert.Equal(t, map[string]*flapRecord{
+		"10.0.0.1": {FlapTimes: []int64{1, 2, 3}, Quarantined: true},
+		"10.0.0.2": {FlapTimes: []int64{4}},
+	}, removedFlapRecords, "Unexpected flap records.")
+
+	// The quarantined DataNode registers again with a new id and its Chunk.
+	_, err := RegisterOperation{DataNodeId: "dataNode3", Address: "10.0.0.1", ChunkIds: []string{"chunk1"},
+		Time: time.Now().UnixMilli()}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	dataNode := dataNodeMap["dataNode3"]
+	assert.Equal(t, Quarantined, dataNode.Status, "Quarantine should not be bypassed by dying.")
+	assert.Equal(t, []int64{1, 2, 3}, dataNode.FlapTimes, "Unexpected flap times.")
+	assert.Equal(t, 0, dataNode.Chunks.Cardinality(), "Chunk of quarantined datanode should not be trusted.")
+	_, err = RegisterOperation{DataNodeId: "dataNode4", Address: "10.0.0.2", Time: time.Now().UnixMilli()}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, common.Alive, dataNodeMap["dataNode4"].Status, "Unexpected status.")
+	assert.Equal(t, []int64{4}, dataNodeMap["dataNode4"].FlapTimes, "Flaps should be kept.")
+	assert.Empty(t, removedFlapRecords, "Flap records should be taken.")
+
+	// Flaps of a removed DataNode can be cleared by its address.
+	removedFlapRecords["10.0.0.5"] = &flapRecord{Quarantined: true}
+	assert.NoError(t, ClearDataNodeQuarantine("10.0.0.5"), "Unexpected error.")
+	assert.Empty(t, removedFlapRecords, "Flap record should be cleared.")
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+
+	set "github.com/deckarep/golang-set"
+	"github.com/spf13/viper"
+)
+
+// Mode of handling a replica which fails the checksum, see
+// master.checksumMismatchMode.
+const (
+	// MismatchModeEvict forgets the replica, so the DataNode may drop it.
+	MismatchModeEvict = "evict"
+	// MismatchModeQuarantine marks the replica bad on its Chunk. It is neither
+	// read nor counted as a replica, but it is never deleted by master, so that
+	// it can be inspected.
+	MismatchModeQuarantine = "quarantine"
+)
+
+// QuarantinedReplica is a replica of a Chunk which failed the checksum and is
+// kept on its DataNode for inspection.
+type QuarantinedReplica struct {
+	ChunkId    string
+	DataNodeId string
+}
+
+// getChecksumMismatchMode gets the mode of handling a replica which fails the
+// checksum. Unknown modes are handled as MismatchModeEvict.
+func getChecksumMismatchMode() string {
+	switch mode := viper.GetString(MasterChecksumMismatchMode); mode {
+	case MismatchModeQuarantine:
+		return MismatchModeQuarantine
+	case MismatchModeEvict, "":
+	default:
+		Logger.Warnf("Unknown checksum mismatch mode %q, evict is used.", mode)
+	}
+	return MismatchModeEvict
+}
+
+// quarantineReplica marks the replica of this Chunk on the given DataNode bad.
+// The replica must have been removed from dataNodes. The caller must hold
+// updateChunksLock.
+func (c *Chunk) quarantineReplica(dataNodeId string) {
+	if c.quarantinedDataNodes == nil {
+		c.quarantinedDataNodes = set.NewSet()
+	}
+	c.quarantinedDataNodes.Add(dataNodeId)
+	Logger.Warnf("Quarantine replica failing the checksum, chunk id: %s, datanode id: %s", c.Id, dataNodeId)
+}
+
+// ReleaseQuarantinedReplica releases a quarantined replica once it has been
+// inspected, so that its DataNode is told to delete it.
+func ReleaseQuarantinedReplica(chunkId string, dataNodeId string) error {
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	chunk, ok := chunksMap[chunkId]
+	if !ok {
+		return fmt.Errorf("chunk not exist, chunk id: %s", chunkId)
+	}
+	if !chunk.isQuarantinedOn(dataNodeId) {
+		return fmt.Errorf("replica is not quarantined, chunk id: %s, datanode id: %s", chunkId, dataNodeId)
+	}
+	chunk.quarantinedDataNodes.Remove(dataNodeId)
+	if dataNode, ok := dataNodeMap[dataNodeId]; ok {
+		dataNode.scheduleChunkDelete(chunkId)
+	}
+	Logger.Infof("Release quarantined replica, chunk id: %s, datanode id: %s", chunkId, dataNodeId)
+	return nil
+}
+
+// forgetQuarantinedReplicas drops all quarantined replicas on a DataNode which
+// is removed, since they can neither be inspected nor deleted any more. The
+// caller must hold updateMapLock.
+func forgetQuarantinedReplicas(dataNodeId string) {
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	for _, chunk := range chunksMap {
+		if chunk.isQuarantinedOn(dataNodeId) {
+			chunk.quarantinedDataNodes.Remove(dataNodeId)
+		}
+	}
+}
+
+// ListQuarantinedReplicas returns all quarantined replicas ordered by id of
+// their Chunk and DataNode.
+func ListQuarantinedReplicas() []QuarantinedReplica {
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	replicas := make([]QuarantinedReplica, 0)
+	for id, chunk := range chunksMap {
+		if !chunk.hasQuarantinedReplica() {
+			continue
+		}
+		for _, dataNodeId := range set2SortedStrings(chunk.quarantinedDataNodes) {
+			replicas = append(replicas, QuarantinedReplica{ChunkId: id, DataNodeId: dataNodeId})
+		}
+	}
+	sort.SliceStable(replicas, func(i, j int) bool {
+		return replicas[i].ChunkId < replicas[j].ChunkId
+	})
+	return replicas
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	set "github.com/deckarep/golang-set"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"tinydfs-base/common"
+	"tinydfs-base/util"
+)
+
+func TestChecksumMismatch_Quarantine(t *testing.T) {
+	mode := viper.GetString(MasterChecksumMismatchMode)
+	viper.Set(MasterChecksumMismatchMode, MismatchModeQuarantine)
+	t.Cleanup(func() {
+		viper.Set(MasterChecksumMismatchMode, mode)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	for _, id := range []string{"dataNode1", "dataNode2", "dataNode3", "dataNode4"} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet(),
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	for _, id := range []string{"dataNode1", "dataNode2", "dataNode3"} {
+		dataNodeMap[id].Chunks.Add("chunk1")
+	}
+	chunksMap["chunk1"] = &Chunk{Id: "chunk1", dataNodes: set.NewSet("dataNode1", "dataNode2", "dataNode3"),
+		pendingDataNodes: set.NewSet()}
+
+	// The bad replica is excluded from the Chunk but not deleted.
+	_, err := HeartbeatOperation{DataNodeId: "dataNode1", InvalidChunks: []string{"chunk1"}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	chunk := chunksMap["chunk1"]
+	assert.Equal(t, []string{"dataNode2", "dataNode3"}, set2SortedStrings(chunk.dataNodes),
+		"Bad replica should not be counted.")
+	assert.Equal(t, []QuarantinedReplica{{ChunkId: "chunk1", DataNodeId: "dataNode1"}}, ListQuarantinedReplicas(),
+		"Bad replica should be quarantined.")
+	assert.False(t, IsChunkDeletePending("dataNode1", "chunk1"), "Bad replica should not be deleted.")
+	dataNodeIds, _ := GetSortedDataNodeIds(chunk.dataNodes)
+	assert.ElementsMatch(t, []string{"dataNode2", "dataNode3"}, dataNodeIds, "Bad replica should not be read.")
+	restored, err := parseChunk(strings.TrimSuffix(chunk.String(), "\n"))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.True(t, restored.isQuarantinedOn("dataNode1"), "Quarantined replica should be persisted.")
+
+	// The Chunk is re-replicated to a DataNode other than the one with the bad
+	// replica.
+	assert.Equal(t, 1, pendingChunkQueue.Len(), "Chunk should be re-replicated.")
+	chunkIds := []string{"chunk1"}
+	dataNodeIds = []string{"dataNode1", "dataNode2", "dataNode3", "dataNode4"}
+	isStore := getStoreState(chunkIds, dataNodeIds)
+	assert.Equal(t, [][]bool{{true, true, true, false}}, isStore, "Bad replica should not be overwritten.")
+	receiverPlan := allocateChunksDFS(1, len(dataNodeIds), getBlockedState(chunkIds, dataNodeIds, isStore))
+	assert.Equal(t, []int{3}, receiverPlan, "Unexpected receiver.")
+	ApplyAllocatePlan([]int{1}, receiverPlan, chunkIds, dataNodeIds, chunkIds, 1, nil, nil)
+	copyInfo := ChunkSendInfo{ChunkId: "chunk1", DataNodeId: "dataNode4", SendType: common.CopySendType}
+	_, err = HeartbeatOperation{DataNodeId: "dataNode2", ChunkIds: []string{"chunk1"},
+		SuccessInfos: []ChunkSendInfo{copyInfo}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []string{"dataNode2", "dataNode3", "dataNode4"}, set2SortedStrings(chunk.dataNodes),
+		"Replica count should be restored.")
+
+	// A full chunk report with the bad replica does not bring it back.
+	assert.NoError(t, BeginChunkReport("dataNode1"), "Unexpected error.")
+	_, _, _, err = FinishChunkReport("dataNode1", []string{"chunk1"}, time.Now())
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []string{"dataNode2", "dataNode3", "dataNode4"}, set2SortedStrings(chunk.dataNodes),
+		"Reported bad replica should not be counted.")
+	assert.True(t, chunk.isQuarantinedOn("dataNode1"), "Bad replica should stay quarantined.")
+	assert.False(t, IsChunkDeletePending("dataNode1", "chunk1"), "Bad replica should not be deleted.")
+}
+
+func TestQuarantinedReplica_Release(t *testing.T) {
+	t.Cleanup(func() {
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+		stagedChunks = make([]stagedChunk, 0)
+		removedFlapRecords = make(map[string]*flapRecord)
+	})
+	for _, id := range []string{"dataNode1", "dataNode2", "dataNode3"} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Chunks: set.NewSet(),
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	for _, id := range []string{"chunk1", "chunk2", "chunk3"} {
+		chunksMap[id] = &Chunk{Id: id, dataNodes: set.NewSet("dataNode2"), pendingDataNodes: set.NewSet(),
+			quarantinedDataNodes: set.NewSet("dataNode1", "dataNode3")}
+	}
+
+	// A released replica is deleted.
+	assert.NoError(t, ReleaseQuarantinedReplica("chunk1", "dataNode1"),
+		"Unexpected error.")
+	assert.False(t, chunksMap["chunk1"].isQuarantinedOn("dataNode1"), "Replica should be released.")
+	assert.True(t, IsChunkDeletePending("dataNode1", "chunk1"), "Released replica should be deleted.")
+	assert.Error(t, ReleaseQuarantinedReplica("chunk1", "dataNode1"), "Expected an error.")
+	assert.Error(t, ReleaseQuarantinedReplica("unknown", "dataNode1"), "Expected an error.")
+
+	// Quarantined replicas of reclaimed Chunk are deleted.
+	ReclaimChunks([]string{"chunk2"})
+	assert.True(t, IsChunkDeletePending("dataNode1", "chunk2"), "Quarantined replica should be deleted.")
+	assert.True(t, IsChunkDeletePending("dataNode3", "chunk2"), "Quarantined replica should be deleted.")
+
+	// Quarantined replicas of a removed DataNode are forgotten.
+	assert.NoError(t, ForceRemoveDataNode("dataNode3", time.Now()), "Unexpected error.")
+	assert.Equal(t, []QuarantinedReplica{{ChunkId: "chunk3", DataNodeId: "dataNode1"}}, ListQuarantinedReplicas(),
+		"Unexpected quarantined replicas.")
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"bufio"
+	"sort"
+
+	"tinydfs-base/common"
+	"tinydfs-base/util"
+)
+
+// Kind of NamespaceDiff.
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	// DiffRenamed means the FileNode is renamed or moved to another directory.
+	DiffRenamed = "renamed"
+	// DiffChanged means metadata other than the name and the parent, such as
+	// Size, Chunks or policies, is changed.
+	DiffChanged = "changed"
+)
+
+// NamespaceDiff is a difference of a FileNode between two snapshots.
+type NamespaceDiff struct {
+	Kind       string
+	FileNodeId string
+	Namespace  string
+	// OldPath is empty for an added FileNode, and NewPath is empty for a removed
+	// one.
+	OldPath string
+	NewPath string
+}
+
+// DiffSnapshots reads the directory trees of two snapshots and returns how the
+// new one differs from the old one. FileNode are matched by id, and the
+// differences are ordered like add2Arr walking the new trees, followed by the
+// removed FileNode in the order of the old trees. Only the directory tree
+// section of each snapshot is read, and the trees are built aside, so metadata
+// of master is never changed. Deleted FileNode are kept however long ago they
+// were deleted, so that the result does not depend on when it is run.
+func DiffSnapshots(oldBuf *bufio.Scanner, newBuf *bufio.Scanner) ([]NamespaceDiff, error) {
+	oldMap, err := readDirTree(oldBuf, false)
+	if err != nil {
+		return nil, err
+	}
+	newMap, err := readDirTree(newBuf, false)
+	if err != nil {
+		return nil, err
+	}
+	oldNodes, newNodes := linkDirTree(oldMap), linkDirTree(newMap)
+	diffs := make([]NamespaceDiff, 0)
+	for _, newNode := range newNodes {
+		namespace, newPath := getFullPath(newNode)
+		oldNode, ok := oldMap[newNode.Id]
+		if !ok {
+			diffs = append(diffs, NamespaceDiff{Kind: DiffAdded, FileNodeId: newNode.Id, Namespace: namespace,
+				NewPath: newPath})
+			continue
+		}
+		_, oldPath := getFullPath(oldNode)
+		diff := NamespaceDiff{FileNodeId: newNode.Id, Namespace: namespace, OldPath: oldPath, NewPath: newPath}
+		isRenamed := oldNode.FileName != newNode.FileName || getParentId(oldNode) != getParentId(newNode)
+		if isRenamed {
+			diff.Kind = DiffRenamed
+			diffs = append(diffs, diff)
+		}
+		// Compare the rest of metadata in the same way as IsDeepEqualTo, the
+		// name and the rename history are left out if the FileNode is renamed.
+		oldMeta, newMeta := oldNode.copyMeta(), newNode.copyMeta()
+		if isRenamed {
+			oldMeta.FileName, oldMeta.RenameHistory = newMeta.FileName, newMeta.RenameHistory
+		}
+		if oldMeta.String() != newMeta.String() {
+			diff.Kind = DiffChanged
+			diffs = append(diffs, diff)
+		}
+	}
+	for _, oldNode := range oldNodes {
+		if _, ok := newMap[oldNode.Id]; !ok {
+			namespace, oldPath := getFullPath(oldNode)
+			diffs = append(diffs, NamespaceDiff{Kind: DiffRemoved, FileNodeId: oldNode.Id, Namespace: namespace,
+				OldPath: oldPath})
+		}
+	}
+	return diffs, nil
+}
+
+// linkDirTree links FileNode read by ReadDirTree into directory trees like
+// buildTree, but it neither changes any global index nor repairs duplicate
+// names. It returns all FileNode reachable from roots of namespaces in the order
+// of add2Arr, the default namespace first.
+func linkDirTree(nodeMap map[string]*FileNode) []*FileNode {
+	ids := make([]string, 0, len(nodeMap))
+	for id := range nodeMap {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	roots := make([]*FileNode, 0)
+	for _, id := range ids {
+		node := nodeMap[id]
+		if node.ParentNode != nil && node.ParentNode.Id == common.MinusOneString {
+			roots = append(roots, node)
+		}
+		children := node.ChildNodes
+		if children == nil {
+			continue
+		}
+		node.ChildNodes = make(map[string]*FileNode, len(children))
+		for childId := range children {
+			child, ok := nodeMap[childId]
+			if !ok {
+				continue
+			}
+			name := child.FileName
+			if _, ok := node.ChildNodes[name]; ok {
+				name = util.CombineString(name, deleteDelimiter, child.Id)
+			}
+			node.ChildNodes[name] = child
+			child.ParentNode = node
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		return roots[i].FileName < roots[j].FileName
+	})
+	nodes := make([]*FileNode, 0, len(nodeMap))
+	for _, r := range roots {
+		r.ParentNode = nil
+		r.add2Arr(&nodes)
+	}
+	return nodes
+}
+
+// getParentId gets id of the parent of the FileNode, it is empty for a root.
+func getParentId(fileNode *FileNode) string {
+	if fileNode.ParentNode == nil {
+		return ""
+	}
+	return fileNode.ParentNode.Id
+}
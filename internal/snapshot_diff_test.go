@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"tinydfs-base/util"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		chunksMap = make(map[string]*Chunk)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	_, err := AddFileNode("/", "dir", 0, false)
+	assert.NoError(t, err, "Unexpected error.")
+	renamed, err := AddFileNode("/dir", "a.txt", 1, true)
+	assert.NoError(t, err, "Unexpected error.")
+	removed, err := AddFileNode("/dir", "b.txt", 1, true)
+	assert.NoError(t, err, "Unexpected error.")
+	changed, err := AddFileNode("/", "c.txt", 1, true)
+	assert.NoError(t, err, "Unexpected error.")
+	oldSink := &memorySink{}
+	assert.NoError(t, PersistDirTree(oldSink), "Unexpected error.")
+
+	_, err = RenameFileNode("/dir/a.txt", "d.txt", time.Now())
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = RemoveOperation{Path: "/dir/b.txt", Immediate: true}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	_, err = SetFileNodeMinReadReplicas("/c.txt", 2)
+	assert.NoError(t, err, "Unexpected error.")
+	added, err := AddFileNode("/dir", "e.txt", 1, true)
+	assert.NoError(t, err, "Unexpected error.")
+	newSink := &memorySink{}
+	assert.NoError(t, PersistDirTree(newSink), "Unexpected error.")
+
+	diffs, err := DiffSnapshots(bufio.NewScanner(strings.NewReader(oldSink.String())),
+		bufio.NewScanner(strings.NewReader(newSink.String())))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []NamespaceDiff{
+		{Kind: DiffChanged, FileNodeId: changed.Id, OldPath: "/c.txt", NewPath: "/c.txt"},
+		{Kind: DiffRenamed, FileNodeId: renamed.Id, OldPath: "/dir/a.txt", NewPath: "/dir/d.txt"},
+		{Kind: DiffAdded, FileNodeId: added.Id, NewPath: "/dir/e.txt"},
+		{Kind: DiffRemoved, FileNodeId: removed.Id, OldPath: "/dir/b.txt"},
+	}, diffs, "Unexpected diffs.")
+
+	// Diffing snapshots never touches the directory tree of master.
+	for path, fileNode := range map[string]*FileNode{"/dir/d.txt": renamed, "/c.txt": changed, "/dir/e.txt": added} {
+		_, fullPath := getFullPath(fileNode)
+		assert.Equal(t, path, fullPath, "Directory tree should not be changed.")
+	}
+	assert.Len(t, root.ChildNodes["dir"].ChildNodes, 2, "Directory tree should not be changed.")
+	diffs, err = DiffSnapshots(bufio.NewScanner(strings.NewReader(newSink.String())),
+		bufio.NewScanner(strings.NewReader(newSink.String())))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Empty(t, diffs, "Same snapshot should have no diff.")
+}
+
+func TestDiffSnapshots_OldTombstone(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	fileNode, err := AddFileNode("/", "a.txt", 1, true)
+	assert.NoError(t, err, "Unexpected error.")
+	oldSink := &memorySink{}
+	assert.NoError(t, PersistDirTree(oldSink), "Unexpected error.")
+	// The FileNode has been deleted long before the diff is run, it is still
+	// a deletion rather than a removal from the directory tree.
+	delTime := time.Now().Add(-48 * time.Hour)
+	fileNode.IsDel, fileNode.DelTime = true, &delTime
+	newSink := &memorySink{}
+	assert.NoError(t, PersistDirTree(newSink), "Unexpected error.")
+
+	diffs, err := DiffSnapshots(bufio.NewScanner(strings.NewReader(oldSink.String())),
+		bufio.NewScanner(strings.NewReader(newSink.String())))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []NamespaceDiff{
+		{Kind: DiffChanged, FileNodeId: fileNode.Id, OldPath: "/a.txt", NewPath: "/a.txt"},
+	}, diffs, "Unexpected diffs.")
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/spf13/viper"
+)
+
+// snapshotDirName is the directory under the raft directory where
+// raft.FileSnapshotStore puts snapshots.
+const snapshotDirName = "snapshots"
+
+// SnapshotInfo describes a snapshot kept on disk.
+type SnapshotInfo struct {
+	Id    string
+	Index uint64
+	Term  uint64
+	// Size is the size of the snapshot in bytes.
+	Size       int64
+	CreateTime time.Time
+}
+
+// snapshotStore is a raft.FileSnapshotStore which prunes old snapshots by the
+// configured retention after a snapshot is taken. The embedded store retains
+// every snapshot itself, so only Prune deletes them.
+type snapshotStore struct {
+	*raft.FileSnapshotStore
+	// dir is the directory storing snapshots.
+	dir string
+}
+
+// pruningSnapshotSink prunes old snapshots of the store once the snapshot is
+// written successfully.
+type pruningSnapshotSink struct {
+	raft.SnapshotSink
+	store *snapshotStore
+}
+
+func newSnapshotStore(base string) (*snapshotStore, error) {
+	fss, err := raft.NewFileSnapshotStore(base, math.MaxInt32, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotStore{FileSnapshotStore: fss, dir: filepath.Join(base, snapshotDirName)}, nil
+}
+
+func (s *snapshotStore) Create(version raft.SnapshotVersion, index, term uint64, configuration raft.Configuration,
+	configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+	sink, err := s.FileSnapshotStore.Create(version, index, term, configuration, configurationIndex, trans)
+	if err != nil {
+		return nil, err
+	}
+	return &pruningSnapshotSink{SnapshotSink: sink, store: s}, nil
+}
+
+func (s *pruningSnapshotSink) Close() error {
+	if err := s.SnapshotSink.Close(); err != nil {
+		return err
+	}
+	if _, err := s.store.Prune(time.Now()); err != nil {
+		Logger.Warnf("Fail to prune snapshots, error detail: %s", err.Error())
+	}
+	return nil
+}
+
+// Inventory returns all snapshots kept on disk, the most recent first.
+func (s *snapshotStore) Inventory() ([]SnapshotInfo, error) {
+	metas, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SnapshotInfo, 0, len(metas))
+	for _, meta := range metas {
+		info := SnapshotInfo{Id: meta.ID, Index: meta.Index, Term: meta.Term, Size: meta.Size}
+		if stat, err := os.Stat(filepath.Join(s.dir, meta.ID)); err == nil {
+			info.CreateTime = stat.ModTime()
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Prune deletes snapshots which are neither one of the most recent
+// master.snapshotRetainNum snapshots nor newer than master.snapshotRetainAge
+// seconds. The most recent snapshot is always kept, because logs compacted into
+// it can only be recovered from it. It returns id of deleted snapshots.
+func (s *snapshotStore) Prune(now time.Time) ([]string, error) {
+	retainNum := defaultSnapshotRetainNum
+	if viper.IsSet(MasterSnapshotRetainNum) {
+		retainNum = viper.GetInt(MasterSnapshotRetainNum)
+	}
+	if retainNum < 1 {
+		retainNum = 1
+	}
+	retainAge := time.Duration(viper.GetInt(MasterSnapshotRetainAge)) * time.Second
+	infos, err := s.Inventory()
+	if err != nil {
+		return nil, err
+	}
+	pruned := make([]string, 0)
+	for i, info := range infos {
+		if i < retainNum || (retainAge > 0 && now.Sub(info.CreateTime) < retainAge) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.dir, info.Id)); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, info.Id)
+	}
+	if len(pruned) != 0 {
+		Logger.Infof("Prune snapshots, pruned num: %d, kept num: %d", len(pruned), len(infos)-len(pruned))
+	}
+	return pruned, nil
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotStore_Prune(t *testing.T) {
+	retainNum := viper.GetInt(MasterSnapshotRetainNum)
+	retainAge := viper.GetInt(MasterSnapshotRetainAge)
+	viper.Set(MasterSnapshotRetainNum, 3)
+	viper.Set(MasterSnapshotRetainAge, 0)
+	t.Cleanup(func() {
+		viper.Set(MasterSnapshotRetainNum, retainNum)
+		viper.Set(MasterSnapshotRetainAge, retainAge)
+	})
+	store, err := newSnapshotStore(t.TempDir())
+	assert.NoError(t, err, "Unexpected error.")
+	for index := uint64(1); index <= 5; index++ {
+		sink, err := store.Create(raft.SnapshotVersionMax, index, 1, raft.Configuration{}, 0, nil)
+		assert.NoError(t, err, "Unexpected error.")
+		_, err = sink.Write([]byte("metadata"))
+		assert.NoError(t, err, "Unexpected error.")
+		assert.NoError(t, sink.Close(), "Unexpected error.")
+	}
+	infos, err := store.Inventory()
+	assert.NoError(t, err, "Unexpected error.")
+	indexes := make([]uint64, len(infos))
+	for i, info := range infos {
+		indexes[i] = info.Index
+	}
+	assert.Equal(t, []uint64{5, 4, 3}, indexes, "Only the most recent snapshots should be kept.")
+	assert.Equal(t, int64(len("metadata")), infos[0].Size, "Unexpected snapshot size.")
+
+	// Snapshots newer than the retain age are kept beyond the retain num, but
+	// the most recent one is kept whatever the config is.
+	viper.Set(MasterSnapshotRetainNum, 0)
+	viper.Set(MasterSnapshotRetainAge, 3600)
+	pruned, err := store.Prune(time.Now())
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Empty(t, pruned, "Snapshots within retain age should be kept.")
+	pruned, err = store.Prune(time.Now().Add(2 * time.Hour))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []string{infos[1].Id, infos[2].Id}, pruned, "Unexpected pruned snapshots.")
+	infos, err = store.Inventory()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 1, len(infos), "The most recent snapshot should be kept.")
+	assert.Equal(t, uint64(5), infos[0].Index, "Unexpected kept snapshot.")
+}
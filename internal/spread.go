@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
+	"tinydfs-base/common"
+)
+
+// blockFullDomains blocks DataNode whose failure domain already has
+// maxPerDomain replicas of the Chunk, including replicas which are being sent.
+// Unlike the distance term of allocateCost, it may block all DataNode, because
+// spreading is an invariant of the file rather than a preference.
+func blockFullDomains(isBlocked []bool, isStore []bool, dataNodes []*DataNode, topologyKeys []string,
+	maxPerDomain int) {
+	domainCount := make(map[string]int)
+	for k, holder := range dataNodes {
+		if isStore[k] && holder != nil {
+			domainCount[getFailureDomain(holder.Tags, topologyKeys)]++
+		}
+	}
+	for j, dataNode := range dataNodes {
+		if !isBlocked[j] && domainCount[getFailureDomain(dataNode.Tags, topologyKeys)] >= maxPerDomain {
+			isBlocked[j] = true
+		}
+	}
+}
+
+// limitReplicasPerDomain drops allocated DataNode of each Chunk which would put
+// more than maxPerDomain replicas in a failure domain. The dropped replicas are
+// not replaced here, they are re-replicated later under the same limit as other
+// missing replicas.
+func limitReplicasPerDomain(allocated [][]*DataNode, maxPerDomain int) [][]*DataNode {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	if maxPerDomain == 0 || len(topologyKeys) == 0 {
+		return allocated
+	}
+	res := make([][]*DataNode, len(allocated))
+	for i, dataNodes := range allocated {
+		domainCount := make(map[string]int)
+		res[i] = make([]*DataNode, 0, len(dataNodes))
+		for _, dataNode := range dataNodes {
+			domain := getFailureDomain(dataNode.Tags, topologyKeys)
+			if domainCount[domain] >= maxPerDomain {
+				Logger.Warnf("Drop allocated datanode exceeding max replicas per domain, chunk index: %d, "+
+					"datanode id: %s, domain: %s", i, dataNode.Id, domain)
+				continue
+			}
+			domainCount[domain]++
+			res[i] = append(res[i], dataNode)
+		}
+	}
+	return res
+}
+
+// spreadWriteReplicas makes the allocated DataNode of each Chunk of a new file
+// span at least minDomains failure domains of the widest topology key, see
+// master.writeQuorumDomains. A replica in the most crowded domain is replaced by
+// the least used alive DataNode of a domain without replica, or such a DataNode
+// is added if the Chunk has fewer replicas than replicaNum. Unlike
+// AuditChunkSpread which repairs the spread later, it fails if the topology can
+// not satisfy it, so that the write is rejected rather than acknowledged with
+// all replicas in fewer domains.
+func spreadWriteReplicas(allocated [][]*DataNode, constraint PlacementConstraint,
+	minDomains int, replicaNum int) ([][]*DataNode, error) {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	if len(topologyKeys) == 0 {
+		return nil, fmt.Errorf("write quorum placement needs a topology key, write quorum domains: %d",
+			minDomains)
+	}
+	domainKeys := topologyKeys[:1]
+	if replicaNum < minDomains {
+		return nil, fmt.Errorf("replicas can not span more domains than replica num, replica num: %d, "+
+			"write quorum domains: %d", replicaNum, minDomains)
+	}
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	candidates := make([]*DataNode, 0, len(dataNodeMap))
+	for _, node := range dataNodeMap {
+		if node.Status == common.Alive && constraint.Match(node.Tags) {
+			candidates = append(candidates, node)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Id < candidates[j].Id
+	})
+	// processMap contains how many bytes have been directed to each DataNode
+	// by spreading in this request.
+	processMap := make(map[*DataNode]int)
+	res := make([][]*DataNode, len(allocated))
+	for i, dataNodes := range allocated {
+		chosen := append(make([]*DataNode, 0, len(dataNodes)), dataNodes...)
+		for {
+			domainCount := make(map[string]int)
+			for _, dataNode := range chosen {
+				domainCount[getFailureDomain(dataNode.Tags, domainKeys)]++
+			}
+			if len(domainCount) >= minDomains {
+				break
+			}
+			var target *DataNode
+			for _, node := range candidates {
+				if domainCount[getFailureDomain(node.Tags, domainKeys)] != 0 {
+					continue
+				}
+				if target == nil || node.CalUsage(processMap[node]) < target.CalUsage(processMap[target]) {
+					target = node
+				}
+			}
+			if target == nil {
+				return nil, fmt.Errorf("replicas can not span enough domains, chunk index: %d, key: %s, "+
+					"domain num: %d, write quorum domains: %d", i, domainKeys[0], len(domainCount), minDomains)
+			}
+			processMap[target] += common.ChunkSize
+			if len(chosen) < replicaNum {
+				chosen = append(chosen, target)
+				continue
+			}
+			// Replace the last replica of the most crowded domain.
+			replaced := -1
+			for k, dataNode := range chosen {
+				if replaced == -1 || domainCount[getFailureDomain(dataNode.Tags, domainKeys)] >=
+					domainCount[getFailureDomain(chosen[replaced].Tags, domainKeys)] {
+					replaced = k
+				}
+			}
+			Logger.Infof("Replace replica to span domains, chunk index: %d, datanode id: %s, target: %s", i,
+				chosen[replaced].Id, target.Id)
+			chosen[replaced] = target
+		}
+		res[i] = chosen
+	}
+	return res, nil
+}
+
+// AuditChunkSpread checks all Chunk of files with a MaxReplicasPerDomain and
+// schedules a move for each replica which makes its failure domain exceed the
+// limit. The replica is moved to the alive DataNode with the fewest Chunk in a
+// failure domain which is still under the limit. Violations without such a
+// DataNode are only flagged and will be audited again next time. It returns the
+// number of moves scheduled.
+func AuditChunkSpread() int {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	if len(topologyKeys) == 0 {
+		return 0
+	}
+	limits := make(map[string]int)
+	updateConstraintLock.RLock()
+	for _, fileNode := range spreadFileNodes {
+		for _, chunkId := range fileNode.Chunks {
+			limits[chunkId] = fileNode.MaxReplicasPerDomain
+		}
+	}
+	updateConstraintLock.RUnlock()
+	chunkIds := make([]string, 0, len(limits))
+	for chunkId := range limits {
+		chunkIds = append(chunkIds, chunkId)
+	}
+	sort.Strings(chunkIds)
+	updateMapLock.Lock()
+	defer updateMapLock.Unlock()
+	updateChunksLock.Lock()
+	defer updateChunksLock.Unlock()
+	scheduled := 0
+	for _, chunkId := range chunkIds {
+		chunk, ok := chunksMap[chunkId]
+		if !ok || chunk.codingScheme.IsErasureCoded() {
+			continue
+		}
+		scheduled += auditChunkSpread(chunk, limits[chunkId], topologyKeys)
+	}
+	if scheduled != 0 {
+		Logger.Infof("Schedule moves to repair chunk spread, move num: %d", scheduled)
+	}
+	return scheduled
+}
+
+// auditChunkSpread schedules moves for replicas of the Chunk which exceed
+// maxPerDomain. Replicas being moved away are not counted in their failure
+// domain, while replicas being sent are counted in the failure domain of their
+// target. The caller must hold updateMapLock and updateChunksLock.
+func auditChunkSpread(chunk *Chunk, maxPerDomain int, topologyKeys []string) int {
+	constraint := getPlacementConstraint(chunk.Id)
+	domainCount := make(map[string]int)
+	holders := make([]*DataNode, 0, chunk.dataNodes.Cardinality())
+	for _, id := range set2SortedStrings(chunk.dataNodes) {
+		dataNode, ok := dataNodeMap[id]
+		if !ok || isMovingChunk(dataNode, chunk.Id) {
+			continue
+		}
+		domainCount[getFailureDomain(dataNode.Tags, topologyKeys)]++
+		holders = append(holders, dataNode)
+	}
+	for _, id := range chunk.pendingDataNodes.ToSlice() {
+		if dataNode, ok := dataNodeMap[id.(string)]; ok {
+			domainCount[getFailureDomain(dataNode.Tags, topologyKeys)]++
+		}
+	}
+	scheduled := 0
+	for _, source := range holders {
+		sourceDomain := getFailureDomain(source.Tags, topologyKeys)
+		if domainCount[sourceDomain] <= maxPerDomain || chunk.isPinnedOn(source.Id) ||
+			source.Status != common.Alive {
+			continue
+		}
+		var target *DataNode
+		for _, node := range dataNodeMap {
+			if node.Status != common.Alive || chunk.dataNodes.Contains(node.Id) ||
+				chunk.pendingDataNodes.Contains(node.Id) || chunk.isQuarantinedOn(node.Id) ||
+				!constraint.Match(node.Tags) ||
+				domainCount[getFailureDomain(node.Tags, topologyKeys)] >= maxPerDomain {
+				continue
+			}
+			if target == nil || node.Chunks.Cardinality() < target.Chunks.Cardinality() ||
+				(node.Chunks.Cardinality() == target.Chunks.Cardinality() && node.Id < target.Id) {
+				target = node
+			}
+		}
+		if target == nil {
+			Logger.Warnf("Chunk violates max replicas per domain but no datanode can receive it, chunk id: %s, "+
+				"datanode id: %s, domain: %s", chunk.Id, source.Id, sourceDomain)
+			chunkSpreadViolationCountMonitor.WithLabelValues(spreadNoTarget).Inc()
+			continue
+		}
+		source.FutureSendChunks[ChunkSendInfo{
+			ChunkId:    chunk.Id,
+			DataNodeId: target.Id,
+			SendType:   common.MoveSendType,
+		}] = common.WaitToInform
+		chunk.pendingDataNodes.Add(target.Id)
+		domainCount[sourceDomain]--
+		domainCount[getFailureDomain(target.Tags, topologyKeys)]++
+		Logger.Infof("Move chunk to repair its spread, chunk id: %s, source: %s, target: %s", chunk.Id,
+			source.Id, target.Id)
+		chunkSpreadViolationCountMonitor.WithLabelValues(spreadMoveScheduled).Inc()
+		scheduled++
+	}
+	return scheduled
+}
+
+// isMovingChunk checks whether the DataNode has been told to move the Chunk
+// away.
+func isMovingChunk(dataNode *DataNode, chunkId string) bool {
+	for info := range dataNode.FutureSendChunks {
+		if info.ChunkId == chunkId && info.SendType == common.MoveSendType {
+			return true
+		}
+	}
+	return false
+}
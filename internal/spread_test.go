@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	set "github.com/deckarep/golang-set"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"tinydfs-base/common"
+	"tinydfs-base/protocol/pb"
+	"tinydfs-base/util"
+)
+
+func TestAuditChunkSpread(t *testing.T) {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	viper.Set(MasterTopologyKeys, []string{"rack"})
+	t.Cleanup(func() {
+		viper.Set(MasterTopologyKeys, topologyKeys)
+		root.ChildNodes = map[string]*FileNode{}
+		spreadFileNodes = make(map[string]*FileNode)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+		pendingChunkQueue = util.NewQueue[String]()
+	})
+	file, err := AddFileNode("/", "critical.txt", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	err = newLeaderHandler(t).SetMaxPerDomain(context.Background(), "", "/critical.txt", 1)
+	assert.NoError(t, err, "Unexpected error.")
+	restored, err := ReadDirTree(bufio.NewScanner(strings.NewReader(file.String() + common.SnapshotDelimiter)))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 1, restored[file.Id].MaxReplicasPerDomain, "Policy should be persisted.")
+
+	chunkId := file.Chunks[0]
+	for id, rack := range map[string]string{"dataNode1": "rack1", "dataNode2": "rack1", "dataNode3": "rack2",
+		"dataNode4": "rack3", "dataNode5": "rack1"} {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Tags: map[string]string{"rack": rack},
+			Chunks: set.NewSet(), FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+	// The allocator never puts two replicas in the same rack.
+	allocated := limitReplicasPerDomain([][]*DataNode{{dataNodeMap["dataNode1"], dataNodeMap["dataNode2"],
+		dataNodeMap["dataNode3"]}}, getFileNodeMaxReplicasPerDomain(file.Id))
+	assert.Equal(t, []*DataNode{dataNodeMap["dataNode1"], dataNodeMap["dataNode3"]}, allocated[0],
+		"Replica exceeding the limit should be dropped.")
+
+	// Inject a violation: two replicas are placed in rack1.
+	for _, id := range []string{"dataNode1", "dataNode2", "dataNode3"} {
+		dataNodeMap[id].Chunks.Add(chunkId)
+	}
+	chunksMap[chunkId] = &Chunk{Id: chunkId, dataNodes: set.NewSet("dataNode1", "dataNode2", "dataNode3"),
+		pendingDataNodes: set.NewSet()}
+	assert.Equal(t, 1, AuditChunkSpread(), "Unexpected move num.")
+	moveInfo := ChunkSendInfo{ChunkId: chunkId, DataNodeId: "dataNode4", SendType: common.MoveSendType}
+	assert.Equal(t, common.WaitToInform, dataNodeMap["dataNode1"].FutureSendChunks[moveInfo],
+		"Excess replica should be moved to the rack without replica.")
+	assert.Equal(t, 0, AuditChunkSpread(), "Scheduled move should not be scheduled again.")
+
+	// The move is done, so the spread is repaired.
+	_, err = HeartbeatOperation{DataNodeId: "dataNode1", SuccessInfos: []ChunkSendInfo{moveInfo}}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []string{"dataNode2", "dataNode3", "dataNode4"}, set2SortedStrings(chunksMap[chunkId].dataNodes),
+		"Unexpected data nodes.")
+	assert.Equal(t, 0, AuditChunkSpread(), "Repaired chunk should not be moved.")
+
+	// Re-replication never picks a rack which already has a replica.
+	dataNodeIds := []string{"dataNode1", "dataNode2", "dataNode3", "dataNode4", "dataNode5"}
+	isBlocked := getBlockedState([]string{chunkId}, dataNodeIds, getStoreState([]string{chunkId}, dataNodeIds))
+	assert.Equal(t, []bool{true, true, true, true, true}, isBlocked[0], "Full racks should be blocked.")
+}
+
+func TestSpreadWriteReplicas(t *testing.T) {
+	topologyKeys := viper.GetStringSlice(MasterTopologyKeys)
+	replicaNum := viper.GetInt(common.ReplicaNum)
+	viper.Set(MasterTopologyKeys, []string{"zone", "rack"})
+	viper.Set(common.ReplicaNum, 3)
+	viper.Set(MasterWriteQuorumDomains, 2)
+	t.Cleanup(func() {
+		viper.Set(MasterTopologyKeys, topologyKeys)
+		viper.Set(common.ReplicaNum, replicaNum)
+		viper.Set(MasterWriteQuorumDomains, 0)
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	addDataNode := func(id string, zone string, usedCapacity int) {
+		dataNodeMap[id] = &DataNode{Id: id, Status: common.Alive, Tags: map[string]string{"zone": zone, "rack": id},
+			Chunks: set.NewSet(), UsedCapacity: usedCapacity, FullCapacity: 100 * common.ChunkSize,
+			FutureSendChunks: make(map[ChunkSendInfo]int)}
+	}
+
+	// A single-zone cluster can not satisfy the write quorum placement.
+	for _, id := range []string{"dataNode1", "dataNode2", "dataNode3"} {
+		addDataNode(id, "zone1", 0)
+	}
+	indexTestFile(t, "file1", 1)
+	indexTestFile(t, "file2", 2)
+	_, err := AddOperation{FileNodeId: "file1", ChunkNum: 1, MinAckNum: 1, Stage: common.GetDataNodes}.Apply()
+	assert.Error(t, err, "Write should be rejected.")
+	_, ok := chunksMap["file1_0"]
+	assert.False(t, ok, "Rejected write should not add chunk.")
+
+	// The most used DataNode of a two-zone cluster is the only one in zone2, so
+	// it is not allocated unless the replicas are spread.
+	addDataNode("dataNode4", "zone2", 50*common.ChunkSize)
+	reply, err := AddOperation{FileNodeId: "file2", ChunkNum: 2, MinAckNum: 1, Stage: common.GetDataNodes}.Apply()
+	assert.NoError(t, err, "Unexpected error.")
+	for i, ids := range reply.(*pb.GetDataNodes4AddReply).DataNodeIds {
+		assert.Len(t, ids.Items, 3, "Unexpected replica num.")
+		assert.Contains(t, ids.Items, "dataNode4", "Replicas should span both zones.")
+		chunk := chunksMap[util.CombineString("file2", common.ChunkIdDelimiter, strconv.Itoa(i))]
+		assert.Equal(t, 3, chunk.minAckNum, "Write should wait for all replicas.")
+	}
+}
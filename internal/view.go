@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"tinydfs-base/common"
+	"tinydfs-base/util"
+)
+
+// ReadView is a read-only view of the directory trees and Chunk locations frozen
+// at the moment it is opened. It holds its own copy of metadata, so a long scan
+// on it will neither see nor block later mutations.
+type ReadView struct {
+	// Index is the index of the last Raft log applied when the view is opened.
+	Index uint64
+	// roots stores the copied roots of all namespaces, using namespace name as
+	// the key. The key of the default namespace is rootFileName.
+	roots map[string]*FileNode
+	// chunks stores id of all DataNode storing each Chunk, using Chunk id as key.
+	chunks map[string][]string
+	// dataNodes stores the copied state of each DataNode used to locate Chunk.
+	dataNodes map[string]dataNodeView
+}
+
+// dataNodeView is the state of a DataNode copied into a ReadView.
+type dataNodeView struct {
+	Address string
+	Status  int
+	IOLoad  int
+}
+
+// ChunkLocation includes all alive DataNode storing a Chunk, sorted by IOLoad.
+type ChunkLocation struct {
+	ChunkId       string
+	DataNodeIds   []string
+	DataNodeAddrs []string
+	// ReadUnsafe is true if the number of alive replicas is below the
+	// MinReadReplicas of the file, which means the data is at risk.
+	ReadUnsafe bool
+}
+
+// BeginReadView opens a ReadView of current metadata. The directory trees,
+// DataNode and Chunk are copied in a single critical section of their own locks
+// rather than applyLock, so opening a view does not block applying logs. All
+// reads in the view see at least all mutations up to the log of ReadView.Index.
+func BeginReadView() *ReadView {
+	view := &ReadView{Index: getLastAppliedIndex()}
+	createFileNodeLock.Lock()
+	defer createFileNodeLock.Unlock()
+	updateMapLock.RLock()
+	defer updateMapLock.RUnlock()
+	updateChunksLock.RLock()
+	defer updateChunksLock.RUnlock()
+	view.roots = map[string]*FileNode{rootFileName: copyFileNode(root, nil)}
+	for namespace, nsRoot := range namespaceRoots {
+		view.roots[namespace] = copyFileNode(nsRoot, nil)
+	}
+	view.dataNodes = make(map[string]dataNodeView, len(dataNodeMap))
+	for id, dataNode := range dataNodeMap {
+		view.dataNodes[id] = dataNodeView{
+			Address: dataNode.Address,
+			Status:  dataNode.Status,
+			IOLoad:  dataNode.IOLoad,
+		}
+	}
+	view.chunks = make(map[string][]string, len(chunksMap))
+	for id, chunk := range chunksMap {
+		view.chunks[id] = util.Interfaces2TypeArr[string](chunk.dataNodes.ToSlice())
+	}
+	return view
+}
+
+// copyFileNode deeply copies the subtree rooted at the given FileNode.
+func copyFileNode(fileNode *FileNode, parent *FileNode) *FileNode {
+	newNode := fileNode.copyMeta()
+	newNode.ParentNode = parent
+	if fileNode.ChildNodes != nil {
+		newNode.ChildNodes = make(map[string]*FileNode, len(fileNode.ChildNodes))
+		for name, child := range fileNode.ChildNodes {
+			newNode.ChildNodes[name] = copyFileNode(child, newNode)
+		}
+	}
+	return newNode
+}
+
+// Stat gets the FileNode of the given path in the default namespace.
+func (v *ReadView) Stat(path string) (*FileNode, error) {
+	return v.StatIn(rootFileName, path)
+}
+
+// StatIn gets the FileNode of the given path in the given namespace.
+func (v *ReadView) StatIn(namespace string, path string) (*FileNode, error) {
+	nsRoot, ok := v.roots[namespace]
+	if !ok {
+		return nil, fmt.Errorf("namespace not exist, namespace : %s", namespace)
+	}
+	return checkAndGetFileNode(nsRoot, path)
+}
+
+// List gets all FileNode under the given directory in the default namespace.
+func (v *ReadView) List(path string) ([]*FileNode, error) {
+	return v.ListIn(rootFileName, path)
+}
+
+// ListIn gets all FileNode under the given directory in the given namespace.
+// Deleted FileNode are not included.
+func (v *ReadView) ListIn(namespace string, path string) ([]*FileNode, error) {
+	nsRoot, ok := v.roots[namespace]
+	if !ok {
+		return nil, fmt.Errorf("namespace not exist, namespace : %s", namespace)
+	}
+	return listFileNode(nsRoot, path, false)
+}
+
+// GetFileLocations gets the location of all Chunk of the given file in the
+// default namespace.
+func (v *ReadView) GetFileLocations(path string) ([]ChunkLocation, error) {
+	return v.GetFileLocationsIn(rootFileName, path)
+}
+
+// GetFileLocationsIn gets the location of all Chunk of the given file in the
+// given namespace.
+func (v *ReadView) GetFileLocationsIn(namespace string, path string) ([]ChunkLocation, error) {
+	fileNode, err := v.StatIn(namespace, path)
+	if err != nil {
+		return nil, err
+	}
+	if !fileNode.IsFile {
+		return nil, fmt.Errorf("path is not a file, path : %s", path)
+	}
+	locations := make([]ChunkLocation, len(fileNode.Chunks))
+	for i := range fileNode.Chunks {
+		chunkId := util.CombineString(fileNode.Id, common.ChunkIdDelimiter, strconv.Itoa(i))
+		locations[i] = v.getChunkLocation(chunkId)
+		locations[i].ReadUnsafe = len(locations[i].DataNodeIds) < fileNode.MinReadReplicas
+	}
+	return locations, nil
+}
+
+// getChunkLocation gets all alive DataNode storing the Chunk, sorted by IOLoad
+// in the same way as GetSortedDataNodeIds.
+func (v *ReadView) getChunkLocation(chunkId string) ChunkLocation {
+	ids := make([]string, 0)
+	for _, id := range v.chunks[chunkId] {
+		if dataNode, ok := v.dataNodes[id]; ok && dataNode.Status == common.Alive {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	sort.SliceStable(ids, func(i, j int) bool {
+		return v.dataNodes[ids[i]].IOLoad < v.dataNodes[ids[j]].IOLoad
+	})
+	location := ChunkLocation{
+		ChunkId:       chunkId,
+		DataNodeIds:   ids,
+		DataNodeAddrs: make([]string, len(ids)),
+	}
+	for i, id := range ids {
+		location.DataNodeAddrs[i] = v.dataNodes[id].Address
+	}
+	return location
+}
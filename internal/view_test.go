@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	set "github.com/deckarep/golang-set"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+	"tinydfs-base/common"
+)
+
+func TestBeginReadView(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	root.ChildNodes = map[string]*FileNode{}
+	fsm := MasterFSM{}
+	apply := func(index uint64, operation Operation, opType string) {
+		response := fsm.Apply(&raft.Log{Index: index, Data: getData4Apply(operation, opType)}).(*ApplyResponse)
+		assert.NoError(t, response.Error, "Unexpected error.")
+	}
+	apply(1, &MkdirOperation{Path: "/", FileName: "a"}, common.OperationMkdir)
+	fileNode, err := AddFileNode("/a", "b.txt", common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	chunkId := fileNode.Id + common.ChunkIdDelimiter + "0"
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Address: "address1", Status: common.Alive}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Address: "address2", Status: common.Alive}
+	chunksMap[chunkId] = &Chunk{Id: chunkId, dataNodes: set.NewSet("dataNode1"), pendingDataNodes: set.NewSet()}
+
+	view := BeginReadView()
+	assert.Equal(t, uint64(1), view.Index, "Unexpected index.")
+
+	// Mutate the namespace and chunks after the view is opened.
+	apply(2, &MkdirOperation{Path: "/a", FileName: "c"}, common.OperationMkdir)
+	apply(3, &RemoveOperation{Path: "/a/b.txt"}, common.OperationRemove)
+	UpdateChunk4Heartbeat(HeartbeatOperation{
+		SuccessInfos: []ChunkSendInfo{{ChunkId: chunkId, DataNodeId: "dataNode2"}},
+	})
+	_, ok := getFileNode("/a/b.txt")
+	assert.False(t, ok, "File should be removed from the live tree.")
+
+	fileNodes, err := view.List("/a")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 1, len(fileNodes), "View should not observe the new directory.")
+	assert.Equal(t, "b.txt", fileNodes[0].FileName, "Unexpected file.")
+	stat, err := view.Stat("/a/b.txt")
+	assert.NoError(t, err, "View should not observe the removal.")
+	assert.False(t, stat.IsDel, "View should not observe the removal.")
+	locations, err := view.GetFileLocations("/a/b.txt")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, []ChunkLocation{{
+		ChunkId:       chunkId,
+		DataNodeIds:   []string{"dataNode1"},
+		DataNodeAddrs: []string{"address1"},
+	}}, locations, "View should not observe the new replica.")
+	assert.Equal(t, uint64(1), view.Index, "Index of view should not change.")
+}
+
+func TestReadView_ReadUnsafe(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+		chunksMap = make(map[string]*Chunk)
+		dataNodeMap = make(map[string]*DataNode)
+	})
+	handler := newLeaderHandler(t)
+	fileNode, err := AddFileNode("/", "a.txt", 2*common.ChunkSize, true)
+	assert.NoError(t, err, "Unexpected error.")
+	assert.NoError(t, handler.SetReadFloor(context.Background(), "", "/a.txt", 2), "Unexpected error.")
+	dataNodeMap["dataNode1"] = &DataNode{Id: "dataNode1", Address: "address1", Status: common.Alive}
+	dataNodeMap["dataNode2"] = &DataNode{Id: "dataNode2", Address: "address2", Status: common.Alive}
+	dataNodeMap["dataNode3"] = &DataNode{Id: "dataNode3", Address: "address3", Status: common.Waiting}
+	chunkIds := []string{fileNode.Id + common.ChunkIdDelimiter + "0", fileNode.Id + common.ChunkIdDelimiter + "1"}
+	chunksMap[chunkIds[0]] = &Chunk{Id: chunkIds[0], dataNodes: set.NewSet("dataNode1", "dataNode2"),
+		pendingDataNodes: set.NewSet()}
+	// Only one replica of the second Chunk is alive.
+	chunksMap[chunkIds[1]] = &Chunk{Id: chunkIds[1], dataNodes: set.NewSet("dataNode1", "dataNode3"),
+		pendingDataNodes: set.NewSet()}
+
+	locations, err := handler.GetFileLocations(context.Background(), "/a.txt")
+	assert.NoError(t, err, "Unexpected error.")
+	assert.False(t, locations[0].ReadUnsafe, "Chunk with enough replicas should be safe.")
+	assert.True(t, locations[1].ReadUnsafe, "Chunk below the floor should be unsafe.")
+	assert.Equal(t, []string{"dataNode1"}, locations[1].DataNodeIds, "Locations should still be returned.")
+
+	_, err = SetFileNodeMinReadReplicas("/", 1)
+	assert.Error(t, err, "Floor can only be set on a file.")
+
+	// The floor is persisted.
+	nodes, err := ReadDirTree(bufio.NewScanner(strings.NewReader(fileNode.String() + common.SnapshotDelimiter)))
+	assert.NoError(t, err, "Unexpected error.")
+	assert.Equal(t, 2, nodes[fileNode.Id].MinReadReplicas, "Unexpected min read replicas.")
+}
+
+func TestBeginReadView_NotBlockedByApply(t *testing.T) {
+	t.Cleanup(func() {
+		root.ChildNodes = map[string]*FileNode{}
+	})
+	_, err := AddFileNode("/", "a", common.DirSize, false)
+	assert.NoError(t, err, "Unexpected error.")
+	// Opening a view while a log is being applied must not wait for it.
+	applyLock.Lock()
+	defer applyLock.Unlock()
+	done := make(chan *ReadView)
+	go func() {
+		done <- BeginReadView()
+	}()
+	select {
+	case view := <-done:
+		_, err = view.Stat("/a")
+		assert.NoError(t, err, "Unexpected error.")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Opening a read view is blocked by applying a log.")
+	}
+}